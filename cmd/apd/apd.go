@@ -0,0 +1,322 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary apd keeps an inventory of the Wi-Fi access points in the LAN (with
+// their clients, where supported), pushes the Wi-Fi networks of
+// /perm/accesspoints.json to the managed access points and serves the LAN
+// topology (which device is behind which switch or access point).
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+
+	"github.com/rtr7/router7/internal/accesspoint"
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/topology"
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	perm   = flag.String("perm", "/perm", "path to replace /perm")
+	ifname = flag.String("interface", "lan0", "LAN interface (listen for LLDP announcements, bridge forwarding database, neighbors)")
+)
+
+var topologyTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<head>
+<meta charset="utf-8">
+<title>LAN topology</title>
+<style type="text/css">
+body {
+  margin-left: 1em;
+}
+ul {
+  list-style: none;
+  border-left: 1px solid grey;
+  padding-left: 1.5em;
+}
+span.kind {
+  min-width: 4em;
+  display: inline-block;
+  text-align: center;
+  border: 1px solid grey;
+  border-radius: 5px;
+  margin-right: .5em;
+}
+span.router, span.port {
+  background-color: #ddd;
+}
+span.switch {
+  background-color: #9cf;
+}
+span.ap {
+  background-color: orange;
+}
+.hwaddr, .addr {
+  font-family: monospace;
+}
+</style>
+</head>
+<body>
+{{ define "node" }}
+<li>
+<span class="kind {{ .Kind }}">{{ .Kind }}</span>
+{{ .Name }}
+{{ if (and (ne .Kind "router") (ne .Kind "port")) }}<span class="hwaddr">{{ .ID }}</span>{{ end }}
+{{ range .Addrs }}<span class="addr">{{ . }}</span> {{ end }}
+{{ if .Children }}
+<ul>
+{{ range .Children }}{{ template "node" . }}{{ end }}
+</ul>
+{{ end }}
+</li>
+{{ end }}
+<ul>
+{{ template "node" . }}
+</ul>
+</body>
+</html>
+`))
+
+var httpListeners = multilisten.NewPool()
+
+func updateListeners() error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8073"),
+			Handler: profiling.Handler(freeze.Guard(*perm, http.DefaultServeMux)),
+		}
+	})
+	return nil
+}
+
+// frozen reports whether the configuration is frozen, in which case apd does
+// not push to the access points on its own.
+func frozen() bool {
+	st, err := freeze.Read(*perm, time.Now())
+	if err != nil {
+		log.Printf("freeze: %v", err)
+		return false
+	}
+	if st != nil {
+		log.Printf("configuration frozen (%s), not pushing to access points", st.Reason)
+	}
+	return st != nil
+}
+
+// readConfig returns the configuration of accesspoints.json, which is
+// optional: access points are discovered without it.
+func readConfig() (accesspoint.Config, error) {
+	cfg, err := accesspoint.ReadConfig(*perm)
+	if err != nil && os.IsNotExist(err) {
+		return accesspoint.Config{}, nil
+	}
+	return cfg, err
+}
+
+func listenLLDP(inv *accesspoint.Inventory) {
+	f, err := accesspoint.ListenLLDP(*ifname)
+	if err != nil {
+		log.Printf("LLDP: %v", err)
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, 1514)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			log.Printf("LLDP: %v", err)
+			return
+		}
+		neighbor, err := accesspoint.ParseLLDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		inv.ObserveLLDP(neighbor, time.Now())
+	}
+}
+
+func logic() error {
+	inv, err := accesspoint.LoadInventory(*perm)
+	if err != nil {
+		return err
+	}
+	var (
+		mu     sync.Mutex
+		cfg    accesspoint.Config
+		pushed accesspoint.Config
+	)
+	push := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := accesspoint.Push(cfg); err != nil {
+			return err
+		}
+		pushed = cfg
+		return nil
+	}
+	refresh := func() {
+		leases, err := accesspoint.ReadLeases(*perm)
+		if err != nil {
+			log.Printf("ReadLeases: %v", err)
+		}
+		now := time.Now()
+		inv.UpdateLeases(leases, now)
+		mu.Lock()
+		c := cfg
+		mu.Unlock()
+		inv.Refresh(c, now)
+	}
+
+	if cfg, err = readConfig(); err != nil {
+		return err
+	}
+	if !frozen() {
+		if err := push(); err != nil {
+			log.Print(err)
+		}
+	}
+	go listenLLDP(inv)
+	go func() {
+		for i := 0; ; i++ {
+			refresh()
+			if i%10 == 0 {
+				if err := inv.Persist(); err != nil {
+					log.Printf("Persist: %v", err)
+				}
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	http.HandleFunc("/aps.json", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(inv.List())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	computeTopology := func() (topology.Graph, error) {
+		fdb, addrs, err := topology.Gather(*ifname)
+		if err != nil {
+			return topology.Graph{}, err
+		}
+		leases, err := accesspoint.ReadLeases(*perm)
+		if err != nil {
+			return topology.Graph{}, err
+		}
+		hostname, _ := os.Hostname()
+		return topology.Compute(topology.Input{
+			Router:       hostname,
+			FDB:          fdb,
+			Addrs:        addrs,
+			LLDP:         inv.Neighbors(),
+			Leases:       leases,
+			AccessPoints: inv.List(),
+		}, time.Now()), nil
+	}
+	http.HandleFunc("/topology.json", func(w http.ResponseWriter, r *http.Request) {
+		g, err := computeTopology()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(g)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	http.HandleFunc("/topology", func(w http.ResponseWriter, r *http.Request) {
+		g, err := computeTopology()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := topologyTmpl.Execute(w, g.Tree()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+	http.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := push(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	})
+
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		newCfg, err := readConfig()
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			continue
+		}
+		mu.Lock()
+		cfg = newCfg
+		changed := !reflect.DeepEqual(cfg, pushed)
+		mu.Unlock()
+		// netconfigd notifies apd after every Apply, so only push changes.
+		// Changes made during a freeze are pushed with the first
+		// notification after the freeze ended.
+		if changed && !frozen() {
+			if err := push(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
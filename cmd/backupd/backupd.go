@@ -26,6 +26,7 @@ import (
 
 	"github.com/rtr7/router7/internal/backup"
 	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
 	"github.com/rtr7/router7/internal/teelogger"
 )
 
@@ -40,7 +41,10 @@ func updateListeners() error {
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8077")}
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8077"),
+			Handler: profiling.Handler(http.DefaultServeMux),
+		}
 	})
 	return nil
 }
@@ -0,0 +1,201 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary bgpd announces the delegated IPv6 prefix to the BGP peers of
+// /perm/bgp.json (e.g. the core router of a home lab) and installs the routes
+// it learns from them with route protocol bgp.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/bgp"
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+// delegatedPrefixes returns the prefixes of the DHCPv6 lease.
+func delegatedPrefixes() ([]*net.IPNet, error) {
+	b, err := ioutil.ReadFile(filepath.Join(*perm, "dhcp6/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg dhcp6.Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	prefixes := make([]*net.IPNet, len(cfg.Prefixes))
+	for i := range cfg.Prefixes {
+		prefixes[i] = &cfg.Prefixes[i]
+	}
+	return prefixes, nil
+}
+
+func bgpRoute(r bgp.Route) (*netlink.Route, error) {
+	route := &netlink.Route{
+		Dst:      r.Prefix,
+		Gw:       r.NextHop,
+		Protocol: unix.RTPROT_BGP,
+	}
+	if r.Prefix.IP.To4() == nil {
+		route.Priority = 1024 // default metric of the kernel
+	}
+	if r.NextHop.IsLinkLocalUnicast() {
+		// Link-local next hops need an interface: use the interface via
+		// which the peer is reachable.
+		routes, err := netlink.RouteGet(net.ParseIP(r.Peer))
+		if err != nil {
+			return nil, err
+		}
+		if len(routes) == 0 {
+			return nil, syscall.ENETUNREACH
+		}
+		route.LinkIndex = routes[0].LinkIndex
+	}
+	return route, nil
+}
+
+// installRoutes makes the main routing table contain exactly the routes of
+// protocol bgp which were learned.
+func installRoutes(learned []bgp.Route) {
+	desired := make(map[string]*netlink.Route)
+	for _, r := range learned {
+		key := r.Prefix.String()
+		if _, ok := desired[key]; ok {
+			continue // learned from multiple peers, first one wins
+		}
+		route, err := bgpRoute(r)
+		if err != nil {
+			log.Printf("route %v via %v: %v", r.Prefix, r.NextHop, err)
+			continue
+		}
+		desired[key] = route
+	}
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Protocol: unix.RTPROT_BGP,
+	}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.Printf("RouteList: %v", err)
+		return
+	}
+	installed := make(map[string]bool)
+	for idx := range existing {
+		r := &existing[idx]
+		key := "0.0.0.0/0"
+		if r.Dst != nil {
+			key = r.Dst.String()
+		} else if r.Gw != nil && r.Gw.To4() == nil {
+			key = "::/0"
+		}
+		if want, ok := desired[key]; ok && want.Gw.Equal(r.Gw) {
+			installed[key] = true
+			continue
+		}
+		if err := netlink.RouteDel(r); err != nil {
+			log.Printf("RouteDel(%v): %v", r.Dst, err)
+		}
+	}
+	for key, r := range desired {
+		if installed[key] {
+			continue
+		}
+		if err := netlink.RouteReplace(r); err != nil {
+			log.Printf("RouteReplace(%v via %v): %v", r.Dst, r.Gw, err)
+		}
+	}
+	log.Printf("%d routes learned", len(desired))
+}
+
+func serve(cfg bgp.Config) (*bgp.Speaker, error) {
+	s, err := bgp.NewSpeaker(cfg, installRoutes)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := delegatedPrefixes()
+	if err != nil {
+		log.Printf("cannot announce delegated prefixes: %v", err)
+	}
+	s.SetAnnounced(prefixes)
+	go s.Serve()
+	return s, nil
+}
+
+func logic() error {
+	cfg, err := bgp.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/bgp.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	// Remove the routes of a previous run, which are re-learned once the
+	// sessions are established.
+	installRoutes(nil)
+	s, err := serve(cfg)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		newCfg, err := bgp.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(newCfg, cfg) {
+			// Re-establishing the sessions withdraws all routes, so only
+			// do it when the configuration changed.
+			s.Close()
+			if s, err = serve(newCfg); err != nil {
+				return err
+			}
+			cfg = newCfg
+			continue
+		}
+		prefixes, err := delegatedPrefixes()
+		if err != nil {
+			log.Printf("delegatedPrefixes: %v", err)
+			continue
+		}
+		s.SetAnnounced(prefixes) // e.g. a new prefix after a DHCPv6 renewal
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
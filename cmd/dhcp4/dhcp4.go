@@ -13,11 +13,14 @@
 // limitations under the License.
 
 // Binary dhcp4 obtains a DHCPv4 lease, persists it to
-// /perm/dhcp4/wire/lease.json and notifies netconfigd.
+// /perm/dhcp4/wire/lease.json and notifies netconfigd and dnsd whenever the
+// lease changed. SIGUSR1 makes it renew the lease right away (netconfigd sends
+// it when uplink0 regains carrier), SIGUSR2 makes it release the lease. A
+// lease which expires without renewal is removed. In chaos mode (-chaos),
+// SIGHUP makes the lease expire right away.
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -25,6 +28,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -33,9 +37,12 @@ import (
 	"github.com/google/renameio"
 	"github.com/jpillora/backoff"
 	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/hooks"
+	"github.com/rtr7/router7/internal/lease"
 	"github.com/rtr7/router7/internal/netconfig"
-	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/netns"
 	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/trace"
 )
 
 var log = teelogger.NewConsole()
@@ -43,9 +50,15 @@ var log = teelogger.NewConsole()
 var (
 	netInterface = flag.String("interface", "uplink0", "network interface to operate on")
 	stateDir     = flag.String("state_dir", "/perm/dhcp4", "directory in which to store lease data (wire/lease.json) and last ACK (wire/ack)")
+
+	chaos         = flag.Bool("chaos", false, "chaos mode for validating failover, rollback and alerting: SIGHUP makes the lease expire right away, and responses are delayed by -chaos_response_delay")
+	responseDelay = flag.Duration("chaos_response_delay", 0, "in chaos mode, delay each packet of the DHCP server by this duration (responses delayed by more than 10s are dropped)")
 )
 
 func logic() error {
+	if err := trace.Init("/perm", "dhcp4"); err != nil {
+		log.Printf("tracing: %v", err)
+	}
 	leasePath := filepath.Join(*stateDir, "wire/lease.json")
 	if err := os.MkdirAll(filepath.Dir(leasePath), 0755); err != nil {
 		return err
@@ -67,6 +80,10 @@ func logic() error {
 			}
 		}
 	}
+	var settings netconfig.DHCP4Settings
+	if details.DHCP4 != nil {
+		settings = *details.DHCP4
+	}
 	ackFn := filepath.Join(*stateDir, "wire/ack")
 	var ack *layers.DHCPv4
 	ackB, err := ioutil.ReadFile(ackFn)
@@ -83,61 +100,105 @@ func logic() error {
 		HWAddr:    hwaddr,
 		Ack:       ack,
 	}
-	usr2 := make(chan os.Signal, 1)
-	signal.Notify(usr2, syscall.SIGUSR2)
-	backoff := backoff.Backoff{
-		Factor: 2,
-		Jitter: true,
-		Min:    10 * time.Second,
-		Max:    1 * time.Minute,
-	}
-	for c.ObtainOrRenew() {
-		if err := c.Err(); err != nil {
-			dur := backoff.Duration()
-			log.Printf("Temporary error: %v (waiting %v)", err, dur)
-			time.Sleep(dur)
-			continue
-		}
-		backoff.Reset()
-		log.Printf("lease: %+v", c.Config())
-		b, err := json.Marshal(c.Config())
-		if err != nil {
-			return err
-		}
-		if err := renameio.WriteFile(leasePath, b, 0644); err != nil {
-			return fmt.Errorf("persisting lease to %s: %v", leasePath, err)
+	for _, code := range settings.ParameterRequestList {
+		c.ParameterRequestList = append(c.ParameterRequestList, layers.DHCPOpt(code))
+	}
+	if s := settings.SubnetSelection; s != "" {
+		if c.SubnetSelection = net.ParseIP(s).To4(); c.SubnetSelection == nil {
+			return fmt.Errorf("invalid subnet_selection %q: not an IPv4 address", s)
 		}
-		buf := gopacket.NewSerializeBuffer()
-		gopacket.SerializeLayers(buf,
-			gopacket.SerializeOptions{
-				FixLengths:       true,
-				ComputeChecksums: true,
-			},
-			c.Ack,
-		)
-		if err := renameio.WriteFile(ackFn, buf.Bytes(), 0644); err != nil {
-			return fmt.Errorf("persisting DHCPACK to %s: %v", ackFn, err)
+	}
+	if s := settings.RequestedAddress; s != "" {
+		if c.RequestedAddress = net.ParseIP(s).To4(); c.RequestedAddress == nil {
+			return fmt.Errorf("invalid requested_address %q: not an IPv4 address", s)
 		}
-		if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
-			log.Printf("notifying netconfig: %v", err)
+	}
+	if v := settings.VLAN; v != nil {
+		c.VLAN = &dhcp4.VLAN{
+			ID:       v.ID,
+			Priority: v.Priority,
 		}
-		select {
-		case <-time.After(time.Until(c.Config().RenewAfter)):
-			// fallthrough and renew the DHCP lease
-		case <-usr2:
-			log.Printf("SIGUSR2 received, sending DHCPRELEASE")
-			if err := c.Release(); err != nil {
-				return err
+	}
+	var hup chan os.Signal
+	if *chaos {
+		log.Printf("chaos mode: SIGHUP makes the lease expire, delaying responses by %v", *responseDelay)
+		c.ResponseDelay = *responseDelay
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	hookRunner := hooks.NewRunner("/perm")
+	m := lease.Manager{
+		Client: &c,
+		State: func() lease.State {
+			cfg := c.Config()
+			// Renewals only change the times, which netconfigd does not use.
+			key := cfg
+			key.RenewAfter, key.RebindAfter, key.Expiry = time.Time{}, time.Time{}, time.Time{}
+			return lease.State{
+				Lease:  cfg,
+				Key:    key,
+				Renew:  cfg.RenewAfter,
+				Expiry: cfg.Expiry,
+			}
+		},
+		Path: leasePath,
+		Persisted: func() error {
+			buf := gopacket.NewSerializeBuffer()
+			gopacket.SerializeLayers(buf,
+				gopacket.SerializeOptions{
+					FixLengths:       true,
+					ComputeChecksums: true,
+				},
+				c.Ack,
+			)
+			if err := renameio.WriteFile(ackFn, buf.Bytes(), 0644); err != nil {
+				return fmt.Errorf("persisting DHCPACK to %s: %v", ackFn, err)
 			}
+			return nil
+		},
+		Release: c.Release,
+		Notify:  []string{"/user/netconfigd", "/user/dnsd"},
+		Changed: func(st lease.State) {
+			cfg := st.Lease.(dhcp4.Config)
+			hookRunner.Run(hooks.EventLeaseAcquired, map[string]string{
+				"interface":   *netInterface,
+				"client_ip":   cfg.ClientIP,
+				"subnet_mask": cfg.SubnetMask,
+				"router":      cfg.Router,
+				"dns":         strings.Join(cfg.DNS, " "),
+				"expiry":      cfg.Expiry.Format(time.RFC3339),
+			})
+		},
+		Backoff: backoff.Backoff{
+			Factor: 2,
+			Jitter: true,
+			Min:    10 * time.Second,
+			Max:    1 * time.Minute,
+		},
+		Expire: hup,
+		Forget: func() { c.Ack = nil }, // start over at DHCPDISCOVER
+	}
+	if err := m.Run(usr1, usr2); err != nil {
+		if err == lease.ErrReleased {
 			os.Exit(125) // quit supervision by gokrazy
 		}
+		return err
 	}
-	return c.Err() // permanent error
+	return nil
 }
 
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
 func main() {
 	// TODO: drop privileges, run as separate uid?
 	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,215 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/renameio"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/fingerprint"
+)
+
+// device is an entry in the device database (/perm/dhcp4d/devices.json),
+// which collects information about LAN devices from passive observation.
+type device struct {
+	HardwareAddr string `json:"hardware_addr"`
+	MDNSName     string `json:"mdns_name,omitempty"` // e.g. “Living-Room-TV”
+	Model        string `json:"model,omitempty"`     // from _device-info._tcp, e.g. “MacBookPro16,1”
+}
+
+var (
+	devicesMu sync.Mutex
+	devices   = make(map[string]*device) // by hardware address
+)
+
+func devicesPath(permDir string) string {
+	return filepath.Join(permDir, "dhcp4d", "devices.json")
+}
+
+func loadDevices(permDir string) error {
+	b, err := ioutil.ReadFile(devicesPath(permDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var list []*device
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	for _, d := range list {
+		devices[d.HardwareAddr] = d
+	}
+	return nil
+}
+
+func persistDevicesLocked(permDir string) error {
+	list := make([]*device, 0, len(devices))
+	for _, d := range devices {
+		list = append(list, d)
+	}
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(devicesPath(permDir), b, 0644)
+}
+
+// deviceLabel returns a friendly label for the device which obtained lease l,
+// e.g. “Living-Room-TV (Samsung, Android)”.
+func deviceLabel(l *dhcp4d.Lease, vendor string) string {
+	var details []string
+	if vendor != "" {
+		details = append(details, vendor)
+	}
+	if system := fingerprint.Classify(l.Fingerprint, l.VendorClass); system != "" {
+		details = append(details, system)
+	}
+	devicesMu.Lock()
+	d, ok := devices[l.HardwareAddr]
+	devicesMu.Unlock()
+	var name string
+	if ok {
+		name = d.MDNSName
+		if d.Model != "" {
+			details = append(details, d.Model)
+		}
+	}
+	if name == "" {
+		return strings.Join(details, ", ")
+	}
+	if len(details) == 0 {
+		return name
+	}
+	return name + " (" + strings.Join(details, ", ") + ")"
+}
+
+// hardwareAddrByIP returns the hardware address which holds a lease for ip.
+func hardwareAddrByIP(ip net.IP) string {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	for _, l := range leases {
+		if l.Addr.Equal(ip) {
+			return l.HardwareAddr
+		}
+	}
+	return ""
+}
+
+// recordMDNS updates the device database based on the mDNS response msg.
+func recordMDNS(permDir string, msg *dns.Msg) {
+	names := make(map[string]string) // hostname → hardware address
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		// hardwareAddrByIP locks leasesMu, which must not be acquired while
+		// holding devicesMu (see deviceLabel).
+		if hwaddr := hardwareAddrByIP(a.A); hwaddr != "" {
+			names[strings.TrimSuffix(a.Hdr.Name, ".local.")] = hwaddr
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	changed := false
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	for name, hwaddr := range names {
+		d, ok := devices[hwaddr]
+		if !ok {
+			d = &device{HardwareAddr: hwaddr}
+			devices[hwaddr] = d
+		}
+		if d.MDNSName != name {
+			d.MDNSName = name
+			changed = true
+		}
+	}
+	for _, rr := range append(msg.Answer, msg.Extra...) {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.HasSuffix(txt.Hdr.Name, "._device-info._tcp.local.") {
+			continue
+		}
+		name := strings.TrimSuffix(txt.Hdr.Name, "._device-info._tcp.local.")
+		d, ok := devices[names[name]]
+		if !ok {
+			continue
+		}
+		for _, kv := range txt.Txt {
+			if model := strings.TrimPrefix(kv, "model="); model != kv && d.Model != model {
+				d.Model = model
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := persistDevicesLocked(permDir); err != nil {
+		log.Printf("persisting devices: %v", err)
+	}
+}
+
+// watchMDNS passively listens for mDNS responses on ifname to learn device
+// names and models.
+func watchMDNS(permDir, ifname string) error {
+	if err := loadDevices(permDir); err != nil {
+		log.Printf("loading devices: %v", err)
+	}
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	group := net.IPv4(224, 0, 0, 251)
+	c, err := net.ListenPacket("udp4", "224.0.0.251:5353")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	p := ipv4.NewPacketConn(c)
+	if err := p.JoinGroup(ifi, &net.UDPAddr{IP: group}); err != nil {
+		return err
+	}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		var msg dns.Msg
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue // not a valid DNS message
+		}
+		if !msg.Response {
+			continue
+		}
+		recordMDNS(permDir, &msg)
+	}
+}
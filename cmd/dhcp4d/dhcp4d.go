@@ -43,10 +43,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/rtr7/router7/internal/alert"
 	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/hooks"
 	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/netns"
 	"github.com/rtr7/router7/internal/notify"
 	"github.com/rtr7/router7/internal/oui"
+	"github.com/rtr7/router7/internal/profiling"
 	"github.com/rtr7/router7/internal/teelogger"
 )
 
@@ -59,6 +65,11 @@ var nonExpiredLeases = promauto.NewGauge(prometheus.GaugeOpts{
 	Help: "Number of non-expired DHCP leases",
 })
 
+var droppedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "dropped_requests",
+	Help: "Number of DHCP requests dropped by rate limiting, by reason",
+}, []string{"reason"})
+
 func updateNonExpired(leases []*dhcp4d.Lease) {
 	now := time.Now()
 	nonExpired := 0
@@ -148,8 +159,9 @@ form {
 <th>IP address</th>
 <th>Hostname</th>
 <th>MAC address</th>
-<th>Vendor</th>
+<th>Device</th>
 <th>Expiry</th>
+<th>Internet</th>
 </tr>
 {{ range $idx, $l := . }}
 <tr>
@@ -164,7 +176,7 @@ form {
 {{ end }}
 </td>
 <td class="hwaddr">{{$l.HardwareAddr}}</td>
-<td>{{$l.Vendor}}</td>
+<td>{{$l.Device}}</td>
 <td title="{{ timefmt $l.Expiry }}">
 {{ if $l.Expired }}
 {{ since $l.Expiry }}
@@ -178,6 +190,24 @@ form {
 {{ end }}
 {{ end }}
 </td>
+<td>
+{{ if $l.Paused }}
+<form action="/resume" method="post">
+<input type="hidden" name="hardwareaddr" value="{{$l.HardwareAddr}}">
+<span class="expired">paused</span>
+<input type="submit" value="resume">
+</form>
+{{ else }}
+<form action="/pause" method="post">
+<input type="hidden" name="hardwareaddr" value="{{$l.HardwareAddr}}">
+<select name="duration">
+<option value="1h">1 hour</option>
+<option value="">until resumed</option>
+</select>
+<input type="submit" value="pause">
+</form>
+{{ end }}
+</td>
 </tr>
 {{ end }}
 {{ end }}
@@ -191,6 +221,16 @@ form {
 `))
 )
 
+// knownDevice reports whether hwaddr has (or had) one of leases.
+func knownDevice(leases []*dhcp4d.Lease, hwaddr string) bool {
+	for _, l := range leases {
+		if l.HardwareAddr == hwaddr {
+			return true
+		}
+	}
+	return false
+}
+
 func loadLeases(h *dhcp4d.Handler, fn string) error {
 	b, err := ioutil.ReadFile(fn)
 	if err != nil {
@@ -223,7 +263,10 @@ func updateListeners() error {
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8067")}
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8067"),
+			Handler: profiling.Handler(freeze.Guard("/perm", http.DefaultServeMux)),
+		}
 	})
 	return nil
 }
@@ -233,20 +276,21 @@ type srv struct {
 	leases func(newLeases []*dhcp4d.Lease, latest *dhcp4d.Lease)
 }
 
+func loadConfig(handler *dhcp4d.Handler, permDir string) error {
+	cfg, err := dhcp4d.ReadConfig(permDir)
+	if err != nil {
+		return err
+	}
+	return handler.SetConfig(cfg)
+}
+
 func newSrv(permDir string) (*srv, error) {
 	http.Handle("/metrics", promhttp.Handler())
 	if err := updateListeners(); err != nil {
 		return nil, err
 	}
-	go func() {
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, syscall.SIGUSR1)
-		for range ch {
-			if err := updateListeners(); err != nil {
-				log.Printf("updateListeners: %v", err)
-			}
-		}
-	}()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
 
 	if err := os.MkdirAll(filepath.Join(permDir, "dhcp4d"), 0755); err != nil {
 		return nil, err
@@ -263,6 +307,25 @@ func newSrv(permDir string) (*srv, error) {
 	if err := loadLeases(handler, filepath.Join(permDir, "dhcp4d/leases.json")); err != nil {
 		return nil, err
 	}
+	if err := loadConfig(handler, permDir); err != nil {
+		return nil, err
+	}
+	for _, reason := range []string{dhcp4d.DropDuplicate, dhcp4d.DropRateLimit, dhcp4d.DropOverload} {
+		droppedRequests.WithLabelValues(reason) // export a zero value
+	}
+	handler.Dropped = func(reason string) {
+		droppedRequests.WithLabelValues(reason).Inc()
+	}
+	go func() {
+		for range ch {
+			if err := updateListeners(); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+			if err := loadConfig(handler, permDir); err != nil {
+				log.Printf("loadConfig: %v", err)
+			}
+		}
+	}()
 
 	http.HandleFunc("/sethostname", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -283,6 +346,8 @@ func newSrv(permDir string) (*srv, error) {
 		http.Redirect(w, r, "/", http.StatusFound)
 	})
 
+	registerPauseHandlers(permDir)
+
 	http.HandleFunc("/lease/", func(w http.ResponseWriter, r *http.Request) {
 		hostname := strings.TrimPrefix(r.URL.Path, "/lease/")
 		if hostname == "" {
@@ -314,17 +379,25 @@ func newSrv(permDir string) (*srv, error) {
 		}
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		host, _, err := net.SplitHostPort(r.RemoteAddr)
+	http.HandleFunc("/leases.json", func(w http.ResponseWriter, r *http.Request) {
+		leasesMu.Lock()
+		sorted := make([]*dhcp4d.Lease, len(leases))
+		copy(sorted, leases)
+		leasesMu.Unlock()
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Num < sorted[j].Num
+		})
+		b, err := json.Marshal(sorted)
 		if err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		ip := net.ParseIP(host)
-		if xff := r.Header.Get("X-Forwarded-For"); ip.IsLoopback() && xff != "" {
-			ip = net.ParseIP(xff)
-		}
-		if !gokrazy.IsInPrivateNet(ip) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := fromPrivateNet(r); !ok {
 			http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
 			return
 		}
@@ -333,8 +406,15 @@ func newSrv(permDir string) (*srv, error) {
 			dhcp4d.Lease
 
 			Vendor  string
+			Device  string
 			Expired bool
 			Static  bool
+			Paused  bool
+		}
+
+		paused, err := netconfig.Paused(permDir, time.Now())
+		if err != nil {
+			log.Printf("netconfig.Paused: %v", err)
 		}
 
 		leasesMu.Lock()
@@ -342,12 +422,15 @@ func newSrv(permDir string) (*srv, error) {
 		static := make([]tmplLease, 0, len(leases))
 		dynamic := make([]tmplLease, 0, len(leases))
 		tl := func(l *dhcp4d.Lease) tmplLease {
-			return tmplLease{
+			t := tmplLease{
 				Lease:   *l,
 				Vendor:  ouiDB.Lookup(l.HardwareAddr[:8]),
 				Expired: l.Expired(time.Now()),
 				Static:  l.Expiry.IsZero(),
 			}
+			t.Device = deviceLabel(l, t.Vendor)
+			_, t.Paused = paused[l.HardwareAddr]
+			return t
 		}
 		for _, l := range leases {
 			if l.Expiry.IsZero() {
@@ -375,9 +458,25 @@ func newSrv(permDir string) (*srv, error) {
 		}
 	})
 
+	notifier := alert.Load(permDir)
+	hookRunner := hooks.NewRunner(permDir)
 	handler.Leases = func(newLeases []*dhcp4d.Lease, latest *dhcp4d.Lease) {
 		leasesMu.Lock()
 		defer leasesMu.Unlock()
+		if latest != nil && !knownDevice(leases, latest.HardwareAddr) {
+			notifier.Notify(alert.Event{
+				Type:    alert.EventNewDevice,
+				Title:   "new device: " + latest.Hostname,
+				Message: fmt.Sprintf("%s (%s, %s) obtained %s", latest.Hostname, latest.HardwareAddr, ouiDB.Lookup(latest.HardwareAddr[:8]), latest.Addr),
+			})
+			hookRunner.Run(hooks.EventDeviceJoined, map[string]string{
+				"interface":     *iface,
+				"hostname":      latest.Hostname,
+				"hardware_addr": latest.HardwareAddr,
+				"vendor":        ouiDB.Lookup(latest.HardwareAddr[:8]),
+				"addr":          latest.Addr.String(),
+			})
+		}
 		leases = newLeases
 		log.Printf("DHCPACK %+v", latest)
 		b, err := json.Marshal(leases)
@@ -419,13 +518,23 @@ func (s *srv) run(ctx context.Context) error {
 	}
 }
 
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
 func main() {
 	// TODO: drop privileges, run as separate uid?
 	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
 	srv, err := newSrv("/perm")
 	if err != nil {
 		log.Fatal(err)
 	}
+	go func() {
+		if err := watchMDNS("/perm", *iface); err != nil {
+			log.Printf("mDNS: %v", err)
+		}
+	}()
 	if err := srv.run(context.Background()); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,127 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+
+	"github.com/rtr7/router7/internal/conntrack"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+)
+
+// fromPrivateNet reports whether the request originates from a private
+// network (or was proxied on behalf of a client in a private network).
+func fromPrivateNet(r *http.Request) (net.IP, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+	if xff := r.Header.Get("X-Forwarded-For"); ip.IsLoopback() && xff != "" {
+		ip = net.ParseIP(xff)
+	}
+	return ip, gokrazy.IsInPrivateNet(ip)
+}
+
+// leaseAddr returns the IP address leased to hwaddr, if any.
+func leaseAddr(hwaddr string) string {
+	leasesMu.Lock()
+	defer leasesMu.Unlock()
+	for _, l := range leases {
+		if l.HardwareAddr == hwaddr {
+			return l.Addr.String()
+		}
+	}
+	return ""
+}
+
+func notifyNetconfigd() {
+	if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+		log.Printf("notifying netconfigd: %v", err)
+	}
+}
+
+// registerPauseHandlers installs handlers which pause (block forwarding of)
+// and resume the internet access of a client, identified by its hardware
+// address. Pausing also kills the client’s existing connections.
+func registerPauseHandlers(permDir string) {
+	http.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if ip, ok := fromPrivateNet(r); !ok {
+			http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+			return
+		}
+		hwaddr := r.FormValue("hardwareaddr")
+		if hwaddr == "" {
+			http.Error(w, "missing hardwareaddr parameter", http.StatusBadRequest)
+			return
+		}
+		var until time.Time
+		if v := r.FormValue("duration"); v != "" { // empty: until resumed
+			var err error
+			until, err = netconfig.BlockUntil(v, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		addr := leaseAddr(hwaddr)
+		if err := netconfig.Pause(permDir, hwaddr, addr, until); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notifyNetconfigd()
+		if addr != "" {
+			if _, err := conntrack.Delete(&conntrack.Filter{Host: net.ParseIP(addr)}); err != nil {
+				log.Printf("killing connections of %s: %v", addr, err)
+			}
+		}
+		log.Printf("paused %s (%s) until %v", hwaddr, addr, until)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+
+	http.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if ip, ok := fromPrivateNet(r); !ok {
+			http.Error(w, fmt.Sprintf("access from %v forbidden", ip), http.StatusForbidden)
+			return
+		}
+		hwaddr := r.FormValue("hardwareaddr")
+		if hwaddr == "" {
+			http.Error(w, "missing hardwareaddr parameter", http.StatusBadRequest)
+			return
+		}
+		if err := netconfig.Resume(permDir, hwaddr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		notifyNetconfigd()
+		log.Printf("resumed %s", hwaddr)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
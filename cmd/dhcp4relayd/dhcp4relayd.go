@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary dhcp4relayd relays the DHCPv4 requests of the clients on the
+// interfaces of /perm/dhcp4relay.json (e.g. VLANs whose leases are handed out
+// by a central DHCP server) to their servers, with option 82.
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rtr7/router7/internal/dhcp4relay"
+	"github.com/rtr7/router7/internal/netns"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+func logic() error {
+	if _, err := dhcp4relay.ReadConfig(*perm); err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/dhcp4relay.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for {
+		// Re-read the configuration and the interface addresses, e.g. once
+		// netconfigd created a VLAN interface.
+		cfg, err := dhcp4relay.ReadConfig(*perm)
+		if err != nil {
+			return err
+		}
+		a, err := dhcp4relay.NewAgent(cfg)
+		if err != nil {
+			return err
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- a.Serve() }()
+		select {
+		case <-ch:
+			a.Close()
+			<-errs
+		case err := <-errs:
+			a.Close()
+			return err
+		}
+	}
+}
+
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
+func main() {
+	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
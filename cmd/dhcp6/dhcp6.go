@@ -13,28 +13,40 @@
 // limitations under the License.
 
 // Binary dhcp6 obtains a DHCPv6 lease, persists it to
-// /perm/dhcp6/wire/lease.json and notifies netconfigd.
+// /perm/dhcp6/wire/lease.json and notifies netconfigd, radvd, dnsd and bgpd
+// whenever the lease changed. SIGUSR1 makes it renew the lease right away,
+// SIGUSR2 makes it release the lease. A lease whose prefixes all expired
+// without renewal is removed. In chaos mode (-chaos), SIGHUP makes the lease
+// expire right away.
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/google/renameio"
+	"github.com/jpillora/backoff"
 	"github.com/rtr7/router7/internal/dhcp6"
-	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/hooks"
+	"github.com/rtr7/router7/internal/lease"
+	"github.com/rtr7/router7/internal/netns"
 	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/trace"
 )
 
 var log = teelogger.NewConsole()
 
+var chaos = flag.Bool("chaos", false, "chaos mode for validating failover, rollback and alerting: SIGHUP makes the lease expire right away")
+
 func logic() error {
+	if err := trace.Init("/perm", "dhcp6"); err != nil {
+		log.Printf("tracing: %v", err)
+	}
 	const leasePath = "/perm/dhcp6/wire/lease.json"
 	if err := os.MkdirAll(filepath.Dir(leasePath), 0755); err != nil {
 		return err
@@ -52,44 +64,84 @@ func logic() error {
 	if err != nil {
 		return err
 	}
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
 	usr2 := make(chan os.Signal, 1)
 	signal.Notify(usr2, syscall.SIGUSR2)
-	for c.ObtainOrRenew() {
-		if err := c.Err(); err != nil {
-			log.Printf("Temporary error: %v", err)
-			time.Sleep(10 * time.Second)
-			continue
-		}
-		log.Printf("lease: %+v", c.Config())
-		b, err := json.Marshal(c.Config())
-		if err != nil {
-			return err
-		}
-		if err := renameio.WriteFile(leasePath, b, 0644); err != nil {
+	var hup chan os.Signal
+	if *chaos {
+		log.Printf("chaos mode: SIGHUP makes the lease expire")
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+	hookRunner := hooks.NewRunner("/perm")
+	var hookedPrefixes string
+	m := lease.Manager{
+		Client: c,
+		State: func() lease.State {
+			cfg := c.Config()
+			// The lifetimes are part of the key: netconfigd extends the
+			// lifetimes of the delegated addresses on every renewal.
+			key := cfg
+			key.RenewAfter = time.Time{}
+			var expiry time.Time
+			for _, l := range cfg.Lifetimes {
+				if l.ValidUntil.After(expiry) {
+					expiry = l.ValidUntil
+				}
+			}
+			return lease.State{
+				Lease:  cfg,
+				Key:    key,
+				Renew:  cfg.RenewAfter,
+				Expiry: expiry,
+			}
+		},
+		Path: leasePath,
+		Release: func() error {
+			_, _, err := c.Release()
 			return err
-		}
-		if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
-			log.Printf("notifying netconfig: %v", err)
-		}
-		if err := notify.Process("/user/radvd", syscall.SIGUSR1); err != nil {
-			log.Printf("notifying radvd: %v", err)
-		}
-		select {
-		case <-time.After(time.Until(c.Config().RenewAfter)):
-			// fallthrough and renew the DHCP lease
-		case <-usr2:
-			log.Printf("SIGUSR2 received, sending DHCPRELEASE")
-			if _, _, err := c.Release(); err != nil {
-				return err
+		},
+		Notify: []string{"/user/netconfigd", "/user/radvd", "/user/dnsd", "/user/bgpd", "/user/sitelinkd"},
+		Changed: func(st lease.State) {
+			// The key changes on every renewal (lifetimes), the hooks
+			// only run when the prefixes changed.
+			cfg := st.Lease.(dhcp6.Config)
+			var prefixes []string
+			for _, p := range cfg.Prefixes {
+				prefixes = append(prefixes, p.String())
 			}
+			if joined := strings.Join(prefixes, " "); joined != hookedPrefixes {
+				hookedPrefixes = joined
+				hookRunner.Run(hooks.EventPrefixChanged, map[string]string{
+					"interface": "uplink0",
+					"prefixes":  joined,
+					"dns":       strings.Join(cfg.DNS, " "),
+				})
+			}
+		},
+		Backoff: backoff.Backoff{
+			Min: 10 * time.Second,
+			Max: 10 * time.Second,
+		},
+		Expire: hup,
+	}
+	if err := m.Run(usr1, usr2); err != nil {
+		if err == lease.ErrReleased {
 			os.Exit(125) // quit supervision by gokrazy
 		}
+		return err
 	}
-	return c.Err() // permanent error
+	return nil
 }
 
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
 func main() {
 	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
@@ -26,16 +26,28 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gokrazy/gokrazy"
+	"github.com/google/renameio"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/rtr7/router7/internal/alert"
 	"github.com/rtr7/router7/internal/diag"
+	"github.com/rtr7/router7/internal/hooks"
 	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
 )
 
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
 var httpListeners = multilisten.NewPool()
 
 func updateListeners() error {
@@ -45,7 +57,10 @@ func updateListeners() error {
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "7733")}
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "7733"),
+			Handler: profiling.Handler(http.DefaultServeMux),
+		}
 	})
 	return nil
 }
@@ -103,6 +118,150 @@ func logic() error {
 		fmt.Fprintf(w, `<!DOCTYPE html><style type="text/css">ul { list-style-type: none; }</style><ul>`)
 		dump(0, w, re)
 	})
+	notifier := alert.Load(*perm)
+	rec, err := diag.NewRecorder(filepath.Join(*perm, "diagd", "availability.json"))
+	if err != nil {
+		return err
+	}
+	hookRunner := hooks.NewRunner(*perm)
+	var notified time.Time // start of the last outage which was notified
+	var hooked time.Time   // start of the ongoing outage the hooks ran for
+	go func() {
+		for range time.Tick(15 * time.Second) {
+			mu.Lock()
+			re := m.Evaluate()
+			mu.Unlock()
+			now := time.Now()
+			if err := rec.Observe(now, re); err != nil {
+				log.Printf("recording availability: %v", err)
+			}
+			outages := rec.History().Outages
+			if len(outages) == 0 {
+				continue
+			}
+			last := outages[len(outages)-1]
+			if !hooked.IsZero() && (!last.Start.Equal(hooked) || !last.End.IsZero()) {
+				hookRunner.Run(hooks.EventUplinkUp, map[string]string{
+					"interface": uplink,
+					"since":     hooked.Format(time.RFC3339),
+				})
+				hooked = time.Time{}
+			}
+			if last.End.IsZero() && !last.Start.Equal(hooked) {
+				hooked = last.Start
+				hookRunner.Run(hooks.EventUplinkDown, map[string]string{
+					"interface":   uplink,
+					"since":       last.Start.Format(time.RFC3339),
+					"cause":       last.Cause,
+					"first_error": last.FirstError,
+				})
+			}
+			if last.End.IsZero() && last.Duration(now) > 5*time.Minute && !last.Start.Equal(notified) {
+				notified = last.Start
+				notifier.Notify(alert.Event{
+					Type:    alert.EventUplinkDown,
+					Title:   "uplink down",
+					Message: fmt.Sprintf("uplink unreachable since %v (suspected cause: %s, %s)", last.Start.Format(time.RFC3339), last.Cause, last.FirstError),
+				})
+			}
+		}
+	}()
+	http.HandleFunc("/outages.json", func(w http.ResponseWriter, r *http.Request) {
+		h := rec.History()
+		now := time.Now()
+		type outage struct {
+			diag.Outage
+			DurationSeconds float64 `json:"duration_seconds"`
+		}
+		reply := struct {
+			Hours   []diag.Hour `json:"hours"`
+			Outages []outage    `json:"outages"`
+		}{
+			Hours: h.Hours,
+		}
+		for _, o := range h.Outages {
+			reply.Outages = append(reply.Outages, outage{
+				Outage:          o,
+				DurationSeconds: o.Duration(now).Seconds(),
+			})
+		}
+		b, err := json.Marshal(&reply)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+	targets, err := diag.ReadSLAConfig(*perm)
+	if err != nil {
+		return err
+	}
+	sla := diag.NewSLAMonitor(targets, prometheus.DefaultRegisterer)
+	sla.OnEvent = func(ev diag.SLAEvent) {
+		log.Print(ev)
+		if ev.Breached {
+			notifier.Notify(alert.Event{
+				Type:    alert.EventSLABreach,
+				Title:   "SLA breached: " + ev.Target,
+				Message: ev.String(),
+			})
+		}
+	}
+	go sla.Run(1 * time.Second)
+	http.HandleFunc("/sla.json", func(w http.ResponseWriter, r *http.Request) {
+		reply := struct {
+			Hours  []diag.SLAHour  `json:"hours"`
+			Events []diag.SLAEvent `json:"events"`
+		}{
+			Hours:  sla.Hours(),
+			Events: sla.Events(),
+		}
+		b, err := json.Marshal(&reply)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	})
+	healthCfg, err := diag.ReadHealthConfig(*perm)
+	if err != nil {
+		return err
+	}
+	if healthCfg != nil {
+		arbiter := diag.NewHealthArbiter(*healthCfg)
+		// The arbiter starts out considering the uplink healthy: reset any
+		// state persisted before diagd was restarted.
+		if err := persistHealth(arbiter); err != nil {
+			log.Printf("persisting uplink health: %v", err)
+		}
+		go arbiter.Run(func(healthy bool) {
+			if err := persistHealth(arbiter); err != nil {
+				log.Printf("persisting uplink health: %v", err)
+			}
+			state := "down"
+			if healthy {
+				state = "up"
+			}
+			log.Printf("uplink %s declared %s, notifying netconfigd", arbiter.Interface(), state)
+			if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+				log.Printf("notifying netconfigd: %v", err)
+			}
+		})
+		http.HandleFunc("/uplink_health.json", func(w http.ResponseWriter, r *http.Request) {
+			b, err := json.Marshal(uplinkHealth(arbiter))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write(b)
+		})
+	} else {
+		// Remove stale state so that netconfigd does not keep the uplink
+		// demoted after health arbitration was disabled.
+		os.Remove(filepath.Join(*perm, "diagd", "health.json"))
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/exposure", exposureHandler(uplink))
 	http.HandleFunc("/health.json", func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		re := m.Evaluate()
@@ -132,6 +291,27 @@ func logic() error {
 	return nil
 }
 
+func uplinkHealth(arbiter *diag.HealthArbiter) netconfig.UplinkHealth {
+	healthy, since := arbiter.Healthy()
+	return netconfig.UplinkHealth{
+		Interface: arbiter.Interface(),
+		Healthy:   healthy,
+		Since:     since,
+	}
+}
+
+func persistHealth(arbiter *diag.HealthArbiter) error {
+	b, err := json.Marshal(uplinkHealth(arbiter))
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(*perm, "diagd", "health.json")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(fn, b, 0644)
+}
+
 func main() {
 	flag.Parse()
 
@@ -0,0 +1,97 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rtr7/router7/internal/exposure"
+	"golang.org/x/net/proxy"
+)
+
+var exposureVantage = flag.String("exposure_vantage",
+	"",
+	"URL of a SOCKS5 proxy outside of the network (e.g. socks5://vps.example.net:1080) from which to probe the WAN address. If empty, the router probes its WAN address itself (hairpin), which cannot probe port forwardings")
+
+func interfaceAddrs(ifname string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// exposureHandler lists the ports which are reachable from the internet, to
+// surface forgotten port forwardings and services.
+func exposureHandler(uplink string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var vantage proxy.Dialer // hairpin
+		if *exposureVantage != "" {
+			u, err := url.Parse(*exposureVantage)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			vantage, err = proxy.FromURL(u, &net.Dialer{Timeout: 5 * time.Second})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		wan, err := interfaceAddrs(uplink)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		exposures, err := exposure.Scan(*perm, wan, vantage)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `<!DOCTYPE html><title>exposure</title><table><tr><th>Proto</th><th>Port</th><th>Source</th><th>Detail</th></tr>`)
+		for _, e := range exposures {
+			symbol := "?" // not probed
+			if e.Probed {
+				symbol = "✘"
+				if e.Reachable {
+					symbol = "✔"
+				}
+			}
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s %s</td></tr>\n",
+				html.EscapeString(e.Proto),
+				html.EscapeString(e.Port),
+				html.EscapeString(e.Source),
+				symbol,
+				html.EscapeString(e.Detail))
+		}
+		fmt.Fprintf(w, "</table>")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gokrazy/gokrazy"
 	miekgdns "github.com/miekg/dns"
@@ -33,16 +34,19 @@ import (
 	"github.com/rtr7/router7/internal/dns"
 	"github.com/rtr7/router7/internal/multilisten"
 	"github.com/rtr7/router7/internal/netconfig"
-
-	_ "net/http/pprof"
+	"github.com/rtr7/router7/internal/netns"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/trace"
 )
 
 var (
-	httpListeners = multilisten.NewPool()
-	dnsListeners  = multilisten.NewPool()
+	httpListeners         = multilisten.NewPool()
+	dnsListeners          = multilisten.NewPool()
+	publicDNSListeners    = multilisten.NewPool()
+	publicDNSTCPListeners = multilisten.NewPool()
 )
 
-func updateListeners(mux *miekgdns.ServeMux) error {
+func updateListeners(srv *dns.Server, public bool) error {
 	hosts, err := gokrazy.PrivateInterfaceAddrs()
 	if err != nil {
 		return err
@@ -52,7 +56,30 @@ func updateListeners(mux *miekgdns.ServeMux) error {
 		return &listenerAdapter{&miekgdns.Server{
 			Addr:    net.JoinHostPort(host, "53"),
 			Net:     "udp",
-			Handler: mux,
+			Handler: srv.Mux,
+		}}
+	})
+
+	// Only answer queries from the internet when serving a zone.
+	var publicHosts []string
+	if public {
+		if publicHosts, err = gokrazy.PublicInterfaceAddrs(); err != nil {
+			return err
+		}
+	}
+	publicDNSListeners.ListenAndServe(publicHosts, func(host string) multilisten.Listener {
+		return &listenerAdapter{&miekgdns.Server{
+			Addr:    net.JoinHostPort(host, "53"),
+			Net:     "udp",
+			Handler: srv.PublicMux,
+		}}
+	})
+	// Resolvers retry truncated answers via TCP.
+	publicDNSTCPListeners.ListenAndServe(publicHosts, func(host string) multilisten.Listener {
+		return &listenerAdapter{&miekgdns.Server{
+			Addr:    net.JoinHostPort(host, "53"),
+			Net:     "tcp",
+			Handler: srv.PublicMux,
 		}}
 	})
 
@@ -61,7 +88,10 @@ func updateListeners(mux *miekgdns.ServeMux) error {
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8053")}
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8053"),
+			Handler: profiling.Handler(http.DefaultServeMux),
+		}
 	})
 
 	return nil
@@ -74,18 +104,20 @@ type listenerAdapter struct {
 func (a *listenerAdapter) Close() error { return a.Shutdown() }
 
 func logic() error {
-	// TODO: set correct upstream DNS resolver(s)
+	if err := trace.Init("/perm", "dnsd"); err != nil {
+		log.Printf("tracing: %v", err)
+	}
 	ip, err := netconfig.LinkAddress("/perm", "lan0")
 	if err != nil {
 		return err
 	}
 	srv := dns.NewServer(ip.String()+":53", "lan")
+	var leases []dhcp4d.Lease
 	readLeases := func() error {
 		b, err := ioutil.ReadFile("/perm/dhcp4d/leases.json")
 		if err != nil {
 			return err
 		}
-		var leases []dhcp4d.Lease
 		if err := json.Unmarshal(b, &leases); err != nil {
 			return err
 		}
@@ -95,27 +127,84 @@ func logic() error {
 	if err := readLeases(); err != nil {
 		log.Printf("cannot resolve DHCP hostnames: %v", err)
 	}
+	var tokenAddrs map[string]net.IP
+	readTokenAddrs := func() {
+		var err error
+		tokenAddrs, err = netconfig.TokenAddrs("/perm")
+		if err != nil {
+			log.Printf("cannot resolve token addresses: %v", err)
+		}
+		srv.SetTokenAddrs(tokenAddrs)
+	}
+	readTokenAddrs()
+	readUpstreams := func() {
+		upstreams, err := dns.LeaseUpstreams("/perm")
+		if err != nil {
+			log.Printf("cannot use DHCP resolvers: %v", err)
+			return
+		}
+		srv.SetUpstreams(upstreams)
+	}
+	readUpstreams()
+	var cfg dns.Config
+	readConfig := func() error {
+		var err error
+		cfg, err = dns.ReadConfig("/perm")
+		if err != nil {
+			return err
+		}
+		return srv.SetConfig(cfg)
+	}
+	if err := readConfig(); err != nil {
+		log.Printf("readConfig: %v", err)
+	}
+	updateZone := func() {
+		if cfg.Zone == "" {
+			srv.SetZone(nil)
+			return
+		}
+		srv.SetZone(zoneFor(cfg.Zone, leases, tokenAddrs))
+	}
+	updateZone()
 	http.Handle("/metrics", srv.PrometheusHandler())
 	http.HandleFunc("/dyndns", srv.DyndnsHandler)
-	if err := updateListeners(srv.Mux); err != nil {
+	http.HandleFunc("/acme/", srv.ACMEHandler)
+	if err := updateListeners(srv, cfg.Zone != ""); err != nil {
 		return err
 	}
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGUSR1)
-	for range ch {
-		if err := updateListeners(srv.Mux); err != nil {
-			log.Printf("updateListeners: %v", err)
-		}
-		if err := readLeases(); err != nil {
-			log.Printf("readLeases: %v", err)
+	// Periodically pick up address changes (e.g. IPv6 neighbors or prefix
+	// changes) for the zone.
+	tick := time.Tick(1 * time.Minute)
+	for {
+		select {
+		case <-ch:
+			if err := readLeases(); err != nil {
+				log.Printf("readLeases: %v", err)
+			}
+			readUpstreams()
+			if err := readConfig(); err != nil {
+				log.Printf("readConfig: %v", err)
+			}
+			if err := updateListeners(srv, cfg.Zone != ""); err != nil {
+				log.Printf("updateListeners: %v", err)
+			}
+		case <-tick:
 		}
+		readTokenAddrs()
+		updateZone()
 	}
-	return nil
 }
 
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
 func main() {
 	// TODO: drop privileges, run as separate uid?
 	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/dns"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// uplinkIPv4 returns the public IPv4 address of the active uplink (see
+// netconfig.ActiveUplink), if any.
+func uplinkIPv4() net.IP {
+	uplink, err := netconfig.ActiveUplink()
+	if err != nil {
+		return nil
+	}
+	iface, err := net.InterfaceByName(uplink)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// globalIPv6 returns the global IPv6 addresses which the client with hwaddr
+// uses on lan0, as per the neighbor table.
+func globalIPv6(hwaddr string) []net.IP {
+	mac, err := net.ParseMAC(hwaddr)
+	if err != nil {
+		return nil
+	}
+	link, err := netlink.LinkByName("lan0")
+	if err != nil {
+		return nil
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V6)
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, n := range neighs {
+		if n.HardwareAddr.String() != mac.String() ||
+			!n.IP.IsGlobalUnicast() ||
+			n.IP.To4() != nil {
+			continue
+		}
+		if n.IP[0]&0xfe == 0xfc {
+			continue // unique local address
+		}
+		ips = append(ips, n.IP)
+	}
+	return ips
+}
+
+// zoneFor returns the zone name with the router’s current public addresses
+// (at the zone apex) and those of port forwarding destinations (named after
+// their DHCP hostname). Destinations with a token binding are published with
+// their token address (see netconfig.TokenAddrs) instead of the addresses
+// from the neighbor table.
+func zoneFor(name string, leases []dhcp4d.Lease, tokenAddrs map[string]net.IP) *dns.Zone {
+	z := &dns.Zone{
+		Name:  name,
+		Addrs: make(map[string][]net.IP),
+	}
+	v4 := uplinkIPv4()
+	var apex []net.IP
+	if v4 != nil {
+		apex = append(apex, v4)
+	}
+	if v6, err := multilisten.IPv6Net1("/perm"); err == nil {
+		apex = append(apex, net.ParseIP(v6))
+	}
+	z.Addrs[""] = apex
+
+	forwardings, err := netconfig.PortForwardings("/perm")
+	if err != nil {
+		log.Printf("zone %s: %v", name, err)
+		return z
+	}
+	for _, fw := range forwardings {
+		dest := net.ParseIP(fw.DestAddr)
+		for _, l := range leases {
+			if !l.Addr.Equal(dest) || l.Hostname == "" {
+				continue
+			}
+			host := strings.ToLower(l.Hostname)
+			if _, ok := z.Addrs[host]; ok {
+				break
+			}
+			var addrs []net.IP
+			if v4 != nil {
+				addrs = append(addrs, v4) // reachable via port forwarding
+			}
+			if mac, err := net.ParseMAC(l.HardwareAddr); err == nil && tokenAddrs[mac.String()] != nil {
+				z.Addrs[host] = append(addrs, tokenAddrs[mac.String()])
+				break
+			}
+			z.Addrs[host] = append(addrs, globalIPv6(l.HardwareAddr)...)
+			break
+		}
+	}
+	return z
+}
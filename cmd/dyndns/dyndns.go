@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary dyndns updates the DNS records of /perm/dyndns.json (RFC 2136 with
+// TSIG, or Cloudflare) whenever the uplink address or the delegated IPv6
+// prefix changed. netconfigd sends SIGUSR1 after applying new leases; failed
+// updates are retried with backoff.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rtr7/router7/internal/dyndns"
+	"github.com/rtr7/router7/internal/netns"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+func logic() error {
+	cfg, err := dyndns.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/dyndns.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	u, err := dyndns.NewUpdater(*perm, cfg)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	retry := time.NewTicker(1 * time.Minute)
+	defer retry.Stop()
+	for {
+		addrs, err := dyndns.CurrentAddrs(*perm, time.Now())
+		if err != nil {
+			log.Printf("reading leases: %v", err)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+			err := u.Update(ctx, addrs)
+			cancel()
+			if err != nil {
+				log.Printf("persisting state: %v", err)
+			}
+		}
+		select {
+		case <-ch:
+		case <-retry.C:
+		}
+	}
+}
+
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
+func main() {
+	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
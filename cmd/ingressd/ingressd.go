@@ -0,0 +1,137 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary ingressd routes HTTP requests and TLS connections arriving on the
+// public ports 80 and 443 to internal hosts by hostname, configured via
+// /perm/ingress.json. Unlike port forwardings, this allows exposing multiple
+// services behind one IPv4 address (do not forward the ports 80 and 443 in
+// portforwardings.json when using ingressd).
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gokrazy/gokrazy"
+
+	"github.com/rtr7/router7/internal/ingress"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+var (
+	httpListeners = multilisten.NewPool()
+	tlsListeners  = multilisten.NewPool()
+)
+
+// tlsListener adapts ingress.Proxy.ServeTLS to multilisten.Listener.
+type tlsListener struct {
+	addr  string
+	proxy *ingress.Proxy
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+func (l *tlsListener) ListenAndServe() error {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.ln = ln
+	l.mu.Unlock()
+	return l.proxy.ServeTLS(ln)
+}
+
+func (l *tlsListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln == nil {
+		return nil
+	}
+	return l.ln.Close()
+}
+
+func updateListeners(proxy *ingress.Proxy) error {
+	hosts, err := gokrazy.PublicInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "80"),
+			Handler: proxy,
+		}
+	})
+
+	tlsListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &tlsListener{
+			addr:  net.JoinHostPort(host, "443"),
+			proxy: proxy,
+		}
+	})
+	return nil
+}
+
+func logic() error {
+	cfg, err := ingress.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/ingress.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	proxy := ingress.NewProxy()
+	if err := proxy.SetConfig(cfg); err != nil {
+		return err
+	}
+	if err := updateListeners(proxy); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(proxy); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		cfg, err := ingress.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			continue
+		}
+		if err := proxy.SetConfig(cfg); err != nil {
+			log.Printf("SetConfig: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
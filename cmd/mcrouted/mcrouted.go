@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary mcrouted forwards IPv4 multicast traffic between interfaces
+// according to the static routes of /perm/mcroute.json, e.g. SSDP between
+// LAN segments or IPTV from the uplink into a VLAN.
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/rtr7/router7/internal/mcroute"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+func serve(cfg mcroute.Config) (*mcroute.Router, error) {
+	r, err := mcroute.NewRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := r.Serve(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return r, nil
+}
+
+func logic() error {
+	cfg, err := mcroute.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/mcroute.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	ifaces := mcroute.Interfaces(cfg)
+	r, err := serve(cfg)
+	if err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		newCfg, err := mcroute.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			continue
+		}
+		newIfaces := mcroute.Interfaces(newCfg)
+		// Re-creating the Router interrupts forwarding, so only do it when
+		// necessary (netconfigd notifies mcrouted after every Apply).
+		if reflect.DeepEqual(newCfg, cfg) && reflect.DeepEqual(newIfaces, ifaces) {
+			continue
+		}
+		if err := r.Close(); err != nil {
+			log.Printf("Close: %v", err)
+		}
+		if r, err = serve(newCfg); err != nil {
+			return err
+		}
+		cfg, ifaces = newCfg, newIfaces
+		log.Printf("reconfigured: %d routes, %d interfaces", len(cfg.Routes), len(ifaces))
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
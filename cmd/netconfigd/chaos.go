@@ -0,0 +1,112 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/notify"
+)
+
+// chaosMonkey simulates failures in chaos mode (-chaos), to validate
+// failover, rollback and alerting end-to-end, e.g.:
+//
+//	curl -d interface=uplink0 -d duration=2m http://router7:8066/chaos/link_down
+//	curl -d client=dhcp4 http://router7:8066/chaos/expire_lease
+type chaosMonkey struct {
+	mu   sync.Mutex
+	down map[string]bool // links which are currently dropped
+}
+
+// linkDownHandler sets a link down and back up after the specified duration
+// (default: 1m), which the DHCP clients and diagd observe as a loss of
+// carrier. Re-applying the configuration in the meantime sets the link up
+// early.
+func (c *chaosMonkey) linkDownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("interface")
+	if name == "" {
+		name = "uplink0"
+	}
+	dur := 1 * time.Minute
+	if v := r.FormValue("duration"); v != "" {
+		var err error
+		if dur, err = time.ParseDuration(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down[name] {
+		http.Error(w, fmt.Sprintf("link %s is already down", name), http.StatusConflict)
+		return
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.down[name] = true
+	log.Printf("chaos: link %s down for %v", name, dur)
+	time.AfterFunc(dur, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.down, name)
+		log.Printf("chaos: setting link %s up", name)
+		if err := netlink.LinkSetUp(link); err != nil {
+			log.Printf("chaos: %v", err)
+		}
+	})
+	fmt.Fprintf(w, "link %s down until %v\n", name, time.Now().Add(dur).Format(time.RFC3339))
+}
+
+// expireLeaseHandler makes the lease of a DHCP client (dhcp4 or dhcp6,
+// default: dhcp4) expire right away. The client must run in chaos mode, too:
+// without -chaos, SIGHUP terminates it.
+func (c *chaosMonkey) expireLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	client := r.FormValue("client")
+	switch client {
+	case "":
+		client = "dhcp4"
+	case "dhcp4", "dhcp6":
+	default:
+		http.Error(w, fmt.Sprintf("unknown client %q, expected dhcp4 or dhcp6", client), http.StatusBadRequest)
+		return
+	}
+	if err := notify.Process("/user/"+client, syscall.SIGHUP); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("chaos: expired the lease of %s", client)
+	fmt.Fprintf(w, "expired the lease of %s\n", client)
+}
@@ -0,0 +1,399 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/conntrack"
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// reapply requests netconfig.Apply to run again (coalescing requests).
+func reapply(ch chan<- os.Signal) {
+	select {
+	case ch <- syscall.SIGUSR1:
+	default:
+		// re-apply already pending
+	}
+}
+
+func parseFilter(r *http.Request) (*conntrack.Filter, error) {
+	f, err := parseFlow(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.Empty() {
+		return nil, fmt.Errorf("refusing to kill all connections: specify host, src, dst, sport, dport or proto")
+	}
+	return f, nil
+}
+
+// parseFlow parses the host, src, dst, sport, dport and proto form values.
+func parseFlow(r *http.Request) (*conntrack.Filter, error) {
+	var f conntrack.Filter
+	for _, ip := range []struct {
+		key string
+		dst *net.IP
+	}{
+		{"host", &f.Host},
+		{"src", &f.SrcIP},
+		{"dst", &f.DstIP},
+	} {
+		if v := r.FormValue(ip.key); v != "" {
+			if *ip.dst = net.ParseIP(v); *ip.dst == nil {
+				return nil, fmt.Errorf("invalid %s address %q", ip.key, v)
+			}
+		}
+	}
+	for _, port := range []struct {
+		key string
+		dst *uint16
+	}{
+		{"sport", &f.SrcPort},
+		{"dport", &f.DstPort},
+	} {
+		if v := r.FormValue(port.key); v != "" {
+			p, err := strconv.ParseUint(v, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", port.key, v, err)
+			}
+			*port.dst = uint16(p)
+		}
+	}
+	switch proto := strings.ToLower(r.FormValue("proto")); proto {
+	case "":
+	case "tcp":
+		f.Proto = syscall.IPPROTO_TCP
+	case "udp":
+		f.Proto = syscall.IPPROTO_UDP
+	case "icmp":
+		f.Proto = syscall.IPPROTO_ICMP
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", proto)
+	}
+	return &f, nil
+}
+
+// killHandler deletes the conntrack entries matching the request and
+// optionally blocks the host for the specified duration (or “forever”, i.e.
+// until removed), e.g.:
+//
+//	curl -d host=192.168.42.23 -d block=10m http://router7:8066/conntrack/kill
+func killHandler(dir string, ch chan<- os.Signal) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		f, err := parseFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := r.FormValue("block"); v != "" {
+			if f.Host == nil {
+				http.Error(w, "block requires host", http.StatusBadRequest)
+				return
+			}
+			until, err := netconfig.BlockUntil(v, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			block := netconfig.Block{
+				Addr:   f.Host.String(),
+				Until:  until,
+				Reason: "killed via API",
+			}
+			if err := netconfig.AddBlock(dir, block); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reapply(ch)
+		}
+		n, err := conntrack.Delete(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("killed %d connections matching %+v", n, f)
+		fmt.Fprintf(w, "deleted %d conntrack entries\n", n)
+	}
+}
+
+// simulateHandler reports which firewall rules a hypothetical packet would
+// match, e.g.:
+//
+//	curl 'http://router7:8066/firewall/simulate?iif=uplink0&oif=lan0&src=203.0.113.1&dst=198.51.100.1&proto=tcp&dport=8080'
+func simulateHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseFlow(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p := netconfig.Packet{
+			IIfName: r.FormValue("iif"),
+			OIfName: r.FormValue("oif"),
+			Src:     f.SrcIP,
+			Dst:     f.DstIP,
+			Proto:   f.Proto,
+			SrcPort: f.SrcPort,
+			DstPort: f.DstPort,
+			SYN:     r.FormValue("syn") != "",
+		}
+		if v := r.FormValue("hwaddr"); v != "" {
+			if p.SrcHardwareAddr, err = net.ParseMAC(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		tr, err := netconfig.Simulate(dir, p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(tr); err != nil {
+			log.Printf("encoding trace: %v", err)
+		}
+	}
+}
+
+// exportHandler returns the generated firewall in “nft list ruleset” syntax,
+// or as a shell script installing it (format=script), e.g.:
+//
+//	curl 'http://router7:8066/firewall/export?format=script'
+func exportHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var script bool
+		switch format := r.FormValue("format"); format {
+		case "", "nft":
+		case "script":
+			script = true
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q, expected nft or script", format), http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		if err := netconfig.Export(dir, &buf, script); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+	}
+}
+
+// dohProvidersHandler returns (GET) or replaces (PUT) the addresses of the
+// DNS-over-HTTPS providers which are blocked for the block_encrypted_dns
+// clients of firewall.json, e.g.:
+//
+//	curl -X PUT -d '["1.1.1.1", "8.8.8.8"]' http://router7:8066/firewall/doh_providers
+func dohProvidersHandler(dir string, ch chan<- os.Signal) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			providers, err := netconfig.ReadDoHProviders(dir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(providers); err != nil {
+				log.Printf("encoding DoH providers: %v", err)
+			}
+
+		case http.MethodPut:
+			var providers []string
+			if err := json.NewDecoder(r.Body).Decode(&providers); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := netconfig.WriteDoHProviders(dir, providers); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			reapply(ch)
+			fmt.Fprintf(w, "stored %d DoH providers\n", len(providers))
+
+		default:
+			http.Error(w, "expected a GET or PUT request", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// freezeHandler returns (GET), starts (PUT) or ends (DELETE) a configuration
+// freeze, during which the control APIs of all daemons reject mutating
+// requests, e.g.:
+//
+//	curl -X PUT -d 'reason=debugging uplink&duration=2h' http://router7:8066/freeze
+//	curl -X DELETE http://router7:8066/freeze
+func freezeHandler(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			st, err := freeze.Read(dir, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reply := struct {
+				Frozen bool `json:"frozen"`
+				*freeze.State
+			}{
+				Frozen: st != nil,
+				State:  st,
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&reply); err != nil {
+				log.Printf("encoding freeze state: %v", err)
+			}
+
+		case http.MethodPut:
+			st := freeze.State{
+				Reason: r.FormValue("reason"),
+				Since:  time.Now(),
+			}
+			if st.Reason == "" {
+				http.Error(w, "missing reason parameter", http.StatusBadRequest)
+				return
+			}
+			if d := r.FormValue("duration"); d != "" {
+				dur, err := time.ParseDuration(d)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				st.Until = st.Since.Add(dur)
+			}
+			if err := freeze.Freeze(dir, st); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("configuration frozen: %s", st.Reason)
+			fmt.Fprintf(w, "configuration frozen\n")
+
+		case http.MethodDelete:
+			if err := freeze.Thaw(dir); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("configuration thawed")
+			fmt.Fprintf(w, "configuration thawed\n")
+
+		default:
+			http.Error(w, "expected a GET, PUT or DELETE request", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// featuresHandler returns (GET) the health of experimental features, or
+// resets (DELETE) a feature which was disabled after failing, e.g.:
+//
+//	curl -X DELETE http://router7:8066/features?name=flowtable
+func featuresHandler(dir string, ch chan<- os.Signal) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			health, err := netconfig.ReadFeatureHealth(dir)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(health); err != nil {
+				log.Printf("encoding feature health: %v", err)
+			}
+
+		case http.MethodDelete:
+			name := r.FormValue("name")
+			if name == "" {
+				http.Error(w, "missing name parameter", http.StatusBadRequest)
+				return
+			}
+			ok, err := netconfig.ResetFeature(dir, name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "feature not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("feature %s: reset", name)
+			reapply(ch)
+			fmt.Fprintf(w, "feature %s reset\n", name)
+
+		default:
+			http.Error(w, "expected a GET or DELETE request", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// generationsHandler returns (GET) the active and the previous firewall
+// generation, or re-activates (POST) the previous generation until the next
+// Apply, e.g.:
+//
+//	curl -X POST http://router7:8066/firewall/generations
+func generationsHandler(dir string) http.HandlerFunc {
+	notifier := alert.Load(dir)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			var gens struct {
+				Current  *netconfig.FirewallGeneration `json:"current"`
+				Previous *netconfig.FirewallGeneration `json:"previous"`
+			}
+			gens.Current, gens.Previous = netconfig.FirewallGenerations()
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(gens); err != nil {
+				log.Printf("encoding firewall generations: %v", err)
+			}
+
+		case http.MethodPost:
+			gen, err := netconfig.RollbackFirewall()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			msg := fmt.Sprintf("re-activated firewall generation %d (%d rules)", gen.Num, gen.Rules)
+			log.Printf("firewall: %s", msg)
+			notifier.Notify(alert.Event{
+				Type:    alert.EventConfigRollback,
+				Title:   "firewall rolled back",
+				Message: msg,
+			})
+			fmt.Fprintln(w, msg)
+
+		default:
+			http.Error(w, "expected a GET or POST request", http.StatusMethodNotAllowed)
+		}
+	}
+}
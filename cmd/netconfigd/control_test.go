@@ -0,0 +1,53 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+func TestKillHandlerRejectsDuration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ch := make(chan os.Signal, 1)
+	for _, block := range []string{"0s", "-10m"} {
+		form := url.Values{"host": {"192.168.42.23"}, "block": {block}}
+		req := httptest.NewRequest("POST", "/conntrack/kill", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		killHandler(dir, ch)(rec, req)
+		if got, want := rec.Code, http.StatusBadRequest; got != want {
+			t.Errorf("block=%s: status %d, want %d", block, got, want)
+		}
+	}
+	blocks, err := netconfig.ReadBlocks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) > 0 {
+		t.Errorf("unexpected blocks: %+v", blocks)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+)
+
+// linkAction is how watchLinks reacts to a link update.
+type linkAction int
+
+const (
+	ignoreLink      linkAction = iota
+	reapplyLink                // re-apply the configuration
+	reapplyAndRenew            // re-apply and renew the DHCP leases
+)
+
+// linkTracker follows the links (by interface index) and their carrier to
+// decide how to react to link updates, see watchLinks.
+type linkTracker struct {
+	dir string // contains interfaces.json
+
+	// Renaming or bringing up a link results in further RTM_NEWLINK
+	// messages, so only the first message for any interface index means
+	// that the link appeared.
+	seen    map[int32]bool
+	carrier map[int32]bool
+}
+
+func newLinkTracker(dir string) *linkTracker {
+	return &linkTracker{
+		dir:     dir,
+		seen:    make(map[int32]bool),
+		carrier: make(map[int32]bool),
+	}
+}
+
+func (t *linkTracker) update(update netlink.LinkUpdate) linkAction {
+	idx := update.Index
+	switch update.Header.Type {
+	case unix.RTM_NEWLINK:
+		attr := update.Link.Attrs()
+		up := update.IfInfomsg.Flags&unix.IFF_LOWER_UP != 0
+		if t.seen[idx] {
+			if up == t.carrier[idx] {
+				return ignoreLink
+			}
+			t.carrier[idx] = up
+			if !netconfig.Configured(t.dir, attr) {
+				return ignoreLink
+			}
+			if !up {
+				log.Printf("link %s lost carrier", attr.Name)
+				return ignoreLink
+			}
+			log.Printf("link %s regained carrier, re-applying", attr.Name)
+			if attr.Name == "uplink0" {
+				return reapplyAndRenew
+			}
+			return reapplyLink
+		}
+		t.seen[idx] = true
+		t.carrier[idx] = up
+		if update.Header.Flags&unix.NLM_F_MULTI != 0 {
+			return ignoreLink // part of the initial link dump
+		}
+		if !netconfig.Configured(t.dir, attr) {
+			return ignoreLink
+		}
+		log.Printf("configured link %s (%s) appeared, re-applying", attr.Name, attr.HardwareAddr)
+		return reapplyLink
+
+	case unix.RTM_DELLINK:
+		delete(t.seen, idx)
+		delete(t.carrier, idx)
+	}
+	return ignoreLink
+}
+
+// watchLinks triggers a re-apply (by sending to ch) whenever a link which is
+// configured in interfaces.json appears after boot, e.g. a USB network card,
+// or regains carrier, e.g. when plugging in the uplink cable. In the latter
+// case, the DHCP clients are asked to renew their leases right away, as the
+// link might now be connected to a different network.
+func watchLinks(dir string, ch chan<- os.Signal) error {
+	updates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribeWithOptions(updates, nil, netlink.LinkSubscribeOptions{
+		ListExisting: true,
+	}); err != nil {
+		return err
+	}
+	t := newLinkTracker(dir)
+	for update := range updates {
+		switch t.update(update) {
+		case reapplyLink:
+			reapply(ch)
+		case reapplyAndRenew:
+			reapply(ch)
+			renewLeases()
+		}
+	}
+	return fmt.Errorf("netlink subscription closed")
+}
+
+// renewLeases makes the DHCP clients on uplink0 renew their leases.
+func renewLeases() {
+	for _, p := range []string{"/user/dhcp4", "/user/dhcp6"} {
+		if err := notify.Process(p, syscall.SIGUSR1); err != nil {
+			log.Printf("notifying %s: %v", p, err)
+		}
+	}
+}
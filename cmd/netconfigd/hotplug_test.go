@@ -0,0 +1,201 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// linkUpdate returns a link update as sent by the kernel for the link with
+// index idx, name and hardware address hwaddr, and the interface flags.
+func linkUpdate(t *testing.T, typ uint16, idx int, name, hwaddr string, flags uint32) netlink.LinkUpdate {
+	t.Helper()
+	var addr net.HardwareAddr
+	if hwaddr != "" {
+		var err error
+		addr, err = net.ParseMAC(hwaddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return netlink.LinkUpdate{
+		Header: unix.NlMsghdr{Type: typ},
+		IfInfomsg: nl.IfInfomsg{
+			IfInfomsg: unix.IfInfomsg{Index: int32(idx), Flags: flags},
+		},
+		Link: &netlink.Device{
+			LinkAttrs: netlink.LinkAttrs{Index: idx, Name: name, HardwareAddr: addr},
+		},
+	}
+}
+
+func writeInterfaces(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, "interfaces.json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkTrackerHotplug(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "hotplug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeInterfaces(t, tmp, `{"interfaces":[
+  {"hardware_addr": "00:0d:b9:49:70:18", "name": "uplink0"},
+  {"hardware_addr": "00:e0:4c:68:01:23", "name": "lan1"}
+]}`)
+
+	tr := newLinkTracker(tmp)
+	dump := linkUpdate(t, unix.RTM_NEWLINK, 2, "uplink0", "00:0d:b9:49:70:18", 0)
+	dump.Header.Flags = unix.NLM_F_MULTI
+	for _, tt := range []struct {
+		desc   string
+		update netlink.LinkUpdate
+		want   linkAction
+	}{
+		{
+			desc:   "configured link in the initial dump",
+			update: dump,
+			want:   ignoreLink,
+		},
+		{
+			desc:   "USB network card plugged in",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 5, "eth1", "00:e0:4c:68:01:23", 0),
+			want:   reapplyLink,
+		},
+		{
+			desc:   "USB network card renamed",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 5, "lan1", "00:e0:4c:68:01:23", 0),
+			want:   ignoreLink,
+		},
+		{
+			desc:   "unconfigured network card plugged in",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 6, "eth2", "00:e0:4c:68:04:56", 0),
+			want:   ignoreLink,
+		},
+		{
+			desc:   "USB network card unplugged",
+			update: linkUpdate(t, unix.RTM_DELLINK, 5, "lan1", "00:e0:4c:68:01:23", 0),
+			want:   ignoreLink,
+		},
+		{
+			desc:   "USB network card plugged in again",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 7, "eth1", "00:e0:4c:68:01:23", 0),
+			want:   reapplyLink,
+		},
+	} {
+		if got := tr.update(tt.update); got != tt.want {
+			t.Errorf("%s: update = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestLinkTrackerCarrier(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "hotplug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeInterfaces(t, tmp, `{"interfaces":[
+  {"hardware_addr": "00:0d:b9:49:70:18", "name": "uplink0"},
+  {"hardware_addr": "00:0d:b9:49:70:19", "name": "lan0"}
+]}`)
+
+	const (
+		down = unix.IFF_UP
+		up   = unix.IFF_UP | unix.IFF_LOWER_UP
+	)
+	tr := newLinkTracker(tmp)
+	for _, update := range []netlink.LinkUpdate{
+		linkUpdate(t, unix.RTM_NEWLINK, 2, "uplink0", "00:0d:b9:49:70:18", down),
+		linkUpdate(t, unix.RTM_NEWLINK, 3, "lan0", "00:0d:b9:49:70:19", up),
+		linkUpdate(t, unix.RTM_NEWLINK, 4, "eth2", "00:e0:4c:68:04:56", down),
+	} {
+		update.Header.Flags = unix.NLM_F_MULTI // initial link dump
+		if got := tr.update(update); got != ignoreLink {
+			t.Errorf("%s in initial dump: update = %v, want %v", update.Link.Attrs().Name, got, ignoreLink)
+		}
+	}
+
+	for _, tt := range []struct {
+		desc   string
+		update netlink.LinkUpdate
+		want   linkAction
+	}{
+		{
+			desc:   "uplink cable plugged in",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 2, "uplink0", "00:0d:b9:49:70:18", up),
+			want:   reapplyAndRenew,
+		},
+		{
+			desc:   "uplink change without carrier change",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 2, "uplink0", "00:0d:b9:49:70:18", up),
+			want:   ignoreLink,
+		},
+		{
+			desc:   "uplink cable unplugged",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 2, "uplink0", "00:0d:b9:49:70:18", down),
+			want:   ignoreLink,
+		},
+		{
+			desc:   "uplink cable plugged in again",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 2, "uplink0", "00:0d:b9:49:70:18", up),
+			want:   reapplyAndRenew,
+		},
+		{
+			desc:   "LAN cable unplugged",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 3, "lan0", "00:0d:b9:49:70:19", down),
+			want:   ignoreLink,
+		},
+		{
+			// lan0 has no DHCP client, so only the configuration is
+			// re-applied.
+			desc:   "LAN cable plugged in",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 3, "lan0", "00:0d:b9:49:70:19", up),
+			want:   reapplyLink,
+		},
+		{
+			desc:   "unconfigured link regained carrier",
+			update: linkUpdate(t, unix.RTM_NEWLINK, 4, "eth2", "00:e0:4c:68:04:56", up),
+			want:   ignoreLink,
+		},
+	} {
+		if got := tr.update(tt.update); got != tt.want {
+			t.Errorf("%s: update = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestReapplyCoalesces(t *testing.T) {
+	ch := make(chan os.Signal, 1)
+	reapply(ch)
+	reapply(ch) // must not block while a re-apply is pending
+	<-ch
+	select {
+	case sig := <-ch:
+		t.Errorf("unexpected second re-apply: %v", sig)
+	default:
+	}
+}
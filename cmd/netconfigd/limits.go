@@ -0,0 +1,47 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/rtr7/router7/internal/limits"
+)
+
+// enforceLimits applies the resource limits of limits.json to the router7
+// programs. gokrazy restarts programs which exit, so the limits are
+// re-applied periodically to cover new processes.
+func enforceLimits(dir string) {
+	e, err := limits.NewEnforcer("/sys/fs/cgroup")
+	if err != nil {
+		log.Printf("limits: %v", err)
+		return
+	}
+	var last string // only log changed errors, not every period
+	for ; ; time.Sleep(10 * time.Second) {
+		cfg, err := limits.ReadConfig(dir)
+		if err == nil {
+			err = e.Apply(cfg)
+		}
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if msg != last && msg != "" {
+			log.Printf("limits: %s", msg)
+		}
+		last = msg
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// detectLoops periodically probes the bridges with loop detection for LAN
+// loops, alerting once per loop and disabling the port if configured.
+func detectLoops(dir string) {
+	notifier := alert.Load(dir)
+	reported := make(map[netconfig.Loop]bool)
+	for ; ; time.Sleep(30 * time.Second) {
+		loops, err := netconfig.DetectLoops(dir)
+		if err != nil {
+			log.Printf("DetectLoops: %v", err)
+			continue
+		}
+		current := make(map[netconfig.Loop]bool)
+		for _, l := range loops {
+			current[l] = true
+			if reported[l] {
+				continue
+			}
+			msg := l.String()
+			if l.DisablePort {
+				if err := netconfig.DisableLoopPort(l); err != nil {
+					msg += ", disabling " + l.ReceivedOn + " failed: " + err.Error()
+				} else {
+					msg += ", disabled " + l.ReceivedOn + " until netconfigd restarts"
+				}
+			}
+			log.Printf("loop detected: %s", msg)
+			notifier.Notify(alert.Event{
+				Type:    alert.EventBridgeLoop,
+				Title:   "LAN loop on " + l.Bridge,
+				Message: msg,
+			})
+		}
+		reported = current
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// routerCollector exports the state of the router (interface counters, lease
+// expiry, conntrack usage and firewall counters), read on every scrape.
+type routerCollector struct {
+	dir string
+
+	ifaceBytes   *prometheus.Desc
+	ifacePackets *prometheus.Desc
+	ifaceErrors  *prometheus.Desc
+	ifaceDropped *prometheus.Desc
+
+	uplinkExpiry   *prometheus.Desc
+	prefixExpiry   *prometheus.Desc
+	leaseExpiry    *prometheus.Desc
+	conntrack      *prometheus.Desc
+	conntrackLimit *prometheus.Desc
+
+	rulePackets    *prometheus.Desc
+	ruleBytes      *prometheus.Desc
+	counterPackets *prometheus.Desc
+	counterBytes   *prometheus.Desc
+}
+
+func newRouterCollector(dir string) *routerCollector {
+	direction := []string{"interface", "direction"}
+	return &routerCollector{
+		dir: dir,
+
+		ifaceBytes:   prometheus.NewDesc("interface_bytes_total", "bytes received (rx) or transmitted (tx)", direction, nil),
+		ifacePackets: prometheus.NewDesc("interface_packets_total", "packets received (rx) or transmitted (tx)", direction, nil),
+		ifaceErrors:  prometheus.NewDesc("interface_errors_total", "receive (rx) or transmit (tx) errors", direction, nil),
+		ifaceDropped: prometheus.NewDesc("interface_dropped_total", "packets dropped on receive (rx) or transmit (tx)", direction, nil),
+
+		uplinkExpiry: prometheus.NewDesc("dhcp4_lease_expiry_timestamp_seconds", "expiry of the DHCPv4 lease of the uplink", []string{"interface", "addr"}, nil),
+		prefixExpiry: prometheus.NewDesc("dhcp6_prefix_valid_until_timestamp_seconds", "end of the valid lifetime of the delegated prefix", []string{"prefix"}, nil),
+		leaseExpiry:  prometheus.NewDesc("dhcp4d_lease_expiry_timestamp_seconds", "expiry of the DHCPv4 lease handed out to a LAN client", []string{"hardware_addr", "addr", "hostname"}, nil),
+
+		conntrack:      prometheus.NewDesc("conntrack_entries", "number of connection tracking entries", nil, nil),
+		conntrackLimit: prometheus.NewDesc("conntrack_entries_limit", "maximum number of connection tracking entries (nf_conntrack_max)", nil, nil),
+
+		rulePackets:    prometheus.NewDesc("nftables_rule_packets_total", "packets matched by a firewall rule with a counter", []string{"family", "table", "chain", "handle"}, nil),
+		ruleBytes:      prometheus.NewDesc("nftables_rule_bytes_total", "bytes matched by a firewall rule with a counter", []string{"family", "table", "chain", "handle"}, nil),
+		counterPackets: prometheus.NewDesc("nftables_counter_packets_total", "packets counted by a named firewall counter", []string{"family", "table", "name"}, nil),
+		counterBytes:   prometheus.NewDesc("nftables_counter_bytes_total", "bytes counted by a named firewall counter", []string{"family", "table", "name"}, nil),
+	}
+}
+
+func (c *routerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.ifaceBytes, c.ifacePackets, c.ifaceErrors, c.ifaceDropped,
+		c.uplinkExpiry, c.prefixExpiry, c.leaseExpiry,
+		c.conntrack, c.conntrackLimit,
+		c.rulePackets, c.ruleBytes, c.counterPackets, c.counterBytes,
+	} {
+		ch <- d
+	}
+}
+
+func (c *routerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, collect := range []func(chan<- prometheus.Metric) error{
+		c.collectInterfaces,
+		c.collectLeases,
+		c.collectConntrack,
+		c.collectFirewall,
+	} {
+		if err := collect(ch); err != nil {
+			log.Printf("metrics: %v", err)
+		}
+	}
+}
+
+func (c *routerCollector) collectInterfaces(ch chan<- prometheus.Metric) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	counter := func(d *prometheus.Desc, v uint64, ifname, direction string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), ifname, direction)
+	}
+	for _, l := range links {
+		attrs := l.Attrs()
+		s := attrs.Statistics
+		if s == nil || attrs.Name == "lo" {
+			continue
+		}
+		counter(c.ifaceBytes, s.RxBytes, attrs.Name, "rx")
+		counter(c.ifaceBytes, s.TxBytes, attrs.Name, "tx")
+		counter(c.ifacePackets, s.RxPackets, attrs.Name, "rx")
+		counter(c.ifacePackets, s.TxPackets, attrs.Name, "tx")
+		counter(c.ifaceErrors, s.RxErrors, attrs.Name, "rx")
+		counter(c.ifaceErrors, s.TxErrors, attrs.Name, "tx")
+		counter(c.ifaceDropped, s.RxDropped, attrs.Name, "rx")
+		counter(c.ifaceDropped, s.TxDropped, attrs.Name, "tx")
+	}
+	return nil
+}
+
+// readJSON decodes fn in dir into v, reporting false if fn does not exist.
+func readJSON(dir, fn string, v interface{}) (bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("%s: %v", fn, err)
+	}
+	return true, nil
+}
+
+func (c *routerCollector) collectLeases(ch chan<- prometheus.Metric) error {
+	gauge := func(d *prometheus.Desc, unix int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(unix), labels...)
+	}
+	uplinks := map[string]string{"uplink0": "dhcp4/wire/lease.json"}
+	for _, backup := range netconfig.BackupUplinks {
+		rel, _ := filepath.Rel(c.dir, netconfig.BackupLeasePath(c.dir, backup))
+		uplinks[backup] = rel
+	}
+	for ifname, fn := range uplinks {
+		var lease dhcp4.Config
+		ok, err := readJSON(c.dir, fn, &lease)
+		if err != nil {
+			return err
+		}
+		if ok && !lease.Expiry.IsZero() {
+			gauge(c.uplinkExpiry, lease.Expiry.Unix(), ifname, lease.ClientIP)
+		}
+	}
+
+	var lease6 dhcp6.Config
+	if _, err := readJSON(c.dir, "dhcp6/wire/lease.json", &lease6); err != nil {
+		return err
+	}
+	for i, prefix := range lease6.Prefixes {
+		if i < len(lease6.Lifetimes) && !lease6.Lifetimes[i].ValidUntil.IsZero() {
+			gauge(c.prefixExpiry, lease6.Lifetimes[i].ValidUntil.Unix(), prefix.String())
+		}
+	}
+
+	var leases []*dhcp4d.Lease
+	if _, err := readJSON(c.dir, "dhcp4d/leases.json", &leases); err != nil {
+		return err
+	}
+	for _, l := range leases {
+		hostname := l.Hostname
+		if l.HostnameOverride != "" {
+			hostname = l.HostnameOverride
+		}
+		gauge(c.leaseExpiry, l.Expiry.Unix(), l.HardwareAddr, l.Addr.String(), hostname)
+	}
+	return nil
+}
+
+// readProcUint reads a numeric sysctl, e.g. net/netfilter/nf_conntrack_count.
+func readProcUint(key string) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc/sys", key))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (c *routerCollector) collectConntrack(ch chan<- prometheus.Metric) error {
+	count, err := readProcUint("net/netfilter/nf_conntrack_count")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // nf_conntrack not loaded (yet)
+		}
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.conntrack, prometheus.GaugeValue, float64(count))
+	max, err := readProcUint("net/netfilter/nf_conntrack_max")
+	if err != nil {
+		return err
+	}
+	ch <- prometheus.MustNewConstMetric(c.conntrackLimit, prometheus.GaugeValue, float64(max))
+	return nil
+}
+
+func familyLabel(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyIPv4:
+		return "ipv4"
+	case nftables.TableFamilyIPv6:
+		return "ipv6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	}
+	return strconv.Itoa(int(f))
+}
+
+func (c *routerCollector) collectFirewall(ch chan<- prometheus.Metric) error {
+	var conn nftables.Conn
+	chains, err := conn.ListChains()
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		rules, err := conn.GetRule(chain.Table, chain)
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			for _, e := range r.Exprs {
+				counter, ok := e.(*expr.Counter)
+				if !ok {
+					continue
+				}
+				labels := []string{familyLabel(chain.Table.Family), chain.Table.Name, chain.Name, strconv.FormatUint(r.Handle, 10)}
+				ch <- prometheus.MustNewConstMetric(c.rulePackets, prometheus.CounterValue, float64(counter.Packets), labels...)
+				ch <- prometheus.MustNewConstMetric(c.ruleBytes, prometheus.CounterValue, float64(counter.Bytes), labels...)
+			}
+		}
+	}
+
+	tables, err := conn.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		objs, err := conn.GetObjects(t)
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			co, ok := o.(*nftables.CounterObj)
+			if !ok || co.Name == "fwded" {
+				continue // fwded is exported (and reset) by the filter_forward metrics
+			}
+			labels := []string{familyLabel(t.Family), t.Name, co.Name}
+			ch <- prometheus.MustNewConstMetric(c.counterPackets, prometheus.CounterValue, float64(co.Packets), labels...)
+			ch <- prometheus.MustNewConstMetric(c.counterBytes, prometheus.CounterValue, float64(co.Bytes), labels...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for fn, content := range map[string]string{
+		"dhcp4/wire/lease.json": `{"expiry":"2020-06-01T12:00:00Z","client_ip":"85.195.207.62"}`,
+		"dhcp6/wire/lease.json": `{"prefixes":[{"IP":"2a02:168:4a00::","Mask":"////////AAAAAAAAAAAAAA=="}],"lifetimes":[{"valid_until":"2020-06-02T00:00:00Z"}]}`,
+		"dhcp4d/leases.json":    `[{"addr":"192.168.42.23","hardware_addr":"22:b3:67:fb:c4:41","hostname":"xps","hostname_override":"midna","expiry":"2020-06-01T13:00:00Z"}]`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, fn)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &leaseCollector{newRouterCollector(dir)}
+	want := `
+# HELP dhcp4_lease_expiry_timestamp_seconds expiry of the DHCPv4 lease of the uplink
+# TYPE dhcp4_lease_expiry_timestamp_seconds gauge
+dhcp4_lease_expiry_timestamp_seconds{addr="85.195.207.62",interface="uplink0"} 1.5910128e+09
+# HELP dhcp4d_lease_expiry_timestamp_seconds expiry of the DHCPv4 lease handed out to a LAN client
+# TYPE dhcp4d_lease_expiry_timestamp_seconds gauge
+dhcp4d_lease_expiry_timestamp_seconds{addr="192.168.42.23",hardware_addr="22:b3:67:fb:c4:41",hostname="midna"} 1.5910164e+09
+# HELP dhcp6_prefix_valid_until_timestamp_seconds end of the valid lifetime of the delegated prefix
+# TYPE dhcp6_prefix_valid_until_timestamp_seconds gauge
+dhcp6_prefix_valid_until_timestamp_seconds{prefix="2a02:168:4a00::/48"} 1.591056e+09
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+// leaseCollector collects only the lease metrics of a routerCollector, which
+// do not depend on the network configuration of the test environment.
+type leaseCollector struct {
+	*routerCollector
+}
+
+func (c *leaseCollector) Collect(ch chan<- prometheus.Metric) {
+	if err := c.collectLeases(ch); err != nil {
+		panic(err)
+	}
+}
@@ -17,12 +17,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/gokrazy/gokrazy"
 	"github.com/google/nftables"
@@ -30,16 +32,26 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/rtr7/router7/internal/freeze"
 	"github.com/rtr7/router7/internal/multilisten"
 	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/netns"
 	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/profiling"
 	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/trace"
 )
 
 var log = teelogger.NewConsole()
 
 var (
 	linger = flag.Bool("linger", true, "linger around after applying the configuration (until killed)")
+
+	validate = flag.Bool("validate", false, "validate the configuration, print its problems and exit (non-zero if there are problems)")
+
+	dryRun = flag.Bool("dry_run", false, "print the problems of the configuration and the operations which would be performed to apply it, without performing them, and exit")
+
+	chaos = flag.Bool("chaos", false, "chaos mode for validating failover, rollback and alerting: serve /chaos/link_down and /chaos/expire_lease to simulate failures")
 )
 
 func init() {
@@ -119,13 +131,20 @@ func updateListeners() error {
 	}
 
 	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
-		return &http.Server{Addr: net.JoinHostPort(host, "8066")}
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8066"),
+			Handler: profiling.Handler(freeze.Guard("/perm/", http.DefaultServeMux, "/freeze")),
+		}
 	})
 	return nil
 }
 
 func logic() error {
+	if err := trace.Init("/perm", "netconfigd"); err != nil {
+		log.Printf("tracing: %v", err)
+	}
 	if *linger {
+		prometheus.MustRegister(newRouterCollector("/perm/"))
 		http.Handle("/metrics", promhttp.Handler())
 		if err := updateListeners(); err != nil {
 			return err
@@ -133,6 +152,57 @@ func logic() error {
 	}
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGUSR1)
+	smoke := &smokeTester{dir: "/perm/"}
+	if *linger {
+		http.Handle("/smoketest.json", smoke)
+		http.HandleFunc("/conntrack/kill", killHandler("/perm/", ch))
+		http.HandleFunc("/firewall/simulate", simulateHandler("/perm/"))
+		http.HandleFunc("/firewall/export", exportHandler("/perm/"))
+		http.HandleFunc("/firewall/doh_providers", dohProvidersHandler("/perm/", ch))
+		http.HandleFunc("/firewall/generations", generationsHandler("/perm/"))
+		http.HandleFunc("/freeze", freezeHandler("/perm/"))
+		http.HandleFunc("/features", featuresHandler("/perm/", ch))
+		if *chaos {
+			log.Printf("chaos mode: serving /chaos/link_down and /chaos/expire_lease")
+			c := &chaosMonkey{down: make(map[string]bool)}
+			http.HandleFunc("/chaos/link_down", c.linkDownHandler)
+			http.HandleFunc("/chaos/expire_lease", c.expireLeaseHandler)
+		}
+		go enforceLimits("/perm/")
+		go detectLoops("/perm/")
+		go checkPortSecurity("/perm/")
+		go func() {
+			for range time.Tick(1 * time.Minute) {
+				changed, err := updateQuotas("/perm/")
+				if err != nil {
+					log.Printf("updateQuotas: %v", err)
+				}
+				if changed {
+					reapply(ch) // re-apply firewall rules
+				}
+				pruned, err := netconfig.PruneBlocks("/perm/", time.Now())
+				if err != nil {
+					log.Printf("PruneBlocks: %v", err)
+					continue
+				}
+				if pruned {
+					reapply(ch) // remove expired blocks
+				}
+			}
+		}()
+		if u, err := newUsageCollector("/perm/"); err != nil {
+			log.Printf("usage: %v", err)
+		} else {
+			http.HandleFunc("/usage/daily", u.dailyHandler)
+			http.HandleFunc("/usage/weekly", u.weeklyHandler)
+			go u.run()
+		}
+		go func() {
+			if err := watchLinks("/perm/", ch); err != nil {
+				log.Printf("watchLinks: %v", err)
+			}
+		}()
+	}
 	for {
 		err := netconfig.Apply("/perm/", "/")
 
@@ -149,13 +219,18 @@ func logic() error {
 		if err := p.Signal(syscall.SIGHUP); err != nil {
 			log.Printf("kill -HUP 1: %v", err)
 		}
+		if _, ok := err.(netconfig.Warnings); ok {
+			// Already logged by netconfig.Apply; not fatal.
+			err = nil
+		}
 		if err != nil {
 			return err
 		}
 		if !*linger {
 			break
 		}
-		<-ch
+		smoke.applied()
+		await("/perm/", ch)
 		if err := updateListeners(); err != nil {
 			log.Printf("updateListeners: %v", err)
 		}
@@ -163,8 +238,29 @@ func logic() error {
 	return nil
 }
 
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
 func main() {
 	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
+	if *validate {
+		problems := netconfig.Validate("/perm/")
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if *dryRun {
+		if err := netconfig.DryRun("/perm/", os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,43 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// checkPortSecurity periodically enforces the hardware address limits of the
+// bridge members, alerting when a member is locked.
+func checkPortSecurity(dir string) {
+	notifier := alert.Load(dir)
+	for ; ; time.Sleep(10 * time.Second) {
+		violations, err := netconfig.CheckPortSecurity(dir)
+		if err != nil {
+			log.Printf("CheckPortSecurity: %v", err)
+			continue
+		}
+		for _, v := range violations {
+			log.Printf("port security: %v", v)
+			notifier.Notify(alert.Event{
+				Type:    alert.EventPortSecurity,
+				Title:   "port security violation on " + v.Member,
+				Message: v.String() + " until netconfigd restarts",
+			})
+		}
+	}
+}
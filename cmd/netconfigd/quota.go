@@ -0,0 +1,85 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/quota"
+)
+
+var (
+	quotaUsed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "quota",
+			Name:      "used_bytes",
+			Help:      "bytes transferred in the current billing period",
+		},
+		[]string{"interface"})
+	quotaLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "quota",
+			Name:      "limit_bytes",
+			Help:      "bytes which can be transferred per billing period",
+		},
+		[]string{"interface"})
+)
+
+// updateQuotas accounts the traffic of all interfaces with a quota and
+// reports whether any quota changed its exceeded state.
+func updateQuotas(dir string) (bool, error) {
+	cfg, err := quota.ReadConfig(dir)
+	if err != nil {
+		return false, err
+	}
+	if len(cfg.Quotas) == 0 {
+		return false, nil
+	}
+	states, err := quota.ReadState(dir)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	changed := false
+	for _, q := range cfg.Quotas {
+		link, err := netlink.LinkByName(q.Interface)
+		if err != nil {
+			continue // e.g. LTE modem not plugged in
+		}
+		stats := link.Attrs().Statistics
+		if stats == nil {
+			continue
+		}
+		s, ok := states[q.Interface]
+		if !ok {
+			s = &quota.State{
+				Interface:   q.Interface,
+				LastCounter: stats.RxBytes + stats.TxBytes,
+			}
+			states[q.Interface] = s
+		}
+		if s.Update(q, now, stats.RxBytes+stats.TxBytes) {
+			log.Printf("quota for %s: exceeded=%v (%d of %d bytes used)", q.Interface, s.Exceeded, s.UsedBytes, q.LimitBytes)
+			changed = true
+		}
+		quotaUsed.WithLabelValues(q.Interface).Set(float64(s.UsedBytes))
+		quotaLimit.WithLabelValues(q.Interface).Set(float64(q.LimitBytes))
+	}
+	return changed, quota.WriteState(dir, states)
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+var (
+	networkHealthy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netconfig_network_healthy",
+		Help: "1 if all checks of the smoke test after the last Apply passed",
+	})
+	smokeCheckOK = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netconfig_smoke_check_ok",
+		Help: "1 if the smoke test check passed after the last Apply",
+	}, []string{"check"})
+)
+
+// smokeTester runs the dataplane smoke test after every Apply.
+type smokeTester struct {
+	dir string
+
+	mu   sync.Mutex
+	gen  int // incremented by every Apply
+	last *netconfig.SmokeResult
+}
+
+// applied starts a smoke test once the network settled. Results of tests
+// overtaken by a later Apply are discarded.
+func (s *smokeTester) applied() {
+	s.mu.Lock()
+	s.gen++
+	gen := s.gen
+	s.last = nil
+	s.mu.Unlock()
+	go func() {
+		cfg, err := netconfig.ReadSmokeTestConfig(s.dir)
+		if err != nil {
+			log.Printf("smoke test: %v", err)
+			return
+		}
+		time.Sleep(cfg.SettleDuration())
+		s.mu.Lock()
+		stale := gen != s.gen
+		s.mu.Unlock()
+		if stale {
+			return
+		}
+		res, err := netconfig.SmokeTest(s.dir, cfg)
+		if err != nil {
+			log.Printf("smoke test: %v", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if gen != s.gen {
+			return
+		}
+		s.last = res
+		if res.Healthy {
+			networkHealthy.Set(1)
+			log.Printf("smoke test: network healthy")
+		} else {
+			networkHealthy.Set(0)
+		}
+		for _, c := range res.Checks {
+			if c.OK {
+				smokeCheckOK.WithLabelValues(c.Name).Set(1)
+			} else {
+				smokeCheckOK.WithLabelValues(c.Name).Set(0)
+				log.Printf("smoke test: %s failed: %s", c.Name, c.Detail)
+			}
+		}
+	}()
+}
+
+// Result returns the result of the smoke test after the last Apply, or nil
+// if it is still pending.
+func (s *smokeTester) Result() *netconfig.SmokeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *smokeTester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(s.Result())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/usage"
+)
+
+// usageCollector accounts conntrack byte counters to LAN devices.
+type usageCollector struct {
+	dir string
+
+	mu sync.Mutex
+	c  *usage.Collector
+}
+
+func newUsageCollector(dir string) (*usageCollector, error) {
+	// Byte counters are only maintained with accounting enabled.
+	if err := ioutil.WriteFile("/proc/sys/net/netfilter/nf_conntrack_acct", []byte("1"), 0644); err != nil {
+		log.Printf("enabling conntrack accounting: %v", err)
+	}
+	c, err := usage.NewCollector(dir, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &usageCollector{dir: dir, c: c}, nil
+}
+
+// lookup returns a usage.DeviceFunc which resolves addresses using the
+// neighbor table of lan0 and the hostnames of the DHCPv4 leases.
+func (u *usageCollector) lookup() (usage.DeviceFunc, error) {
+	link, err := netlink.LinkByName("lan0")
+	if err != nil {
+		return nil, err
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	hwaddrs := make(map[string]string, len(neighs))
+	for _, n := range neighs {
+		if n.HardwareAddr == nil || n.State&(netlink.NUD_FAILED|netlink.NUD_INCOMPLETE) != 0 {
+			continue
+		}
+		hwaddrs[n.IP.String()] = n.HardwareAddr.String()
+	}
+	hostnames := make(map[string]string)
+	if b, err := ioutil.ReadFile(filepath.Join(u.dir, "dhcp4d/leases.json")); err == nil {
+		var leases []dhcp4d.Lease
+		if err := json.Unmarshal(b, &leases); err == nil {
+			for _, l := range leases {
+				hostname := l.Hostname
+				if l.HostnameOverride != "" {
+					hostname = l.HostnameOverride
+				}
+				hostnames[l.HardwareAddr] = hostname
+			}
+		}
+	}
+	return func(ip net.IP) (string, string, bool) {
+		hwaddr, ok := hwaddrs[ip.String()]
+		return hwaddr, hostnames[hwaddr], ok
+	}, nil
+}
+
+func (u *usageCollector) collect() error {
+	lookup, err := u.lookup()
+	if err != nil {
+		return err
+	}
+	var flows []*netlink.ConntrackFlow
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		f, err := netlink.ConntrackTableList(netlink.ConntrackTable, family)
+		if err != nil {
+			return err
+		}
+		flows = append(flows, f...)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.c.Collect(time.Now(), flows, lookup)
+}
+
+func (u *usageCollector) persist() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.c.Persist()
+}
+
+// run collects every minute and persists every 15 minutes.
+func (u *usageCollector) run() {
+	persist := time.Tick(15 * time.Minute)
+	for range time.Tick(1 * time.Minute) {
+		if err := u.collect(); err != nil {
+			log.Printf("collecting usage: %v", err)
+		}
+		select {
+		case <-persist:
+			if err := u.persist(); err != nil {
+				log.Printf("persisting usage: %v", err)
+			}
+		default:
+		}
+	}
+}
+
+func serveSummary(w http.ResponseWriter, s *usage.Summary) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		log.Printf("encoding usage summary: %v", err)
+	}
+}
+
+func parseDate(r *http.Request, key string, def time.Time) (time.Time, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return def, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, time.Local)
+}
+
+// dailyHandler returns the per-device usage of a day (default: today), e.g.:
+//
+//	curl 'http://router7:8066/usage/daily?date=2020-06-01'
+func (u *usageCollector) dailyHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	day, err := parseDate(r, "date", now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u.mu.Lock()
+	today := u.c.Summary()
+	u.mu.Unlock()
+	if day.Format("2006-01-02") == today.Start {
+		serveSummary(w, today)
+		return
+	}
+	s, err := usage.ReadDay(u.dir, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveSummary(w, s)
+}
+
+// weeklyHandler returns the per-device usage of the week starting on the
+// specified Monday (default: the current week), e.g.:
+//
+//	curl 'http://router7:8066/usage/weekly?start=2020-06-01'
+func (u *usageCollector) weeklyHandler(w http.ResponseWriter, r *http.Request) {
+	start, err := parseDate(r, "start", usage.WeekStart(time.Now()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Include the traffic of today which was not yet persisted.
+	if err := u.persist(); err != nil {
+		log.Printf("persisting usage: %v", err)
+	}
+	s, err := usage.ReadWeek(u.dir, start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveSummary(w, s)
+}
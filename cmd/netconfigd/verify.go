@@ -0,0 +1,96 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+var (
+	verifyInterval = flag.Duration("verify_interval", 1*time.Minute, "how often to compare the kernel state against the configuration (0 disables verification)")
+	repairDrift    = flag.Bool("repair_drift", true, "re-apply the configuration when the kernel state drifted (otherwise, drift is only logged)")
+)
+
+var (
+	driftDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netconfig_drift_detected_total",
+		Help: "number of verifications which found the kernel state to differ from the configuration",
+	}, []string{"kind"})
+	driftRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netconfig_drift_repairs_total",
+		Help: "number of times the configuration was re-applied to repair drift",
+	}, []string{"kind"})
+)
+
+// verify compares the kernel state against the configuration in dir and
+// reports whether the configuration needs to be re-applied.
+func verify(dir string) bool {
+	var repair bool
+	for _, check := range []struct {
+		kind string
+		fn   func(dir string) ([]string, error)
+	}{
+		{"nftables", netconfig.VerifyFirewall},
+		{"routes", netconfig.VerifyRoutes},
+	} {
+		diffs, err := check.fn(dir)
+		if err != nil {
+			log.Printf("verifying %s: %v", check.kind, err)
+			continue
+		}
+		if len(diffs) == 0 {
+			continue
+		}
+		driftDetected.WithLabelValues(check.kind).Inc()
+		for _, d := range diffs {
+			log.Printf("%s drift: %s", check.kind, d)
+		}
+		if *repairDrift {
+			driftRepairs.WithLabelValues(check.kind).Inc()
+			repair = true
+		}
+	}
+	return repair
+}
+
+// await blocks until a re-apply is requested via ch, or until the periodic
+// verification detects drift which should be repaired. Verification runs in
+// the same goroutine as netconfig.Apply so that it never observes a
+// half-applied state.
+func await(dir string, ch <-chan os.Signal) {
+	if *verifyInterval == 0 {
+		<-ch
+		return
+	}
+	ticker := time.NewTicker(*verifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch:
+			return
+		case <-ticker.C:
+			if verify(dir) {
+				return
+			}
+		}
+	}
+}
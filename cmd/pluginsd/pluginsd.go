@@ -0,0 +1,182 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary pluginsd runs the plugins of /perm/plugins.json (restarting them when
+// they exit) and serves the plugin API (see package plugin) to them: events,
+// firewall fragments and status. Configuration changes take effect when
+// pluginsd is restarted.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/netns"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/plugin"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+// supervisor runs plugins until stopped.
+type supervisor struct {
+	mu      sync.Mutex
+	stopped bool
+	running map[string]*exec.Cmd
+}
+
+// run runs p attached to the plugin API of srv, restarting it with increasing
+// delay when it exits.
+func (s *supervisor) run(srv *plugin.Server, p plugin.Plugin) {
+	b := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+	}
+	for {
+		cmd := exec.Command(p.Path, p.Args...)
+		cmd.Env = append(os.Environ(), plugin.EnvName+"="+p.Name)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		api, err := srv.Attach(p.Name, cmd)
+		if err == nil {
+			s.mu.Lock()
+			if s.stopped {
+				s.mu.Unlock()
+				api.Close()
+				return
+			}
+			err = cmd.Start()
+			if err == nil {
+				s.running[p.Name] = cmd
+			}
+			s.mu.Unlock()
+			if err == nil {
+				start := time.Now()
+				err = cmd.Wait()
+				s.mu.Lock()
+				delete(s.running, p.Name)
+				s.mu.Unlock()
+				if time.Since(start) > b.Max {
+					b.Reset() // ran long enough to not be crash-looping
+				}
+			}
+			api.Close()
+		}
+		delay := b.Duration()
+		log.Printf("plugin %s exited: %v, restarting in %v", p.Name, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// stop terminates all running plugins and prevents restarts.
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for name, cmd := range s.running {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("plugin %s: %v", name, err)
+		}
+	}
+}
+
+func logic() error {
+	cfg, err := plugin.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/plugins.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+
+	// Fragments of plugins which are no longer configured are removed.
+	configured := make(map[string]bool)
+	for _, p := range cfg.Plugins {
+		configured[p.Name] = true
+	}
+	fragments, err := netconfig.ReadFirewallFragments(*perm)
+	if err != nil {
+		return err
+	}
+	var removed bool
+	for name := range fragments {
+		if configured[name] {
+			continue
+		}
+		if err := netconfig.RemoveFirewallFragment(*perm, name); err != nil {
+			return err
+		}
+		log.Printf("removed firewall fragment of plugin %s", name)
+		removed = true
+	}
+
+	notifyNetconfigd := func() {
+		if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+			log.Printf("notifying netconfigd: %v", err)
+		}
+	}
+	if removed {
+		notifyNetconfigd()
+	}
+
+	srv := plugin.NewServer(*perm)
+	srv.FirewallChanged = notifyNetconfigd
+	errc := make(chan error, 1)
+	go func() { errc <- http.ListenAndServe(plugin.Addr, freeze.Guard(*perm, srv, "/publish")) }()
+
+	sup := &supervisor{running: make(map[string]*exec.Cmd)}
+	for _, p := range cfg.Plugins {
+		log.Printf("starting plugin %s (%s)", p.Name, p.Path)
+		go sup.run(srv, p)
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		sup.stop()
+		return err
+	case <-ch:
+		log.Printf("SIGTERM received, terminating plugins")
+		sup.stop()
+		return nil
+	}
+}
+
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
+func main() {
+	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary pppoe establishes a PPPoE session with the credentials of
+// /perm/pppoe.json, persists the negotiated configuration to
+// /perm/pppoe/wire/lease.json and notifies netconfigd and dnsd, which install
+// the address and default route of the ppp0 interface like those of a DHCP
+// lease. SIGUSR2 terminates the session and quits.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/jpillora/backoff"
+	"github.com/rtr7/router7/internal/netns"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/pppoe"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	perm     = flag.String("perm", "/perm", "path to replace /perm")
+	stateDir = flag.String("state_dir", "/perm/pppoe", "directory in which to store lease data (wire/lease.json)")
+	unit     = flag.Int("unit", 0, "number N of the pppN interface to create")
+)
+
+func notifyLease() {
+	if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+		log.Printf("notifying netconfig: %v", err)
+	}
+	if err := notify.Process("/user/dnsd", syscall.SIGUSR1); err != nil {
+		log.Printf("notifying dnsd: %v", err)
+	}
+}
+
+func logic() error {
+	cfg, err := pppoe.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/pppoe.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	leasePath := filepath.Join(*stateDir, "wire/lease.json")
+	if err := os.MkdirAll(filepath.Dir(leasePath), 0755); err != nil {
+		return err
+	}
+	writeLease := func(l pppoe.Lease) {
+		log.Printf("lease: %+v", l)
+		b, err := json.Marshal(l)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if err := renameio.WriteFile(leasePath, b, 0644); err != nil {
+			log.Printf("persisting lease to %s: %v", leasePath, err)
+			return
+		}
+		notifyLease()
+	}
+	// removeLease makes netconfigd stop configuring the (gone) ppp interface,
+	// e.g. so that a backup uplink takes over the default route.
+	removeLease := func() {
+		if err := os.Remove(leasePath); err != nil {
+			if !os.IsNotExist(err) {
+				log.Print(err)
+			}
+			return
+		}
+		notifyLease()
+	}
+
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	backoff := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    10 * time.Second,
+		Max:    1 * time.Minute,
+	}
+	for {
+		done := make(chan struct{})
+		errc := make(chan error, 1)
+		start := time.Now()
+		go func() { errc <- pppoe.Run(cfg, *unit, done, writeLease) }()
+		select {
+		case err = <-errc:
+		case <-usr2:
+			log.Printf("SIGUSR2 received, terminating session")
+			close(done)
+			if err := <-errc; err != nil {
+				log.Print(err)
+			}
+			removeLease()
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		removeLease()
+		if time.Since(start) > backoff.Max {
+			backoff.Reset() // the session was established for a while
+		}
+		dur := backoff.Duration()
+		log.Printf("Temporary error: %v (waiting %v)", err, dur)
+		select {
+		case <-time.After(dur):
+		case <-usr2:
+			os.Exit(125) // quit supervision by gokrazy
+		}
+	}
+}
+
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
+func main() {
+	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary pppoed is a PPPoE server (access concentrator) on the interface of
+// /perm/pppoed.json, e.g. for using router7 as a lab BRAS or to terminate the
+// sessions of a downstream bridged modem. Clients are authenticated against
+// local accounts or a RADIUS server, which also receives accounting records.
+// SIGTERM terminates all sessions.
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rtr7/router7/internal/netns"
+	"github.com/rtr7/router7/internal/pppoe"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+func logic() error {
+	cfg, err := pppoe.ReadServerConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/pppoed.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	srv, err := pppoe.NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving PPPoE (AC-Name %q) on %s, pool %s", cfg.ACName, cfg.Interface, cfg.Pool)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM)
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ch:
+		log.Printf("SIGTERM received, terminating sessions")
+		return srv.Close()
+	}
+}
+
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
+func main() {
+	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
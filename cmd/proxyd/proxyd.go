@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary proxyd runs an authenticated SOCKS5 and HTTP egress proxy for LAN
+// clients whose outbound (e.g. a backup uplink or a WireGuard tunnel) is
+// selected per rule, configured via /perm/proxy.json.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/gokrazy/gokrazy"
+
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/proxy"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+var listeners = multilisten.NewPool()
+
+// listener adapts proxy.Proxy.Serve to multilisten.Listener.
+type listener struct {
+	addr  string
+	proxy *proxy.Proxy
+
+	mu sync.Mutex
+	ln net.Listener
+}
+
+func (l *listener) ListenAndServe() error {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.ln = ln
+	l.mu.Unlock()
+	return l.proxy.Serve(ln)
+}
+
+func (l *listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln == nil {
+		return nil
+	}
+	return l.ln.Close()
+}
+
+func updateListeners(p *proxy.Proxy, port uint16) error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	listeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &listener{
+			addr:  net.JoinHostPort(host, strconv.Itoa(int(port))),
+			proxy: p,
+		}
+	})
+	return nil
+}
+
+func logic() error {
+	cfg, err := proxy.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/proxy.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	p := proxy.NewProxy()
+	if err := p.SetConfig(cfg); err != nil {
+		return err
+	}
+	// The port is only read at startup, as multilisten.Pool keys listeners
+	// by host.
+	port := cfg.Port
+	if err := updateListeners(p, port); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(p, port); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		cfg, err := proxy.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			continue
+		}
+		if err := p.SetConfig(cfg); err != nil {
+			log.Printf("SetConfig: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -26,6 +26,8 @@ import (
 	"syscall"
 
 	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/netns"
 	"github.com/rtr7/router7/internal/radvd"
 )
 
@@ -51,7 +53,34 @@ func logic() error {
 			}
 		}
 
-		srv.SetPrefixes(append(cfg.Prefixes, additional...))
+		// Announce the subnet of the delegated prefixes which netconfig
+		// configures on lan0 (see ipv6_subnet in interfaces.json).
+		subnets, err := netconfig.IPv6Subnets("/perm")
+		if err != nil {
+			return err
+		}
+		idx, ok := subnets["lan0"]
+		if !ok || idx < 0 {
+			cfg.Prefixes = nil
+		}
+
+		prefixes := make([]radvd.Prefix, 0, len(cfg.Prefixes)+len(additional))
+		for i, p := range cfg.Prefixes {
+			subnet, err := netconfig.Subnet(p, idx)
+			if err != nil {
+				return err
+			}
+			prefix := radvd.Prefix{IPNet: subnet}
+			if i < len(cfg.Lifetimes) {
+				prefix.PreferredUntil = cfg.Lifetimes[i].PreferredUntil
+				prefix.ValidUntil = cfg.Lifetimes[i].ValidUntil
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		for _, p := range additional {
+			prefixes = append(prefixes, radvd.Prefix{IPNet: p})
+		}
+		srv.SetPrefixes(prefixes)
 		return nil
 	}
 	if err := readConfig(); err != nil {
@@ -69,9 +98,14 @@ func logic() error {
 	return srv.ListenAndServe("lan0")
 }
 
+var netnsName = flag.String("netns", "", "network namespace to run in (name created by ip netns add, or path), e.g. for development in a container")
+
 func main() {
 	// TODO: drop privileges, run as separate uid?
 	flag.Parse()
+	if err := netns.Enter(*netnsName); err != nil {
+		log.Fatal(err)
+	}
 	if err := logic(); err != nil {
 		log.Fatal(err)
 	}
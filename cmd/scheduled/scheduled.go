@@ -0,0 +1,154 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary scheduled runs maintenance tasks (e.g. blocklist refreshes,
+// speedtests, backups, certificate renewals) on the schedules configured in
+// /perm/schedule.json and reports their last-run status.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gokrazy/gokrazy"
+
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/scheduler"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+var httpListeners = multilisten.NewPool()
+
+func updateListeners() error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8071"),
+			Handler: profiling.Handler(freeze.Guard(*perm, http.DefaultServeMux)),
+		}
+	})
+	return nil
+}
+
+func logic() error {
+	tasks, err := scheduler.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/schedule.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	s, err := scheduler.New(tasks)
+	if err != nil {
+		return err
+	}
+	loaded := tasks
+
+	var (
+		mu     sync.Mutex
+		cancel context.CancelFunc
+	)
+	start := func(next *scheduler.Scheduler) {
+		mu.Lock()
+		defer mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		s = next
+		go next.Run(ctx)
+	}
+	current := func() *scheduler.Scheduler {
+		mu.Lock()
+		defer mu.Unlock()
+		return s
+	}
+	start(s)
+
+	http.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(current().Status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	http.HandleFunc("/run/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/run/")
+		if err := current().RunNow(r.Context(), name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		tasks, err := scheduler.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			continue
+		}
+		if reflect.DeepEqual(tasks, loaded) {
+			continue // do not interrupt running tasks (e.g. on address changes)
+		}
+		loaded = tasks
+		next, err := scheduler.New(tasks)
+		if err != nil {
+			log.Printf("scheduler.New: %v", err)
+			continue
+		}
+		start(next)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary sitelinkd exchanges the LAN prefixes of this router with the other
+// router7 sites of /perm/sites.json over their WireGuard tunnel. The prefixes
+// learned from each site are persisted for netconfigd, which allows them as
+// WireGuard peer IPs and installs routes and forward accept rules for them.
+//
+// To connect two sites, run sitelinkd -invite on each router and add the
+// printed entry to /perm/sites.json of the respective other router.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/sitelink"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	perm = flag.String("perm", "/perm", "path to replace /perm")
+
+	invite = flag.Bool("invite",
+		false,
+		"print the sites.json entry for this router (to add on the other site) and exit")
+
+	inviteName = flag.String("invite_name",
+		"",
+		"with -invite: name of this site (default: hostname)")
+
+	inviteEndpoint = flag.String("invite_endpoint",
+		"",
+		"with -invite: public host:port at which the other site reaches this router’s WireGuard interface (optional)")
+
+	interval = flag.Duration("interval",
+		1*time.Minute,
+		"how often to fetch the prefixes of the sites")
+)
+
+// printInvite prints the site entry under which the other site knows this
+// router.
+func printInvite(cfg netconfig.SitesConfig) error {
+	publicKey, err := netconfig.WireGuardPublicKey(*perm, cfg.Interface)
+	if err != nil {
+		return err
+	}
+	addr, err := netconfig.LinkAddress(*perm, cfg.Interface)
+	if err != nil {
+		return err
+	}
+	name := *inviteName
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(netconfig.Site{
+		Name:       name,
+		PublicKey:  publicKey,
+		Endpoint:   *inviteEndpoint,
+		TunnelAddr: addr.String(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Add the following entry to the sites of /perm/sites.json on the other router:\n%s\n", b)
+	return nil
+}
+
+type daemon struct {
+	listeners *multilisten.Pool
+
+	mu      sync.Mutex
+	handler http.Handler
+	learned map[string][]string // prefixes by site name
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	h := d.handler
+	d.mu.Unlock()
+	h.ServeHTTP(w, r)
+}
+
+// update (re-)starts serving the local prefixes with configuration cfg and
+// fetches the prefixes of its sites. netconfigd is notified when the learned
+// prefixes changed.
+func (d *daemon) update(cfg netconfig.SitesConfig) error {
+	name, _ := os.Hostname()
+	local := func() ([]string, error) { return sitelink.LocalPrefixes(*perm, cfg.Interface) }
+	d.mu.Lock()
+	d.handler = sitelink.Handler(name, cfg, local)
+	d.mu.Unlock()
+
+	if addr, err := netconfig.LinkAddress(*perm, cfg.Interface); err != nil {
+		log.Printf("not serving prefixes: %v", err)
+	} else {
+		// Keyed by host and port, so that a port change restarts the
+		// listener.
+		hostport := net.JoinHostPort(addr.String(), strconv.Itoa(cfg.Port))
+		d.listeners.ListenAndServe([]string{hostport}, func(hostport string) multilisten.Listener {
+			return &http.Server{
+				Addr:    hostport,
+				Handler: d,
+			}
+		})
+	}
+
+	localPrefixes, err := local()
+	if err != nil {
+		return err
+	}
+	reserved := sitelink.ParseNets(localPrefixes)
+	for _, s := range cfg.Sites {
+		reserved = append(reserved, s.TunnelNet())
+	}
+	sites := append([]netconfig.Site(nil), cfg.Sites...)
+	sort.Slice(sites, func(i, j int) bool { return sites[i].Name < sites[j].Name })
+	learned := make(map[string][]string)
+	for _, s := range sites {
+		prefixes, err := sitelink.Fetch(s, cfg.Port)
+		if err != nil {
+			// Keep the previously learned prefixes: the routes of an
+			// unreachable site are harmless, and withdrawing them would
+			// re-configure netconfigd on every connectivity blip.
+			log.Printf("site %s: %v", s.Name, err)
+			prefixes = d.learned[s.Name]
+		}
+		accepted, err := sitelink.Filter(prefixes, reserved)
+		if err != nil {
+			log.Printf("site %s: %v", s.Name, err)
+		}
+		if len(accepted) > 0 {
+			learned[s.Name] = accepted
+		}
+		// The prefixes of a site cannot be claimed by the following sites.
+		reserved = append(reserved, sitelink.ParseNets(accepted)...)
+	}
+	if reflect.DeepEqual(learned, d.learned) {
+		return nil
+	}
+	log.Printf("learned prefixes changed: %v", learned)
+	if err := netconfig.WriteSitePrefixes(*perm, learned); err != nil {
+		return err
+	}
+	d.learned = learned
+	if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+		log.Printf("notifying netconfigd: %v", err)
+	}
+	return nil
+}
+
+func logic() error {
+	cfg, err := netconfig.ReadSites(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if *invite {
+				// The first site of this router: invite with defaults.
+				return printInvite(netconfig.SitesConfig{Interface: "wg0"})
+			}
+			log.Printf("%s/sites.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	if *invite {
+		return printInvite(cfg)
+	}
+	learned, err := netconfig.ReadSitePrefixes(*perm)
+	if err != nil {
+		return err
+	}
+	d := &daemon{
+		listeners: multilisten.NewPool(),
+		learned:   learned,
+	}
+	if err := d.update(cfg); err != nil {
+		log.Printf("update: %v", err)
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for {
+		select {
+		case <-ch:
+		case <-time.After(*interval):
+		}
+		newCfg, err := netconfig.ReadSites(*perm)
+		if err != nil {
+			log.Printf("ReadSites: %v", err)
+			continue
+		}
+		cfg = newCfg
+		if err := d.update(cfg); err != nil {
+			log.Printf("update: %v", err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
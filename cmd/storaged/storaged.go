@@ -0,0 +1,187 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary storaged enforces the size budgets of /perm/storage.json, monitors
+// free space and flash wear of the permanent partition and sends alerts
+// before it fills up.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/rtr7/router7/internal/alert"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/storage"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+var (
+	freeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "storage",
+		Name:      "free_bytes",
+		Help:      "bytes available on the permanent partition",
+	})
+	totalBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "storage",
+		Name:      "size_bytes",
+		Help:      "size of the permanent partition",
+	})
+	writtenBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "storage",
+		Name:      "written_bytes",
+		Help:      "bytes written to the device holding the permanent partition since boot",
+	})
+	wearRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "storage",
+		Name:      "wear_ratio",
+		Help:      "estimated used flash life time (-0.01 if unknown)",
+	})
+	budgetBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "storage",
+		Name:      "budget_used_bytes",
+		Help:      "bytes used by a budgeted directory",
+	}, []string{"path"})
+	rotatedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "storage",
+		Name:      "rotated_bytes_total",
+		Help:      "bytes deleted to stay within a budget",
+	}, []string{"path"})
+)
+
+var httpListeners = multilisten.NewPool()
+
+func updateListeners() error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8072"),
+			Handler: profiling.Handler(http.DefaultServeMux),
+		}
+	})
+	return nil
+}
+
+func logic() error {
+	m := storage.NewManager(*perm)
+	notifier := alert.Load(*perm)
+
+	var (
+		mu                sync.Mutex
+		last              *storage.Status
+		freeLow, wearHigh bool // notified
+	)
+	check := func() {
+		cfg, err := storage.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			return
+		}
+		st, err := m.Check(cfg, time.Now())
+		if err != nil {
+			log.Printf("Check: %v", err)
+			return
+		}
+		freeBytes.Set(float64(st.FreeBytes))
+		totalBytes.Set(float64(st.TotalBytes))
+		writtenBytes.Set(float64(st.WrittenBytes))
+		wearRatio.Set(st.WearPercent / 100)
+		for _, b := range st.Budgets {
+			budgetBytes.WithLabelValues(b.Path).Set(float64(b.Bytes))
+			if b.RotatedFiles > 0 {
+				log.Printf("%s: rotated %d files (%d bytes) to stay within %d bytes", b.Path, b.RotatedFiles, b.RotatedBytes, b.MaxBytes)
+				rotatedBytes.WithLabelValues(b.Path).Add(float64(b.RotatedBytes))
+			}
+		}
+		if st.FreeLow && !freeLow {
+			notifier.Notify(alert.Event{
+				Type:    alert.EventStorageLow,
+				Title:   "/perm running out of space",
+				Message: fmt.Sprintf("only %.1f%% (%d bytes) of %s are free; budgets are halved until free space recovers", st.FreePercent, st.FreeBytes, *perm),
+			})
+		}
+		freeLow = st.FreeLow
+		if st.WearHigh && !wearHigh {
+			notifier.Notify(alert.Event{
+				Type:    alert.EventStorageWear,
+				Title:   "flash wear",
+				Message: fmt.Sprintf("the device holding %s estimates up to %.0f%% of its life time used; consider replacing it", *perm, st.WearPercent),
+			})
+		}
+		wearHigh = st.WearHigh
+		mu.Lock()
+		last = st
+		mu.Unlock()
+	}
+	check()
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			check()
+		}
+	}()
+
+	http.HandleFunc("/status.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		b, err := json.Marshal(last)
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	http.Handle("/metrics", promhttp.Handler())
+
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary syslogd receives syslog messages from LAN devices (access points,
+// NAS, cameras) and stores them in /perm/log/syslog, one directory per
+// device, with the per-device retention of /perm/syslog.json.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+
+	"github.com/rtr7/router7/internal/accesspoint"
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/syslog"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+var (
+	httpListeners   = multilisten.NewPool()
+	syslogListeners = multilisten.NewPool()
+)
+
+func updateListeners(c *syslog.Collector) error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8074"),
+			Handler: profiling.Handler(http.DefaultServeMux),
+		}
+	})
+	syslogListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &syslog.Server{
+			Addr:      net.JoinHostPort(host, "514"),
+			Collector: c,
+		}
+	})
+	return nil
+}
+
+func logic() error {
+	c := syslog.NewCollector(filepath.Join(*perm, "log", "syslog"))
+	defer c.Close()
+
+	enforce := func() {
+		cfg, err := syslog.ReadConfig(*perm)
+		if err != nil {
+			log.Printf("ReadConfig: %v", err)
+			return
+		}
+		statuses, err := c.Enforce(cfg, time.Now())
+		if err != nil {
+			log.Printf("Enforce: %v", err)
+		}
+		for _, bs := range statuses {
+			if bs.RotatedFiles > 0 {
+				log.Printf("%s: rotated %d files (%d bytes)", bs.Path, bs.RotatedFiles, bs.RotatedBytes)
+			}
+		}
+	}
+	updateNames := func() {
+		leases, err := accesspoint.ReadLeases(*perm)
+		if err != nil {
+			log.Printf("ReadLeases: %v", err)
+			return
+		}
+		c.SetNames(leases, time.Now())
+	}
+	updateNames()
+	enforce()
+	go func() {
+		for i := 1; ; i++ {
+			time.Sleep(1 * time.Minute)
+			updateNames()
+			if i%10 == 0 {
+				enforce()
+			}
+		}
+	}()
+
+	http.HandleFunc("/sources.json", func(w http.ResponseWriter, r *http.Request) {
+		sources, err := c.Sources()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(sources)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	http.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+		date := r.FormValue("date")
+		if date == "" {
+			date = time.Now().UTC().Format("2006-01-02")
+		}
+		path, err := c.Path(r.FormValue("source"), date)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeFile(w, r, path)
+	})
+
+	if err := updateListeners(c); err != nil {
+		return err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := updateListeners(c); err != nil {
+			log.Printf("updateListeners: %v", err)
+		}
+		updateNames()
+		enforce()
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
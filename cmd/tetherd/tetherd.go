@@ -0,0 +1,245 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary tetherd detects phones which are plugged in via USB tethering,
+// renames their network interface to tether0 and obtains a DHCPv4 lease,
+// which netconfigd uses as a low-priority backup uplink. The lease is removed
+// when the phone is unplugged.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/jpillora/backoff"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+var perm = flag.String("perm", "/perm", "path to replace /perm")
+
+const tetherInterface = "tether0"
+
+// tetherDrivers are the kernel drivers of USB tethering network interfaces
+// (Android: rndis_host or cdc_ncm, iOS: ipheth).
+var tetherDrivers = map[string]bool{
+	"rndis_host": true,
+	"cdc_ncm":    true,
+	"cdc_ether":  true,
+	"ipheth":     true,
+}
+
+func driver(ifname string) string {
+	target, err := os.Readlink(filepath.Join("/sys/class/net", ifname, "device", "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+func isTether(link netlink.Link) bool {
+	name := link.Attrs().Name
+	if name == tetherInterface {
+		return true
+	}
+	if strings.HasPrefix(name, "wwan") {
+		return false // LTE modems using cdc_ether are managed by wwand
+	}
+	return tetherDrivers[driver(name)]
+}
+
+func notifyNetconfigd() {
+	if err := notify.Process("/user/netconfigd", syscall.SIGUSR1); err != nil {
+		log.Printf("notifying netconfig: %v", err)
+	}
+}
+
+// lease persists the DHCP lease of one tethering session. Writing and
+// removing the lease file happen under the same lock, and once the lease was
+// removed (the device was unplugged), writes of the still running DHCP client
+// are discarded, so that a stale lease cannot reappear.
+type lease struct {
+	path string
+
+	mu      sync.Mutex
+	removed bool
+}
+
+// write persists b, unless the lease was removed. It returns whether the
+// lease was written.
+func (l *lease) write(b []byte) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.removed {
+		return false, nil
+	}
+	if err := renameio.WriteFile(l.path, b, 0644); err != nil {
+		return false, fmt.Errorf("persisting lease to %s: %v", l.path, err)
+	}
+	return true, nil
+}
+
+// remove removes the lease and discards subsequent writes.
+func (l *lease) remove() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removed = true
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func dhcp(l *lease, stop <-chan struct{}) error {
+	iface, err := net.InterfaceByName(tetherInterface)
+	if err != nil {
+		return err
+	}
+	c := dhcp4.Client{
+		Interface: iface,
+	}
+	backoff := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    1 * time.Second,
+		Max:    1 * time.Minute,
+	}
+	for c.ObtainOrRenew() {
+		if err := c.Err(); err != nil {
+			dur := backoff.Duration()
+			log.Printf("Temporary error: %v (waiting %v)", err, dur)
+			select {
+			case <-time.After(dur):
+				continue
+			case <-stop:
+				return nil
+			}
+		}
+		backoff.Reset()
+		log.Printf("lease: %+v", c.Config())
+		b, err := json.Marshal(c.Config())
+		if err != nil {
+			return err
+		}
+		written, err := l.write(b)
+		if err != nil {
+			return err
+		}
+		if !written {
+			return nil // unplugged
+		}
+		notifyNetconfigd()
+		select {
+		case <-time.After(time.Until(c.Config().RenewAfter)):
+			// fallthrough and renew the DHCP lease
+		case <-stop:
+			return nil
+		}
+	}
+	return c.Err() // permanent error
+}
+
+// setup renames link to tether0 (if required) and brings it up.
+func setup(link netlink.Link) error {
+	if link.Attrs().Name != tetherInterface {
+		log.Printf("renaming %s (driver %s) to %s", link.Attrs().Name, driver(link.Attrs().Name), tetherInterface)
+		if err := netlink.LinkSetDown(link); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetName(link, tetherInterface); err != nil {
+			return err
+		}
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func logic() error {
+	leasePath := netconfig.BackupLeasePath(*perm, tetherInterface)
+	if err := os.MkdirAll(filepath.Dir(leasePath), 0755); err != nil {
+		return err
+	}
+
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		ListExisting: true,
+	}); err != nil {
+		return err
+	}
+
+	var (
+		active int // interface index of the tethering device, if any
+		stop   chan struct{}
+		l      *lease
+	)
+	for update := range updates {
+		idx := update.Link.Attrs().Index
+		switch update.Header.Type {
+		case unix.RTM_NEWLINK:
+			if active != 0 || !isTether(update.Link) {
+				continue
+			}
+			if err := setup(update.Link); err != nil {
+				log.Printf("setting up %s: %v", update.Link.Attrs().Name, err)
+				continue
+			}
+			log.Printf("tethering device plugged in")
+			active = idx
+			stop = make(chan struct{})
+			l = &lease{path: leasePath}
+			go func(l *lease, stop <-chan struct{}) {
+				if err := dhcp(l, stop); err != nil {
+					log.Printf("dhcp: %v", err)
+				}
+			}(l, stop)
+
+		case unix.RTM_DELLINK:
+			if idx != active {
+				continue
+			}
+			log.Printf("tethering device unplugged")
+			close(stop)
+			active = 0
+			if err := l.remove(); err != nil {
+				log.Printf("removing lease: %v", err)
+			}
+			notifyNetconfigd()
+		}
+	}
+	return fmt.Errorf("netlink subscription closed")
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
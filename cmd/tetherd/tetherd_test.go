@@ -0,0 +1,59 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLeaseRemoved(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tetherd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	l := &lease{path: filepath.Join(tmp, "lease.json")}
+	if written, err := l.write([]byte(`{}`)); err != nil || !written {
+		t.Fatalf("write = %v, %v, want true, nil", written, err)
+	}
+
+	// The DHCP client writes while the device is being unplugged: no
+	// matter the order, no lease must remain.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if _, err := l.write([]byte(`{}`)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	if err := l.remove(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if _, err := os.Stat(l.path); !os.IsNotExist(err) {
+		t.Errorf("lease still exists after unplugging (err = %v)", err)
+	}
+	if written, err := l.write([]byte(`{}`)); err != nil || written {
+		t.Errorf("write after remove = %v, %v, want false, nil", written, err)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary wwand brings up an LTE/5G modem as backup uplink, configured via
+// /perm/wwan.json, and reports its signal strength and operator.
+//
+// Addressing is obtained by running cmd/dhcp4 with
+// -interface=wwan0 -state_dir=/perm/dhcp4/wwan0, after which netconfigd
+// installs a default route via wwan0 with a lower priority than uplink0.
+//
+// Modems are controlled either via AT commands or, with "protocol": "qmi", via
+// QMI on the qmi_wwan control device (e.g. /dev/cdc-wdm0). MBIM is not
+// supported. Unresponsive modems time out and the session is retried.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gokrazy/gokrazy"
+	"github.com/google/renameio"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/multilisten"
+	"github.com/rtr7/router7/internal/profiling"
+	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/wwan"
+)
+
+var log = teelogger.NewConsole()
+
+var (
+	perm     = flag.String("perm", "/perm", "path to replace /perm")
+	interval = flag.Duration("interval", 30*time.Second, "how often to query the modem status")
+)
+
+var (
+	signalDBm = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wwan_signal_dbm",
+		Help: "received signal strength of the modem in dBm",
+	})
+	registered = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "wwan_registered",
+		Help: "whether the modem is registered to a network",
+	})
+)
+
+var (
+	statusMu sync.Mutex
+	status   wwan.Status
+)
+
+var httpListeners = multilisten.NewPool()
+
+func updateListeners() error {
+	hosts, err := gokrazy.PrivateInterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	httpListeners.ListenAndServe(hosts, func(host string) multilisten.Listener {
+		return &http.Server{
+			Addr:    net.JoinHostPort(host, "8069"),
+			Handler: profiling.Handler(http.DefaultServeMux),
+		}
+	})
+	return nil
+}
+
+// openControlDevice opens the modem’s control device and, for AT command
+// ports, configures it for raw I/O.
+func openControlDevice(cfg wwan.Config) (*os.File, error) {
+	f, err := os.OpenFile(cfg.ControlDevice, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Protocol == "qmi" {
+		return f, nil // cdc-wdm character device, not a tty
+	}
+	// f.Fd() would switch f to blocking mode, which disables read
+	// deadlines, so configure the tty via SyscallConn instead.
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var terr error
+	if err := rc.Control(func(fd uintptr) { terr = makeRaw(int(fd)) }); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if terr != nil {
+		f.Close()
+		return nil, terr
+	}
+	return f, nil
+}
+
+func makeRaw(fd int) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
+
+func persistStatus(st wwan.Status) error {
+	statusMu.Lock()
+	status = st
+	statusMu.Unlock()
+	signalDBm.Set(float64(st.SignalDBm))
+	if st.Registered {
+		registered.Set(1)
+	} else {
+		registered.Set(0)
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	fn := filepath.Join(*perm, "wwan", "status.json")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(fn, b, 0644)
+}
+
+// session connects the modem and reports its status until an error occurs.
+// connected is called once the connection is established.
+func session(cfg wwan.Config, connected func()) error {
+	f, err := openControlDevice(cfg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var m wwan.Controller
+	if cfg.Protocol == "qmi" {
+		q := wwan.NewQMI(f)
+		defer q.Release()
+		m = q
+	} else {
+		m = wwan.NewModem(f)
+	}
+	if err := m.Init(cfg); err != nil {
+		return err
+	}
+	if err := m.Connect(cfg); err != nil {
+		return err
+	}
+	link, err := netlink.LinkByName(cfg.Interface)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	log.Printf("%s connected (apn %q)", cfg.Interface, cfg.APN)
+	connected()
+	for {
+		st, err := m.Status()
+		if err != nil {
+			return err
+		}
+		if err := persistStatus(st); err != nil {
+			log.Printf("persisting status: %v", err)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func logic() error {
+	cfg, err := wwan.ReadConfig(*perm)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("%s/wwan.json not found, not starting", *perm)
+			os.Exit(125) // quit supervision by gokrazy
+		}
+		return err
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	if err := updateListeners(); err != nil {
+		return err
+	}
+	backoff := backoff.Backoff{
+		Factor: 2,
+		Jitter: true,
+		Min:    10 * time.Second,
+		Max:    5 * time.Minute,
+	}
+	for {
+		// Retries start over at the minimum delay once a session
+		// connected, so that a dropped connection is re-established
+		// quickly.
+		err := session(cfg, backoff.Reset)
+		dur := backoff.Duration()
+		log.Printf("modem session failed: %v (retrying in %v)", err, dur)
+		time.Sleep(dur)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
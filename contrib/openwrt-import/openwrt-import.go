@@ -0,0 +1,123 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary openwrt-import converts the configuration of an OpenWrt router (or
+// the static leases of a dnsmasq.conf) into router7 configuration files,
+// e.g.:
+//
+//	scp -r root@openwrt:/etc/config /tmp/openwrt
+//	openwrt-import -config=/tmp/openwrt -out=/tmp/perm
+//
+// Review the resulting files (and the printed warnings) before copying them
+// to /perm of your router7 installation.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/rtr7/router7/internal/openwrt"
+)
+
+var (
+	configDir = flag.String("config",
+		"",
+		"directory containing the OpenWrt UCI files network, dhcp and firewall (i.e. a copy of /etc/config)")
+
+	dnsmasqConf = flag.String("dnsmasq",
+		"",
+		"path to a dnsmasq.conf whose dhcp-host lines are imported as static leases")
+
+	lan = flag.String("lan",
+		"192.168.42.1/24",
+		"lan0 address, unless configured in the OpenWrt network file")
+
+	out = flag.String("out",
+		"",
+		"directory to write the router7 configuration files to")
+)
+
+func parseUCI(name string) ([]*openwrt.Section, error) {
+	if *configDir == "" {
+		return nil, nil
+	}
+	f, err := os.Open(filepath.Join(*configDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	sections, err := openwrt.ParseUCI(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	return sections, nil
+}
+
+func logic() error {
+	if *out == "" {
+		return fmt.Errorf("-out must be specified")
+	}
+	if *configDir == "" && *dnsmasqConf == "" {
+		return fmt.Errorf("at least one of -config and -dnsmasq must be specified")
+	}
+	var err error
+	in := openwrt.Input{LAN: *lan}
+	if in.Network, err = parseUCI("network"); err != nil {
+		return err
+	}
+	if in.DHCP, err = parseUCI("dhcp"); err != nil {
+		return err
+	}
+	if in.Firewall, err = parseUCI("firewall"); err != nil {
+		return err
+	}
+	if *dnsmasqConf != "" {
+		f, err := os.Open(*dnsmasqConf)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		hosts, err := openwrt.ParseDnsmasq(f)
+		if err != nil {
+			return err
+		}
+		in.DHCP = append(in.DHCP, hosts...)
+	}
+	r, err := openwrt.Convert(in)
+	if err != nil {
+		return err
+	}
+	for _, w := range r.Warnings {
+		log.Printf("warning: %s", w)
+	}
+	if err := r.Write(*out); err != nil {
+		return err
+	}
+	log.Printf("converted %d interfaces, %d port forwardings and %d static leases into %s",
+		len(r.Interfaces.Interfaces), len(r.Forwardings), len(r.Leases), *out)
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logic(); err != nil {
+		log.Fatal(err)
+	}
+}
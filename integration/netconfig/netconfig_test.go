@@ -134,10 +134,21 @@ func goldenPortForwardings(additionalForwarding bool) string {
 }
 
 func goldenNftablesRules(additionalForwarding bool) string {
-	add := ""
+	add, addFilter := "", ""
 	if additionalForwarding {
 		add = `
 		iifname "uplink0" tcp dport 8045 dnat to 192.168.42.22:8045`
+		addFilter = `
+		iifname "uplink0" ip daddr 192.168.42.22 tcp dport 8045 accept`
+	}
+	wg4, wg6 := "", ""
+	if wireGuardAvailable {
+		wg4 = `
+		iifname "wg0" ip saddr 10.0.137.0/24 accept
+		iifname "wg0" ip saddr 10.0.0.0/8 accept`
+		wg6 = `
+		iifname "wg0" ip6 saddr fe80::/64 accept
+		iifname "wg1" ip6 saddr fe80::/64 accept`
 	}
 	return `table ip nat {
 	chain prerouting {
@@ -160,7 +171,11 @@ table ip filter {
 	chain forward {
 		type filter hook forward priority 0; policy accept;
 		oifname "uplink0" tcp flags 0x2 tcp option maxseg size set rt mtu
-		counter name "fwded"
+		counter name "fwded"` + wg4 + `
+		iifname "uplink0" ip daddr 192.168.42.23 tcp dport 9999 accept` + addFilter + `
+		iifname "uplink0" ip daddr 192.168.42.99 tcp dport 8040-8060 accept
+		iifname "uplink0" ip daddr 192.168.42.99 udp dport 53 accept
+		iifname "uplink0" ct state new drop
 	}
 }
 table ip6 filter {
@@ -171,7 +186,7 @@ table ip6 filter {
 	chain forward {
 		type filter hook forward priority 0; policy accept;
 		oifname "uplink0" tcp flags 0x2 tcp option maxseg size set rt mtu
-		counter name "fwded"
+		counter name "fwded"` + wg6 + `
 	}
 }`
 }
@@ -346,9 +361,9 @@ func TestNetconfig(t *testing.T) {
 		}
 
 		wantRoutes := []string{
-			"default via 85.195.207.1 proto dhcp src 85.195.207.62 ",
+			"default via 85.195.207.1 proto 70 src 85.195.207.62 ",
 			"85.195.207.0/25 proto kernel scope link src 85.195.207.62 ",
-			"85.195.207.1 proto dhcp scope link src 85.195.207.62",
+			"85.195.207.1 proto 70 scope link src 85.195.207.62",
 		}
 
 		routes, err := ipLines("-netns", ns, "route", "show", "dev", "uplink0")
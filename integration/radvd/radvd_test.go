@@ -72,8 +72,8 @@ func TestRouterAdvertisement(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	srv.SetPrefixes([]net.IPNet{
-		net.IPNet{IP: net.ParseIP("2a02:168:4a00::"), Mask: net.CIDRMask(64, 128)},
+	srv.SetPrefixes([]radvd.Prefix{
+		{IPNet: net.IPNet{IP: net.ParseIP("2a02:168:4a00::"), Mask: net.CIDRMask(64, 128)}},
 	})
 	conn, err := net.ListenIP("ip6:ipv6-icmp", &net.IPAddr{net.IPv6unspecified, ""})
 	if err != nil {
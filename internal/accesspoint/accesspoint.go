@@ -0,0 +1,317 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package accesspoint keeps an inventory of the Wi-Fi access points in the
+// LAN, discovered via their DHCP requests and LLDP announcements, lists their
+// clients and pushes the Wi-Fi networks of accesspoints.json to the access
+// points which support it (OpenWrt, via ubus).
+package accesspoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Network is a Wi-Fi network which all managed access points serve.
+type Network struct {
+	SSID       string `json:"ssid"`
+	Passphrase string `json:"passphrase"` // WPA2-PSK, empty for an open network
+
+	// VLAN tags the traffic of the network’s clients (e.g. 10 for lan0.10),
+	// default untagged. OpenWrt access points need a network interface
+	// named vlan<VLAN> bridging the VLAN.
+	VLAN int `json:"vlan"`
+}
+
+// Managed is an access point whose clients are listed and to which the
+// networks are pushed.
+type Managed struct {
+	HardwareAddr string `json:"hardware_addr"`
+	Type         string `json:"type"` // only openwrt
+	URL          string `json:"url"`  // e.g. http://192.168.42.3/ubus
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+}
+
+// Config is read from /perm/accesspoints.json.
+type Config struct {
+	Networks     []Network `json:"networks"`
+	AccessPoints []Managed `json:"access_points"`
+}
+
+// ReadConfig reads accesspoints.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "accesspoints.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Client is a Wi-Fi client associated with an access point.
+type Client struct {
+	HardwareAddr string `json:"hardware_addr"`
+	Interface    string `json:"interface"` // e.g. wlan0
+	Signal       int    `json:"signal"`    // in dBm, e.g. -61
+}
+
+// AccessPoint is an entry in the inventory.
+type AccessPoint struct {
+	HardwareAddr string    `json:"hardware_addr"`
+	Addr         string    `json:"addr,omitempty"`     // from the DHCP lease
+	Hostname     string    `json:"hostname,omitempty"` // from the DHCP lease or LLDP
+	Vendor       string    `json:"vendor,omitempty"`   // e.g. Ubiquiti
+	Sources      []string  `json:"sources"`            // dhcp, lldp and/or config
+	LastSeen     time.Time `json:"last_seen"`
+	Managed      bool      `json:"managed"`
+	Clients      []Client  `json:"clients,omitempty"`
+	Error        string    `json:"error,omitempty"` // of the last ubus request
+}
+
+// vendorClasses maps DHCP vendor class identifier (option 60) prefixes of
+// access point firmwares to vendors.
+var vendorClasses = []struct {
+	prefix string
+	vendor string
+}{
+	{"ubnt", "Ubiquiti"},
+	{"ArubaInstantAP", "Aruba"},
+	{"ArubaAP", "Aruba"},
+	{"Cisco AP", "Cisco"},
+	{"Ruckus CPE", "Ruckus"},
+	{"MERAKI", "Meraki"},
+}
+
+// leaseVendor returns the vendor of the access point which obtained l, or
+// the empty string if l was not obtained by an access point.
+func leaseVendor(l *dhcp4d.Lease) string {
+	for _, vc := range vendorClasses {
+		if strings.HasPrefix(l.VendorClass, vc.prefix) {
+			return vc.vendor
+		}
+	}
+	return ""
+}
+
+// Inventory is the set of known access points, persisted in
+// /perm/apd/inventory.json.
+type Inventory struct {
+	path string
+
+	mu   sync.Mutex
+	aps  map[string]*AccessPoint // by hardware address
+	lldp map[string]Neighbor     // by hardware address, not persisted
+}
+
+// LoadInventory returns the Inventory persisted in dir (if any).
+func LoadInventory(dir string) (*Inventory, error) {
+	inv := &Inventory{
+		path: filepath.Join(dir, "apd", "inventory.json"),
+		aps:  make(map[string]*AccessPoint),
+		lldp: make(map[string]Neighbor),
+	}
+	b, err := ioutil.ReadFile(inv.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return inv, nil
+		}
+		return nil, err
+	}
+	var list []*AccessPoint
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, ap := range list {
+		inv.aps[ap.HardwareAddr] = ap
+	}
+	return inv, nil
+}
+
+// Persist writes the inventory to disk. The inventory is persisted
+// periodically instead of on every change to limit flash wear.
+func (inv *Inventory) Persist() error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(inv.path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(inv.listLocked(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(inv.path, b, 0644)
+}
+
+func (inv *Inventory) listLocked() []AccessPoint {
+	list := make([]AccessPoint, 0, len(inv.aps))
+	for _, ap := range inv.aps {
+		list = append(list, *ap)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].HardwareAddr < list[j].HardwareAddr })
+	return list
+}
+
+// List returns the access points, sorted by hardware address.
+func (inv *Inventory) List() []AccessPoint {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.listLocked()
+}
+
+// Neighbors returns the LLDP neighbors (e.g. switches and access points)
+// observed since the process started, sorted by hardware address.
+func (inv *Inventory) Neighbors() []Neighbor {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	neighbors := make([]Neighbor, 0, len(inv.lldp))
+	for _, n := range inv.lldp {
+		neighbors = append(neighbors, n)
+	}
+	sort.Slice(neighbors, func(i, j int) bool { return neighbors[i].HardwareAddr < neighbors[j].HardwareAddr })
+	return neighbors
+}
+
+func addSource(ap *AccessPoint, source string) {
+	for _, s := range ap.Sources {
+		if s == source {
+			return
+		}
+	}
+	ap.Sources = append(ap.Sources, source)
+	sort.Strings(ap.Sources)
+}
+
+// observe records that the access point hwaddr was seen via source, calling
+// update (if non-nil) to update its details.
+func (inv *Inventory) observe(hwaddr, source string, at time.Time, update func(*AccessPoint)) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	ap, ok := inv.aps[hwaddr]
+	if !ok {
+		ap = &AccessPoint{HardwareAddr: hwaddr}
+		inv.aps[hwaddr] = ap
+		log.Printf("new access point %s (via %s)", hwaddr, source)
+	}
+	addSource(ap, source)
+	if at.After(ap.LastSeen) {
+		ap.LastSeen = at
+	}
+	if update != nil {
+		update(ap)
+	}
+}
+
+// UpdateLeases adds the access points which obtained one of leases to the
+// inventory.
+func (inv *Inventory) UpdateLeases(leases []*dhcp4d.Lease, now time.Time) {
+	for _, l := range leases {
+		vendor := leaseVendor(l)
+		if vendor == "" || l.Expired(now) {
+			continue
+		}
+		inv.observe(l.HardwareAddr, "dhcp", now, func(ap *AccessPoint) {
+			ap.Addr = l.Addr.String()
+			ap.Vendor = vendor
+			if l.HostnameOverride != "" {
+				ap.Hostname = l.HostnameOverride
+			} else if l.Hostname != "" {
+				ap.Hostname = l.Hostname
+			}
+		})
+	}
+}
+
+// ReadLeases reads the dhcp4d leases from dir.
+func ReadLeases(dir string) ([]*dhcp4d.Lease, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4d", "leases.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var leases []*dhcp4d.Lease
+	if err := json.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// ObserveLLDP records n (see Neighbors) and adds its sender to the inventory
+// if it announces the WLAN access point capability.
+func (inv *Inventory) ObserveLLDP(n Neighbor, now time.Time) {
+	inv.mu.Lock()
+	inv.lldp[n.HardwareAddr] = n
+	inv.mu.Unlock()
+	if !n.AccessPoint() {
+		return
+	}
+	inv.observe(n.HardwareAddr, "lldp", now, func(ap *AccessPoint) {
+		if n.SystemName != "" && ap.Hostname == "" {
+			ap.Hostname = n.SystemName
+		}
+	})
+}
+
+// Refresh lists the clients of the managed access points of cfg. Errors are
+// recorded in AccessPoint.Error.
+func (inv *Inventory) Refresh(cfg Config, now time.Time) {
+	for _, m := range cfg.AccessPoints {
+		clients, err := newUbus(m).clients()
+		seen := now
+		if err != nil {
+			seen = time.Time{} // unreachable
+		}
+		inv.observe(m.HardwareAddr, "config", seen, func(ap *AccessPoint) {
+			ap.Managed = true
+			ap.Error = ""
+			ap.Clients = clients
+			if err != nil {
+				ap.Error = err.Error()
+			}
+		})
+	}
+}
+
+// Push configures the networks of cfg on all managed access points.
+func Push(cfg Config) error {
+	var errs []string
+	for _, m := range cfg.AccessPoints {
+		if err := newUbus(m).pushNetworks(cfg.Networks); err != nil {
+			errs = append(errs, m.HardwareAddr+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("pushing networks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
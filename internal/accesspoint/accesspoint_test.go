@@ -0,0 +1,321 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesspoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+func tlv(typ int, val []byte) []byte {
+	hdr := uint16(typ)<<9 | uint16(len(val))
+	return append([]byte{byte(hdr >> 8), byte(hdr)}, val...)
+}
+
+func TestParseLLDP(t *testing.T) {
+	frame := append([]byte(nil), lldpMulticast...)
+	frame = append(frame, 0x02, 0x00, 0x00, 0x00, 0x00, 0x07) // source
+	frame = append(frame, 0x88, 0xcc)
+	frame = append(frame, tlv(tlvChassisID, []byte{4, 0x02, 0x00, 0x00, 0x00, 0x00, 0x07})...)
+	frame = append(frame, tlv(tlvPortID, []byte("\x05eth0"))...)
+	frame = append(frame, tlv(3, []byte{0, 120})...) // TTL
+	frame = append(frame, tlv(tlvSystemName, []byte("ap-attic"))...)
+	frame = append(frame, tlv(tlvCapabilities, []byte{0, 0x0c, 0, 0x08})...)
+	frame = append(frame, tlv(tlvEnd, nil)...)
+
+	got, err := ParseLLDP(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Neighbor{
+		HardwareAddr: "02:00:00:00:00:07",
+		ChassisID:    "02:00:00:00:00:07",
+		PortID:       "eth0",
+		SystemName:   "ap-attic",
+		Capabilities: capWLANAccessPoint,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("ParseLLDP: unexpected result: diff (-want +got):\n%s", diff)
+	}
+	if !got.AccessPoint() {
+		t.Errorf("AccessPoint() = false, want true")
+	}
+
+	if _, err := ParseLLDP(frame[:len(frame)-10]); err == nil {
+		t.Errorf("ParseLLDP(truncated frame) unexpectedly succeeded")
+	}
+}
+
+func TestInventory(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "accesspoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	inv, err := LoadInventory(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.UpdateLeases([]*dhcp4d.Lease{
+		{
+			Addr:         net.ParseIP("192.168.42.3"),
+			HardwareAddr: "02:00:00:00:00:03",
+			Hostname:     "UAP-AC-Lite",
+			VendorClass:  "ubnt",
+			Expiry:       now.Add(time.Hour),
+		},
+		{
+			Addr:         net.ParseIP("192.168.42.4"),
+			HardwareAddr: "02:00:00:00:00:04",
+			Hostname:     "laptop",
+			VendorClass:  "MSFT 5.0",
+			Expiry:       now.Add(time.Hour),
+		},
+	}, now)
+	inv.ObserveLLDP(Neighbor{HardwareAddr: "02:00:00:00:00:03", SystemName: "ap-attic", Capabilities: capWLANAccessPoint}, now)
+	inv.ObserveLLDP(Neighbor{HardwareAddr: "02:00:00:00:00:05", Capabilities: capBridge}, now)
+	if err := inv.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err = LoadInventory(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AccessPoint{
+		{
+			HardwareAddr: "02:00:00:00:00:03",
+			Addr:         "192.168.42.3",
+			Hostname:     "UAP-AC-Lite",
+			Vendor:       "Ubiquiti",
+			Sources:      []string{"dhcp", "lldp"},
+			LastSeen:     now,
+		},
+	}
+	if diff := cmp.Diff(want, inv.List()); diff != "" {
+		t.Fatalf("List: unexpected result: diff (-want +got):\n%s", diff)
+	}
+}
+
+// fakeUbus implements the subset of the OpenWrt ubus JSON-RPC interface which
+// the accesspoint package uses.
+type fakeUbus struct {
+	mu      sync.Mutex
+	ifaces  map[string]map[string]string // wifi-iface sections
+	commits int
+}
+
+func (f *fakeUbus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply := func(result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      1,
+			"result":  result,
+		})
+	}
+	if req.Method == "list" {
+		reply(map[string]interface{}{
+			"hostapd.wlan0": map[string]interface{}{},
+			"hostapd.wlan1": map[string]interface{}{},
+		})
+		return
+	}
+	var session, object, method string
+	json.Unmarshal(req.Params[0], &session)
+	json.Unmarshal(req.Params[1], &object)
+	json.Unmarshal(req.Params[2], &method)
+	var args map[string]interface{}
+	json.Unmarshal(req.Params[3], &args)
+
+	if object == "session" && method == "login" {
+		if args["password"] != "secret" {
+			reply([]interface{}{6}) // permission denied
+			return
+		}
+		reply([]interface{}{0, map[string]string{"ubus_rpc_session": "c0ffee"}})
+		return
+	}
+	if session != "c0ffee" {
+		reply([]interface{}{6})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch object + "." + method {
+	case "hostapd.wlan0.get_clients":
+		reply([]interface{}{0, map[string]interface{}{
+			"clients": map[string]interface{}{
+				"02:00:00:00:01:01": map[string]interface{}{"signal": -61},
+			},
+		}})
+	case "hostapd.wlan1.get_clients":
+		reply([]interface{}{4}) // interface down
+	case "uci.get":
+		switch args["type"] {
+		case "wifi-device":
+			reply([]interface{}{0, map[string]interface{}{
+				"values": map[string]interface{}{
+					"radio0": map[string]string{".type": "wifi-device"},
+					"radio1": map[string]string{".type": "wifi-device"},
+				},
+			}})
+		case "wifi-iface":
+			reply([]interface{}{0, map[string]interface{}{"values": f.ifaces}})
+		}
+	case "uci.delete":
+		delete(f.ifaces, args["section"].(string))
+		reply([]interface{}{0})
+	case "uci.add":
+		values := make(map[string]string)
+		for k, v := range args["values"].(map[string]interface{}) {
+			values[k] = v.(string)
+		}
+		f.ifaces[args["name"].(string)] = values
+		reply([]interface{}{0})
+	case "uci.commit":
+		f.commits++
+		reply([]interface{}{0})
+	default:
+		reply([]interface{}{3}) // method not found
+	}
+}
+
+func TestOpenWrt(t *testing.T) {
+	fake := &fakeUbus{
+		ifaces: map[string]map[string]string{
+			"default_radio0": {"ssid": "OpenWrt"},
+			"router7_0_old":  {"ssid": "stale"},
+		},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "accesspoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg := Config{
+		Networks: []Network{
+			{SSID: "home", Passphrase: "correct horse"},
+			{SSID: "iot", Passphrase: "battery staple", VLAN: 10},
+		},
+		AccessPoints: []Managed{
+			{
+				HardwareAddr: "02:00:00:00:00:03",
+				Type:         "openwrt",
+				URL:          srv.URL,
+				Username:     "root",
+				Password:     "secret",
+			},
+		},
+	}
+
+	t.Run("Clients", func(t *testing.T) {
+		now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+		inv, err := LoadInventory(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inv.Refresh(cfg, now)
+		want := []AccessPoint{
+			{
+				HardwareAddr: "02:00:00:00:00:03",
+				Sources:      []string{"config"},
+				LastSeen:     now,
+				Managed:      true,
+				Clients: []Client{
+					{HardwareAddr: "02:00:00:00:01:01", Interface: "wlan0", Signal: -61},
+				},
+			},
+		}
+		if diff := cmp.Diff(want, inv.List()); diff != "" {
+			t.Fatalf("List: unexpected result: diff (-want +got):\n%s", diff)
+		}
+
+		wrong := cfg
+		wrong.AccessPoints = []Managed{cfg.AccessPoints[0]}
+		wrong.AccessPoints[0].Password = "wrong"
+		inv.Refresh(wrong, now.Add(time.Minute))
+		ap := inv.List()[0]
+		if ap.Error == "" || !ap.LastSeen.Equal(now) {
+			t.Errorf("Refresh with wrong password: got error %q, last seen %v; want error, last seen %v", ap.Error, ap.LastSeen, now)
+		}
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		if err := Push(cfg); err != nil {
+			t.Fatal(err)
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		var names []string
+		for name := range fake.ifaces {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		wantNames := []string{"default_radio0", "router7_0_radio0", "router7_0_radio1", "router7_1_radio0", "router7_1_radio1"}
+		if diff := cmp.Diff(wantNames, names); diff != "" {
+			t.Fatalf("wifi-iface sections: diff (-want +got):\n%s", diff)
+		}
+		want := map[string]string{
+			"device":     "radio1",
+			"mode":       "ap",
+			"ssid":       "iot",
+			"network":    "vlan10",
+			"encryption": "psk2",
+			"key":        "battery staple",
+		}
+		if diff := cmp.Diff(want, fake.ifaces["router7_1_radio1"]); diff != "" {
+			t.Errorf("router7_1_radio1: diff (-want +got):\n%s", diff)
+		}
+		if got, want := fake.commits, 1; got != want {
+			t.Errorf("commits = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		unsupported := cfg
+		unsupported.AccessPoints = []Managed{{HardwareAddr: "02:00:00:00:00:09", Type: "unifi"}}
+		if err := Push(unsupported); err == nil || !strings.Contains(err.Error(), "unsupported") {
+			t.Errorf("Push(type unifi) = %v, want unsupported error", err)
+		}
+	})
+}
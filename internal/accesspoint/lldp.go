@@ -0,0 +1,148 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesspoint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// etherTypeLLDP is the EtherType of the Link Layer Discovery Protocol
+// (IEEE 802.1AB).
+const etherTypeLLDP = 0x88cc
+
+// lldpMulticast is the nearest bridge group address, to which LLDP frames
+// are sent.
+var lldpMulticast = net.HardwareAddr{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// LLDP TLV types
+const (
+	tlvEnd          = 0
+	tlvChassisID    = 1
+	tlvPortID       = 2
+	tlvSystemName   = 5
+	tlvCapabilities = 7
+)
+
+// System capabilities
+const (
+	capBridge          = 1 << 2
+	capWLANAccessPoint = 1 << 3
+)
+
+// Neighbor is the sender of an LLDP frame.
+type Neighbor struct {
+	HardwareAddr string // source address of the frame
+	ChassisID    string
+	PortID       string
+	SystemName   string
+
+	// Capabilities are the enabled system capabilities.
+	Capabilities uint16
+}
+
+// AccessPoint reports whether n announces to be a WLAN access point.
+func (n Neighbor) AccessPoint() bool {
+	return n.Capabilities&capWLANAccessPoint != 0
+}
+
+// Switch reports whether n announces to be a bridge (i.e. a switch).
+func (n Neighbor) Switch() bool {
+	return n.Capabilities&capBridge != 0
+}
+
+// lldpID formats a chassis or port ID TLV value, whose first byte is the
+// subtype.
+func lldpID(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	const subtypeMACAddress = 4 // for chassis and port IDs
+	if b[0] == subtypeMACAddress && len(b) == 7 {
+		return net.HardwareAddr(b[1:]).String()
+	}
+	return string(b[1:])
+}
+
+// ParseLLDP parses the Ethernet frame b containing an LLDP data unit.
+func ParseLLDP(b []byte) (Neighbor, error) {
+	var n Neighbor
+	if len(b) < 14 || binary.BigEndian.Uint16(b[12:]) != etherTypeLLDP {
+		return n, fmt.Errorf("not an LLDP frame")
+	}
+	n.HardwareAddr = net.HardwareAddr(b[6:12]).String()
+	b = b[14:]
+	for len(b) >= 2 {
+		hdr := binary.BigEndian.Uint16(b)
+		typ, length := hdr>>9, int(hdr&0x1ff)
+		b = b[2:]
+		if len(b) < length {
+			return n, fmt.Errorf("TLV %d: truncated", typ)
+		}
+		val := b[:length]
+		b = b[length:]
+		switch typ {
+		case tlvEnd:
+			return n, nil
+		case tlvChassisID:
+			n.ChassisID = lldpID(val)
+		case tlvPortID:
+			n.PortID = lldpID(val)
+		case tlvSystemName:
+			n.SystemName = string(val)
+		case tlvCapabilities:
+			if len(val) == 4 {
+				n.Capabilities = binary.BigEndian.Uint16(val[2:])
+			}
+		}
+	}
+	return n, nil
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+// ListenLLDP returns a packet socket receiving LLDP frames on ifname.
+func ListenLLDP(ifname string) (*os.File, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(etherTypeLLDP)))
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{
+		Protocol: htons(etherTypeLLDP),
+		Ifindex:  iface.Index,
+	}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	mreq := &unix.PacketMreq{
+		Ifindex: int32(iface.Index),
+		Type:    unix.PACKET_MR_MULTICAST,
+		Alen:    uint16(len(lldpMulticast)),
+	}
+	copy(mreq.Address[:], lldpMulticast)
+	if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, mreq); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "lldp"), nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accesspoint
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ubusStatusNotFound is returned by ubus calls for missing objects (e.g. a
+// deleted uci section).
+const ubusStatusNotFound = 4
+
+// sectionPrefix names the wifi-iface sections which router7 manages on
+// OpenWrt access points.
+const sectionPrefix = "router7_"
+
+// ubus is a client of the JSON-RPC interface of OpenWrt (uhttpd-mod-ubus).
+type ubus struct {
+	m       Managed
+	client  *http.Client
+	session string
+}
+
+func newUbus(m Managed) *ubus {
+	return &ubus{
+		m:      m,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// request sends a JSON-RPC request and returns its result.
+func (u *ubus) request(method string, params []interface{}) (json.RawMessage, error) {
+	if u.m.Type != "openwrt" {
+		return nil, fmt.Errorf("unsupported access point type %q", u.m.Type)
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.client.Post(u.m.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+	}
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("%s", reply.Error.Message)
+	}
+	return reply.Result, nil
+}
+
+// rawCall calls method of object with args (in session), unmarshaling the
+// result into result.
+func (u *ubus) rawCall(session, object, method string, args interface{}, result interface{}) error {
+	reply, err := u.request("call", []interface{}{session, object, method, args})
+	if err != nil {
+		return fmt.Errorf("%s.%s: %v", object, method, err)
+	}
+	// The result of calls is [status, data].
+	var res []json.RawMessage
+	if err := json.Unmarshal(reply, &res); err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("%s.%s: empty result", object, method)
+	}
+	var status int
+	if err := json.Unmarshal(res[0], &status); err != nil {
+		return err
+	}
+	if status != 0 {
+		return &ubusError{object: object, method: method, status: status}
+	}
+	if result == nil || len(res) < 2 {
+		return nil
+	}
+	return json.Unmarshal(res[1], result)
+}
+
+type ubusError struct {
+	object, method string
+	status         int
+}
+
+func (e *ubusError) Error() string {
+	return fmt.Sprintf("%s.%s: ubus status %d", e.object, e.method, e.status)
+}
+
+// call calls method of object with args, logging in first if necessary.
+func (u *ubus) call(object, method string, args interface{}, result interface{}) error {
+	if u.session == "" {
+		var login struct {
+			Session string `json:"ubus_rpc_session"`
+		}
+		const anonymous = "00000000000000000000000000000000"
+		if err := u.rawCall(anonymous, "session", "login", map[string]string{
+			"username": u.m.Username,
+			"password": u.m.Password,
+		}, &login); err != nil {
+			return err
+		}
+		u.session = login.Session
+	}
+	return u.rawCall(u.session, object, method, args, result)
+}
+
+// clients lists the clients of all hostapd instances.
+func (u *ubus) clients() ([]Client, error) {
+	// The hostapd instances register one object per interface, e.g.
+	// hostapd.wlan0.
+	reply, err := u.request("list", []interface{}{"hostapd.*"})
+	if err != nil {
+		return nil, fmt.Errorf("list: %v", err)
+	}
+	var objects map[string]json.RawMessage
+	if err := json.Unmarshal(reply, &objects); err != nil {
+		return nil, err
+	}
+	var names []string
+	for object := range objects {
+		names = append(names, strings.TrimPrefix(object, "hostapd."))
+	}
+	sort.Strings(names)
+	var clients []Client
+	for _, ifname := range names {
+		var reply struct {
+			Clients map[string]struct {
+				Signal int `json:"signal"`
+			} `json:"clients"`
+		}
+		if err := u.call("hostapd."+ifname, "get_clients", map[string]string{}, &reply); err != nil {
+			if e, ok := err.(*ubusError); ok && e.status == ubusStatusNotFound {
+				continue // interface down
+			}
+			return nil, err
+		}
+		for hwaddr, c := range reply.Clients {
+			clients = append(clients, Client{
+				HardwareAddr: hwaddr,
+				Interface:    ifname,
+				Signal:       c.Signal,
+			})
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].HardwareAddr < clients[j].HardwareAddr })
+	return clients, nil
+}
+
+// wifiIface returns the uci options of the wifi-iface section serving n on
+// radio.
+func wifiIface(n Network, radio string) map[string]string {
+	network := "lan"
+	if n.VLAN != 0 {
+		network = "vlan" + strconv.Itoa(n.VLAN)
+	}
+	opts := map[string]string{
+		"device":     radio,
+		"mode":       "ap",
+		"ssid":       n.SSID,
+		"network":    network,
+		"encryption": "none",
+	}
+	if n.Passphrase != "" {
+		opts["encryption"] = "psk2"
+		opts["key"] = n.Passphrase
+	}
+	return opts
+}
+
+// pushNetworks replaces the wifi-iface sections managed by router7 with one
+// section per network and radio.
+func (u *ubus) pushNetworks(networks []Network) error {
+	type sections struct {
+		Values map[string]map[string]interface{} `json:"values"`
+	}
+	var radios, ifaces sections
+	if err := u.call("uci", "get", map[string]string{
+		"config": "wireless",
+		"type":   "wifi-device",
+	}, &radios); err != nil {
+		return err
+	}
+	if err := u.call("uci", "get", map[string]string{
+		"config": "wireless",
+		"type":   "wifi-iface",
+	}, &ifaces); err != nil {
+		return err
+	}
+	for name := range ifaces.Values {
+		if !strings.HasPrefix(name, sectionPrefix) {
+			continue
+		}
+		if err := u.call("uci", "delete", map[string]string{
+			"config":  "wireless",
+			"section": name,
+		}, nil); err != nil {
+			return err
+		}
+	}
+	var radioNames []string
+	for name := range radios.Values {
+		radioNames = append(radioNames, name)
+	}
+	sort.Strings(radioNames)
+	for idx, n := range networks {
+		for _, radio := range radioNames {
+			if err := u.call("uci", "add", map[string]interface{}{
+				"config": "wireless",
+				"type":   "wifi-iface",
+				"name":   fmt.Sprintf("%s%d_%s", sectionPrefix, idx, radio),
+				"values": wifiIface(n, radio),
+			}, nil); err != nil {
+				return err
+			}
+		}
+	}
+	// Committing via ubus triggers a reload of the wireless configuration.
+	return u.call("uci", "commit", map[string]string{"config": "wireless"}, nil)
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alert sends notifications about critical events (e.g. a long
+// uplink outage) via e-mail or push notification services, as configured in
+// /perm/alert.json.
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Event types, which select the channels in Config.Events.
+const (
+	EventUplinkDown     = "uplink_down"     // uplink unreachable for > 5 minutes
+	EventSLABreach      = "sla_breach"      // latency/loss threshold breached
+	EventNewDevice      = "new_device"      // unknown device obtained a lease
+	EventConfigRollback = "config_rollback" // configuration was rolled back
+	EventStorageLow     = "storage_low"     // /perm is running out of space
+	EventStorageWear    = "storage_wear"    // flash life time nearly used up
+	EventBridgeLoop     = "bridge_loop"     // loop detected on a LAN bridge
+	EventPortSecurity   = "port_security"   // too many devices on a bridge port
+)
+
+// Event is a notification.
+type Event struct {
+	Type    string
+	Time    time.Time
+	Title   string // e.g. “uplink down”
+	Message string
+}
+
+// ChannelConfig configures a notification channel. Type selects which of
+// the remaining fields are used.
+type ChannelConfig struct {
+	Type string `json:"type"` // smtp, ntfy, pushover or telegram
+
+	// smtp
+	Server   string   `json:"server"` // host:port, e.g. smtp.example.com:587
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	// ntfy: the topic URL, e.g. https://ntfy.sh/router7-alerts
+	// pushover, telegram: optional API URL override
+	URL string `json:"url"`
+
+	// pushover
+	Token   string `json:"token"` // also used by telegram (bot token)
+	UserKey string `json:"user_key"`
+
+	// telegram
+	ChatID string `json:"chat_id"`
+}
+
+// Config is read from /perm/alert.json.
+type Config struct {
+	Channels map[string]ChannelConfig `json:"channels"`
+
+	// Events maps event types (e.g. uplink_down) to the names of the
+	// channels which are notified.
+	Events map[string][]string `json:"events"`
+}
+
+// ReadConfig reads alert.json from dir. A missing file results in an empty
+// Config, i.e. no notifications.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "alert.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// channel delivers events.
+type channel interface {
+	send(ctx context.Context, ev Event) error
+}
+
+func newChannel(cfg ChannelConfig) (channel, error) {
+	switch cfg.Type {
+	case "smtp":
+		if cfg.Server == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return nil, fmt.Errorf("smtp: server, from and to must be set")
+		}
+		return &smtpChannel{cfg}, nil
+	case "ntfy":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("ntfy: url must be set")
+		}
+		return &ntfyChannel{cfg}, nil
+	case "pushover":
+		if cfg.Token == "" || cfg.UserKey == "" {
+			return nil, fmt.Errorf("pushover: token and user_key must be set")
+		}
+		return &pushoverChannel{cfg}, nil
+	case "telegram":
+		if cfg.Token == "" || cfg.ChatID == "" {
+			return nil, fmt.Errorf("telegram: token and chat_id must be set")
+		}
+		return &telegramChannel{cfg}, nil
+	default:
+		return nil, fmt.Errorf("unknown channel type %q", cfg.Type)
+	}
+}
+
+// Notifier sends events to the channels configured for their type.
+type Notifier struct {
+	channels map[string]channel
+	events   map[string][]string
+}
+
+// NewNotifier returns a Notifier for cfg.
+func NewNotifier(cfg Config) (*Notifier, error) {
+	n := &Notifier{
+		channels: make(map[string]channel),
+		events:   cfg.Events,
+	}
+	for name, cc := range cfg.Channels {
+		ch, err := newChannel(cc)
+		if err != nil {
+			return nil, fmt.Errorf("channel %s: %v", name, err)
+		}
+		n.channels[name] = ch
+	}
+	for typ, names := range cfg.Events {
+		for _, name := range names {
+			if _, ok := n.channels[name]; !ok {
+				return nil, fmt.Errorf("event %s: unknown channel %q", typ, name)
+			}
+		}
+	}
+	return n, nil
+}
+
+// Load returns a Notifier for the configuration in dir. Errors are logged and
+// result in a Notifier which does not send any notifications, so that a
+// broken alert.json does not prevent the caller from starting.
+func Load(dir string) *Notifier {
+	cfg, err := ReadConfig(dir)
+	if err == nil {
+		var n *Notifier
+		if n, err = NewNotifier(cfg); err == nil {
+			return n
+		}
+	}
+	log.Printf("alert.json: %v", err)
+	return &Notifier{}
+}
+
+// Notify sends ev to all channels configured for its type. Delivery happens
+// in the background; failures are logged.
+func (n *Notifier) Notify(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	go n.deliver(ev)
+}
+
+// deliver sends ev to all channels configured for its type and returns the
+// number of failed deliveries.
+func (n *Notifier) deliver(ev Event) int {
+	var failed int
+	for _, name := range n.events[ev.Type] {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := n.channels[name].send(ctx, ev)
+		cancel()
+		if err != nil {
+			log.Printf("alert: sending %s event via %s: %v", ev.Type, name, err)
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNotifier(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs = make(map[string]string) // path → summary
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		summary := string(b)
+		if title := r.Header.Get("Title"); title != "" {
+			summary = title + ": " + summary
+		}
+		mu.Lock()
+		reqs[r.URL.Path] = summary
+		mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			http.Error(w, "nope", http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+
+	n, err := NewNotifier(Config{
+		Channels: map[string]ChannelConfig{
+			"phone":    {Type: "ntfy", URL: srv.URL + "/router7"},
+			"pushover": {Type: "pushover", URL: srv.URL + "/pushover", Token: "t", UserKey: "u"},
+			"telegram": {Type: "telegram", URL: srv.URL, Token: "123:abc", ChatID: "42"},
+			"broken":   {Type: "ntfy", URL: srv.URL + "/fail"},
+		},
+		Events: map[string][]string{
+			EventUplinkDown: {"phone", "pushover", "telegram"},
+			EventNewDevice:  {"broken"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed := n.deliver(Event{Type: EventUplinkDown, Title: "uplink down", Message: "since 5m"}); failed != 0 {
+		t.Errorf("deliver: %d failed deliveries", failed)
+	}
+	for path, want := range map[string]string{
+		"/router7":                "uplink down: since 5m",
+		"/pushover":               "message=since+5m&title=uplink+down&token=t&user=u",
+		"/bot123:abc/sendMessage": "chat_id=42&text=uplink+down%0A%0Asince+5m",
+	} {
+		if got := reqs[path]; got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	if failed := n.deliver(Event{Type: EventNewDevice}); failed != 1 {
+		t.Errorf("deliver: got %d failed deliveries, want 1", failed)
+	}
+	if failed := n.deliver(Event{Type: EventConfigRollback}); failed != 0 {
+		t.Errorf("deliver(unconfigured event): %d failed deliveries", failed)
+	}
+
+	for _, cfg := range []Config{
+		{Channels: map[string]ChannelConfig{"x": {Type: "carrier-pigeon"}}},
+		{Channels: map[string]ChannelConfig{"x": {Type: "ntfy"}}},
+		{Events: map[string][]string{EventUplinkDown: {"nonexistent"}}},
+	} {
+		if _, err := NewNotifier(cfg); err == nil {
+			t.Errorf("NewNotifier(%+v): unexpectedly succeeded", cfg)
+		}
+	}
+}
+
+func TestSMTPMessage(t *testing.T) {
+	c := &smtpChannel{ChannelConfig{From: "router7@example.com", To: []string{"a@example.com", "b@example.com"}}}
+	msg := string(c.message(Event{Title: "new device", Message: "aa:bb:cc:dd:ee:ff"}))
+	for _, want := range []string{
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: [router7] new device\r\n",
+		"\r\n\r\naa:bb:cc:dd:ee:ff\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q does not contain %q", msg, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+)
+
+func post(ctx context.Context, req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: unexpected HTTP status %v: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func postForm(ctx context.Context, u string, form url.Values) error {
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return post(ctx, req)
+}
+
+// ntfyChannel publishes to an ntfy topic, see https://ntfy.sh/docs/publish/
+type ntfyChannel struct {
+	cfg ChannelConfig
+}
+
+func (c *ntfyChannel) send(ctx context.Context, ev Event) error {
+	req, err := http.NewRequest("POST", c.cfg.URL, strings.NewReader(ev.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", ev.Title)
+	req.Header.Set("Tags", ev.Type)
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	return post(ctx, req)
+}
+
+// pushoverChannel sends messages via https://pushover.net/api
+type pushoverChannel struct {
+	cfg ChannelConfig
+}
+
+func (c *pushoverChannel) send(ctx context.Context, ev Event) error {
+	u := c.cfg.URL
+	if u == "" {
+		u = "https://api.pushover.net/1/messages.json"
+	}
+	return postForm(ctx, u, url.Values{
+		"token":   []string{c.cfg.Token},
+		"user":    []string{c.cfg.UserKey},
+		"title":   []string{ev.Title},
+		"message": []string{ev.Message},
+	})
+}
+
+// telegramChannel sends messages via a bot, see
+// https://core.telegram.org/bots/api#sendmessage
+type telegramChannel struct {
+	cfg ChannelConfig
+}
+
+func (c *telegramChannel) send(ctx context.Context, ev Event) error {
+	u := c.cfg.URL
+	if u == "" {
+		u = "https://api.telegram.org"
+	}
+	return postForm(ctx, u+"/bot"+c.cfg.Token+"/sendMessage", url.Values{
+		"chat_id": []string{c.cfg.ChatID},
+		"text":    []string{ev.Title + "\n\n" + ev.Message},
+	})
+}
+
+// smtpChannel sends e-mails, using STARTTLS if the server supports it.
+type smtpChannel struct {
+	cfg ChannelConfig
+}
+
+func (c *smtpChannel) message(ev Event) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", c.cfg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(c.cfg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: [router7] %s\r\n", ev.Title)
+	fmt.Fprintf(&buf, "Date: %s\r\n", ev.Time.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n%s\r\n", ev.Message)
+	return buf.Bytes()
+}
+
+func (c *smtpChannel) send(ctx context.Context, ev Event) error {
+	var auth smtp.Auth
+	if c.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(c.cfg.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.cfg.Username, c.cfg.Password, host)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(c.cfg.Server, auth, c.cfg.From, c.cfg.To, c.message(ev))
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
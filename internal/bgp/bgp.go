@@ -0,0 +1,528 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bgp implements a minimal BGP-4 speaker (RFC 4271) which announces
+// prefixes (e.g. the delegated IPv6 prefix) to its peers and learns their
+// routes, for networks in which the LAN is a small routed lab network.
+//
+// The speaker only establishes sessions actively, supports IPv4 and IPv6
+// unicast (RFC 4760) and 4-octet AS numbers (RFC 6793), and does not
+// re-advertise learned routes: it is a stub router, not a route reflector.
+package bgp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// PeerConfig is a BGP neighbor.
+type PeerConfig struct {
+	Address string `json:"address"` // e.g. 192.168.42.2 or 2001:db8::2
+	AS      uint32 `json:"as"`      // e.g. 65000; equal to the local AS for iBGP
+	Port    int    `json:"port"`    // default: 179
+
+	// HoldTime is the proposed hold time in seconds (default: 90).
+	HoldTime int `json:"hold_time"`
+
+	// NextHop6 is the next hop for announced IPv6 prefixes, e.g. the
+	// address of lan0. Defaults to the local address of the session if it
+	// is an IPv6 address, otherwise to the IPv4-mapped IPv6 address.
+	NextHop6 string `json:"next_hop6"`
+}
+
+// Config is read from /perm/bgp.json.
+type Config struct {
+	AS       uint32       `json:"as"`        // local AS, e.g. 65001
+	RouterID string       `json:"router_id"` // e.g. 192.168.42.1
+	Peers    []PeerConfig `json:"peers"`
+
+	// Announce lists prefixes to announce in addition to those passed to
+	// SetAnnounced (the delegated prefixes), e.g. ["10.0.0.0/24"].
+	Announce []string `json:"announce"`
+}
+
+// ReadConfig reads bgp.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "bgp.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Route is a route learned from a peer.
+type Route struct {
+	Prefix  *net.IPNet
+	NextHop net.IP
+	Peer    string // PeerConfig.Address
+}
+
+const (
+	defaultHoldTime = 90 * time.Second
+	connectRetry    = 30 * time.Second
+	// openHoldTime is the hold time until the OPEN message is received,
+	// see RFC 4271 section 8.2.2.
+	openHoldTime = 4 * time.Minute
+)
+
+// Speaker maintains BGP sessions to the configured peers.
+type Speaker struct {
+	cfg      Config
+	routerID net.IP
+	extra    []*net.IPNet // Config.Announce
+	onChange func([]Route)
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	changeMu  sync.Mutex // serializes onChange calls
+
+	mu        sync.Mutex
+	announced []*net.IPNet
+	learned   map[string]map[string]Route // peer → prefix → route
+	sessions  map[*session]bool
+}
+
+// NewSpeaker returns a Speaker for cfg. onChange is called with all learned
+// routes (sorted by prefix) whenever they change, e.g. to install them into
+// the kernel routing table.
+func NewSpeaker(cfg Config, onChange func([]Route)) (*Speaker, error) {
+	if cfg.AS == 0 {
+		return nil, fmt.Errorf("as must be set")
+	}
+	routerID := net.ParseIP(cfg.RouterID).To4()
+	if routerID == nil {
+		return nil, fmt.Errorf("invalid router_id %q: must be an IPv4 address", cfg.RouterID)
+	}
+	for _, pc := range cfg.Peers {
+		if net.ParseIP(pc.Address) == nil {
+			return nil, fmt.Errorf("invalid peer address %q", pc.Address)
+		}
+		if pc.AS == 0 {
+			return nil, fmt.Errorf("peer %s: as must be set", pc.Address)
+		}
+		if pc.NextHop6 != "" && net.ParseIP(pc.NextHop6) == nil {
+			return nil, fmt.Errorf("peer %s: invalid next_hop6 %q", pc.Address, pc.NextHop6)
+		}
+	}
+	var extra []*net.IPNet
+	for _, p := range cfg.Announce {
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		extra = append(extra, n)
+	}
+	return &Speaker{
+		cfg:       cfg,
+		routerID:  routerID,
+		extra:     extra,
+		onChange:  onChange,
+		announced: extra,
+		done:      make(chan struct{}),
+		learned:   make(map[string]map[string]Route),
+		sessions:  make(map[*session]bool),
+	}, nil
+}
+
+// Serve maintains a session to every peer until Close is called.
+func (s *Speaker) Serve() {
+	for _, pc := range s.cfg.Peers {
+		s.wg.Add(1)
+		go func(pc PeerConfig) {
+			defer s.wg.Done()
+			s.runPeer(pc)
+		}(pc)
+	}
+	s.wg.Wait()
+}
+
+// Close terminates all sessions.
+func (s *Speaker) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+// SetAnnounced sets the prefixes to announce (in addition to
+// Config.Announce), e.g. the delegated IPv6 prefixes.
+func (s *Speaker) SetAnnounced(prefixes []*net.IPNet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.announced = append(append([]*net.IPNet(nil), s.extra...), prefixes...)
+	for sess := range s.sessions {
+		select {
+		case sess.kick <- struct{}{}:
+		default:
+			// update already pending
+		}
+	}
+}
+
+// Learned returns the routes learned from all peers, sorted by prefix.
+func (s *Speaker) Learned() []Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.learnedLocked()
+}
+
+func (s *Speaker) learnedLocked() []Route {
+	var routes []Route
+	for _, rib := range s.learned {
+		for _, r := range rib {
+			routes = append(routes, r)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if a, b := routes[i].Prefix.String(), routes[j].Prefix.String(); a != b {
+			return a < b
+		}
+		return routes[i].Peer < routes[j].Peer
+	})
+	return routes
+}
+
+func (s *Speaker) changed() {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+	if s.onChange != nil {
+		s.onChange(s.Learned())
+	}
+}
+
+func (s *Speaker) runPeer(pc PeerConfig) {
+	for {
+		err := s.session(pc)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		log.Printf("peer %s: %v (retrying in %v)", pc.Address, err, connectRetry)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+// session is an established BGP session.
+type session struct {
+	kick chan struct{} // announcements changed
+}
+
+func (s *Speaker) session(pc PeerConfig) error {
+	port := pc.Port
+	if port == 0 {
+		port = 179
+	}
+	d := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := d.Dial("tcp", net.JoinHostPort(pc.Address, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	// Until the session is established, reads block the session goroutine,
+	// so Close needs to interrupt them by closing conn.
+	handshake := make(chan struct{})
+	var handshakeOnce sync.Once
+	endHandshake := func() { handshakeOnce.Do(func() { close(handshake) }) }
+	defer endHandshake()
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-handshake:
+		}
+	}()
+
+	hold := defaultHoldTime
+	if pc.HoldTime > 0 {
+		hold = time.Duration(pc.HoldTime) * time.Second
+	}
+	local := &open{
+		as:       s.cfg.AS,
+		holdTime: uint16(hold / time.Second),
+		routerID: s.routerID,
+		as4:      true,
+		families: []family{
+			{afiIPv4, safiUnicast},
+			{afiIPv6, safiUnicast},
+		},
+	}
+	if err := writeMsg(conn, msgOpen, local.marshal()); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(openHoldTime))
+	typ, body, err := readMsg(conn)
+	if err != nil {
+		return err
+	}
+	if typ == msgNotification {
+		return parseNotification(body)
+	}
+	if typ != msgOpen {
+		return notify(conn, errFSM, 0)
+	}
+	remote, err := parseOpen(body)
+	if err != nil {
+		return notify(conn, errOpen, 0)
+	}
+	if remote.as != pc.AS {
+		log.Printf("peer %s: AS %d, expected %d", pc.Address, remote.as, pc.AS)
+		return notify(conn, errOpen, errOpenBadPeer)
+	}
+	if remote.holdTime != 0 && remote.holdTime < 3 {
+		return notify(conn, errOpen, errOpenHoldTime)
+	}
+	if peerHold := time.Duration(remote.holdTime) * time.Second; peerHold < hold {
+		hold = peerHold
+	}
+	as4 := remote.as4
+	if err := writeMsg(conn, msgKeepalive, nil); err != nil {
+		return err
+	}
+	endHandshake()
+
+	sess := &session{kick: make(chan struct{}, 1)}
+	sess.kick <- struct{}{} // initial announcement
+	s.mu.Lock()
+	s.sessions[sess] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		_, hadRoutes := s.learned[pc.Address]
+		delete(s.learned, pc.Address)
+		s.mu.Unlock()
+		if hadRoutes {
+			s.changed()
+		}
+	}()
+
+	type msg struct {
+		typ  uint8
+		body []byte
+	}
+	msgs := make(chan msg)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			if hold > 0 {
+				conn.SetReadDeadline(time.Now().Add(hold))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			typ, body, err := readMsg(conn)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case msgs <- msg{typ, body}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if hold > 0 {
+		t := time.NewTicker(hold / 3)
+		defer t.Stop()
+		keepalive = t.C
+	}
+	established := false
+	sent := make(map[string]*net.IPNet)
+	for {
+		select {
+		case <-s.done:
+			return notify(conn, errCease, 0)
+
+		case err := <-errc:
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return notify(conn, errHoldTimer, 0)
+			}
+			return err
+
+		case <-keepalive:
+			if err := writeMsg(conn, msgKeepalive, nil); err != nil {
+				return err
+			}
+
+		case <-sess.kick:
+			if !established {
+				// Announce once the peer confirmed the OPEN message.
+				continue
+			}
+			if err := s.announce(conn, pc, as4, sent); err != nil {
+				return err
+			}
+
+		case m := <-msgs:
+			switch m.typ {
+			case msgKeepalive:
+				if !established {
+					established = true
+					log.Printf("peer %s: session established (AS %d, hold time %v)", pc.Address, remote.as, hold)
+					if err := s.announce(conn, pc, as4, sent); err != nil {
+						return err
+					}
+				}
+			case msgUpdate:
+				if !established {
+					return notify(conn, errFSM, 0)
+				}
+				u, err := parseUpdate(m.body, as4)
+				if err != nil {
+					log.Printf("peer %s: %v", pc.Address, err)
+					return notify(conn, errUpdate, 0)
+				}
+				s.learn(pc.Address, u)
+			case msgNotification:
+				return parseNotification(m.body)
+			default:
+				return notify(conn, errFSM, 0)
+			}
+		}
+	}
+}
+
+// notify sends a NOTIFICATION message and returns it as error, which
+// terminates the session.
+func notify(conn net.Conn, code, subcode uint8) error {
+	writeMsg(conn, msgNotification, []byte{code, subcode})
+	return &notificationError{code: code, subcode: subcode}
+}
+
+// announce sends an UPDATE message for the difference between the currently
+// announced prefixes and those sent to the peer before.
+func (s *Speaker) announce(conn net.Conn, pc PeerConfig, as4 bool, sent map[string]*net.IPNet) error {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	u := &update{}
+	if pc.AS == s.cfg.AS {
+		u.localPref = 100 // iBGP
+	} else {
+		u.asPath = []uint32{s.cfg.AS}
+	}
+	if ip := localIP.To4(); ip != nil {
+		u.nextHop = ip
+	}
+	u.nextHop6 = net.ParseIP(pc.NextHop6)
+	if u.nextHop6 == nil {
+		u.nextHop6 = localIP.To16() // IPv4-mapped if IPv4
+	}
+
+	s.mu.Lock()
+	current := make(map[string]*net.IPNet)
+	for _, p := range s.announced {
+		if isIPv4(p) && u.nextHop == nil {
+			continue // no IPv4 next hop on an IPv6 session
+		}
+		current[p.String()] = p
+	}
+	s.mu.Unlock()
+	for key, p := range sent {
+		if _, ok := current[key]; !ok {
+			u.withdrawn = append(u.withdrawn, p)
+			delete(sent, key)
+		}
+	}
+	for key, p := range current {
+		if _, ok := sent[key]; !ok {
+			u.nlri = append(u.nlri, p)
+			sent[key] = p
+		}
+	}
+	if len(u.withdrawn) == 0 && len(u.nlri) == 0 {
+		return nil
+	}
+	log.Printf("peer %s: announcing %v, withdrawing %v", pc.Address, u.nlri, u.withdrawn)
+	return writeMsg(conn, msgUpdate, u.marshal(as4))
+}
+
+// learn updates the routes learned from peer. Routes which loop (AS path
+// contains the local AS) or which are within an announced prefix are
+// ignored.
+func (s *Speaker) learn(peer string, u *update) {
+	s.mu.Lock()
+	rib := s.learned[peer]
+	if rib == nil {
+		rib = make(map[string]Route)
+		s.learned[peer] = rib
+	}
+	changed := false
+	for _, p := range u.withdrawn {
+		if _, ok := rib[p.String()]; ok {
+			delete(rib, p.String())
+			changed = true
+		}
+	}
+	loop := false
+	for _, as := range u.asPath {
+		if as == s.cfg.AS {
+			loop = true
+		}
+	}
+	for _, p := range u.nlri {
+		nextHop := u.nextHop
+		if !isIPv4(p) {
+			nextHop = u.nextHop6
+			if nextHop == nil || nextHop.IsLinkLocalUnicast() || nextHop.IsUnspecified() {
+				nextHop = u.linkLocal
+			}
+		}
+		if loop || nextHop == nil || s.ownPrefixLocked(p) {
+			if _, ok := rib[p.String()]; ok {
+				delete(rib, p.String()) // implicit withdrawal
+				changed = true
+			}
+			continue
+		}
+		rib[p.String()] = Route{Prefix: p, NextHop: nextHop, Peer: peer}
+		changed = true
+	}
+	s.mu.Unlock()
+	if changed {
+		s.changed()
+	}
+}
+
+func (s *Speaker) ownPrefixLocked(p *net.IPNet) bool {
+	ones, _ := p.Mask.Size()
+	for _, a := range s.announced {
+		aones, _ := a.Mask.Size()
+		if aones <= ones && a.Contains(p.IP) {
+			return true
+		}
+	}
+	return false
+}
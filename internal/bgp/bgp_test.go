@@ -0,0 +1,239 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// summary formats the fields of u which this package uses.
+func (u *update) summary() string {
+	return fmt.Sprintf("withdrawn %v, nlri %v, as path %v, local pref %d, next hop %v / %v / %v",
+		u.withdrawn, u.nlri, u.asPath, u.localPref, u.nextHop, u.nextHop6, u.linkLocal)
+}
+
+func TestOpen(t *testing.T) {
+	for _, o := range []*open{
+		{
+			as:       65001,
+			holdTime: 90,
+			routerID: net.ParseIP("192.168.42.1").To4(),
+			as4:      true,
+			families: []family{{afiIPv4, safiUnicast}, {afiIPv6, safiUnicast}},
+		},
+		{
+			as:       4200000000,
+			holdTime: 0,
+			routerID: net.ParseIP("10.0.0.1").To4(),
+			as4:      true,
+		},
+	} {
+		got, err := parseOpen(o.marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(o, got, cmp.AllowUnexported(open{}, family{})); diff != "" {
+			t.Errorf("parseOpen(marshal()): diff (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	for _, as4 := range []bool{false, true} {
+		u := &update{
+			withdrawn: []*net.IPNet{mustCIDR("10.1.0.0/16"), mustCIDR("2001:db8:2::/48")},
+			nlri:      []*net.IPNet{mustCIDR("10.0.0.0/8"), mustCIDR("0.0.0.0/0"), mustCIDR("2001:db8:1::/48")},
+			asPath:    []uint32{65001, 65002},
+			localPref: 100,
+			nextHop:   net.ParseIP("192.0.2.1").To4(),
+			nextHop6:  net.ParseIP("2001:db8::1"),
+			linkLocal: net.ParseIP("fe80::1"),
+		}
+		got, err := parseUpdate(u.marshal(as4), as4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(u.summary(), got.summary()); diff != "" {
+			t.Errorf("parseUpdate(marshal(), as4=%v): diff (-want +got):\n%s", as4, diff)
+		}
+	}
+
+	// A withdrawal-only UPDATE carries no mandatory path attributes.
+	u := &update{withdrawn: []*net.IPNet{mustCIDR("2001:db8:2::/48")}}
+	b := u.marshal(true)
+	got, err := parseUpdate(b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(u.summary(), got.summary()); diff != "" {
+		t.Errorf("parseUpdate(marshal()): diff (-want +got):\n%s", diff)
+	}
+
+	for i := 1; i < len(b); i++ {
+		parseUpdate(b[:i], true) // must not panic
+	}
+}
+
+// fakePeer is the remote end of a BGP session.
+type fakePeer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// read returns the next message, which must be of type want. KEEPALIVE
+// messages are skipped.
+func (p *fakePeer) read(want uint8) []byte {
+	p.t.Helper()
+	typ, body, err := readMsg(p.conn)
+	for err == nil && typ == msgKeepalive && want != msgKeepalive {
+		typ, body, err = readMsg(p.conn)
+	}
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if typ != want {
+		p.t.Fatalf("got message type %d (%x), want %d", typ, body, want)
+	}
+	return body
+}
+
+func (p *fakePeer) write(typ uint8, body []byte) {
+	p.t.Helper()
+	if err := writeMsg(p.conn, typ, body); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	learned := make(chan []Route, 10)
+	s, err := NewSpeaker(Config{
+		AS:       65001,
+		RouterID: "192.168.42.1",
+		Peers: []PeerConfig{
+			{
+				Address: "127.0.0.1",
+				AS:      65000,
+				Port:    ln.Addr().(*net.TCPAddr).Port,
+			},
+		},
+	}, func(routes []Route) { learned <- routes })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAnnounced([]*net.IPNet{mustCIDR("2001:db8:1::/48")})
+	go s.Serve()
+	defer s.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &fakePeer{t: t, conn: conn}
+
+	o, err := parseOpen(p.read(msgOpen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.as, uint32(65001); got != want {
+		t.Fatalf("OPEN: AS %d, want %d", got, want)
+	}
+	p.write(msgOpen, (&open{
+		as:       65000,
+		holdTime: 9,
+		routerID: net.ParseIP("192.168.42.2").To4(),
+		as4:      true,
+	}).marshal())
+	p.write(msgKeepalive, nil)
+	p.read(msgKeepalive)
+
+	u, err := parseUpdate(p.read(msgUpdate), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &update{
+		nlri:     []*net.IPNet{mustCIDR("2001:db8:1::/48")},
+		asPath:   []uint32{65001},
+		nextHop6: net.ParseIP("::ffff:127.0.0.1"), // IPv4 session
+	}
+	if diff := cmp.Diff(want.summary(), u.summary()); diff != "" {
+		t.Fatalf("announcement: diff (-want +got):\n%s", diff)
+	}
+
+	p.write(msgUpdate, (&update{
+		nlri: []*net.IPNet{
+			mustCIDR("10.99.0.0/16"),
+			mustCIDR("2001:db8:1:1::/64"), // within the announced prefix
+			mustCIDR("2001:db8:99::/48"),
+		},
+		asPath:   []uint32{65000},
+		nextHop:  net.ParseIP("127.0.0.2").To4(),
+		nextHop6: net.ParseIP("2001:db8::2"),
+	}).marshal(true))
+	routes := <-learned
+	wantRoutes := []Route{
+		{Prefix: mustCIDR("10.99.0.0/16"), NextHop: net.ParseIP("127.0.0.2").To4(), Peer: "127.0.0.1"},
+		{Prefix: mustCIDR("2001:db8:99::/48"), NextHop: net.ParseIP("2001:db8::2"), Peer: "127.0.0.1"},
+	}
+	if diff := cmp.Diff(wantRoutes, routes); diff != "" {
+		t.Fatalf("learned routes: diff (-want +got):\n%s", diff)
+	}
+
+	// Routes whose AS path contains the local AS are ignored.
+	p.write(msgUpdate, (&update{
+		nlri:     []*net.IPNet{mustCIDR("2001:db8:99::/48")},
+		asPath:   []uint32{65000, 65001},
+		nextHop6: net.ParseIP("2001:db8::2"),
+	}).marshal(true))
+	if diff := cmp.Diff(wantRoutes[:1], <-learned); diff != "" {
+		t.Fatalf("learned routes after loop: diff (-want +got):\n%s", diff)
+	}
+
+	s.SetAnnounced(nil)
+	u, err = parseUpdate(p.read(msgUpdate), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &update{withdrawn: []*net.IPNet{mustCIDR("2001:db8:1::/48")}}
+	if diff := cmp.Diff(want.summary(), u.summary()); diff != "" {
+		t.Fatalf("withdrawal: diff (-want +got):\n%s", diff)
+	}
+
+	go s.Close()
+	if got, want := parseNotification(p.read(msgNotification)).code, uint8(errCease); got != want {
+		t.Fatalf("NOTIFICATION code %d, want %d", got, want)
+	}
+	if routes := <-learned; len(routes) != 0 {
+		t.Fatalf("learned routes after Close: %v, want none", routes)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Message types, see RFC 4271 section 4.1.
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+const (
+	headerLen = 19
+	maxMsgLen = 4096
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	// asTrans is sent in the 2-octet AS field of OPEN messages by speakers
+	// with a 4-octet AS number (RFC 6793).
+	asTrans = 23456
+
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+)
+
+// Path attribute type codes and flags, see RFC 4271 section 4.3.
+const (
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrLocalPref   = 5
+	attrMPReachNLRI = 14 // RFC 4760
+	attrMPUnreach   = 15 // RFC 4760
+
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtLen     = 0x10
+
+	originIGP  = 0
+	asSequence = 2
+)
+
+// Error codes of NOTIFICATION messages, see RFC 4271 section 4.5.
+const (
+	errHeader       = 1
+	errOpen         = 2
+	errUpdate       = 3
+	errHoldTimer    = 4
+	errFSM          = 5
+	errCease        = 6
+	errOpenBadPeer  = 2 // subcode of errOpen
+	errOpenHoldTime = 6 // subcode of errOpen
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+func writeMsg(w io.Writer, typ uint8, body []byte) error {
+	if headerLen+len(body) > maxMsgLen {
+		return fmt.Errorf("message too long: %d bytes", headerLen+len(body))
+	}
+	b := make([]byte, headerLen, headerLen+len(body))
+	copy(b, marker)
+	binary.BigEndian.PutUint16(b[16:18], uint16(headerLen+len(body)))
+	b[18] = typ
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+func readMsg(r io.Reader) (typ uint8, body []byte, _ error) {
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(hdr[:16], marker) {
+		return 0, nil, fmt.Errorf("invalid marker %x", hdr[:16])
+	}
+	length := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if length < headerLen || length > maxMsgLen {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+	body = make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[18], body, nil
+}
+
+type family struct {
+	afi  uint16
+	safi uint8
+}
+
+// open is a BGP OPEN message with the capabilities this package uses.
+type open struct {
+	as       uint32
+	holdTime uint16 // seconds
+	routerID net.IP
+	as4      bool // 4-octet AS number capability
+	families []family
+}
+
+func (o *open) marshal() []byte {
+	var caps []byte
+	for _, f := range o.families {
+		caps = append(caps, capMultiprotocol, 4, byte(f.afi>>8), byte(f.afi), 0, f.safi)
+	}
+	if o.as4 {
+		caps = append(caps, capFourOctetAS, 4)
+		caps = append(caps, uint32Bytes(o.as)...)
+	}
+	as2 := o.as
+	if as2 > 0xffff {
+		as2 = asTrans
+	}
+	b := []byte{4} // version
+	b = append(b, byte(as2>>8), byte(as2))
+	b = append(b, byte(o.holdTime>>8), byte(o.holdTime))
+	b = append(b, o.routerID.To4()...)
+	b = append(b, byte(2+len(caps)), 2 /* capabilities */, byte(len(caps)))
+	return append(b, caps...)
+}
+
+func parseOpen(b []byte) (*open, error) {
+	if len(b) < 10 {
+		return nil, fmt.Errorf("OPEN too short")
+	}
+	if b[0] != 4 {
+		return nil, fmt.Errorf("unsupported BGP version %d", b[0])
+	}
+	o := &open{
+		as:       uint32(binary.BigEndian.Uint16(b[1:3])),
+		holdTime: binary.BigEndian.Uint16(b[3:5]),
+		routerID: net.IP(append([]byte(nil), b[5:9]...)),
+	}
+	params := b[10:]
+	if int(b[9]) != len(params) {
+		return nil, fmt.Errorf("OPEN: invalid optional parameters length")
+	}
+	for len(params) > 0 {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return nil, fmt.Errorf("OPEN: truncated optional parameter")
+		}
+		typ, val := params[0], params[2:2+int(params[1])]
+		params = params[2+int(params[1]):]
+		if typ != 2 {
+			continue // not capabilities
+		}
+		for len(val) > 0 {
+			if len(val) < 2 || len(val) < 2+int(val[1]) {
+				return nil, fmt.Errorf("OPEN: truncated capability")
+			}
+			code, c := val[0], val[2:2+int(val[1])]
+			val = val[2+int(val[1]):]
+			switch {
+			case code == capMultiprotocol && len(c) == 4:
+				o.families = append(o.families, family{
+					afi:  binary.BigEndian.Uint16(c[0:2]),
+					safi: c[3],
+				})
+			case code == capFourOctetAS && len(c) == 4:
+				o.as4 = true
+				o.as = binary.BigEndian.Uint32(c)
+			}
+		}
+	}
+	return o, nil
+}
+
+// update is a BGP UPDATE message. IPv4 prefixes are carried in the NLRI and
+// withdrawn routes fields, IPv6 prefixes in the multiprotocol attributes.
+type update struct {
+	withdrawn []*net.IPNet
+	nlri      []*net.IPNet
+
+	asPath    []uint32
+	localPref uint32 // only for iBGP, 0 if absent
+	nextHop   net.IP // IPv4 NLRI
+	nextHop6  net.IP // IPv6 NLRI (global address)
+	linkLocal net.IP // IPv6 NLRI, optional link-local next hop
+}
+
+func isIPv4(n *net.IPNet) bool { return n.IP.To4() != nil }
+
+func uint32Bytes(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func appendPrefix(b []byte, n *net.IPNet) []byte {
+	ones, _ := n.Mask.Size()
+	ip := n.IP.To4()
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+	return append(append(b, byte(ones)), ip[:(ones+7)/8]...)
+}
+
+func parsePrefixes(b []byte, afi uint16) ([]*net.IPNet, error) {
+	bits := 32
+	if afi == afiIPv6 {
+		bits = 128
+	}
+	var prefixes []*net.IPNet
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > bits || len(b) < 1+n {
+			return nil, fmt.Errorf("invalid prefix")
+		}
+		ip := make(net.IP, bits/8)
+		copy(ip, b[1:1+n])
+		mask := net.CIDRMask(ones, bits)
+		prefixes = append(prefixes, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+		b = b[1+n:]
+	}
+	return prefixes, nil
+}
+
+func appendAttr(b []byte, flags, code uint8, val []byte) []byte {
+	if len(val) > 0xff {
+		b = append(b, flags|flagExtLen, code, byte(len(val)>>8), byte(len(val)))
+	} else {
+		b = append(b, flags, code, byte(len(val)))
+	}
+	return append(b, val...)
+}
+
+func (u *update) marshal(as4 bool) []byte {
+	var withdrawn4, withdrawn6, nlri4, nlri6 []byte
+	for _, n := range u.withdrawn {
+		if isIPv4(n) {
+			withdrawn4 = appendPrefix(withdrawn4, n)
+		} else {
+			withdrawn6 = appendPrefix(withdrawn6, n)
+		}
+	}
+	for _, n := range u.nlri {
+		if isIPv4(n) {
+			nlri4 = appendPrefix(nlri4, n)
+		} else {
+			nlri6 = appendPrefix(nlri6, n)
+		}
+	}
+
+	var attrs []byte
+	if len(nlri4) > 0 || len(nlri6) > 0 {
+		attrs = appendAttr(attrs, flagTransitive, attrOrigin, []byte{originIGP})
+		var path []byte
+		if len(u.asPath) > 0 {
+			path = append(path, asSequence, byte(len(u.asPath)))
+			for _, as := range u.asPath {
+				if as4 {
+					path = append(path, uint32Bytes(as)...)
+				} else {
+					path = append(path, byte(as>>8), byte(as))
+				}
+			}
+		}
+		attrs = appendAttr(attrs, flagTransitive, attrASPath, path)
+		if len(nlri4) > 0 {
+			attrs = appendAttr(attrs, flagTransitive, attrNextHop, u.nextHop.To4())
+		}
+		if u.localPref != 0 {
+			attrs = appendAttr(attrs, flagTransitive, attrLocalPref, uint32Bytes(u.localPref))
+		}
+	}
+	if len(nlri6) > 0 {
+		nh := append([]byte(nil), u.nextHop6.To16()...)
+		if u.linkLocal != nil {
+			nh = append(nh, u.linkLocal.To16()...)
+		}
+		val := []byte{0, afiIPv6, safiUnicast, byte(len(nh))}
+		val = append(val, nh...)
+		val = append(val, 0) // reserved
+		attrs = appendAttr(attrs, flagOptional, attrMPReachNLRI, append(val, nlri6...))
+	}
+	if len(withdrawn6) > 0 {
+		val := []byte{0, afiIPv6, safiUnicast}
+		attrs = appendAttr(attrs, flagOptional, attrMPUnreach, append(val, withdrawn6...))
+	}
+
+	b := []byte{byte(len(withdrawn4) >> 8), byte(len(withdrawn4))}
+	b = append(b, withdrawn4...)
+	b = append(b, byte(len(attrs)>>8), byte(len(attrs)))
+	b = append(b, attrs...)
+	return append(b, nlri4...)
+}
+
+func parseUpdate(b []byte, as4 bool) (*update, error) {
+	errTruncated := fmt.Errorf("UPDATE truncated")
+	if len(b) < 2 {
+		return nil, errTruncated
+	}
+	wlen := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+wlen+2 {
+		return nil, errTruncated
+	}
+	var u update
+	var err error
+	if u.withdrawn, err = parsePrefixes(b[2:2+wlen], afiIPv4); err != nil {
+		return nil, err
+	}
+	b = b[2+wlen:]
+	alen := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+alen {
+		return nil, errTruncated
+	}
+	attrs := b[2 : 2+alen]
+	nlri, err := parsePrefixes(b[2+alen:], afiIPv4)
+	if err != nil {
+		return nil, err
+	}
+	u.nlri = nlri
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, errTruncated
+		}
+		flags, code := attrs[0], attrs[1]
+		var val []byte
+		if flags&flagExtLen != 0 {
+			if len(attrs) < 4 || len(attrs) < 4+int(binary.BigEndian.Uint16(attrs[2:4])) {
+				return nil, errTruncated
+			}
+			n := int(binary.BigEndian.Uint16(attrs[2:4]))
+			val, attrs = attrs[4:4+n], attrs[4+n:]
+		} else {
+			if len(attrs) < 3+int(attrs[2]) {
+				return nil, errTruncated
+			}
+			n := int(attrs[2])
+			val, attrs = attrs[3:3+n], attrs[3+n:]
+		}
+		switch code {
+		case attrASPath:
+			width := 2
+			if as4 {
+				width = 4
+			}
+			for len(val) > 0 {
+				if len(val) < 2 || len(val) < 2+width*int(val[1]) {
+					return nil, errTruncated
+				}
+				for i := 0; i < int(val[1]); i++ {
+					as := val[2+width*i : 2+width*(i+1)]
+					if as4 {
+						u.asPath = append(u.asPath, binary.BigEndian.Uint32(as))
+					} else {
+						u.asPath = append(u.asPath, uint32(binary.BigEndian.Uint16(as)))
+					}
+				}
+				val = val[2+width*int(val[1]):]
+			}
+
+		case attrNextHop:
+			if len(val) == 4 {
+				u.nextHop = net.IP(append([]byte(nil), val...))
+			}
+
+		case attrLocalPref:
+			if len(val) == 4 {
+				u.localPref = binary.BigEndian.Uint32(val)
+			}
+
+		case attrMPReachNLRI:
+			if len(val) < 5 || len(val) < 5+int(val[3]) {
+				return nil, errTruncated
+			}
+			afi, safi, nhlen := binary.BigEndian.Uint16(val[0:2]), val[2], int(val[3])
+			if afi != afiIPv6 || safi != safiUnicast {
+				continue // not negotiated
+			}
+			nh := val[4 : 4+nhlen]
+			if nhlen == 16 || nhlen == 32 {
+				u.nextHop6 = net.IP(append([]byte(nil), nh[:16]...))
+			}
+			if nhlen == 32 {
+				u.linkLocal = net.IP(append([]byte(nil), nh[16:]...))
+			}
+			prefixes, err := parsePrefixes(val[5+nhlen:], afiIPv6)
+			if err != nil {
+				return nil, err
+			}
+			u.nlri = append(u.nlri, prefixes...)
+
+		case attrMPUnreach:
+			if len(val) < 3 {
+				return nil, errTruncated
+			}
+			afi, safi := binary.BigEndian.Uint16(val[0:2]), val[2]
+			if afi != afiIPv6 || safi != safiUnicast {
+				continue // not negotiated
+			}
+			prefixes, err := parsePrefixes(val[3:], afiIPv6)
+			if err != nil {
+				return nil, err
+			}
+			u.withdrawn = append(u.withdrawn, prefixes...)
+		}
+	}
+	return &u, nil
+}
+
+// notificationError is a NOTIFICATION message, sent or received.
+type notificationError struct {
+	code, subcode uint8
+}
+
+func (n *notificationError) Error() string {
+	return fmt.Sprintf("NOTIFICATION code %d, subcode %d", n.code, n.subcode)
+}
+
+func parseNotification(b []byte) *notificationError {
+	if len(b) < 2 {
+		return &notificationError{}
+	}
+	return &notificationError{code: b[0], subcode: b[1]}
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conntrack selects and deletes connection tracking entries.
+package conntrack
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Filter matches conntrack flows by their original direction. Zero values
+// match any flow.
+type Filter struct {
+	Host    net.IP // matches source or destination address
+	Proto   uint8  // e.g. unix.IPPROTO_TCP
+	SrcIP   net.IP
+	DstIP   net.IP
+	SrcPort uint16
+	DstPort uint16
+
+	// MasqueradedTo matches flows whose source address was translated to
+	// this address, e.g. the address of an uplink.
+	MasqueradedTo net.IP
+}
+
+// Empty reports whether f would match all flows.
+func (f *Filter) Empty() bool {
+	return f.Host == nil && f.Proto == 0 && f.SrcIP == nil && f.DstIP == nil && f.SrcPort == 0 && f.DstPort == 0 && f.MasqueradedTo == nil
+}
+
+// MatchConntrackFlow implements netlink.CustomConntrackFilter.
+func (f *Filter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if f.Empty() {
+		return false // never delete all flows by accident
+	}
+	fwd := flow.Forward
+	if f.Host != nil && !f.Host.Equal(fwd.SrcIP) && !f.Host.Equal(fwd.DstIP) {
+		return false
+	}
+	if f.Proto != 0 && f.Proto != fwd.Protocol {
+		return false
+	}
+	if f.SrcIP != nil && !f.SrcIP.Equal(fwd.SrcIP) {
+		return false
+	}
+	if f.DstIP != nil && !f.DstIP.Equal(fwd.DstIP) {
+		return false
+	}
+	if f.SrcPort != 0 && f.SrcPort != fwd.SrcPort {
+		return false
+	}
+	if f.DstPort != 0 && f.DstPort != fwd.DstPort {
+		return false
+	}
+	if f.MasqueradedTo != nil && (!f.MasqueradedTo.Equal(flow.Reverse.DstIP) || f.MasqueradedTo.Equal(fwd.SrcIP)) {
+		return false
+	}
+	return true
+}
+
+var _ netlink.CustomConntrackFilter = (*Filter)(nil)
+
+// Delete deletes all IPv4 and IPv6 conntrack entries matching f and returns
+// the number of deleted entries.
+func Delete(f *Filter) (uint, error) {
+	var total uint
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, f)
+		if err != nil {
+			return total, fmt.Errorf("ConntrackDeleteFilter: %v", err)
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestMatch(t *testing.T) {
+	var flow netlink.ConntrackFlow
+	flow.Forward.Protocol = unix.IPPROTO_TCP
+	flow.Forward.SrcIP = net.ParseIP("192.168.42.23")
+	flow.Forward.DstIP = net.ParseIP("8.8.8.8")
+	flow.Forward.SrcPort = 54321
+	flow.Forward.DstPort = 443
+	flow.Reverse.SrcIP = net.ParseIP("8.8.8.8")
+	flow.Reverse.DstIP = net.ParseIP("203.0.113.5") // masqueraded
+
+	for _, tt := range []struct {
+		desc   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, false},
+		{"host (source)", Filter{Host: net.ParseIP("192.168.42.23")}, true},
+		{"host (destination)", Filter{Host: net.ParseIP("8.8.8.8")}, true},
+		{"other host", Filter{Host: net.ParseIP("192.168.42.24")}, false},
+		{"5-tuple", Filter{
+			Proto:   unix.IPPROTO_TCP,
+			SrcIP:   net.ParseIP("192.168.42.23"),
+			DstIP:   net.ParseIP("8.8.8.8"),
+			SrcPort: 54321,
+			DstPort: 443,
+		}, true},
+		{"other protocol", Filter{Host: net.ParseIP("8.8.8.8"), Proto: unix.IPPROTO_UDP}, false},
+		{"other port", Filter{Host: net.ParseIP("8.8.8.8"), DstPort: 80}, false},
+		{"masqueraded", Filter{MasqueradedTo: net.ParseIP("203.0.113.5")}, true},
+		{"masqueraded to other address", Filter{MasqueradedTo: net.ParseIP("198.51.100.7")}, false},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := tt.filter.MatchConntrackFlow(&flow); got != tt.want {
+				t.Errorf("MatchConntrackFlow = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
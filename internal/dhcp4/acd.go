@@ -0,0 +1,147 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+)
+
+// Address conflict detection parameters (PROBE_NUM, PROBE_MIN, PROBE_MAX and
+// ANNOUNCE_WAIT of RFC 5227, section 1.1).
+const (
+	probeNum     = 3
+	probeMin     = 1 * time.Second
+	probeMax     = 2 * time.Second
+	announceWait = 2 * time.Second
+)
+
+// probePacket returns an ARP probe for ip: an ARP request whose sender IP
+// address is all zero, so that the neighbor caches of other hosts are not
+// polluted should ip turn out to be in use. The probe is tagged if vlan is
+// not nil.
+func probePacket(hwaddr net.HardwareAddr, ip net.IP, vlan *VLAN) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	eth := &layers.Ethernet{
+		SrcMAC:       hwaddr,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	ls := []gopacket.SerializableLayer{eth}
+	if vlan != nil {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		ls = append(ls, &layers.Dot1Q{
+			Priority:       vlan.Priority,
+			VLANIdentifier: vlan.ID,
+			Type:           layers.EthernetTypeARP,
+		})
+	}
+	ls = append(ls,
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   hwaddr,
+			SourceProtAddress: net.IPv4zero.To4(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    ip.To4(),
+		})
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// conflict returns the hardware address of the host which uses ip according
+// to the ARP packet b (RFC 5227, section 2.1.1): either the host claims ip as
+// its sender address, or it probes for ip itself. It returns nil if b does
+// not reveal a conflict.
+func conflict(b []byte, hwaddr net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	pkt := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.DecodeOptions{})
+	arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		return nil
+	}
+	sender := net.HardwareAddr(arp.SourceHwAddress)
+	if bytes.Equal(sender, hwaddr) {
+		return nil // our own probe
+	}
+	if net.IP(arp.SourceProtAddress).Equal(ip) {
+		return sender
+	}
+	if arp.Operation == layers.ARPRequest &&
+		net.IP(arp.SourceProtAddress).Equal(net.IPv4zero) &&
+		net.IP(arp.DstProtAddress).Equal(ip) {
+		return sender
+	}
+	return nil
+}
+
+// probeARP sends ARP probes for ip via conn and returns the hardware address
+// of the host already using ip, or nil if no host responded.
+func probeARP(conn net.PacketConn, hwaddr net.HardwareAddr, ip net.IP, vlan *VLAN) (net.HardwareAddr, error) {
+	probe, err := probePacket(hwaddr, ip, vlan)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for i := 0; i < probeNum; i++ {
+		if _, err := conn.WriteTo(probe, &raw.Addr{HardwareAddr: layers.EthernetBroadcast}); err != nil {
+			return nil, err
+		}
+		wait := probeMin + time.Duration(rand.Int63n(int64(probeMax-probeMin)))
+		if i == probeNum-1 {
+			wait = announceWait
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return nil, err
+		}
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if os.IsTimeout(err) {
+					break // next probe
+				}
+				return nil, err
+			}
+			if other := conflict(buf[:n], hwaddr, ip); other != nil {
+				return other, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// probeInterface performs address conflict detection for ip on iface (or on
+// the VLAN of iface, if vlan is not nil).
+func probeInterface(iface *net.Interface, hwaddr net.HardwareAddr, ip net.IP, vlan *VLAN) (net.HardwareAddr, error) {
+	conn, err := raw.ListenPacket(iface, syscall.ETH_P_ARP, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return probeARP(conn, hwaddr, ip, vlan)
+}
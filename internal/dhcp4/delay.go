@@ -0,0 +1,48 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// delayConn is a net.PacketConn which delays received packets, simulating a
+// slow DHCP server (see Client.ResponseDelay). Packets which would be
+// delivered after the read deadline are dropped.
+type delayConn struct {
+	net.PacketConn
+	delay    time.Duration
+	deadline time.Time
+}
+
+func (c *delayConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *delayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if !c.deadline.IsZero() && time.Now().Add(c.delay).After(c.deadline) {
+		time.Sleep(time.Until(c.deadline))
+		return 0, addr, syscall.EAGAIN // like a timeout of the raw socket
+	}
+	time.Sleep(c.delay)
+	return n, addr, nil
+}
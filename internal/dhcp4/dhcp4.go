@@ -17,6 +17,7 @@ package dhcp4
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -27,21 +28,53 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/mdlayher/raw"
 	"github.com/rtr7/dhcp4"
+	"github.com/rtr7/router7/internal/trace"
 	"golang.org/x/sys/unix"
 )
 
 type Config struct {
 	RenewAfter time.Time `json:"valid_until"`
-	ClientIP   string    `json:"client_ip"`   // e.g. 85.195.207.62
-	SubnetMask string    `json:"subnet_mask"` // e.g. 255.255.255.128
-	Router     string    `json:"router"`      // e.g. 85.195.207.1
-	DNS        []string  `json:"dns"`         // e.g. 77.109.128.2, 213.144.129.20
+
+	// RebindAfter (T2) is when renewals are no longer addressed to the
+	// server which granted the lease, but to any server.
+	RebindAfter time.Time `json:"rebind_after"`
+
+	// Expiry is when the lease ends unless renewed, after which the address
+	// must no longer be used.
+	Expiry time.Time `json:"expiry"`
+
+	ClientIP   string   `json:"client_ip"`   // e.g. 85.195.207.62
+	SubnetMask string   `json:"subnet_mask"` // e.g. 255.255.255.128
+	Router     string   `json:"router"`      // e.g. 85.195.207.1
+	DNS        []string `json:"dns"`         // e.g. 77.109.128.2, 213.144.129.20
 }
 
 type Client struct {
 	Interface *net.Interface // e.g. net.InterfaceByName("eth0")
 	HWAddr    net.HardwareAddr
 
+	// ParameterRequestList (option 55) overrides the default list of
+	// requested options (DNS, router, subnet mask).
+	ParameterRequestList []layers.DHCPOpt
+
+	// SubnetSelection (option 118, RFC 3011) asks the server to allocate an
+	// address from the specified subnet, as required by some ISPs.
+	SubnetSelection net.IP
+
+	// RequestedAddress (option 50) is requested in DHCPDISCOVER, e.g. an
+	// address the ISP assigned to this router.
+	RequestedAddress net.IP
+
+	// VLAN, if not nil, makes the client send tagged frames on Interface
+	// itself, for uplinks which require DHCP on a VLAN (or priority-tagged
+	// frames) when no VLAN sub-interface exists yet.
+	VLAN *VLAN
+
+	// ResponseDelay, if non-zero, delays each packet received from the
+	// DHCP server (chaos mode), e.g. to validate the failover to a backup
+	// uplink. Responses delayed beyond the 10 second timeout are dropped.
+	ResponseDelay time.Duration
+
 	err          error
 	once         sync.Once
 	connection   net.PacketConn
@@ -51,6 +84,10 @@ type Client struct {
 	timeNow      func() time.Time
 	generateXID  func() uint32
 
+	// probe performs address conflict detection (RFC 5227) for ip and
+	// returns the hardware address of the host already using ip, if any.
+	probe func(ip net.IP) (net.HardwareAddr, error)
+
 	// last DHCPACK packet for renewal/release
 	Ack *layers.DHCPv4
 }
@@ -80,6 +117,32 @@ func (c *Client) packet(xid uint32, opts []layers.DHCPOption) *layers.DHCPv4 {
 	}
 }
 
+// optSubnetSelection is not defined by gopacket.
+const optSubnetSelection = layers.DHCPOpt(118)
+
+var defaultParameterRequestList = []layers.DHCPOpt{
+	layers.DHCPOptDNS,
+	layers.DHCPOptRouter,
+	layers.DHCPOptSubnetMask,
+}
+
+// options returns the options included in both DHCPDISCOVER and DHCPREQUEST.
+func (c *Client) options() []layers.DHCPOption {
+	params := c.ParameterRequestList
+	if len(params) == 0 {
+		params = defaultParameterRequestList
+	}
+	opts := []layers.DHCPOption{
+		dhcp4.HostnameOpt(c.hostname),
+		dhcp4.ClientIDOpt(layers.LinkTypeEthernet, c.hardwareAddr),
+		dhcp4.ParamsRequestOpt(params...),
+	}
+	if subnet := c.SubnetSelection.To4(); subnet != nil {
+		opts = append(opts, layers.NewDHCPOption(optSubnetSelection, subnet))
+	}
+	return opts
+}
+
 var errNAK = errors.New("received DHCPNAK")
 
 // ObtainOrRenew returns false when encountering a permanent error.
@@ -89,6 +152,26 @@ func (c *Client) ObtainOrRenew() bool {
 		if c.timeNow == nil {
 			c.timeNow = time.Now
 		}
+		if c.hardwareAddr == nil && c.HWAddr != nil {
+			c.hardwareAddr = c.HWAddr
+		}
+		if c.hardwareAddr == nil && c.Interface != nil {
+			c.hardwareAddr = c.Interface.HardwareAddr
+		}
+		if c.VLAN != nil {
+			if err := c.VLAN.validate(); err != nil {
+				onceErr = err
+				return
+			}
+		}
+		if c.connection == nil && c.Interface != nil && c.VLAN != nil {
+			conn, err := listenTagged(c.Interface, c.hardwareAddr, *c.VLAN)
+			if err != nil {
+				onceErr = err
+				return
+			}
+			c.connection = conn
+		}
 		if c.connection == nil && c.Interface != nil {
 			conn, err := raw.ListenPacket(c.Interface, syscall.ETH_P_IP, &raw.Config{
 				LinuxSockDGRAM: true,
@@ -103,15 +186,20 @@ func (c *Client) ObtainOrRenew() bool {
 			onceErr = fmt.Errorf("c.Interface is nil")
 			return
 		}
-		if c.hardwareAddr == nil && c.HWAddr != nil {
-			c.hardwareAddr = c.HWAddr
-		}
-		if c.hardwareAddr == nil {
-			c.hardwareAddr = c.Interface.HardwareAddr
+		if c.connection != nil && c.ResponseDelay > 0 {
+			c.connection = &delayConn{
+				PacketConn: c.connection,
+				delay:      c.ResponseDelay,
+			}
 		}
 		if c.generateXID == nil {
 			c.generateXID = dhcp4.XIDGenerator(c.hardwareAddr)
 		}
+		if c.probe == nil && c.Interface != nil {
+			c.probe = func(ip net.IP) (net.HardwareAddr, error) {
+				return probeInterface(c.Interface, c.hardwareAddr, ip, c.VLAN)
+			}
+		}
 		if c.hostname == "" {
 			var utsname unix.Utsname
 			if err := unix.Uname(&utsname); err != nil {
@@ -126,7 +214,19 @@ func (c *Client) ObtainOrRenew() bool {
 		return false // permanent error
 	}
 	c.err = nil // clear previous error
-	ack, err := c.dhcpRequest()
+	span := trace.Start(nil, "dhcp4.ObtainOrRenew")
+	if c.Interface != nil {
+		span.SetAttribute("interface", c.Interface.Name)
+	}
+	span.SetAttribute("renew", c.Ack != nil)
+	defer func() {
+		if c.Ack != nil {
+			span.SetAttribute("client_ip", c.Ack.YourClientIP.String())
+		}
+		span.SetError(c.err)
+		span.End()
+	}()
+	ack, err := c.dhcpRequest(span)
 	if err != nil {
 		if errno, ok := err.(syscall.Errno); ok && errno == syscall.EAGAIN {
 			c.err = fmt.Errorf("DHCP: timeout (server(s) unreachable)")
@@ -138,23 +238,126 @@ func (c *Client) ObtainOrRenew() bool {
 		c.err = fmt.Errorf("DHCP: %v", err)
 		return true // temporary error
 	}
+	if newAddr := c.Ack == nil || !c.Ack.YourClientIP.Equal(ack.YourClientIP); newAddr && c.probe != nil {
+		// RFC 2131, section 4.4.1: the client SHOULD check the newly
+		// received address, e.g. with ARP. ISPs occasionally hand out
+		// addresses which are still in use by another customer.
+		other, err := c.probe(ack.YourClientIP)
+		if err != nil {
+			c.err = fmt.Errorf("DHCP: address conflict detection: %v", err)
+			return true // temporary error
+		}
+		if other != nil {
+			c.Ack = nil // start over at DHCPDISCOVER
+			if err := c.decline(ack); err != nil {
+				c.err = fmt.Errorf("DHCP: %v in use by %v, DHCPDECLINE: %v", ack.YourClientIP, other, err)
+				return true // temporary error
+			}
+			c.err = fmt.Errorf("DHCP: %v in use by %v, sent DHCPDECLINE", ack.YourClientIP, other)
+			return true // temporary error
+		}
+	}
+	cfg, err := updateConfig(c.cfg, ack, c.timeNow())
+	if err != nil {
+		c.Ack = nil // start over at DHCPDISCOVER
+		c.err = fmt.Errorf("DHCP: %v", err)
+		return true // temporary error
+	}
 	c.Ack = ack
-	c.cfg.ClientIP = ack.YourClientIP.String()
-	lease := dhcp4.LeaseFromACK(ack)
+	c.cfg = cfg
+	return true
+}
+
+// minRenewalTime prevents busy-looping when a server hands out leases with a
+// zero (or very short) lease time.
+const minRenewalTime = 1 * time.Minute
+
+// sanitizeOptions drops the options interpreted by this package whose length
+// is invalid, so that malformed packets from the WAN cannot crash the client.
+func sanitizeOptions(opts []layers.DHCPOption) []layers.DHCPOption {
+	sanitized := make([]layers.DHCPOption, 0, len(opts))
+	for _, o := range opts {
+		if int(o.Length) != len(o.Data) {
+			continue
+		}
+		switch o.Type {
+		case layers.DHCPOptMessageType:
+			if len(o.Data) != 1 {
+				continue
+			}
+		case layers.DHCPOptSubnetMask,
+			layers.DHCPOptBroadcastAddr,
+			layers.DHCPOptServerID,
+			layers.DHCPOptLeaseTime,
+			layers.DHCPOptT1,
+			layers.DHCPOptT2:
+			if len(o.Data) != 4 {
+				continue
+			}
+		case layers.DHCPOptRouter:
+			if len(o.Data) < 4 || len(o.Data)%4 != 0 {
+				continue
+			}
+			// Only the first (most preferred) router is used.
+			o = layers.NewDHCPOption(o.Type, o.Data[:4])
+		case layers.DHCPOptDNS:
+			if len(o.Data) == 0 || len(o.Data)%4 != 0 {
+				continue
+			}
+		}
+		sanitized = append(sanitized, o)
+	}
+	return sanitized
+}
+
+// updateConfig returns cfg, updated with the lease contained in ack.
+func updateConfig(cfg Config, ack *layers.DHCPv4, now time.Time) (Config, error) {
+	if ip := ack.YourClientIP.To4(); ip == nil || ip.Equal(net.IPv4zero) {
+		return cfg, fmt.Errorf("DHCPACK does not contain an IPv4 address: %v", ack.YourClientIP)
+	}
+	cfg.ClientIP = ack.YourClientIP.String()
+	sanitized := *ack
+	sanitized.Options = sanitizeOptions(ack.Options)
+	lease := dhcp4.LeaseFromACK(&sanitized)
 	if mask := lease.Netmask; len(mask) > 0 {
-		c.cfg.SubnetMask = fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
+		cfg.SubnetMask = fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
 	}
 	if len(lease.Router) > 0 {
-		c.cfg.Router = lease.Router.String()
+		cfg.Router = lease.Router.String()
 	}
 	if len(lease.DNS) > 0 {
-		c.cfg.DNS = make([]string, len(lease.DNS))
+		cfg.DNS = make([]string, len(lease.DNS))
 		for idx, ip := range lease.DNS {
-			c.cfg.DNS[idx] = ip.String()
+			cfg.DNS[idx] = ip.String()
 		}
 	}
-	c.cfg.RenewAfter = c.timeNow().Add(lease.RenewalTime)
-	return true
+	renewalTime := lease.RenewalTime
+	if renewalTime < minRenewalTime {
+		renewalTime = minRenewalTime
+	}
+	leaseTime := 10 * time.Minute // fallback of dhcp4.LeaseFromACK
+	var rebindingTime time.Duration
+	for _, o := range sanitized.Options {
+		switch o.Type {
+		case layers.DHCPOptLeaseTime:
+			leaseTime = time.Duration(binary.BigEndian.Uint32(o.Data)) * time.Second
+		case layers.DHCPOptT2:
+			rebindingTime = time.Duration(binary.BigEndian.Uint32(o.Data)) * time.Second
+		}
+	}
+	if leaseTime < 2*renewalTime {
+		// Leave time for at least one renewal attempt before the lease
+		// expires, even if the server hands out (very) short leases.
+		leaseTime = 2 * renewalTime
+	}
+	if rebindingTime <= renewalTime || rebindingTime >= leaseTime {
+		// RFC 2131, section 4.4.5: T2 defaults to 0.875 * lease time.
+		rebindingTime = leaseTime * 7 / 8
+	}
+	cfg.RenewAfter = now.Add(renewalTime)
+	cfg.RebindAfter = now.Add(rebindingTime)
+	cfg.Expiry = now.Add(leaseTime)
+	return cfg, nil
 }
 
 func (c *Client) Release() error {
@@ -170,6 +373,16 @@ func (c *Client) Release() error {
 	return nil
 }
 
+// decline informs the server that the address of ack is already in use.
+func (c *Client) decline(ack *layers.DHCPv4) error {
+	decline := c.packet(c.generateXID(), append([]layers.DHCPOption{
+		dhcp4.MessageTypeOpt(layers.DHCPMsgTypeDecline),
+		dhcp4.RequestIPOpt(ack.YourClientIP),
+		dhcp4.ClientIDOpt(layers.LinkTypeEthernet, c.hardwareAddr),
+	}, serverID(ack)...))
+	return dhcp4.Write(c.connection, decline)
+}
+
 func (c *Client) Err() error {
 	return c.err
 }
@@ -178,57 +391,77 @@ func (c *Client) Config() Config {
 	return c.cfg
 }
 
-func (c *Client) dhcpRequest() (*layers.DHCPv4, error) {
+func (c *Client) dhcpRequest(span *trace.Span) (*layers.DHCPv4, error) {
 	var last *layers.DHCPv4
 
 	if c.Ack != nil {
 		last = c.Ack
 	} else {
-		discover := c.packet(c.generateXID(), []layers.DHCPOption{
-			dhcp4.MessageTypeOpt(layers.DHCPMsgTypeDiscover),
-			dhcp4.HostnameOpt(c.hostname),
-			dhcp4.ClientIDOpt(layers.LinkTypeEthernet, c.hardwareAddr),
-			dhcp4.ParamsRequestOpt(
-				layers.DHCPOptDNS,
-				layers.DHCPOptRouter,
-				layers.DHCPOptSubnetMask),
-		})
-		if err := dhcp4.Write(c.connection, discover); err != nil {
+		discoverSpan := trace.Start(span, "DHCPDISCOVER")
+		offer, err := c.discover()
+		discoverSpan.SetError(err)
+		discoverSpan.End()
+		if err != nil {
 			return nil, err
 		}
+		last = offer
+	}
 
-		// Look for DHCPOFFER packet (described in RFC2131 4.3.1):
-		c.connection.SetReadDeadline(time.Now().Add(10 * time.Second))
-		for {
-			offer, err := dhcp4.Read(c.connection)
-			if err != nil {
-				return nil, err
-			}
-			if offer == nil {
-				continue // not a DHCPv4 packet
-			}
-			if offer.Xid != discover.Xid {
-				continue // broadcast reply for different DHCP transaction
-			}
-			if !dhcp4.HasMessageType(offer.Options, layers.DHCPMsgTypeOffer) {
-				continue
-			}
-			last = offer
-			break
+	requestSpan := trace.Start(span, "DHCPREQUEST")
+	ack, err := c.request(last)
+	requestSpan.SetError(err)
+	requestSpan.End()
+	return ack, err
+}
+
+// discover sends a DHCPDISCOVER and returns the first DHCPOFFER.
+func (c *Client) discover() (*layers.DHCPv4, error) {
+	opts := []layers.DHCPOption{
+		dhcp4.MessageTypeOpt(layers.DHCPMsgTypeDiscover),
+	}
+	if addr := c.RequestedAddress.To4(); addr != nil {
+		opts = append(opts, dhcp4.RequestIPOpt(addr))
+	}
+	discover := c.packet(c.generateXID(), append(opts, c.options()...))
+	if err := dhcp4.Write(c.connection, discover); err != nil {
+		return nil, err
+	}
+
+	// Look for DHCPOFFER packet (described in RFC2131 4.3.1):
+	c.connection.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		offer, err := dhcp4.Read(c.connection)
+		if err != nil {
+			return nil, err
+		}
+		if offer == nil {
+			continue // not a DHCPv4 packet
+		}
+		if offer.Xid != discover.Xid {
+			continue // broadcast reply for different DHCP transaction
+		}
+		if !dhcp4.HasMessageType(offer.Options, layers.DHCPMsgTypeOffer) {
+			continue
 		}
+		return offer, nil
 	}
+}
 
+// request sends a DHCPREQUEST for the address of last (a DHCPOFFER or the
+// DHCPACK of the lease to renew) and returns the DHCPACK.
+func (c *Client) request(last *layers.DHCPv4) (*layers.DHCPv4, error) {
 	// Build a DHCPREQUEST packet:
-	request := c.packet(last.Xid, append([]layers.DHCPOption{
+	opts := append([]layers.DHCPOption{
 		dhcp4.MessageTypeOpt(layers.DHCPMsgTypeRequest),
 		dhcp4.RequestIPOpt(last.YourClientIP),
-		dhcp4.HostnameOpt(c.hostname),
-		dhcp4.ClientIDOpt(layers.LinkTypeEthernet, c.hardwareAddr),
-		dhcp4.ParamsRequestOpt(
-			layers.DHCPOptDNS,
-			layers.DHCPOptRouter,
-			layers.DHCPOptSubnetMask),
-	}, serverID(last)...))
+	}, c.options()...)
+	sid := serverID(last)
+	if c.Ack != nil && !c.cfg.RebindAfter.IsZero() && !c.timeNow().Before(c.cfg.RebindAfter) {
+		// RFC 2131, section 4.3.2: the server which granted the lease did
+		// not answer until T2, so any server may extend it (REBINDING).
+		sid = nil
+	}
+	request := c.packet(last.Xid, append(opts, sid...))
 	if err := dhcp4.Write(c.connection, request); err != nil {
 		return nil, err
 	}
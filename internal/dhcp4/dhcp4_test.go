@@ -18,10 +18,15 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rtr7/dhcp4"
 	"github.com/rtr7/router7/internal/testing/pcapreplayer"
 )
 
@@ -58,10 +63,12 @@ func TestDHCP4(t *testing.T) {
 	}
 	got := c.Config()
 	want := Config{
-		RenewAfter: now.Add(13*time.Minute + 24*time.Second),
-		ClientIP:   "85.195.207.62",
-		SubnetMask: "255.255.255.128",
-		Router:     "85.195.207.1",
+		RenewAfter:  now.Add(13*time.Minute + 24*time.Second),
+		RebindAfter: now.Add(23*time.Minute + 27*time.Second),
+		Expiry:      now.Add(26*time.Minute + 48*time.Second),
+		ClientIP:    "85.195.207.62",
+		SubnetMask:  "255.255.255.128",
+		Router:      "85.195.207.1",
 		DNS: []string{
 			"77.109.128.2",
 			"213.144.129.20",
@@ -71,3 +78,345 @@ func TestDHCP4(t *testing.T) {
 		t.Fatalf("unexpected config: diff (-want +got):\n%s", diff)
 	}
 }
+
+func TestOptions(t *testing.T) {
+	c := Client{
+		hardwareAddr:         net.HardwareAddr{0xd8, 0x58, 0xd7, 0x00, 0x4e, 0xdf},
+		hostname:             "router7",
+		ParameterRequestList: []layers.DHCPOpt{layers.DHCPOptSubnetMask, layers.DHCPOptRouter, layers.DHCPOptDNS, layers.DHCPOptClasslessStaticRoute},
+		SubnetSelection:      net.ParseIP("100.64.0.0"),
+	}
+	got := make(map[layers.DHCPOpt][]byte)
+	for _, o := range c.options() {
+		got[o.Type] = o.Data
+	}
+	want := map[layers.DHCPOpt][]byte{
+		layers.DHCPOptHostname:      []byte("router7"),
+		layers.DHCPOptClientID:      {0x01, 0xd8, 0x58, 0xd7, 0x00, 0x4e, 0xdf},
+		layers.DHCPOptParamsRequest: {1, 3, 6, 121},
+		optSubnetSelection:          {100, 64, 0, 0},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected options: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestMalformedACK(t *testing.T) {
+	now := time.Now()
+	ack := &layers.DHCPv4{
+		YourClientIP: net.IP{192, 0, 2, 23},
+		Options: []layers.DHCPOption{
+			layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255}),
+			layers.NewDHCPOption(layers.DHCPOptLeaseTime, []byte{1}),
+			layers.NewDHCPOption(layers.DHCPOptT1, nil),
+			layers.NewDHCPOption(layers.DHCPOptRouter, []byte{192, 0, 2, 1, 192, 0, 2, 2}),
+			layers.NewDHCPOption(layers.DHCPOptDNS, []byte{192, 0, 2, 53, 1}),
+			{Type: layers.DHCPOptDomainName, Length: 10, Data: []byte("lan")},
+		},
+	}
+	got, err := updateConfig(Config{}, ack, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		RenewAfter:  now.Add(5 * time.Minute), // default lease time of 10 minutes
+		RebindAfter: now.Add(10 * time.Minute * 7 / 8),
+		Expiry:      now.Add(10 * time.Minute),
+		ClientIP:    "192.0.2.23",
+		Router:      "192.0.2.1",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected config: diff (-want +got):\n%s", diff)
+	}
+
+	ack.Options = []layers.DHCPOption{
+		layers.NewDHCPOption(layers.DHCPOptLeaseTime, []byte{0, 0, 0, 0}),
+	}
+	got, err = updateConfig(Config{}, ack, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := got.RenewAfter, now.Add(minRenewalTime); !got.Equal(want) {
+		t.Errorf("zero lease time: unexpected RenewAfter: got %v, want %v", got, want)
+	}
+	if got, want := got.Expiry, now.Add(2*minRenewalTime); !got.Equal(want) {
+		t.Errorf("zero lease time: unexpected Expiry: got %v, want %v", got, want)
+	}
+
+	ack.YourClientIP = net.IPv4zero
+	if _, err := updateConfig(Config{}, ack, now); err == nil {
+		t.Errorf("updateConfig unexpectedly succeeded for a DHCPACK without address")
+	}
+}
+
+func TestDecline(t *testing.T) {
+	conn, err := pcapreplayer.NewDHCP4Conn("testdata/fiber7.pcap", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	other := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	var probed net.IP
+	c := Client{
+		hardwareAddr: net.HardwareAddr{0xd8, 0x58, 0xd7, 0x00, 0x4e, 0xdf},
+		timeNow:      time.Now,
+		connection:   conn,
+		generateXID: func() uint32 {
+			return 0x7708d724
+		},
+		probe: func(ip net.IP) (net.HardwareAddr, error) {
+			probed = ip
+			return other, nil
+		},
+	}
+
+	c.ObtainOrRenew()
+	if got, want := probed.String(), "85.195.207.62"; got != want {
+		t.Errorf("probed address: got %s, want %s", got, want)
+	}
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), "DHCPDECLINE") {
+		t.Errorf("unexpected error: got %v, want DHCPDECLINE error", err)
+	}
+	if c.Ack != nil {
+		t.Errorf("declined DHCPACK retained")
+	}
+	if diff := cmp.Diff(Config{}, c.Config()); diff != "" {
+		t.Errorf("declined lease applied: diff (-want +got):\n%s", diff)
+	}
+}
+
+// arpConn is a net.PacketConn which returns the queued packets, followed by
+// timeouts.
+type arpConn struct {
+	net.PacketConn // nil; only the methods below are used
+	queue          [][]byte
+	written        int
+}
+
+func (c *arpConn) WriteTo(b []byte, addr net.Addr) (int, error) { c.written++; return len(b), nil }
+func (c *arpConn) SetReadDeadline(t time.Time) error            { return nil }
+func (c *arpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.queue) == 0 {
+		return 0, nil, syscall.EAGAIN
+	}
+	n := copy(b, c.queue[0])
+	c.queue = c.queue[1:]
+	return n, nil, nil
+}
+
+func arpPacket(t *testing.T, op uint16, hwaddr net.HardwareAddr, src, dst net.IP) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{
+			SrcMAC:       hwaddr,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         op,
+			SourceHwAddress:   hwaddr,
+			SourceProtAddress: src.To4(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    dst.To4(),
+		}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProbeARP(t *testing.T) {
+	var (
+		own     = net.HardwareAddr{0xd8, 0x58, 0xd7, 0x00, 0x4e, 0xdf}
+		other   = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+		ip      = net.ParseIP("192.0.2.23")
+		otherIP = net.ParseIP("192.0.2.42")
+	)
+	ownProbe, err := probePacket(own, ip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		queue [][]byte
+		want  net.HardwareAddr
+	}{
+		{
+			name: "NoConflict",
+			queue: [][]byte{
+				ownProbe, // looped back
+				arpPacket(t, layers.ARPRequest, other, otherIP, net.ParseIP("192.0.2.1")),
+			},
+		},
+		{
+			name:  "Reply",
+			queue: [][]byte{arpPacket(t, layers.ARPReply, other, ip, net.IPv4zero)},
+			want:  other,
+		},
+		{
+			name:  "SimultaneousProbe",
+			queue: [][]byte{arpPacket(t, layers.ARPRequest, other, net.IPv4zero, ip)},
+			want:  other,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &arpConn{queue: tt.queue}
+			got, err := probeARP(conn, own, ip, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want.String() {
+				t.Errorf("probeARP = %v, want %v", got, tt.want)
+			}
+			if tt.want == nil && conn.written != probeNum {
+				t.Errorf("probeARP sent %d probes, want %d", conn.written, probeNum)
+			}
+		})
+	}
+}
+
+// frameConn is a net.PacketConn which records written frames and returns the
+// queued frames.
+type frameConn struct {
+	net.PacketConn // nil; only the methods below are used
+	queue          [][]byte
+	written        [][]byte
+}
+
+func (c *frameConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *frameConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.queue) == 0 {
+		return 0, nil, syscall.EAGAIN
+	}
+	n := copy(b, c.queue[0])
+	c.queue = c.queue[1:]
+	return n, nil, nil
+}
+
+func TestVLAN(t *testing.T) {
+	hwaddr := net.HardwareAddr{0x02, 0x73, 0x53, 0x00, 0xca, 0xfe}
+	offer := &layers.DHCPv4{
+		Operation:    layers.DHCPOpReply,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          0x2342,
+		YourClientIP: net.ParseIP("192.0.2.23"),
+		ClientHWAddr: hwaddr,
+	}
+	ipPacket := func(ls ...gopacket.SerializableLayer) []byte {
+		t.Helper()
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			SrcIP:    net.ParseIP("192.0.2.1"),
+			DstIP:    net.IPv4bcast,
+			Protocol: layers.IPProtocolUDP,
+		}
+		udp := &layers.UDP{SrcPort: 67, DstPort: 68}
+		udp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, append(ls, ip, udp, offer)...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	eth := func(typ layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: typ,
+		}
+	}
+
+	fc := &frameConn{
+		queue: [][]byte{
+			// tagged with a different VLAN: skipped
+			ipPacket(eth(layers.EthernetTypeDot1Q), &layers.Dot1Q{VLANIdentifier: 8, Type: layers.EthernetTypeIPv4}),
+			// untagged by the kernel
+			ipPacket(eth(layers.EthernetTypeIPv4)),
+		},
+	}
+	conn := &taggedConn{
+		PacketConn: fc,
+		hwaddr:     hwaddr,
+		vlan:       VLAN{ID: 7, Priority: 6},
+	}
+	c := Client{
+		hardwareAddr: hwaddr,
+		connection:   conn,
+		generateXID:  func() uint32 { return 0x2342 },
+	}
+	if err := dhcp4.Write(c.connection, c.packet(0x2342, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fc.written), 1; got != want {
+		t.Fatalf("frames written: got %d, want %d", got, want)
+	}
+	pkt := gopacket.NewPacket(fc.written[0], layers.LayerTypeEthernet, gopacket.DecodeOptions{})
+	dot1q, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+	if !ok {
+		t.Fatalf("written frame is not tagged: %v", pkt)
+	}
+	if got, want := dot1q.VLANIdentifier, uint16(7); got != want {
+		t.Errorf("VLAN ID: got %d, want %d", got, want)
+	}
+	if got, want := dot1q.Priority, uint8(6); got != want {
+		t.Errorf("VLAN priority: got %d, want %d", got, want)
+	}
+	if pkt.Layer(layers.LayerTypeDHCPv4) == nil {
+		t.Errorf("written frame does not contain a DHCP packet: %v", pkt)
+	}
+
+	got, err := dhcp4.Read(c.connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || !got.YourClientIP.Equal(offer.YourClientIP) {
+		t.Errorf("dhcp4.Read = %v, want offer for %v", got, offer.YourClientIP)
+	}
+
+	probe, err := probePacket(hwaddr, offer.YourClientIP, &VLAN{ID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt = gopacket.NewPacket(probe, layers.LayerTypeEthernet, gopacket.DecodeOptions{})
+	if dot1q, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); !ok || dot1q.VLANIdentifier != 7 {
+		t.Errorf("ARP probe not tagged with VLAN 7: %v", pkt)
+	}
+
+	if err := (&VLAN{ID: 4095}).validate(); err == nil {
+		t.Errorf("VLAN ID 4095 unexpectedly valid")
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	conn := &delayConn{
+		PacketConn: &arpConn{queue: [][]byte{{1}, {2}}},
+		delay:      50 * time.Millisecond,
+	}
+	buf := make([]byte, 1)
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(10 * time.Second))
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := time.Since(start), conn.delay; got < want {
+		t.Errorf("packet delivered after %v, want at least %v", got, want)
+	}
+	// The second packet would be delivered after the deadline.
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(buf); err != syscall.EAGAIN {
+		t.Errorf("ReadFrom = %v, want %v", err, syscall.EAGAIN)
+	}
+}
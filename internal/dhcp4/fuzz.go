@@ -0,0 +1,42 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build gofuzz
+// +build gofuzz
+
+package dhcp4
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Fuzz is the entry point for go-fuzz, e.g.:
+//
+//	go-fuzz-build github.com/rtr7/router7/internal/dhcp4
+//	go-fuzz -bin=dhcp4-fuzz.zip -workdir=/tmp/dhcp4-fuzz
+func Fuzz(data []byte) int {
+	// Like dhcp4.Read, rely on gopacket recovering from decoder panics.
+	pkt := gopacket.NewPacket(data, layers.LayerTypeDHCPv4, gopacket.DecodeOptions{})
+	ack, ok := pkt.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok {
+		return 0
+	}
+	if _, err := updateConfig(Config{}, ack, time.Now()); err != nil {
+		return 0
+	}
+	return 1
+}
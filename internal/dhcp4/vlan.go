@@ -0,0 +1,145 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+)
+
+// VLAN is an IEEE 802.1Q tag, which the client adds to the frames it sends.
+type VLAN struct {
+	// ID is the VLAN identifier, e.g. 7. Frames with ID 0 are
+	// priority-tagged: they belong to the untagged network, but carry a
+	// priority.
+	ID uint16
+
+	// Priority is the priority code point (PCP), 0 to 7, which some ISPs
+	// require for DHCP frames.
+	Priority uint8
+}
+
+func (v *VLAN) validate() error {
+	if v.ID > 4094 {
+		return fmt.Errorf("invalid VLAN ID %d: must be 0 to 4094", v.ID)
+	}
+	if v.Priority > 7 {
+		return fmt.Errorf("invalid VLAN priority %d: must be 0 to 7", v.Priority)
+	}
+	return nil
+}
+
+// tci returns the tag control information of v.
+func (v *VLAN) tci() uint16 {
+	return uint16(v.Priority)<<13 | v.ID
+}
+
+const (
+	ethernetHdrLen = 14
+	dot1qHdrLen    = 4
+)
+
+// taggedConn is a net.PacketConn which sends the IPv4 packets written to it
+// as VLAN-tagged ethernet frames and returns the IPv4 packets received on the
+// VLAN. This way, the client works on VLAN uplinks before (or without) a VLAN
+// sub-interface, e.g. at first boot.
+//
+// The kernel strips the tag of received frames when no sub-interface for the
+// VLAN exists, so received frames are typically untagged.
+type taggedConn struct {
+	net.PacketConn // SOCK_RAW packet conn, bound to ETH_P_IP
+	hwaddr         net.HardwareAddr
+	vlan           VLAN
+}
+
+func listenTagged(iface *net.Interface, hwaddr net.HardwareAddr, vlan VLAN) (*taggedConn, error) {
+	conn, err := raw.ListenPacket(iface, syscall.ETH_P_IP, nil)
+	if err != nil {
+		return nil, err
+	}
+	if vlan.ID != 0 {
+		// Network cards which filter VLANs in hardware drop frames of
+		// VLANs without sub-interface, unless in promiscuous mode.
+		if err := conn.SetPromiscuous(true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &taggedConn{
+		PacketConn: conn,
+		hwaddr:     hwaddr,
+		vlan:       vlan,
+	}, nil
+}
+
+func (c *taggedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dst := layers.EthernetBroadcast
+	if ra, ok := addr.(*raw.Addr); ok && ra.HardwareAddr != nil {
+		dst = ra.HardwareAddr
+	}
+	frame := make([]byte, ethernetHdrLen+dot1qHdrLen+len(b))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], c.hwaddr)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(layers.EthernetTypeDot1Q))
+	binary.BigEndian.PutUint16(frame[14:16], c.vlan.tci())
+	binary.BigEndian.PutUint16(frame[16:18], uint16(layers.EthernetTypeIPv4))
+	copy(frame[18:], b)
+	if _, err := c.PacketConn.WriteTo(frame, &raw.Addr{HardwareAddr: dst}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// untag returns the IPv4 packet contained in frame, if frame was received on
+// the VLAN with the specified id.
+func untag(frame []byte, id uint16) ([]byte, bool) {
+	if len(frame) < ethernetHdrLen {
+		return nil, false
+	}
+	etype := layers.EthernetType(binary.BigEndian.Uint16(frame[12:14]))
+	payload := frame[ethernetHdrLen:]
+	if etype == layers.EthernetTypeDot1Q {
+		if len(payload) < dot1qHdrLen {
+			return nil, false
+		}
+		if vid := binary.BigEndian.Uint16(payload[0:2]) & 0xfff; vid != id && vid != 0 {
+			return nil, false // different VLAN
+		}
+		etype = layers.EthernetType(binary.BigEndian.Uint16(payload[2:4]))
+		payload = payload[dot1qHdrLen:]
+	}
+	if etype != layers.EthernetTypeIPv4 {
+		return nil, false
+	}
+	return payload, true
+}
+
+func (c *taggedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, ethernetHdrLen+dot1qHdrLen+len(b))
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if payload, ok := untag(buf[:n], c.vlan.ID); ok {
+			return copy(b, payload), addr, nil
+		}
+	}
+}
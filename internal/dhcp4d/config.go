@@ -0,0 +1,278 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// ClassOption is a DHCP option sent to the clients of a Class.
+type ClassOption struct {
+	Code uint8 `json:"code"` // e.g. 66 (TFTP server name)
+
+	// Type determines how Value is encoded: string (default), ip (a
+	// comma-separated list of IPv4 addresses), hex, uint8, uint16 or uint32.
+	Type  string `json:"type"`
+	Value string `json:"value"` // e.g. “tftp://192.168.42.5”
+}
+
+// Class selects options for clients based on their vendor class identifier
+// (option 60) or user class (option 77), e.g. to point VoIP phones to their
+// provisioning server, or PXE clients to a boot file.
+type Class struct {
+	Name string `json:"name"` // e.g. “voip”
+
+	// VendorClass matches clients whose vendor class identifier starts with
+	// VendorClass, e.g. “PXEClient” or “Polycom”.
+	VendorClass string `json:"vendor_class"`
+
+	// UserClass matches clients which send the user class UserClass, e.g.
+	// “iPXE”.
+	UserClass string `json:"user_class"`
+
+	Options []ClassOption `json:"options"`
+
+	// NextServer and BootFile are set in the BOOTP header (siaddr and file),
+	// as expected by PXE clients.
+	NextServer string `json:"next_server"`
+	BootFile   string `json:"boot_file"`
+}
+
+// Config is read from /perm/dhcp4d.json.
+type Config struct {
+	// Classes are matched in order. Options of multiple matching classes are
+	// combined; for options (and boot settings) configured in more than one
+	// class, the first matching class wins.
+	Classes []Class `json:"classes"`
+
+	RateLimit RateLimit `json:"rate_limit"`
+
+	Pool         Pool          `json:"pool"`
+	Reservations []Reservation `json:"reservations"`
+}
+
+// ReadConfig reads dhcp4d.json from dir. A missing file results in an empty
+// Config.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4d.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+type class struct {
+	Class
+	options    []dhcp4.Option
+	nextServer net.IP
+}
+
+func encodeOption(o ClassOption) ([]byte, error) {
+	switch o.Type {
+	case "", "string":
+		return []byte(o.Value), nil
+	case "ip":
+		var b []byte
+		for _, s := range strings.Split(o.Value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s)).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IPv4 address %q", s)
+			}
+			b = append(b, ip...)
+		}
+		return b, nil
+	case "hex":
+		return hex.DecodeString(strings.Replace(o.Value, ":", "", -1))
+	case "uint8", "uint16", "uint32":
+		size, _ := strconv.Atoi(strings.TrimPrefix(o.Type, "uint"))
+		v, err := strconv.ParseUint(o.Value, 0, size)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v))
+		return b[4-size/8:], nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", o.Type)
+	}
+}
+
+func parseClasses(cfg Config) ([]class, error) {
+	classes := make([]class, 0, len(cfg.Classes))
+	for _, c := range cfg.Classes {
+		if c.VendorClass == "" && c.UserClass == "" {
+			return nil, fmt.Errorf("class %s: one of vendor_class and user_class must be set", c.Name)
+		}
+		parsed := class{Class: c}
+		for _, o := range c.Options {
+			switch dhcp4.OptionCode(o.Code) {
+			case dhcp4.Pad, dhcp4.End, dhcp4.OptionDHCPMessageType, dhcp4.OptionServerIdentifier, dhcp4.OptionIPAddressLeaseTime:
+				return nil, fmt.Errorf("class %s: option %d cannot be overridden", c.Name, o.Code)
+			}
+			b, err := encodeOption(o)
+			if err != nil {
+				return nil, fmt.Errorf("class %s: option %d: %v", c.Name, o.Code, err)
+			}
+			if len(b) > 255 {
+				return nil, fmt.Errorf("class %s: option %d: value too long (%d bytes)", c.Name, o.Code, len(b))
+			}
+			parsed.options = append(parsed.options, dhcp4.Option{
+				Code:  dhcp4.OptionCode(o.Code),
+				Value: b,
+			})
+		}
+		if c.NextServer != "" {
+			if parsed.nextServer = net.ParseIP(c.NextServer).To4(); parsed.nextServer == nil {
+				return nil, fmt.Errorf("class %s: invalid next_server %q", c.Name, c.NextServer)
+			}
+		}
+		if len(c.BootFile) > 127 {
+			return nil, fmt.Errorf("class %s: boot_file too long", c.Name)
+		}
+		classes = append(classes, parsed)
+	}
+	return classes, nil
+}
+
+// userClasses returns the user classes of option 77, which is either a list
+// of length-prefixed strings (RFC 3004) or, as sent by many clients, a
+// single string.
+func userClasses(b []byte) []string {
+	classes := []string{string(b)}
+	for len(b) > 0 {
+		n := int(b[0])
+		if n == 0 || n+1 > len(b) {
+			break
+		}
+		classes = append(classes, string(b[1:1+n]))
+		b = b[1+n:]
+	}
+	return classes
+}
+
+func (c *class) matches(options dhcp4.Options) bool {
+	if c.VendorClass != "" {
+		if vc, ok := options[dhcp4.OptionVendorClassIdentifier]; !ok || !strings.HasPrefix(string(vc), c.VendorClass) {
+			return false
+		}
+	}
+	if c.UserClass != "" {
+		uc, ok := options[dhcp4.OptionUserClass]
+		if !ok {
+			return false
+		}
+		var found bool
+		for _, u := range userClasses(uc) {
+			if u == c.UserClass {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SetConfig applies cfg. It is safe to call SetConfig while serving.
+func (h *Handler) SetConfig(cfg Config) error {
+	classes, err := parseClasses(cfg)
+	if err != nil {
+		return err
+	}
+	pool, err := h.parsePool(cfg)
+	if err != nil {
+		return err
+	}
+	h.limiter.setConfig(cfg.RateLimit)
+	h.leasesMu.Lock()
+	if h.setPoolLocked(pool) {
+		h.callLeasesLocked(nil)
+	}
+	h.leasesMu.Unlock()
+	h.classesMu.Lock()
+	defer h.classesMu.Unlock()
+	h.classes = classes
+	h.LeasePeriod = pool.leasePeriod
+	return nil
+}
+
+// reply returns a reply to request p (with options) of type mt, including
+// the options of matching classes.
+func (h *Handler) reply(p dhcp4.Packet, mt dhcp4.MessageType, yIAddr net.IP, options dhcp4.Options) dhcp4.Packet {
+	opts := h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
+	var (
+		nextServer net.IP
+		bootFile   string
+		fromClass  = make(map[dhcp4.OptionCode]bool)
+	)
+	h.classesMu.Lock()
+	for _, c := range h.classes {
+		if !c.matches(options) {
+			continue
+		}
+		// Options configured for a class are sent even if the client did
+		// not request them: they were configured for these clients.
+	Option:
+		for _, o := range c.options {
+			if fromClass[o.Code] {
+				continue // first matching class wins
+			}
+			fromClass[o.Code] = true
+			for i, existing := range opts {
+				if existing.Code == o.Code {
+					opts[i] = o // class options override defaults
+					continue Option
+				}
+			}
+			opts = append(opts, o)
+		}
+		if nextServer == nil {
+			nextServer = c.nextServer
+		}
+		if bootFile == "" {
+			bootFile = c.BootFile
+		}
+	}
+	leasePeriod := h.LeasePeriod
+	h.classesMu.Unlock()
+	reply := dhcp4.ReplyPacket(p, mt, h.serverIP, yIAddr, leasePeriod, opts)
+	if nextServer != nil {
+		reply.SetSIAddr(nextServer)
+	}
+	if bootFile != "" {
+		reply.SetFile([]byte(bootFile))
+	}
+	return reply
+}
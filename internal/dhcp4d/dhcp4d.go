@@ -23,6 +23,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/rtr7/router7/internal/fingerprint"
 	"github.com/rtr7/router7/internal/netconfig"
 
 	"github.com/google/gopacket"
@@ -38,6 +39,12 @@ type Lease struct {
 	Hostname         string    `json:"hostname"`
 	HostnameOverride string    `json:"hostname_override"`
 	Expiry           time.Time `json:"expiry"`
+
+	// Fingerprint is the DHCP parameter request list (option 55) sent by the
+	// client, e.g. “1,3,6,15”. Together with VendorClass (option 60), it
+	// identifies the client’s operating system, see internal/fingerprint.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	VendorClass string `json:"vendor_class,omitempty"`
 }
 
 func (l *Lease) Expired(at time.Time) bool {
@@ -58,9 +65,19 @@ type Handler struct {
 	// Leases is called whenever a new lease is handed out
 	Leases func([]*Lease, *Lease)
 
+	// Dropped is called whenever a request is dropped, with one of the Drop*
+	// reasons.
+	Dropped func(reason string)
+
+	limiter *rateLimiter
+
 	leasesMu sync.Mutex
 	leasesHW map[string]int // points into leasesIP
 	leasesIP map[int]*Lease
+	reserved map[string]int // hardware address to lease number, see Reservation
+
+	classesMu sync.Mutex // also guards LeasePeriod
+	classes   []class
 }
 
 func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.PacketConn) (*Handler, error) {
@@ -81,18 +98,15 @@ func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.Pac
 		}
 	}
 	serverIP = serverIP.To4()
-	start := make(net.IP, len(serverIP))
-	copy(start, serverIP)
-	start[len(start)-1] += 1
 	return &Handler{
 		rawConn:     conn,
 		iface:       iface,
 		leasesHW:    make(map[string]int),
 		leasesIP:    make(map[int]*Lease),
 		serverIP:    serverIP,
-		start:       start,
-		leaseRange:  230,
-		LeasePeriod: 20 * time.Minute,
+		start:       dhcp4.IPAdd(serverIP, 1),
+		leaseRange:  defaultLeaseRange,
+		LeasePeriod: defaultLeasePeriod,
 		options: dhcp4.Options{
 			dhcp4.OptionSubnetMask:       []byte{255, 255, 255, 0},
 			dhcp4.OptionRouter:           []byte(serverIP),
@@ -101,6 +115,7 @@ func NewHandler(dir string, iface *net.Interface, ifaceName string, conn net.Pac
 			dhcp4.OptionDomainSearch:     []byte{0x03, 'l', 'a', 'n', 0x00},
 		},
 		timeNow: time.Now,
+		limiter: newRateLimiter(RateLimit{}),
 	}, nil
 }
 
@@ -163,13 +178,17 @@ func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
 		return -1
 	}
 
+	h.leasesMu.Lock()
+	defer h.leasesMu.Unlock()
 	leaseNum := dhcp4.IPRange(h.start, reqIP) - 1
 	if leaseNum < 0 || leaseNum >= h.leaseRange {
 		return -1
 	}
 
-	h.leasesMu.Lock()
-	defer h.leasesMu.Unlock()
+	if h.reservedLocked(hwaddr, leaseNum) {
+		return -1 // requestor has a reservation for a different address
+	}
+
 	l, ok := h.leasesIP[leaseNum]
 	if !ok {
 		return leaseNum // lease available
@@ -188,6 +207,12 @@ func (h *Handler) canLease(reqIP net.IP, hwaddr string) int {
 
 // ServeDHCP is always called from the same goroutine, so no locking is required.
 func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	if reason := h.limiter.allow(p, msgType, h.timeNow()); reason != "" {
+		if h.Dropped != nil {
+			h.Dropped(reason)
+		}
+		return nil
+	}
 	reply := h.serveDHCP(p, msgType, options)
 	if reply == nil {
 		return nil // unsupported request
@@ -197,12 +222,7 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		ComputeChecksums: true,
 		FixLengths:       true,
 	}
-	destMAC := p.CHAddr()
-	destIP := reply.YIAddr()
-	if p.Broadcast() {
-		destMAC = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
-		destIP = net.IPv4bcast
-	}
+	destMAC, destIP := replyDestination(p, reply)
 	ethernet := &layers.Ethernet{
 		DstMAC:       destMAC,
 		SrcMAC:       h.iface.HardwareAddr,
@@ -235,6 +255,33 @@ func (h *Handler) ServeDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 	return nil
 }
 
+// replyDestination returns the destination of reply to req, following RFC
+// 2131, section 4.1: clients without an IP address which did not set the
+// broadcast flag (i.e. which can receive unicast packets before being
+// configured) receive their reply via unicast to their hardware address,
+// which is why replies are sent using AF_PACKET instead of a UDP socket.
+func replyDestination(req, reply dhcp4.Packet) (net.HardwareAddr, net.IP) {
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	var nak bool
+	if mt := reply.ParseOptions()[dhcp4.OptionDHCPMessageType]; len(mt) == 1 {
+		nak = dhcp4.MessageType(mt[0]) == dhcp4.NAK
+	}
+	if nak {
+		// The client’s address is unusable, so the NAK is always broadcast.
+		return broadcast, net.IPv4bcast
+	}
+	if ciaddr := req.CIAddr(); !ciaddr.Equal(net.IPv4zero) {
+		// The client is configured (renewing or rebinding).
+		return req.CHAddr(), ciaddr
+	}
+	if req.Broadcast() ||
+		req.HLen() != 6 || // not an ethernet address
+		reply.YIAddr().Equal(net.IPv4zero) {
+		return broadcast, net.IPv4bcast
+	}
+	return req.CHAddr(), reply.YIAddr()
+}
+
 func (h *Handler) leaseHW(hwAddr string) (*Lease, bool) {
 	h.leasesMu.Lock()
 	defer h.leasesMu.Unlock()
@@ -280,12 +327,10 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 			return nil // no free leases
 		}
 
-		return dhcp4.ReplyPacket(p,
-			dhcp4.Offer,
-			h.serverIP,
-			dhcp4.IPAdd(h.start, free),
-			h.LeasePeriod,
-			h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+		h.leasesMu.Lock()
+		offer := dhcp4.IPAdd(h.start, free)
+		h.leasesMu.Unlock()
+		return h.reply(p, dhcp4.Offer, offer, options)
 
 	case dhcp4.Request:
 		if server, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP) {
@@ -296,12 +341,17 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 			return dhcp4.ReplyPacket(p, dhcp4.NAK, h.serverIP, nil, 0, nil)
 		}
 
+		h.classesMu.Lock()
+		leasePeriod := h.LeasePeriod
+		h.classesMu.Unlock()
 		lease := &Lease{
 			Num:          leaseNum,
 			Addr:         make([]byte, 4),
 			HardwareAddr: p.CHAddr().String(),
-			Expiry:       h.timeNow().Add(h.LeasePeriod),
+			Expiry:       h.timeNow().Add(leasePeriod),
 			Hostname:     string(options[dhcp4.OptionHostName]),
+			Fingerprint:  fingerprint.ParameterList(options[dhcp4.OptionParameterRequestList]),
+			VendorClass:  string(options[dhcp4.OptionVendorClassIdentifier]),
 		}
 		copy(lease.Addr, reqIP.To4())
 
@@ -327,8 +377,7 @@ func (h *Handler) serveDHCP(p dhcp4.Packet, msgType dhcp4.MessageType, options d
 		h.leasesIP[leaseNum] = lease
 		h.leasesHW[lease.HardwareAddr] = leaseNum
 		h.callLeasesLocked(lease)
-		return dhcp4.ReplyPacket(p, dhcp4.ACK, h.serverIP, reqIP, h.LeasePeriod,
-			h.options.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList]))
+		return h.reply(p, dhcp4.ACK, reqIP, options)
 	}
 	return nil
 }
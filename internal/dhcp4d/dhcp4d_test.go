@@ -15,6 +15,7 @@
 package dhcp4d
 
 import (
+	"bytes"
 	"io/ioutil"
 	"net"
 	"os"
@@ -22,6 +23,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/krolaw/dhcp4"
 )
 
@@ -455,3 +457,361 @@ func TestPersistentStorage(t *testing.T) {
 		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
 	}
 }
+
+func TestClasses(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(Config{
+		Classes: []Class{
+			{
+				Name:        "pxe",
+				VendorClass: "PXEClient",
+				Options: []ClassOption{
+					{Code: 66, Value: "192.168.42.5"},
+				},
+				NextServer: "192.168.42.5",
+				BootFile:   "pxelinux.0",
+			},
+			{
+				Name:      "voip",
+				UserClass: "voice",
+				Options: []ClassOption{
+					{Code: 42, Type: "ip", Value: "192.168.42.6"}, // NTP servers
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+
+	t.Run("PXE", func(t *testing.T) {
+		p := discover(net.IPv4zero, hardwareAddr, dhcp4.Option{
+			Code:  dhcp4.OptionVendorClassIdentifier,
+			Value: []byte("PXEClient:Arch:00000:UNDI:002001"),
+		})
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		opts := resp.ParseOptions()
+		if got, want := string(opts[dhcp4.OptionTFTPServerName]), "192.168.42.5"; got != want {
+			t.Errorf("unexpected TFTP server name: got %q, want %q", got, want)
+		}
+		if got, want := resp.SIAddr(), (net.IP{192, 168, 42, 5}); !got.Equal(want) {
+			t.Errorf("unexpected siaddr: got %v, want %v", got, want)
+		}
+		if got, want := string(bytes.TrimRight(resp.File(), "\x00")), "pxelinux.0"; got != want {
+			t.Errorf("unexpected file: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("UserClass", func(t *testing.T) {
+		p := discover(net.IPv4zero, hardwareAddr, dhcp4.Option{
+			Code:  dhcp4.OptionUserClass,
+			Value: []byte("\x05voice"), // RFC 3004 encoding
+		})
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		opts := resp.ParseOptions()
+		if got, want := net.IP(opts[dhcp4.OptionNetworkTimeProtocolServers]), (net.IP{192, 168, 42, 6}); !got.Equal(want) {
+			t.Errorf("unexpected NTP servers: got %v, want %v", got, want)
+		}
+		if _, ok := opts[dhcp4.OptionTFTPServerName]; ok {
+			t.Errorf("unexpected TFTP server name in reply to non-PXE client")
+		}
+	})
+
+	t.Run("NoMatch", func(t *testing.T) {
+		p := discover(net.IPv4zero, hardwareAddr, dhcp4.Option{
+			Code:  dhcp4.OptionVendorClassIdentifier,
+			Value: []byte("android-dhcp-10"),
+		})
+		resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+		opts := resp.ParseOptions()
+		for _, code := range []dhcp4.OptionCode{dhcp4.OptionTFTPServerName, dhcp4.OptionNetworkTimeProtocolServers} {
+			if _, ok := opts[code]; ok {
+				t.Errorf("unexpected option %v in reply", code)
+			}
+		}
+		if got := resp.SIAddr(); !got.Equal(net.IPv4zero) {
+			t.Errorf("unexpected siaddr: got %v, want %v", got, net.IPv4zero)
+		}
+	})
+}
+
+func TestClassesInvalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Classes: []Class{{Name: "nomatch"}}},
+		{Classes: []Class{{Name: "ip", VendorClass: "x", Options: []ClassOption{{Code: 6, Type: "ip", Value: "::1"}}}}},
+		{Classes: []Class{{Name: "uint8", VendorClass: "x", Options: []ClassOption{{Code: 23, Type: "uint8", Value: "256"}}}}},
+		{Classes: []Class{{Name: "msgtype", VendorClass: "x", Options: []ClassOption{{Code: 53, Value: "x"}}}}},
+	} {
+		if _, err := parseClasses(cfg); err == nil {
+			t.Errorf("parseClasses(%+v) unexpectedly succeeded", cfg)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	hardwareAddr := net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	p := request(net.IP{192, 168, 42, 120}, hardwareAddr)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	var leases []*Lease
+	handler.Leases = func(l []*Lease, latest *Lease) { leases = l }
+	if err := handler.SetConfig(Config{
+		Pool: Pool{
+			Start:       "192.168.42.100",
+			End:         "192.168.42.149",
+			LeasePeriod: "1h",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(leases), 1; got != want {
+		t.Fatalf("unexpected number of leases: got %d, want %d", got, want)
+	}
+	if got, want := leases[0].Num, 20; got != want {
+		t.Errorf("lease not renumbered: got %d, want %d", got, want)
+	}
+
+	for _, tt := range []struct {
+		addr net.IP
+		want dhcp4.MessageType
+	}{
+		{net.IP{192, 168, 42, 99}, dhcp4.NAK},
+		{net.IP{192, 168, 42, 100}, dhcp4.ACK},
+		{net.IP{192, 168, 42, 149}, dhcp4.ACK},
+		{net.IP{192, 168, 42, 150}, dhcp4.NAK},
+	} {
+		p := request(tt.addr, hardwareAddr)
+		resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+		if got := messageType(resp); got != tt.want {
+			t.Errorf("DHCPREQUEST(%v) resulted in unexpected message type: got %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	p = discover(net.IPv4zero, net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x77})
+	resp := handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if ip := resp.YIAddr().To4(); ip[3] < 100 || ip[3] > 149 {
+		t.Errorf("DHCPOFFER for %v, which is outside of the pool", ip)
+	}
+	lt := resp.ParseOptions()[dhcp4.OptionIPAddressLeaseTime]
+	if got, want := lt, []byte{0, 0, 0x0e, 0x10}; !bytes.Equal(got, want) {
+		t.Errorf("unexpected lease time: got %x, want %x", got, want)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	var (
+		addr          = net.IP{192, 168, 42, 23}
+		hardwareAddr1 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		hardwareAddr2 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x77}
+	)
+
+	// hardwareAddr2 obtains addr before it is reserved for hardwareAddr1.
+	p := request(addr, hardwareAddr2)
+	handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+
+	cfg := Config{
+		Reservations: []Reservation{
+			{HardwareAddr: "11:22:33:44:55:66", Addr: "192.168.42.23", Hostname: "printer"},
+		},
+	}
+	if err := handler.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	p = request(addr, hardwareAddr2)
+	resp := handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST of reserved address resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	p = discover(net.IPv4zero, hardwareAddr1)
+	resp = handler.serveDHCP(p, dhcp4.Discover, p.ParseOptions())
+	if got, want := resp.YIAddr().To4(), addr.To4(); !got.Equal(want) {
+		t.Errorf("DHCPOFFER for wrong IP: got %v, want %v", got, want)
+	}
+
+	p = request(net.IP{192, 168, 42, 42}, hardwareAddr1)
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.NAK; got != want {
+		t.Errorf("DHCPREQUEST of other address resulted in unexpected message type: got %v, want %v", got, want)
+	}
+
+	p = request(addr, hardwareAddr1, dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte("unnamed")})
+	resp = handler.serveDHCP(p, dhcp4.Request, p.ParseOptions())
+	if got, want := messageType(resp), dhcp4.ACK; got != want {
+		t.Fatalf("DHCPREQUEST resulted in unexpected message type: got %v, want %v", got, want)
+	}
+	l, ok := handler.leaseHW(hardwareAddr1.String())
+	if !ok {
+		t.Fatalf("no lease for %v", hardwareAddr1)
+	}
+	if !l.Expiry.IsZero() || l.Hostname != "printer" {
+		t.Errorf("reserved lease = %+v, want permanent lease for printer", l)
+	}
+
+	// Removing the reservation turns the lease into a dynamic one.
+	if err := handler.SetConfig(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := handler.leaseHW(hardwareAddr1.String()); l.Expiry.IsZero() {
+		t.Errorf("lease still permanent after removing the reservation")
+	}
+}
+
+func TestPoolInvalid(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	for _, cfg := range []Config{
+		{Pool: Pool{Start: "192.168.42.100"}},
+		{Pool: Pool{Start: "192.168.42.100", End: "192.168.43.10"}},
+		{Pool: Pool{Start: "192.168.42.100", End: "192.168.42.99"}},
+		{Pool: Pool{Start: "192.168.42.1", End: "192.168.42.99"}},
+		{Pool: Pool{LeasePeriod: "10s"}},
+		{Reservations: []Reservation{{HardwareAddr: "x", Addr: "192.168.42.23"}}},
+		{Reservations: []Reservation{{HardwareAddr: "11:22:33:44:55:66", Addr: "192.168.42.250"}}},
+		{Reservations: []Reservation{
+			{HardwareAddr: "11:22:33:44:55:66", Addr: "192.168.42.23"},
+			{HardwareAddr: "11:22:33:44:55:77", Addr: "192.168.42.23"},
+		}},
+	} {
+		if err := handler.SetConfig(cfg); err == nil {
+			t.Errorf("SetConfig(%+v) unexpectedly succeeded", cfg)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	handler, cleanup := testHandler(t)
+	defer cleanup()
+
+	if err := handler.SetConfig(Config{
+		RateLimit: RateLimit{
+			PerSecond:  1,
+			Burst:      2,
+			MaxClients: 2,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	handler.timeNow = func() time.Time { return now }
+	var dropped []string
+	handler.Dropped = func(reason string) { dropped = append(dropped, reason) }
+
+	serve := func(hwaddr net.HardwareAddr, xid byte) {
+		p := dhcp4.RequestPacket(
+			dhcp4.Discover,
+			hwaddr,
+			net.IPv4zero,
+			[]byte{0xaa, 0xbb, 0xcc, xid},
+			false,
+			nil,
+		)
+		handler.ServeDHCP(p, dhcp4.Discover, p.ParseOptions())
+	}
+	var (
+		client1 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x01}
+		client2 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x02}
+		client3 = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x03}
+	)
+
+	serve(client1, 1)
+	serve(client1, 1) // e.g. received via two bridge ports
+	serve(client1, 2)
+	serve(client1, 3) // burst exhausted
+	serve(client2, 1)
+	serve(client3, 1) // too many clients
+	want := []string{DropDuplicate, DropRateLimit, DropOverload}
+	if diff := cmp.Diff(want, dropped); diff != "" {
+		t.Fatalf("unexpected drops: diff (-want +got):\n%s", diff)
+	}
+
+	// After the clients are idle for long enough, their state expires and
+	// their tokens are refilled.
+	dropped = nil
+	now = now.Add(2 * time.Second)
+	serve(client3, 1)
+	serve(client1, 4)
+	if len(dropped) > 0 {
+		t.Fatalf("unexpected drops: %q", dropped)
+	}
+}
+
+func TestReplyDestination(t *testing.T) {
+	var (
+		hardwareAddr = net.HardwareAddr{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+		broadcast    = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		offered      = net.IP{192, 168, 42, 23}
+		configured   = net.IP{192, 168, 42, 42}
+	)
+	for _, tt := range []struct {
+		name      string
+		broadcast bool
+		ciaddr    net.IP
+		mt        dhcp4.MessageType
+		wantMAC   net.HardwareAddr
+		wantIP    net.IP
+	}{
+		{
+			name:    "unicast",
+			mt:      dhcp4.Offer,
+			wantMAC: hardwareAddr,
+			wantIP:  offered,
+		},
+		{
+			name:      "broadcast flag",
+			broadcast: true,
+			mt:        dhcp4.Offer,
+			wantMAC:   broadcast,
+			wantIP:    net.IPv4bcast,
+		},
+		{
+			name:      "renewal",
+			broadcast: true,
+			ciaddr:    configured,
+			mt:        dhcp4.ACK,
+			wantMAC:   hardwareAddr,
+			wantIP:    configured,
+		},
+		{
+			name:    "nak",
+			ciaddr:  configured,
+			mt:      dhcp4.NAK,
+			wantMAC: broadcast,
+			wantIP:  net.IPv4bcast,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := dhcp4.RequestPacket(
+				dhcp4.Request,
+				hardwareAddr,
+				net.IPv4zero,
+				[]byte{0xaa, 0xbb, 0xcc, 0xdd},
+				tt.broadcast,
+				nil,
+			)
+			if tt.ciaddr != nil {
+				req.SetCIAddr(tt.ciaddr)
+			}
+			yiaddr := offered
+			if tt.mt == dhcp4.NAK {
+				yiaddr = nil
+			}
+			reply := dhcp4.ReplyPacket(req, tt.mt, net.IP{192, 168, 42, 1}, yiaddr, 0, nil)
+			gotMAC, gotIP := replyDestination(req, reply)
+			if gotMAC.String() != tt.wantMAC.String() || !gotIP.Equal(tt.wantIP) {
+				t.Errorf("replyDestination() = %v, %v, want %v, %v", gotMAC, gotIP, tt.wantMAC, tt.wantIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// Default pool: the defaultLeaseRange addresses following the server address.
+const (
+	defaultLeaseRange  = 230
+	defaultLeasePeriod = 20 * time.Minute
+)
+
+// Pool configures the addresses handed out. Zero values select the defaults.
+type Pool struct {
+	// Start and End are the first and last address handed out, e.g.
+	// “192.168.42.100” and “192.168.42.199”. Both need to be in the subnet
+	// of the server. Default: the 230 addresses following the server
+	// address.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// LeasePeriod is the validity of dynamic leases, e.g. “1h”. Default:
+	// 20m.
+	LeasePeriod string `json:"lease_period"`
+}
+
+// Reservation assigns a fixed address to a client, identified by its
+// hardware address. Reserved leases never expire, and their address is not
+// handed out to other clients.
+type Reservation struct {
+	HardwareAddr string `json:"hardware_addr"` // e.g. “02:73:53:00:ca:fe”
+	Addr         string `json:"addr"`          // within Pool
+	Hostname     string `json:"hostname"`      // optional
+}
+
+type pool struct {
+	start       net.IP
+	leaseRange  int
+	leasePeriod time.Duration
+
+	// reserved maps hardware addresses to lease numbers.
+	reserved map[string]int
+	hostname map[string]string // of reservations, by hardware address
+}
+
+func (h *Handler) parsePool(cfg Config) (pool, error) {
+	p := pool{
+		start:       dhcp4.IPAdd(h.serverIP, 1),
+		leaseRange:  defaultLeaseRange,
+		leasePeriod: defaultLeasePeriod,
+		reserved:    make(map[string]int),
+		hostname:    make(map[string]string),
+	}
+	subnet := &net.IPNet{
+		IP:   h.serverIP.Mask(net.IPMask(h.options[dhcp4.OptionSubnetMask])),
+		Mask: net.IPMask(h.options[dhcp4.OptionSubnetMask]),
+	}
+	parse := func(field, s string) (net.IP, error) {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("pool: invalid %s %q", field, s)
+		}
+		if !subnet.Contains(ip) {
+			return nil, fmt.Errorf("pool: %s %v not in %v", field, ip, subnet)
+		}
+		return ip, nil
+	}
+	if cfg.Pool.Start != "" || cfg.Pool.End != "" {
+		start, err := parse("start", cfg.Pool.Start)
+		if err != nil {
+			return p, err
+		}
+		end, err := parse("end", cfg.Pool.End)
+		if err != nil {
+			return p, err
+		}
+		if bytes.Compare(start, end) > 0 {
+			return p, fmt.Errorf("pool: start %v after end %v", start, end)
+		}
+		p.start = start
+		p.leaseRange = dhcp4.IPRange(start, end)
+		if n := dhcp4.IPRange(start, h.serverIP) - 1; n >= 0 && n < p.leaseRange {
+			return p, fmt.Errorf("pool: contains server address %v", h.serverIP)
+		}
+	}
+	if cfg.Pool.LeasePeriod != "" {
+		d, err := time.ParseDuration(cfg.Pool.LeasePeriod)
+		if err != nil {
+			return p, fmt.Errorf("pool: lease_period: %v", err)
+		}
+		if d < time.Minute {
+			return p, fmt.Errorf("pool: lease_period %v too short", d)
+		}
+		p.leasePeriod = d
+	}
+
+	taken := make(map[int]string)
+	for _, r := range cfg.Reservations {
+		hwaddr, err := net.ParseMAC(r.HardwareAddr)
+		if err != nil {
+			return p, fmt.Errorf("reservation: %v", err)
+		}
+		ip := net.ParseIP(r.Addr).To4()
+		if ip == nil {
+			return p, fmt.Errorf("reservation %v: invalid addr %q", hwaddr, r.Addr)
+		}
+		num := dhcp4.IPRange(p.start, ip) - 1
+		if num < 0 || num >= p.leaseRange {
+			return p, fmt.Errorf("reservation %v: %v not in pool", hwaddr, ip)
+		}
+		if _, ok := p.reserved[hwaddr.String()]; ok {
+			return p, fmt.Errorf("reservation %v: duplicate hardware_addr", hwaddr)
+		}
+		if other, ok := taken[num]; ok {
+			return p, fmt.Errorf("reservation %v: %v already reserved for %s", hwaddr, ip, other)
+		}
+		taken[num] = hwaddr.String()
+		p.reserved[hwaddr.String()] = num
+		p.hostname[hwaddr.String()] = r.Hostname
+	}
+	return p, nil
+}
+
+// setPoolLocked applies p to the leases database. Leases are renumbered
+// when the start of the pool moved, and dropped when they no longer fit.
+// Clients with a reservation receive a permanent lease, replacing any lease
+// of other clients for the reserved address. It reports whether the leases
+// database changed.
+func (h *Handler) setPoolLocked(p pool) bool {
+	var changed bool
+	if !p.start.Equal(h.start) || p.leaseRange != h.leaseRange {
+		leasesIP := make(map[int]*Lease)
+		for _, l := range h.leasesIP {
+			num := l.Num
+			if !p.start.Equal(h.start) {
+				num = -1
+				if l.Addr.To4() != nil {
+					num = dhcp4.IPRange(p.start, l.Addr) - 1
+				}
+			}
+			if num < 0 || num >= p.leaseRange {
+				delete(h.leasesHW, l.HardwareAddr)
+				changed = true
+				continue
+			}
+			if num != l.Num {
+				l.Num = num
+				h.leasesHW[l.HardwareAddr] = num
+				changed = true
+			}
+			leasesIP[num] = l
+		}
+		h.leasesIP = leasesIP
+	}
+	h.start = p.start
+	h.leaseRange = p.leaseRange
+
+	now := h.timeNow()
+	for hwaddr := range h.reserved {
+		if _, ok := p.reserved[hwaddr]; ok {
+			continue
+		}
+		// The reservation was removed: the lease expires like a dynamic one.
+		if l, ok := h.leasesIP[h.leasesHW[hwaddr]]; ok && l.HardwareAddr == hwaddr && l.Expiry.IsZero() {
+			l.Expiry = now.Add(p.leasePeriod)
+			changed = true
+		}
+	}
+	for hwaddr, num := range p.reserved {
+		lease := &Lease{
+			Num:          num,
+			Addr:         dhcp4.IPAdd(p.start, num),
+			HardwareAddr: hwaddr,
+			Hostname:     p.hostname[hwaddr],
+		}
+		if old, ok := h.leasesIP[num]; ok && old.HardwareAddr == hwaddr {
+			if old.Expiry.IsZero() && (lease.Hostname == "" || lease.Hostname == old.Hostname || old.HostnameOverride != "") {
+				continue // already in place
+			}
+		}
+		if old, ok := h.leasesHW[hwaddr]; ok {
+			if l, ok := h.leasesIP[old]; ok && l.HardwareAddr == hwaddr {
+				if lease.Hostname == "" {
+					lease.Hostname = l.Hostname
+				}
+				lease.HostnameOverride = l.HostnameOverride
+				lease.Fingerprint = l.Fingerprint
+				lease.VendorClass = l.VendorClass
+				delete(h.leasesIP, old)
+			}
+		}
+		if l, ok := h.leasesIP[num]; ok {
+			delete(h.leasesHW, l.HardwareAddr)
+		}
+		if lease.HostnameOverride != "" {
+			lease.Hostname = lease.HostnameOverride
+		}
+		h.leasesIP[num] = lease
+		h.leasesHW[hwaddr] = num
+		changed = true
+	}
+	h.reserved = p.reserved
+	return changed
+}
+
+// reservedLocked reports whether hwaddr may not lease leaseNum because it has
+// a reservation for a different address.
+func (h *Handler) reservedLocked(hwaddr string, leaseNum int) bool {
+	num, ok := h.reserved[hwaddr]
+	return ok && num != leaseNum
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4d
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// Reasons for dropping a request, as passed to Handler.Dropped.
+const (
+	DropDuplicate = "duplicate" // retransmission of the previous request
+	DropRateLimit = "ratelimit" // client exceeded its request rate
+	DropOverload  = "overload"  // too many clients are tracked
+)
+
+// RateLimit protects the server from broadcast storms and misbehaving
+// clients. Zero values select the defaults.
+type RateLimit struct {
+	// PerSecond is the sustained number of requests per second a client
+	// (identified by its hardware address) may send. Default: 1.
+	PerSecond float64 `json:"per_second"`
+
+	// Burst is the number of requests a client may send at once, e.g. when
+	// booting. Default: 10.
+	Burst int `json:"burst"`
+
+	// MaxClients caps the number of clients whose rate limiting state is
+	// tracked. Requests of further clients are dropped until the state of
+	// idle clients expires. Default: 1024.
+	MaxClients int `json:"max_clients"`
+}
+
+// dedupWindow is the interval within which an identical request (same
+// client, message type and transaction ID) is considered a duplicate, e.g. as
+// received via multiple bridge ports. Genuine retransmissions are sent after
+// 4 seconds (RFC 2131, section 4.1).
+const dedupWindow = 1 * time.Second
+
+type clientState struct {
+	tokens   float64
+	last     time.Time // last token refill
+	xid      []byte
+	msgType  dhcp4.MessageType
+	received time.Time // of xid/msgType
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	cfg       RateLimit
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimit) *rateLimiter {
+	rl := &rateLimiter{clients: make(map[string]*clientState)}
+	rl.setConfig(cfg)
+	return rl
+}
+
+func (rl *rateLimiter) setConfig(cfg RateLimit) {
+	if cfg.PerSecond <= 0 {
+		cfg.PerSecond = 1
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 10
+	}
+	if cfg.MaxClients <= 0 {
+		cfg.MaxClients = 1024
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+}
+
+// idle returns how long it takes for a client to refill all its tokens, after
+// which its state is equivalent to that of a new client.
+func (rl *rateLimiter) idle() time.Duration {
+	return time.Duration(float64(rl.cfg.Burst) / rl.cfg.PerSecond * float64(time.Second))
+}
+
+// sweepLocked removes the state of idle clients. To bound the cost of
+// sweeping during a storm, it runs at most once per second.
+func (rl *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Second {
+		return
+	}
+	rl.lastSweep = now
+	idle := rl.idle()
+	for hwaddr, c := range rl.clients {
+		if now.Sub(c.last) >= idle && now.Sub(c.received) >= dedupWindow {
+			delete(rl.clients, hwaddr)
+		}
+	}
+}
+
+// allow returns the reason for dropping the request, or the empty string if
+// the request should be served.
+func (rl *rateLimiter) allow(p dhcp4.Packet, msgType dhcp4.MessageType, now time.Time) string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	hwaddr := p.CHAddr().String()
+	c, ok := rl.clients[hwaddr]
+	if !ok {
+		if len(rl.clients) >= rl.cfg.MaxClients {
+			rl.sweepLocked(now)
+		}
+		if len(rl.clients) >= rl.cfg.MaxClients {
+			return DropOverload
+		}
+		c = &clientState{
+			tokens: float64(rl.cfg.Burst),
+			last:   now,
+		}
+		rl.clients[hwaddr] = c
+	}
+
+	xid := p.XId()
+	if c.msgType == msgType &&
+		bytes.Equal(c.xid, xid) &&
+		now.Sub(c.received) < dedupWindow {
+		return DropDuplicate
+	}
+	c.xid = append(c.xid[:0], xid...)
+	c.msgType = msgType
+	c.received = now
+
+	c.tokens += now.Sub(c.last).Seconds() * rl.cfg.PerSecond
+	if max := float64(rl.cfg.Burst); c.tokens > max {
+		c.tokens = max
+	}
+	c.last = now
+	if c.tokens < 1 {
+		return DropRateLimit
+	}
+	c.tokens--
+	return ""
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4relay
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/krolaw/dhcp4/conn"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Agent relays between the clients on the interfaces of a Config and the
+// servers.
+type Agent struct {
+	relays  []Relay
+	giaddrs map[string]net.IP // by interface
+
+	clients map[string]net.PacketConn // bound to the relayed interfaces
+
+	// servers is not bound to an interface: it receives the replies of
+	// the servers, which are addressed to the gateway address but arrive
+	// on the interface facing the servers.
+	servers net.PacketConn
+}
+
+// interfaceAddr returns the first IPv4 address of ifname.
+func interfaceAddr(ifname string) (net.IP, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no IPv4 address", ifname)
+}
+
+// NewAgent opens the sockets for relaying on the interfaces of cfg.
+// Interfaces which are not present or have no IPv4 address (yet) are
+// skipped.
+func NewAgent(cfg Config) (*Agent, error) {
+	a := &Agent{
+		giaddrs: make(map[string]net.IP),
+		clients: make(map[string]net.PacketConn),
+	}
+	for _, r := range cfg.Relays {
+		giaddr, err := interfaceAddr(r.Interface)
+		if err != nil {
+			log.Printf("not relaying on %s: %v", r.Interface, err)
+			continue
+		}
+		pc, err := conn.NewUDP4BoundListener(r.Interface, ":67")
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("%s: %v", r.Interface, err)
+		}
+		log.Printf("relaying on %s (%v) to %v", r.Interface, giaddr, r.Servers)
+		a.relays = append(a.relays, r)
+		a.giaddrs[r.Interface] = giaddr
+		a.clients[r.Interface] = pc
+	}
+	// An empty interface name leaves the socket unbound (SO_BINDTODEVICE
+	// with an empty name), with SO_REUSEADDR like the bound sockets.
+	pc, err := conn.NewUDP4BoundListener("", ":67")
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	a.servers = pc
+	return a, nil
+}
+
+// Close closes all sockets, which makes Serve return.
+func (a *Agent) Close() error {
+	for _, pc := range a.clients {
+		pc.Close()
+	}
+	if a.servers != nil {
+		a.servers.Close()
+	}
+	return nil
+}
+
+func (a *Agent) serveClients(r Relay, pc net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		p, err := relayRequest(dhcp4.Packet(buf[:n]), r, a.giaddrs[r.Interface])
+		if err != nil {
+			if err != errMalformed {
+				log.Printf("%s: dropping request: %v", r.Interface, err)
+			}
+			continue
+		}
+		for _, s := range r.Servers {
+			dst := &net.UDPAddr{IP: net.ParseIP(s), Port: 67}
+			if _, err := a.servers.WriteTo(p, dst); err != nil {
+				log.Printf("%s: forwarding to %v: %v", r.Interface, dst, err)
+			}
+		}
+	}
+}
+
+func (a *Agent) serveServers() error {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := a.servers.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		p := dhcp4.Packet(buf[:n])
+		if len(p) < 240 || p.OpCode() != dhcp4.BootReply {
+			continue // e.g. a broadcast request of a client
+		}
+		out, r, err := relayReply(p, a.relays, a.giaddrs)
+		if err != nil {
+			log.Printf("dropping reply: %v", err)
+			continue
+		}
+		dst := replyDest(out)
+		if _, err := a.clients[r.Interface].WriteTo(out, dst); err != nil {
+			log.Printf("%s: returning reply to %v: %v", r.Interface, dst, err)
+		}
+	}
+}
+
+// Serve relays until a socket fails or the Agent is closed.
+func (a *Agent) Serve() error {
+	errs := make(chan error, len(a.relays)+1)
+	for _, r := range a.relays {
+		go func(r Relay) {
+			errs <- a.serveClients(r, a.clients[r.Interface])
+		}(r)
+	}
+	go func() { errs <- a.serveServers() }()
+	return <-errs
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhcp4relay implements a DHCPv4 relay agent (RFC 1542, RFC 3046):
+// requests of the clients on a relayed interface (e.g. a VLAN whose leases
+// are handed out by a central DHCP server) are forwarded to the configured
+// servers with the address of the interface as gateway address and a relay
+// agent information option (82), replies are returned to the clients.
+package dhcp4relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// Relay configures relaying on an interface.
+type Relay struct {
+	Interface string   `json:"interface"` // e.g. lan0.20
+	Servers   []string `json:"servers"`   // e.g. ["10.0.0.5"]
+
+	// CircuitID identifies the interface to the servers (sub-option 1 of
+	// option 82), default: the interface name.
+	CircuitID string `json:"circuit_id,omitempty"`
+
+	// RemoteID identifies the relay agent (sub-option 2), e.g. the name of
+	// the site. Omitted if empty.
+	RemoteID string `json:"remote_id,omitempty"`
+}
+
+// Config is read from /perm/dhcp4relay.json.
+type Config struct {
+	Relays []Relay `json:"relays"`
+}
+
+// ReadConfig reads dhcp4relay.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4relay.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("dhcp4relay.json: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, r := range cfg.Relays {
+		if r.Interface == "" {
+			return cfg, fmt.Errorf("dhcp4relay.json: relay without interface")
+		}
+		if seen[r.Interface] {
+			return cfg, fmt.Errorf("dhcp4relay.json: %s: relayed more than once", r.Interface)
+		}
+		seen[r.Interface] = true
+		if len(r.Servers) == 0 {
+			return cfg, fmt.Errorf("dhcp4relay.json: %s: no servers", r.Interface)
+		}
+		for _, s := range r.Servers {
+			if net.ParseIP(s).To4() == nil {
+				return cfg, fmt.Errorf("dhcp4relay.json: %s: invalid server %q", r.Interface, s)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// maxHops is the hop count above which requests are dropped (RFC 1542 section
+// 4.1.1), which prevents forwarding loops between relay agents.
+const maxHops = 16
+
+// Errors returned for packets which are dropped.
+var (
+	errMalformed = errors.New("malformed packet")
+	errHops      = errors.New("hop count exceeded")
+	errUntrusted = errors.New("request already contains relay agent information")
+	errUnknown   = errors.New("reply for an unknown gateway address")
+	errCircuit   = errors.New("reply for a different circuit")
+)
+
+// options returns the options of p (after the magic cookie) up to (but
+// excluding) the End option.
+func options(p dhcp4.Packet) ([]byte, error) {
+	if len(p) < 240 {
+		return nil, errMalformed
+	}
+	opts := p[240:]
+	for i := 0; i < len(opts); {
+		switch dhcp4.OptionCode(opts[i]) {
+		case dhcp4.End:
+			return opts[:i], nil
+		case dhcp4.Pad:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || i+2+int(opts[i+1]) > len(opts) {
+			return nil, errMalformed
+		}
+		i += 2 + int(opts[i+1])
+	}
+	return nil, errMalformed // no End option
+}
+
+// agentInfo returns the value of option 82 with the circuit ID and, if
+// set, the remote ID.
+func agentInfo(circuitID, remoteID string) []byte {
+	b := append([]byte{1, byte(len(circuitID))}, circuitID...)
+	if remoteID != "" {
+		b = append(b, 2, byte(len(remoteID)))
+		b = append(b, remoteID...)
+	}
+	return b
+}
+
+// relayRequest returns request p of a client on the interface with address
+// giaddr, to be forwarded to the servers of r.
+func relayRequest(p dhcp4.Packet, r Relay, giaddr net.IP) (dhcp4.Packet, error) {
+	if len(p) < 240 || p.OpCode() != dhcp4.BootRequest {
+		return nil, errMalformed
+	}
+	if p.Hops() >= maxHops {
+		return nil, errHops
+	}
+	opts, err := options(p)
+	if err != nil {
+		return nil, err
+	}
+	out := make(dhcp4.Packet, 240, len(p)+64)
+	copy(out, p[:240])
+	out = append(out, opts...)
+	out = append(out, byte(dhcp4.End))
+	out.SetHops(p.Hops() + 1)
+	if gi := p.GIAddr(); !gi.Equal(net.IPv4zero) {
+		// Relayed by another agent already (which added its option 82,
+		// if any): forward unchanged apart from the hop count.
+		return out, nil
+	}
+	if _, ok := p.ParseOptions()[dhcp4.OptionRelayAgentInformation]; ok {
+		// RFC 3046 section 2.1: without a gateway address, option 82 was
+		// added by the client (or an untrusted agent).
+		return nil, errUntrusted
+	}
+	out.SetGIAddr(giaddr)
+	circuitID := r.CircuitID
+	if circuitID == "" {
+		circuitID = r.Interface
+	}
+	out.AddOption(dhcp4.OptionRelayAgentInformation, agentInfo(circuitID, r.RemoteID))
+	out.PadToMinSize()
+	return out, nil
+}
+
+// relayReply returns reply p of a server without the relay agent information
+// option, and the relay on whose interface (with address giaddr) the client
+// is.
+func relayReply(p dhcp4.Packet, relays []Relay, giaddrs map[string]net.IP) (dhcp4.Packet, Relay, error) {
+	if len(p) < 240 || p.OpCode() != dhcp4.BootReply {
+		return nil, Relay{}, errMalformed
+	}
+	var (
+		relay Relay
+		found bool
+	)
+	for _, r := range relays {
+		if ip, ok := giaddrs[r.Interface]; ok && ip.Equal(p.GIAddr()) {
+			relay, found = r, true
+			break
+		}
+	}
+	if !found {
+		return nil, Relay{}, errUnknown
+	}
+	opts, err := options(p)
+	if err != nil {
+		return nil, Relay{}, err
+	}
+	out := make(dhcp4.Packet, 240, len(p))
+	copy(out, p[:240])
+	for len(opts) > 0 {
+		if dhcp4.OptionCode(opts[0]) == dhcp4.Pad {
+			opts = opts[1:]
+			continue
+		}
+		n := 2 + int(opts[1])
+		if dhcp4.OptionCode(opts[0]) == dhcp4.OptionRelayAgentInformation {
+			circuitID := relay.CircuitID
+			if circuitID == "" {
+				circuitID = relay.Interface
+			}
+			if string(opts[2:n]) != string(agentInfo(circuitID, relay.RemoteID)) {
+				return nil, Relay{}, errCircuit
+			}
+		} else {
+			out = append(out, opts[:n]...)
+		}
+		opts = opts[n:]
+	}
+	out = append(out, byte(dhcp4.End))
+	out.PadToMinSize()
+	return out, relay, nil
+}
+
+// replyDest returns the destination of reply p on the client interface:
+// clients which have an address (renewals) receive a unicast reply, all other
+// clients a broadcast, as their hardware address is not resolvable yet.
+func replyDest(p dhcp4.Packet) *net.UDPAddr {
+	if ci := p.CIAddr(); !ci.Equal(net.IPv4zero) && !p.Broadcast() {
+		return &net.UDPAddr{IP: ci, Port: 68}
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+}
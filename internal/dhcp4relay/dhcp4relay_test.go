@@ -0,0 +1,136 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp4relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+var hardwareAddr = net.HardwareAddr{0x22, 0xb3, 0x67, 0xfb, 0xc4, 0x41}
+
+func TestRelay(t *testing.T) {
+	relays := []Relay{
+		{Interface: "lan0.20", Servers: []string{"10.0.0.5"}},
+		{Interface: "lan0.30", Servers: []string{"10.0.0.5"}, CircuitID: "guest", RemoteID: "home"},
+	}
+	giaddrs := map[string]net.IP{
+		"lan0.20": net.ParseIP("192.168.20.1").To4(),
+		"lan0.30": net.ParseIP("192.168.30.1").To4(),
+	}
+
+	discover := dhcp4.RequestPacket(dhcp4.Discover, hardwareAddr, nil, []byte{1, 2, 3, 4}, false, nil)
+	req, err := relayRequest(discover, relays[1], giaddrs["lan0.30"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.GIAddr(), giaddrs["lan0.30"]; !got.Equal(want) {
+		t.Errorf("giaddr = %v, want %v", got, want)
+	}
+	if got, want := req.Hops(), byte(1); got != want {
+		t.Errorf("hops = %d, want %d", got, want)
+	}
+	want := []byte{1, 5, 'g', 'u', 'e', 's', 't', 2, 4, 'h', 'o', 'm', 'e'}
+	if got := req.ParseOptions()[dhcp4.OptionRelayAgentInformation]; !bytes.Equal(got, want) {
+		t.Errorf("option 82 = %q, want %q", got, want)
+	}
+	if got, want := req.ParseOptions()[dhcp4.OptionDHCPMessageType], []byte{byte(dhcp4.Discover)}; !bytes.Equal(got, want) {
+		t.Errorf("message type = %v, want %v", got, want)
+	}
+
+	// The server echoes option 82 (RFC 3046 section 2.2).
+	offer := dhcp4.ReplyPacket(req, dhcp4.Offer, net.ParseIP("10.0.0.5").To4(), net.ParseIP("192.168.30.23"), time.Hour, []dhcp4.Option{
+		{Code: dhcp4.OptionRelayAgentInformation, Value: req.ParseOptions()[dhcp4.OptionRelayAgentInformation]},
+		{Code: dhcp4.OptionRouter, Value: giaddrs["lan0.30"]},
+	})
+	reply, r, err := relayReply(offer, relays, giaddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Interface, "lan0.30"; got != want {
+		t.Errorf("reply relayed to %s, want %s", got, want)
+	}
+	opts := reply.ParseOptions()
+	if _, ok := opts[dhcp4.OptionRelayAgentInformation]; ok {
+		t.Errorf("option 82 not removed from reply")
+	}
+	if got, want := opts[dhcp4.OptionRouter], []byte(giaddrs["lan0.30"]); !bytes.Equal(got, want) {
+		t.Errorf("router option = %v, want %v", got, want)
+	}
+	if got, want := replyDest(reply).String(), "255.255.255.255:68"; got != want {
+		t.Errorf("reply destination = %s, want %s", got, want)
+	}
+
+	// A reply whose option 82 belongs to a different circuit is dropped.
+	offer.SetGIAddr(giaddrs["lan0.20"])
+	if _, _, err := relayReply(offer, relays, giaddrs); err != errCircuit {
+		t.Errorf("relayReply(other circuit) = %v, want %v", err, errCircuit)
+	}
+	offer.SetGIAddr(net.ParseIP("192.168.99.1"))
+	if _, _, err := relayReply(offer, relays, giaddrs); err != errUnknown {
+		t.Errorf("relayReply(unknown giaddr) = %v, want %v", err, errUnknown)
+	}
+
+	// Renewals are answered by unicast.
+	renew := dhcp4.ReplyPacket(req, dhcp4.ACK, net.ParseIP("10.0.0.5").To4(), net.ParseIP("192.168.20.23"), time.Hour, nil)
+	renew.SetCIAddr(net.ParseIP("192.168.20.23"))
+	renew.SetGIAddr(giaddrs["lan0.20"])
+	reply, _, err = relayReply(renew, relays, giaddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replyDest(reply).String(), "192.168.20.23:68"; got != want {
+		t.Errorf("reply destination = %s, want %s", got, want)
+	}
+}
+
+func TestRelayDrop(t *testing.T) {
+	r := Relay{Interface: "lan0.20", Servers: []string{"10.0.0.5"}}
+	giaddr := net.ParseIP("192.168.20.1")
+
+	looped := dhcp4.RequestPacket(dhcp4.Discover, hardwareAddr, nil, []byte{1, 2, 3, 4}, false, nil)
+	looped.SetHops(maxHops)
+	if _, err := relayRequest(looped, r, giaddr); err != errHops {
+		t.Errorf("relayRequest(hops %d) = %v, want %v", maxHops, err, errHops)
+	}
+
+	spoofed := dhcp4.RequestPacket(dhcp4.Discover, hardwareAddr, nil, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRelayAgentInformation, Value: agentInfo("lan0.30", "")},
+	})
+	if _, err := relayRequest(spoofed, r, giaddr); err != errUntrusted {
+		t.Errorf("relayRequest(option 82 from client) = %v, want %v", err, errUntrusted)
+	}
+
+	// Requests relayed by another agent keep their gateway address.
+	relayed := dhcp4.RequestPacket(dhcp4.Discover, hardwareAddr, nil, []byte{1, 2, 3, 4}, false, []dhcp4.Option{
+		{Code: dhcp4.OptionRelayAgentInformation, Value: agentInfo("port7", "")},
+	})
+	relayed.SetGIAddr(net.ParseIP("192.168.21.1"))
+	req, err := relayRequest(relayed, r, giaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.GIAddr(), net.ParseIP("192.168.21.1"); !got.Equal(want) {
+		t.Errorf("giaddr = %v, want %v", got, want)
+	}
+
+	if _, err := relayRequest(dhcp4.Packet([]byte{1, 2, 3}), r, giaddr); err != errMalformed {
+		t.Errorf("relayRequest(short packet) = %v, want %v", err, errMalformed)
+	}
+}
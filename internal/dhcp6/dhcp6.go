@@ -25,6 +25,7 @@ import (
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/dhcpv6/client6"
 	"github.com/insomniacslk/dhcp/iana"
+	"github.com/rtr7/router7/internal/trace"
 )
 
 type ClientConfig struct {
@@ -60,6 +61,17 @@ type Config struct {
 	RenewAfter time.Time   `json:"valid_until"`
 	Prefixes   []net.IPNet `json:"prefixes"` // e.g. 2a02:168:4a00::/48
 	DNS        []string    `json:"dns"`      // e.g. 2001:1620:2777:1::10, 2001:1620:2777:2::20
+
+	// Lifetimes contains the lifetimes of Prefixes, in the same order.
+	Lifetimes []Lifetime `json:"lifetimes,omitempty"`
+}
+
+// Lifetime is the preferred and valid lifetime of a delegated prefix, as
+// absolute times so that readers of the lease file need not know when it was
+// written.
+type Lifetime struct {
+	PreferredUntil time.Time `json:"preferred_until"`
+	ValidUntil     time.Time `json:"valid_until"`
 }
 
 type Client struct {
@@ -259,33 +271,80 @@ func (c *Client) request(advertise *dhcpv6.Message) (*dhcpv6.Message, *dhcpv6.Me
 
 func (c *Client) ObtainOrRenew() bool {
 	c.err = nil // clear previous error
+	span := trace.Start(nil, "dhcp6.ObtainOrRenew")
+	defer func() {
+		span.SetError(c.err)
+		span.End()
+	}()
+	solicitSpan := trace.Start(span, "SOLICIT")
 	_, advertise, err := c.solicit(nil)
+	solicitSpan.SetError(err)
+	solicitSpan.End()
 	if err != nil {
 		c.err = err
 		return true
 	}
 
 	c.advertise = advertise
+	requestSpan := trace.Start(span, "REQUEST")
 	_, reply, err := c.request(advertise)
+	requestSpan.SetError(err)
+	requestSpan.End()
 	if err != nil {
 		c.err = err
 		return true
 	}
+	c.cfg = configFromReply(reply, c.timeNow())
+	span.SetAttribute("prefixes", len(c.cfg.Prefixes))
+	return true
+}
+
+// minRenewalTime prevents busy-looping when a server hands out prefixes with
+// a zero (or very short) T1.
+const minRenewalTime = 1 * time.Minute
+
+// configFromReply extracts the network configuration from reply, skipping
+// malformed options: reply was received from the WAN.
+func configFromReply(reply *dhcpv6.Message, now time.Time) Config {
 	var newCfg Config
 	for _, iapd := range reply.Options.IAPD() {
-		t1 := c.timeNow().Add(iapd.T1)
-		if t1.Before(newCfg.RenewAfter) || newCfg.RenewAfter.IsZero() {
-			newCfg.RenewAfter = t1
-		}
+		t1 := iapd.T1
 		for _, prefix := range iapd.Options.Prefixes() {
+			if prefix.Prefix == nil || prefix.Prefix.IP.To16() == nil || prefix.Prefix.IP.To4() != nil {
+				continue
+			}
+			if prefix.ValidLifetime == 0 {
+				continue // prefix withdrawn
+			}
+			if t1 == 0 {
+				// T1 is left to the client (RFC 8415, section 21.21):
+				// renew after half of the preferred lifetime.
+				t1 = prefix.PreferredLifetime / 2
+			}
 			newCfg.Prefixes = append(newCfg.Prefixes, *prefix.Prefix)
+			newCfg.Lifetimes = append(newCfg.Lifetimes, Lifetime{
+				PreferredUntil: now.Add(prefix.PreferredLifetime),
+				ValidUntil:     now.Add(prefix.ValidLifetime),
+			})
+		}
+		if t1 < minRenewalTime {
+			t1 = minRenewalTime
+		}
+		renewAfter := now.Add(t1)
+		if renewAfter.Before(newCfg.RenewAfter) || newCfg.RenewAfter.IsZero() {
+			newCfg.RenewAfter = renewAfter
 		}
 	}
 	for _, dns := range reply.Options.DNS() {
+		if dns.To16() == nil || dns.To4() != nil {
+			continue
+		}
 		newCfg.DNS = append(newCfg.DNS, dns.String())
 	}
-	c.cfg = newCfg
-	return true
+	if newCfg.RenewAfter.IsZero() {
+		newCfg.RenewAfter = now.Add(minRenewalTime) // no IA_PD, retry later
+	}
+	return newCfg
 }
 
 func (c *Client) Release() (release *dhcpv6.Message, reply *dhcpv6.Message, err error) {
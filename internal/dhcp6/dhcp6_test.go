@@ -33,6 +33,8 @@ func TestDHCP6(t *testing.T) {
 		RequestTID  dhcpv6.TransactionID
 		Prefix      net.IPNet
 		Expiry      time.Duration
+		Preferred   time.Duration
+		Valid       time.Duration
 	}{
 		{
 			CaptureFile: "fiber7.pcap",
@@ -40,6 +42,8 @@ func TestDHCP6(t *testing.T) {
 			RequestTID:  dhcpv6.TransactionID{0x73, 0x8c, 0x3b},
 			Prefix:      mustParseCIDR("2a02:168:4a00::/48"),
 			Expiry:      20 * time.Minute,
+			Preferred:   1 * time.Hour,
+			Valid:       24 * time.Hour,
 		},
 
 		{
@@ -48,6 +52,8 @@ func TestDHCP6(t *testing.T) {
 			RequestTID:  dhcpv6.TransactionID{0x49, 0xb4, 0x8c},
 			Prefix:      mustParseCIDR("2a02:168:4bf3::/48"),
 			Expiry:      1000 * time.Second,
+			Preferred:   3000 * time.Second,
+			Valid:       4000 * time.Second,
 		},
 	} {
 		t.Run(tt.CaptureFile, func(t *testing.T) {
@@ -96,6 +102,12 @@ func TestDHCP6(t *testing.T) {
 					"2001:1620:2777:1::10",
 					"2001:1620:2777:2::20",
 				},
+				Lifetimes: []Lifetime{
+					{
+						PreferredUntil: now.Add(tt.Preferred),
+						ValidUntil:     now.Add(tt.Valid),
+					},
+				},
 			}
 			if diff := cmp.Diff(want, got); diff != "" {
 				t.Fatalf("unexpected config: diff (-want +got):\n%s", diff)
@@ -111,3 +123,44 @@ func mustParseCIDR(s string) net.IPNet {
 	}
 	return *net
 }
+
+func TestMalformedReply(t *testing.T) {
+	now := time.Now()
+	prefix := mustParseCIDR("2001:db8::/48")
+	var pdOptions dhcpv6.PDOptions
+	pdOptions.Add(&dhcpv6.OptIAPrefix{}) // no prefix
+	pdOptions.Add(&dhcpv6.OptIAPrefix{
+		ValidLifetime: 1 * time.Hour,
+		Prefix:        &net.IPNet{IP: net.IP{192, 0, 2, 0}, Mask: net.CIDRMask(24, 32)},
+	})
+	pdOptions.Add(&dhcpv6.OptIAPrefix{
+		PreferredLifetime: 30 * time.Minute,
+		ValidLifetime:     1 * time.Hour,
+		Prefix:            &prefix,
+	})
+	reply, err := dhcpv6.NewMessage(
+		dhcpv6.WithIAPD([4]byte{0, 0, 0, 1}),
+		dhcpv6.WithDNS(net.IP{192, 0, 2, 53}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply.UpdateOption(&dhcpv6.OptIAPD{
+		IaId:    [4]byte{0, 0, 0, 1},
+		Options: pdOptions,
+	})
+
+	got := configFromReply(reply, now)
+	want := Config{
+		// T1 is zero, so the client renews after half of the preferred
+		// lifetime.
+		RenewAfter: now.Add(15 * time.Minute),
+		Prefixes:   []net.IPNet{prefix},
+		Lifetimes: []Lifetime{
+			{PreferredUntil: now.Add(30 * time.Minute), ValidUntil: now.Add(1 * time.Hour)},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected config: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build gofuzz
+// +build gofuzz
+
+package dhcp6
+
+import (
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Fuzz is the entry point for go-fuzz, e.g.:
+//
+//	go-fuzz-build github.com/rtr7/router7/internal/dhcp6
+//	go-fuzz -bin=dhcp6-fuzz.zip -workdir=/tmp/dhcp6-fuzz
+func Fuzz(data []byte) int {
+	reply, err := dhcpv6.MessageFromBytes(data)
+	if err != nil {
+		return 0
+	}
+	configFromReply(reply, time.Now())
+	return 1
+}
@@ -15,8 +15,14 @@
 package diag_test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rtr7/router7/internal/diag"
 
 	"github.com/google/go-cmp/cmp"
@@ -52,3 +58,224 @@ func TestDiagMonitor(t *testing.T) {
 		t.Fatalf("Evaluate(): unexpected result: diff (-want +got):\n%s", diff)
 	}
 }
+
+func uplinkResult(linkErr, dhcpErr, pingErr bool) *diag.EvalResult {
+	return &diag.EvalResult{
+		Name:  "link/uplink0",
+		Error: linkErr,
+		Children: []*diag.EvalResult{
+			{
+				Name:  "dhcp4",
+				Error: dhcpErr,
+				Children: []*diag.EvalResult{
+					{Name: "ping4gw", Error: pingErr, Status: "timeout"},
+				},
+			},
+			{Name: "dhcp6", Error: true}, // IPv6 failures are not outages
+		},
+	}
+}
+
+func TestCause(t *testing.T) {
+	for _, tt := range []struct {
+		re   *diag.EvalResult
+		want string
+	}{
+		{uplinkResult(false, false, false), ""},
+		{uplinkResult(true, false, false), diag.CauseLinkDown},
+		{uplinkResult(false, true, false), diag.CauseDHCPFailure},
+		{uplinkResult(false, false, true), diag.CauseUpstreamLoss},
+	} {
+		if got := diag.Cause(tt.re); got != tt.want {
+			t.Errorf("Cause() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "diagd", "availability.json")
+
+	r, err := diag.NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 6, 1, 13, 59, 0, 0, time.UTC)
+	for _, obs := range []struct {
+		offset time.Duration
+		re     *diag.EvalResult
+	}{
+		{0, uplinkResult(false, false, false)},
+		{30 * time.Second, uplinkResult(false, false, true)},
+		{90 * time.Second, uplinkResult(false, false, true)},
+		{120 * time.Second, uplinkResult(false, false, false)},
+	} {
+		if err := r.Observe(start.Add(obs.offset), obs.re); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The history must survive a restart.
+	r, err = diag.NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := r.History()
+	want := []diag.Outage{
+		{
+			Start:      start.Add(30 * time.Second),
+			End:        start.Add(120 * time.Second),
+			Cause:      diag.CauseUpstreamLoss,
+			FirstError: "ping4gw: timeout",
+		},
+	}
+	if diff := cmp.Diff(want, h.Outages); diff != "" {
+		t.Errorf("unexpected outages: diff (-want +got):\n%s", diff)
+	}
+	wantHours := []diag.Hour{
+		{Start: start.Truncate(time.Hour), Up: 30 * time.Second, Down: 30 * time.Second},
+		{Start: start.Add(time.Minute).Truncate(time.Hour), Down: 60 * time.Second},
+	}
+	if diff := cmp.Diff(wantHours, h.Hours); diff != "" {
+		t.Errorf("unexpected hours: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSLAMonitor(t *testing.T) {
+	m := diag.NewSLAMonitor([]diag.SLATarget{
+		{Name: "gw", Addr: "192.0.2.1", MaxLossPercent: 10, MaxLatencyMS: 50},
+	}, prometheus.NewRegistry())
+	var (
+		rtt  time.Duration
+		lost bool
+	)
+	m.Probe = func(addr string) (time.Duration, error) {
+		if lost {
+			return 0, fmt.Errorf("timeout")
+		}
+		return rtt, nil
+	}
+	var events []diag.SLAEvent
+	m.OnEvent = func(ev diag.SLAEvent) { events = append(events, ev) }
+
+	now := time.Date(2020, 6, 1, 13, 0, 0, 0, time.UTC)
+	probe := func(n int) {
+		for i := 0; i < n; i++ {
+			m.ProbeAll(now)
+			now = now.Add(time.Second)
+		}
+	}
+	rtt = 10 * time.Millisecond
+	probe(20)
+	if len(events) != 0 {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	lost = true
+	probe(5) // 20% loss
+	lost = false
+	rtt = 100 * time.Millisecond
+	probe(75) // loss and latency recover
+
+	want := []struct {
+		kind     string
+		breached bool
+	}{
+		{"loss", true},
+		{"latency", true},
+		{"loss", false},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("unexpected events: got %v, want %v", events, want)
+	}
+	for idx, ev := range events {
+		if ev.Kind != want[idx].kind || ev.Breached != want[idx].breached {
+			t.Errorf("event %d: got %v, want %+v", idx, ev, want[idx])
+		}
+	}
+
+	hours := m.Hours()
+	if len(hours) != 1 {
+		t.Fatalf("unexpected hours: %+v", hours)
+	}
+	h := hours[0]
+	if got, want := h.LossPercent, 5.0; got != want {
+		t.Errorf("LossPercent = %v, want %v", got, want)
+	}
+	if got, want := h.P50MS, 100.0; got != want {
+		t.Errorf("P50MS = %v, want %v", got, want)
+	}
+}
+
+func TestHealthArbiter(t *testing.T) {
+	a := diag.NewHealthArbiter(diag.HealthConfig{
+		// Probes default to 3, i.e. 2 of 3 are required.
+		DownAfter:       2,
+		UpAfter:         3,
+		HoldDownSeconds: 60,
+	})
+	now := time.Now()
+	tick := func() time.Time {
+		now = now.Add(5 * time.Second)
+		return now
+	}
+
+	// A single failed round, or a round in which only one probe fails, does
+	// not change the state.
+	for _, succeeded := range []int{1, 2, 0, 3} {
+		if a.Observe(tick(), succeeded) {
+			t.Fatalf("Observe(%d) unexpectedly changed the state", succeeded)
+		}
+	}
+	if a.Observe(tick(), 1) {
+		t.Fatalf("Observe(1) unexpectedly changed the state after one failed round")
+	}
+	if !a.Observe(tick(), 0) {
+		t.Fatalf("Observe(0) did not declare the uplink down after two failed rounds")
+	}
+	if healthy, _ := a.Healthy(); healthy {
+		t.Fatalf("uplink unexpectedly healthy")
+	}
+
+	// Recovery requires three healthy rounds, and the hold-down timer to
+	// expire.
+	for i := 0; i < 5; i++ {
+		if a.Observe(tick(), 3) {
+			t.Fatalf("Observe(3) unexpectedly changed the state within the hold-down time")
+		}
+	}
+	now = now.Add(1 * time.Minute)
+	if !a.Observe(tick(), 3) {
+		t.Fatalf("Observe(3) did not declare the uplink up after the hold-down time")
+	}
+	if healthy, _ := a.Healthy(); !healthy {
+		t.Fatalf("uplink unexpectedly unhealthy")
+	}
+}
+
+func TestReadHealthConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "diag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, tt := range []struct {
+		cfg     string
+		wantErr bool
+	}{
+		{`{"probes": [{"kind": "http", "addr": "http://connectivitycheck.gstatic.com/generate_204"}]}`, false},
+		{`{"probes": [{"kind": "http", "addr": "connectivitycheck.gstatic.com"}]}`, true},
+		{`{"probes": [{"kind": "ping", "addr": "1.1.1.1"}, {"kind": "tcp", "addr": "8.8.8.8:443"}]}`, false},
+		{`{"probes": [{"kind": "smtp", "addr": "192.0.2.1:25"}]}`, true},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "health.json"), []byte(tt.cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := diag.ReadHealthConfig(tmp); (err != nil) != tt.wantErr {
+			t.Errorf("ReadHealthConfig(%s) = %v, want error: %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
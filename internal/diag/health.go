@@ -0,0 +1,369 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// HealthProbe is one of the probes which determine whether an uplink is
+// healthy. Probes are bound to the uplink interface, so that their results
+// are independent of which uplink currently carries the default route.
+type HealthProbe struct {
+	Kind string `json:"kind"` // “ping”, “tcp”, “dns” or “http”
+
+	// Addr is e.g. 1.1.1.1 (ping), 1.1.1.1:443 (tcp), 9.9.9.9:53 (dns) or
+	// http://connectivitycheck.gstatic.com/generate_204 (http, which
+	// succeeds for any status below 400).
+	Addr string `json:"addr"`
+}
+
+// DefaultHealthProbes are used when /perm/health.json does not list any
+// probes: different targets of different operators, using different
+// protocols.
+var DefaultHealthProbes = []HealthProbe{
+	{Kind: "ping", Addr: "1.1.1.1"},
+	{Kind: "tcp", Addr: "8.8.8.8:443"},
+	{Kind: "dns", Addr: "9.9.9.9:53"},
+}
+
+// HealthConfig is read from /perm/health.json. Zero values select the
+// defaults.
+type HealthConfig struct {
+	Interface string        `json:"interface"` // default: uplink0
+	Probes    []HealthProbe `json:"probes"`
+
+	// Required is the number of probes (N of M) which must succeed for a
+	// round of probes to count as healthy. Default: a majority.
+	Required int `json:"required"`
+
+	IntervalSeconds int `json:"interval_seconds"` // between rounds, default: 5
+
+	// DownAfter and UpAfter are the number of consecutive rounds (default: 3
+	// and 6) which need to disagree with the current state before the
+	// uplink is declared down or up (hysteresis).
+	DownAfter int `json:"down_after"`
+	UpAfter   int `json:"up_after"`
+
+	// HoldDownSeconds is the minimum time (default: 60) between changes of
+	// the declared state, so that a marginal link does not cause route
+	// churn.
+	HoldDownSeconds int `json:"hold_down_seconds"`
+}
+
+// ReadHealthConfig reads health.json from dir. Health arbitration is opt-in:
+// if the file does not exist, ReadHealthConfig returns nil.
+func ReadHealthConfig(dir string) (*HealthConfig, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "health.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg HealthConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	for _, p := range cfg.Probes {
+		switch p.Kind {
+		case "ping", "tcp", "dns":
+		case "http":
+			if u, err := url.Parse(p.Addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("probe %+v: addr must be an http or https URL", p)
+			}
+		default:
+			return nil, fmt.Errorf("probe %+v: unknown kind %q (expected ping, tcp, dns or http)", p, p.Kind)
+		}
+		if p.Addr == "" {
+			return nil, fmt.Errorf("probe %+v: addr must be set", p)
+		}
+	}
+	return &cfg, nil
+}
+
+func (cfg HealthConfig) withDefaults() HealthConfig {
+	if cfg.Interface == "" {
+		cfg.Interface = "uplink0"
+	}
+	if len(cfg.Probes) == 0 {
+		cfg.Probes = DefaultHealthProbes
+	}
+	if cfg.Required <= 0 {
+		cfg.Required = len(cfg.Probes)/2 + 1
+	}
+	if cfg.Required > len(cfg.Probes) {
+		cfg.Required = len(cfg.Probes)
+	}
+	if cfg.IntervalSeconds <= 0 {
+		cfg.IntervalSeconds = 5
+	}
+	if cfg.DownAfter <= 0 {
+		cfg.DownAfter = 3
+	}
+	if cfg.UpAfter <= 0 {
+		cfg.UpAfter = 6
+	}
+	if cfg.HoldDownSeconds <= 0 {
+		cfg.HoldDownSeconds = 60
+	}
+	return cfg
+}
+
+// HealthArbiter declares an uplink up or down based on rounds of probes.
+type HealthArbiter struct {
+	// Probe runs p and returns an error if it failed. Replaceable for
+	// testing.
+	Probe func(ifname string, p HealthProbe) error
+
+	cfg HealthConfig
+
+	mu      sync.Mutex
+	healthy bool
+	streak  int // consecutive rounds disagreeing with healthy
+	changed time.Time
+}
+
+// NewHealthArbiter returns a HealthArbiter which initially considers the
+// uplink healthy.
+func NewHealthArbiter(cfg HealthConfig) *HealthArbiter {
+	return &HealthArbiter{
+		Probe:   healthProbe,
+		cfg:     cfg.withDefaults(),
+		healthy: true,
+	}
+}
+
+// Interface returns the name of the uplink whose health is arbitrated.
+func (a *HealthArbiter) Interface() string {
+	return a.cfg.Interface
+}
+
+// Healthy returns whether the uplink is currently considered healthy, and
+// since when (zero if the state never changed).
+func (a *HealthArbiter) Healthy() (bool, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.healthy, a.changed
+}
+
+// Observe records a round of probes of which succeeded probes succeeded, and
+// reports whether the declared state changed.
+func (a *HealthArbiter) Observe(now time.Time, succeeded int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ok := succeeded >= a.cfg.Required
+	if ok == a.healthy {
+		a.streak = 0
+		return false
+	}
+	a.streak++
+	need := a.cfg.UpAfter
+	if a.healthy {
+		need = a.cfg.DownAfter
+	}
+	if a.streak < need {
+		return false
+	}
+	holdDown := time.Duration(a.cfg.HoldDownSeconds) * time.Second
+	if !a.changed.IsZero() && now.Sub(a.changed) < holdDown {
+		return false // change once the hold-down timer expired
+	}
+	a.healthy = ok
+	a.streak = 0
+	a.changed = now
+	return true
+}
+
+// ProbeAll runs all probes concurrently and returns the number of probes
+// which succeeded.
+func (a *HealthArbiter) ProbeAll() int {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+	for _, p := range a.cfg.Probes {
+		wg.Add(1)
+		go func(p HealthProbe) {
+			defer wg.Done()
+			if err := a.Probe(a.cfg.Interface, p); err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			succeeded++
+		}(p)
+	}
+	wg.Wait()
+	return succeeded
+}
+
+// Run probes the uplink every interval and calls onChange whenever the
+// declared state changes. It does not return.
+func (a *HealthArbiter) Run(onChange func(healthy bool)) {
+	for range time.Tick(time.Duration(a.cfg.IntervalSeconds) * time.Second) {
+		if a.Observe(time.Now(), a.ProbeAll()) {
+			healthy, _ := a.Healthy()
+			onChange(healthy)
+		}
+	}
+}
+
+const healthProbeTimeout = 2 * time.Second
+
+func bindToDevice(ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifname)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+func healthProbe(ifname string, p HealthProbe) error {
+	switch p.Kind {
+	case "ping":
+		return pingDevice(ifname, p.Addr)
+
+	case "tcp":
+		d := net.Dialer{
+			Timeout: healthProbeTimeout,
+			Control: bindToDevice(ifname),
+		}
+		conn, err := d.Dial("tcp4", p.Addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case "dns":
+		c := dns.Client{
+			Net: "udp4",
+			Dialer: &net.Dialer{
+				Timeout: healthProbeTimeout,
+				Control: bindToDevice(ifname),
+			},
+			Timeout: healthProbeTimeout,
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(".", dns.TypeNS)
+		_, _, err := c.Exchange(m, p.Addr)
+		return err
+
+	case "http":
+		return httpProbe(ifname, p.Addr)
+
+	default:
+		return fmt.Errorf("unknown kind %q", p.Kind)
+	}
+}
+
+// httpProbe requests url via ifname.
+func httpProbe(ifname, url string) error {
+	d := net.Dialer{
+		Timeout: healthProbeTimeout,
+		Control: bindToDevice(ifname),
+	}
+	client := &http.Client{
+		Timeout: healthProbeTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, "tcp4", addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse // a redirect is a response, too
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected HTTP status: %v", resp.Status)
+	}
+	return nil
+}
+
+// pingDevice sends an ICMP echo request to addr via ifname and waits for the
+// reply.
+func pingDevice(ifname, addr string) error {
+	ip, err := net.ResolveIPAddr("ip4", addr)
+	if err != nil {
+		return err
+	}
+	lc := net.ListenConfig{Control: bindToDevice(ifname)}
+	conn, err := lc.ListenPacket(context.Background(), "ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	id := os.Getpid() & 0xffff
+	req := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  1,
+			Data: []byte("router7 health"),
+		},
+	}
+	b, err := req.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(b, ip); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(healthProbeTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if !peer.(*net.IPAddr).IP.Equal(ip.IP) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(1 /* ICMP */, buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && reply.Type == ipv4.ICMPTypeEchoReply && echo.ID == id {
+			return nil
+		}
+	}
+}
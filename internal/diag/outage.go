@@ -0,0 +1,240 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// Suspected causes of an outage, derived from the first failing node of the
+// IPv4 path (see Cause).
+const (
+	CauseLinkDown     = "link down"
+	CauseDHCPFailure  = "DHCP failure"
+	CauseUpstreamLoss = "upstream loss"
+)
+
+// Cause returns the suspected cause of the uplink being unreachable, or the
+// empty string if the IPv4 path (link, DHCPv4 and the nodes depending on
+// DHCPv4) succeeded.
+func Cause(re *EvalResult) string {
+	cause, _ := classify(re)
+	return cause
+}
+
+// classify returns the suspected cause and the first failing node of the IPv4
+// path.
+func classify(re *EvalResult) (string, *EvalResult) {
+	if strings.HasPrefix(re.Name, "link/") {
+		if re.Error {
+			return CauseLinkDown, re
+		}
+		for _, ch := range re.Children {
+			if cause, failed := classify(ch); cause != "" {
+				return cause, failed
+			}
+		}
+		return "", nil
+	}
+	if re.Name != "dhcp4" {
+		return "", nil // IPv6 path
+	}
+	if re.Error {
+		return CauseDHCPFailure, re
+	}
+	if failed := firstFailed(re); failed != nil {
+		return CauseUpstreamLoss, failed
+	}
+	return "", nil
+}
+
+func firstFailed(re *EvalResult) *EvalResult {
+	if re.Error {
+		return re
+	}
+	for _, ch := range re.Children {
+		if failed := firstFailed(ch); failed != nil {
+			return failed
+		}
+	}
+	return nil
+}
+
+// Outage is a period during which the uplink was unreachable.
+type Outage struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"` // zero while the outage is ongoing
+	Cause string    `json:"cause"`
+
+	// FirstError is the first failing node and its status, e.g.
+	// “dhcp4: lease expired at …”.
+	FirstError string `json:"first_error"`
+}
+
+// Duration returns the duration of o (so far, if it is ongoing).
+func (o *Outage) Duration(now time.Time) time.Duration {
+	if o.End.IsZero() {
+		return now.Sub(o.Start)
+	}
+	return o.End.Sub(o.Start)
+}
+
+// Hour is the availability of the uplink during one hour. Up and Down are
+// encoded in nanoseconds.
+type Hour struct {
+	Start time.Time     `json:"start"`
+	Up    time.Duration `json:"up"`
+	Down  time.Duration `json:"down"`
+}
+
+// History is the recorded availability of the uplink.
+type History struct {
+	Hours   []Hour   `json:"hours"`
+	Outages []Outage `json:"outages"`
+}
+
+// Limits of the recorded history, so that the state file stays small.
+const (
+	maxHours   = 90 * 24
+	maxOutages = 1000
+
+	// maxGap is the maximum duration between two observations which is
+	// accounted in Hours.
+	maxGap = 5 * time.Minute
+)
+
+// Recorder records the availability of the uplink to a state file, which is
+// written whenever the availability changes and once per hour.
+type Recorder struct {
+	path string
+
+	mu       sync.Mutex
+	history  History
+	last     time.Time // last observation
+	lastUp   bool
+	lastHour time.Time // written to path
+}
+
+// NewRecorder returns a Recorder which persists its history in path,
+// continuing the history which was previously persisted, if any.
+func NewRecorder(path string) (*Recorder, error) {
+	r := &Recorder{path: path, lastUp: true}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &r.history); err != nil {
+			return nil, err
+		}
+		if n := len(r.history.Outages); n > 0 && r.history.Outages[n-1].End.IsZero() {
+			r.lastUp = false
+		}
+	}
+	return r, nil
+}
+
+func (r *Recorder) hour(start time.Time) *Hour {
+	if n := len(r.history.Hours); n > 0 && r.history.Hours[n-1].Start.Equal(start) {
+		return &r.history.Hours[n-1]
+	}
+	r.history.Hours = append(r.history.Hours, Hour{Start: start})
+	if len(r.history.Hours) > maxHours {
+		r.history.Hours = r.history.Hours[len(r.history.Hours)-maxHours:]
+	}
+	return &r.history.Hours[len(r.history.Hours)-1]
+}
+
+// Observe records the evaluation result re, obtained at now.
+func (r *Recorder) Observe(now time.Time, re *EvalResult) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cause, failed := classify(re)
+	up := cause == ""
+
+	// Account the time since the previous observation to the state which was
+	// observed back then. A gap (e.g. the router was powered off) is not
+	// accounted at all.
+	if !r.last.IsZero() && now.Sub(r.last) < maxGap {
+		for t := r.last; t.Before(now); {
+			start := t.Truncate(time.Hour)
+			end := start.Add(time.Hour)
+			if end.After(now) {
+				end = now
+			}
+			h := r.hour(start)
+			if r.lastUp {
+				h.Up += end.Sub(t)
+			} else {
+				h.Down += end.Sub(t)
+			}
+			t = end
+		}
+	}
+	r.last = now
+
+	changed := up != r.lastUp
+	r.lastUp = up
+	if changed {
+		if up {
+			r.history.Outages[len(r.history.Outages)-1].End = now
+		} else {
+			r.history.Outages = append(r.history.Outages, Outage{
+				Start:      now,
+				Cause:      cause,
+				FirstError: failed.Name + ": " + failed.Status,
+			})
+			if len(r.history.Outages) > maxOutages {
+				r.history.Outages = r.history.Outages[len(r.history.Outages)-maxOutages:]
+			}
+		}
+	}
+
+	if hour := now.Truncate(time.Hour); changed || !hour.Equal(r.lastHour) {
+		r.lastHour = hour
+		return r.persist()
+	}
+	return nil
+}
+
+func (r *Recorder) persist() error {
+	b, err := json.Marshal(&r.history)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(r.path, b, 0644)
+}
+
+// History returns a copy of the recorded history.
+func (r *Recorder) History() History {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return History{
+		Hours:   append([]Hour(nil), r.history.Hours...),
+		Outages: append([]Outage(nil), r.history.Outages...),
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digineo/go-ping"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultGateway can be used as SLATarget.Addr to ping the current IPv4
+// default gateway (typically the ISP’s router).
+const DefaultGateway = "$default-gateway"
+
+// SLATarget is a target whose latency and loss is monitored.
+type SLATarget struct {
+	Name string `json:"name"` // e.g. “isp-gateway”
+	Addr string `json:"addr"` // host name, IPv4 address or DefaultGateway
+
+	// Thresholds which, when exceeded over the last slaWindow probes,
+	// trigger an SLAEvent. Zero disables the threshold.
+	MaxLossPercent float64 `json:"max_loss_percent"`
+	MaxLatencyMS   float64 `json:"max_latency_ms"` // 95th percentile
+}
+
+// DefaultSLATargets are monitored when /perm/sla.json does not exist.
+var DefaultSLATargets = []SLATarget{
+	{Name: "gateway", Addr: DefaultGateway, MaxLossPercent: 5, MaxLatencyMS: 50},
+	{Name: "cloudflare", Addr: "1.1.1.1", MaxLossPercent: 5, MaxLatencyMS: 100},
+}
+
+// ReadSLAConfig reads the targets from sla.json in dir, or returns
+// DefaultSLATargets if the file does not exist.
+func ReadSLAConfig(dir string) ([]SLATarget, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sla.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultSLATargets, nil
+		}
+		return nil, err
+	}
+	var cfg struct {
+		Targets []SLATarget `json:"targets"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	for _, t := range cfg.Targets {
+		if t.Name == "" || t.Addr == "" {
+			return nil, fmt.Errorf("target %+v: name and addr must be set", t)
+		}
+	}
+	return cfg.Targets, nil
+}
+
+const (
+	// slaWindow is the number of most recent probes over which thresholds
+	// are evaluated.
+	slaWindow = 60
+
+	// slaMinSamples is the number of probes required before thresholds are
+	// evaluated, so that a single lost probe after startup does not
+	// trigger an event.
+	slaMinSamples = 10
+
+	// slaHours is the number of SLAHour entries kept per target.
+	slaHours = 48
+
+	// slaEvents is the number of SLAEvents kept.
+	slaEvents = 100
+)
+
+// SLAHour summarizes the probes of a target during one hour.
+type SLAHour struct {
+	Target      string    `json:"target"`
+	Start       time.Time `json:"start"`
+	Sent        int       `json:"sent"`
+	Lost        int       `json:"lost"`
+	LossPercent float64   `json:"loss_percent"`
+	P50MS       float64   `json:"p50_ms"`
+	P95MS       float64   `json:"p95_ms"`
+	P99MS       float64   `json:"p99_ms"`
+
+	rtts []time.Duration
+}
+
+// SLAEvent is emitted when a threshold is breached (Breached is true) and when
+// the target recovers (Breached is false).
+type SLAEvent struct {
+	Time      time.Time `json:"time"`
+	Target    string    `json:"target"`
+	Kind      string    `json:"kind"` // “loss” or “latency”
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Breached  bool      `json:"breached"`
+}
+
+func (ev SLAEvent) String() string {
+	state := "recovered"
+	if ev.Breached {
+		state = "breached"
+	}
+	return fmt.Sprintf("SLA %s: %s %s (%.2f, threshold %.2f)", state, ev.Target, ev.Kind, ev.Value, ev.Threshold)
+}
+
+// sample is the result of one probe: rtt is negative if the probe was lost.
+type sample time.Duration
+
+type slaTarget struct {
+	SLATarget
+	hours    []*SLAHour
+	recent   []sample // last slaWindow probes
+	breached map[string]bool
+}
+
+// SLAMonitor pings targets and tracks their latency and loss.
+type SLAMonitor struct {
+	// Probe pings addr and returns the round-trip time. Replaceable for
+	// testing.
+	Probe func(addr string) (time.Duration, error)
+
+	// OnEvent, if non-nil, is called for each event (in addition to the
+	// event being recorded, see Events).
+	OnEvent func(SLAEvent)
+
+	mu      sync.Mutex
+	targets []*slaTarget
+	events  []SLAEvent
+
+	rtt      *prometheus.HistogramVec
+	probes   *prometheus.CounterVec
+	loss     *prometheus.GaugeVec
+	breaches *prometheus.CounterVec
+}
+
+// NewSLAMonitor returns an SLAMonitor for targets whose metrics are
+// registered with reg.
+func NewSLAMonitor(targets []SLATarget, reg prometheus.Registerer) *SLAMonitor {
+	m := &SLAMonitor{
+		Probe: ping4Probe,
+		rtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "diag_sla_rtt_seconds",
+			Help:    "Round-trip time of successful SLA probes",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		}, []string{"target"}),
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "diag_sla_probes_total",
+			Help: "SLA probes by result (ok or lost)",
+		}, []string{"target", "result"}),
+		loss: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "diag_sla_loss_ratio",
+			Help: "Ratio of lost SLA probes within the evaluation window",
+		}, []string{"target"}),
+		breaches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "diag_sla_breaches_total",
+			Help: "SLA threshold breaches by kind (loss or latency)",
+		}, []string{"target", "kind"}),
+	}
+	reg.MustRegister(m.rtt, m.probes, m.loss, m.breaches)
+	for _, t := range targets {
+		m.targets = append(m.targets, &slaTarget{
+			SLATarget: t,
+			breached:  make(map[string]bool),
+		})
+	}
+	return m
+}
+
+func ping4Probe(addr string) (time.Duration, error) {
+	const timeout = 1 * time.Second
+	if addr == DefaultGateway {
+		gw, err := defaultIPv4Gateway()
+		if err != nil {
+			return 0, err
+		}
+		addr = gw
+	}
+	ip, err := net.ResolveIPAddr("ip4", addr)
+	if err != nil {
+		return 0, err
+	}
+	p, err := ping.New("0.0.0.0", "")
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+	return p.Ping(ip, timeout)
+}
+
+// Run probes all targets every interval. It does not return.
+func (m *SLAMonitor) Run(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.ProbeAll(time.Now())
+	}
+}
+
+// ProbeAll probes all targets concurrently and records the results as
+// obtained at now.
+func (m *SLAMonitor) ProbeAll(now time.Time) {
+	var wg sync.WaitGroup
+	for _, t := range m.targets {
+		wg.Add(1)
+		go func(t *slaTarget) {
+			defer wg.Done()
+			rtt, err := m.Probe(t.Addr)
+			if err != nil {
+				rtt = -1
+			}
+			m.record(now, t, sample(rtt))
+		}(t)
+	}
+	wg.Wait()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1 // nearest rank
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (m *SLAMonitor) record(now time.Time, t *slaTarget, s sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s < 0 {
+		m.probes.WithLabelValues(t.Name, "lost").Inc()
+	} else {
+		m.probes.WithLabelValues(t.Name, "ok").Inc()
+		m.rtt.WithLabelValues(t.Name).Observe(time.Duration(s).Seconds())
+	}
+
+	start := now.Truncate(time.Hour)
+	if n := len(t.hours); n == 0 || !t.hours[n-1].Start.Equal(start) {
+		t.hours = append(t.hours, &SLAHour{Target: t.Name, Start: start})
+		if len(t.hours) > slaHours {
+			t.hours = t.hours[len(t.hours)-slaHours:]
+		}
+	}
+	h := t.hours[len(t.hours)-1]
+	h.Sent++
+	if s < 0 {
+		h.Lost++
+	} else {
+		h.rtts = append(h.rtts, time.Duration(s))
+	}
+
+	t.recent = append(t.recent, s)
+	if len(t.recent) > slaWindow {
+		t.recent = t.recent[len(t.recent)-slaWindow:]
+	}
+	var (
+		lost int
+		rtts []time.Duration
+	)
+	for _, s := range t.recent {
+		if s < 0 {
+			lost++
+		} else {
+			rtts = append(rtts, time.Duration(s))
+		}
+	}
+	lossPercent := 100 * float64(lost) / float64(len(t.recent))
+	m.loss.WithLabelValues(t.Name).Set(lossPercent / 100)
+	if len(t.recent) < slaMinSamples {
+		return
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	m.check(now, t, "loss", lossPercent, t.MaxLossPercent)
+	if len(rtts) > 0 {
+		m.check(now, t, "latency", ms(percentile(rtts, 0.95)), t.MaxLatencyMS)
+	}
+}
+
+// check emits an SLAEvent if the breach state of kind changed.
+func (m *SLAMonitor) check(now time.Time, t *slaTarget, kind string, value, threshold float64) {
+	if threshold == 0 {
+		return
+	}
+	breached := value > threshold
+	if breached == t.breached[kind] {
+		return
+	}
+	t.breached[kind] = breached
+	ev := SLAEvent{
+		Time:      now,
+		Target:    t.Name,
+		Kind:      kind,
+		Value:     value,
+		Threshold: threshold,
+		Breached:  breached,
+	}
+	if breached {
+		m.breaches.WithLabelValues(t.Name, kind).Inc()
+	}
+	m.events = append(m.events, ev)
+	if len(m.events) > slaEvents {
+		m.events = m.events[len(m.events)-slaEvents:]
+	}
+	if m.OnEvent != nil {
+		m.OnEvent(ev)
+	}
+}
+
+// Hours returns the per-hour summaries of all targets.
+func (m *SLAMonitor) Hours() []SLAHour {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hours []SLAHour
+	for _, t := range m.targets {
+		for _, h := range t.hours {
+			sorted := append([]time.Duration(nil), h.rtts...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			summary := *h
+			summary.rtts = nil
+			summary.LossPercent = 100 * float64(h.Lost) / float64(h.Sent)
+			summary.P50MS = ms(percentile(sorted, 0.50))
+			summary.P95MS = ms(percentile(sorted, 0.95))
+			summary.P99MS = ms(percentile(sorted, 0.99))
+			hours = append(hours, summary)
+		}
+	}
+	return hours
+}
+
+// Events returns the most recent events.
+func (m *SLAMonitor) Events() []SLAEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SLAEvent(nil), m.events...)
+}
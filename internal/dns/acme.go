@@ -0,0 +1,118 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ACMEClient may publish ACME DNS-01 challenges for its name, see
+// ACMEHandler.
+type ACMEClient struct {
+	// Name is relative to the zone, e.g. “nas” for nas.home.example.com.
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// challengeLifetime bounds how long challenges are served in case the ACME
+// client does not clean up.
+const challengeLifetime = 1 * time.Hour
+
+func (s *Server) challenges(fqdn string, now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []string
+	for value, expiry := range s.acmeChallenges[fqdn] {
+		if now.Before(expiry) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// ACMEHandler publishes (/acme/present) and removes (/acme/cleanup) TXT
+// records for ACME DNS-01 challenges in the zone configured via SetZone. The
+// API is compatible with the httpreq DNS provider of the lego ACME client,
+// e.g.:
+//
+//	HTTPREQ_ENDPOINT=http://router7:8053/acme HTTPREQ_USERNAME=nas \
+//	HTTPREQ_PASSWORD=secret lego --dns httpreq -d nas.home.example.com run
+//
+// Requests are authenticated using HTTP basic authentication with the name
+// and password of an ACMEClient configured in dns.json.
+func (s *Server) ACMEHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		FQDN  string `json:"fqdn"`
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fqdn := dns.Fqdn(strings.ToLower(req.FQDN))
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="router7"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want, ok := s.acmeClients[strings.ToLower(user)]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		http.Error(w, "invalid credentials", http.StatusForbidden)
+		return
+	}
+	if s.zone == nil {
+		http.Error(w, "no zone configured", http.StatusNotFound)
+		return
+	}
+	if allowed := "_acme-challenge." + strings.ToLower(user) + "." + s.zone.name; fqdn != allowed {
+		http.Error(w, fmt.Sprintf("%s may only publish %s", user, allowed), http.StatusForbidden)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/acme") {
+	case "/present":
+		values, ok := s.acmeChallenges[fqdn]
+		if !ok {
+			values = make(map[string]time.Time)
+			s.acmeChallenges[fqdn] = values
+		}
+		values[req.Value] = time.Now().Add(challengeLifetime)
+	case "/cleanup":
+		delete(s.acmeChallenges[fqdn], req.Value)
+		if len(s.acmeChallenges[fqdn]) == 0 {
+			delete(s.acmeChallenges, fqdn)
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
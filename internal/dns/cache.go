@@ -0,0 +1,198 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxCacheEntries bounds the memory used by the response cache.
+	maxCacheEntries = 4096
+
+	// maxCacheTTL bounds how long responses are cached, regardless of the
+	// TTLs the upstream returned.
+	maxCacheTTL = 1 * time.Hour
+)
+
+type cacheKey struct {
+	name   string // lower-cased
+	qtype  uint16
+	qclass uint16
+	do     bool // DNSSEC OK, changes which records are included
+}
+
+type cacheEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+	expiry time.Time
+}
+
+// cache holds upstream responses until the smallest TTL of their records (or,
+// for negative responses, the SOA minimum of RFC 2308) expired.
+type cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[cacheKey]*cacheEntry)}
+}
+
+// keyFor returns the cache key for r and whether r can be answered from the
+// cache at all.
+func keyFor(r *dns.Msg) (cacheKey, bool) {
+	if len(r.Question) != 1 || r.CheckingDisabled {
+		return cacheKey{}, false
+	}
+	q := r.Question[0]
+	var do bool
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		do:     do,
+	}, true
+}
+
+// ttl returns how long m may be cached, or 0 if m must not be cached.
+func ttl(m *dns.Msg) time.Duration {
+	if m.Truncated {
+		return 0
+	}
+	min := uint32(maxCacheTTL / time.Second)
+	switch {
+	case m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0):
+		// Negative responses are cached per the SOA record.
+		var soa *dns.SOA
+		for _, rr := range m.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+				break
+			}
+		}
+		if soa == nil {
+			return 0
+		}
+		if soa.Hdr.Ttl < min {
+			min = soa.Hdr.Ttl
+		}
+		if soa.Minttl < min {
+			min = soa.Minttl
+		}
+	case m.Rcode == dns.RcodeSuccess:
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					continue // not a record, the TTL field holds flags
+				}
+				if ttl := rr.Header().Ttl; ttl < min {
+					min = ttl
+				}
+			}
+		}
+	default:
+		return 0 // e.g. SERVFAIL
+	}
+	return time.Duration(min) * time.Second
+}
+
+// get returns a response to r from the cache, or nil.
+func (c *cache) get(r *dns.Msg, now time.Time) *dns.Msg {
+	key, ok := keyFor(r)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expiry) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	m := e.msg.Copy()
+	m.Id = r.Id
+	m.Question = r.Question // preserve the case of the query name
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+// put stores the response m to r in the cache, if it can be cached.
+func (c *cache) put(r, m *dns.Msg, now time.Time) {
+	key, ok := keyFor(r)
+	if !ok {
+		return
+	}
+	d := ttl(m)
+	if d == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expiry) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < maxCacheEntries {
+				break
+			}
+			delete(c.entries, k) // random eviction
+		}
+	}
+	c.entries[key] = &cacheEntry{
+		msg:    m.Copy(),
+		stored: now,
+		expiry: now.Add(d),
+	}
+}
+
+// flush removes all entries, e.g. after the filtering configuration changed.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*cacheEntry)
+}
+
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Config is read from /perm/dns.json.
+type Config struct {
+	// RebindingProtection removes private addresses (RFC 1918, loopback,
+	// link-local, unique local) from answers to queries for public names,
+	// which protects LAN services against DNS rebinding attacks.
+	RebindingProtection bool `json:"rebinding_protection"`
+
+	// RebindingAllowlist are domains (including their subdomains) which may
+	// resolve to private addresses, e.g. split-horizon corp.example.com.
+	RebindingAllowlist []string `json:"rebinding_allowlist"`
+
+	// BlockedQueryTypes are refused instead of being forwarded, e.g. ANY.
+	BlockedQueryTypes []string `json:"blocked_query_types"`
+
+	// Clients override the upstream resolvers for specific LAN clients, e.g.
+	// to use a family-filter resolver for kids’ devices. See also
+	// dns_redirect in firewall.json for clients using their own resolvers.
+	Clients []ClientConfig `json:"clients"`
+
+	// Zone is a public zone (e.g. home.example.com) to answer authoritatively
+	// with the router’s public addresses and those of port forwarding
+	// destinations. Its NS record must point to the router.
+	Zone string `json:"zone"`
+
+	// ACME are the clients which may publish ACME DNS-01 challenges in Zone,
+	// see Server.ACMEHandler.
+	ACME []ACMEClient `json:"acme"`
+}
+
+// ClientConfig overrides the upstream resolvers for a LAN client, identified
+// by IP address or by MAC address (via its DHCP lease).
+type ClientConfig struct {
+	Addr         string   `json:"addr"`      // e.g. “192.168.42.23”
+	HardwareAddr string   `json:"hwaddr"`    // e.g. “00:1f:16:3a:62:8d”
+	Upstreams    []string `json:"upstreams"` // e.g. “185.228.168.168:53”
+}
+
+// ReadConfig reads dns.json from dir. A missing file results in an empty
+// Config.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dns.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// filter is the parsed form of the filtering-related Config fields.
+type filter struct {
+	rebinding    bool
+	allowlist    []string // lower-cased, fully qualified
+	blockedTypes map[uint16]bool
+
+	// upstreams overrides, keyed by IP address or (lower-case) MAC address
+	upstreams map[string][]string
+}
+
+func newFilter(cfg Config) (*filter, error) {
+	f := &filter{
+		rebinding:    cfg.RebindingProtection,
+		blockedTypes: make(map[uint16]bool),
+		upstreams:    make(map[string][]string),
+	}
+	for _, d := range cfg.RebindingAllowlist {
+		f.allowlist = append(f.allowlist, dns.Fqdn(strings.ToLower(d)))
+	}
+	for _, t := range cfg.BlockedQueryTypes {
+		typ, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", t)
+		}
+		f.blockedTypes[typ] = true
+	}
+	for _, cl := range cfg.Clients {
+		if len(cl.Upstreams) == 0 {
+			continue
+		}
+		for _, u := range cl.Upstreams {
+			if _, _, err := net.SplitHostPort(u); err != nil {
+				return nil, fmt.Errorf("client %s%s: upstream %q: %v", cl.Addr, cl.HardwareAddr, u, err)
+			}
+		}
+		switch {
+		case cl.Addr != "":
+			ip := net.ParseIP(cl.Addr)
+			if ip == nil {
+				return nil, fmt.Errorf("client %q: invalid IP address", cl.Addr)
+			}
+			f.upstreams[ip.String()] = cl.Upstreams
+		case cl.HardwareAddr != "":
+			hwaddr, err := net.ParseMAC(cl.HardwareAddr)
+			if err != nil {
+				return nil, fmt.Errorf("client %q: %v", cl.HardwareAddr, err)
+			}
+			f.upstreams[hwaddr.String()] = cl.Upstreams
+		default:
+			return nil, fmt.Errorf("client without addr or hwaddr")
+		}
+	}
+	return f, nil
+}
+
+// clientUpstreams returns the upstream resolvers configured for the client
+// with IP address ip and MAC address hwaddr (empty if unknown), if any.
+func (f *filter) clientUpstreams(ip net.IP, hwaddr string) []string {
+	if ip != nil {
+		if u, ok := f.upstreams[ip.String()]; ok {
+			return u
+		}
+	}
+	if hwaddr != "" {
+		return f.upstreams[hwaddr]
+	}
+	return nil
+}
+
+var rebindingNets = append([]*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	// link-local: https://tools.ietf.org/html/rfc3927
+	mustParseCIDR("169.254.0.0/16"),
+	// unspecified: https://tools.ietf.org/html/rfc4291#section-2.5.2
+	mustParseCIDR("::/128"),
+	// link-local: https://tools.ietf.org/html/rfc4291#section-2.5.6
+	mustParseCIDR("fe80::/10"),
+	// unique local: https://tools.ietf.org/html/rfc4193
+	mustParseCIDR("fc00::/7"),
+}, localNets...)
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range rebindingNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether name may resolve to private addresses.
+func (f *filter) allowed(name string) bool {
+	name = strings.ToLower(name)
+	for _, d := range f.allowlist {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebind removes answers with private addresses from m, unless protection is
+// disabled or the queried name is allowlisted. It returns the number of removed
+// answers.
+func (f *filter) rebind(m *dns.Msg) int {
+	if !f.rebinding {
+		return 0
+	}
+	for _, q := range m.Question {
+		if f.allowed(q.Name) {
+			return 0
+		}
+	}
+	var removed int
+	answers := m.Answer[:0]
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip != nil && isPrivate(ip) && !f.allowed(rr.Header().Name) {
+			removed++
+			continue
+		}
+		answers = append(answers, rr)
+	}
+	m.Answer = answers
+	return removed
+}
@@ -29,6 +29,7 @@ import (
 
 	"github.com/rtr7/router7/internal/dhcp4d"
 	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/trace"
 
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
@@ -45,6 +46,10 @@ type lcHostname string
 type Server struct {
 	Mux *dns.ServeMux
 
+	// PublicMux answers queries from the internet, which are refused unless
+	// they are for the zone configured via SetZone.
+	PublicMux *dns.ServeMux
+
 	client    *dns.Client
 	domain    string
 	sometimes *rate.Limiter
@@ -53,36 +58,62 @@ type Server struct {
 		queries   prometheus.Counter
 		upstream  *prometheus.CounterVec
 		questions prometheus.Histogram
+
+		// per-upstream metrics, labeled by upstream address
+		upstreamRTT      *prometheus.HistogramVec
+		upstreamFailures *prometheus.CounterVec
+		upstreamHealthy  *prometheus.GaugeVec
+		upstreamSelected *prometheus.GaugeVec
+
+		filtered *prometheus.CounterVec
+
+		cacheHits   prometheus.Counter
+		cacheMisses prometheus.Counter
 	}
 
+	cache *cache
+
 	mu           sync.Mutex
 	hostname, ip string
 	hostsByName  map[lcHostname]string
 	hostsByIP    map[string]string
 	subnames     map[lcHostname]map[string]net.IP // hostname → subname → ip
+	hwaddrsByIP  map[string]string
+	tokenAddrs   map[string]net.IP // hwaddr → IPv6 address
+	zone         *zone
+
+	acmeClients    map[string]string               // name → password
+	acmeChallenges map[string]map[string]time.Time // fqdn → value → expiry
+	filter         *filter
 
 	upstreamMu sync.RWMutex
-	upstream   []string
+	upstream   []string       // ordered by preference
+	failures   map[string]int // consecutive failures per upstream
 }
 
+// unhealthyFailures is the number of consecutive failures after which an
+// upstream is considered unhealthy and moved to the end of the preference
+// list, until it answers a latency probe again.
+const unhealthyFailures = 3
+
 func NewServer(addr, domain string) *Server {
 	hostname, _ := os.Hostname()
 	ip, _, _ := net.SplitHostPort(addr)
 	server := &Server{
-		Mux:    dns.NewServeMux(),
-		client: &dns.Client{},
-		domain: domain,
-		upstream: []string{
-			// https://developers.google.com/speed/public-dns/docs/using#google_public_dns_ip_addresses
-			"8.8.8.8:53",
-			"8.8.4.4:53",
-			"[2001:4860:4860::8888]:53",
-			"[2001:4860:4860::8844]:53",
-		},
+		Mux:       dns.NewServeMux(),
+		PublicMux: dns.NewServeMux(),
+		client:    &dns.Client{},
+		domain:    domain,
+		upstream:  append([]string(nil), defaultUpstreams...),
+		cache:     newCache(),
 		sometimes: rate.NewLimiter(rate.Every(1*time.Second), 1), // at most once per second
 		hostname:  hostname,
 		ip:        ip,
 		subnames:  make(map[lcHostname]map[string]net.IP),
+		failures:  make(map[string]int),
+		filter:    &filter{},
+
+		acmeChallenges: make(map[string]map[string]time.Time),
 	}
 	server.prom.registry = prometheus.NewRegistry()
 
@@ -108,11 +139,78 @@ func NewServer(addr, domain string) *Server {
 	})
 	server.prom.registry.MustRegister(server.prom.questions)
 
+	server.prom.upstreamRTT = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dns_upstream_rtt_seconds",
+			Help:    "Round trip time of queries forwarded to each upstream",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 12),
+		},
+		[]string{"upstream"},
+	)
+	server.prom.registry.MustRegister(server.prom.upstreamRTT)
+
+	server.prom.upstreamFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_upstream_failures_total",
+			Help: "Number of queries which each upstream did not answer (e.g. timeouts)",
+		},
+		[]string{"upstream"},
+	)
+	server.prom.registry.MustRegister(server.prom.upstreamFailures)
+
+	server.prom.upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_healthy",
+			Help: "Whether each upstream is considered healthy (1) or not (0)",
+		},
+		[]string{"upstream"},
+	)
+	server.prom.registry.MustRegister(server.prom.upstreamHealthy)
+
+	server.prom.upstreamSelected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "dns_upstream_selected",
+			Help: "Whether each upstream is currently preferred (1) or not (0)",
+		},
+		[]string{"upstream"},
+	)
+	server.prom.registry.MustRegister(server.prom.upstreamSelected)
+
+	server.prom.filtered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_filtered_total",
+			Help: "Number of refused queries (query_type) and removed answers (rebinding)",
+		},
+		[]string{"reason"},
+	)
+	server.prom.registry.MustRegister(server.prom.filtered)
+
+	server.prom.cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_hits_total",
+		Help: "Number of forwarded queries answered from the cache",
+	})
+	server.prom.registry.MustRegister(server.prom.cacheHits)
+
+	server.prom.cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_misses_total",
+		Help: "Number of forwarded queries not found in the cache",
+	})
+	server.prom.registry.MustRegister(server.prom.cacheMisses)
+
+	server.prom.registry.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "dns_cache_entries",
+			Help: "Number of responses in the cache",
+		},
+		func() float64 { return float64(server.cache.len()) },
+	))
+
 	server.prom.registry.MustRegister(prometheus.NewGoCollector())
 	server.initHostsLocked()
 	server.Mux.HandleFunc(".", server.handleRequest)
 	server.Mux.HandleFunc("lan.", server.handleInternal)
 	server.Mux.HandleFunc("localhost.", server.handleInternal)
+	server.PublicMux.HandleFunc(".", server.refuse)
 	go func() {
 		for range time.Tick(10 * time.Second) {
 			server.probeUpstreamLatency()
@@ -124,6 +222,7 @@ func NewServer(addr, domain string) *Server {
 func (s *Server) initHostsLocked() {
 	s.hostsByName = make(map[lcHostname]string)
 	s.hostsByIP = make(map[string]string)
+	s.hwaddrsByIP = make(map[string]string)
 	if s.hostname != "" && s.ip != "" {
 		lower := strings.ToLower(s.hostname)
 		s.hostsByName[lcHostname(lower)] = s.ip
@@ -173,12 +272,120 @@ func (s *Server) probeUpstreamLatency() {
 		return results[i].rtt < results[j].rtt
 	})
 	log.Printf("probe results: %v", results)
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+	if !sameUpstreams(s.upstream, upstreams) {
+		return // SetUpstreams was called while probing
+	}
 	for idx, result := range results {
 		upstreams[idx] = result.upstream
+		if result.rtt == time.Duration(math.MaxInt64) {
+			s.prom.upstreamHealthy.WithLabelValues(result.upstream).Set(0)
+			continue
+		}
+		// An upstream which answers probes is healthy again.
+		delete(s.failures, result.upstream)
+		s.prom.upstreamHealthy.WithLabelValues(result.upstream).Set(1)
+	}
+	s.upstream = upstreams
+	s.updateSelectedLocked()
+}
+
+// updateSelectedLocked updates the dns_upstream_selected metric.
+func (s *Server) updateSelectedLocked() {
+	for idx, u := range s.upstream {
+		if idx == 0 {
+			s.prom.upstreamSelected.WithLabelValues(u).Set(1)
+		} else {
+			s.prom.upstreamSelected.WithLabelValues(u).Set(0)
+		}
 	}
+}
+
+// upstreamSucceeded records that upstream u (at index idx of the preference
+// list) answered a query within rtt.
+func (s *Server) upstreamSucceeded(u string, idx int, rtt time.Duration) {
+	s.prom.upstreamRTT.WithLabelValues(u).Observe(rtt.Seconds())
 	s.upstreamMu.Lock()
 	defer s.upstreamMu.Unlock()
-	s.upstream = upstreams
+	delete(s.failures, u)
+	s.prom.upstreamHealthy.WithLabelValues(u).Set(1)
+	if idx > 0 && idx < len(s.upstream) && s.upstream[idx] == u {
+		// re-order this upstream to the front of s.upstream.
+		s.upstream = append(append([]string{u}, s.upstream[:idx]...), s.upstream[idx+1:]...)
+		s.updateSelectedLocked()
+	}
+}
+
+// upstreamFailed records that upstream u did not answer a query, moving it
+// to the end of the preference list once it is considered unhealthy.
+func (s *Server) upstreamFailed(u string) {
+	s.prom.upstreamFailures.WithLabelValues(u).Inc()
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+	s.failures[u]++
+	if s.failures[u] != unhealthyFailures {
+		return
+	}
+	log.Printf("upstream %s failed %d times in a row, failing over", u, unhealthyFailures)
+	s.prom.upstreamHealthy.WithLabelValues(u).Set(0)
+	for idx, other := range s.upstream {
+		if other != u {
+			continue
+		}
+		s.upstream = append(append(s.upstream[:idx:idx], s.upstream[idx+1:]...), u)
+		break
+	}
+	s.updateSelectedLocked()
+}
+
+// SetConfig configures query filtering, rebinding protection, per-client
+// upstreams and ACME clients.
+func (s *Server) SetConfig(cfg Config) error {
+	f, err := newFilter(cfg)
+	if err != nil {
+		return err
+	}
+	acmeClients := make(map[string]string)
+	for _, cl := range cfg.ACME {
+		if cl.Name == "" || cl.Password == "" {
+			return fmt.Errorf("acme: name and password must be set")
+		}
+		acmeClients[strings.ToLower(cl.Name)] = cl.Password
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = f
+	s.acmeClients = acmeClients
+	s.cache.flush() // cached responses were filtered by the old config
+	return nil
+}
+
+// clientUpstreams returns the upstreams configured for the client which sent
+// the request to w, if any.
+func (s *Server) clientUpstreams(f *filter, w dns.ResponseWriter) []string {
+	if len(f.upstreams) == 0 {
+		return nil
+	}
+	var ip net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return nil
+	}
+	s.mu.Lock()
+	hwaddr := s.hwaddrsByIP[ip.String()]
+	s.mu.Unlock()
+	return f.clientUpstreams(ip, hwaddr)
+}
+
+func (s *Server) currentFilter() *filter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter
 }
 
 func (s *Server) hostByName(n string) (string, bool) {
@@ -195,6 +402,23 @@ func (s *Server) hostByIP(n string) (string, bool) {
 	return r, ok
 }
 
+// SetTokenAddrs sets the IPv6 addresses (keyed by hardware address) which
+// AAAA queries for DHCP hostnames are answered with, see
+// netconfig.TokenAddrs.
+func (s *Server) SetTokenAddrs(addrs map[string]net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenAddrs = addrs
+}
+
+// tokenAddr returns the IPv6 address of the host with IPv4 address host.
+func (s *Server) tokenAddr(host string) (net.IP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ip, ok := s.tokenAddrs[s.hwaddrsByIP[host]]
+	return ip, ok
+}
+
 func (s *Server) subname(hostname, host string) (net.IP, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -262,6 +486,11 @@ func (s *Server) SetLeases(leases []dhcp4d.Lease) {
 		if l.Expired(now) {
 			continue
 		}
+		if hwaddr, err := net.ParseMAC(l.HardwareAddr); err == nil {
+			if _, ok := s.hwaddrsByIP[l.Addr.String()]; !ok {
+				s.hwaddrsByIP[l.Addr.String()] = hwaddr.String()
+			}
+		}
 		if l.Hostname == "" {
 			continue
 		}
@@ -350,6 +579,9 @@ func (s *Server) resolve(q dns.Question) (rr dns.RR, err error) {
 			if q.Qtype == dns.TypeA {
 				return dns.NewRR(q.Name + " 3600 IN A " + host)
 			}
+			if ip, ok := s.tokenAddr(host); ok && q.Qtype == dns.TypeAAAA {
+				return dns.NewRR(q.Name + " 3600 IN AAAA " + ip.String())
+			}
 			return nil, errEmpty
 		}
 	}
@@ -414,25 +646,79 @@ func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 
 	s.prom.queries.Inc()
 	s.prom.questions.Observe(float64(len(r.Question)))
-	s.prom.upstream.WithLabelValues("DNS").Inc()
 
-	for idx, u := range s.upstreams() {
-		in, _, err := s.client.Exchange(r, u)
+	span := trace.StartSampled(nil, "dns.query")
+	defer span.End()
+	if len(r.Question) > 0 {
+		span.SetAttribute("name", r.Question[0].Name)
+		span.SetAttribute("type", dns.TypeToString[r.Question[0].Qtype])
+	}
+
+	f := s.currentFilter()
+	for _, q := range r.Question {
+		if f.blockedTypes[q.Qtype] {
+			s.prom.filtered.WithLabelValues("query_type").Inc()
+			span.SetAttribute("filtered", true)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+	}
+
+	upstreams := s.upstreams()
+	override := s.clientUpstreams(f, w)
+	if len(override) > 0 {
+		// Responses of per-client upstreams differ (e.g. family filters), so
+		// they are neither answered from nor stored in the cache.
+		upstreams = override
+	} else {
+		if m := s.cache.get(r, time.Now()); m != nil {
+			s.prom.cacheHits.Inc()
+			s.prom.upstream.WithLabelValues("cache").Inc()
+			span.SetAttribute("cached", true)
+			w.WriteMsg(m)
+			return
+		}
+		s.prom.cacheMisses.Inc()
+	}
+	s.prom.upstream.WithLabelValues("DNS").Inc()
+	for idx, u := range upstreams {
+		exchange := trace.Start(span, "dns.exchange")
+		exchange.SetAttribute("upstream", u)
+		in, rtt, err := s.client.Exchange(r, u)
+		exchange.SetError(err)
+		exchange.End()
 		if err != nil {
 			if s.sometimes.Allow() {
 				log.Printf("resolving %v failed: %v", r.Question, err)
 			}
+			if len(override) > 0 {
+				// per-client upstreams are tried in configured order
+				s.prom.upstreamFailures.WithLabelValues(u).Inc()
+			} else {
+				s.upstreamFailed(u)
+			}
 			continue // fall back to next-slower upstream
 		}
+		if n := f.rebind(in); n > 0 {
+			s.prom.filtered.WithLabelValues("rebinding").Add(float64(n))
+			if s.sometimes.Allow() {
+				log.Printf("rebinding protection: removed %d private answers for %v", n, r.Question)
+			}
+		}
+		if len(override) == 0 {
+			s.cache.put(r, in, time.Now())
+		}
 		w.WriteMsg(in)
-		if idx > 0 {
-			// re-order this upstream to the front of s.upstream.
-			s.upstreamMu.Lock()
-			s.upstream = append(append([]string{u}, s.upstream[:idx]...), s.upstream[idx+1:]...)
-			s.upstreamMu.Unlock()
+		if len(override) > 0 {
+			s.prom.upstreamRTT.WithLabelValues(u).Observe(rtt.Seconds())
+		} else {
+			s.upstreamSucceeded(u, idx, rtt)
 		}
 		return
 	}
+	span.SetError(fmt.Errorf("all %d upstreams failed", len(upstreams)))
 	// DNS has no reply for resolving errors
 }
 
@@ -457,6 +743,9 @@ func (s *Server) resolveSubname(hostname string, q dns.Question) (dns.RR, error)
 			if q.Qtype == dns.TypeA {
 				return dns.NewRR(q.Name + " 3600 IN A " + host)
 			}
+			if ip, ok := s.tokenAddr(host); ok && q.Qtype == dns.TypeAAAA {
+				return dns.NewRR(q.Name + " 3600 IN AAAA " + ip.String())
+			}
 			return nil, errEmpty
 		}
 
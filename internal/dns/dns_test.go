@@ -22,6 +22,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -30,11 +32,13 @@ import (
 	"github.com/rtr7/router7/internal/dhcp4d"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // TODO(later): upstream a dnstest.Recorder implementation
 type recorder struct {
 	response *dns.Msg
+	remote   net.Addr
 }
 
 func (r *recorder) WriteMsg(m *dns.Msg) error {
@@ -43,7 +47,7 @@ func (r *recorder) WriteMsg(m *dns.Msg) error {
 }
 
 func (r *recorder) LocalAddr() net.Addr       { return nil }
-func (r *recorder) RemoteAddr() net.Addr      { return nil }
+func (r *recorder) RemoteAddr() net.Addr      { return r.remote }
 func (r *recorder) Write([]byte) (int, error) { return 0, nil }
 func (r *recorder) Close() error              { return nil }
 func (r *recorder) TsigStatus() error         { return nil }
@@ -121,6 +125,47 @@ func TestResolveFallbackOnce(t *testing.T) {
 	}
 }
 
+func TestResolveFailover(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	var deadHits uint32
+	dead := dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddUint32(&deadHits, 1)
+		// send no reply
+	}))
+	healthy := dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply(w, r, " 3600 IN A 127.0.0.1")
+	}))
+	s.upstream = []string{dead, healthy}
+
+	// Each query falls back to the healthy upstream, which is then preferred.
+	if err := resolveTestTarget(s, "google.ch.", net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.upstreams()[0], healthy; got != want {
+		t.Errorf("preferred upstream = %s, want %s", got, want)
+	}
+	if got, want := testutil.ToFloat64(s.prom.upstreamSelected.WithLabelValues(healthy)), 1.0; got != want {
+		t.Errorf("dns_upstream_selected{upstream=%q} = %v, want %v", healthy, got, want)
+	}
+
+	// Consecutive failures mark the upstream as unhealthy.
+	for i := 0; i < unhealthyFailures-1; i++ {
+		s.upstreamFailed(dead)
+	}
+	if got, want := testutil.ToFloat64(s.prom.upstreamHealthy.WithLabelValues(dead)), 0.0; got != want {
+		t.Errorf("dns_upstream_healthy{upstream=%q} = %v, want %v", dead, got, want)
+	}
+	if got, want := testutil.ToFloat64(s.prom.upstreamFailures.WithLabelValues(dead)), float64(unhealthyFailures); got != want {
+		t.Errorf("dns_upstream_failures_total{upstream=%q} = %v, want %v", dead, got, want)
+	}
+	if got, want := s.upstreams(), []string{healthy, dead}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstreams = %v, want %v", got, want)
+	}
+	if got, want := atomic.LoadUint32(&deadHits), uint32(1); got != want {
+		t.Errorf("dead upstream server hits = %d, wanted %d", got, want)
+	}
+}
+
 func reply(w dns.ResponseWriter, r *dns.Msg, response string) {
 	rr, _ := dns.NewRR(r.Question[0].Name + response)
 	m := new(dns.Msg)
@@ -620,3 +665,439 @@ func TestSubname(t *testing.T) {
 		}
 	})
 }
+
+func TestTokenAddrs(t *testing.T) {
+	s := NewServer("127.0.0.2:0", "lan")
+	s.SetLeases([]dhcp4d.Lease{
+		{
+			Hostname:     "testtarget",
+			HardwareAddr: "00:1f:16:31:73:75",
+			Addr:         net.IP{192, 168, 42, 23},
+		},
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("testtarget.lan.", dns.TypeAAAA)
+	r := &recorder{}
+	s.Mux.ServeDNS(r, m)
+	if got, want := len(r.response.Answer), 0; got != want {
+		t.Fatalf("unexpected number of answers before SetTokenAddrs: got %d, want %d", got, want)
+	}
+
+	const ip = "2a02:168:4a00::23"
+	s.SetTokenAddrs(map[string]net.IP{
+		"00:1f:16:31:73:75": net.ParseIP(ip),
+	})
+	for _, name := range []string{
+		"testtarget.lan.",
+		"testtarget.",
+	} {
+		if err := resolveTestTarget(s, name, net.ParseIP(ip)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := resolveTestTarget(s, "testtarget.lan.", net.ParseIP("192.168.42.23")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRebindingProtection(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply(w, r, " 3600 IN A 192.168.1.1")
+		})),
+	}
+	if err := s.SetConfig(Config{
+		RebindingProtection: true,
+		RebindingAllowlist:  []string{"corp.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("evil.example.net.", dns.TypeA)
+	r := &recorder{}
+	s.Mux.ServeDNS(r, m)
+	if r.response == nil {
+		t.Fatalf("nil response")
+	}
+	if got, want := len(r.response.Answer), 0; got != want {
+		t.Errorf("unexpected number of answers: got %d, want %d", got, want)
+	}
+
+	if err := resolveTestTarget(s, "intranet.corp.example.com.", net.ParseIP("192.168.1.1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockedQueryTypes(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	var hits uint32
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddUint32(&hits, 1)
+			reply(w, r, " 3600 IN A 127.0.0.1")
+		})),
+	}
+	if err := s.SetConfig(Config{BlockedQueryTypes: []string{"any"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("google.ch.", dns.TypeANY)
+	r := &recorder{}
+	s.Mux.ServeDNS(r, m)
+	if r.response == nil {
+		t.Fatalf("nil response")
+	}
+	if got, want := r.response.Rcode, dns.RcodeRefused; got != want {
+		t.Errorf("unexpected rcode: got %v, want %v", got, want)
+	}
+	if got, want := atomic.LoadUint32(&hits), uint32(0); got != want {
+		t.Errorf("upstream hits = %d, want %d", got, want)
+	}
+
+	if err := s.SetConfig(Config{BlockedQueryTypes: []string{"BOGUS"}}); err == nil {
+		t.Errorf("SetConfig(BOGUS) unexpectedly succeeded")
+	}
+}
+
+func TestClientUpstreams(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			reply(w, r, " 3600 IN A 127.0.0.1")
+		})),
+	}
+	family := dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply(w, r, " 3600 IN A 127.0.0.2")
+	}))
+	s.SetLeases([]dhcp4d.Lease{
+		{
+			Addr:         net.ParseIP("192.168.42.24"),
+			HardwareAddr: "00:1F:16:3A:62:8D",
+			Expiry:       time.Now().Add(1 * time.Hour),
+		},
+	})
+	if err := s.SetConfig(Config{
+		Clients: []ClientConfig{
+			{Addr: "192.168.42.23", Upstreams: []string{family}},
+			{HardwareAddr: "00:1f:16:3a:62:8d", Upstreams: []string{family}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		client string
+		want   net.IP
+	}{
+		{"192.168.42.22", net.ParseIP("127.0.0.1")},
+		{"192.168.42.23", net.ParseIP("127.0.0.2")},
+		{"192.168.42.24", net.ParseIP("127.0.0.2")}, // via hwaddr
+	} {
+		t.Run(tt.client, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion("google.ch.", dns.TypeA)
+			r := &recorder{remote: &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 1234}}
+			s.Mux.ServeDNS(r, m)
+			if r.response == nil {
+				t.Fatalf("nil response")
+			}
+			if got, want := len(r.response.Answer), 1; got != want {
+				t.Fatalf("unexpected number of answers: got %d, want %d", got, want)
+			}
+			if got := r.response.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Errorf("unexpected response IP: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZone(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	s.SetZone(&Zone{
+		Name: "Home.example.com",
+		Addrs: map[string][]net.IP{
+			"":         {net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")},
+			"nas":      {net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::23")},
+			"printer2": nil,
+		},
+	})
+
+	for _, mux := range []*dns.ServeMux{s.Mux, s.PublicMux} {
+		for _, tt := range []struct {
+			name  string
+			qtype uint16
+			rcode int
+			want  string
+		}{
+			{"home.example.com.", dns.TypeA, dns.RcodeSuccess, "203.0.113.1"},
+			{"NAS.home.example.com.", dns.TypeAAAA, dns.RcodeSuccess, "2001:db8::23"},
+			{"home.example.com.", dns.TypeNS, dns.RcodeSuccess, "home.example.com."},
+			{"printer2.home.example.com.", dns.TypeA, dns.RcodeSuccess, ""},
+			{"unknown.home.example.com.", dns.TypeA, dns.RcodeNameError, ""},
+		} {
+			m := new(dns.Msg)
+			m.SetQuestion(tt.name, tt.qtype)
+			r := &recorder{}
+			mux.ServeDNS(r, m)
+			if r.response == nil {
+				t.Fatalf("%s: nil response", tt.name)
+			}
+			if got, want := r.response.Rcode, tt.rcode; got != want {
+				t.Errorf("%s: unexpected rcode: got %v, want %v", tt.name, got, want)
+			}
+			if !r.response.Authoritative {
+				t.Errorf("%s: response unexpectedly not authoritative", tt.name)
+			}
+			var got string
+			if len(r.response.Answer) > 0 {
+				switch rr := r.response.Answer[0].(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.AAAA:
+					got = rr.AAAA.String()
+				case *dns.NS:
+					got = rr.Ns
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%s: unexpected answer: got %q, want %q", tt.name, got, tt.want)
+			}
+		}
+	}
+
+	// Other names must not be resolved for the internet.
+	m := new(dns.Msg)
+	m.SetQuestion("google.ch.", dns.TypeA)
+	r := &recorder{}
+	s.PublicMux.ServeDNS(r, m)
+	if r.response == nil {
+		t.Fatalf("nil response")
+	}
+	if got, want := r.response.Rcode, dns.RcodeRefused; got != want {
+		t.Errorf("unexpected rcode: got %v, want %v", got, want)
+	}
+}
+
+func TestZoneSerial(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	addrs := map[string][]net.IP{
+		"": {net.ParseIP("203.0.113.1")},
+	}
+	serial := func() uint32 {
+		m := new(dns.Msg)
+		m.SetQuestion("home.example.com.", dns.TypeSOA)
+		r := &recorder{}
+		s.PublicMux.ServeDNS(r, m)
+		if r.response == nil || len(r.response.Answer) != 1 {
+			t.Fatalf("unexpected SOA response: %v", r.response)
+		}
+		return r.response.Answer[0].(*dns.SOA).Serial
+	}
+	s.SetZone(&Zone{Name: "home.example.com", Addrs: addrs})
+	initial := serial()
+
+	// Updates without changes keep the serial.
+	s.SetZone(&Zone{Name: "home.example.com", Addrs: map[string][]net.IP{
+		"": {net.ParseIP("203.0.113.1")},
+	}})
+	if got := serial(); got != initial {
+		t.Errorf("serial after unchanged update = %d, want %d", got, initial)
+	}
+
+	// Changes increase the serial, even within the same second.
+	s.SetZone(&Zone{Name: "home.example.com", Addrs: map[string][]net.IP{
+		"": {net.ParseIP("203.0.113.2")},
+	}})
+	if got := serial(); got <= initial {
+		t.Errorf("serial after change = %d, want > %d", got, initial)
+	}
+}
+
+func TestACME(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	if err := s.SetConfig(Config{
+		ACME: []ACMEClient{{Name: "nas", Password: "secret"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetZone(&Zone{Name: "home.example.com"})
+
+	acme := func(path, user, password, fqdn string) int {
+		body := strings.NewReader(fmt.Sprintf(`{"fqdn": %q, "value": "token"}`, fqdn))
+		req := httptest.NewRequest("POST", "/acme/"+path, body)
+		req.SetBasicAuth(user, password)
+		rec := httptest.NewRecorder()
+		s.ACMEHandler(rec, req)
+		return rec.Code
+	}
+	txt := func() []string {
+		m := new(dns.Msg)
+		m.SetQuestion("_acme-challenge.nas.home.example.com.", dns.TypeTXT)
+		r := &recorder{}
+		s.PublicMux.ServeDNS(r, m)
+		var values []string
+		for _, rr := range r.response.Answer {
+			values = append(values, rr.(*dns.TXT).Txt...)
+		}
+		return values
+	}
+
+	const fqdn = "_acme-challenge.nas.home.example.com."
+	if got, want := acme("present", "nas", "wrong", fqdn), http.StatusForbidden; got != want {
+		t.Errorf("wrong password: got HTTP %d, want %d", got, want)
+	}
+	if got, want := acme("present", "nas", "secret", "_acme-challenge.home.example.com."), http.StatusForbidden; got != want {
+		t.Errorf("other name: got HTTP %d, want %d", got, want)
+	}
+	if got, want := acme("present", "nas", "secret", fqdn), http.StatusOK; got != want {
+		t.Fatalf("present: got HTTP %d, want %d", got, want)
+	}
+	if got, want := txt(), []string{"token"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TXT records: got %q, want %q", got, want)
+	}
+	if got, want := acme("cleanup", "nas", "secret", fqdn), http.StatusOK; got != want {
+		t.Fatalf("cleanup: got HTTP %d, want %d", got, want)
+	}
+	if got := txt(); len(got) != 0 {
+		t.Errorf("TXT records after cleanup: got %q, want none", got)
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := NewServer("localhost:0", "lan")
+	var hits uint32
+	s.upstream = []string{
+		dnsServerAddr(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddUint32(&hits, 1)
+			if r.Question[0].Name == "nx.example.net." {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeNameError)
+				soa, _ := dns.NewRR("example.net. 3600 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 86400 300")
+				m.Ns = append(m.Ns, soa)
+				w.WriteMsg(m)
+				return
+			}
+			reply(w, r, " 60 IN A 127.0.0.1")
+		})),
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := resolveTestTarget(s, "google.ch.", net.ParseIP("127.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := atomic.LoadUint32(&hits), uint32(1); got != want {
+		t.Errorf("upstream hits = %d, want %d", got, want)
+	}
+	if got, want := testutil.ToFloat64(s.prom.cacheHits), 2.0; got != want {
+		t.Errorf("dns_cache_hits_total = %v, want %v", got, want)
+	}
+
+	// Cached responses are answered with the query ID, query name case and
+	// the remaining TTL.
+	m := new(dns.Msg)
+	m.SetQuestion("GOOGLE.ch.", dns.TypeA)
+	later := time.Now().Add(20 * time.Second)
+	resp := s.cache.get(m, later)
+	if resp == nil {
+		t.Fatalf("cache.get(%v) = nil", m.Question)
+	}
+	if got, want := resp.Id, m.Id; got != want {
+		t.Errorf("response ID = %d, want %d", got, want)
+	}
+	if got, want := resp.Question[0].Name, "GOOGLE.ch."; got != want {
+		t.Errorf("response question = %q, want %q", got, want)
+	}
+	if got := resp.Answer[0].Header().Ttl; got > 40 {
+		t.Errorf("response TTL = %d, want <= 40", got)
+	}
+	if resp := s.cache.get(m, later.Add(1*time.Minute)); resp != nil {
+		t.Errorf("cache.get after expiry = %v, want nil", resp)
+	}
+
+	// Negative responses are cached for the SOA minimum.
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("nx.example.net.", dns.TypeA)
+		r := &recorder{}
+		s.Mux.ServeDNS(r, m)
+		if r.response == nil {
+			t.Fatalf("nil response")
+		}
+		if got, want := r.response.Rcode, dns.RcodeNameError; got != want {
+			t.Fatalf("unexpected rcode: got %v, want %v", got, want)
+		}
+	}
+	if got, want := atomic.LoadUint32(&hits), uint32(2); got != want {
+		t.Errorf("upstream hits = %d, want %d", got, want)
+	}
+	nx := new(dns.Msg)
+	nx.SetQuestion("nx.example.net.", dns.TypeA)
+	if resp := s.cache.get(nx, time.Now().Add(301*time.Second)); resp != nil {
+		t.Errorf("negative response cached beyond SOA minimum")
+	}
+
+	// Changing the configuration flushes the cache.
+	if err := s.SetConfig(Config{RebindingProtection: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.cache.len(), 0; got != want {
+		t.Errorf("cache entries after SetConfig = %d, want %d", got, want)
+	}
+}
+
+func TestLeaseUpstreams(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	got, err := LeaseUpstreams(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("LeaseUpstreams without leases = %v, want none", got)
+	}
+
+	for fn, content := range map[string]string{
+		"dhcp4/wire/lease.json": `{"dns": ["77.109.128.2", "213.144.129.20"]}`,
+		"dhcp6/wire/lease.json": `{"dns": ["2001:1620:2777:1::10", "77.109.128.2"]}`,
+		"pppoe/wire/lease.json": `{"interface": "ppp0", "dns": ["192.0.2.53"]}`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, fn)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err = LeaseUpstreams(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"77.109.128.2:53",
+		"213.144.129.20:53",
+		"[2001:1620:2777:1::10]:53",
+		"192.0.2.53:53",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("LeaseUpstreams = %v, want %v", got, want)
+	}
+
+	s := NewServer("localhost:0", "lan")
+	s.SetUpstreams(got)
+	if got := s.upstreams(); !reflect.DeepEqual(got, want) {
+		t.Errorf("upstreams = %v, want %v", got, want)
+	}
+	s.SetUpstreams(nil)
+	if got, want := s.upstreams(), defaultUpstreams; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstreams after SetUpstreams(nil) = %v, want %v", got, want)
+	}
+}
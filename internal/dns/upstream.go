@@ -0,0 +1,110 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// defaultUpstreams are used until the DHCP leases provide resolvers.
+var defaultUpstreams = []string{
+	// https://developers.google.com/speed/public-dns/docs/using#google_public_dns_ip_addresses
+	"8.8.8.8:53",
+	"8.8.4.4:53",
+	"[2001:4860:4860::8888]:53",
+	"[2001:4860:4860::8844]:53",
+}
+
+// LeaseUpstreams returns the resolvers which the DHCPv4, DHCPv6 and PPPoE
+// clients learned from their leases in dir (dhcp4/wire/lease.json,
+// dhcp6/wire/lease.json and pppoe/wire/lease.json), as host:port. Missing
+// leases are skipped.
+func LeaseUpstreams(dir string) ([]string, error) {
+	var upstreams []string
+	seen := make(map[string]bool)
+	for _, fn := range []string{"dhcp4/wire/lease.json", "dhcp6/wire/lease.json", "pppoe/wire/lease.json"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var lease struct {
+			DNS []string `json:"dns"`
+		}
+		if err := json.Unmarshal(b, &lease); err != nil {
+			return nil, err
+		}
+		for _, addr := range lease.DNS {
+			ip := net.ParseIP(addr)
+			if ip == nil || ip.IsUnspecified() {
+				continue
+			}
+			u := net.JoinHostPort(ip.String(), "53")
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams, nil
+}
+
+func sameUpstreams(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := append([]string(nil), a...)
+	bs := append([]string(nil), b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for idx := range as {
+		if as[idx] != bs[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetUpstreams sets the resolvers which queries are forwarded to, e.g. those
+// returned by LeaseUpstreams. An empty list restores the default upstreams.
+// The preference order established by latency probes is kept as long as the
+// set of upstreams does not change.
+func (s *Server) SetUpstreams(upstreams []string) {
+	if len(upstreams) == 0 {
+		upstreams = defaultUpstreams
+	}
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+	if sameUpstreams(s.upstream, upstreams) {
+		return
+	}
+	log.Printf("upstreams: %v", upstreams)
+	for _, u := range s.upstream {
+		s.prom.upstreamSelected.DeleteLabelValues(u)
+		s.prom.upstreamHealthy.DeleteLabelValues(u)
+	}
+	s.upstream = append([]string(nil), upstreams...)
+	s.failures = make(map[string]int)
+	s.updateSelectedLocked()
+	s.cache.flush()
+}
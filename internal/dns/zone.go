@@ -0,0 +1,197 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zoneTTL is short so that address changes (e.g. a new DHCPv4 lease on the
+// uplink) propagate quickly.
+const zoneTTL = 60
+
+// Zone is a public DNS zone which is answered authoritatively, e.g. a
+// subdomain whose NS record points to the router’s public address.
+type Zone struct {
+	Name string // e.g. home.example.com
+
+	// Addrs maps lower-case names relative to the zone (empty for the zone
+	// apex) to their current addresses.
+	Addrs map[string][]net.IP
+}
+
+type zone struct {
+	name   string // lower-case, fully qualified
+	addrs  map[string][]net.IP
+	serial uint32
+}
+
+// SetZone configures the zone which the server answers authoritatively (nil
+// disables it). Queries for the zone are answered on Mux (for LAN clients)
+// and on PublicMux (for the internet).
+func (s *Server) SetZone(z *Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if z == nil {
+		if s.zone != nil {
+			s.Mux.HandleRemove(s.zone.name)
+			s.PublicMux.HandleRemove(s.zone.name)
+		}
+		s.zone = nil
+		return
+	}
+	name := dns.Fqdn(strings.ToLower(z.Name))
+	if s.zone != nil && s.zone.name != name {
+		s.Mux.HandleRemove(s.zone.name)
+		s.PublicMux.HandleRemove(s.zone.name)
+	}
+	// The serial only changes with the records, so that secondaries do
+	// not transfer the zone on every update, and never decreases.
+	serial := uint32(time.Now().Unix())
+	if old := s.zone; old != nil && old.name == name {
+		if sameAddrs(old.addrs, z.Addrs) {
+			serial = old.serial
+		} else if serial <= old.serial {
+			serial = old.serial + 1
+		}
+	}
+	s.zone = &zone{
+		name:   name,
+		addrs:  z.Addrs,
+		serial: serial,
+	}
+	s.Mux.HandleFunc(name, s.handleZone)
+	s.PublicMux.HandleFunc(name, s.handleZone)
+}
+
+func sameAddrs(a, b map[string][]net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, addrs := range a {
+		other, ok := b[name]
+		if !ok || len(addrs) != len(other) {
+			return false
+		}
+		for i, ip := range addrs {
+			if !ip.Equal(other[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *Server) currentZone() *zone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.zone
+}
+
+func (z *zone) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: z.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zoneTTL},
+		Ns:      z.name,
+		Mbox:    "hostmaster." + z.name,
+		Serial:  z.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  zoneTTL,
+	}
+}
+
+// answer returns the answers for q and whether the name exists.
+func (z *zone) answer(q dns.Question) ([]dns.RR, bool) {
+	name := strings.ToLower(q.Name)
+	rel := strings.TrimSuffix(strings.TrimSuffix(name, z.name), ".")
+	addrs, ok := z.addrs[rel]
+	if !ok && rel != "" {
+		return nil, false
+	}
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: zoneTTL}
+	var answers []dns.RR
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		for _, ip := range addrs {
+			if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+				hdr.Rrtype = dns.TypeA
+				answers = append(answers, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+				hdr.Rrtype = dns.TypeAAAA
+				answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypeNS:
+		if rel == "" {
+			hdr.Rrtype = dns.TypeNS
+			answers = append(answers, &dns.NS{Hdr: hdr, Ns: z.name})
+		}
+	case dns.TypeSOA:
+		if rel == "" {
+			answers = append(answers, z.soa())
+		}
+	}
+	return answers, true
+}
+
+func (s *Server) handleZone(w dns.ResponseWriter, r *dns.Msg) {
+	s.prom.queries.Inc()
+	s.prom.questions.Observe(float64(len(r.Question)))
+	s.prom.upstream.WithLabelValues("zone").Inc()
+	z := s.currentZone()
+	if z == nil || len(r.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	q := r.Question[0]
+	answers, ok := z.answer(q)
+	if values := s.challenges(strings.ToLower(q.Name), time.Now()); len(values) > 0 {
+		ok = true
+		if q.Qtype == dns.TypeTXT {
+			for _, v := range values {
+				answers = append(answers, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: zoneTTL},
+					Txt: []string{v},
+				})
+			}
+		}
+	}
+	if !ok {
+		m.SetRcode(r, dns.RcodeNameError)
+	}
+	m.Answer = answers
+	if len(answers) == 0 {
+		m.Ns = []dns.RR{z.soa()} // for negative caching
+	}
+	w.WriteMsg(m)
+}
+
+// refuse answers queries for names outside of the zone on PublicMux, so that
+// the router does not act as an open resolver.
+func (s *Server) refuse(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
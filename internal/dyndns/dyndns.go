@@ -0,0 +1,337 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dyndns keeps DNS records pointed at the uplink address and the
+// delegated IPv6 prefix, as configured in /perm/dyndns.json, by updating them
+// via RFC 2136 (with TSIG) or the Cloudflare API whenever the leases change.
+//
+// The last pushed address and failed attempts of each record are persisted in
+// /perm/dyndns/state.json, so that restarts neither repeat updates nor reset
+// the backoff after failures.
+package dyndns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/jpillora/backoff"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/pppoe"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// ProviderConfig configures a DNS provider. Type selects which of the
+// remaining fields are used.
+type ProviderConfig struct {
+	Type string `json:"type"` // rfc2136 or cloudflare
+
+	// rfc2136
+	Server    string `json:"server"`    // host:port, e.g. ns1.example.net:53
+	Zone      string `json:"zone"`      // e.g. example.net
+	KeyName   string `json:"key_name"`  // TSIG key name, e.g. router7
+	Algorithm string `json:"algorithm"` // TSIG algorithm, default: hmac-sha256
+	Secret    string `json:"secret"`    // base64-encoded TSIG secret
+
+	// cloudflare
+	ZoneID   string `json:"zone_id"`
+	APIToken string `json:"api_token"` // with the Zone.DNS edit permission
+	URL      string `json:"url"`       // optional API URL override
+}
+
+// Record is a DNS record to keep up to date.
+type Record struct {
+	Name     string `json:"name"`     // e.g. home.example.net
+	Type     string `json:"type"`     // A (default) or AAAA
+	Provider string `json:"provider"` // name in Config.Providers
+	TTL      int    `json:"ttl"`      // default: 300
+
+	// IPv6Host is the interface identifier of AAAA records within the lan0
+	// subnet of the delegated prefix, default ::1 (router7 itself). Use e.g.
+	// the token of a LAN host from bindings.json to point at that host.
+	IPv6Host string `json:"ipv6_host"`
+}
+
+func (r Record) key() string {
+	return r.Name + "/" + r.Type
+}
+
+// Config is read from /perm/dyndns.json.
+type Config struct {
+	Providers map[string]ProviderConfig `json:"providers"`
+	Records   []Record                  `json:"records"`
+}
+
+// ReadConfig reads dyndns.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dyndns.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("dyndns.json: %v", err)
+	}
+	for idx, r := range cfg.Records {
+		if r.Name == "" {
+			return cfg, fmt.Errorf("dyndns.json: record %d: name must be set", idx)
+		}
+		switch r.Type {
+		case "":
+			cfg.Records[idx].Type = "A"
+		case "A", "AAAA":
+		default:
+			return cfg, fmt.Errorf("dyndns.json: record %s: unknown type %q (expected A or AAAA)", r.Name, r.Type)
+		}
+		if r.TTL == 0 {
+			cfg.Records[idx].TTL = 300
+		}
+		if r.IPv6Host == "" {
+			cfg.Records[idx].IPv6Host = "::1"
+		} else if ip := net.ParseIP(r.IPv6Host); ip == nil || ip.To4() != nil {
+			return cfg, fmt.Errorf("dyndns.json: record %s: invalid ipv6_host %q", r.Name, r.IPv6Host)
+		}
+		if _, ok := cfg.Providers[r.Provider]; !ok {
+			return cfg, fmt.Errorf("dyndns.json: record %s: unknown provider %q", r.Name, r.Provider)
+		}
+	}
+	return cfg, nil
+}
+
+// provider updates DNS records.
+type provider interface {
+	update(ctx context.Context, r Record, ip net.IP) error
+}
+
+func newProvider(cfg ProviderConfig) (provider, error) {
+	switch cfg.Type {
+	case "rfc2136":
+		if cfg.Server == "" || cfg.Zone == "" {
+			return nil, fmt.Errorf("rfc2136: server and zone must be set")
+		}
+		if (cfg.KeyName == "") != (cfg.Secret == "") {
+			return nil, fmt.Errorf("rfc2136: key_name and secret must be set together")
+		}
+		return &rfc2136Provider{cfg}, nil
+	case "cloudflare":
+		if cfg.ZoneID == "" || cfg.APIToken == "" {
+			return nil, fmt.Errorf("cloudflare: zone_id and api_token must be set")
+		}
+		return &cloudflareProvider{cfg}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q", cfg.Type)
+	}
+}
+
+// Addrs are the addresses which records point to.
+type Addrs struct {
+	IPv4 net.IP     // of the uplink (PPPoE session or DHCPv4 lease)
+	LAN6 *net.IPNet // lan0 subnet of the delegated IPv6 prefix
+}
+
+// CurrentAddrs returns the addresses of the leases in dir. Addresses are nil
+// while the corresponding lease is missing or expired.
+func CurrentAddrs(dir string, now time.Time) (Addrs, error) {
+	var addrs Addrs
+	var session pppoe.Lease
+	var lease4 dhcp4.Config
+	if err := readJSON(filepath.Join(dir, "pppoe/wire/lease.json"), &session); err != nil {
+		return addrs, err
+	}
+	if err := readJSON(filepath.Join(dir, "dhcp4/wire/lease.json"), &lease4); err != nil {
+		return addrs, err
+	}
+	if ip := net.ParseIP(session.ClientIP).To4(); ip != nil {
+		addrs.IPv4 = ip
+	} else if ip := net.ParseIP(lease4.ClientIP).To4(); ip != nil {
+		addrs.IPv4 = ip
+	}
+
+	var lease6 dhcp6.Config
+	if err := readJSON(filepath.Join(dir, "dhcp6/wire/lease.json"), &lease6); err != nil {
+		return addrs, err
+	}
+	subnets, err := netconfig.IPv6Subnets(dir)
+	if err != nil {
+		return addrs, err
+	}
+	idx, ok := subnets["lan0"]
+	if !ok || idx < 0 {
+		return addrs, nil
+	}
+	for i, prefix := range lease6.Prefixes {
+		if i < len(lease6.Lifetimes) && !lease6.Lifetimes[i].ValidUntil.IsZero() &&
+			!lease6.Lifetimes[i].ValidUntil.After(now) {
+			continue // expired
+		}
+		subnet, err := netconfig.Subnet(prefix, idx)
+		if err != nil {
+			return addrs, err
+		}
+		addrs.LAN6 = &subnet
+		break
+	}
+	return addrs, nil
+}
+
+// readJSON unmarshals the file fn into v, leaving v untouched if fn does not
+// exist.
+func readJSON(fn string, v interface{}) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	return nil
+}
+
+// addr returns the address r should point to, or nil if unknown.
+func (r Record) addr(addrs Addrs) net.IP {
+	if r.Type == "A" {
+		return addrs.IPv4
+	}
+	if addrs.LAN6 == nil {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, addrs.LAN6.IP.To16())
+	copy(ip[8:], net.ParseIP(r.IPv6Host).To16()[8:])
+	return ip
+}
+
+// RecordState is persisted in /perm/dyndns/state.json.
+type RecordState struct {
+	Addr    string    `json:"addr"` // last successfully pushed
+	Updated time.Time `json:"updated"`
+
+	// Failures is the number of consecutive failed updates. No further
+	// attempt is made before RetryAfter.
+	Failures   int       `json:"failures,omitempty"`
+	RetryAfter time.Time `json:"retry_after,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// Updater pushes address changes to the providers.
+type Updater struct {
+	records   []Record
+	providers map[string]provider
+	statePath string
+	state     map[string]*RecordState // by Record.key
+	backoff   backoff.Backoff
+	timeNow   func() time.Time
+}
+
+// NewUpdater returns an Updater for cfg which persists its state in dir.
+func NewUpdater(dir string, cfg Config) (*Updater, error) {
+	u := &Updater{
+		records:   cfg.Records,
+		providers: make(map[string]provider),
+		statePath: filepath.Join(dir, "dyndns", "state.json"),
+		state:     make(map[string]*RecordState),
+		backoff: backoff.Backoff{
+			Factor: 2,
+			Min:    1 * time.Minute,
+			Max:    1 * time.Hour,
+		},
+		timeNow: time.Now,
+	}
+	for name, pc := range cfg.Providers {
+		p, err := newProvider(pc)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %v", name, err)
+		}
+		u.providers[name] = p
+	}
+	if err := readJSON(u.statePath, &u.state); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// State returns the state of the record called name (e.g. home.example.net)
+// of type typ (A or AAAA), or nil if it was never updated.
+func (u *Updater) State(name, typ string) *RecordState {
+	return u.state[Record{Name: name, Type: typ}.key()]
+}
+
+// Update pushes the records whose address differs from the last pushed
+// address, unless a previous failure is still backing off. Failed updates are
+// logged and retried by later calls.
+func (u *Updater) Update(ctx context.Context, addrs Addrs) error {
+	var changed bool
+	for _, r := range u.records {
+		ip := r.addr(addrs)
+		if ip == nil {
+			continue // address not (yet) known
+		}
+		st, ok := u.state[r.key()]
+		if !ok {
+			st = &RecordState{}
+			u.state[r.key()] = st
+		}
+		if st.Addr == ip.String() {
+			continue
+		}
+		now := u.timeNow()
+		if now.Before(st.RetryAfter) {
+			continue
+		}
+		changed = true
+		if err := u.providers[r.Provider].update(ctx, r, ip); err != nil {
+			st.Failures++
+			st.RetryAfter = now.Add(u.backoff.ForAttempt(float64(st.Failures - 1)))
+			st.LastError = err.Error()
+			log.Printf("updating %s %s to %v: %v (retrying after %v)", r.Type, r.Name, ip, err, st.RetryAfter.Format(time.RFC3339))
+			continue
+		}
+		log.Printf("updated %s %s to %v", r.Type, r.Name, ip)
+		*st = RecordState{
+			Addr:    ip.String(),
+			Updated: now,
+		}
+	}
+	if !changed {
+		return nil
+	}
+	b, err := json.Marshal(u.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(u.statePath), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(u.statePath, b, 0644)
+}
+
+// fqdn returns name as a fully qualified domain name, e.g. example.net.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dyndns
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+)
+
+func writeFile(t *testing.T, fn, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dyndns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const providers = `"providers": {"cf": {"type": "cloudflare", "zone_id": "z", "api_token": "t"}}`
+	for _, tt := range []struct {
+		cfg     string
+		wantErr bool
+	}{
+		{`{` + providers + `, "records": [{"name": "home.example.net", "provider": "cf"}]}`, false},
+		{`{` + providers + `, "records": [{"name": "home.example.net", "type": "AAAA", "ipv6_host": "::1234", "provider": "cf"}]}`, false},
+		{`{` + providers + `, "records": [{"name": "home.example.net", "type": "MX", "provider": "cf"}]}`, true},
+		{`{` + providers + `, "records": [{"name": "home.example.net", "provider": "nsupdate"}]}`, true},
+		{`{` + providers + `, "records": [{"name": "home.example.net", "type": "AAAA", "ipv6_host": "10.0.0.1", "provider": "cf"}]}`, true},
+	} {
+		writeFile(t, filepath.Join(tmp, "dyndns.json"), tt.cfg)
+		if _, err := ReadConfig(tmp); (err != nil) != tt.wantErr {
+			t.Errorf("ReadConfig(%s) = %v, want error: %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCurrentAddrs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dyndns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	now := time.Now()
+
+	addrs, err := CurrentAddrs(tmp, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs.IPv4 != nil || addrs.LAN6 != nil {
+		t.Errorf("CurrentAddrs without leases = %+v, want none", addrs)
+	}
+
+	writeFile(t, filepath.Join(tmp, "dhcp4/wire/lease.json"), `{"client_ip": "203.0.113.23"}`)
+	writeFile(t, filepath.Join(tmp, "dhcp6/wire/lease.json"), `{"prefixes": [{"IP": "2001:db8:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`)
+	addrs, err = CurrentAddrs(tmp, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addrs.IPv4.String(), "203.0.113.23"; got != want {
+		t.Errorf("IPv4: got %s, want %s", got, want)
+	}
+	for _, tt := range []struct {
+		record Record
+		want   string
+	}{
+		{Record{Type: "A"}, "203.0.113.23"},
+		{Record{Type: "AAAA", IPv6Host: "::1"}, "2001:db8:4a00::1"},
+		{Record{Type: "AAAA", IPv6Host: "::dead:beef"}, "2001:db8:4a00::dead:beef"},
+	} {
+		if got := tt.record.addr(addrs).String(); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.record, got, tt.want)
+		}
+	}
+
+	// The PPPoE session takes precedence over the DHCPv4 lease.
+	writeFile(t, filepath.Join(tmp, "pppoe/wire/lease.json"), `{"client_ip": "198.51.100.5"}`)
+	addrs, err = CurrentAddrs(tmp, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addrs.IPv4.String(), "198.51.100.5"; got != want {
+		t.Errorf("IPv4 with PPPoE session: got %s, want %s", got, want)
+	}
+}
+
+func TestRFC2136(t *testing.T) {
+	const secret = "so6ZGir4GPAqINNh9U5c3A=="
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan *dns.Msg, 1)
+	srv := &dns.Server{
+		PacketConn: pc,
+		TsigSecret: map[string]string{"router7.": secret},
+		// The default accepts only queries and notifies.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.IsTsig() == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeNotAuth
+			} else {
+				updates <- r
+			}
+			m.SetTsig("router7.", dns.HmacSHA256, 300, time.Now().Unix())
+			w.WriteMsg(m)
+		}),
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	p := &rfc2136Provider{ProviderConfig{
+		Type:    "rfc2136",
+		Server:  pc.LocalAddr().String(),
+		Zone:    "example.net",
+		KeyName: "router7",
+		Secret:  secret,
+	}}
+	r := Record{Name: "home.example.net", Type: "A", TTL: 300}
+	if err := p.update(context.Background(), r, net.ParseIP("203.0.113.23")); err != nil {
+		t.Fatal(err)
+	}
+	update := <-updates
+	if got, want := update.Question[0].Name, "example.net."; got != want {
+		t.Errorf("zone: got %s, want %s", got, want)
+	}
+	var got []string
+	for _, rr := range update.Ns {
+		got = append(got, rr.String())
+	}
+	want := []string{
+		"home.example.net.\t0\tCLASS255\tA\t", // delete the RRset
+		"home.example.net.\t300\tIN\tA\t203.0.113.23",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("update: diff (-want +got):\n%s", diff)
+	}
+
+	wrongKey := *p
+	wrongKey.cfg.Secret = "c2VjcmV0"
+	if err := wrongKey.update(context.Background(), r, net.ParseIP("203.0.113.23")); err == nil {
+		t.Errorf("update with wrong TSIG secret unexpectedly succeeded")
+	}
+}
+
+// fakeCloudflare implements the DNS record endpoints of the Cloudflare API.
+type fakeCloudflare struct {
+	mu       sync.Mutex
+	fail     bool
+	requests []string
+	records  []cloudflareRecord
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if f.fail || r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"success": false, "errors": [{"code": 971, "message": "Please wait and consider throttling your request speed"}]}`))
+		return
+	}
+	var result interface{}
+	switch r.Method {
+	case "GET":
+		result = f.records
+	case "POST", "PUT":
+		var rec cloudflareRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec.ID = "372e67954025e0ba6aaa6d586b9e0b59"
+		f.records = []cloudflareRecord{rec}
+		result = rec
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+}
+
+func TestUpdater(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "dyndns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cf := &fakeCloudflare{}
+	ts := httptest.NewServer(cf)
+	defer ts.Close()
+	cfg := Config{
+		Providers: map[string]ProviderConfig{
+			"cf": {Type: "cloudflare", ZoneID: "023e105f4ecef8ad9ca31a8372d0c353", APIToken: "secret", URL: ts.URL},
+		},
+		Records: []Record{{Name: "home.example.net", Type: "A", Provider: "cf", TTL: 300}},
+	}
+	now := time.Now()
+	newUpdater := func() *Updater {
+		u, err := NewUpdater(tmp, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.timeNow = func() time.Time { return now }
+		return u
+	}
+	requests := func() int {
+		cf.mu.Lock()
+		defer cf.mu.Unlock()
+		return len(cf.requests)
+	}
+	ctx := context.Background()
+	addrs := Addrs{IPv4: net.ParseIP("203.0.113.23")}
+
+	u := newUpdater()
+	if err := u.Update(ctx, addrs); err != nil {
+		t.Fatal(err)
+	}
+	want := []cloudflareRecord{{ID: "372e67954025e0ba6aaa6d586b9e0b59", Type: "A", Name: "home.example.net", Content: "203.0.113.23", TTL: 300}}
+	if diff := cmp.Diff(want, cf.records); diff != "" {
+		t.Errorf("records: diff (-want +got):\n%s", diff)
+	}
+	if got, want := requests(), 2; got != want { // GET, POST
+		t.Fatalf("got %d requests, want %d", got, want)
+	}
+
+	// Unchanged addresses are not pushed again, not even after a restart.
+	u = newUpdater()
+	if err := u.Update(ctx, addrs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := requests(), 2; got != want {
+		t.Fatalf("got %d requests after restart, want %d", got, want)
+	}
+
+	// A failed update is not retried before the backoff expired, not even
+	// after a restart.
+	cf.fail = true
+	addrs.IPv4 = net.ParseIP("203.0.113.42")
+	if err := u.Update(ctx, addrs); err != nil {
+		t.Fatal(err)
+	}
+	st := u.State("home.example.net", "A")
+	if st.Failures != 1 || st.Addr != "203.0.113.23" {
+		t.Errorf("state after failure = %+v, want 1 failure, address 203.0.113.23", st)
+	}
+	u = newUpdater()
+	now = now.Add(30 * time.Second)
+	if err := u.Update(ctx, addrs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := requests(), 3; got != want {
+		t.Fatalf("got %d requests while backing off, want %d", got, want)
+	}
+
+	cf.fail = false
+	now = now.Add(1 * time.Minute)
+	if err := u.Update(ctx, addrs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := requests(), 5; got != want { // GET, PUT
+		t.Fatalf("got %d requests after the backoff, want %d", got, want)
+	}
+	if got, want := cf.requests[4], "PUT /zones/023e105f4ecef8ad9ca31a8372d0c353/dns_records/372e67954025e0ba6aaa6d586b9e0b59"; got != want {
+		t.Errorf("request: got %q, want %q", got, want)
+	}
+	if st := u.State("home.example.net", "A"); st.Failures != 0 || st.Addr != "203.0.113.42" {
+		t.Errorf("state after update = %+v, want no failures, address 203.0.113.42", st)
+	}
+}
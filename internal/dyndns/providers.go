@@ -0,0 +1,163 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dyndns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rfc2136Provider sends DNS UPDATE messages (RFC 2136), signed with TSIG
+// (RFC 8945) if a key is configured, e.g. to BIND or Knot.
+type rfc2136Provider struct {
+	cfg ProviderConfig
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, r Record, ip net.IP) error {
+	hdr := dns.RR_Header{
+		Name:  fqdn(r.Name),
+		Class: dns.ClassINET,
+		Ttl:   uint32(r.TTL),
+	}
+	var rr dns.RR
+	if r.Type == "A" {
+		hdr.Rrtype = dns.TypeA
+		rr = &dns.A{Hdr: hdr, A: ip.To4()}
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(fqdn(p.cfg.Zone))
+	m.RemoveRRset([]dns.RR{rr})
+	m.Insert([]dns.RR{rr})
+	c := &dns.Client{Timeout: 10 * time.Second}
+	if p.cfg.KeyName != "" {
+		algorithm := dns.HmacSHA256
+		if p.cfg.Algorithm != "" {
+			algorithm = fqdn(strings.ToLower(p.cfg.Algorithm))
+		}
+		key := fqdn(strings.ToLower(p.cfg.KeyName))
+		c.TsigSecret = map[string]string{key: p.cfg.Secret}
+		m.SetTsig(key, algorithm, 300, time.Now().Unix())
+	}
+	reply, _, err := c.ExchangeContext(ctx, m, p.cfg.Server)
+	if err != nil {
+		return err
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s: %s", p.cfg.Server, dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// cloudflareProvider updates records via the Cloudflare API, see
+// https://developers.cloudflare.com/api/operations/dns-records-for-a-zone-list-dns-records
+type cloudflareProvider struct {
+	cfg ProviderConfig
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+// do sends a request to the Cloudflare API and decodes the result into
+// result (unless nil).
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, body, result interface{}) error {
+	u := p.cfg.URL
+	if u == "" {
+		u = "https://api.cloudflare.com/client/v4"
+	}
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var cr cloudflareResponse
+	if err := json.Unmarshal(b, &cr); err != nil || !cr.Success {
+		if len(cr.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s (code %d)", method, path, cr.Errors[0].Message, cr.Errors[0].Code)
+		}
+		return fmt.Errorf("%s %s: unexpected HTTP status %v: %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(cr.Result, result)
+}
+
+func (p *cloudflareProvider) update(ctx context.Context, r Record, ip net.IP) error {
+	path := "/zones/" + url.PathEscape(p.cfg.ZoneID) + "/dns_records"
+	var existing []cloudflareRecord
+	query := url.Values{
+		"type": []string{r.Type},
+		"name": []string{strings.TrimSuffix(r.Name, ".")},
+	}
+	if err := p.do(ctx, "GET", path+"?"+query.Encode(), nil, &existing); err != nil {
+		return err
+	}
+	rec := cloudflareRecord{
+		Type:    r.Type,
+		Name:    strings.TrimSuffix(r.Name, "."),
+		Content: ip.String(),
+		TTL:     r.TTL,
+	}
+	if len(existing) == 0 {
+		return p.do(ctx, "POST", path, &rec, nil)
+	}
+	return p.do(ctx, "PUT", path+"/"+url.PathEscape(existing[0].ID), &rec, nil)
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ethtool implements the subset of the SIOCETHTOOL ioctl interface
+// which router7 requires. The ioctl interface is used instead of the ethtool
+// netlink interface, as the latter is only available in Linux ≥ 5.6.
+package ethtool
+
+import (
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// from include/uapi/linux/ethtool.h
+const (
+	ethtoolGSet        = 0x00000001
+	ethtoolSSet        = 0x00000002
+	ethtoolGPauseParam = 0x00000012
+	ethtoolSPauseParam = 0x00000013
+	ethtoolSTSO        = 0x0000001f
+	ethtoolGPermAddr   = 0x00000020
+	ethtoolSGSO        = 0x00000024
+	ethtoolGFlags      = 0x00000025
+	ethtoolSFlags      = 0x00000026
+	ethtoolSGRO        = 0x0000002c
+	ethtoolGEEE        = 0x00000044
+	ethtoolSEEE        = 0x00000045
+
+	ethFlagLRO = 1 << 15
+
+	duplexHalf = 0x00
+	duplexFull = 0x01
+
+	autonegDisable = 0x00
+	autonegEnable  = 0x01
+
+	supportedAutoneg = 1 << 6
+)
+
+// cmd is struct ethtool_cmd.
+type cmd struct {
+	cmd           uint32
+	supported     uint32
+	advertising   uint32
+	speed         uint16
+	duplex        uint8
+	port          uint8
+	phyAddress    uint8
+	transceiver   uint8
+	autoneg       uint8
+	mdioSupport   uint8
+	maxtxpkt      uint32
+	maxrxpkt      uint32
+	speedHi       uint16
+	ethTpMdix     uint8
+	ethTpMdixCtrl uint8
+	lpAdvertising uint32
+	reserved      [2]uint32
+}
+
+// eee is struct ethtool_eee.
+type eee struct {
+	cmd          uint32
+	supported    uint32
+	advertised   uint32
+	lpAdvertised uint32
+	eeeActive    uint32
+	eeeEnabled   uint32
+	txLpiEnabled uint32
+	txLpiTimer   uint32
+	reserved     [2]uint32
+}
+
+// value is struct ethtool_value.
+type value struct {
+	cmd  uint32
+	data uint32
+}
+
+// pauseParam is struct ethtool_pauseparam.
+type pauseParam struct {
+	cmd     uint32
+	autoneg uint32
+	rxPause uint32
+	txPause uint32
+}
+
+// ifreq is struct ifreq with the ifr_data union member.
+type ifreq struct {
+	name [unix.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte // pad to sizeof(struct ifreq)
+}
+
+// ioctl issues the ethtool command contained in the buffer data for ifname.
+func ioctl(ifname string, data unsafe.Pointer) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var ifr ifreq
+	if len(ifname) >= len(ifr.name) {
+		return fmt.Errorf("interface name %q too long", ifname)
+	}
+	copy(ifr.name[:], ifname)
+	ifr.data = data
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// PermAddr returns the permanent hardware address of ifname, i.e. the address
+// burnt into the network card, which stays the same when the current address
+// is changed (e.g. spoofed or randomized by the driver).
+func PermAddr(ifname string) (net.HardwareAddr, error) {
+	var req struct {
+		cmd  uint32
+		size uint32
+		data [32]byte // MAX_ADDR_LEN
+	}
+	req.cmd = ethtoolGPermAddr
+	req.size = uint32(len(req.data))
+	if err := ioctl(ifname, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("ETHTOOL_GPERMADDR(%s): %v", ifname, err)
+	}
+	addr := make(net.HardwareAddr, req.size)
+	copy(addr, req.data[:req.size])
+	for _, b := range addr {
+		if b != 0 {
+			return addr, nil
+		}
+	}
+	// e.g. virtual interfaces
+	return nil, fmt.Errorf("ETHTOOL_GPERMADDR(%s): no permanent address", ifname)
+}
+
+// Autoneg reports whether ifname supports autonegotiation of its link speed
+// and duplex mode, and whether autonegotiation is currently enabled.
+func Autoneg(ifname string) (supported, enabled bool, _ error) {
+	c := cmd{cmd: ethtoolGSet}
+	if err := ioctl(ifname, unsafe.Pointer(&c)); err != nil {
+		return false, false, fmt.Errorf("ETHTOOL_GSET(%s): %v", ifname, err)
+	}
+	return c.supported&supportedAutoneg != 0, c.autoneg == autonegEnable, nil
+}
+
+// SetSpeedDuplex forces the link speed (in Mbit/s) and duplex mode of ifname,
+// disabling autonegotiation. A speed of 0 re-enables autonegotiation.
+func SetSpeedDuplex(ifname string, speed int, fullDuplex bool) error {
+	c := cmd{cmd: ethtoolGSet}
+	if err := ioctl(ifname, unsafe.Pointer(&c)); err != nil {
+		return fmt.Errorf("ETHTOOL_GSET(%s): %v", ifname, err)
+	}
+	c.cmd = ethtoolSSet
+	if speed == 0 {
+		c.autoneg = autonegEnable
+		c.advertising = c.supported
+	} else {
+		c.autoneg = autonegDisable
+		c.speed = uint16(speed)
+		c.speedHi = uint16(speed >> 16)
+		c.duplex = duplexHalf
+		if fullDuplex {
+			c.duplex = duplexFull
+		}
+	}
+	if err := ioctl(ifname, unsafe.Pointer(&c)); err != nil {
+		return fmt.Errorf("ETHTOOL_SSET(%s): %v", ifname, err)
+	}
+	return nil
+}
+
+// SetEEE enables or disables Energy-Efficient Ethernet (802.3az) on ifname.
+func SetEEE(ifname string, enabled bool) error {
+	e := eee{cmd: ethtoolGEEE}
+	if err := ioctl(ifname, unsafe.Pointer(&e)); err != nil {
+		return fmt.Errorf("ETHTOOL_GEEE(%s): %v", ifname, err)
+	}
+	e.cmd = ethtoolSEEE
+	e.eeeEnabled = boolToUint32(enabled)
+	e.txLpiEnabled = boolToUint32(enabled)
+	if err := ioctl(ifname, unsafe.Pointer(&e)); err != nil {
+		return fmt.Errorf("ETHTOOL_SEEE(%s): %v", ifname, err)
+	}
+	return nil
+}
+
+// SetPause configures receiving and sending pause frames (802.3x flow
+// control) on ifname, disabling pause autonegotiation. A nil rx or tx leaves
+// the respective current setting unchanged.
+func SetPause(ifname string, rx, tx *bool) error {
+	p := pauseParam{cmd: ethtoolGPauseParam}
+	if err := ioctl(ifname, unsafe.Pointer(&p)); err != nil {
+		return fmt.Errorf("ETHTOOL_GPAUSEPARAM(%s): %v", ifname, err)
+	}
+	p.update(rx, tx)
+	if err := ioctl(ifname, unsafe.Pointer(&p)); err != nil {
+		return fmt.Errorf("ETHTOOL_SPAUSEPARAM(%s): %v", ifname, err)
+	}
+	return nil
+}
+
+// update turns p, as returned by ETHTOOL_GPAUSEPARAM, into an
+// ETHTOOL_SPAUSEPARAM request which overrides the non-nil settings.
+func (p *pauseParam) update(rx, tx *bool) {
+	p.cmd = ethtoolSPauseParam
+	p.autoneg = 0
+	if rx != nil {
+		p.rxPause = boolToUint32(*rx)
+	}
+	if tx != nil {
+		p.txPause = boolToUint32(*tx)
+	}
+}
+
+// Offload identifies a segmentation/receive offload feature.
+type Offload string
+
+const (
+	GRO Offload = "gro" // generic receive offload
+	GSO Offload = "gso" // generic segmentation offload
+	TSO Offload = "tso" // TCP segmentation offload
+	LRO Offload = "lro" // large receive offload
+)
+
+// SetOffload enables or disables the offload feature o on ifname.
+func SetOffload(ifname string, o Offload, enabled bool) error {
+	var c uint32
+	switch o {
+	case GRO:
+		c = ethtoolSGRO
+	case GSO:
+		c = ethtoolSGSO
+	case TSO:
+		c = ethtoolSTSO
+	case LRO:
+		// LRO is toggled via the device flags.
+		v := value{cmd: ethtoolGFlags}
+		if err := ioctl(ifname, unsafe.Pointer(&v)); err != nil {
+			return fmt.Errorf("ETHTOOL_GFLAGS(%s): %v", ifname, err)
+		}
+		v.cmd = ethtoolSFlags
+		if enabled {
+			v.data |= ethFlagLRO
+		} else {
+			v.data &^= ethFlagLRO
+		}
+		if err := ioctl(ifname, unsafe.Pointer(&v)); err != nil {
+			return fmt.Errorf("ETHTOOL_SFLAGS(%s): %v", ifname, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown offload %q", o)
+	}
+	v := value{cmd: c, data: boolToUint32(enabled)}
+	if err := ioctl(ifname, unsafe.Pointer(&v)); err != nil {
+		return fmt.Errorf("SIOCETHTOOL(%s, %s=%v): %v", ifname, o, enabled, err)
+	}
+	return nil
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
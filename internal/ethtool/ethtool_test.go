@@ -0,0 +1,61 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethtool
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestStructSizes(t *testing.T) {
+	// The sizes must match the kernel’s struct definitions in
+	// include/uapi/linux/ethtool.h.
+	for _, tt := range []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"ethtool_cmd", unsafe.Sizeof(cmd{}), 44},
+		{"ethtool_eee", unsafe.Sizeof(eee{}), 40},
+		{"ethtool_pauseparam", unsafe.Sizeof(pauseParam{}), 16},
+		{"ethtool_value", unsafe.Sizeof(value{}), 8},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("sizeof(struct %s) = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestPauseUpdate(t *testing.T) {
+	on, off := true, false
+	for _, tt := range []struct {
+		name   string
+		rx, tx *bool
+		want   pauseParam
+	}{
+		{"RxOnly", &off, nil, pauseParam{cmd: ethtoolSPauseParam, rxPause: 0, txPause: 1}},
+		{"TxOnly", nil, &off, pauseParam{cmd: ethtoolSPauseParam, rxPause: 1, txPause: 0}},
+		{"Both", &off, &on, pauseParam{cmd: ethtoolSPauseParam, rxPause: 0, txPause: 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// current settings: autonegotiated, both directions enabled
+			p := pauseParam{cmd: ethtoolGPauseParam, autoneg: 1, rxPause: 1, txPause: 1}
+			p.update(tt.rx, tt.tx)
+			if p != tt.want {
+				t.Errorf("update(%v, %v) = %+v, want %+v", tt.rx, tt.tx, p, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exposure reports which ports of the router are reachable from the
+// internet.
+//
+// The candidates are the router’s listening sockets and its port forwardings.
+// Each TCP candidate is probed by connecting to the WAN address, either from
+// an external vantage (a SOCKS5 proxy outside of the network, e.g. ssh -D on
+// a remote host) or, without a vantage, from the router itself (hairpinning).
+// Hairpin connections do not arrive on the uplink, so they bypass the port
+// forwardings and the uplink firewall rules: port forwardings can only be
+// probed from an external vantage.
+//
+// Additionally, the WAN address is queried for SSDP (UPnP discovery) and mDNS
+// responders, which must not answer on the uplink. SOCKS5 cannot carry these
+// UDP queries, so they are always sent from the router itself.
+package exposure
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rtr7/router7/internal/netconfig"
+	"golang.org/x/net/proxy"
+)
+
+// probeTimeout bounds each probe of the WAN address.
+const probeTimeout = 2 * time.Second
+
+// Exposure is a port which might be reachable from the internet.
+type Exposure struct {
+	Proto  string // tcp or udp
+	Port   string // e.g. 22 or 8080-8090
+	Source string // e.g. “listening socket”, “port forwarding”, “SSDP”
+	Detail string // e.g. “forwarded to 192.168.42.23:80”
+	// Probed is true if the port was probed on the WAN address, in which
+	// case Reachable is the observed result.
+	Probed    bool
+	Reachable bool
+}
+
+// socket is a listening socket parsed from /proc/net/{tcp,udp}{,6}.
+type socket struct {
+	addr net.IP
+	port uint16
+}
+
+// parseProcNet parses a /proc/net/{tcp,udp}{,6} file and returns all sockets
+// in state state (0A for TCP LISTEN, 07 for unconnected UDP).
+func parseProcNet(r io.Reader, state string) ([]socket, error) {
+	var sockets []socket
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != state {
+			continue
+		}
+		idx := strings.LastIndex(fields[1], ":")
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed local address %q", fields[1])
+		}
+		addr, err := hex.DecodeString(fields[1][:idx])
+		if err != nil {
+			return nil, err
+		}
+		// The kernel prints the address as host byte order (little endian)
+		// 32-bit words.
+		for i := 0; i+4 <= len(addr); i += 4 {
+			addr[i], addr[i+1], addr[i+2], addr[i+3] = addr[i+3], addr[i+2], addr[i+1], addr[i]
+		}
+		port, err := strconv.ParseUint(fields[1][idx+1:], 16, 16)
+		if err != nil {
+			return nil, err
+		}
+		sockets = append(sockets, socket{addr: net.IP(addr), port: uint16(port)})
+	}
+	return sockets, scanner.Err()
+}
+
+// exposed returns the sockets of /proc/net/{proto,proto6} in state state
+// which accept connections on the WAN addresses wan.
+func exposed(proto, state string, wan []net.IP) ([]socket, error) {
+	var sockets []socket
+	for _, suffix := range []string{"", "6"} {
+		f, err := os.Open("/proc/net/" + proto + suffix)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // e.g. IPv6 disabled
+			}
+			return nil, err
+		}
+		all, err := parseProcNet(f, state)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range all {
+			if len(s.targets(wan)) > 0 {
+				sockets = append(sockets, s)
+			}
+		}
+	}
+	return sockets, nil
+}
+
+// targets returns the addresses of wan on which s accepts connections.
+func (s socket) targets(wan []net.IP) []net.IP {
+	var targets []net.IP
+	for _, ip := range wan {
+		switch {
+		case ip.Equal(s.addr):
+		case s.addr.IsUnspecified() && (s.addr.To4() == nil || ip.To4() != nil):
+			// 0.0.0.0 accepts IPv4 connections, :: accepts both families
+		default:
+			continue
+		}
+		targets = append(targets, ip)
+	}
+	return targets
+}
+
+func dial(vantage proxy.Dialer, addr string) (net.Conn, error) {
+	if cd, ok := vantage.(proxy.ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+		return cd.DialContext(ctx, "tcp", addr)
+	}
+	return vantage.Dial("tcp", addr)
+}
+
+// probeTCP connects to port on the addresses ips via vantage. It reports
+// whether any connection was established and describes the results.
+func probeTCP(vantage proxy.Dialer, ips []net.IP, port string) (bool, string) {
+	var reachable bool
+	results := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		conn, err := dial(vantage, addr)
+		if err != nil {
+			results = append(results, addr+": "+err.Error())
+			continue
+		}
+		conn.Close()
+		reachable = true
+		results = append(results, addr+": connected")
+	}
+	return reachable, strings.Join(results, ", ")
+}
+
+// queryUDP sends req to addr and reports whether a response for which valid
+// returns true arrived, with a description of the result.
+func queryUDP(addr string, req []byte, valid func([]byte) bool) (bool, string) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return false, addr + ": " + err.Error()
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return false, addr + ": " + err.Error()
+	}
+	if _, err := conn.Write(req); err != nil {
+		return false, addr + ": " + err.Error()
+	}
+	buf := make([]byte, 9000)
+	n, err := conn.Read(buf)
+	if err != nil {
+		// e.g. a timeout, or ECONNREFUSED (ICMP port unreachable)
+		return false, addr + ": no response (" + err.Error() + ")"
+	}
+	if !valid(buf[:n]) {
+		return false, addr + ": invalid response"
+	}
+	return true, addr + ": responded"
+}
+
+// ssdpSearch is an SSDP M-SEARCH request for all devices and services.
+const ssdpSearch = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 1\r\n" +
+	"ST: ssdp:all\r\n" +
+	"\r\n"
+
+func validSSDP(b []byte) bool {
+	return strings.HasPrefix(string(b), "HTTP/1.1 200")
+}
+
+// mdnsQuery returns a DNS-SD service enumeration query. Sent from a port
+// other than 5353, responders answer it via unicast (legacy unicast, RFC 6762
+// section 6.7).
+func mdnsQuery() []byte {
+	var m dns.Msg
+	m.SetQuestion("_services._dns-sd._udp.local.", dns.TypePTR)
+	b, err := m.Pack()
+	if err != nil {
+		panic(err) // constant message
+	}
+	return b
+}
+
+func validMDNS(b []byte) bool {
+	var m dns.Msg
+	return m.Unpack(b) == nil && m.Response
+}
+
+// probeDiscovery queries the addresses wan for SSDP and mDNS responders.
+func probeDiscovery(wan []net.IP) []Exposure {
+	if len(wan) == 0 {
+		return nil
+	}
+	var exposures []Exposure
+	for _, d := range []struct {
+		source string
+		port   string
+		req    []byte
+		valid  func([]byte) bool
+	}{
+		{"SSDP", "1900", []byte(ssdpSearch), validSSDP},
+		{"mDNS", "5353", mdnsQuery(), validMDNS},
+	} {
+		e := Exposure{
+			Proto:  "udp",
+			Port:   d.port,
+			Source: d.source,
+			Probed: true,
+		}
+		results := make([]string, 0, len(wan))
+		for _, ip := range wan {
+			ok, result := queryUDP(net.JoinHostPort(ip.String(), d.port), d.req, d.valid)
+			if ok {
+				e.Reachable = true
+			}
+			results = append(results, result)
+		}
+		e.Detail = strings.Join(results, ", ")
+		exposures = append(exposures, e)
+	}
+	return exposures
+}
+
+// Scan returns the exposures of the router whose uplink has the addresses
+// wan, based on its listening sockets and the port forwardings configured in
+// dir. TCP ports are probed via vantage, or from the router itself (hairpin)
+// if vantage is nil.
+func Scan(dir string, wan []net.IP, vantage proxy.Dialer) ([]Exposure, error) {
+	hairpin := vantage == nil
+	if hairpin {
+		vantage = &net.Dialer{Timeout: probeTimeout}
+	}
+
+	var exposures []Exposure
+	for _, l := range []struct {
+		proto string
+		state string
+	}{
+		{"tcp", "0A"}, // LISTEN
+		{"udp", "07"}, // unconnected
+	} {
+		sockets, err := exposed(l.proto, l.state, wan)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sockets {
+			port := strconv.Itoa(int(s.port))
+			e := Exposure{
+				Proto:  l.proto,
+				Port:   port,
+				Source: "listening socket",
+				Detail: "listening on " + net.JoinHostPort(s.addr.String(), port),
+			}
+			if l.proto == "tcp" {
+				var result string
+				e.Reachable, result = probeTCP(vantage, s.targets(wan), port)
+				e.Probed = true
+				e.Detail += "; " + result
+			}
+			exposures = append(exposures, e)
+		}
+	}
+
+	forwardings, err := netconfig.PortForwardings(dir)
+	if err != nil {
+		return nil, err
+	}
+	var wan4 []net.IP
+	for _, ip := range wan {
+		if ip.To4() != nil {
+			wan4 = append(wan4, ip) // port forwardings are IPv4 only
+		}
+	}
+	for _, fw := range forwardings {
+		for _, proto := range strings.Split(fw.Proto, ",") {
+			if proto == "" {
+				proto = "tcp"
+			}
+			e := Exposure{
+				Proto:  proto,
+				Port:   fw.Port,
+				Source: "port forwarding",
+				Detail: "forwarded to " + fw.DestAddr + ":" + fw.DestPort,
+			}
+			switch {
+			case proto != "tcp":
+			case hairpin:
+				e.Detail += "; not probed: hairpin connections bypass port forwardings"
+			default:
+				// For port ranges, the first port is representative.
+				var result string
+				e.Reachable, result = probeTCP(vantage, wan4, strings.Split(fw.Port, "-")[0])
+				e.Probed = true
+				e.Detail += "; " + result
+			}
+			exposures = append(exposures, e)
+		}
+	}
+
+	return append(exposures, probeDiscovery(wan)...), nil
+}
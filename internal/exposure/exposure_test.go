@@ -0,0 +1,151 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exposure
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0016 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12346 1 0000000000000000 100 0 0 10 0
+   2: 012AA8C0:0016 172AA8C0:D431 01 00000000:00000000 00:00000000 00000000     0        0 12347 1 0000000000000000 100 0 0 10 0
+`
+
+func TestParseProcNet(t *testing.T) {
+	sockets, err := parseProcNet(strings.NewReader(procNetTCP), "0A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []socket{
+		{addr: net.ParseIP("127.0.0.1"), port: 53},
+		{addr: net.ParseIP("0.0.0.0"), port: 22},
+	}
+	if len(sockets) != len(want) {
+		t.Fatalf("unexpected number of sockets: got %d, want %d", len(sockets), len(want))
+	}
+	for idx, s := range sockets {
+		if !s.addr.Equal(want[idx].addr) || s.port != want[idx].port {
+			t.Errorf("socket %d: got %v:%d, want %v:%d", idx, s.addr, s.port, want[idx].addr, want[idx].port)
+		}
+	}
+}
+
+func TestTargets(t *testing.T) {
+	wan := []net.IP{net.ParseIP("203.0.113.2"), net.ParseIP("2001:db8::2")}
+	for _, tt := range []struct {
+		addr string
+		want []string
+	}{
+		{"0.0.0.0", []string{"203.0.113.2"}},
+		{"::", []string{"203.0.113.2", "2001:db8::2"}},
+		{"203.0.113.2", []string{"203.0.113.2"}},
+		{"2001:db8::2", []string{"2001:db8::2"}},
+		{"127.0.0.1", nil},
+		{"192.168.42.1", nil},
+	} {
+		addr := net.ParseIP(tt.addr)
+		if ip4 := addr.To4(); ip4 != nil {
+			addr = ip4 // like parseProcNet
+		}
+		var got []string
+		for _, ip := range (socket{addr: addr}).targets(wan) {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("targets(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	localhost := []net.IP{net.ParseIP("127.0.0.1")}
+	if reachable, result := probeTCP(&net.Dialer{}, localhost, port); !reachable {
+		t.Errorf("probeTCP(open port) = false (%s), want true", result)
+	}
+
+	ln.Close()
+	if reachable, result := probeTCP(&net.Dialer{}, localhost, port); reachable {
+		t.Errorf("probeTCP(closed port) = true (%s), want false", result)
+	}
+}
+
+func TestQueryUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var resp []byte
+			if strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				resp = []byte("HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\n\r\n")
+			} else {
+				var m dns.Msg
+				if err := m.Unpack(buf[:n]); err != nil {
+					continue
+				}
+				m.Response = true
+				if resp, err = m.Pack(); err != nil {
+					continue
+				}
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	addr := pc.LocalAddr().String()
+	if ok, result := queryUDP(addr, []byte(ssdpSearch), validSSDP); !ok {
+		t.Errorf("SSDP query: no valid response (%s)", result)
+	}
+	if ok, result := queryUDP(addr, mdnsQuery(), validMDNS); !ok {
+		t.Errorf("mDNS query: no valid response (%s)", result)
+	}
+	if ok, _ := queryUDP(addr, mdnsQuery(), validSSDP); ok {
+		t.Errorf("SSDP validation unexpectedly accepted mDNS response")
+	}
+
+	pc.Close()
+	if ok, result := queryUDP(addr, []byte(ssdpSearch), validSSDP); ok {
+		t.Errorf("SSDP query to closed port: unexpected response (%s)", result)
+	}
+}
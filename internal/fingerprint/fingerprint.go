@@ -0,0 +1,76 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fingerprint classifies LAN devices based on the DHCP options they
+// send.
+package fingerprint
+
+import (
+	"strconv"
+	"strings"
+)
+
+// vendorClasses maps DHCP vendor class identifier (option 60) prefixes to
+// operating systems.
+var vendorClasses = []struct {
+	prefix string
+	os     string
+}{
+	{"android-dhcp", "Android"},
+	{"MSFT", "Windows"},
+	{"dhcpcd", "Linux"},
+	{"udhcp", "Linux (embedded)"},
+	{"Cisco", "Cisco"},
+	{"HUAWEI", "Huawei"},
+	{"SAMSUNG", "Samsung"},
+}
+
+// parameterLists maps DHCP parameter request lists (option 55) to operating
+// systems.
+var parameterLists = map[string]string{
+	"1,3,6,15,31,33,43,44,46,47,119,121,249,252": "Windows",
+	"1,3,6,15,31,33,43,44,46,47,121,249,252":     "Windows",
+	"1,121,3,6,15,114,119,252,95,44,46":          "macOS",
+	"1,121,3,6,15,119,252,95,44,46":              "macOS",
+	"1,121,3,6,15,119,252":                       "iOS",
+	"1,121,3,6,15,108,114,119,252":               "iOS",
+	"1,3,6,15,26,28,51,58,59,43":                 "Android",
+	"1,3,6,15,26,28,51,58,59,43,114":             "Android",
+	"1,28,2,3,15,6,119,12,44,47,26,121,42":       "Linux",
+	"1,3,6,12,15,28,42":                          "Linux (embedded)",
+	"1,3,6,12,15,28,40,41,42":                    "Linux (embedded)",
+}
+
+// ParameterList formats a DHCP parameter request list (option 55) as a
+// comma-separated list of decimal option codes, e.g. “1,3,6,15”.
+func ParameterList(opts []byte) string {
+	codes := make([]string, len(opts))
+	for idx, o := range opts {
+		codes[idx] = strconv.Itoa(int(o))
+	}
+	return strings.Join(codes, ",")
+}
+
+// Classify returns the operating system which most likely sent a DHCP
+// request with the specified parameter request list (as returned by
+// ParameterList) and vendor class identifier, or the empty string if
+// unknown.
+func Classify(parameterList, vendorClass string) string {
+	for _, vc := range vendorClasses {
+		if strings.HasPrefix(vendorClass, vc.prefix) {
+			return vc.os
+		}
+	}
+	return parameterLists[parameterList]
+}
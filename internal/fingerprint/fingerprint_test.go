@@ -0,0 +1,35 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fingerprint
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	for _, tt := range []struct {
+		opts        []byte
+		vendorClass string
+		want        string
+	}{
+		{[]byte{1, 3, 6, 15, 26, 28, 51, 58, 59, 43}, "android-dhcp-10", "Android"},
+		{[]byte{1, 3, 6, 15, 31, 33, 43, 44, 46, 47, 119, 121, 249, 252}, "MSFT 5.0", "Windows"},
+		{[]byte{1, 121, 3, 6, 15, 119, 252}, "", "iOS"},
+		{[]byte{1, 2, 3}, "", ""},
+	} {
+		pl := ParameterList(tt.opts)
+		if got := Classify(pl, tt.vendorClass); got != tt.want {
+			t.Errorf("Classify(%q, %q) = %q, want %q", pl, tt.vendorClass, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package freeze implements a global configuration freeze: while
+// /perm/freeze.json exists, the control APIs of all daemons reject mutating
+// requests, but continue to serve reads. This protects against accidental
+// changes during troubleshooting sessions or runaway automation.
+package freeze
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// State is persisted in /perm/freeze.json.
+type State struct {
+	Reason string    `json:"reason"` // e.g. “debugging uplink flaps”
+	Since  time.Time `json:"since"`
+
+	// Until, if non-zero, ends the freeze automatically, so that a
+	// forgotten freeze does not block changes forever.
+	Until time.Time `json:"until,omitempty"`
+}
+
+func path(dir string) string {
+	return filepath.Join(dir, "freeze.json")
+}
+
+// Read returns the freeze state in dir, or nil if the configuration is not
+// frozen (or the freeze expired at now).
+func Read(dir string, now time.Time) (*State, error) {
+	b, err := ioutil.ReadFile(path(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var st State
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	if !st.Until.IsZero() && now.After(st.Until) {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// Freeze freezes the configuration in dir.
+func Freeze(dir string, st State) error {
+	b, err := json.Marshal(&st)
+	if err != nil {
+		return err
+	}
+	return renameio.WriteFile(path(dir), b, 0644)
+}
+
+// Thaw ends a freeze of the configuration in dir, if any.
+func Thaw(dir string) error {
+	if err := os.Remove(path(dir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// Guard wraps h such that mutating requests (i.e. requests other than GET,
+// HEAD and OPTIONS) are rejected with 423 Locked while the configuration in
+// dir is frozen. Requests for the paths listed in exempt are always passed to
+// h, e.g. the API for ending the freeze.
+func Guard(dir string, h http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mutating(r.Method) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		for _, p := range exempt {
+			if r.URL.Path == p {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		st, err := Read(dir, time.Now())
+		if err != nil {
+			// Fail closed: a corrupt freeze file should not permit changes.
+			http.Error(w, fmt.Sprintf("reading freeze state: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if st != nil {
+			http.Error(w, fmt.Sprintf("configuration frozen since %v: %s", st.Since.Format(time.RFC3339), st.Reason), http.StatusLocked)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
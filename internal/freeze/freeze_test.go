@@ -0,0 +1,80 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package freeze_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rtr7/router7/internal/freeze"
+)
+
+func TestGuard(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "freeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	h := freeze.Guard(tmp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/freeze")
+	status := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+
+	if got, want := status("POST", "/sethostname"), http.StatusOK; got != want {
+		t.Errorf("POST before freeze: got HTTP status %d, want %d", got, want)
+	}
+
+	now := time.Now()
+	if err := freeze.Freeze(tmp, freeze.State{Reason: "debugging", Since: now}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/lease/xps", http.StatusOK},
+		{"POST", "/sethostname", http.StatusLocked},
+		{"DELETE", "/freeze", http.StatusOK},
+	} {
+		if got := status(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s %s while frozen: got HTTP status %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	// Expired freezes are ignored.
+	if err := freeze.Freeze(tmp, freeze.State{Since: now.Add(-2 * time.Hour), Until: now.Add(-1 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := status("POST", "/sethostname"), http.StatusOK; got != want {
+		t.Errorf("POST after expiry: got HTTP status %d, want %d", got, want)
+	}
+
+	if err := freeze.Freeze(tmp, freeze.State{Since: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := freeze.Thaw(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := status("POST", "/sethostname"), http.StatusOK; got != want {
+		t.Errorf("POST after thaw: got HTTP status %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hooks runs user-provided programs on lifecycle events (e.g. when
+// the uplink obtained a new lease), the escape hatch for automation which
+// router7 does not implement itself.
+//
+// The hooks of an event are the executable files in /perm/hooks/<event>/,
+// which are run in lexical order. Each hook receives the event in its
+// environment (ROUTER7_EVENT, ROUTER7_TIME and ROUTER7_<KEY> for each key of
+// the event data, e.g. ROUTER7_INTERFACE) and as a JSON object on stdin.
+//
+// Events are also published to pluginsd, whose plugins can subscribe to them.
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Events.
+const (
+	EventLeaseAcquired = "lease-acquired" // dhcp4 obtained a new (or changed) lease
+	EventPrefixChanged = "prefix-changed" // dhcp6 obtained a new (or changed) prefix
+	EventUplinkDown    = "uplink-down"    // diagd detected an uplink outage
+	EventUplinkUp      = "uplink-up"      // the outage ended
+	EventDeviceJoined  = "device-joined"  // an unknown device obtained a lease
+)
+
+// Event is passed to the hooks.
+type Event struct {
+	Event string            `json:"event"`
+	Time  time.Time         `json:"time"`
+	Data  map[string]string `json:"data"`
+}
+
+// PublishURL is the pluginsd endpoint to which events are published.
+const PublishURL = "http://localhost:8075/publish"
+
+// Runner runs the hooks in a directory.
+type Runner struct {
+	dir        string // e.g. /perm/hooks
+	timeout    time.Duration
+	publishURL string
+
+	mu sync.Mutex // serializes hook runs
+}
+
+// NewRunner returns a Runner for the hooks in dir/hooks.
+func NewRunner(dir string) *Runner {
+	return &Runner{
+		dir:        filepath.Join(dir, "hooks"),
+		timeout:    30 * time.Second,
+		publishURL: PublishURL,
+	}
+}
+
+// Run publishes event and runs its hooks in the background. The hooks of one
+// Runner run one at a time, in the order of the events; failures are logged.
+func (r *Runner) Run(event string, data map[string]string) {
+	ev := Event{
+		Event: event,
+		Time:  time.Now(),
+		Data:  data,
+	}
+	go func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.publish(ev)
+		r.run(ev)
+	}()
+}
+
+var publishClient = &http.Client{Timeout: 5 * time.Second}
+
+// publish sends ev to pluginsd. Errors are ignored: pluginsd is optional.
+func (r *Runner) publish(ev Event) {
+	if r.publishURL == "" {
+		return
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	resp, err := publishClient.Post(r.publishURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// hooks returns the paths of the executable files in the directory of event.
+func (r *Runner) hooks(event string) ([]string, error) {
+	dir := filepath.Join(r.dir, event)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+			continue // e.g. a README
+		}
+		paths = append(paths, filepath.Join(dir, fi.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// env returns the environment of the hooks for ev.
+func env(ev Event) []string {
+	e := append(os.Environ(),
+		"ROUTER7_EVENT="+ev.Event,
+		"ROUTER7_TIME="+ev.Time.Format(time.RFC3339))
+	keys := make([]string, 0, len(ev.Data))
+	for k := range ev.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e = append(e, "ROUTER7_"+strings.ToUpper(k)+"="+ev.Data[k])
+	}
+	return e
+}
+
+// run runs the hooks of ev and returns the number of failed hooks.
+func (r *Runner) run(ev Event) int {
+	paths, err := r.hooks(ev.Event)
+	if err != nil {
+		log.Printf("hooks: %v", err)
+		return 1
+	}
+	if len(paths) == 0 {
+		return 0
+	}
+	input, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("hooks: %v", err)
+		return 1
+	}
+	var failed int
+	for _, path := range paths {
+		if err := r.runHook(path, ev, input); err != nil {
+			log.Printf("hook %s: %v", path, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+func (r *Runner) runHook(path string, ev Event, input []byte) error {
+	cmd := exec.Command(path)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = env(ev)
+	cmd.Stdin = bytes.NewReader(input)
+	// Run the hook in its own process group, so that processes it started
+	// are killed on timeout, too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			log.Printf("hook %s: %s", filepath.Base(path), scanner.Text())
+		}
+		io.Copy(ioutil.Discard, pr) // drain overlong lines
+	}()
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		<-done
+		return err
+	}
+	timer := time.AfterFunc(r.timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	fired := !timer.Stop()
+	pw.Close()
+	<-done
+	if fired {
+		return fmt.Errorf("killed after %v", r.timeout)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRun(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	tmp, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "hooks", EventLeaseAcquired)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(tmp, "out")
+	for _, f := range []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{"10-env", "#!/bin/sh\necho \"$ROUTER7_EVENT $ROUTER7_INTERFACE $ROUTER7_CLIENT_IP\" >> " + out + "\n", 0755},
+		{"20-stdin", "#!/bin/sh\ncat >> " + out + "\n", 0755},
+		{"30-fail", "#!/bin/sh\nexit 1\n", 0755},
+		{"README", "not a hook\n", 0644},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewRunner(tmp)
+	ev := Event{
+		Event: EventLeaseAcquired,
+		Time:  time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+		Data:  map[string]string{"interface": "uplink0", "client_ip": "85.195.207.62"},
+	}
+	if got, want := r.run(ev), 1; got != want {
+		t.Errorf("run: %d hooks failed, want %d", got, want)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(b), "\n", 2)
+	if got, want := lines[0], "lease-acquired uplink0 85.195.207.62"; got != want {
+		t.Errorf("environment: got %q, want %q", got, want)
+	}
+	var got Event
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ev, got); diff != "" {
+		t.Errorf("stdin: diff (-want +got):\n%s", diff)
+	}
+
+	// Events without hooks are fine.
+	if got := r.run(Event{Event: EventUplinkDown}); got != 0 {
+		t.Errorf("run(no hooks): %d hooks failed, want 0", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	tmp, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "hooks", EventUplinkDown)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "hang"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(tmp)
+	r.timeout = 100 * time.Millisecond
+	start := time.Now()
+	if got := r.run(Event{Event: EventUplinkDown}); got != 1 {
+		t.Errorf("run: %d hooks failed, want 1", got)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("run took %v despite the timeout", d)
+	}
+}
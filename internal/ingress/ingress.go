@@ -0,0 +1,275 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ingress routes incoming HTTP requests (by Host header) and TLS
+// connections (by server name indication) to internal hosts, so that multiple
+// services can be exposed on the ports 80 and 443 of a single IPv4 address.
+package ingress
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/splice"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Route is an entry in ingress.json.
+type Route struct {
+	Host string `json:"host"` // e.g. nas.example.com
+
+	// HTTPBackend receives the HTTP requests for Host, e.g. 192.168.42.23:80.
+	HTTPBackend string `json:"http_backend"`
+
+	// TLSBackend receives the TLS connections for Host (passed through
+	// without decrypting them), e.g. 192.168.42.23:443.
+	TLSBackend string `json:"tls_backend"`
+
+	// CertFile and KeyFile (PEM) terminate TLS connections for Host instead,
+	// whose requests are then proxied to HTTPBackend.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// Config is read from /perm/ingress.json.
+type Config struct {
+	Routes []Route `json:"routes"`
+}
+
+// ReadConfig reads ingress.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "ingress.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+type route struct {
+	Route
+	proxy *httputil.ReverseProxy
+	cert  *tls.Certificate
+}
+
+// Proxy routes HTTP requests and TLS connections as configured via
+// SetConfig.
+type Proxy struct {
+	mu     sync.Mutex
+	routes map[string]*route // by lower-case host
+
+	terminated *connListener
+}
+
+// NewProxy returns a Proxy without routes.
+func NewProxy() *Proxy {
+	p := &Proxy{
+		routes:     make(map[string]*route),
+		terminated: newConnListener(),
+	}
+	go func() {
+		srv := &http.Server{Handler: p}
+		log.Printf("serving terminated TLS connections: %v", srv.Serve(p.terminated))
+	}()
+	return p
+}
+
+// SetConfig replaces the routes of p.
+func (p *Proxy) SetConfig(cfg Config) error {
+	routes := make(map[string]*route)
+	for _, r := range cfg.Routes {
+		if r.Host == "" {
+			return fmt.Errorf("route without host")
+		}
+		rt := &route{Route: r}
+		if r.HTTPBackend != "" {
+			if _, _, err := net.SplitHostPort(r.HTTPBackend); err != nil {
+				return fmt.Errorf("%s: http_backend: %v", r.Host, err)
+			}
+			backend := r.HTTPBackend
+			rt.proxy = &httputil.ReverseProxy{
+				Director: func(req *http.Request) {
+					req.URL.Scheme = "http"
+					req.URL.Host = backend
+					if req.TLS != nil {
+						req.Header.Set("X-Forwarded-Proto", "https")
+					} else {
+						req.Header.Set("X-Forwarded-Proto", "http")
+					}
+				},
+			}
+		}
+		if r.CertFile != "" || r.KeyFile != "" {
+			if r.HTTPBackend == "" {
+				return fmt.Errorf("%s: terminating TLS requires http_backend", r.Host)
+			}
+			cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+			if err != nil {
+				return fmt.Errorf("%s: %v", r.Host, err)
+			}
+			rt.cert = &cert
+		}
+		routes[strings.ToLower(r.Host)] = rt
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routes = routes
+	return nil
+}
+
+func (p *Proxy) route(host string) *route {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.routes[strings.ToLower(host)]
+}
+
+// ServeHTTP proxies r to the HTTP backend of its host.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt := p.route(r.Host)
+	if rt == nil || rt.proxy == nil {
+		http.Error(w, "no route for host", http.StatusNotFound)
+		return
+	}
+	rt.proxy.ServeHTTP(w, r)
+}
+
+// readOnlyConn passes reads to r and fails writes, so that a TLS ClientHello
+// can be parsed without responding to it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+var errHelloRead = errors.New("ClientHello read")
+
+// serverName returns the server name indication of the TLS ClientHello which
+// conn sends, and a net.Conn which replays the bytes consumed in the process.
+func serverName(conn net.Conn) (string, net.Conn, error) {
+	var (
+		peeked bytes.Buffer
+		name   string
+	)
+	err := tls.Server(readOnlyConn{conn, io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if err != errHelloRead {
+		return "", nil, err
+	}
+	return name, &replayConn{conn, io.MultiReader(&peeked, conn)}, nil
+}
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *replayConn) CloseWrite() error {
+	if cw, ok := c.Conn.(splice.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// HandleTLS routes the TLS connection conn by its server name indication:
+// either by passing it through to the TLS backend, or by terminating it.
+func (p *Proxy) HandleTLS(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	name, replay, err := serverName(conn)
+	if err != nil {
+		log.Printf("%v: reading ClientHello: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	rt := p.route(name)
+	switch {
+	case rt == nil:
+		log.Printf("%v: no route for server name %q", conn.RemoteAddr(), name)
+		conn.Close()
+
+	case rt.cert != nil:
+		p.terminated.push(tls.Server(replay, &tls.Config{
+			Certificates: []tls.Certificate{*rt.cert},
+		}))
+
+	case rt.TLSBackend != "":
+		defer conn.Close()
+		backend, err := net.DialTimeout("tcp", rt.TLSBackend, 10*time.Second)
+		if err != nil {
+			log.Printf("%v: dialing %s: %v", conn.RemoteAddr(), rt.TLSBackend, err)
+			return
+		}
+		defer backend.Close()
+		splice.Conns(replay, backend)
+
+	default:
+		log.Printf("%v: no TLS backend for server name %q", conn.RemoteAddr(), name)
+		conn.Close()
+	}
+}
+
+// ServeTLS accepts connections on ln and routes them using HandleTLS.
+func (p *Proxy) ServeTLS(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.HandleTLS(conn)
+	}
+}
+
+// connListener is a net.Listener for connections which were accepted
+// elsewhere, e.g. TLS connections to be served by an http.Server.
+type connListener struct {
+	conns chan net.Conn
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn)}
+}
+
+func (l *connListener) push(c net.Conn) { l.conns <- c }
+
+func (l *connListener) Accept() (net.Conn, error) { return <-l.conns, nil }
+func (l *connListener) Close() error              { return nil }
+func (l *connListener) Addr() net.Addr            { return &net.TCPAddr{} }
@@ -0,0 +1,119 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingress
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPRouting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "nas %s", r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+
+	p := NewProxy()
+	if err := p.SetConfig(Config{
+		Routes: []Route{
+			{Host: "NAS.example.com", HTTPBackend: strings.TrimPrefix(backend.URL, "http://")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		host string
+		code int
+		body string
+	}{
+		{"nas.example.com", http.StatusOK, "nas http"},
+		{"nas.example.com:80", http.StatusOK, "nas http"},
+		{"other.example.com", http.StatusNotFound, "no route for host\n"},
+	} {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/", nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.code; got != want {
+			t.Errorf("%s: unexpected HTTP status: got %d, want %d", tt.host, got, want)
+		}
+		if got, want := rec.Body.String(), tt.body; got != want {
+			t.Errorf("%s: unexpected body: got %q, want %q", tt.host, got, want)
+		}
+	}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "nas %s", r.TLS.ServerName)
+	}))
+	defer backend.Close()
+
+	p := NewProxy()
+	if err := p.SetConfig(Config{
+		Routes: []Route{
+			{Host: "nas.example.com", TLSBackend: backend.Listener.Addr().String()},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go p.ServeTLS(ln)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				return tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+					ServerName:         "nas.example.com",
+					InsecureSkipVerify: true, // httptest certificate
+				})
+			},
+		},
+	}
+	resp, err := client.Get("https://nas.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "nas nas.example.com"; got != want {
+		t.Errorf("unexpected body: got %q, want %q", got, want)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	server, client := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "nas.example.com"}).Handshake()
+	name, _, err := serverName(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := name, "nas.example.com"; got != want {
+		t.Errorf("unexpected server name: got %q, want %q", got, want)
+	}
+}
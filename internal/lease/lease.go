@@ -0,0 +1,237 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lease implements the lifecycle of the leases of the dhcp4 and dhcp6
+// clients: leases are renewed on schedule and persisted for netconfigd (and
+// other consumers), which are notified only when the lease changed. A lease
+// which expires without renewal is removed, so that netconfigd removes its
+// addresses and routes.
+package lease
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/jpillora/backoff"
+
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Client obtains and renews a lease, e.g. *dhcp4.Client.
+type Client interface {
+	// ObtainOrRenew returns false when encountering a permanent error.
+	ObtainOrRenew() bool
+	// Err returns the error of the last ObtainOrRenew call, if any.
+	Err() error
+}
+
+// State is the state of the lease of a Client after ObtainOrRenew.
+type State struct {
+	Lease interface{} // persisted as JSON, e.g. dhcp4.Config
+
+	// Key is the part of Lease whose changes require the consumers to
+	// re-configure, e.g. the address, but not the renewal time.
+	Key interface{}
+
+	Renew  time.Time // when to renew the lease
+	Expiry time.Time // when the lease ends unless renewed, zero if unknown
+}
+
+// ErrReleased is returned by Run after the lease was released.
+var ErrReleased = errors.New("lease released")
+
+// Manager runs the lifecycle of the lease of a Client.
+type Manager struct {
+	Client Client
+
+	// State returns the state of the lease after a successful
+	// ObtainOrRenew.
+	State func() State
+
+	// Path is the file to which the lease is written, e.g.
+	// /perm/dhcp4/wire/lease.json.
+	Path string
+
+	// Persisted, if not nil, is called after the lease was written, e.g. to
+	// persist the DHCPACK packet for renewals across restarts.
+	Persisted func() error
+
+	// Release releases the lease (e.g. DHCPRELEASE).
+	Release func() error
+
+	// Notify are the processes (e.g. /user/netconfigd) which are sent
+	// SIGUSR1 when the lease changed.
+	Notify []string
+
+	// Changed, if not nil, is called after the consumers were notified of a
+	// new or changed lease, e.g. to run hooks.
+	Changed func(State)
+
+	// Backoff is the delay between attempts after temporary errors.
+	Backoff backoff.Backoff
+
+	// Expire, if not nil, makes the lease expire right away when receiving
+	// from it (e.g. SIGHUP in chaos mode), to validate how the consumers deal
+	// with losing the lease.
+	Expire <-chan os.Signal
+
+	// Forget, if not nil, is called after a forced expiry so that the client
+	// obtains a new lease instead of renewing the old one (e.g. DHCPDISCOVER
+	// instead of DHCPREQUEST).
+	Forget func()
+
+	timeNow func() time.Time
+	notify  func(process string) error
+}
+
+func (m *Manager) now() time.Time {
+	if m.timeNow != nil {
+		return m.timeNow()
+	}
+	return time.Now()
+}
+
+func (m *Manager) notifyAll() {
+	for _, process := range m.Notify {
+		var err error
+		if m.notify != nil {
+			err = m.notify(process)
+		} else {
+			err = notify.Process(process, syscall.SIGUSR1)
+		}
+		if err != nil {
+			log.Printf("notifying %s: %v", process, err)
+		}
+	}
+}
+
+// remove removes the lease file and notifies the consumers, so that they stop
+// using the lease.
+func (m *Manager) remove() error {
+	if err := os.Remove(m.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m.notifyAll()
+	return nil
+}
+
+// forceExpiry removes the lease as if it expired.
+func (m *Manager) forceExpiry() error {
+	log.Printf("forcing lease expiry, removing %s", m.Path)
+	if m.Forget != nil {
+		m.Forget()
+	}
+	return m.remove()
+}
+
+// Run obtains a lease and renews it until the Client encounters a permanent
+// error, which is returned. A value on renew makes Run renew the lease right
+// away (e.g. SIGUSR1 once the uplink regained carrier), a value on release
+// makes it release the lease and return ErrReleased.
+func (m *Manager) Run(renew, release <-chan os.Signal) error {
+	var (
+		notified []byte // Key of the lease the consumers were notified of
+		expiry   time.Time
+	)
+	for m.Client.ObtainOrRenew() {
+		if err := m.Client.Err(); err != nil {
+			if !expiry.IsZero() && !m.now().Before(expiry) {
+				log.Printf("lease expired at %v without renewal, removing %s", expiry, m.Path)
+				if err := m.remove(); err != nil {
+					return err
+				}
+				expiry = time.Time{}
+				notified = nil
+			}
+			dur := m.Backoff.Duration()
+			wait := dur
+			if !expiry.IsZero() {
+				if until := expiry.Sub(m.now()); until < wait {
+					wait = until
+				}
+			}
+			log.Printf("Temporary error: %v (waiting %v)", err, dur)
+			select {
+			case <-time.After(wait):
+			case <-renew:
+				m.Backoff.Reset()
+			case <-m.Expire:
+				if err := m.forceExpiry(); err != nil {
+					return err
+				}
+				expiry = time.Time{}
+				notified = nil
+			}
+			continue
+		}
+		m.Backoff.Reset()
+		st := m.State()
+		log.Printf("lease: %+v", st.Lease)
+		b, err := json.Marshal(st.Lease)
+		if err != nil {
+			return err
+		}
+		if err := renameio.WriteFile(m.Path, b, 0644); err != nil {
+			return err
+		}
+		if m.Persisted != nil {
+			if err := m.Persisted(); err != nil {
+				return err
+			}
+		}
+		key, err := json.Marshal(st.Key)
+		if err != nil {
+			return err
+		}
+		if notified == nil || !bytes.Equal(key, notified) {
+			m.notifyAll()
+			notified = key
+			if m.Changed != nil {
+				m.Changed(st)
+			}
+		}
+		expiry = st.Expiry
+
+		select {
+		case <-time.After(st.Renew.Sub(m.now())):
+			// fallthrough and renew the lease
+		case <-renew:
+			log.Printf("SIGUSR1 received (carrier regained), renewing lease")
+		case <-m.Expire:
+			if err := m.forceExpiry(); err != nil {
+				return err
+			}
+			expiry = time.Time{}
+			notified = nil
+		case <-release:
+			log.Printf("SIGUSR2 received, releasing lease")
+			if err := m.Release(); err != nil {
+				return err
+			}
+			if err := m.remove(); err != nil {
+				return err
+			}
+			return ErrReleased
+		}
+	}
+	return m.Client.Err() // permanent error
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lease
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/jpillora/backoff"
+)
+
+type step struct {
+	addr string // empty for a temporary error
+}
+
+// fakeClient plays a script of ObtainOrRenew results, followed by a
+// permanent error.
+type fakeClient struct {
+	script []step
+	addr   string
+	err    error
+	check  func(idx int) // called before each step
+	idx    int
+}
+
+var errPermanent = errors.New("permanent error")
+
+func (c *fakeClient) ObtainOrRenew() bool {
+	if c.idx == len(c.script) {
+		c.err = errPermanent
+		return false
+	}
+	c.check(c.idx)
+	s := c.script[c.idx]
+	c.idx++
+	if s.addr == "" {
+		c.err = errors.New("timeout")
+		return true
+	}
+	c.addr, c.err = s.addr, nil
+	return true
+}
+
+func (c *fakeClient) Err() error { return c.err }
+
+type lease struct {
+	Addr  string    `json:"addr"`
+	Renew time.Time `json:"renew"`
+}
+
+func TestManager(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "lease.json")
+
+	now := time.Now()
+	var notified []string
+	c := &fakeClient{
+		script: []step{
+			{addr: "192.0.2.23"},
+			{addr: "192.0.2.23"}, // renewal: no notification
+			{addr: "198.51.100.23"},
+			{}, // temporary error before expiry
+			{}, // temporary error after expiry: lease removed
+			{addr: "198.51.100.23"},
+		},
+	}
+	c.check = func(idx int) {
+		if idx == 4 {
+			now = now.Add(time.Hour) // lease expired
+		}
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != (idx > 0 && idx != 5) {
+			t.Errorf("step %d: lease file exists = %v", idx, exists)
+		}
+	}
+	m := &Manager{
+		Client: c,
+		State: func() State {
+			renew := now.Add(-1 * time.Second) // renew right away
+			return State{
+				Lease:  lease{Addr: c.addr, Renew: renew},
+				Key:    c.addr,
+				Renew:  renew,
+				Expiry: now.Add(time.Minute),
+			}
+		},
+		Path:   path,
+		Notify: []string{"/user/netconfigd"},
+		Changed: func(st State) {
+			notified = append(notified, "changed "+st.Key.(string))
+		},
+		Backoff: backoff.Backoff{Min: time.Millisecond, Max: time.Millisecond},
+		timeNow: func() time.Time { return now },
+		notify: func(process string) error {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				notified = append(notified, process+" (removed)")
+				return nil
+			}
+			var l lease
+			if err := json.Unmarshal(b, &l); err != nil {
+				t.Fatal(err)
+			}
+			notified = append(notified, process+" "+l.Addr)
+			return nil
+		},
+	}
+	if err := m.Run(nil, nil); err != errPermanent {
+		t.Fatalf("Run = %v, want %v", err, errPermanent)
+	}
+	want := []string{
+		"/user/netconfigd 192.0.2.23",
+		"changed 192.0.2.23",
+		"/user/netconfigd 198.51.100.23",
+		"changed 198.51.100.23",
+		"/user/netconfigd (removed)",
+		"/user/netconfigd 198.51.100.23",
+		"changed 198.51.100.23",
+	}
+	if diff := cmp.Diff(want, notified); diff != "" {
+		t.Errorf("notifications: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestManagerRelease(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "lease.json")
+
+	c := &fakeClient{
+		script: []step{{addr: "192.0.2.23"}},
+		check:  func(int) {},
+	}
+	var released bool
+	m := &Manager{
+		Client: c,
+		State: func() State {
+			return State{
+				Lease: lease{Addr: c.addr},
+				Key:   c.addr,
+				Renew: time.Now().Add(time.Hour),
+			}
+		},
+		Path:    path,
+		Release: func() error { released = true; return nil },
+		notify:  func(string) error { return nil },
+	}
+	release := make(chan os.Signal, 1)
+	release <- os.Interrupt
+	if err := m.Run(nil, release); err != ErrReleased {
+		t.Fatalf("Run = %v, want %v", err, ErrReleased)
+	}
+	if !released {
+		t.Errorf("lease not released")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lease file not removed after release: %v", err)
+	}
+}
+
+func TestManagerExpire(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "lease.json")
+
+	c := &fakeClient{
+		script: []step{
+			{addr: "192.0.2.23"},
+			{addr: "192.0.2.23"}, // obtained again after the forced expiry
+		},
+		check: func(int) {},
+	}
+	var notified []string
+	var forgotten bool
+	m := &Manager{
+		Client: c,
+		State: func() State {
+			renew := time.Now().Add(time.Hour)
+			if c.idx == len(c.script) {
+				renew = time.Now() // run into the permanent error
+			}
+			return State{
+				Lease: lease{Addr: c.addr},
+				Key:   c.addr,
+				Renew: renew,
+			}
+		},
+		Path:   path,
+		Notify: []string{"/user/netconfigd"},
+		Forget: func() { forgotten = true },
+		notify: func(process string) error {
+			if _, err := os.Stat(path); err != nil {
+				notified = append(notified, process+" (removed)")
+				return nil
+			}
+			notified = append(notified, process)
+			return nil
+		},
+	}
+	expire := make(chan os.Signal, 1)
+	expire <- os.Interrupt
+	m.Expire = expire
+	if err := m.Run(nil, nil); err != errPermanent {
+		t.Fatalf("Run = %v, want %v", err, errPermanent)
+	}
+	if !forgotten {
+		t.Errorf("Forget not called")
+	}
+	want := []string{
+		"/user/netconfigd",
+		"/user/netconfigd (removed)",
+		"/user/netconfigd", // notified again although the lease is unchanged
+	}
+	if diff := cmp.Diff(want, notified); diff != "" {
+		t.Errorf("notifications: diff (-want +got):\n%s", diff)
+	}
+}
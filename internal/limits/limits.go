@@ -0,0 +1,302 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package limits applies scheduling priorities, OOM scores and cgroup
+// resource limits to the router7 processes, so that a misbehaving auxiliary
+// process cannot starve the DHCP and DNS servers.
+package limits
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Limits are applied to all processes of a program. Zero values leave the
+// corresponding setting unchanged.
+type Limits struct {
+	Nice        int `json:"nice"`          // -20 (highest priority) to 19
+	OOMScoreAdj int `json:"oom_score_adj"` // -1000 (never killed) to 1000
+
+	// CPUWeight is the relative share of CPU time under contention (1 to
+	// 10000, the kernel default is 100).
+	CPUWeight int `json:"cpu_weight"`
+
+	// MemoryMax is the hard memory limit, e.g. “64M”. The process is
+	// OOM-killed (and restarted by gokrazy) when exceeding it.
+	MemoryMax string `json:"memory_max"`
+}
+
+// Dataplane are the limits of processes which clients depend on for network
+// connectivity.
+var Dataplane = Limits{
+	Nice:        -5,
+	OOMScoreAdj: -900,
+	CPUWeight:   1000,
+}
+
+// Auxiliary are the limits of processes which serve diagnostics, backups and
+// other non-essential features.
+var Auxiliary = Limits{
+	Nice:        5,
+	OOMScoreAdj: 500,
+	CPUWeight:   50,
+}
+
+// DefaultConfig assigns the router7 programs to Dataplane or Auxiliary.
+var DefaultConfig = Config{
+	Programs: map[string]Limits{
+		"netconfigd": Dataplane,
+		"dhcp4":      Dataplane,
+		"dhcp6":      Dataplane,
+		"dhcp4d":     Dataplane,
+		"dnsd":       Dataplane,
+		"radvd":      Dataplane,
+		"backupd":    Auxiliary,
+		"captured":   Auxiliary,
+		"diagd":      Auxiliary,
+		"proxyd":     Auxiliary,
+		"scheduled":  Auxiliary,
+		"storaged":   Auxiliary,
+	},
+}
+
+// Config is read from /perm/limits.json.
+type Config struct {
+	// Programs maps program names (e.g. “dnsd”) to their limits. Programs
+	// listed in limits.json replace the DefaultConfig entry.
+	Programs map[string]Limits `json:"programs"`
+}
+
+// ReadConfig reads limits.json from dir and merges it into DefaultConfig.
+func ReadConfig(dir string) (Config, error) {
+	cfg := Config{Programs: make(map[string]Limits)}
+	for name, l := range DefaultConfig.Programs {
+		cfg.Programs[name] = l
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "limits.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	var override Config
+	if err := json.Unmarshal(b, &override); err != nil {
+		return cfg, err
+	}
+	for name, l := range override.Programs {
+		if l.Nice < -20 || l.Nice > 19 {
+			return cfg, fmt.Errorf("%s: nice %d out of range [-20, 19]", name, l.Nice)
+		}
+		if l.OOMScoreAdj < -1000 || l.OOMScoreAdj > 1000 {
+			return cfg, fmt.Errorf("%s: oom_score_adj %d out of range [-1000, 1000]", name, l.OOMScoreAdj)
+		}
+		if l.CPUWeight < 0 || l.CPUWeight > 10000 {
+			return cfg, fmt.Errorf("%s: cpu_weight %d out of range [1, 10000]", name, l.CPUWeight)
+		}
+		if _, err := parseSize(l.MemoryMax); err != nil {
+			return cfg, fmt.Errorf("%s: memory_max: %v", name, err)
+		}
+		cfg.Programs[name] = l
+	}
+	return cfg, nil
+}
+
+// parseSize parses sizes like 64M into bytes. The empty string results in 0.
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mult := uint64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		mult = 1 << 10
+	case 'M', 'm':
+		mult = 1 << 20
+	case 'G', 'g':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// Enforcer applies a Config to running processes.
+type Enforcer struct {
+	procRoot    string // /proc
+	cgroupRoot  string // cgroup2 mount point, e.g. /sys/fs/cgroup/unified
+	setpriority func(tid, nice int) error
+}
+
+// NewEnforcer returns an Enforcer which places processes into cgroups below
+// the cgroup2 hierarchy mounted at cgroupRoot, mounting it if required.
+func NewEnforcer(cgroupRoot string) (*Enforcer, error) {
+	if err := mountCgroup2(cgroupRoot); err != nil {
+		return nil, err
+	}
+	return &Enforcer{
+		procRoot:   "/proc",
+		cgroupRoot: cgroupRoot,
+		setpriority: func(tid, nice int) error {
+			return unix.Setpriority(unix.PRIO_PROCESS, tid, nice)
+		},
+	}, nil
+}
+
+func mountCgroup2(dir string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err == nil && st.Type == unix.CGROUP2_SUPER_MAGIC {
+		return nil // already mounted
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("cgroup2", dir, "cgroup2", 0, ""); err != nil {
+		return fmt.Errorf("mount cgroup2 %s: %v", dir, err)
+	}
+	return nil
+}
+
+var numericRe = regexp.MustCompile(`^[0-9]+$`)
+
+// programs returns the pids of the gokrazy programs (started as
+// /user/<name>) by name.
+func (e *Enforcer) programs() (map[string][]int, error) {
+	fis, err := ioutil.ReadDir(e.procRoot)
+	if err != nil {
+		return nil, err
+	}
+	pids := make(map[string][]int)
+	for _, fi := range fis {
+		if !fi.IsDir() || !numericRe.MatchString(fi.Name()) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(e.procRoot, fi.Name(), "cmdline"))
+		if err != nil {
+			continue // process vanished
+		}
+		argv0 := string(b)
+		if idx := strings.IndexByte(argv0, 0); idx > -1 {
+			argv0 = argv0[:idx]
+		}
+		if !strings.HasPrefix(argv0, "/user/") {
+			continue
+		}
+		pid, _ := strconv.Atoi(fi.Name()) // already verified to be numeric
+		name := strings.TrimPrefix(argv0, "/user/")
+		pids[name] = append(pids[name], pid)
+	}
+	return pids, nil
+}
+
+func writeFile(fn, val string) error {
+	return ioutil.WriteFile(fn, []byte(val), 0644)
+}
+
+// Apply applies cfg to all running programs. Programs which were restarted
+// since the last call are only covered once Apply is called again, so it
+// should be called periodically.
+func (e *Enforcer) Apply(cfg Config) error {
+	pids, err := e.programs()
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for name, l := range cfg.Programs {
+		for _, pid := range pids[name] {
+			if err := e.apply(name, pid, l); err != nil {
+				errs = append(errs, fmt.Sprintf("%s (pid %d): %v", name, pid, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (e *Enforcer) apply(name string, pid int, l Limits) error {
+	proc := filepath.Join(e.procRoot, strconv.Itoa(pid))
+	if l.OOMScoreAdj != 0 {
+		if err := writeFile(filepath.Join(proc, "oom_score_adj"), strconv.Itoa(l.OOMScoreAdj)); err != nil {
+			return err
+		}
+	}
+	if l.Nice != 0 {
+		// The nice value is a per-thread attribute on Linux. Threads which
+		// are created later inherit it from their creator.
+		tasks, err := ioutil.ReadDir(filepath.Join(proc, "task"))
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil {
+				continue
+			}
+			if err := e.setpriority(tid, l.Nice); err != nil {
+				return fmt.Errorf("setpriority(%d): %v", tid, err)
+			}
+		}
+	}
+	if l.CPUWeight == 0 && l.MemoryMax == "" {
+		return nil
+	}
+	return e.applyCgroup(name, pid, l)
+}
+
+func (e *Enforcer) applyCgroup(name string, pid int, l Limits) error {
+	// cgroup2 does not allow processes in inner cgroups, so the router7
+	// cgroup only contains one cgroup per program.
+	parent := filepath.Join(e.cgroupRoot, "router7")
+	dir := filepath.Join(parent, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, d := range []string{e.cgroupRoot, parent} {
+		if err := writeFile(filepath.Join(d, "cgroup.subtree_control"), "+cpu +memory"); err != nil {
+			return err
+		}
+	}
+	if l.CPUWeight != 0 {
+		if err := writeFile(filepath.Join(dir, "cpu.weight"), strconv.Itoa(l.CPUWeight)); err != nil {
+			return err
+		}
+	}
+	max := "max"
+	if l.MemoryMax != "" {
+		n, err := parseSize(l.MemoryMax)
+		if err != nil {
+			return err
+		}
+		max = strconv.FormatUint(n, 10)
+	}
+	if err := writeFile(filepath.Join(dir, "memory.max"), max); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "cgroup.procs"), strconv.Itoa(pid))
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package limits
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg, err := ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(DefaultConfig, cfg); diff != "" {
+		t.Errorf("unexpected default config: (-want +got)\n%s", diff)
+	}
+
+	const override = `{"programs": {"diagd": {"nice": 10, "memory_max": "32M"}}}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "limits.json"), []byte(override), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(Limits{Nice: 10, MemoryMax: "32M"}, cfg.Programs["diagd"]); diff != "" {
+		t.Errorf("unexpected diagd limits: (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(Dataplane, cfg.Programs["dnsd"]); diff != "" {
+		t.Errorf("unexpected dnsd limits: (-want +got)\n%s", diff)
+	}
+
+	const invalid = `{"programs": {"diagd": {"memory_max": "lots"}}}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "limits.json"), []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(tmp); err == nil {
+		t.Errorf("ReadConfig unexpectedly succeeded for invalid memory_max")
+	}
+}
+
+func TestApply(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	proc := filepath.Join(tmp, "proc")
+	for pid, cmdline := range map[string]string{
+		"1":   "/gokrazy/init\x00",
+		"100": "/user/dnsd\x00-listen\x00",
+		"200": "/user/diagd\x00",
+	} {
+		if err := os.MkdirAll(filepath.Join(proc, pid, "task", pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(proc, pid, "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(proc, "100", "task", "101"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cgroup := filepath.Join(tmp, "cgroup")
+	if err := os.MkdirAll(cgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	nice := make(map[int]int)
+	e := &Enforcer{
+		procRoot:   proc,
+		cgroupRoot: cgroup,
+		setpriority: func(tid, n int) error {
+			nice[tid] = n
+			return nil
+		},
+	}
+	cfg := Config{
+		Programs: map[string]Limits{
+			"dnsd":  Dataplane,
+			"diagd": {Nice: 5, OOMScoreAdj: 500, CPUWeight: 50, MemoryMax: "32M"},
+		},
+	}
+	if err := e.Apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(map[int]int{100: -5, 101: -5, 200: 5}, nice); diff != "" {
+		t.Errorf("unexpected nice values: (-want +got)\n%s", diff)
+	}
+	for fn, want := range map[string]string{
+		"proc/100/oom_score_adj":                "-900",
+		"proc/200/oom_score_adj":                "500",
+		"cgroup/cgroup.subtree_control":         "+cpu +memory",
+		"cgroup/router7/cgroup.subtree_control": "+cpu +memory",
+		"cgroup/router7/dnsd/cpu.weight":        "1000",
+		"cgroup/router7/dnsd/memory.max":        "max",
+		"cgroup/router7/dnsd/cgroup.procs":      "100",
+		"cgroup/router7/diagd/cpu.weight":       "50",
+		"cgroup/router7/diagd/memory.max":       "33554432",
+		"cgroup/router7/diagd/cgroup.procs":     "200",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(tmp, fn))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := strings.TrimSpace(string(b)); got != want {
+			t.Errorf("%s: got %q, want %q", fn, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(proc, "1", "oom_score_adj")); !os.IsNotExist(err) {
+		t.Errorf("limits unexpectedly applied to non-router7 process")
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mcroute forwards IPv4 multicast traffic between interfaces
+// according to static routes (like smcroute), e.g. SSDP between LAN segments
+// or IPTV from the uplink into a VLAN.
+//
+// The kernel forwards multicast traffic only while a multicast routing socket
+// is open: it reports traffic without forwarding cache (MFC) entry via the
+// socket, and the Router installs MFC entries for traffic matching a route
+// via netlink.
+package mcroute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Route is an entry in mcroute.json.
+type Route struct {
+	From string   `json:"from"` // inbound interface, e.g. uplink0
+	To   []string `json:"to"`   // outbound interfaces, e.g. ["lan0.10"]
+
+	// Group is a multicast group (e.g. 239.255.255.250) or a range of groups
+	// (e.g. 232.0.0.0/8).
+	Group string `json:"group"`
+
+	// Source restricts the route to traffic from one sender, e.g. 192.0.2.1
+	// (default: any source).
+	Source string `json:"source"`
+}
+
+// Config is read from /perm/mcroute.json.
+type Config struct {
+	Routes []Route `json:"routes"`
+}
+
+// ReadConfig reads mcroute.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "mcroute.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+type route struct {
+	from   string
+	to     []string
+	group  *net.IPNet
+	source net.IP // nil means any source
+}
+
+func parseRoutes(cfg Config) ([]route, error) {
+	routes := make([]route, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		if r.From == "" || len(r.To) == 0 {
+			return nil, fmt.Errorf("route %s: from and to must be specified", r.Group)
+		}
+		group := r.Group
+		if !strings.Contains(group, "/") {
+			group += "/32"
+		}
+		_, ipnet, err := net.ParseCIDR(group)
+		if err != nil {
+			return nil, err
+		}
+		if ipnet.IP.To4() == nil || !ipnet.IP.IsMulticast() {
+			return nil, fmt.Errorf("route %s: not an IPv4 multicast group", r.Group)
+		}
+		var source net.IP
+		if r.Source != "" {
+			if source = net.ParseIP(r.Source).To4(); source == nil {
+				return nil, fmt.Errorf("route %s: invalid source %q", r.Group, r.Source)
+			}
+		}
+		routes = append(routes, route{
+			from:   r.From,
+			to:     r.To,
+			group:  ipnet,
+			source: source,
+		})
+	}
+	return routes, nil
+}
+
+// match returns the first route for traffic from source to group arriving
+// on ifname, or nil.
+func match(routes []route, ifname string, source, group net.IP) *route {
+	for i, r := range routes {
+		if r.from != ifname || !r.group.Contains(group) {
+			continue
+		}
+		if r.source != nil && !r.source.Equal(source) {
+			continue
+		}
+		return &routes[i]
+	}
+	return nil
+}
+
+// Interfaces returns the index of each present interface used in cfg. The
+// Router must be re-created when the result changes, e.g. after a VLAN
+// interface was created.
+func Interfaces(cfg Config) map[string]int {
+	indexes := make(map[string]int)
+	for _, r := range cfg.Routes {
+		for _, ifname := range append([]string{r.From}, r.To...) {
+			if iface, err := net.InterfaceByName(ifname); err == nil {
+				indexes[ifname] = iface.Index
+			}
+		}
+	}
+	return indexes
+}
+
+// Multicast routing socket options and messages, from
+// include/uapi/linux/mroute.h
+const (
+	mrtInit   = 200
+	mrtAddVIF = 202
+
+	viffUseIfindex = 0x8
+	maxVIFs        = 32
+
+	igmpmsgNocache = 1
+
+	rtnlFamilyIPMR = 128
+)
+
+// vifctl returns a struct vifctl adding the interface with index ifindex as
+// virtual interface vifi.
+func vifctl(vifi uint16, ifindex int) []byte {
+	b := make([]byte, 16)
+	copy(b[0:], binaryutil.NativeEndian.PutUint16(vifi))
+	b[2] = viffUseIfindex // vifc_flags
+	b[3] = 1              // vifc_threshold (TTL)
+	copy(b[8:], binaryutil.NativeEndian.PutUint32(uint32(ifindex)))
+	return b
+}
+
+// parseUpcall parses a struct igmpmsg, which the kernel sends for traffic
+// without MFC entry. Its first 20 bytes overlay an IPv4 header, whose
+// protocol field (im_mbz) is zero, unlike for IGMP packets.
+func parseUpcall(b []byte) (vif int, source, group net.IP, ok bool) {
+	if len(b) < 20 || b[8] != igmpmsgNocache || b[9] != 0 {
+		return 0, nil, nil, false
+	}
+	vif = int(b[10]) | int(b[11])<<8 // im_vif, im_vif_hi
+	return vif, net.IP(append([]byte(nil), b[12:16]...)), net.IP(append([]byte(nil), b[16:20]...)), true
+}
+
+// Router holds the multicast routing socket.
+type Router struct {
+	routes []route
+	f      *os.File // for reading upcalls, fd in non-blocking mode
+	vifs   map[string]int
+	ifaces []int // ifindex by vif
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewRouter opens the multicast routing socket and adds the present
+// interfaces of cfg as virtual interfaces. Only one Router can exist at a
+// time.
+func NewRouter(cfg Config) (*Router, error) {
+	routes, err := parseRoutes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_IGMP)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{
+		routes: routes,
+		f:      os.NewFile(uintptr(fd), "mroute"),
+		vifs:   make(map[string]int),
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, mrtInit, 1); err != nil {
+		r.f.Close()
+		return nil, fmt.Errorf("MRT_INIT: %v", err)
+	}
+	for ifname, ifindex := range Interfaces(cfg) {
+		if len(r.ifaces) == maxVIFs {
+			r.f.Close()
+			return nil, fmt.Errorf("more than %d interfaces", maxVIFs)
+		}
+		vif := len(r.ifaces)
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_IP, mrtAddVIF, string(vifctl(uint16(vif), ifindex))); err != nil {
+			r.f.Close()
+			return nil, fmt.Errorf("MRT_ADD_VIF(%s): %v", ifname, err)
+		}
+		r.vifs[ifname] = vif
+		r.ifaces = append(r.ifaces, ifindex)
+	}
+	return r, nil
+}
+
+// addMFC installs the forwarding cache entry for traffic from source to
+// group via netlink. The entry is removed by the kernel once the multicast
+// routing socket is closed.
+func (r *Router) addMFC(rt *route, source, group net.IP) error {
+	from, ok := r.vifs[rt.from]
+	if !ok {
+		return fmt.Errorf("interface %s not present", rt.from)
+	}
+	// The kernel reads the TTL threshold of each virtual interface from the
+	// position of its next hop; 255 disables forwarding.
+	hops := make([]uint8, len(r.ifaces))
+	for i := range hops {
+		hops[i] = 255
+	}
+	for _, ifname := range rt.to {
+		if vif, ok := r.vifs[ifname]; ok {
+			hops[vif] = 1
+		}
+	}
+	var multipath []byte
+	for vif, ttl := range hops {
+		nh := &nl.RtNexthop{}
+		nh.Ifindex = int32(r.ifaces[vif])
+		nh.Hops = ttl
+		multipath = append(multipath, nh.Serialize()...)
+	}
+
+	req := nl.NewNetlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = rtnlFamilyIPMR
+	msg.Table = unix.RT_TABLE_DEFAULT
+	msg.Protocol = unix.RTPROT_MROUTED
+	msg.Type = unix.RTN_MULTICAST
+	msg.Src_len = 32
+	msg.Dst_len = 32
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(unix.RTA_SRC, source.To4()))
+	req.AddData(nl.NewRtAttr(unix.RTA_DST, group.To4()))
+	req.AddData(nl.NewRtAttr(unix.RTA_IIF, nl.Uint32Attr(uint32(r.ifaces[from]))))
+	req.AddData(nl.NewRtAttr(unix.RTA_MULTIPATH, multipath))
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// Serve installs forwarding cache entries for traffic matching a route until
+// the Router is closed.
+func (r *Router) Serve() error {
+	buf := make([]byte, 1500)
+	for {
+		n, err := r.f.Read(buf)
+		if err != nil {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		vif, source, group, ok := parseUpcall(buf[:n])
+		if !ok || vif >= len(r.ifaces) {
+			continue // e.g. an IGMP packet
+		}
+		var ifname string
+		for name, v := range r.vifs {
+			if v == vif {
+				ifname = name
+			}
+		}
+		rt := match(r.routes, ifname, source, group)
+		if rt == nil {
+			continue
+		}
+		if err := r.addMFC(rt, source, group); err != nil {
+			log.Printf("adding route %v → %v from %s: %v", source, group, ifname, err)
+			continue
+		}
+		log.Printf("forwarding %v → %v from %s to %s", source, group, ifname, strings.Join(rt.to, ", "))
+	}
+}
+
+// Close closes the multicast routing socket, which removes all virtual
+// interfaces and forwarding cache entries.
+func (r *Router) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mcroute
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	routes, err := parseRoutes(Config{
+		Routes: []Route{
+			{From: "lan0", To: []string{"lan0.10"}, Group: "239.255.255.250"},
+			{From: "uplink0", To: []string{"lan0.20"}, Group: "232.0.0.0/8", Source: "192.0.2.1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ifname, source, group string
+		want                  string // first outbound interface, empty for no match
+	}{
+		{"lan0", "192.168.42.23", "239.255.255.250", "lan0.10"},
+		{"lan0.10", "192.168.10.23", "239.255.255.250", ""},
+		{"lan0", "192.168.42.23", "239.255.255.251", ""},
+		{"uplink0", "192.0.2.1", "232.1.2.3", "lan0.20"},
+		{"uplink0", "192.0.2.2", "232.1.2.3", ""},
+	} {
+		r := match(routes, tt.ifname, net.ParseIP(tt.source), net.ParseIP(tt.group))
+		var got string
+		if r != nil {
+			got = r.to[0]
+		}
+		if got != tt.want {
+			t.Errorf("match(%s, %s → %s): got %q, want %q", tt.ifname, tt.source, tt.group, got, tt.want)
+		}
+	}
+
+	for _, r := range []Route{
+		{From: "lan0", To: []string{"lan0.10"}, Group: "192.168.42.1"},
+		{From: "lan0", Group: "239.255.255.250"},
+		{From: "lan0", To: []string{"lan0.10"}, Group: "239.255.255.250", Source: "2001:db8::1"},
+	} {
+		if _, err := parseRoutes(Config{Routes: []Route{r}}); err == nil {
+			t.Errorf("parseRoutes(%+v) unexpectedly succeeded", r)
+		}
+	}
+}
+
+func TestParseUpcall(t *testing.T) {
+	b := []byte{
+		0, 0, 0, 0, 0, 0, 0, 0, // unused
+		igmpmsgNocache, // im_msgtype
+		0,              // im_mbz
+		3, 0,           // im_vif, im_vif_hi
+		192, 0, 2, 1, // im_src
+		239, 255, 255, 250, // im_dst
+	}
+	vif, source, group, ok := parseUpcall(b)
+	if !ok {
+		t.Fatalf("parseUpcall: not an upcall")
+	}
+	if vif != 3 || source.String() != "192.0.2.1" || group.String() != "239.255.255.250" {
+		t.Errorf("parseUpcall: got vif %d, %v → %v", vif, source, group)
+	}
+
+	b[9] = 2 // IGMP packet
+	if _, _, _, ok := parseUpcall(b); ok {
+		t.Errorf("parseUpcall unexpectedly parsed an IGMP packet")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/ndp"
+	"github.com/mdlayher/raw"
+	"github.com/vishvananda/netlink"
+)
+
+// announcements is the number of gratuitous ARP packets (or unsolicited
+// neighbor advertisements) sent for a new address, announceInterval apart
+// (like ANNOUNCE_NUM and ANNOUNCE_INTERVAL of RFC 5227). The first
+// announcement is sent after announceInterval, too, so that IPv6 addresses
+// completed duplicate address detection.
+const (
+	announcements    = 2
+	announceInterval = 1 * time.Second
+)
+
+// garpPacket returns a gratuitous ARP request announcing that ip is at
+// hwaddr.
+func garpPacket(hwaddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       hwaddr,
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   hwaddr,
+			SourceProtAddress: ip.To4(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    ip.To4(),
+		})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func announceIPv4(iface *net.Interface, ip net.IP) error {
+	b, err := garpPacket(iface.HardwareAddr, ip)
+	if err != nil {
+		return err
+	}
+	conn, err := raw.ListenPacket(iface, syscall.ETH_P_ARP, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.WriteTo(b, &raw.Addr{HardwareAddr: layers.EthernetBroadcast})
+	return err
+}
+
+func announceIPv6(iface *net.Interface, ip net.IP) error {
+	conn, _, err := ndp.Dial(iface, ndp.LinkLocal)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	na := &ndp.NeighborAdvertisement{
+		Override:      true,
+		TargetAddress: ip,
+		Options: []ndp.Option{
+			&ndp.LinkLayerAddress{
+				Direction: ndp.Target,
+				Addr:      iface.HardwareAddr,
+			},
+		},
+	}
+	return conn.WriteTo(na, nil, net.IPv6linklocalallnodes)
+}
+
+// announceAddrs sends gratuitous ARP packets (IPv4) and unsolicited neighbor
+// advertisements (IPv6) for ips on ifname, so that clients update their
+// neighbor caches immediately, e.g. after the router was replaced or after a
+// failover. announceAddrs returns once all announcements were sent.
+func announceAddrs(ifname string, ips []net.IP) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		log.Printf("announce: %v", err)
+		return
+	}
+	for i := 0; i < announcements; i++ {
+		time.Sleep(announceInterval)
+		for _, ip := range ips {
+			announce := announceIPv6
+			if ip.To4() != nil {
+				announce = announceIPv4
+			}
+			if err := announce(iface, ip); err != nil {
+				log.Printf("announce %v on %s: %v", ip, ifname, err)
+			}
+		}
+	}
+}
+
+// newAddrs returns the IP addresses of want which are not in existing.
+func newAddrs(existing []netlink.Addr, want []*netlink.Addr) []net.IP {
+	var ips []net.IP
+	for _, w := range want {
+		var found bool
+		for _, e := range existing {
+			if e.IP.Equal(w.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ips = append(ips, w.IP)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/vishvananda/netlink"
+)
+
+func TestGARPPacket(t *testing.T) {
+	hwaddr := net.HardwareAddr{0x02, 0x73, 0x53, 0x00, 0xb0, 0x0c}
+	ip := net.ParseIP("192.168.42.1")
+	b, err := garpPacket(hwaddr, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
+	eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		t.Fatalf("no Ethernet layer in %x", b)
+	}
+	if got, want := eth.DstMAC.String(), "ff:ff:ff:ff:ff:ff"; got != want {
+		t.Errorf("destination: got %s, want %s", got, want)
+	}
+	arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		t.Fatalf("no ARP layer in %x", b)
+	}
+	if arp.Operation != layers.ARPRequest {
+		t.Errorf("operation: got %d, want request", arp.Operation)
+	}
+	if got := net.HardwareAddr(arp.SourceHwAddress); got.String() != hwaddr.String() {
+		t.Errorf("sender hardware address: got %v, want %v", got, hwaddr)
+	}
+	// A gratuitous ARP request has the same sender and target address.
+	for _, addr := range [][]byte{arp.SourceProtAddress, arp.DstProtAddress} {
+		if got := net.IP(addr); !got.Equal(ip) {
+			t.Errorf("protocol address: got %v, want %v", got, ip)
+		}
+	}
+}
+
+func TestNewAddrs(t *testing.T) {
+	parse := func(s string) *netlink.Addr {
+		addr, err := netlink.ParseAddr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	existing := []netlink.Addr{
+		*parse("192.168.42.1/24"),
+		*parse("fe80::73:53ff:fe00:b00c/64"),
+	}
+	want := []*netlink.Addr{
+		parse("192.168.42.1/24"),
+		parse("2a02:168:4a00::1/64"),
+	}
+	got := newAddrs(existing, want)
+	if diff := cmp.Diff([]net.IP{net.ParseIP("2a02:168:4a00::1")}, got); diff != "" {
+		t.Errorf("unexpected new addresses: (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// FirewallConfig is read from firewall.json.
+type FirewallConfig struct {
+	// AntiSpoofing drops packets with bogon source addresses arriving on the
+	// uplink and packets arriving on LAN-side interfaces (see lanNetworks)
+	// whose source address is neither within the interface network nor
+	// routed via it (see routes.json), and enables reverse path filtering.
+	AntiSpoofing bool `json:"anti_spoofing"`
+
+	// DNSRedirect are clients (MAC addresses, IPv4 addresses or networks)
+	// whose DNS traffic is redirected to the router, e.g. so that the
+	// per-client upstreams of dns.json cannot be bypassed.
+	DNSRedirect []string `json:"dns_redirect"`
+
+	// BlockEncryptedDNS are clients (as in DNSRedirect) whose DNS-over-TLS
+	// traffic and DNS-over-HTTPS traffic to known providers (see
+	// ReadDoHProviders) is dropped.
+	BlockEncryptedDNS []string `json:"block_encrypted_dns"`
+
+	// Interception delivers TCP connections of selected clients to a
+	// transparent proxy on the router.
+	Interception *InterceptionConfig `json:"interception"`
+
+	// Pinholes are the only new IPv6 connections from the internet which are
+	// forwarded to lan0, if set.
+	Pinholes []Pinhole `json:"pinholes"`
+}
+
+func readFirewallConfig(dir string) (FirewallConfig, error) {
+	var cfg FirewallConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "firewall.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// bogons4 are IPv4 networks which must not appear as source address on the
+// uplink (RFC 6890 special-purpose and unallocated address space).
+var bogons4 = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+}
+
+// bogons6 are the IPv6 equivalent of bogons4. Link-local addresses are
+// required for neighbor discovery and DHCPv6 and hence not included.
+var bogons6 = []string{
+	"::/128",
+	"::1/128",
+	"::ffff:0:0/96",
+	"2001:db8::/32",
+	"fc00::/7",
+	"ff00::/8",
+}
+
+// saddrExprs returns expressions comparing the source address of the packet
+// against network n.
+func saddrExprs(n *net.IPNet, op expr.CmpOp) []expr.Any {
+	return addrExprs(n, op, false)
+}
+
+// daddrExprs returns expressions comparing the destination address of the
+// packet against network n.
+func daddrExprs(n *net.IPNet, op expr.CmpOp) []expr.Any {
+	return addrExprs(n, op, true)
+}
+
+func addrExprs(n *net.IPNet, op expr.CmpOp, dst bool) []expr.Any {
+	offset, ip := uint32(12), n.IP.To4() // IPv4 header source address
+	if ip == nil || len(n.Mask) == net.IPv6len {
+		// IPv6 network (possibly IPv4-mapped, e.g. ::ffff:0:0/96)
+		offset, ip = 8, n.IP.To16() // IPv6 header source address
+	}
+	if dst {
+		offset += uint32(len(ip))
+	}
+	mask := []byte(n.Mask)
+	return []expr.Any{
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(ip)),
+		},
+		// [ bitwise reg 1 = (reg=1 & 0x0000ffff ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			DestRegister:   1,
+			SourceRegister: 1,
+			Len:            uint32(len(ip)),
+			Mask:           mask,
+			Xor:            make([]byte, len(ip)),
+		},
+		// [ cmp eq reg 1 0x0000a8c0 ]
+		&expr.Cmp{
+			Op:       op,
+			Register: 1,
+			Data:     ip.Mask(n.Mask),
+		},
+	}
+}
+
+func iifnameExprs(ifname string) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x6e616c00 ... ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     nfifname(ifname),
+		},
+	}
+}
+
+// uplinkAddr returns the IPv4 address of the uplink, if any. The address of
+// the DHCPv4 lease is preferred, as the firewall is built before the lease is
+// applied.
+func uplinkAddr(dir, ifname string) net.IP {
+	if ifname == "uplink0" {
+		_, addr, _, err := dhcp4Lease(filepath.Join(dir, "dhcp4/wire/lease.json"), ifname, 0)
+		if err == nil && addr != nil {
+			return addr.IP
+		}
+	}
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// lanNetwork is the IPv4 network of a LAN-side interface, with the
+// destinations of the static routes via that interface, i.e. the networks
+// which are routed behind LAN hosts.
+type lanNetwork struct {
+	ifname string
+	net    *net.IPNet
+	routed []*net.IPNet
+}
+
+// lanNetworks returns the LAN-side interfaces of interfaces.json in dir: those
+// with an IPv4 address which are neither uplinks nor tunnels (which carry
+// traffic from the networks of other sites).
+func lanNetworks(dir, uplink string) ([]lanNetwork, error) {
+	cfg, err := readInterfaceConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	tunnels, err := readTunnels(dir)
+	if err != nil {
+		return nil, err
+	}
+	wg, err := readWireGuard(dir)
+	if err != nil {
+		return nil, err
+	}
+	tunnel := make(map[string]bool)
+	for _, t := range tunnels.Tunnels {
+		tunnel[t.Name] = true
+	}
+	for _, iface := range wg.Interfaces {
+		tunnel[iface.Name] = true
+	}
+	routes, err := readRoutesConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var lans []lanNetwork
+	for _, details := range cfg.Interfaces {
+		if details.Addr == "" ||
+			details.Name == uplink ||
+			strings.HasPrefix(details.Name, "uplink") ||
+			tunnel[details.Name] {
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(details.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip.To4() == nil {
+			continue
+		}
+		lan := lanNetwork{ifname: details.Name, net: ipnet}
+		for _, sr := range routes.Routes {
+			_, dst, err := net.ParseCIDR(sr.Destination)
+			if err != nil || dst.IP.To4() == nil {
+				continue // invalid routes are reported by applyRoutes
+			}
+			gw := net.ParseIP(sr.Gateway)
+			if sr.Interface == details.Name || (gw != nil && ipnet.Contains(gw)) {
+				lan.routed = append(lan.routed, dst)
+			}
+		}
+		lans = append(lans, lan)
+	}
+	return lans, nil
+}
+
+// applyAntiSpoofing adds rules which drop packets with spoofed source
+// addresses, derived from the uplink and LAN-side interface roles.
+func applyAntiSpoofing(dir, uplink string, c *ruleset, filter4, filter6 *nftables.Table) error {
+	cfg, err := readFirewallConfig(dir)
+	if err != nil {
+		return err
+	}
+	lans, err := lanNetworks(dir, uplink)
+	if err != nil {
+		return err
+	}
+
+	// Strict reverse path filtering on the LAN, loose filtering on the uplink
+	// (so that asymmetric routing via backup uplinks keeps working). When
+	// disabled, the kernel default (no filtering) is restored.
+	lanFilter, uplinkFilter := "1", "2"
+	if !cfg.AntiSpoofing {
+		lanFilter, uplinkFilter = "0", "0"
+	}
+	var sysctls []string
+	for _, lan := range lans {
+		sysctls = append(sysctls, "net.ipv4.conf."+lan.ifname+".rp_filter="+lanFilter)
+	}
+	if uplink != "" {
+		sysctls = append(sysctls, "net.ipv4.conf."+uplink+".rp_filter="+uplinkFilter)
+	}
+	c.sysctls = append(c.sysctls, sysctls...)
+	if !cfg.AntiSpoofing {
+		return nil
+	}
+
+	// When behind another router (e.g. an ISP modem), the uplink address is
+	// within a bogon network, which must not be dropped.
+	own := uplinkAddr(dir, uplink)
+
+	for _, t := range []struct {
+		table  *nftables.Table
+		bogons []string
+	}{
+		{filter4, bogons4},
+		{filter6, bogons6},
+	} {
+		prerouting := c.AddChain(&nftables.Chain{
+			Name:     "antispoof",
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityRaw,
+			Table:    t.table,
+			Type:     nftables.ChainTypeFilter,
+		})
+
+		if uplink != "" {
+			for _, bogon := range t.bogons {
+				_, n, err := net.ParseCIDR(bogon)
+				if err != nil {
+					return err
+				}
+				// own is an IPv4 address, which net.IPNet.Contains
+				// also finds in ::ffff:0:0/96.
+				if own != nil && t.table == filter4 && n.Contains(own) {
+					continue
+				}
+				exprs := iifnameExprs(uplink)
+				exprs = append(exprs, saddrExprs(n, expr.CmpOpEq)...)
+				exprs = append(exprs,
+					// [ immediate reg 0 drop ]
+					&expr.Verdict{Kind: expr.VerdictDrop})
+				c.AddRule(&nftables.Rule{
+					Table: t.table,
+					Chain: prerouting,
+					Exprs: exprs,
+				})
+			}
+		}
+
+		if t.table != filter4 {
+			// The LAN IPv6 prefix is delegated dynamically; reverse path
+			// filtering is left to the kernel’s routing decision.
+			continue
+		}
+		// DHCP clients use source address 0.0.0.0 before obtaining a lease.
+		unspecified := &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(32, 32)}
+		for _, lan := range lans {
+			exprs := iifnameExprs(lan.ifname)
+			for _, n := range append([]*net.IPNet{lan.net, unspecified}, lan.routed...) {
+				exprs = append(exprs, saddrExprs(n, expr.CmpOpNeq)...)
+			}
+			exprs = append(exprs,
+				// [ immediate reg 0 drop ]
+				&expr.Verdict{Kind: expr.VerdictDrop})
+			c.AddRule(&nftables.Rule{
+				Table: t.table,
+				Chain: prerouting,
+				Exprs: exprs,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestAddrExprs(t *testing.T) {
+	for _, tt := range []struct {
+		network    string
+		dst        bool
+		wantOffset uint32
+		wantMask   []byte
+		wantData   net.IP
+	}{
+		{
+			network:    "10.0.0.0/8",
+			wantOffset: 12,
+			wantMask:   []byte{0xff, 0, 0, 0},
+			wantData:   net.IP{10, 0, 0, 0},
+		},
+		{
+			network:    "192.168.42.0/24",
+			dst:        true,
+			wantOffset: 16,
+			wantMask:   []byte{0xff, 0xff, 0xff, 0},
+			wantData:   net.IP{192, 168, 42, 0},
+		},
+		{
+			network:    "2001:db8::/32",
+			wantOffset: 8,
+			wantMask:   net.CIDRMask(32, 128),
+			wantData:   net.ParseIP("2001:db8::"),
+		},
+		{
+			network:    "fc00::/7",
+			dst:        true,
+			wantOffset: 24,
+			wantMask:   net.CIDRMask(7, 128),
+			wantData:   net.ParseIP("fc00::"),
+		},
+		{
+			// IPv4-mapped IPv6 addresses are matched in the IPv6 header
+			// with their full 16 bytes, not as IPv4 addresses.
+			network:    "::ffff:0:0/96",
+			wantOffset: 8,
+			wantMask:   net.CIDRMask(96, 128),
+			wantData:   net.ParseIP("::ffff:0:0").To16(),
+		},
+	} {
+		_, n, err := net.ParseCIDR(tt.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exprs := addrExprs(n, expr.CmpOpEq, tt.dst)
+		want := []expr.Any{
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       tt.wantOffset,
+				Len:          uint32(len(tt.wantData)),
+			},
+			&expr.Bitwise{
+				DestRegister:   1,
+				SourceRegister: 1,
+				Len:            uint32(len(tt.wantData)),
+				Mask:           tt.wantMask,
+				Xor:            make([]byte, len(tt.wantData)),
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte(tt.wantData),
+			},
+		}
+		if diff := cmp.Diff(want, exprs); diff != "" {
+			t.Errorf("addrExprs(%s, dst=%v): diff (-want +got):\n%s", tt.network, tt.dst, diff)
+		}
+	}
+}
+
+func TestAntiSpoofing(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}, PeerName: "uplink0-peer"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for fn, content := range map[string]string{
+		"firewall.json": `{"anti_spoofing": true}`,
+		"interfaces.json": `{"interfaces": [
+  {"name": "lan0", "addr": "192.168.42.1/24"},
+  {"name": "lan1", "addr": "10.10.0.1/24"},
+  {"name": "gre0", "addr": "10.0.138.1/30"}
+]}`,
+		"tunnels.json": `{"tunnels": [{"name": "gre0", "type": "gre", "local": "10.0.137.1", "remote": "10.0.137.2"}]}`,
+		// Networks behind LAN hosts, which must not be dropped.
+		"routes.json": `{"routes": [
+  {"destination": "10.23.0.0/16", "gateway": "192.168.42.2"},
+  {"destination": "172.16.5.0/24", "interface": "lan1"},
+  {"destination": "10.99.0.0/16", "gateway": "10.0.138.2"}
+]}`,
+		// Behind an ISP modem, the uplink address is in a bogon network.
+		"dhcp4/wire/lease.json": `{"client_ip": "192.168.1.23", "subnet_mask": "255.255.255.0", "router": "192.168.1.1"}`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, fn)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := buildFirewall(tmp, "uplink0", identityCounters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rs.export(&buf)
+	got := buf.String()
+	for _, want := range []string{
+		`iifname "uplink0" ip saddr 10.0.0.0/8 drop`,
+		`iifname "uplink0" ip saddr 127.0.0.0/8 drop`,
+		`iifname "uplink0" ip6 saddr ::1 drop`,
+		`iifname "uplink0" ip6 saddr ::ffff:0.0.0.0/96 drop`,
+		`iifname "uplink0" ip6 saddr fc00::/7 drop`,
+		`iifname "lan0" ip saddr != 192.168.42.0/24 ip saddr != 0.0.0.0 ip saddr != 10.23.0.0/16 drop`,
+		`iifname "lan1" ip saddr != 10.10.0.0/24 ip saddr != 0.0.0.0 ip saddr != 172.16.5.0/24 drop`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("export does not contain %q", want)
+		}
+	}
+	// The network of the uplink address is not dropped.
+	if notWant := `ip saddr 192.168.0.0/16 drop`; strings.Contains(got, notWant) {
+		t.Errorf("export unexpectedly contains %q", notWant)
+	}
+	// Tunnels carry traffic from the networks of other sites.
+	if notWant := `iifname "gre0"`; strings.Contains(got, notWant) {
+		t.Errorf("export unexpectedly contains %q", notWant)
+	}
+	// Link-local addresses are required for neighbor discovery.
+	if notWant := `ip6 saddr fe80::/10`; strings.Contains(got, notWant) {
+		t.Errorf("export unexpectedly contains %q", notWant)
+	}
+	if t.Failed() {
+		t.Logf("export:\n%s", got)
+	}
+
+	wantSysctls := []string{
+		"net.ipv4.conf.lan0.rp_filter=1",
+		"net.ipv4.conf.lan1.rp_filter=1",
+		"net.ipv4.conf.uplink0.rp_filter=2",
+	}
+	if diff := cmp.Diff(wantSysctls, rs.sysctls); diff != "" {
+		t.Errorf("sysctls: diff (-want +got):\n%s", diff)
+	}
+
+	// Disabling anti-spoofing restores reverse path filtering to the kernel
+	// default.
+	if err := ioutil.WriteFile(filepath.Join(tmp, "firewall.json"), []byte(`{"anti_spoofing": false}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err = buildFirewall(tmp, "uplink0", identityCounters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSysctls = []string{
+		"net.ipv4.conf.lan0.rp_filter=0",
+		"net.ipv4.conf.lan1.rp_filter=0",
+		"net.ipv4.conf.uplink0.rp_filter=0",
+	}
+	if diff := cmp.Diff(wantSysctls, rs.sysctls); diff != "" {
+		t.Errorf("sysctls: diff (-want +got):\n%s", diff)
+	}
+	buf.Reset()
+	rs.export(&buf)
+	if notWant := `iifname "lan0" ip saddr`; strings.Contains(buf.String(), notWant) {
+		t.Errorf("export unexpectedly contains %q", notWant)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/trace"
+)
+
+// Names of the built-in steps of Apply, in order. Appliers can be
+// ordered after any of them (see Applier.After).
+const (
+	StepInterfaces = "interfaces" // link names, MTU, addresses from interfaces.json
+	StepFirewall   = "firewall"
+	StepSysctl     = "sysctl"
+	StepUp         = "up"        // links from interfaces.json are set up
+	StepNeighbors  = "neighbors" // static neighbor bindings
+	StepLinks      = "links"     // addresses and routes (DHCPv4, DHCPv6)
+	StepWireGuard  = "wireguard"
+	StepMTU        = "mtu"
+	StepQoS        = "qos" // traffic shaping from qos.json
+)
+
+// Applier is an additional apply step, e.g. for a custom tunnel type.
+// Appliers are registered via RegisterApplier, typically from an init
+// function in a file added to cmd/netconfigd.
+type Applier struct {
+	// Name identifies the step in errors and can be referred to by the After
+	// field of other steps.
+	Name string
+
+	// After is the name of the step (built-in or registered) after which
+	// this step runs. If empty, the step runs after all built-in steps.
+	After string
+
+	// Apply configures the kernel according to the configuration in dir.
+	// Errors are reported like errors of the built-in steps, i.e. they make
+	// Apply fail after all remaining steps ran.
+	Apply func(dir string) error
+
+	// Feature, if set, marks the step as experimental (e.g. “flowtable”,
+	// “xdp” or “nat64”): it only runs while the feature flag of this name is
+	// enabled in features.json, and it is disabled automatically when it
+	// keeps failing (see FeatureFlag).
+	Feature string
+}
+
+var (
+	stepsMu sync.Mutex
+	steps   []Applier
+)
+
+// RegisterApplier registers s to be run by Apply. It panics if s has no name or
+// if an applier with the same name was already registered.
+func RegisterApplier(s Applier) {
+	stepsMu.Lock()
+	defer stepsMu.Unlock()
+	if s.Name == "" || s.Apply == nil {
+		panic("netconfig: RegisterApplier: Name and Apply must be set")
+	}
+	for _, other := range steps {
+		if other.Name == s.Name {
+			panic(fmt.Sprintf("netconfig: RegisterApplier called twice for %q", s.Name))
+		}
+	}
+	steps = append(steps, s)
+}
+
+// stepRunner runs the registered steps as their predecessors complete.
+type stepRunner struct {
+	dir         string
+	appendError func(error)
+	steps       []Applier
+	ran         map[string]bool
+	features    *features
+
+	// span is the span of Apply, whose steps are recorded as child spans
+	// covering the time since the previous step completed.
+	span *trace.Span
+	last time.Time
+	errs []error // errors of the current step
+}
+
+func newStepRunner(dir string, appendError func(error), features *features) *stepRunner {
+	stepsMu.Lock()
+	defer stepsMu.Unlock()
+	return &stepRunner{
+		dir:         dir,
+		appendError: appendError,
+		features:    features,
+		steps:       append([]Applier(nil), steps...),
+		ran:         make(map[string]bool),
+	}
+}
+
+// failed records err as an error of the current step. r may be nil.
+func (r *stepRunner) failed(err error) {
+	if r == nil {
+		return
+	}
+	r.errs = append(r.errs, err)
+}
+
+// done marks the step name as completed and runs the registered steps which
+// are ordered after it, in registration order.
+func (r *stepRunner) done(name string) {
+	span := trace.StartAt(r.span, name, r.last)
+	if len(r.errs) > 0 {
+		span.SetError(fmt.Errorf("%v", r.errs))
+	}
+	span.End()
+	r.errs = nil
+	r.last = time.Now()
+	r.ran[name] = true
+	for _, s := range r.steps {
+		if s.After != name || r.ran[s.Name] {
+			continue
+		}
+		r.run(s)
+	}
+}
+
+func (r *stepRunner) run(s Applier) {
+	if err := r.apply(s); err != nil {
+		r.appendError(fmt.Errorf("%s: %v", s.Name, err))
+	}
+	r.done(s.Name)
+}
+
+func (r *stepRunner) apply(s Applier) error {
+	if s.Feature == "" {
+		return s.Apply(r.dir)
+	}
+	if r.features == nil || !r.features.enabled(s.Feature) {
+		return nil // steps ordered after s still run
+	}
+	return r.features.run(s, r.dir)
+}
+
+// finish runs the steps without predecessor, followed by all steps whose
+// predecessor does not exist.
+func (r *stepRunner) finish() {
+	for _, s := range r.steps {
+		if s.After == "" && !r.ran[s.Name] {
+			r.run(s)
+		}
+	}
+	for _, s := range r.steps {
+		if r.ran[s.Name] {
+			continue
+		}
+		log.Printf("step %s: unknown predecessor %q, running last", s.Name, s.After)
+		r.run(s)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApplierOrder(t *testing.T) {
+	var order []string
+	step := func(name, after string) Applier {
+		return Applier{
+			Name:  name,
+			After: after,
+			Apply: func(dir string) error {
+				order = append(order, name)
+				if name == "failing" {
+					return fmt.Errorf("failed")
+				}
+				return nil
+			},
+		}
+	}
+	var errors []error
+	r := &stepRunner{
+		dir: "/perm",
+		appendError: func(err error) {
+			errors = append(errors, err)
+		},
+		steps: []Applier{
+			step("last", ""),
+			step("tunnel-routes", "tunnel"),
+			step("tunnel", StepLinks),
+			step("orphan", "nonexistent"),
+			step("failing", StepFirewall),
+		},
+		ran: make(map[string]bool),
+	}
+	for _, name := range []string{StepInterfaces, StepFirewall, StepSysctl, StepUp, StepNeighbors, StepLinks, StepWireGuard, StepMTU, StepQoS} {
+		order = append(order, name)
+		r.done(name)
+	}
+	r.finish()
+
+	want := []string{
+		StepInterfaces,
+		StepFirewall,
+		"failing",
+		StepSysctl,
+		StepUp,
+		StepNeighbors,
+		StepLinks,
+		"tunnel",
+		"tunnel-routes",
+		StepWireGuard,
+		StepMTU,
+		StepQoS,
+		"last",
+		"orphan",
+	}
+	if diff := cmp.Diff(want, order); diff != "" {
+		t.Errorf("unexpected step order: (-want +got)\n%s", diff)
+	}
+	if got, want := fmt.Sprint(errors), "[failing: failed]"; got != want {
+		t.Errorf("unexpected errors: got %s, want %s", got, want)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	flags := `{"flowtable": {"enabled": true, "max_failures": 2}, "nat64": {"enabled": false}}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "features.json"), []byte(flags), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	var (
+		ran     []string
+		failing = true
+	)
+	step := func(name, feature string) Applier {
+		return Applier{
+			Name:    name,
+			After:   StepLinks,
+			Feature: feature,
+			Apply: func(dir string) error {
+				ran = append(ran, name)
+				if failing && name == "flowtable" {
+					panic("nil pointer dereference")
+				}
+				return nil
+			},
+		}
+	}
+	apply := func() []error {
+		t.Helper()
+		var errors []error
+		appendError := func(err error) { errors = append(errors, err) }
+		features, err := loadFeatures(tmp, func() time.Time { return now })
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &stepRunner{
+			dir:         tmp,
+			appendError: appendError,
+			steps: []Applier{
+				step("flowtable", "flowtable"),
+				step("nat64", "nat64"),
+				step("stable", ""),
+			},
+			ran:      make(map[string]bool),
+			features: features,
+		}
+		r.done(StepLinks)
+		return errors
+	}
+	health := func() []FeatureHealth {
+		t.Helper()
+		health, err := ReadFeatureHealth(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return health
+	}
+
+	// A panic of an experimental step is recovered and counts as failure.
+	if got, want := fmt.Sprint(apply()), "[flowtable: panic: nil pointer dereference]"; got != want {
+		t.Errorf("unexpected errors: got %s, want %s", got, want)
+	}
+	if diff := cmp.Diff([]string{"flowtable", "stable"}, ran); diff != "" {
+		t.Errorf("unexpected steps: (-want +got)\n%s", diff)
+	}
+	want := []FeatureHealth{
+		{Name: "flowtable", Failures: 1, LastError: "panic: nil pointer dereference"},
+	}
+	if diff := cmp.Diff(want, health()); diff != "" {
+		t.Errorf("unexpected health: (-want +got)\n%s", diff)
+	}
+
+	// A crash of netconfigd while running the step (i.e. the feature is
+	// still marked as running) is detected by the next Apply, and disables
+	// the feature after max_failures.
+	failing = false
+	crashed := map[string]*FeatureHealth{
+		"flowtable": {Name: "flowtable", Failures: 1, Running: true},
+	}
+	if err := writeFeatureHealth(tmp, crashed); err != nil {
+		t.Fatal(err)
+	}
+	ran = nil
+	if errors := apply(); len(errors) > 0 {
+		t.Errorf("unexpected errors: %v", errors)
+	}
+	if diff := cmp.Diff([]string{"stable"}, ran); diff != "" {
+		t.Errorf("unexpected steps: (-want +got)\n%s", diff)
+	}
+	want = []FeatureHealth{
+		{
+			Name:      "flowtable",
+			Failures:  2,
+			LastError: "netconfigd crashed while running the step",
+			Disabled:  true,
+			Since:     now,
+		},
+	}
+	if diff := cmp.Diff(want, health()); diff != "" {
+		t.Errorf("unexpected health: (-want +got)\n%s", diff)
+	}
+
+	// Once reset, the feature runs again and its health is tracked anew.
+	if ok, err := ResetFeature(tmp, "flowtable"); err != nil || !ok {
+		t.Fatalf("ResetFeature = %v, %v; want true, nil", ok, err)
+	}
+	ran = nil
+	if errors := apply(); len(errors) > 0 {
+		t.Errorf("unexpected errors: %v", errors)
+	}
+	if diff := cmp.Diff([]string{"flowtable", "stable"}, ran); diff != "" {
+		t.Errorf("unexpected steps: (-want +got)\n%s", diff)
+	}
+	want = []FeatureHealth{{Name: "flowtable"}}
+	if diff := cmp.Diff(want, health()); diff != "" {
+		t.Errorf("unexpected health: (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// routeBatchSize is the number of route requests sent in one sendmsg(2). The
+// kernel processes all messages of a batch in one go, which saves a system
+// call and a round trip per route when installing thousands of routes (e.g.
+// the AllowedIPs of a VPN peer).
+const routeBatchSize = 256
+
+// routeRequest returns an RTM_NEWROUTE (replace) or RTM_DELROUTE request for
+// r, encoding the route attributes like netlink.RouteReplace and
+// netlink.RouteDel do for the routes which router7 installs.
+func routeRequest(proto int, r *netlink.Route) (*nl.NetlinkRequest, error) {
+	var (
+		req *nl.NetlinkRequest
+		msg *nl.RtMsg
+	)
+	switch proto {
+	case unix.RTM_NEWROUTE:
+		req = nl.NewNetlinkRequest(proto, unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+		msg = nl.NewRtMsg()
+	case unix.RTM_DELROUTE:
+		req = nl.NewNetlinkRequest(proto, unix.NLM_F_ACK)
+		msg = nl.NewRtDelMsg()
+	default:
+		return nil, fmt.Errorf("unsupported request type %d", proto)
+	}
+	var family int
+	switch {
+	case r.Dst != nil && r.Dst.IP != nil:
+		family = nl.GetIPFamily(r.Dst.IP)
+	case r.Gw != nil:
+		family = nl.GetIPFamily(r.Gw) // default route
+	default:
+		return nil, fmt.Errorf("one of Dst.IP or Gw must not be nil")
+	}
+	addr := func(ip net.IP) []byte {
+		if family == netlink.FAMILY_V4 {
+			return ip.To4()
+		}
+		return ip.To16()
+	}
+	var attrs []*nl.RtAttr
+	if r.Dst != nil && r.Dst.IP != nil {
+		ones, _ := r.Dst.Mask.Size()
+		msg.Dst_len = uint8(ones)
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_DST, addr(r.Dst.IP)))
+	}
+	if r.Src != nil {
+		if nl.GetIPFamily(r.Src) != family {
+			return nil, fmt.Errorf("source and destination are not the same address family")
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PREFSRC, addr(r.Src)))
+	}
+	if r.Gw != nil {
+		if nl.GetIPFamily(r.Gw) != family {
+			return nil, fmt.Errorf("gateway and destination are not the same address family")
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_GATEWAY, addr(r.Gw)))
+	}
+	if r.Table > 0 {
+		if r.Table >= 256 {
+			msg.Table = unix.RT_TABLE_UNSPEC
+			attrs = append(attrs, nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(r.Table))))
+		} else {
+			msg.Table = uint8(r.Table)
+		}
+	}
+	if r.Priority > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(r.Priority))))
+	}
+	if r.Protocol > 0 {
+		msg.Protocol = uint8(r.Protocol)
+	}
+	if r.Type > 0 {
+		msg.Type = uint8(r.Type)
+	}
+	msg.Flags = uint32(r.Flags)
+	msg.Scope = uint8(r.Scope)
+	msg.Family = uint8(family)
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	req.AddData(nl.NewRtAttr(unix.RTA_OIF, nl.Uint32Attr(uint32(r.LinkIndex))))
+	return req, nil
+}
+
+// batchRoutes sends an RTM_NEWROUTE (replace) or RTM_DELROUTE request (see
+// proto) for each of routes in batches of routeBatchSize and returns an error
+// for each failed request.
+func batchRoutes(proto int, routes []*netlink.Route) []error {
+	if len(routes) == 0 {
+		return nil
+	}
+	verb := "RouteReplace"
+	if proto == unix.RTM_DELROUTE {
+		verb = "RouteDel"
+	}
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return []error{err}
+	}
+	defer unix.Close(fd)
+	kernel := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for len(routes) > 0 {
+		batch := routes
+		if len(batch) > routeBatchSize {
+			batch = batch[:routeBatchSize]
+		}
+		routes = routes[len(batch):]
+
+		var buf []byte
+		pending := make(map[uint32]*netlink.Route, len(batch))
+		for _, r := range batch {
+			req, err := routeRequest(proto, r)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s(%v): %v", verb, r.Dst, err))
+				continue
+			}
+			buf = append(buf, req.Serialize()...)
+			pending[req.Seq] = r
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		if err := unix.Sendto(fd, buf, 0, kernel); err != nil {
+			return append(errs, fmt.Errorf("%s: sendto: %v", verb, err))
+		}
+		rb := make([]byte, 32*1024)
+		for len(pending) > 0 {
+			n, _, err := unix.Recvfrom(fd, rb, 0)
+			if err != nil {
+				return append(errs, fmt.Errorf("%s: recvfrom: %v", verb, err))
+			}
+			msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+			if err != nil {
+				return append(errs, fmt.Errorf("%s: %v", verb, err))
+			}
+			for _, m := range msgs {
+				r, ok := pending[m.Header.Seq]
+				if !ok || m.Header.Type != unix.NLMSG_ERROR {
+					continue
+				}
+				delete(pending, m.Header.Seq)
+				if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+					errs = append(errs, fmt.Errorf("%s(%v): %v", verb, r.Dst, syscall.Errno(-errno)))
+				}
+			}
+		}
+	}
+	return errs
+}
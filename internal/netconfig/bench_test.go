@@ -0,0 +1,210 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Apply runs on every lease renewal, so building and reconciling large
+// configurations must stay cheap. Run the benchmarks using:
+//
+//	go test -run=^$ -bench=. -benchmem ./internal/netconfig
+//
+// The benchmarks which modify the kernel state run in a new network namespace
+// (requiring root privileges) and are skipped otherwise.
+
+// writePortForwardings writes n port forwardings, resulting in n rules.
+func writePortForwardings(tb testing.TB, dir string, n int) {
+	tb.Helper()
+	var cfg portForwardings
+	for i := 0; i < n; i++ {
+		cfg.Forwardings = append(cfg.Forwardings, PortForwarding{
+			Proto:    "tcp",
+			Port:     fmt.Sprint(1024 + i),
+			DestAddr: fmt.Sprintf("192.168.%d.%d", 42+i/250, 2+i%250),
+			DestPort: "80",
+		})
+	}
+	b, err := json.Marshal(&cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "portforwardings.json"), b, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func identityCounters(o *nftables.CounterObj) *nftables.CounterObj { return o }
+
+func BenchmarkBuildFirewall(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writePortForwardings(b, tmp, 10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := buildFirewall(tmp, "uplink0", identityCounters); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSimulate(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writePortForwardings(b, tmp, 10000)
+	p := Packet{
+		IIfName: "uplink0",
+		OIfName: "lan0",
+		Src:     net.ParseIP("203.0.113.1"),
+		Dst:     net.ParseIP("198.51.100.1"),
+		Proto:   unix.IPPROTO_TCP,
+		DstPort: 65000, // not forwarded: all rules are evaluated
+		SYN:     true,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Simulate(tmp, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// allocsPerForwarding is the allocation budget of buildFirewall per port
+// forwarding. Exceeding it likely means that a change regressed Apply
+// latency for large configurations.
+const allocsPerForwarding = 40
+
+func TestBuildFirewallAllocs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	const n = 1000
+	writePortForwardings(t, tmp, n)
+
+	allocs := testing.AllocsPerRun(5, func() {
+		if _, err := buildFirewall(tmp, "uplink0", identityCounters); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got := allocs / n; got > allocsPerForwarding {
+		t.Errorf("buildFirewall: %.1f allocations per port forwarding, want <= %d", got, allocsPerForwarding)
+	}
+}
+
+// inNewNetNS moves the calling goroutine into a new network namespace. The
+// goroutine stays locked to its OS thread, which is terminated once the
+// goroutine exits, so that no other goroutine runs in the namespace.
+func inNewNetNS(b *testing.B) {
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		b.Skipf("unshare(CLONE_NEWNET): %v", err)
+	}
+}
+
+// BenchmarkApplyFirewall uses a smaller ruleset than the other benchmarks:
+// the vendored nftables package sends the whole ruleset in one netlink
+// batch, which fails (EMSGSIZE or ENOBUFS) for a few hundred rules.
+func BenchmarkApplyFirewall(b *testing.B) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writePortForwardings(b, tmp, 100)
+	rs, err := buildFirewall(tmp, "uplink0", identityCounters)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	inNewNetNS(b)
+	c := &nftables.Conn{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rs.apply(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplyRoutes(b *testing.B) {
+	inNewNetNS(b)
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}}); err != nil {
+		b.Skipf("adding dummy link: %v", err)
+	}
+	link, err := netlink.LinkByName("uplink0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		b.Fatal(err)
+	}
+	addr, err := netlink.ParseAddr("10.0.0.2/8")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ls := linkState{
+		source: "benchmark",
+		ifname: "uplink0",
+		addrs:  []*netlink.Addr{addr},
+	}
+	for i := 0; i < 1000; i++ {
+		ls.routes = append(ls.routes, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   net.IPv4(172, 16+byte(i/256), byte(i%256), 0),
+				Mask: net.CIDRMask(24, 32),
+			},
+			Gw: net.ParseIP("10.0.0.1"),
+		})
+	}
+	h, err := netlink.NewHandle()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Delete()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ls.apply(h, ls.addrs, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
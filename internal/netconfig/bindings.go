@@ -0,0 +1,268 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+)
+
+// Binding pins an IP address to a hardware address on lan0.
+type Binding struct {
+	HardwareAddr string `json:"hardware_addr"` // e.g. 00:1f:16:31:73:75
+	Addr         string `json:"addr"`          // e.g. 192.168.42.23 or 2a02:168:4a00::23
+
+	// Token is the IPv6 interface identifier (e.g. ::23) which the host uses
+	// within the delegated prefix on lan0 (e.g. via ip token set ::23 dev
+	// eth0). The binding then follows prefix changes: it pins prefix::token,
+	// which dnsd also resolves the host’s name to. Addr may be empty.
+	Token string `json:"token"`
+
+	// Enforce drops traffic from Addr which does not originate from
+	// HardwareAddr, and ARP packets claiming Addr from other hardware
+	// addresses.
+	Enforce bool `json:"enforce"`
+}
+
+type bindingsConfig struct {
+	Bindings []Binding `json:"bindings"`
+}
+
+type parsedBinding struct {
+	Binding
+	hwaddr net.HardwareAddr
+	ip     net.IP
+	token  bool // ip was derived from Token
+}
+
+func readBindings(dir string) ([]parsedBinding, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "bindings.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg bindingsConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	var prefix *net.IPNet
+	addrs, err := dhcp6Addrs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 0 {
+		prefix = addrs[0].IPNet
+	}
+	parsed := make([]parsedBinding, 0, len(cfg.Bindings))
+	for _, b := range cfg.Bindings {
+		hwaddr, err := net.ParseMAC(b.HardwareAddr)
+		if err != nil {
+			return nil, err
+		}
+		if b.Addr != "" || b.Token == "" {
+			ip := net.ParseIP(b.Addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", b.Addr)
+			}
+			parsed = append(parsed, parsedBinding{Binding: b, hwaddr: hwaddr, ip: ip})
+		}
+		if b.Token != "" {
+			token := net.ParseIP(b.Token)
+			if token == nil || token.To4() != nil || !token.Mask(net.CIDRMask(64, 128)).IsUnspecified() {
+				return nil, fmt.Errorf("invalid token %q, expected e.g. ::23", b.Token)
+			}
+			if prefix == nil {
+				continue // dhcp6 might not have obtained a lease yet
+			}
+			parsed = append(parsed, parsedBinding{
+				Binding: b,
+				hwaddr:  hwaddr,
+				ip:      tokenAddr(prefix, token),
+				token:   true,
+			})
+		}
+	}
+	return parsed, nil
+}
+
+// tokenAddr returns the address with the network bits of prefix and the
+// interface identifier token.
+func tokenAddr(prefix *net.IPNet, token net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	network := prefix.IP.To16().Mask(net.CIDRMask(64, 128))
+	for i := range ip {
+		ip[i] = network[i] | token[i]
+	}
+	return ip
+}
+
+// TokenAddrs returns the current lan0 address of each binding with a Token,
+// keyed by hardware address (e.g. 00:1f:16:31:73:75).
+func TokenAddrs(dir string) (map[string]net.IP, error) {
+	bindings, err := readBindings(dir)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]net.IP)
+	for _, b := range bindings {
+		if b.token {
+			addrs[b.hwaddr.String()] = b.ip
+		}
+	}
+	return addrs, nil
+}
+
+// neighbors returns the bindings as permanent entries for the kernel neighbor
+// (ARP/NDP) table of lan0.
+func neighbors(dir string) ([]*netlink.Neigh, error) {
+	bindings, err := readBindings(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(bindings) == 0 {
+		return nil, nil
+	}
+	lan, err := netlink.LinkByName("lan0")
+	if err != nil {
+		return nil, err
+	}
+	var neighs []*netlink.Neigh
+	for _, b := range bindings {
+		family := netlink.FAMILY_V6
+		if b.ip.To4() != nil {
+			family = netlink.FAMILY_V4
+		}
+		neighs = append(neighs, &netlink.Neigh{
+			LinkIndex:    lan.Attrs().Index,
+			Family:       family,
+			State:        netlink.NUD_PERMANENT,
+			IP:           b.ip,
+			HardwareAddr: b.hwaddr,
+		})
+	}
+	return neighs, nil
+}
+
+// applyBindings drops forwarded traffic from enforced binding addresses
+// which does not originate from the bound hardware address.
+func applyBindings(dir string, c *ruleset, filter *nftables.Table, forward *nftables.Chain) error {
+	bindings, err := readBindings(dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		if !b.Enforce {
+			continue
+		}
+		if (b.ip.To4() != nil) != (filter.Family == nftables.TableFamilyIPv4) {
+			continue // address belongs to the other table
+		}
+		bits := 128
+		if b.ip.To4() != nil {
+			bits = 32
+		}
+		exprs := iifnameExprs("lan0")
+		exprs = append(exprs, saddrExprs(&net.IPNet{IP: b.ip, Mask: net.CIDRMask(bits, bits)}, expr.CmpOpEq)...)
+		exprs = append(exprs, etherSaddrExprs(b.hwaddr)...)
+		// etherSaddrExprs compares for equality, invert the final comparison
+		exprs[len(exprs)-1].(*expr.Cmp).Op = expr.CmpOpNeq
+		exprs = append(exprs,
+			// [ immediate reg 0 drop ]
+			&expr.Verdict{Kind: expr.VerdictDrop})
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: forward,
+			Exprs: exprs,
+		})
+	}
+	return nil
+}
+
+// applyARPBindings drops ARP packets on lan0 which claim an enforced binding
+// address from a different hardware address (ARP spoofing).
+func applyARPBindings(dir string, c *ruleset) error {
+	bindings, err := readBindings(dir)
+	if err != nil {
+		return err
+	}
+	var enforced []parsedBinding
+	for _, b := range bindings {
+		if b.Enforce && b.ip.To4() != nil {
+			enforced = append(enforced, b)
+		}
+	}
+	if len(enforced) == 0 {
+		return nil
+	}
+	arp := c.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyARP,
+		Name:   "filter",
+	})
+	input := c.AddChain(&nftables.Chain{
+		Name:     "input",
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Table:    arp,
+		Type:     nftables.ChainTypeFilter,
+	})
+	for _, b := range enforced {
+		exprs := iifnameExprs("lan0")
+		exprs = append(exprs,
+			// [ payload load 4b @ network header + 14 => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       14, // sender protocol address
+				Len:          4,
+			},
+			// [ cmp eq reg 1 0x172aa8c0 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     b.ip.To4(),
+			},
+			// [ payload load 6b @ network header + 8 => reg 1 ]
+			&expr.Payload{
+				DestRegister: 1,
+				Base:         expr.PayloadBaseNetworkHeader,
+				Offset:       8, // sender hardware address
+				Len:          6,
+			},
+			// [ cmp neq reg 1 0x16001f00 0x00007573 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     []byte(b.hwaddr),
+			},
+			// [ immediate reg 0 drop ]
+			&expr.Verdict{Kind: expr.VerdictDrop})
+		c.AddRule(&nftables.Rule{
+			Table: arp,
+			Chain: input,
+			Exprs: exprs,
+		})
+	}
+	return nil
+}
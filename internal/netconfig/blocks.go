@@ -0,0 +1,294 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/renameio"
+	"golang.org/x/sys/unix"
+)
+
+// Block prevents forwarding traffic from and to a client.
+type Block struct {
+	Addr         string    `json:"addr"`          // e.g. 192.168.42.23
+	HardwareAddr string    `json:"hardware_addr"` // e.g. 00:1f:16:31:73:75
+	Until        time.Time `json:"until"`         // zero value: until removed
+	Reason       string    `json:"reason"`        // e.g. “killed via API”
+}
+
+// Active reports whether b is in effect at time now.
+func (b Block) Active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+// BlockUntil returns the end of a block or pause starting at now, given its
+// duration as passed to the API: a positive duration (e.g. 30m), or “forever”
+// for a block which lasts until removed (zero time). Durations which are not
+// positive are rejected, as the block would be pruned right away.
+func BlockUntil(duration string, now time.Time) (time.Time, error) {
+	if duration == "forever" {
+		return time.Time{}, nil
+	}
+	dur, err := time.ParseDuration(duration)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if dur <= 0 {
+		return time.Time{}, fmt.Errorf("duration %v is not positive (use forever to block until removed)", dur)
+	}
+	return now.Add(dur), nil
+}
+
+func blocksPath(dir string) string {
+	return filepath.Join(dir, "netconfigd", "blocks.json")
+}
+
+// ReadBlocks reads the blocks from dir.
+func ReadBlocks(dir string) ([]Block, error) {
+	b, err := ioutil.ReadFile(blocksPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var blocks []Block
+	if err := json.Unmarshal(b, &blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// blocksMu serializes updates within the process, the lock file next to
+// blocks.json serializes them between processes (netconfigd and dhcp4d).
+var blocksMu sync.Mutex
+
+// updateBlocks applies update to the blocks in dir while holding the blocks
+// lock, and writes the result if update reports a change.
+func updateBlocks(dir string, update func([]Block) ([]Block, bool)) (bool, error) {
+	blocksMu.Lock()
+	defer blocksMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(blocksPath(dir)), 0755); err != nil {
+		return false, err
+	}
+	lock, err := os.OpenFile(blocksPath(dir)+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Close() // releases the lock
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return false, fmt.Errorf("flock(%s): %v", lock.Name(), err)
+	}
+	blocks, err := ReadBlocks(dir)
+	if err != nil {
+		return false, err
+	}
+	blocks, changed := update(blocks)
+	if !changed {
+		return false, nil
+	}
+	b, err := json.MarshalIndent(blocks, "", "\t")
+	if err != nil {
+		return false, err
+	}
+	return true, renameio.WriteFile(blocksPath(dir), b, 0644)
+}
+
+// WriteBlocks persists blocks to dir, replacing all existing blocks.
+func WriteBlocks(dir string, blocks []Block) error {
+	_, err := updateBlocks(dir, func([]Block) ([]Block, bool) {
+		return blocks, true
+	})
+	return err
+}
+
+// AddBlock adds block to the blocks in dir.
+func AddBlock(dir string, block Block) error {
+	_, err := updateBlocks(dir, func(blocks []Block) ([]Block, bool) {
+		return append(blocks, block), true
+	})
+	return err
+}
+
+// PruneBlocks removes expired blocks from dir and reports whether any block
+// was removed.
+func PruneBlocks(dir string, now time.Time) (bool, error) {
+	return updateBlocks(dir, func(blocks []Block) ([]Block, bool) {
+		active := blocks[:0]
+		for _, b := range blocks {
+			if b.Active(now) {
+				active = append(active, b)
+			}
+		}
+		return active, len(active) != len(blocks)
+	})
+}
+
+// Pause blocks the client with hardware address hwaddr (and its IP address
+// addr, if known) until the specified time (zero value: until resumed). If
+// the client is already paused, its pause is updated.
+func Pause(dir, hwaddr, addr string, until time.Time) error {
+	if _, err := net.ParseMAC(hwaddr); err != nil {
+		return err
+	}
+	pause := Block{
+		Addr:         addr,
+		HardwareAddr: hwaddr,
+		Until:        until,
+		Reason:       "paused",
+	}
+	_, err := updateBlocks(dir, func(blocks []Block) ([]Block, bool) {
+		for idx, b := range blocks {
+			if b.HardwareAddr == hwaddr && b.Reason == pause.Reason {
+				if addr == "" {
+					pause.Addr = b.Addr
+				}
+				blocks[idx] = pause
+				return blocks, true
+			}
+		}
+		return append(blocks, pause), true
+	})
+	return err
+}
+
+// Resume removes all blocks of the client with hardware address hwaddr.
+func Resume(dir, hwaddr string) error {
+	_, err := updateBlocks(dir, func(blocks []Block) ([]Block, bool) {
+		remaining := blocks[:0]
+		for _, b := range blocks {
+			if b.HardwareAddr != hwaddr {
+				remaining = append(remaining, b)
+			}
+		}
+		return remaining, len(remaining) != len(blocks)
+	})
+	return err
+}
+
+// Paused returns the active blocks of paused clients, keyed by hardware
+// address.
+func Paused(dir string, now time.Time) (map[string]Block, error) {
+	blocks, err := ReadBlocks(dir)
+	if err != nil {
+		return nil, err
+	}
+	paused := make(map[string]Block)
+	for _, b := range blocks {
+		if b.HardwareAddr != "" && b.Active(now) {
+			paused[b.HardwareAddr] = b
+		}
+	}
+	return paused, nil
+}
+
+// etherSaddrExprs returns expressions matching packets received from
+// ethernet hardware address hwaddr.
+func etherSaddrExprs(hwaddr net.HardwareAddr) []expr.Any {
+	return []expr.Any{
+		// [ meta load iiftype => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFTYPE, Register: 1},
+		// [ cmp eq reg 1 0x00000001 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.NativeEndian.PutUint16(unix.ARPHRD_ETHER),
+		},
+		// [ payload load 6b @ link header + 6 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseLLHeader,
+			Offset:       6, // source address
+			Len:          6,
+		},
+		// [ cmp eq reg 1 0x16001f00 0x00007573 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte(hwaddr),
+		},
+	}
+}
+
+// applyBlocks drops forwarded traffic from and to blocked clients.
+func applyBlocks(dir string, c *ruleset, filter *nftables.Table, forward *nftables.Chain) error {
+	blocks, err := ReadBlocks(dir)
+	if err != nil {
+		return err
+	}
+	_, pluginBlocks, err := pluginFragments(dir)
+	if err != nil {
+		return err
+	}
+	blocks = append(blocks, pluginBlocks...)
+	now := time.Now()
+	for _, b := range blocks {
+		if !b.Active(now) {
+			continue
+		}
+		if b.HardwareAddr != "" {
+			hwaddr, err := net.ParseMAC(b.HardwareAddr)
+			if err != nil {
+				return fmt.Errorf("block: %v", err)
+			}
+			c.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: append(etherSaddrExprs(hwaddr),
+					// [ immediate reg 0 drop ]
+					&expr.Verdict{Kind: expr.VerdictDrop}),
+			})
+		}
+		if b.Addr == "" {
+			continue
+		}
+		ip := net.ParseIP(b.Addr)
+		if ip == nil {
+			return fmt.Errorf("block: invalid address %q", b.Addr)
+		}
+		if (ip.To4() != nil) != (filter.Family == nftables.TableFamilyIPv4) {
+			continue // address belongs to the other table
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		n := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		for _, match := range [][]expr.Any{
+			saddrExprs(n, expr.CmpOpEq),
+			daddrExprs(n, expr.CmpOpEq),
+		} {
+			c.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: append(match,
+					// [ immediate reg 0 drop ]
+					&expr.Verdict{Kind: expr.VerdictDrop}),
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPauseUpdates(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const hwaddr = "00:1f:16:31:73:75"
+	first := time.Date(2020, 1, 1, 20, 0, 0, 0, time.UTC)
+	if err := Pause(tmp, hwaddr, "192.168.42.23", first); err != nil {
+		t.Fatal(err)
+	}
+	second := first.Add(time.Hour)
+	if err := Pause(tmp, hwaddr, "", second); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBlocks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Block{
+		{
+			Addr:         "192.168.42.23",
+			HardwareAddr: hwaddr,
+			Until:        second,
+			Reason:       "paused",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("blocks: unexpected diff (-want +got):\n%s", diff)
+	}
+
+	if err := Resume(tmp, hwaddr); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ReadBlocks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("blocks after Resume: got %v, want none", got)
+	}
+}
+
+func TestConcurrentBlockUpdates(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	const clients = 20
+	until := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- Pause(tmp, fmt.Sprintf("00:1f:16:31:73:%02x", i), "", until)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errs <- AddBlock(tmp, Block{Addr: fmt.Sprintf("192.168.42.%d", i), Until: until})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ReadBlocks(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(got), 2*clients; got != want {
+		t.Errorf("len(blocks) = %d, want %d (lost updates)", got, want)
+	}
+}
+
+func TestBlockUntil(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		duration string
+		want     time.Time
+		wantErr  bool
+	}{
+		{duration: "30m", want: now.Add(30 * time.Minute)},
+		{duration: "forever", want: time.Time{}},
+		{duration: "0s", wantErr: true},
+		{duration: "-1h", wantErr: true},
+		{duration: "soon", wantErr: true},
+	} {
+		got, err := BlockUntil(tt.duration, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("BlockUntil(%q) = %v, want error %v", tt.duration, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("BlockUntil(%q) = %v, want %v", tt.duration, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// BridgeDetails configure a bridge, whose member interfaces act as one
+// switch. Name the bridge lan0 (and rename the network card previously named
+// lan0) to serve the LAN on all members. The bridge itself is configured
+// (e.g. its address) like a network card in InterfaceConfig.Interfaces,
+// matched by name.
+type BridgeDetails struct {
+	Name    string   `json:"name"`    // e.g. lan0
+	Members []string `json:"members"` // e.g. ["lan1", "lan2", "lan3"]
+
+	// Multicast configures IGMP/MLD snooping (default: the kernel’s
+	// settings, i.e. snooping without querier).
+	Multicast *BridgeMulticast `json:"multicast,omitempty"`
+
+	// STP enables the spanning tree protocol (IEEE 802.1D) of the kernel,
+	// which blocks redundant paths between members. RSTP requires a user
+	// space daemon, which router7 does not include.
+	STP *BridgeSTP `json:"stp,omitempty"`
+
+	// LoopDetection periodically sends probes from all members and reports
+	// (see alert.EventBridgeLoop) probes which arrive back at a member.
+	LoopDetection *LoopDetection `json:"loop_detection,omitempty"`
+
+	// Isolated are members which can only communicate with the bridge
+	// (i.e. router7) and non-isolated members, e.g. ports of IoT devices.
+	// Isolated members cannot communicate with each other.
+	Isolated []string `json:"isolated,omitempty"`
+
+	// MaxMACs limits the number of hardware addresses per member, e.g.
+	// {"lan3": 2}. See CheckPortSecurity.
+	MaxMACs map[string]int `json:"max_macs,omitempty"`
+}
+
+// BridgeSTP configure the spanning tree protocol. Unset fields use the
+// defaults of IEEE 802.1D.
+type BridgeSTP struct {
+	Priority     int `json:"priority"`      // default 32768, lowest is elected root
+	ForwardDelay int `json:"forward_delay"` // in seconds, default 15
+	HelloTime    int `json:"hello_time"`    // in seconds, default 2
+	MaxAge       int `json:"max_age"`       // in seconds, default 20
+}
+
+// LoopDetection configures the loop detection of a bridge.
+type LoopDetection struct {
+	// DisablePort sets the member at which a probe arrived back down, which
+	// breaks the loop until netconfigd is restarted.
+	DisablePort bool `json:"disable_port"`
+}
+
+// BridgeMulticast configure IGMP/MLD snooping, with which the bridge forwards
+// multicast traffic (e.g. IPTV) only to the members with listeners instead of
+// flooding it to all members.
+type BridgeMulticast struct {
+	Snooping bool `json:"snooping"`
+
+	// Querier makes the bridge send IGMP/MLD queries. Listeners only report
+	// their memberships in response to queries, so snooping requires a
+	// querier in the LAN.
+	Querier bool `json:"querier"`
+
+	QueryInterval int `json:"query_interval"` // in seconds, default 125
+	IGMPVersion   int `json:"igmp_version"`   // 2 (default) or 3
+	MLDVersion    int `json:"mld_version"`    // 1 (default) or 2
+
+	// FastLeave are members which stop receiving a group as soon as a
+	// listener leaves it, for members with only one listener (e.g. an IPTV
+	// receiver).
+	FastLeave []string `json:"fast_leave,omitempty"`
+}
+
+// bridge returns the BridgeDetails of ifname, or nil if ifname is not a
+// bridge.
+func (cfg InterfaceConfig) bridge(ifname string) *BridgeDetails {
+	for i, br := range cfg.Bridges {
+		if br.Name == ifname {
+			return &cfg.Bridges[i]
+		}
+	}
+	return nil
+}
+
+func boolAttr(b bool) []byte {
+	if b {
+		return nl.Uint8Attr(1)
+	}
+	return nl.Uint8Attr(0)
+}
+
+// clockT converts seconds to clock_t (USER_HZ, i.e. 1/100 s).
+func clockT(seconds int) uint32 { return uint32(seconds) * 100 }
+
+// bridgeAttrs returns the IFLA_BR_* attributes of br.
+func bridgeAttrs(br *BridgeDetails) ([]*nl.RtAttr, error) {
+	var attrs []*nl.RtAttr
+	if stp := br.STP; stp != nil {
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_BR_STP_STATE, nl.Uint32Attr(1)))
+		if stp.Priority != 0 {
+			attrs = append(attrs, nl.NewRtAttr(nl.IFLA_BR_PRIORITY, nl.Uint16Attr(uint16(stp.Priority))))
+		}
+		for _, t := range []struct {
+			attr    int
+			seconds int
+		}{
+			{nl.IFLA_BR_FORWARD_DELAY, stp.ForwardDelay},
+			{nl.IFLA_BR_HELLO_TIME, stp.HelloTime},
+			{nl.IFLA_BR_MAX_AGE, stp.MaxAge},
+		} {
+			if t.seconds != 0 {
+				attrs = append(attrs, nl.NewRtAttr(t.attr, nl.Uint32Attr(clockT(t.seconds))))
+			}
+		}
+	} else {
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_BR_STP_STATE, nl.Uint32Attr(0)))
+	}
+
+	m := br.Multicast
+	if m == nil {
+		return attrs, nil
+	}
+	attrs = append(attrs,
+		nl.NewRtAttr(nl.IFLA_BR_MCAST_SNOOPING, boolAttr(m.Snooping)),
+		nl.NewRtAttr(nl.IFLA_BR_MCAST_QUERIER, boolAttr(m.Querier)),
+		// Send queries from the bridge address instead of 0.0.0.0, which
+		// some listeners ignore.
+		nl.NewRtAttr(nl.IFLA_BR_MCAST_QUERY_USE_IFADDR, boolAttr(m.Querier)))
+	if m.QueryInterval != 0 {
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_BR_MCAST_QUERY_INTVL, nl.Uint64Attr(uint64(clockT(m.QueryInterval)))))
+	}
+	switch m.IGMPVersion {
+	case 0:
+	case 2, 3:
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_BR_MCAST_IGMP_VERSION, nl.Uint8Attr(uint8(m.IGMPVersion))))
+	default:
+		return nil, fmt.Errorf("bridge %s: unsupported igmp_version %d, expected 2 or 3", br.Name, m.IGMPVersion)
+	}
+	switch m.MLDVersion {
+	case 0:
+	case 1, 2:
+		attrs = append(attrs, nl.NewRtAttr(nl.IFLA_BR_MCAST_MLD_VERSION, nl.Uint8Attr(uint8(m.MLDVersion))))
+	default:
+		return nil, fmt.Errorf("bridge %s: unsupported mld_version %d, expected 1 or 2", br.Name, m.MLDVersion)
+	}
+	return attrs, nil
+}
+
+// setBridge creates the bridge br (or changes its attributes if it already
+// exists), like ip link add br type bridge.
+func setBridge(br *BridgeDetails) error {
+	attrs, err := bridgeAttrs(br)
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_ACK)
+	req.AddData(nl.NewIfInfomsg(unix.AF_UNSPEC))
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(br.Name)))
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	for _, attr := range attrs {
+		data.AddChild(attr)
+	}
+	req.AddData(linkInfo)
+	_, err = req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// Bridge port attributes which are missing in package nl, from
+// include/uapi/linux/if_link.h
+const (
+	iflaBrportIsolated = 33
+	iflaBrportLocked   = 39
+)
+
+// setBridgePort sets the IFLA_BRPORT_* flag attr of the bridge member link,
+// like netlink.LinkSetFastLeave.
+func setBridgePort(link netlink.Link, attr int, value bool) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	protinfo := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+	protinfo.AddRtAttr(attr, boolAttr(value))
+	req.AddData(protinfo)
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// bridgeOf returns the name of the bridge which ifname is a member of, or
+// the empty string.
+func (cfg InterfaceConfig) bridgeOf(ifname string) string {
+	for _, br := range cfg.Bridges {
+		for _, member := range br.Members {
+			if member == ifname {
+				return br.Name
+			}
+		}
+	}
+	return ""
+}
+
+// createBridges creates the bridges of cfg, so that they can be configured
+// like network cards.
+func createBridges(cfg InterfaceConfig) error {
+	for _, details := range cfg.Interfaces {
+		if br := cfg.bridgeOf(details.Name); br != "" && details.Addr != "" {
+			// The kernel does not deliver packets to the addresses of
+			// bridge members, only to those of the bridge.
+			return fmt.Errorf("bridge %s: member %s must not have an address, configure it on %s instead", br, details.Name, br)
+		}
+	}
+	for i := range cfg.Bridges {
+		br := &cfg.Bridges[i]
+		if err := setBridge(br); err != nil {
+			return fmt.Errorf("bridge %s: %v", br.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyBridgeMembers adds the members of the bridges of cfg to their bridge
+// and applies their member settings. Members which are not present (yet) are
+// skipped, links which are no longer members are released.
+func applyBridgeMembers(cfg InterfaceConfig) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, br := range cfg.Bridges {
+		bridge, err := netlink.LinkByName(br.Name)
+		if err != nil {
+			return fmt.Errorf("bridge %s: %v", br.Name, err)
+		}
+		fastLeave := make(map[string]bool)
+		if br.Multicast != nil {
+			for _, member := range br.Multicast.FastLeave {
+				fastLeave[member] = true
+			}
+		}
+		isolated := make(map[string]bool)
+		for _, member := range br.Isolated {
+			isolated[member] = true
+		}
+		for _, member := range br.Members {
+			l, err := netlink.LinkByName(member)
+			if err != nil {
+				log.Printf("bridge %s: member %s: %v", br.Name, member, err)
+				continue
+			}
+			if l.Attrs().MasterIndex != bridge.Attrs().Index {
+				if err := netlink.LinkSetMasterByIndex(l, bridge.Attrs().Index); err != nil {
+					return fmt.Errorf("bridge %s: adding %s: %v", br.Name, member, err)
+				}
+			}
+			if loopDisabled(member) {
+				log.Printf("bridge %s: not enabling %s, which was disabled due to a loop", br.Name, member)
+			} else if err := netlink.LinkSetUp(l); err != nil {
+				return fmt.Errorf("bridge %s: LinkSetUp(%s): %v", br.Name, member, err)
+			}
+			if err := netlink.LinkSetFastLeave(l, fastLeave[member]); err != nil {
+				return fmt.Errorf("bridge %s: fast leave of %s: %v", br.Name, member, err)
+			}
+			if err := setBridgePort(l, iflaBrportIsolated, isolated[member]); err != nil {
+				return fmt.Errorf("bridge %s: isolating %s: %v", br.Name, member, err)
+			}
+			if err := setBridgePort(l, iflaBrportLocked, portLocked(member)); err != nil {
+				return fmt.Errorf("bridge %s: locking %s: %v", br.Name, member, err)
+			}
+		}
+		for _, l := range links {
+			attr := l.Attrs()
+			if attr.MasterIndex != bridge.Attrs().Index || cfg.bridgeOf(attr.Name) == br.Name {
+				continue
+			}
+			log.Printf("bridge %s: releasing %s, which is no longer a member", br.Name, attr.Name)
+			if err := netlink.LinkSetNoMaster(l); err != nil {
+				return fmt.Errorf("bridge %s: releasing %s: %v", br.Name, attr.Name, err)
+			}
+		}
+		if err := netlink.LinkSetUp(bridge); err != nil {
+			return fmt.Errorf("LinkSetUp(%s): %v", br.Name, err)
+		}
+	}
+	return nil
+}
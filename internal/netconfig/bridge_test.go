@@ -0,0 +1,167 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestBridgeAttrs(t *testing.T) {
+	for _, m := range []BridgeMulticast{
+		{IGMPVersion: 1},
+		{MLDVersion: 3},
+	} {
+		if _, err := bridgeAttrs(&BridgeDetails{Name: "lan0", Multicast: &m}); err == nil {
+			t.Errorf("bridgeAttrs(%+v) unexpectedly succeeded", m)
+		}
+	}
+}
+
+func TestBridgeMemberAddr(t *testing.T) {
+	cfg := InterfaceConfig{
+		Interfaces: []InterfaceDetails{
+			{Name: "lan0", Addr: "192.168.42.1/24"},
+			{Name: "lan1", Addr: "192.168.43.1/24"},
+		},
+		Bridges: []BridgeDetails{
+			{Name: "lan0", Members: []string{"lan1", "lan2"}},
+		},
+	}
+	if err := createBridges(cfg); err == nil {
+		t.Errorf("createBridges unexpectedly succeeded with an address on member lan1")
+	}
+}
+
+// TestBridge creates a bridge in a new network namespace, whose settings are
+// verified via a sysfs instance of that namespace.
+func TestBridge(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET | unix.CLONE_NEWNS); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	if err := netlink.LinkAdd(&netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "lan1"},
+		PeerName:  "peer1",
+	}); err != nil {
+		t.Skipf("adding veth link: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	sys := filepath.Join(tmp, "sys")
+	if err := os.Mkdir(sys, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount("sysfs", sys, "sysfs", 0, ""); err != nil {
+		t.Skipf("mounting sysfs: %v", err)
+	}
+	defer unix.Unmount(sys, 0)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{
+  "bridges": [
+    {
+      "name": "br0",
+      "members": ["lan1", "lan2"],
+      "multicast": {
+        "snooping": true,
+        "querier": true,
+        "query_interval": 60,
+        "igmp_version": 3,
+        "fast_leave": ["lan1"]
+      },
+      "stp": {
+        "priority": 4096,
+        "forward_delay": 4
+      },
+      "isolated": ["lan1"]
+    }
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Applying twice verifies that existing bridges are updated.
+	for i := 0; i < 2; i++ {
+		if _, err := applyInterfaces(tmp, tmp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"class/net/br0/bridge/multicast_snooping", "1"},
+		{"class/net/br0/bridge/multicast_querier", "1"},
+		{"class/net/br0/bridge/multicast_query_interval", "6000"},
+		{"class/net/br0/bridge/multicast_igmp_version", "3"},
+		{"class/net/lan1/brport/multicast_fast_leave", "1"},
+		{"class/net/br0/bridge/stp_state", "1"},
+		{"class/net/br0/bridge/priority", "4096"},
+		{"class/net/br0/bridge/forward_delay", "400"},
+		{"class/net/lan1/brport/isolated", "1"},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(sys, tt.path))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := strings.TrimSpace(string(b)); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	master, err := os.Readlink(filepath.Join(sys, "class/net/lan1/master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filepath.Base(master), "br0"; got != want {
+		t.Errorf("master of lan1: got %q, want %q", got, want)
+	}
+
+	// Links which are removed from the members are released.
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{
+  "bridges": [
+    {
+      "name": "br0",
+      "members": ["lan2"]
+    }
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyInterfaces(tmp, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(sys, "class/net/lan1/master")); !os.IsNotExist(err) {
+		t.Errorf("lan1 still has a master after removing it from the members (err = %v)", err)
+	}
+}
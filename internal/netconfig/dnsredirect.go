@@ -0,0 +1,106 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// clientExprs returns expressions matching packets from client, which is
+// either a MAC address, an IPv4 address or an IPv4 network.
+func clientExprs(client string) ([]expr.Any, error) {
+	if hwaddr, err := net.ParseMAC(client); err == nil {
+		return etherSaddrExprs(hwaddr), nil
+	}
+	if !strings.Contains(client, "/") {
+		client += "/32"
+	}
+	ip, n, err := net.ParseCIDR(client)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client %q: expected MAC address, IPv4 address or network", client)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("invalid client %q: only IPv4 is supported", client)
+	}
+	return saddrExprs(n, expr.CmpOpEq), nil
+}
+
+// dnsPorts are redirected for clients listed in dns_redirect: plain DNS is
+// answered by dnsd, whereas DNS-over-TLS connections are refused by the
+// router, so that clients fall back to plain DNS.
+var dnsPorts = []struct {
+	proto uint8
+	port  uint16
+}{
+	{unix.IPPROTO_UDP, 53},
+	{unix.IPPROTO_TCP, 53},
+	{unix.IPPROTO_TCP, 853},
+}
+
+// applyDNSRedirect redirects DNS traffic of the clients configured in
+// firewall.json to the router, regardless of the resolver they try to use.
+func applyDNSRedirect(dir string, c *ruleset, nat *nftables.Table, prerouting *nftables.Chain) error {
+	cfg, err := readFirewallConfig(dir)
+	if err != nil {
+		return err
+	}
+	for _, client := range cfg.DNSRedirect {
+		match, err := clientExprs(client)
+		if err != nil {
+			return fmt.Errorf("dns_redirect: %v", err)
+		}
+		for _, p := range dnsPorts {
+			exprs := iifnameExprs("lan0")
+			exprs = append(exprs, match...)
+			exprs = append(exprs,
+				// [ meta load l4proto => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				// [ cmp eq reg 1 0x00000011 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte{p.proto},
+				},
+				// [ payload load 2b @ transport header + 2 => reg 1 ]
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseTransportHeader,
+					Offset:       2, // destination port
+					Len:          2,
+				},
+				// [ cmp eq reg 1 0x00003500 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     binaryutil.BigEndian.PutUint16(p.port),
+				},
+				// [ redir ]
+				&expr.Redir{})
+			c.AddRule(&nftables.Rule{
+				Table: nat,
+				Chain: prerouting,
+				Exprs: exprs,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+)
+
+// linkName returns the name of the link with index idx, for display.
+func linkName(idx int) string {
+	if iface, err := net.InterfaceByIndex(idx); err == nil {
+		return iface.Name
+	}
+	return fmt.Sprintf("if%d", idx)
+}
+
+// formatRoute formats r similar to “ip route”.
+func formatRoute(r *netlink.Route) string {
+	dst := "default"
+	if r.Dst != nil {
+		dst = r.Dst.String()
+	}
+	parts := []string{dst}
+	if r.Gw != nil {
+		parts = append(parts, "via", r.Gw.String())
+	}
+	if r.LinkIndex != 0 {
+		parts = append(parts, "dev", linkName(r.LinkIndex))
+	}
+	if r.Src != nil {
+		parts = append(parts, "src", r.Src.String())
+	}
+	if r.Protocol != 0 {
+		parts = append(parts, "proto", fmt.Sprint(r.Protocol))
+	}
+	parts = append(parts, "metric", fmt.Sprint(r.Priority))
+	if r.Table != 0 {
+		parts = append(parts, "table", fmt.Sprint(r.Table))
+	}
+	return strings.Join(parts, " ")
+}
+
+// DryRun writes the problems of the configuration in dir (see Validate) and
+// the operations which Apply would perform, without performing them: link
+// settings, netlink address, route, rule and neighbor operations compared to
+// the current kernel state, sysctls which would change, and the firewall
+// ruleset in the syntax of “nft list ruleset”. The WireGuard configuration is
+// only validated.
+func DryRun(dir string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	problems := Validate(dir)
+	for _, p := range problems {
+		fmt.Fprintf(bw, "# problem: %v\n", p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(bw)
+	}
+
+	fmt.Fprintf(bw, "# links (interfaces.json)\n")
+	var cfg InterfaceConfig
+	if _, err := decodeFile(dir, "interfaces.json", &cfg, false); err != nil {
+		return err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		attr := l.Attrs()
+		details, ok := cfg.match(attr)
+		if !ok {
+			continue
+		}
+		if attr.Name != details.Name {
+			fmt.Fprintf(bw, "LinkSetName %s %s\n", attr.Name, details.Name)
+		}
+		if spoof := details.SpoofHardwareAddr; spoof != "" && !strings.EqualFold(spoof, attr.HardwareAddr.String()) {
+			fmt.Fprintf(bw, "LinkSetHardwareAddr %s %s\n", details.Name, spoof)
+		}
+		if details.MTU != 0 && details.MTU != attr.MTU {
+			fmt.Fprintf(bw, "LinkSetMTU %s %d\n", details.Name, details.MTU)
+		}
+		if attr.OperState != netlink.OperUp {
+			fmt.Fprintf(bw, "LinkSetUp %s\n", details.Name)
+		}
+	}
+
+	uplink, err := uplinkInterface()
+	if err != nil {
+		uplink = "uplink0"
+	}
+	var errs []error
+	st := buildState(dir, uplink, func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	}, func(err error) { errs = append(errs, err) })
+	for _, err := range errs {
+		fmt.Fprintf(bw, "# error: %v\n", err)
+	}
+
+	owned := loadOwnedAddrs(dir)
+	desired := make(map[string][]*netlink.Addr)
+	for _, ls := range st.links {
+		desired[ls.ifname] = append(desired[ls.ifname], ls.addrs...)
+	}
+	for _, ls := range st.links {
+		fmt.Fprintf(bw, "\n# %s\n", ls.source)
+		link, err := netlink.LinkByName(ls.ifname)
+		if err != nil {
+			fmt.Fprintf(bw, "# %s: %v\n", ls.ifname, err)
+			continue
+		}
+		existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, addr := range staleAddrs(existing, desired[ls.ifname], ls.ownedFamily) {
+			if owned.owns(ls.ifname, addr) {
+				fmt.Fprintf(bw, "AddrDel %s %s\n", ls.ifname, addr.IPNet)
+			}
+		}
+		for _, addr := range ls.addrs {
+			var found bool
+			for _, e := range existing {
+				if e.IPNet.String() == addr.IPNet.String() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Fprintf(bw, "AddrReplace %s %s\n", ls.ifname, addr.IPNet)
+			}
+		}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+		}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		for _, r := range staleRoutes(routes, ls.routes, ls.ownedProtocol) {
+			fmt.Fprintf(bw, "RouteDel %s\n", formatRoute(r))
+		}
+		for _, r := range ls.routes {
+			if !routeInstalled(routes, r) {
+				fmt.Fprintf(bw, "RouteReplace %s\n", formatRoute(r))
+			}
+		}
+	}
+
+	fmt.Fprintf(bw, "\n# static routes (routes.json)\n")
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Protocol: rtprotStatic,
+	}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for idx := range existing {
+		r := &existing[idx]
+		var found bool
+		for _, want := range st.routes {
+			if sameStaticRoute(r, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(bw, "RouteDel %s\n", formatRoute(r))
+		}
+	}
+	for _, want := range st.routes {
+		var found bool
+		for idx := range existing {
+			if sameStaticRoute(&existing[idx], want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fmt.Fprintf(bw, "RouteReplace %s\n", formatRoute(want))
+		}
+	}
+
+	if len(st.rules) > 0 || len(st.neighbors) > 0 {
+		fmt.Fprintf(bw, "\n# rules and neighbors\n")
+	}
+	for _, r := range st.rules {
+		fmt.Fprintf(bw, "RuleAdd %v\n", r)
+	}
+	for _, n := range st.neighbors {
+		fmt.Fprintf(bw, "NeighSet %s lladdr %s dev %s\n", n.IP, n.HardwareAddr, linkName(n.LinkIndex))
+	}
+
+	fmt.Fprintf(bw, "\n# sysctls\n")
+	for _, ctl := range st.sysctls {
+		idx := strings.Index(ctl, "=")
+		key, val := ctl[:idx], ctl[idx+1:]
+		b, err := ioutil.ReadFile("/proc/sys/" + strings.Replace(key, ".", "/", -1))
+		if err == nil && strings.TrimSpace(string(b)) == val {
+			continue
+		}
+		fmt.Fprintf(bw, "sysctl %s\n", ctl)
+	}
+
+	if st.firewall != nil {
+		fmt.Fprintf(bw, "\n# firewall (replaces the ruleset atomically)\n")
+		st.firewall.export(bw)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/renameio"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDoHProviders are the addresses of well-known public DNS-over-HTTPS
+// resolvers, used until an updated list is written via WriteDoHProviders.
+var DefaultDoHProviders = []string{
+	// Cloudflare
+	"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001",
+	// Google
+	"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844",
+	// Quad9
+	"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9",
+	// OpenDNS
+	"208.67.222.222", "208.67.220.220", "2620:119:35::35", "2620:119:53::53",
+	// AdGuard
+	"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff",
+	// CleanBrowsing
+	"185.228.168.168", "185.228.169.168",
+}
+
+func dohProvidersPath(dir string) string {
+	return filepath.Join(dir, "netconfigd", "doh_providers.json")
+}
+
+// ReadDoHProviders returns the DNS-over-HTTPS resolver addresses stored in
+// dir, or DefaultDoHProviders if none were stored.
+func ReadDoHProviders(dir string) ([]string, error) {
+	b, err := ioutil.ReadFile(dohProvidersPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultDoHProviders, nil
+		}
+		return nil, err
+	}
+	var providers []string
+	if err := json.Unmarshal(b, &providers); err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
+// WriteDoHProviders validates and stores the DNS-over-HTTPS resolver
+// addresses in dir.
+func WriteDoHProviders(dir string, providers []string) error {
+	for _, p := range providers {
+		if net.ParseIP(p) == nil {
+			return fmt.Errorf("invalid IP address %q", p)
+		}
+	}
+	b, err := json.Marshal(providers)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dohProvidersPath(dir)), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(dohProvidersPath(dir), b, 0644)
+}
+
+// applyEncryptedDNSBlock drops DNS-over-TLS, DNS-over-QUIC and (to known
+// providers) DNS-over-HTTPS traffic of the clients configured in
+// firewall.json, so that they have to use dnsd.
+func applyEncryptedDNSBlock(dir string, c *ruleset, filter *nftables.Table, forward *nftables.Chain) error {
+	cfg, err := readFirewallConfig(dir)
+	if err != nil {
+		return err
+	}
+	if len(cfg.BlockEncryptedDNS) == 0 {
+		return nil
+	}
+	providers, err := ReadDoHProviders(dir)
+	if err != nil {
+		return err
+	}
+
+	ipv4 := filter.Family == nftables.TableFamilyIPv4
+	set := &nftables.Set{
+		Table:   filter,
+		Name:    "doh_providers",
+		KeyType: nftables.TypeIP6Addr,
+	}
+	if ipv4 {
+		set.KeyType = nftables.TypeIPAddr
+	}
+	var elems []nftables.SetElement
+	for _, p := range providers {
+		ip := net.ParseIP(p)
+		if ip == nil {
+			return fmt.Errorf("doh_providers: invalid IP address %q", p)
+		}
+		if (ip.To4() != nil) != ipv4 {
+			continue // address belongs to the other table
+		}
+		if ipv4 {
+			elems = append(elems, nftables.SetElement{Key: ip.To4()})
+		} else {
+			elems = append(elems, nftables.SetElement{Key: ip.To16()})
+		}
+	}
+	if err := c.AddSet(set, elems); err != nil {
+		return err
+	}
+
+	daddrOffset, daddrLen := uint32(16), uint32(net.IPv4len) // IPv4 header
+	if !ipv4 {
+		daddrOffset, daddrLen = 24, net.IPv6len // IPv6 header
+	}
+	for _, client := range cfg.BlockEncryptedDNS {
+		hwaddr, err := net.ParseMAC(client)
+		if err != nil && !ipv4 {
+			continue // IPv4 clients cannot be matched in the ip6 table
+		}
+		var match []expr.Any
+		if hwaddr != nil {
+			match = etherSaddrExprs(hwaddr)
+		} else if match, err = clientExprs(client); err != nil {
+			return fmt.Errorf("block_encrypted_dns: %v", err)
+		}
+		for _, proto := range []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+			for _, port := range []uint16{853, 443} {
+				exprs := append([]expr.Any{}, match...)
+				exprs = append(exprs,
+					// [ meta load l4proto => reg 1 ]
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					// [ cmp eq reg 1 0x00000006 ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     []byte{proto},
+					},
+					// [ payload load 2b @ transport header + 2 => reg 1 ]
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseTransportHeader,
+						Offset:       2, // destination port
+						Len:          2,
+					},
+					// [ cmp eq reg 1 0x00005503 ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     binaryutil.BigEndian.PutUint16(port),
+					})
+				if port == 443 {
+					exprs = append(exprs,
+						// [ payload load 4b @ network header + 16 => reg 1 ]
+						&expr.Payload{
+							DestRegister: 1,
+							Base:         expr.PayloadBaseNetworkHeader,
+							Offset:       daddrOffset,
+							Len:          daddrLen,
+						},
+						// [ lookup reg 1 set doh_providers ]
+						&expr.Lookup{
+							SourceRegister: 1,
+							SetName:        set.Name,
+						})
+				}
+				exprs = append(exprs,
+					// [ immediate reg 0 drop ]
+					&expr.Verdict{Kind: expr.VerdictDrop})
+				c.AddRule(&nftables.Rule{
+					Table: filter,
+					Chain: forward,
+					Exprs: exprs,
+				})
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Export writes the firewall which netconfig generates from the configuration
+// in dir in the syntax of “nft list ruleset”, so that it can be audited
+// without touching the kernel ruleset. With script set, the output is a shell
+// script which installs the ruleset using nft -f.
+func Export(dir string, w io.Writer, script bool) error {
+	uplink, err := uplinkInterface()
+	if err != nil {
+		uplink = "uplink0" // rules match on interface names only
+	}
+	rs, err := buildFirewall(dir, uplink, func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	if script {
+		fmt.Fprintf(bw, "#!/bin/sh\n# generated by router7 netconfig\nset -e\nnft -f - <<'EOF'\nflush ruleset\n\n")
+	}
+	rs.export(bw)
+	if script {
+		fmt.Fprintf(bw, "EOF\n")
+	}
+	return bw.Flush()
+}
+
+// valueKind determines how register contents are formatted.
+type valueKind int
+
+const (
+	kindHex valueKind = iota
+	kindIfname
+	kindL4proto
+	kindNfproto
+	kindIPv4
+	kindIPv6
+	kindEther
+	kindPort     // big endian
+	kindHostUint // native endian, e.g. meta mark
+	kindCtState
+)
+
+var setKinds = map[string]valueKind{
+	nftables.TypeIPAddr.Name:      kindIPv4,
+	nftables.TypeIP6Addr.Name:     kindIPv6,
+	nftables.TypeEtherAddr.Name:   kindEther,
+	nftables.TypeInetService.Name: kindPort,
+	nftables.TypeInetProto.Name:   kindL4proto,
+	nftables.TypeMark.Name:        kindHostUint,
+}
+
+var ctStates = []struct {
+	bit  uint32
+	name string
+}{
+	{1, "invalid"},
+	{2, "established"},
+	{4, "related"},
+	{8, "new"},
+	{64, "untracked"},
+}
+
+func formatValue(kind valueKind, b []byte) string {
+	switch kind {
+	case kindIfname:
+		return fmt.Sprintf("%q", string(bytes.TrimRight(b, "\x00")))
+	case kindL4proto:
+		if len(b) == 1 {
+			switch b[0] {
+			case unix.IPPROTO_TCP:
+				return "tcp"
+			case unix.IPPROTO_UDP:
+				return "udp"
+			case unix.IPPROTO_ICMP:
+				return "icmp"
+			case unix.IPPROTO_ICMPV6:
+				return "ipv6-icmp"
+			}
+			return fmt.Sprint(b[0])
+		}
+	case kindNfproto:
+		if len(b) == 1 {
+			switch b[0] {
+			case unix.NFPROTO_IPV4:
+				return "ipv4"
+			case unix.NFPROTO_IPV6:
+				return "ipv6"
+			}
+		}
+	case kindIPv4, kindIPv6:
+		if ip4 := net.IP(b).To4(); kind == kindIPv6 && len(b) == net.IPv6len && ip4 != nil {
+			// IPv4-mapped, which net.IP.String formats like IPv4
+			return "::ffff:" + ip4.String()
+		}
+		if len(b) == net.IPv4len || len(b) == net.IPv6len {
+			return net.IP(b).String()
+		}
+	case kindEther:
+		if len(b) == 6 {
+			return net.HardwareAddr(b).String()
+		}
+	case kindPort:
+		if len(b) == 2 {
+			return fmt.Sprint(binary.BigEndian.Uint16(b))
+		}
+	case kindHostUint:
+		switch len(b) {
+		case 2:
+			if binaryutil.NativeEndian.PutUint16(1)[0] == 1 {
+				return fmt.Sprint(binary.LittleEndian.Uint16(b))
+			}
+			return fmt.Sprint(binary.BigEndian.Uint16(b))
+		case 4:
+			return fmt.Sprintf("0x%08x", binaryutil.NativeEndian.Uint32(b))
+		}
+	case kindCtState:
+		if len(b) == 4 {
+			v := binaryutil.NativeEndian.Uint32(b)
+			var names []string
+			for _, s := range ctStates {
+				if v&s.bit != 0 {
+					names = append(names, s.name)
+				}
+			}
+			if len(names) > 0 {
+				return strings.Join(names, ",")
+			}
+		}
+	}
+	return fmt.Sprintf("0x%x", b)
+}
+
+// operand describes the contents of a register.
+type operand struct {
+	text string // e.g. “ip saddr”, empty for literal data
+	kind valueKind
+	data []byte // literal data (immediate)
+
+	prefix int // prefix length of a masked address, if > 0
+}
+
+func (o operand) String() string {
+	if o.text == "" {
+		return formatValue(o.kind, o.data)
+	}
+	return o.text
+}
+
+var metaKeys = map[expr.MetaKey]struct {
+	name string
+	kind valueKind
+}{
+	expr.MetaKeyIIFNAME:  {"iifname", kindIfname},
+	expr.MetaKeyOIFNAME:  {"oifname", kindIfname},
+	expr.MetaKeyIIF:      {"iif", kindHostUint},
+	expr.MetaKeyOIF:      {"oif", kindHostUint},
+	expr.MetaKeyIIFTYPE:  {"iiftype", kindHostUint},
+	expr.MetaKeyOIFTYPE:  {"oiftype", kindHostUint},
+	expr.MetaKeyL4PROTO:  {"meta l4proto", kindL4proto},
+	expr.MetaKeyNFPROTO:  {"meta nfproto", kindNfproto},
+	expr.MetaKeyPROTOCOL: {"meta protocol", kindHex},
+	expr.MetaKeyMARK:     {"meta mark", kindHostUint},
+	expr.MetaKeyPKTTYPE:  {"meta pkttype", kindHex},
+	expr.MetaKeyLEN:      {"meta length", kindHostUint},
+}
+
+// payloadOperand names well-known header fields, and otherwise uses the raw
+// payload syntax (offsets and lengths in bits), e.g. “@th,104,8”.
+func payloadOperand(family nftables.TableFamily, l4proto string, p *expr.Payload) operand {
+	type field struct {
+		base        expr.PayloadBase
+		offset, len uint32
+	}
+	f := field{p.Base, p.Offset, p.Len}
+	transport := "th"
+	if l4proto == "tcp" || l4proto == "udp" {
+		transport = l4proto
+	}
+	switch f {
+	case field{expr.PayloadBaseLLHeader, 0, 6}:
+		return operand{text: "ether daddr", kind: kindEther}
+	case field{expr.PayloadBaseLLHeader, 6, 6}:
+		return operand{text: "ether saddr", kind: kindEther}
+	case field{expr.PayloadBaseTransportHeader, 0, 2}:
+		return operand{text: transport + " sport", kind: kindPort}
+	case field{expr.PayloadBaseTransportHeader, 2, 2}:
+		return operand{text: transport + " dport", kind: kindPort}
+	case field{expr.PayloadBaseTransportHeader, 13, 1}:
+		if l4proto == "tcp" {
+			return operand{text: "tcp flags"}
+		}
+	}
+	if family == nftables.TableFamilyIPv6 || (family == nftables.TableFamilyINet && p.Len == net.IPv6len) {
+		switch f {
+		case field{expr.PayloadBaseNetworkHeader, 8, 16}:
+			return operand{text: "ip6 saddr", kind: kindIPv6}
+		case field{expr.PayloadBaseNetworkHeader, 24, 16}:
+			return operand{text: "ip6 daddr", kind: kindIPv6}
+		case field{expr.PayloadBaseNetworkHeader, 6, 1}:
+			return operand{text: "ip6 nexthdr", kind: kindL4proto}
+		}
+	} else {
+		switch f {
+		case field{expr.PayloadBaseNetworkHeader, 12, 4}:
+			return operand{text: "ip saddr", kind: kindIPv4}
+		case field{expr.PayloadBaseNetworkHeader, 16, 4}:
+			return operand{text: "ip daddr", kind: kindIPv4}
+		case field{expr.PayloadBaseNetworkHeader, 9, 1}:
+			return operand{text: "ip protocol", kind: kindL4proto}
+		}
+	}
+	base := map[expr.PayloadBase]string{
+		expr.PayloadBaseLLHeader:        "@ll",
+		expr.PayloadBaseNetworkHeader:   "@nh",
+		expr.PayloadBaseTransportHeader: "@th",
+	}[p.Base]
+	return operand{text: fmt.Sprintf("%s,%d,%d", base, p.Offset*8, p.Len*8)}
+}
+
+var cmpOps = map[expr.CmpOp]string{
+	expr.CmpOpEq:  "",
+	expr.CmpOpNeq: "!= ",
+	expr.CmpOpLt:  "< ",
+	expr.CmpOpLte: "<= ",
+	expr.CmpOpGt:  "> ",
+	expr.CmpOpGte: ">= ",
+}
+
+var limitUnits = map[expr.LimitTime]string{
+	expr.LimitTimeSecond: "second",
+	expr.LimitTimeMinute: "minute",
+	expr.LimitTimeHour:   "hour",
+	expr.LimitTimeDay:    "day",
+	expr.LimitTimeWeek:   "week",
+}
+
+func (r *ruleset) findSet(t *nftables.Table, name string) *rulesetSet {
+	for i, s := range r.sets {
+		if s.set.Name == name && s.set.Table.Name == t.Name && s.set.Table.Family == t.Family {
+			return &r.sets[i]
+		}
+	}
+	return nil
+}
+
+// setElements formats the elements of s, e.g. “{ 10.0.0.0-10.255.255.255 }”.
+func setElements(s *rulesetSet) string {
+	kind := setKinds[s.set.KeyType.Name]
+	var elems []string
+	for i := 0; i < len(s.elems); i++ {
+		e := s.elems[i]
+		if e.IntervalEnd {
+			continue
+		}
+		elem := formatValue(kind, e.Key)
+		if s.set.Interval && i+1 < len(s.elems) && s.elems[i+1].IntervalEnd {
+			// interval ends are exclusive
+			end := append([]byte(nil), s.elems[i+1].Key...)
+			for j := len(end) - 1; j >= 0; j-- {
+				end[j]--
+				if end[j] != 0xff {
+					break
+				}
+			}
+			if !bytes.Equal(end, e.Key) {
+				elem += "-" + formatValue(kind, end)
+			}
+			i++
+		}
+		elems = append(elems, elem)
+	}
+	return "{ " + strings.Join(elems, ", ") + " }"
+}
+
+// formatRule renders the expressions of rule in nft syntax.
+func (r *ruleset) formatRule(rule *nftables.Rule) string {
+	var (
+		stmts   []string
+		regs    = make(map[uint32]operand)
+		l4proto string
+	)
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			mk, ok := metaKeys[e.Key]
+			if !ok {
+				mk.name = fmt.Sprintf("meta %d", e.Key)
+			}
+			if e.SourceRegister {
+				src := regs[e.Register]
+				src.kind = mk.kind
+				stmts = append(stmts, fmt.Sprintf("%s set %s", mk.name, src))
+				continue
+			}
+			regs[e.Register] = operand{text: mk.name, kind: mk.kind}
+		case *expr.Payload:
+			regs[e.DestRegister] = payloadOperand(rule.Table.Family, l4proto, e)
+		case *expr.Ct:
+			if e.Key == expr.CtKeySTATE {
+				regs[e.Register] = operand{text: "ct state", kind: kindCtState}
+			} else {
+				regs[e.Register] = operand{text: fmt.Sprintf("ct %d", e.Key)}
+			}
+		case *expr.Rt:
+			if e.Key == expr.RtTCPMSS {
+				regs[e.Register] = operand{text: "rt mtu"}
+			} else {
+				regs[e.Register] = operand{text: fmt.Sprintf("rt %d", e.Key)}
+			}
+		case *expr.Immediate:
+			regs[e.Register] = operand{data: e.Data}
+		case *expr.Byteorder:
+			regs[e.DestRegister] = regs[e.SourceRegister]
+		case *expr.Bitwise:
+			src := regs[e.SourceRegister]
+			if ones, bits := net.IPMask(e.Mask).Size(); bits > 0 && (src.kind == kindIPv4 || src.kind == kindIPv6) && len(bytes.Trim(e.Xor, "\x00")) == 0 {
+				// e.g. “ip saddr 10.0.0.0/8”
+				src.prefix = ones
+				regs[e.DestRegister] = src
+				continue
+			}
+			text := fmt.Sprintf("%s & %s", src, formatValue(src.kind, e.Mask))
+			if len(bytes.Trim(e.Xor, "\x00")) > 0 {
+				text += " ^ " + formatValue(src.kind, e.Xor)
+			}
+			regs[e.DestRegister] = operand{text: text, kind: src.kind}
+		case *expr.Cmp:
+			op := regs[e.Register]
+			val := formatValue(op.kind, e.Data)
+			if op.prefix > 0 && op.prefix < 8*len(e.Data) {
+				val += fmt.Sprintf("/%d", op.prefix)
+			}
+			if op.text == "meta l4proto" && e.Op == expr.CmpOpEq {
+				l4proto = val
+			}
+			if op.kind == kindCtState && e.Op == expr.CmpOpNeq && len(bytes.Trim(e.Data, "\x00")) == 0 {
+				// “ct state & (established|related) != 0”
+				op.text = strings.TrimPrefix(op.text, "ct state & ")
+				stmts = append(stmts, "ct state "+op.text)
+				continue
+			}
+			stmts = append(stmts, fmt.Sprintf("%s %s%s", op, cmpOps[e.Op], val))
+		case *expr.Lookup:
+			op := regs[e.SourceRegister]
+			ref := "@" + e.SetName
+			if s := r.findSet(rule.Table, e.SetName); s != nil && s.set.Anonymous {
+				ref = setElements(s)
+			}
+			neg := ""
+			if e.Invert {
+				neg = "!= "
+			}
+			stmts = append(stmts, fmt.Sprintf("%s %s%s", op, neg, ref))
+		case *expr.Dynset:
+			verb := "add"
+			if e.Operation == 1 { // NFT_DYNSET_OP_UPDATE
+				verb = "update"
+			}
+			stmts = append(stmts, fmt.Sprintf("%s @%s { %s }", verb, e.SetName, regs[e.SrcRegKey]))
+		case *expr.Exthdr:
+			name := fmt.Sprintf("tcp option @%d,%d,%d", e.Type, e.Offset*8, e.Len*8)
+			if e.Op == expr.ExthdrOpTcpopt && e.Type == 2 && e.Offset == 2 && e.Len == 2 {
+				name = "tcp option maxseg size"
+			}
+			if e.SourceRegister != 0 {
+				stmts = append(stmts, fmt.Sprintf("%s set %s", name, regs[e.SourceRegister]))
+				continue
+			}
+			regs[e.DestRegister] = operand{text: name, kind: kindPort}
+		case *expr.Counter:
+			stmts = append(stmts, "counter")
+		case *expr.Objref:
+			stmts = append(stmts, fmt.Sprintf("counter name %q", e.Name))
+		case *expr.Limit:
+			over := ""
+			if e.Over {
+				over = "over "
+			}
+			unit := "packets"
+			if e.Type == expr.LimitTypePktBytes {
+				unit = "bytes"
+			}
+			s := fmt.Sprintf("limit rate %s%d/%s", over, e.Rate, limitUnits[e.Unit])
+			if e.Burst > 0 {
+				s += fmt.Sprintf(" burst %d %s", e.Burst, unit)
+			}
+			stmts = append(stmts, s)
+		case *expr.NAT:
+			verb := "snat"
+			if e.Type == expr.NATTypeDestNAT {
+				verb = "dnat"
+			}
+			kind := kindIPv4
+			if e.Family == unix.NFPROTO_IPV6 {
+				kind = kindIPv6
+			}
+			var to string
+			if e.RegAddrMin != 0 {
+				addr := regs[e.RegAddrMin]
+				addr.kind = kind
+				to = addr.String()
+				if kind == kindIPv6 && e.RegProtoMin != 0 {
+					to = "[" + to + "]"
+				}
+			}
+			if e.RegProtoMin != 0 {
+				port := regs[e.RegProtoMin]
+				port.kind = kindPort
+				to += ":" + port.String()
+				if e.RegProtoMax != 0 && e.RegProtoMax != e.RegProtoMin {
+					max := regs[e.RegProtoMax]
+					max.kind = kindPort
+					to += "-" + max.String()
+				}
+			}
+			stmts = append(stmts, fmt.Sprintf("%s to %s", verb, to))
+		case *expr.Masq:
+			stmts = append(stmts, "masquerade")
+		case *expr.Redir:
+			s := "redirect"
+			if e.RegisterProtoMin != 0 {
+				port := regs[e.RegisterProtoMin]
+				port.kind = kindPort
+				s += " to :" + port.String()
+			}
+			stmts = append(stmts, s)
+		case *expr.TProxy:
+			port := regs[e.RegPort]
+			port.kind = kindPort
+			stmts = append(stmts, "tproxy to :"+port.String())
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				stmts = append(stmts, "accept")
+			case expr.VerdictDrop:
+				stmts = append(stmts, "drop")
+			case expr.VerdictReturn:
+				stmts = append(stmts, "return")
+			case expr.VerdictContinue:
+				stmts = append(stmts, "continue")
+			case expr.VerdictJump:
+				stmts = append(stmts, "jump "+e.Chain)
+			case expr.VerdictGoto:
+				stmts = append(stmts, "goto "+e.Chain)
+			default:
+				stmts = append(stmts, fmt.Sprintf("verdict %d", e.Kind))
+			}
+		default:
+			stmts = append(stmts, fmt.Sprintf("/* %T */", e))
+		}
+	}
+	return strings.Join(stmts, " ")
+}
+
+var hookNames = map[nftables.ChainHook]string{
+	nftables.ChainHookPrerouting:  "prerouting",
+	nftables.ChainHookInput:       "input",
+	nftables.ChainHookForward:     "forward",
+	nftables.ChainHookOutput:      "output",
+	nftables.ChainHookPostrouting: "postrouting",
+}
+
+// export writes r in the syntax of “nft list ruleset”.
+func (r *ruleset) export(w io.Writer) {
+	for i, t := range r.tables {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "table %s %s {\n", familyName(t.Family), t.Name)
+		for _, o := range r.objs {
+			if co, ok := o.(*nftables.CounterObj); ok && co.Table == t {
+				fmt.Fprintf(w, "\tcounter %s {\n\t\tpackets %d bytes %d\n\t}\n\n", co.Name, co.Packets, co.Bytes)
+			}
+		}
+		for i := range r.sets {
+			s := &r.sets[i]
+			if s.set.Table != t || s.set.Anonymous {
+				continue
+			}
+			fmt.Fprintf(w, "\tset %s {\n\t\ttype %s\n", s.set.Name, s.set.KeyType.Name)
+			var flags []string
+			if s.set.Constant {
+				flags = append(flags, "constant")
+			}
+			if s.set.Interval {
+				flags = append(flags, "interval")
+			}
+			if s.set.HasTimeout {
+				flags = append(flags, "timeout")
+			}
+			if len(flags) > 0 {
+				fmt.Fprintf(w, "\t\tflags %s\n", strings.Join(flags, ","))
+			}
+			if s.set.Timeout > 0 {
+				fmt.Fprintf(w, "\t\ttimeout %v\n", s.set.Timeout)
+			}
+			if len(s.elems) > 0 {
+				fmt.Fprintf(w, "\t\telements = %s\n", setElements(s))
+			}
+			fmt.Fprintf(w, "\t}\n\n")
+		}
+		first := true
+		for _, ch := range r.chains {
+			if ch.Table != t {
+				continue
+			}
+			if !first {
+				fmt.Fprintln(w)
+			}
+			first = false
+			fmt.Fprintf(w, "\tchain %s {\n", ch.Name)
+			if ch.Type != "" {
+				policy := "accept"
+				if ch.Policy != nil && *ch.Policy == nftables.ChainPolicyDrop {
+					policy = "drop"
+				}
+				fmt.Fprintf(w, "\t\ttype %s hook %s priority %d; policy %s;\n", ch.Type, hookNames[ch.Hooknum], ch.Priority, policy)
+			}
+			for _, rule := range r.chainRules(ch) {
+				fmt.Fprintf(w, "\t\t%s\n", r.formatRule(rule))
+			}
+			fmt.Fprintf(w, "\t}\n")
+		}
+		fmt.Fprintf(w, "}\n")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestExport(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "portforwardings.json"), []byte(`
+{
+  "forwardings": [
+    {
+      "proto": "tcp",
+      "port": "8080",
+      "dest_addr": "192.168.42.23",
+      "dest_port": "80"
+    },
+    {
+      "proto": "udp",
+      "port": "27015-27030",
+      "dest_addr": "192.168.42.23",
+      "dest_port": "27015-27030"
+    }
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "firewall.json"), []byte(`{"anti_spoofing": true, "block_encrypted_dns": ["192.168.42.52"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := buildFirewall(tmp, "uplink0", func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rs.export(&buf)
+	got := buf.String()
+	for _, want := range []string{
+		"table ip nat {\n\tchain prerouting {\n\t\ttype nat hook prerouting priority 0; policy accept;\n",
+		`iifname "uplink0" meta l4proto tcp tcp dport 8080 dnat to 192.168.42.23:80`,
+		`iifname "uplink0" meta l4proto udp udp dport >= 27015 udp dport <= 27030 dnat to 192.168.42.23:27015-27030`,
+		`oifname "uplink0" masquerade`,
+		`iifname "uplink0" ip saddr 10.0.0.0/8 drop`,
+		"\tset doh_providers {\n\t\ttype ipv4_addr\n",
+		`ip saddr 192.168.42.52 meta l4proto tcp tcp dport 443 ip daddr @doh_providers drop`,
+		`oifname "uplink0" meta l4proto tcp tcp flags & 0x02 != 0x00 tcp option maxseg size set rt mtu`,
+		`counter name "fwded"`,
+		`iifname "uplink0" ip daddr 192.168.42.23 meta l4proto tcp tcp dport 80 accept`,
+		`iifname "uplink0" ip daddr 192.168.42.23 meta l4proto udp udp dport >= 27015 udp dport <= 27030 accept`,
+		`iifname "uplink0" ct state new drop`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("export does not contain %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("export:\n%s", got)
+	}
+	if strings.Contains(got, "/*") {
+		t.Errorf("export contains unsupported expressions:\n%s", got)
+	}
+}
+
+func TestPreloadRuleset(t *testing.T) {
+	var buf bytes.Buffer
+	preloadRuleset().export(&buf)
+	got := buf.String()
+	for _, want := range []string{
+		"table inet preload {\n\tchain input {\n\t\ttype filter hook input priority 0; policy drop;\n",
+		`iifname "lan0" accept`,
+		"ct state established,related accept",
+		"\tchain forward {\n\t\ttype filter hook forward priority 0; policy drop;\n\t}\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("export does not contain %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Logf("export:\n%s", got)
+	}
+}
+
+func TestFirewallOrder(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "quota.json"), []byte(`{"quotas": [{"interface": "uplink0", "limit_bytes": 1000, "billing_day": 1, "priority": [{"proto": "tcp", "port": "443"}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "quota"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "quota", "state.json"), []byte(`[{"interface": "uplink0", "exceeded": true}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteBlocks(tmp, []Block{{Addr: "192.168.42.99"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := buildFirewall(tmp, "uplink0", identityCounters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rs.export(&buf)
+	got := buf.String()
+	drop := strings.Index(got, "ip saddr 192.168.42.99 drop")
+	accept := strings.Index(got, `oifname "uplink0" meta l4proto tcp tcp dport 443 accept`)
+	if drop == -1 || accept == -1 {
+		t.Fatalf("block drop or quota accept missing from ruleset:\n%s", got)
+	}
+	if drop > accept {
+		t.Errorf("block drop emitted after quota accept:\n%s", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/conntrack"
+)
+
+// masqueradedUplinks returns the primary uplink ifname and the BackupUplinks
+// which are present.
+func masqueradedUplinks(ifname string) []string {
+	uplinks := []string{ifname}
+	for _, backup := range BackupUplinks {
+		if _, err := net.InterfaceByName(backup); err != nil {
+			continue // backup uplink not present
+		}
+		uplinks = append(uplinks, backup)
+	}
+	return uplinks
+}
+
+// activeUplink is the uplink which carried the IPv4 default route after the
+// previous apply, with its addresses at that time.
+var activeUplink struct {
+	ifname string
+	addrs  []net.IP
+}
+
+// defaultRouteTarget is looked up to find the uplink which carries the
+// default route. No packets are sent to it.
+var defaultRouteTarget = net.ParseIP("192.0.2.1")
+
+// defaultRouteLink returns the link which carries the IPv4 default route, or
+// nil if there is no default route (e.g. all uplinks are down).
+func defaultRouteLink() (netlink.Link, error) {
+	routes, err := netlink.RouteGet(defaultRouteTarget)
+	if err != nil || len(routes) == 0 {
+		return nil, nil
+	}
+	return netlink.LinkByIndex(routes[0].LinkIndex)
+}
+
+// ActiveUplink returns the name of the uplink which currently carries the
+// IPv4 default route, i.e. a backup uplink after failover, or the primary
+// uplink (e.g. ppp0 for PPPoE) if there is no default route.
+func ActiveUplink() (string, error) {
+	link, err := defaultRouteLink()
+	if err != nil {
+		return "", err
+	}
+	if link != nil {
+		return link.Attrs().Name, nil
+	}
+	return uplinkInterface()
+}
+
+// flushFailedOver deletes the conntrack entries of the connections which were
+// masqueraded to the addresses of the previous uplink when the default route
+// moved to another uplink of uplinks (failover, or recovery of the primary
+// uplink): their packets would leave via the new uplink with the source
+// address of the previous one, so the LAN hosts need to reconnect.
+func flushFailedOver(uplinks []string) error {
+	link, err := defaultRouteLink()
+	if err != nil {
+		return err
+	}
+	if link == nil {
+		return nil // no default route, e.g. all uplinks are down
+	}
+	ifname := link.Attrs().Name
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	previous := activeUplink
+	activeUplink.ifname = ifname
+	activeUplink.addrs = activeUplink.addrs[:0:0]
+	for _, addr := range addrs {
+		activeUplink.addrs = append(activeUplink.addrs, addr.IP)
+	}
+	if previous.ifname == "" || previous.ifname == ifname {
+		return nil
+	}
+	masqueraded := false
+	for _, uplink := range uplinks {
+		if uplink == previous.ifname {
+			masqueraded = true
+		}
+	}
+	if !masqueraded {
+		return nil // e.g. a VPN tunnel
+	}
+	for _, addr := range previous.addrs {
+		n, err := conntrack.Delete(&conntrack.Filter{MasqueradedTo: addr})
+		if err != nil {
+			return err
+		}
+		log.Printf("default route moved from %s to %s: deleted %d connections masqueraded to %v", previous.ifname, ifname, n, addr)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFlushFailedOver(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}, PeerName: "uplink1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	defaultRoutes := make(map[string]*netlink.Route)
+	for _, l := range []struct {
+		name, addr, gw string
+		priority       int
+	}{
+		{"uplink0", "203.0.113.2/24", "203.0.113.1", 0},
+		{"uplink1", "198.51.100.2/24", "198.51.100.1", 100},
+	} {
+		link, err := netlink.LinkByName(l.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := netlink.ParseAddr(l.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatal(err)
+		}
+		r := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        net.ParseIP(l.gw),
+			Priority:  l.priority,
+		}
+		if err := netlink.RouteAdd(r); err != nil {
+			t.Fatal(err)
+		}
+		defaultRoutes[l.name] = r
+	}
+	defer func() { activeUplink.ifname, activeUplink.addrs = "", nil }()
+	uplinks := []string{"uplink0", "uplink1"}
+
+	if err := flushFailedOver(uplinks); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := activeUplink.ifname, "uplink0"; got != want {
+		t.Errorf("active uplink: got %s, want %s", got, want)
+	}
+	if got, err := ActiveUplink(); err != nil || got != "uplink0" {
+		t.Errorf("ActiveUplink() = %q, %v, want uplink0, nil", got, err)
+	}
+
+	// Failover: the default route of uplink0 is demoted.
+	if err := netlink.RouteDel(defaultRoutes["uplink0"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushFailedOver(uplinks); err != nil {
+		t.Skipf("flushFailedOver: %v", err) // e.g. conntrack not available
+	}
+	if got, want := activeUplink.ifname, "uplink1"; got != want {
+		t.Errorf("active uplink after failover: got %s, want %s", got, want)
+	}
+	if got, err := ActiveUplink(); err != nil || got != "uplink1" {
+		t.Errorf("ActiveUplink() after failover = %q, %v, want uplink1, nil", got, err)
+	}
+	if got, want := len(activeUplink.addrs), 1; got != want {
+		t.Fatalf("got %d active uplink addresses, want %d", got, want)
+	}
+	if got, want := activeUplink.addrs[0].String(), "198.51.100.2"; got != want {
+		t.Errorf("active uplink address: got %s, want %s", got, want)
+	}
+}
+
+func TestBackupUplinkInbound(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}, PeerName: "uplink1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range []struct {
+		path    string
+		content string
+	}{
+		{"portforwardings.json", `{"forwardings": [{"proto": "tcp", "port": "8080", "dest_addr": "192.168.42.23", "dest_port": "80"}]}`},
+		{"firewall.json", `{"pinholes": [{"host": "NAS", "proto": "tcp", "port": "443"}]}`},
+		{"bindings.json", `{"bindings": [{"hardware_addr": "00:1f:16:31:73:75", "token": "::23"}]}`},
+		{"dhcp4d/leases.json", `[{"hardware_addr": "00:1f:16:31:73:75", "hostname": "nas", "addr": "192.168.42.23"}]`},
+		{"dhcp6/wire/lease.json", `{"prefixes": [{"IP": "2a02:168:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`},
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, f.path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, f.path), []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No subtests: they would run on a different thread, outside of the
+	// network namespace which contains the backup uplink.
+	for _, tt := range []struct {
+		name string
+		src  string
+		dst  string
+		port uint16
+		want string
+	}{
+		{"IPv4", "203.0.113.1", "192.168.42.23", 80, "drop"},
+		{"IPv6", "2001:db8::1", "2a02:168:4a00::23", 22, "drop"},
+		{"Pinhole", "2001:db8::1", "2a02:168:4a00::23", 443, "accept"},
+	} {
+		tr, err := simulateFirewall(tmp, "uplink0", Packet{
+			IIfName: "uplink1",
+			OIfName: "lan0",
+			Src:     net.ParseIP(tt.src),
+			Dst:     net.ParseIP(tt.dst),
+			Proto:   unix.IPPROTO_TCP,
+			SrcPort: 12345,
+			DstPort: tt.port,
+			SYN:     true,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := tr.Verdict; got != tt.want {
+			t.Errorf("%s: unexpected verdict: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// FeatureFlag enables an experimental step (see Applier.Feature).
+type FeatureFlag struct {
+	Enabled bool `json:"enabled"`
+
+	// MaxFailures is the number of consecutive failed runs (errors, panics
+	// or crashes of netconfigd) after which the feature is disabled until it
+	// is reset (see ResetFeature). Default: 3.
+	MaxFailures int `json:"max_failures"`
+}
+
+// ReadFeatureFlags reads features.json from dir, e.g.:
+//
+//	{"flowtable": {"enabled": true}, "nat64": {"enabled": true, "max_failures": 1}}
+//
+// A missing file results in no feature being enabled.
+func ReadFeatureFlags(dir string) (map[string]FeatureFlag, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "features.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var flags map[string]FeatureFlag
+	if err := json.Unmarshal(b, &flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+func (f FeatureFlag) maxFailures() int {
+	if f.MaxFailures <= 0 {
+		return 3
+	}
+	return f.MaxFailures
+}
+
+// FeatureHealth is the health of an enabled feature, as tracked by Apply.
+type FeatureHealth struct {
+	Name string `json:"name"`
+
+	// Failures is the number of consecutive failed runs.
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+
+	// Running is set while the step of the feature runs. If it is still set
+	// when Apply starts, netconfigd crashed while running the step.
+	Running bool `json:"running"`
+
+	// Disabled is set once Failures reached FeatureFlag.MaxFailures.
+	Disabled bool      `json:"disabled"`
+	Since    time.Time `json:"since,omitempty"` // of Disabled
+}
+
+func featureHealthPath(dir string) string {
+	return filepath.Join(dir, "netconfigd", "features.json")
+}
+
+// ReadFeatureHealth reads the health of all features which were run from dir.
+func ReadFeatureHealth(dir string) ([]FeatureHealth, error) {
+	b, err := ioutil.ReadFile(featureHealthPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var health []FeatureHealth
+	if err := json.Unmarshal(b, &health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+func writeFeatureHealth(dir string, health map[string]*FeatureHealth) error {
+	names := make([]string, 0, len(health))
+	for name := range health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]FeatureHealth, 0, len(names))
+	for _, name := range names {
+		list = append(list, *health[name])
+	}
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(featureHealthPath(dir)), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(featureHealthPath(dir), b, 0644)
+}
+
+// ResetFeature clears the health of feature name, re-enabling it if it was
+// disabled, and reports whether the feature had any health recorded.
+func ResetFeature(dir, name string) (bool, error) {
+	list, err := ReadFeatureHealth(dir)
+	if err != nil {
+		return false, err
+	}
+	health := make(map[string]*FeatureHealth)
+	for i := range list {
+		health[list[i].Name] = &list[i]
+	}
+	if _, ok := health[name]; !ok {
+		return false, nil
+	}
+	delete(health, name)
+	return true, writeFeatureHealth(dir, health)
+}
+
+// features decides which experimental steps run and records their health.
+type features struct {
+	dir    string
+	now    func() time.Time
+	flags  map[string]FeatureFlag
+	health map[string]*FeatureHealth
+}
+
+func loadFeatures(dir string, now func() time.Time) (*features, error) {
+	f := &features{
+		dir:    dir,
+		now:    now,
+		health: make(map[string]*FeatureHealth),
+	}
+	var err error
+	if f.flags, err = ReadFeatureFlags(dir); err != nil {
+		return f, fmt.Errorf("features: %v", err)
+	}
+	list, err := ReadFeatureHealth(dir)
+	if err != nil {
+		return f, fmt.Errorf("features: %v", err)
+	}
+	var crashed bool
+	for i := range list {
+		h := &list[i]
+		f.health[h.Name] = h
+		if h.Running {
+			crashed = true
+			h.Running = false
+			f.fail(h.Name, "netconfigd crashed while running the step")
+		}
+	}
+	if crashed {
+		if err := writeFeatureHealth(dir, f.health); err != nil {
+			return f, fmt.Errorf("features: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// enabled reports whether the step of feature name should run.
+func (f *features) enabled(name string) bool {
+	if !f.flags[name].Enabled {
+		return false
+	}
+	if h, ok := f.health[name]; ok && h.Disabled {
+		return false
+	}
+	return true
+}
+
+func (f *features) get(name string) *FeatureHealth {
+	h, ok := f.health[name]
+	if !ok {
+		h = &FeatureHealth{Name: name}
+		f.health[name] = h
+	}
+	return h
+}
+
+func (f *features) fail(name, reason string) {
+	h := f.get(name)
+	h.Failures++
+	h.LastError = reason
+	if !h.Disabled && h.Failures >= f.flags[name].maxFailures() {
+		h.Disabled = true
+		h.Since = f.now()
+		log.Printf("feature %s: disabled after %d consecutive failures (last: %s)", name, h.Failures, reason)
+	}
+}
+
+// run runs s, which belongs to an enabled feature. The feature is marked as
+// running on disk first, so that a crash of netconfigd counts as failure.
+func (f *features) run(s Applier, dir string) (err error) {
+	h := f.get(s.Feature)
+	h.Running = true
+	if err := writeFeatureHealth(f.dir, f.health); err != nil {
+		log.Printf("feature %s: %v", s.Feature, err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		h.Running = false
+		if err != nil {
+			f.fail(s.Feature, err.Error())
+		} else {
+			h.Failures = 0
+			h.LastError = ""
+		}
+		if err := writeFeatureHealth(f.dir, f.health); err != nil {
+			log.Printf("feature %s: %v", s.Feature, err)
+		}
+	}()
+	return s.Apply(dir)
+}
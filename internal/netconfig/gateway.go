@@ -0,0 +1,179 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// gatewayTimeout is how long resolveGateway waits for the gateway to answer
+// the ARP request (or NDP neighbor solicitation).
+const gatewayTimeout = 3 * time.Second
+
+// gateway is the next hop of a default route.
+type gateway struct {
+	ifname    string
+	linkIndex int
+	ip        net.IP
+}
+
+func (gw gateway) String() string {
+	return fmt.Sprintf("gateway %v on %s", gw.ip, gw.ifname)
+}
+
+// gateways returns the gateways of the IPv4 default routes in st (from DHCPv4
+// leases) and of the IPv6 default routes the kernel installed from router
+// advertisements on the uplink.
+func (st *state) gateways(uplink string) []gateway {
+	var gws []gateway
+	for _, ls := range st.links {
+		for _, r := range ls.routes {
+			if r.Gw == nil || (r.Dst != nil && r.Dst.IP != nil && !r.Dst.IP.IsUnspecified()) {
+				continue
+			}
+			gws = append(gws, gateway{ifname: ls.ifname, linkIndex: r.LinkIndex, ip: r.Gw})
+		}
+	}
+	link, err := netlink.LinkByName(uplink)
+	if err != nil {
+		return gws
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return gws
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Gw != nil {
+			gws = append(gws, gateway{ifname: uplink, linkIndex: link.Attrs().Index, ip: r.Gw})
+		}
+	}
+	return gws
+}
+
+// neighborState returns the hardware address of ip if the neighbor table
+// confirms that it is reachable, and whether resolving ip failed.
+func neighborState(neighs []netlink.Neigh, ip net.IP) (hwaddr net.HardwareAddr, failed bool) {
+	for _, n := range neighs {
+		if !n.IP.Equal(ip) {
+			continue
+		}
+		if n.State&(netlink.NUD_REACHABLE|netlink.NUD_PERMANENT|netlink.NUD_NOARP) != 0 &&
+			len(n.HardwareAddr) > 0 {
+			return n.HardwareAddr, false
+		}
+		if n.State&netlink.NUD_FAILED != 0 {
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+// resolveGateway makes the kernel resolve (or re-confirm) the hardware
+// address of gw by sending a datagram to the discard port of gw, and waits
+// until the neighbor table shows gw as reachable.
+func resolveGateway(gw gateway) (net.HardwareAddr, error) {
+	family := netlink.FAMILY_V4
+	addr := &net.UDPAddr{IP: gw.ip, Port: 9 /* discard */}
+	if gw.ip.To4() == nil {
+		family = netlink.FAMILY_V6
+		if gw.ip.IsLinkLocalUnicast() {
+			addr.Zone = gw.ifname
+		}
+	}
+	d := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, gw.ifname)
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := d.Dial("udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		return nil, err
+	}
+	for deadline := time.Now().Add(gatewayTimeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		neighs, err := netlink.NeighList(gw.linkIndex, family)
+		if err != nil {
+			return nil, err
+		}
+		hwaddr, failed := neighborState(neighs, gw.ip)
+		if hwaddr != nil {
+			return hwaddr, nil
+		}
+		if failed {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no ARP/NDP reply within %v", gatewayTimeout)
+}
+
+// resolving holds the gateways (see gateway.String) which are being resolved,
+// so that an Apply while a gateway does not answer yet does not start another
+// probe of it.
+var (
+	resolvingMu sync.Mutex
+	resolving   = make(map[string]bool)
+)
+
+// resolve is resolveGateway, overridden in tests.
+var resolve = resolveGateway
+
+// resolveGateways pre-populates the neighbor table with the gateways of all
+// default routes, so that the first packets of new connections are not
+// delayed or lost. The gateways are resolved in the background, as an
+// unreachable gateway must not delay Apply (and thereby e.g. the restart of
+// the daemons which listen on new addresses) for up to gatewayTimeout.
+// Unreachable gateways are logged explicitly: they are a problem of the
+// uplink rather than of the configuration, so they do not fail Apply.
+func (st *state) resolveGateways(uplink string) {
+	for _, gw := range st.gateways(uplink) {
+		key := gw.String()
+		resolvingMu.Lock()
+		if resolving[key] {
+			resolvingMu.Unlock()
+			continue
+		}
+		resolving[key] = true
+		resolvingMu.Unlock()
+		go func(gw gateway) {
+			defer func() {
+				resolvingMu.Lock()
+				delete(resolving, key)
+				resolvingMu.Unlock()
+			}()
+			hwaddr, err := resolve(gw)
+			if err != nil {
+				log.Printf("%v unreachable: %v", gw, err)
+				return
+			}
+			log.Printf("%v reachable via %v", gw, hwaddr)
+		}(gw)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// FirewallGeneration describes a firewall ruleset installed by Apply.
+// Generations are numbered consecutively for the lifetime of the process.
+type FirewallGeneration struct {
+	Num       uint64    `json:"num"`
+	Activated time.Time `json:"activated"`
+	Rules     int       `json:"rules"`
+}
+
+type generation struct {
+	FirewallGeneration
+	rs    *ruleset
+	netns int // of the nftables.Conn which activated rs
+}
+
+// generations holds the active and the previous firewall generation. The
+// lock is held while a generation is being installed, so that Apply and
+// RollbackFirewall do not interleave.
+var generations struct {
+	sync.Mutex
+	last     uint64 // number of the last generation handed out
+	current  *generation
+	previous *generation
+}
+
+// commitFirewall replaces the kernel ruleset with rs in a single transaction
+// and verifies that the transaction was committed: the nftables package only
+// reads the first response of a batch, so a transaction which the kernel
+// rejected (e.g. due to an invalid rule) would otherwise go unnoticed.
+func commitFirewall(c *nftables.Conn, rs *ruleset) error {
+	if err := rs.apply(c); err != nil {
+		return err
+	}
+	live, err := liveRuleset(c)
+	if err != nil {
+		return err
+	}
+	diffs, err := rs.diff(live)
+	if err != nil {
+		return err
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("transaction not committed: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// activateFirewall installs rs as a new generation, replacing the entire
+// kernel ruleset in a single transaction. When the transaction fails, the
+// kernel keeps the current generation.
+func activateFirewall(c *nftables.Conn, rs *ruleset) (FirewallGeneration, error) {
+	generations.Lock()
+	defer generations.Unlock()
+	if err := commitFirewall(c, rs); err != nil {
+		return FirewallGeneration{}, err
+	}
+	generations.last++
+	gen := &generation{
+		FirewallGeneration: FirewallGeneration{
+			Num:       generations.last,
+			Activated: time.Now(),
+			Rules:     len(rs.rules),
+		},
+		rs:    rs,
+		netns: c.NetNS,
+	}
+	if generations.current != nil {
+		generations.previous = generations.current
+	}
+	generations.current = gen
+	return gen.FirewallGeneration, nil
+}
+
+// FirewallGenerations returns the active and the previous firewall generation,
+// or nil if there is none.
+func FirewallGenerations() (current, previous *FirewallGeneration) {
+	generations.Lock()
+	defer generations.Unlock()
+	if g := generations.current; g != nil {
+		fg := g.FirewallGeneration
+		current = &fg
+	}
+	if g := generations.previous; g != nil {
+		fg := g.FirewallGeneration
+		previous = &fg
+	}
+	return current, previous
+}
+
+// RollbackFirewall re-activates the previous firewall generation in a single
+// transaction. The generations swap places, so a second RollbackFirewall
+// undoes the first. The rollback lasts until the next Apply.
+func RollbackFirewall() (FirewallGeneration, error) {
+	generations.Lock()
+	defer generations.Unlock()
+	prev := generations.previous
+	if prev == nil {
+		return FirewallGeneration{}, fmt.Errorf("no previous firewall generation")
+	}
+	if err := commitFirewall(&nftables.Conn{NetNS: prev.netns}, prev.rs); err != nil {
+		return FirewallGeneration{}, err
+	}
+	prev.Activated = time.Now()
+	generations.previous, generations.current = generations.current, prev
+	return prev.FirewallGeneration, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// TestFirewallGenerations installs two generations in a new network
+// namespace, verifies that a failing transaction keeps the active generation
+// and rolls back to the first generation.
+func TestFirewallGenerations(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	// The netlink package dials from a thread of its own, which is not in
+	// the new network namespace.
+	ns, err := unix.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(ns)
+
+	build := func(verdicts ...expr.VerdictKind) *ruleset {
+		var rs ruleset
+		filter := rs.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+		forward := rs.AddChain(&nftables.Chain{
+			Name:     "forward",
+			Hooknum:  nftables.ChainHookForward,
+			Priority: nftables.ChainPriorityFilter,
+			Table:    filter,
+			Type:     nftables.ChainTypeFilter,
+		})
+		for _, v := range verdicts {
+			rs.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: []expr.Any{&expr.Verdict{Kind: v}},
+			})
+		}
+		return &rs
+	}
+	verify := func(want *ruleset) {
+		t.Helper()
+		got, err := liveRuleset(&nftables.Conn{NetNS: ns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		diffs, err := want.diff(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range diffs {
+			t.Errorf("live ruleset: %s", d)
+		}
+	}
+
+	if _, err := RollbackFirewall(); err == nil {
+		t.Errorf("RollbackFirewall without previous generation unexpectedly succeeded")
+	}
+
+	c := &nftables.Conn{NetNS: ns}
+	first := build(expr.VerdictAccept)
+	gen1, err := activateFirewall(c, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := build(expr.VerdictAccept, expr.VerdictDrop)
+	gen2, err := activateFirewall(c, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen2.Num != gen1.Num+1 {
+		t.Errorf("generation numbers: got %d after %d, want consecutive numbers", gen2.Num, gen1.Num)
+	}
+	verify(second)
+
+	// A rule in a chain which is not part of the ruleset fails the
+	// transaction, which must not leave a partial ruleset behind.
+	broken := build(expr.VerdictDrop)
+	broken.rules = append(broken.rules, &nftables.Rule{
+		Table: broken.tables[0],
+		Chain: &nftables.Chain{Name: "nonexistent", Table: broken.tables[0]},
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+	})
+	if _, err := activateFirewall(c, broken); err == nil {
+		t.Fatalf("activateFirewall(broken) unexpectedly succeeded")
+	}
+	verify(second)
+	if cur, _ := FirewallGenerations(); cur == nil || cur.Num != gen2.Num {
+		t.Errorf("current generation after failed transaction = %+v, want %d", cur, gen2.Num)
+	}
+
+	rolledBack, err := RollbackFirewall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack.Num != gen1.Num {
+		t.Errorf("RollbackFirewall activated generation %d, want %d", rolledBack.Num, gen1.Num)
+	}
+	verify(first)
+	cur, prev := FirewallGenerations()
+	if cur.Num != gen1.Num || prev.Num != gen2.Num {
+		t.Errorf("FirewallGenerations = %d, %d; want %d, %d", cur.Num, prev.Num, gen1.Num, gen2.Num)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// UplinkHealth is written by diagd to /perm/diagd/health.json when uplink
+// health arbitration is enabled (see /perm/health.json).
+type UplinkHealth struct {
+	Interface string    `json:"interface"` // e.g. uplink0
+	Healthy   bool      `json:"healthy"`
+	Since     time.Time `json:"since"`
+}
+
+// unhealthyPriority is the priority of the default route of an uplink which
+// diagd declared unhealthy. It is higher than the priorities of the
+// BackupUplinks, so that traffic fails over while the route remains
+// available for probing the uplink.
+const unhealthyPriority = 1000
+
+// uplinkHealthy returns false if diagd declared ifname unhealthy. Missing or
+// unreadable state is considered healthy.
+func uplinkHealthy(dir, ifname string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "diagd", "health.json"))
+	if err != nil {
+		return true
+	}
+	var health UplinkHealth
+	if err := json.Unmarshal(b, &health); err != nil {
+		return true
+	}
+	return health.Interface != ifname || health.Healthy
+}
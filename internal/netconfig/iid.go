@@ -0,0 +1,189 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/renameio"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IPv6Settings configure the IPv6 addresses which the router autoconfigures
+// (SLAAC) on an uplink, e.g. for ISPs which filter by interface identifier.
+// Changes take effect for addresses autoconfigured after the next router
+// advertisement or link flap.
+type IPv6Settings struct {
+	// IID selects the interface identifier of autoconfigured addresses:
+	// “eui64” (default: derived from the MAC address), “stable-privacy”
+	// (RFC 7217: stable per prefix, but not derived from the MAC address),
+	// “random” or “token” (see Token).
+	IID string `json:"iid,omitempty"`
+
+	// Token is the static interface identifier for IID “token”, e.g. ::1.
+	Token string `json:"token,omitempty"`
+
+	// TemporaryAddresses enables temporary addresses (RFC 4941), which are
+	// preferred for connections the router itself initiates.
+	TemporaryAddresses bool `json:"temporary_addresses,omitempty"`
+}
+
+// addr_gen_mode values, from include/uapi/linux/if_link.h
+const (
+	addrGenModeEUI64         = 0
+	addrGenModeStablePrivacy = 2
+	addrGenModeRandom        = 3
+)
+
+// iidState is the IPv6 address generation configuration of one link.
+type iidState struct {
+	ifname  string
+	sysctls []string
+	token   net.IP // nil unless IID is “token”
+}
+
+func stableSecretPath(dir string) string {
+	return filepath.Join(dir, "netconfigd", "stable_secret")
+}
+
+// stableSecret returns the secret from which the kernel derives
+// stable-privacy interface identifiers. It is generated once and persisted,
+// so that the addresses are stable across reboots.
+func stableSecret(dir string) (string, error) {
+	b, err := ioutil.ReadFile(stableSecretPath(dir))
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	secret := make(net.IP, net.IPv6len)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(stableSecretPath(dir)), 0755); err != nil {
+		return "", err
+	}
+	if err := renameio.WriteFile(stableSecretPath(dir), []byte(secret.String()+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return secret.String(), nil
+}
+
+func (s *IPv6Settings) state(dir, ifname string) (*iidState, error) {
+	st := &iidState{ifname: ifname}
+	prefix := "net.ipv6.conf." + ifname + "."
+	mode := addrGenModeEUI64
+	switch s.IID {
+	case "", "eui64":
+	case "stable-privacy":
+		secret, err := stableSecret(dir)
+		if err != nil {
+			return nil, err
+		}
+		st.sysctls = append(st.sysctls, prefix+"stable_secret="+secret)
+		mode = addrGenModeStablePrivacy
+	case "random":
+		mode = addrGenModeRandom
+	case "token":
+		st.token = net.ParseIP(s.Token)
+		if st.token == nil || st.token.To4() != nil {
+			return nil, fmt.Errorf("invalid token %q, expected e.g. ::1", s.Token)
+		}
+	default:
+		return nil, fmt.Errorf("unknown iid %q, expected eui64, stable-privacy, random or token", s.IID)
+	}
+	useTempaddr := 0
+	if s.TemporaryAddresses {
+		useTempaddr = 2 // generate and prefer temporary addresses
+	}
+	st.sysctls = append(st.sysctls,
+		fmt.Sprintf("%saddr_gen_mode=%d", prefix, mode),
+		fmt.Sprintf("%suse_tempaddr=%d", prefix, useTempaddr))
+	return st, nil
+}
+
+// iidStates returns the IPv6 address generation configuration of the present
+// links in interfaces.json which have IPv6Settings.
+func iidStates(dir string) ([]*iidState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	var states []*iidState
+	for _, details := range cfg.Interfaces {
+		if details.IPv6 == nil {
+			continue
+		}
+		if _, err := net.InterfaceByName(details.Name); err != nil {
+			continue // link not present
+		}
+		st, err := details.IPv6.state(dir, details.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", details.Name, err)
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// iflaInet6Token is IFLA_INET6_TOKEN from include/uapi/linux/if_link.h
+const iflaInet6Token = 7
+
+// setToken sets the IPv6 token (like ip token set) of ifname, which requires
+// the link to accept router advertisements.
+func setToken(ifname string, token net.IP) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_INET6)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	afSpec := nl.NewRtAttr(unix.IFLA_AF_SPEC, nil)
+	inet6 := afSpec.AddRtAttr(unix.AF_INET6, nil)
+	inet6.AddRtAttr(iflaInet6Token, token.To16())
+	req.AddData(afSpec)
+	_, err = req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+func (st *state) applyTokens(appendError func(error)) {
+	for _, iid := range st.iids {
+		if iid.token == nil {
+			continue
+		}
+		if err := setToken(iid.ifname, iid.token); err != nil {
+			appendError(fmt.Errorf("ipv6 token %v on %s: %v", iid.token, iid.ifname, err))
+		}
+	}
+}
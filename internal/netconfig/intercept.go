@@ -0,0 +1,248 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// InterceptionConfig configures the transparent interception of TCP
+// connections (e.g. for security research using mitmproxy in transparent
+// mode). The proxy is user-provided and must listen on ProxyPort of all
+// addresses with the IP_TRANSPARENT socket option.
+type InterceptionConfig struct {
+	Clients   []string `json:"clients"`    // as in FirewallConfig.DNSRedirect
+	Ports     []uint16 `json:"ports"`      // default: 80, 443
+	ProxyPort uint16   `json:"proxy_port"` // e.g. 8080
+}
+
+const (
+	// interceptMark marks intercepted packets, which are routed to the local
+	// proxy via interceptTable.
+	interceptMark  = 0x10000
+	interceptTable = 100
+)
+
+func readInterceptionConfig(dir string) (*InterceptionConfig, error) {
+	cfg, err := readFirewallConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	ic := cfg.Interception
+	if ic == nil || len(ic.Clients) == 0 {
+		return nil, nil
+	}
+	if ic.ProxyPort == 0 {
+		return nil, fmt.Errorf("interception: proxy_port must be set")
+	}
+	if len(ic.Ports) == 0 {
+		ic.Ports = []uint16{80, 443}
+	}
+	return ic, nil
+}
+
+// applyInterception adds rules which deliver the TCP connections of the
+// configured clients to the transparent proxy.
+func applyInterception(dir string, c *ruleset, filter4 *nftables.Table) error {
+	ic, err := readInterceptionConfig(dir)
+	if err != nil {
+		return err
+	}
+	if ic == nil {
+		return nil
+	}
+	prerouting := c.AddChain(&nftables.Chain{
+		Name:     "intercept",
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+		Table:    filter4,
+		Type:     nftables.ChainTypeFilter,
+	})
+	for _, client := range ic.Clients {
+		match, err := clientExprs(client)
+		if err != nil {
+			return fmt.Errorf("interception: %v", err)
+		}
+		for _, port := range ic.Ports {
+			exprs := iifnameExprs("lan0")
+			exprs = append(exprs, match...)
+			exprs = append(exprs,
+				// [ meta load l4proto => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				// [ cmp eq reg 1 0x00000006 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte{unix.IPPROTO_TCP},
+				},
+				// [ payload load 2b @ transport header + 2 => reg 1 ]
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseTransportHeader,
+					Offset:       2, // destination port
+					Len:          2,
+				},
+				// [ cmp eq reg 1 0x00005000 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     binaryutil.BigEndian.PutUint16(port),
+				},
+				// [ immediate reg 1 0x00010000 ]
+				&expr.Immediate{
+					Register: 1,
+					Data:     binaryutil.NativeEndian.PutUint32(interceptMark),
+				},
+				// [ meta set mark with reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+				// [ immediate reg 1 0x0000901f ]
+				&expr.Immediate{
+					Register: 1,
+					Data:     binaryutil.BigEndian.PutUint16(ic.ProxyPort),
+				},
+				// [ tproxy ip port reg 1 ]
+				&expr.TProxy{
+					Family:      unix.NFPROTO_IPV4,
+					TableFamily: unix.NFPROTO_IPV4,
+					RegPort:     1,
+				},
+				// [ immediate reg 0 accept ]
+				&expr.Verdict{Kind: expr.VerdictAccept})
+			c.AddRule(&nftables.Rule{
+				Table: filter4,
+				Chain: prerouting,
+				Exprs: exprs,
+			})
+		}
+	}
+	return nil
+}
+
+// interceptionState returns the policy routing which delivers packets marked
+// by applyInterception locally.
+func interceptionState(dir string) (*linkState, []*netlink.Rule, error) {
+	ic, err := readInterceptionConfig(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ic == nil {
+		return nil, nil, nil
+	}
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return nil, nil, err
+	}
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V4
+	rule.Mark = interceptMark
+	rule.Mask = interceptMark
+	rule.Table = interceptTable
+	return &linkState{
+		source: "interception",
+		ifname: "lo",
+		routes: []*netlink.Route{
+			{
+				LinkIndex: lo.Attrs().Index,
+				Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+				Type:      unix.RTN_LOCAL,
+				Scope:     netlink.SCOPE_HOST,
+				Table:     interceptTable,
+				Protocol:  rtprotIntercept,
+			},
+		},
+		ownedProtocol: rtprotIntercept,
+	}, []*netlink.Rule{rule}, nil
+}
+
+// ownedRuleTables are the routing tables whose policy routing rules are
+// managed by netconfig: rules referencing them are removed unless desired.
+var ownedRuleTables = map[int]bool{
+	interceptTable: true,
+}
+
+// sameRule reports whether the existing rule a matches the desired rule b.
+// Rules without priority (-1) match regardless of the priority the kernel
+// picked.
+func sameRule(a, b *netlink.Rule) bool {
+	prefix := func(n *net.IPNet) string {
+		if n == nil {
+			return ""
+		}
+		return n.String()
+	}
+	return a.Family == b.Family &&
+		a.Table == b.Table &&
+		a.Mark == b.Mark &&
+		a.Mask == b.Mask &&
+		(b.Priority < 0 || a.Priority == b.Priority) &&
+		prefix(a.Src) == prefix(b.Src) &&
+		prefix(a.Dst) == prefix(b.Dst)
+}
+
+func (st *state) applyRules(appendError func(error)) {
+	var existing []netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			appendError(fmt.Errorf("rules: RuleList: %v", err))
+			return
+		}
+		for _, r := range rules {
+			r.Family = family // not filled in by RuleList
+			existing = append(existing, r)
+		}
+	}
+	for idx := range existing {
+		r := &existing[idx]
+		if !ownedRuleTables[r.Table] && !ownedRulePriority(r.Priority) {
+			continue
+		}
+		var desired bool
+		for _, want := range st.rules {
+			if sameRule(r, want) {
+				desired = true
+				break
+			}
+		}
+		if desired {
+			continue
+		}
+		if err := netlink.RuleDel(r); err != nil {
+			appendError(fmt.Errorf("rules: RuleDel(table %d): %v", r.Table, err))
+		}
+	}
+	for _, want := range st.rules {
+		var found bool
+		for idx := range existing {
+			if sameRule(&existing[idx], want) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if err := netlink.RuleAdd(want); err != nil {
+			appendError(fmt.Errorf("rules: RuleAdd(table %d): %v", want.Table, err))
+		}
+	}
+}
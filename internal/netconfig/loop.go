@@ -0,0 +1,285 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// etherTypeLoopback is the EtherType of the Ethernet configuration testing
+// protocol, which switches commonly use for loop detection probes.
+const etherTypeLoopback = 0x9000
+
+// loopMagic identifies router7 loop detection probes.
+var loopMagic = []byte("rtr7loop")
+
+// loopTimeout is how long DetectLoops waits for probes to arrive back.
+const loopTimeout = 1 * time.Second
+
+// Loop is a LAN loop detected by DetectLoops: a probe sent from member
+// SentOn of bridge Bridge arrived back at member ReceivedOn (which can be the
+// same member, e.g. for a loop within a downstream switch).
+type Loop struct {
+	Bridge     string // e.g. lan0
+	SentOn     string // e.g. lan1
+	ReceivedOn string // e.g. lan2
+
+	// DisablePort is copied from the bridge’s LoopDetection.
+	DisablePort bool
+}
+
+func (l Loop) String() string {
+	return fmt.Sprintf("bridge %s: probe sent on %s arrived back on %s", l.Bridge, l.SentOn, l.ReceivedOn)
+}
+
+// loopProbe returns a broadcast frame from src carrying nonce and the index
+// of the sending member.
+func loopProbe(src net.HardwareAddr, nonce []byte, ifindex int) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	b.Write(src)
+	binary.Write(&b, binary.BigEndian, uint16(etherTypeLoopback))
+	b.Write(loopMagic)
+	b.Write(nonce)
+	binary.Write(&b, binary.BigEndian, uint32(ifindex))
+	// Pad to the minimum Ethernet frame size (without FCS).
+	for b.Len() < 60 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// parseLoopProbe returns the index of the member which sent the probe frame
+// b, if b is a probe carrying nonce.
+func parseLoopProbe(b, nonce []byte) (ifindex int, ok bool) {
+	const hdr = 14
+	if len(b) < hdr+len(loopMagic)+len(nonce)+4 ||
+		binary.BigEndian.Uint16(b[12:]) != etherTypeLoopback {
+		return 0, false
+	}
+	b = b[hdr:]
+	if !bytes.HasPrefix(b, loopMagic) {
+		return 0, false
+	}
+	b = b[len(loopMagic):]
+	if !bytes.Equal(b[:len(nonce)], nonce) {
+		return 0, false // e.g. a probe of a previous run
+	}
+	return int(binary.BigEndian.Uint32(b[len(nonce):])), true
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+// listenLoop returns a packet socket on the member with index ifindex, on
+// which probes are sent and received.
+func listenLoop(ifindex int) (int, error) {
+	// Sockets bound to a specific protocol only receive frames which the
+	// bridge does not consume, so receive all frames and filter in the
+	// kernel instead.
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, err
+	}
+	filter, err := bpf.Assemble([]bpf.Instruction{
+		bpf.LoadAbsolute{Off: 12, Size: 2},
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: etherTypeLoopback, SkipTrue: 1},
+		bpf.RetConstant{Val: 0xffff},
+		bpf.RetConstant{Val: 0},
+	})
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	prog := make([]unix.SockFilter, len(filter))
+	for i, ins := range filter {
+		prog[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  ifindex,
+	}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	tv := unix.NsecToTimeval((100 * time.Millisecond).Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// detectLoops sends a probe from each member of br which is up and reports
+// the probes which arrive back at a member within loopTimeout.
+func detectLoops(br BridgeDetails) ([]Loop, error) {
+	bridge, err := netlink.LinkByName(br.Name)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	fds := make(map[int]int) // by ifindex
+	names := make(map[int]string)
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	for _, member := range br.Members {
+		l, err := netlink.LinkByName(member)
+		if err != nil ||
+			l.Attrs().MasterIndex != bridge.Attrs().Index ||
+			l.Attrs().Flags&net.FlagUp == 0 {
+			continue
+		}
+		idx := l.Attrs().Index
+		fd, err := listenLoop(idx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", member, err)
+		}
+		fds[idx] = fd
+		names[idx] = member
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		loops []Loop
+		seen  = make(map[Loop]bool)
+	)
+	deadline := time.Now().Add(loopTimeout)
+	for idx, fd := range fds {
+		wg.Add(1)
+		go func(idx, fd int) {
+			defer wg.Done()
+			buf := make([]byte, 1514)
+			for time.Now().Before(deadline) {
+				n, from, err := unix.Recvfrom(fd, buf, 0)
+				if err != nil {
+					continue // timeout (or interrupted)
+				}
+				if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+					continue // our own probe
+				}
+				sender, ok := parseLoopProbe(buf[:n], nonce)
+				if !ok {
+					continue
+				}
+				l := Loop{
+					Bridge:      br.Name,
+					SentOn:      names[sender],
+					ReceivedOn:  names[idx],
+					DisablePort: br.LoopDetection != nil && br.LoopDetection.DisablePort,
+				}
+				mu.Lock()
+				if !seen[l] {
+					seen[l] = true
+					loops = append(loops, l)
+				}
+				mu.Unlock()
+			}
+		}(idx, fd)
+	}
+	for idx, fd := range fds {
+		probe := loopProbe(bridge.Attrs().HardwareAddr, nonce, idx)
+		if err := unix.Sendto(fd, probe, 0, &unix.SockaddrLinklayer{
+			Protocol: htons(etherTypeLoopback),
+			Ifindex:  idx,
+			Halen:    6,
+			Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		}); err != nil {
+			log.Printf("bridge %s: sending loop probe on %s: %v", br.Name, names[idx], err)
+		}
+	}
+	wg.Wait()
+	return loops, nil
+}
+
+// DetectLoops probes the bridges of interfaces.json in dir which have
+// LoopDetection enabled for loops.
+func DetectLoops(dir string) ([]Loop, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	var loops []Loop
+	for _, br := range cfg.Bridges {
+		if br.LoopDetection == nil {
+			continue
+		}
+		l, err := detectLoops(br)
+		if err != nil {
+			return nil, fmt.Errorf("bridge %s: %v", br.Name, err)
+		}
+		loops = append(loops, l...)
+	}
+	return loops, nil
+}
+
+var (
+	loopDisabledMu sync.Mutex
+	// loopDisabledPorts are the members which DisableLoopPort set down, so
+	// that Apply does not set them up again.
+	loopDisabledPorts = make(map[string]bool)
+)
+
+func loopDisabled(member string) bool {
+	loopDisabledMu.Lock()
+	defer loopDisabledMu.Unlock()
+	return loopDisabledPorts[member]
+}
+
+// DisableLoopPort sets the member at which the probe of l arrived back down.
+// The member stays down until the process (netconfigd) restarts.
+func DisableLoopPort(l Loop) error {
+	link, err := netlink.LinkByName(l.ReceivedOn)
+	if err != nil {
+		return err
+	}
+	loopDisabledMu.Lock()
+	loopDisabledPorts[l.ReceivedOn] = true
+	loopDisabledMu.Unlock()
+	return netlink.LinkSetDown(link)
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestLoopProbe(t *testing.T) {
+	src := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	probe := loopProbe(src, nonce, 42)
+	if got, want := len(probe), 60; got != want {
+		t.Errorf("len(probe) = %d, want %d", got, want)
+	}
+	ifindex, ok := parseLoopProbe(probe, nonce)
+	if !ok || ifindex != 42 {
+		t.Errorf("parseLoopProbe = %d, %v, want 42, true", ifindex, ok)
+	}
+	if _, ok := parseLoopProbe(probe, []byte{8, 7, 6, 5, 4, 3, 2, 1}); ok {
+		t.Errorf("parseLoopProbe unexpectedly accepted a probe with a different nonce")
+	}
+	if _, ok := parseLoopProbe(probe[:20], nonce); ok {
+		t.Errorf("parseLoopProbe unexpectedly accepted a truncated probe")
+	}
+}
+
+// TestDetectLoops connects two members of a bridge with each other (a veth
+// pair) in a new network namespace. STP keeps the members from forwarding
+// while the test runs, which would otherwise result in a broadcast storm.
+func TestDetectLoops(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	if err := netlink.LinkAdd(&netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "lan1"},
+		PeerName:  "lan2",
+	}); err != nil {
+		t.Skipf("adding veth link: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{
+  "bridges": [
+    {
+      "name": "br0",
+      "members": ["lan1", "lan2"],
+      "stp": {},
+      "loop_detection": {
+        "disable_port": true
+      }
+    }
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyInterfaces(tmp, tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	loops, err := DetectLoops(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(loops, func(i, j int) bool { return loops[i].SentOn < loops[j].SentOn })
+	want := []Loop{
+		{Bridge: "br0", SentOn: "lan1", ReceivedOn: "lan2", DisablePort: true},
+		{Bridge: "br0", SentOn: "lan2", ReceivedOn: "lan1", DisablePort: true},
+	}
+	if diff := cmp.Diff(want, loops); diff != "" {
+		t.Fatalf("DetectLoops: unexpected loops: diff (-want +got):\n%s", diff)
+	}
+
+	if err := DisableLoopPort(loops[0]); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		loopDisabledMu.Lock()
+		defer loopDisabledMu.Unlock()
+		delete(loopDisabledPorts, "lan2")
+	}()
+	// Applying again must not enable the disabled member.
+	if _, err := applyInterfaces(tmp, tmp); err != nil {
+		t.Fatal(err)
+	}
+	l, err := netlink.LinkByName("lan2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Attrs().Flags&net.FlagUp != 0 {
+		t.Errorf("lan2 unexpectedly up after DisableLoopPort")
+	}
+	if loops, err := DetectLoops(tmp); err != nil {
+		t.Fatal(err)
+	} else if len(loops) > 0 {
+		t.Errorf("DetectLoops after DisableLoopPort: got %v, want none", loops)
+	}
+}
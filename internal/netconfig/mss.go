@@ -0,0 +1,78 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// mssClampInterfaces returns the names of the interfaces (in addition to the
+// uplink, which is always clamped) for which TCP MSS clamping rules are
+// generated, unless overridden by mss_clamp in interfaces.json: the PPPoE
+// session (ppp0, see uplinkInterface), the tunnels of tunnels.json, the
+// WireGuard interfaces and interfaces configured with an MTU smaller than
+// 1500. The set is derived from the configuration, not from the kernel, so
+// that rules exist before the links and routes are set up.
+func mssClampInterfaces(dir, uplink string) ([]string, error) {
+	clamp := make(map[string]bool)
+
+	if _, err := os.Stat(filepath.Join(dir, "pppoe.json")); err == nil {
+		clamp["ppp0"] = true
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	tunnels, err := readTunnels(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tunnels.Tunnels {
+		clamp[t.Name] = true
+	}
+
+	wg, err := readWireGuard(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range wg.Interfaces {
+		clamp[iface.Name] = true
+	}
+
+	cfg, err := readInterfaceConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, details := range cfg.Interfaces {
+		if details.MTU > 0 && details.MTU < 1500 {
+			clamp[details.Name] = true
+		}
+	}
+	for _, details := range cfg.Interfaces {
+		if details.MSSClamp != nil {
+			clamp[details.Name] = *details.MSSClamp
+		}
+	}
+
+	var names []string
+	for name, ok := range clamp {
+		if ok && name != uplink {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
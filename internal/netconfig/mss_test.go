@@ -0,0 +1,81 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMSSClamp(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for fn, content := range map[string]string{
+		// uplink1 has a low MTU, but mss_clamp: false
+		"interfaces.json": `{"interfaces": [
+  {"name": "uplink1", "mtu": 1400, "mss_clamp": false},
+  {"name": "uplink2", "mtu": 1480},
+  {"name": "lan0", "mtu": 9000},
+  {"name": "lan1", "mss_clamp": true}
+]}`,
+		"tunnels.json":   `{"tunnels": [{"name": "gre0", "type": "gre", "local": "10.0.137.1", "remote": "10.0.137.2"}]}`,
+		"wireguard.json": `{"interfaces": [{"name": "wg0"}]}`,
+		"pppoe.json":     `{"username": "user"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := mssClampInterfaces(tmp, "uplink0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"gre0", "lan1", "ppp0", "uplink2", "wg0"}, got); diff != "" {
+		t.Errorf("mssClampInterfaces: diff (-want +got):\n%s", diff)
+	}
+
+	rs, err := buildFirewall(tmp, "uplink0", identityCounters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rs.export(&buf)
+	export := buf.String()
+	const clamp = " meta l4proto tcp tcp flags & 0x02 != 0x00 tcp option maxseg size set rt mtu"
+	for _, ifname := range []string{"uplink0", "gre0", "lan1", "ppp0", "uplink2", "wg0"} {
+		// once for IPv4, once for IPv6
+		if got, want := strings.Count(export, `oifname "`+ifname+`"`+clamp), 2; got != want {
+			t.Errorf("%s: %d MSS clamping rules, want %d", ifname, got, want)
+		}
+	}
+	for _, ifname := range []string{"uplink1", "lan0"} {
+		if strings.Contains(export, `oifname "`+ifname+`"`+clamp) {
+			t.Errorf("%s unexpectedly MSS clamped", ifname)
+		}
+	}
+	if t.Failed() {
+		t.Logf("export:\n%s", export)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// tunnelOverhead is the per-packet overhead of tunnel link types, assuming
+// an IPv6 underlay (worst case).
+var tunnelOverhead = map[string]int{
+	"wireguard": 80, // IPv6 (40) + UDP (8) + WireGuard (32)
+	"gre":       48, // IPv6 (40) + GRE with key (8)
+	"ip6gre":    48,
+	"gretap":    62, // IPv6 (40) + GRE with key (8) + Ethernet (14)
+	"ip6gretap": 62,
+	"vxlan":     70, // IPv6 (40) + UDP (8) + VXLAN (8) + Ethernet (14)
+}
+
+func applyMTU(l netlink.Link, mtu int) error {
+	if mtu == 0 || l.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := netlink.LinkSetMTU(l, mtu); err != nil {
+		// e.g. EINVAL when exceeding the maximum MTU of the network card
+		return fmt.Errorf("LinkSetMTU(%s, %d): %v (does the network card support this MTU?)", l.Attrs().Name, mtu, err)
+	}
+	return nil
+}
+
+// checkMTU verifies that link MTUs are coherent: tunnel links are clamped so
+// that their packets fit into their parent link (the underlay) without
+// fragmentation, and bridge members which do not support the MTU of their
+// bridge result in a warning. MTUs configured in interfaces.json in dir are
+// never changed.
+func checkMTU(dir string) error {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	byIndex := make(map[int]netlink.Link)
+	for _, l := range links {
+		byIndex[l.Attrs().Index] = l
+	}
+	for _, l := range links {
+		attr := l.Attrs()
+		if master, ok := byIndex[attr.MasterIndex]; ok && attr.MTU < master.Attrs().MTU {
+			log.Printf("WARNING: %s: MTU %d is smaller than MTU %d of %s, large frames will be dropped",
+				attr.Name, attr.MTU, master.Attrs().MTU, master.Attrs().Name)
+		}
+	}
+
+	cfg, err := readInterfaceConfig(dir)
+	if err != nil {
+		return err
+	}
+	configured := make(map[string]bool)
+	for _, details := range cfg.Interfaces {
+		if details.MTU != 0 {
+			configured[details.Name] = true
+		}
+	}
+	tunnels, err := readTunnels(dir)
+	if err != nil {
+		return err
+	}
+	wg, err := readWireGuard(dir)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, l := range links {
+		overhead, ok := tunnelOverhead[l.Type()]
+		if !ok {
+			continue
+		}
+		attr := l.Attrs()
+		parent := tunnelParent(l, byIndex, tunnels, wg)
+		if parent == nil {
+			continue // underlay unknown, e.g. wireguard without endpoints
+		}
+		max := parent.Attrs().MTU - overhead
+		if attr.MTU <= max {
+			continue
+		}
+		if configured[attr.Name] {
+			log.Printf("WARNING: %s: configured MTU %d exceeds %s MTU %d minus %d bytes %s overhead, packets will be fragmented",
+				attr.Name, attr.MTU, parent.Attrs().Name, parent.Attrs().MTU, overhead, l.Type())
+			continue
+		}
+		log.Printf("clamping MTU of %s from %d to %d: %s MTU %d minus %d bytes %s overhead would result in fragmentation",
+			attr.Name, attr.MTU, max, parent.Attrs().Name, parent.Attrs().MTU, overhead, l.Type())
+		if err := netlink.LinkSetMTU(l, max); err != nil {
+			errs = append(errs, fmt.Errorf("LinkSetMTU(%s, %d): %v", attr.Name, max, err))
+		}
+	}
+	return joinErrors(errs)
+}
+
+// tunnelParent returns the link over which the packets of tunnel link l are
+// sent: the link the tunnel is bound to (dev in tunnels.json), or else the
+// link of the route to the tunnel’s remote address (the peer endpoints of
+// wireguard.json for WireGuard links). If several peers are routed via
+// different links, the one with the smallest MTU is returned.
+func tunnelParent(l netlink.Link, byIndex map[int]netlink.Link, tunnels TunnelConfig, wg wireguardInterfaces) netlink.Link {
+	var (
+		devIndex int
+		remotes  []net.IP
+	)
+	switch l := l.(type) {
+	case *netlink.Vxlan:
+		devIndex = l.VtepDevIndex
+		remotes = append(remotes, l.Group)
+	case *netlink.Gretun:
+		devIndex = int(l.Link)
+		remotes = append(remotes, l.Remote)
+	case *netlink.Gretap:
+		devIndex = int(l.Link)
+		remotes = append(remotes, l.Remote)
+	}
+	if parent, ok := byIndex[devIndex]; ok && devIndex != 0 {
+		return parent
+	}
+	if t := tunnels.tunnel(l.Attrs().Name); t != nil && t.Dev != "" {
+		for _, parent := range byIndex {
+			if parent.Attrs().Name == t.Dev {
+				return parent
+			}
+		}
+	}
+	for _, iface := range wg.Interfaces {
+		if iface.Name != l.Attrs().Name {
+			continue
+		}
+		for _, p := range iface.Peers {
+			host, _, err := net.SplitHostPort(p.Endpoint)
+			if err != nil {
+				continue
+			}
+			remotes = append(remotes, net.ParseIP(host))
+		}
+	}
+	var parent netlink.Link
+	for _, remote := range remotes {
+		if remote == nil || remote.IsUnspecified() {
+			continue
+		}
+		routes, err := netlink.RouteGet(remote)
+		if err != nil || len(routes) == 0 {
+			continue
+		}
+		candidate, ok := byIndex[routes[0].LinkIndex]
+		if !ok || candidate.Attrs().Index == l.Attrs().Index {
+			continue
+		}
+		if parent == nil || candidate.Attrs().MTU < parent.Attrs().MTU {
+			parent = candidate
+		}
+	}
+	return parent
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", errs)
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckMTU(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	for _, veth := range []*netlink.Veth{
+		{LinkAttrs: netlink.LinkAttrs{Name: "uplink0", MTU: 1500}, PeerName: "uplink0-peer"},
+		{LinkAttrs: netlink.LinkAttrs{Name: "lan0", MTU: 9000}, PeerName: "lan0-peer"},
+	} {
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Skipf("LinkAdd(veth): %v", err)
+		}
+	}
+	uplink, err := netlink.LinkByName("uplink0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan, err := netlink.LinkByName("lan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lan); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := netlink.ParseAddr("10.0.5.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(lan, addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []netlink.Link{
+		// The kernel limits the MTU assuming an IPv4 underlay, which
+		// still exceeds the uplink MTU with an IPv6 underlay.
+		&netlink.Vxlan{
+			LinkAttrs:    netlink.LinkAttrs{Name: "vxlan0", MTU: 1500},
+			VxlanId:      42,
+			VtepDevIndex: uplink.Attrs().Index,
+		},
+		// Small enough already.
+		&netlink.Vxlan{
+			LinkAttrs:    netlink.LinkAttrs{Name: "vxlan1", MTU: 1400},
+			VxlanId:      43,
+			VtepDevIndex: uplink.Attrs().Index,
+		},
+		// Jumbo frames on a jumbo frame parent, unrelated to the uplink.
+		&netlink.Vxlan{
+			LinkAttrs:    netlink.LinkAttrs{Name: "vxlan2", MTU: 8000},
+			VxlanId:      44,
+			VtepDevIndex: lan.Attrs().Index,
+		},
+		// Configured explicitly in interfaces.json.
+		&netlink.Vxlan{
+			LinkAttrs:    netlink.LinkAttrs{Name: "vxlan3", MTU: 1450},
+			VxlanId:      45,
+			VtepDevIndex: uplink.Attrs().Index,
+		},
+		// Not bound to a link: the route to the remote is used.
+		&netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "vxlan4", MTU: 9000},
+			VxlanId:   46,
+			Group:     net.ParseIP("10.0.5.2"),
+		},
+	} {
+		if err := netlink.LinkAdd(l); err != nil {
+			t.Skipf("LinkAdd(%s): %v", l.Type(), err)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`{"interfaces": [
+  {"name": "vxlan3", "mtu": 1450}
+]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying twice must not change the result.
+	for i := 0; i < 2; i++ {
+		if err := checkMTU(tmp); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			name string
+			want int
+		}{
+			{"vxlan0", 1500 - tunnelOverhead["vxlan"]},
+			{"vxlan1", 1400},
+			{"vxlan2", 8000},
+			{"vxlan3", 1450},
+			{"vxlan4", 9000 - tunnelOverhead["vxlan"]},
+			{"uplink0", 1500},
+			{"lan0", 9000},
+		} {
+			l, err := netlink.LinkByName(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.Attrs().MTU; got != tt.want {
+				t.Errorf("%s: MTU = %d, want %d", tt.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestApplyMTU(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lan0"}, PeerName: "lan0-peer"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	l, err := netlink.LinkByName("lan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial := l.Attrs().MTU
+
+	// 0 keeps the current MTU.
+	if err := applyMTU(l, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMTU(l, 9000); err != nil {
+		t.Fatal(err)
+	}
+	l, err = netlink.LinkByName("lan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.Attrs().MTU, 9000; got != want {
+		t.Errorf("MTU = %d, want %d (initially %d)", got, want, initial)
+	}
+
+	// Errors point out the MTU as likely culprit.
+	if err := applyMTU(l, 1<<20); err == nil {
+		t.Errorf("applyMTU(1<<20) unexpectedly succeeded")
+	}
+}
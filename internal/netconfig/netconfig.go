@@ -16,6 +16,7 @@
 package netconfig
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -35,9 +37,10 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/rtr7/router7/internal/dhcp4"
-	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/ethtool"
 	"github.com/rtr7/router7/internal/notify"
 	"github.com/rtr7/router7/internal/teelogger"
+	"github.com/rtr7/router7/internal/trace"
 )
 
 var log = teelogger.NewConsole()
@@ -59,129 +62,325 @@ func subnetMaskSize(mask string) (int, error) {
 	return ones, nil
 }
 
-func applyDhcp4(dir string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4/wire/lease.json"))
+// BackupUplinks lists the interfaces which are used as uplink when uplink0 is
+// unavailable (or declared unhealthy by diagd), e.g. an LTE modem. Their
+// default routes are installed with a higher metric than the default route of
+// uplink0, in the order of this list.
+var BackupUplinks = []string{
+	"uplink1", // second wired uplink (e.g. fiber), dhcp4 -interface=uplink1
+	"wwan0",   // LTE/5G modem, see cmd/wwand
+	"tether0", // USB tethering, see cmd/tetherd
+}
+
+// BackupLeasePath returns the path of the DHCPv4 lease file for the backup
+// uplink ifname.
+func BackupLeasePath(dir, ifname string) string {
+	return filepath.Join(dir, "dhcp4", ifname, "wire", "lease.json")
+}
+
+// dhcp4Lease returns the link, address and routes of the DHCPv4 lease in
+// leasePath, or a nil link if dhcp4 did not obtain a lease yet or the lease
+// expired (e.g. because dhcp4 is no longer running).
+func dhcp4Lease(leasePath, ifname string, priority int) (netlink.Link, *netlink.Addr, []*netlink.Route, error) {
+	b, err := ioutil.ReadFile(leasePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // dhcp4 might not have obtained a lease yet
+			return nil, nil, nil, nil // dhcp4 might not have obtained a lease yet
 		}
-		return err
+		return nil, nil, nil, err
 	}
 	var got dhcp4.Config
 	if err := json.Unmarshal(b, &got); err != nil {
-		return err
+		return nil, nil, nil, err
+	}
+	if !got.Expiry.IsZero() && !got.Expiry.After(time.Now()) {
+		log.Printf("%s: DHCPv4 lease expired at %v, ignoring", ifname, got.Expiry)
+		return nil, nil, nil, nil
 	}
 
-	link, err := netlink.LinkByName("uplink0")
+	link, err := netlink.LinkByName(ifname)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	if got.SubnetMask == "" {
-		return fmt.Errorf("invalid DHCP lease: no subnet mask present")
+		return nil, nil, nil, fmt.Errorf("invalid DHCP lease: no subnet mask present")
 	}
 
 	subnetSize, err := subnetMaskSize(got.SubnetMask)
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
 	addr, err := netlink.ParseAddr(fmt.Sprintf("%s/%d", got.ClientIP, subnetSize))
 	if err != nil {
-		return err
+		return nil, nil, nil, err
 	}
 
-	h, err := netlink.NewHandle()
-	if err != nil {
-		return fmt.Errorf("netlink.NewHandle: %v", err)
+	routes := []*netlink.Route{
+		{
+			LinkIndex: link.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   net.ParseIP(got.Router),
+				Mask: net.CIDRMask(32, 32),
+			},
+			Src:      net.ParseIP(got.ClientIP),
+			Scope:    netlink.SCOPE_LINK,
+			Protocol: rtprotLease,
+		},
+		{
+			LinkIndex: link.Attrs().Index,
+			Dst: &net.IPNet{
+				IP:   net.ParseIP("0.0.0.0"),
+				Mask: net.CIDRMask(0, 32),
+			},
+			Gw:       net.ParseIP(got.Router),
+			Src:      net.ParseIP(got.ClientIP),
+			Protocol: rtprotLease,
+			Priority: priority,
+		},
 	}
-	defer h.Delete()
-	if err := h.AddrReplace(link, addr); err != nil {
-		return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+	return link, addr, routes, nil
+}
+
+// dhcp6Addrs returns the addresses of the delegated prefixes for lan0.
+func dhcp6Addrs(dir string) ([]*netlink.Addr, error) {
+	addrs, err := delegatedAddrs(dir, time.Now())
+	if lan, ok := addrs["lan0"]; ok {
+		return lan, nil // errors concern other interfaces
 	}
+	return nil, err
+}
 
-	// from include/uapi/linux/rtnetlink.h
-	const (
-		RTPROT_STATIC = 4
-		RTPROT_DHCP   = 16
-	)
+type InterfaceDetails struct {
+	HardwareAddr      string `json:"hardware_addr"`       // e.g. dc:9b:9c:ee:72:fd
+	SpoofHardwareAddr string `json:"spoof_hardware_addr"` // e.g. dc:9b:9c:ee:72:fd
+	Name              string `json:"name"`                // e.g. uplink0, or lan0
+	Path              string `json:"path"`                // e.g. 0000:02:00.0 (PCI) or 1-1.2:1.0 (USB)
+	Driver            string `json:"driver"`              // e.g. igb
+	Addr              string `json:"addr"`                // e.g. 192.168.42.1/24
+	MTU               int    `json:"mtu"`                 // e.g. 9000 for jumbo frames
+	MSSClamp          *bool  `json:"mss_clamp"`           // default: uplink, PPPoE, tunnels, WireGuard, MTU < 1500
 
-	if err := h.RouteReplace(&netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   net.ParseIP(got.Router),
-			Mask: net.CIDRMask(32, 32),
-		},
-		Src:      net.ParseIP(got.ClientIP),
-		Scope:    netlink.SCOPE_LINK,
-		Protocol: RTPROT_DHCP,
-	}); err != nil {
-		return fmt.Errorf("RouteReplace(router): %v", err)
-	}
-
-	if err := h.RouteReplace(&netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst: &net.IPNet{
-			IP:   net.ParseIP("0.0.0.0"),
-			Mask: net.CIDRMask(0, 32),
-		},
-		Gw:       net.ParseIP(got.Router),
-		Src:      net.ParseIP(got.ClientIP),
-		Protocol: RTPROT_DHCP,
-	}); err != nil {
-		return fmt.Errorf("RouteReplace(default): %v", err)
-	}
+	// IPv6Subnet is the index of the /64 subnet of the delegated IPv6
+	// prefixes which is configured on the interface, e.g. 1 for a guest
+	// network (2001:db8:0:1::1/64 of 2001:db8::/48). lan0 gets subnet 0
+	// unless configured otherwise, a negative index disables the subnet.
+	IPv6Subnet *int `json:"ipv6_subnet,omitempty"`
 
-	return nil
+	Link *LinkSettings `json:"link,omitempty"`
+
+	// Offloads enables (true) or disables (false) offload features, keyed
+	// by gro, gso, tso or lro. Disabling LRO/GRO on the uplink is often
+	// required for correct forwarding and traffic shaping.
+	Offloads map[string]bool `json:"offloads,omitempty"`
+
+	DHCP4 *DHCP4Settings `json:"dhcp4,omitempty"`
+	IPv6  *IPv6Settings  `json:"ipv6,omitempty"`
 }
 
-func applyDhcp6(dir string) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // dhcp6 might not have obtained a lease yet
+// DHCP4Settings customize the DHCPv4 client (cmd/dhcp4) of an uplink, for ISPs
+// or lab networks which require specific options.
+type DHCP4Settings struct {
+	// ParameterRequestList (option 55) replaces the default list of
+	// requested options (6, 3, 1), e.g. [1, 3, 6, 15, 42, 121].
+	ParameterRequestList []uint8 `json:"parameter_request_list,omitempty"`
+
+	// SubnetSelection (option 118), e.g. 100.64.0.0
+	SubnetSelection string `json:"subnet_selection,omitempty"`
+
+	// RequestedAddress (option 50) is requested in DHCPDISCOVER, e.g. a
+	// static or secondary address assigned by the ISP.
+	RequestedAddress string `json:"requested_address,omitempty"`
+
+	// VLAN makes the client send 802.1Q-tagged frames itself, for ISPs which
+	// require DHCP on a VLAN (e.g. 7) or priority-tagged frames (ID 0). This
+	// works at first boot, before a VLAN sub-interface exists.
+	VLAN *DHCP4VLAN `json:"vlan,omitempty"`
+}
+
+// DHCP4VLAN is the 802.1Q tag of the frames sent by the DHCPv4 client.
+type DHCP4VLAN struct {
+	ID       uint16 `json:"id"`       // e.g. 7, or 0 for priority tagging
+	Priority uint8  `json:"priority"` // PCP, 0 to 7
+}
+
+// LinkSettings override the ethernet link settings of an interface, e.g. for
+// ONTs which do not negotiate correctly. Unset fields are left unchanged,
+// except for an unset speed, which restores autonegotiation.
+type LinkSettings struct {
+	Speed   int    `json:"speed"`    // in Mbit/s, e.g. 1000. Disables autonegotiation.
+	Duplex  string `json:"duplex"`   // “full” (default) or “half”
+	EEE     *bool  `json:"eee"`      // Energy-Efficient Ethernet (802.3az)
+	RxPause *bool  `json:"rx_pause"` // flow control (802.3x)
+	TxPause *bool  `json:"tx_pause"`
+}
+
+// The ethtool setters are overridden while testing, as they require a
+// physical network card.
+var (
+	getAutoneg     = ethtool.Autoneg
+	setSpeedDuplex = ethtool.SetSpeedDuplex
+	setEEE         = ethtool.SetEEE
+	setPause       = ethtool.SetPause
+)
+
+// applyLinkSettings applies ls (nil if not configured) to ifname.
+func applyLinkSettings(ifname string, ls *LinkSettings) error {
+	if ls == nil {
+		ls = &LinkSettings{}
+	}
+	if ls.Speed != 0 {
+		if ls.Duplex != "" && ls.Duplex != "full" && ls.Duplex != "half" {
+			return fmt.Errorf("invalid duplex %q: expected full or half", ls.Duplex)
+		}
+		if err := setSpeedDuplex(ifname, ls.Speed, ls.Duplex != "half"); err != nil {
+			return err
+		}
+	} else if supported, enabled, err := getAutoneg(ifname); err == nil && supported && !enabled {
+		// The speed was forced before (and since removed from
+		// interfaces.json), which persists until reboot otherwise.
+		// Interfaces without ethtool support are skipped.
+		if err := setSpeedDuplex(ifname, 0, true); err != nil {
+			return err
 		}
-		return err
 	}
-	var got dhcp6.Config
-	if err := json.Unmarshal(b, &got); err != nil {
-		return err
+	if ls.EEE != nil {
+		if err := setEEE(ifname, *ls.EEE); err != nil {
+			return err
+		}
+	}
+	if ls.RxPause != nil || ls.TxPause != nil {
+		if err := setPause(ifname, ls.RxPause, ls.TxPause); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	link, err := netlink.LinkByName("lan0")
-	if err != nil {
-		return err
+type InterfaceConfig struct {
+	Interfaces []InterfaceDetails `json:"interfaces"`
+	Bridges    []BridgeDetails    `json:"bridges,omitempty"`
+	Virtual    []VirtualDetails   `json:"virtual,omitempty"`
+}
+
+// linkInfo contains the properties of a link which InterfaceDetails can match.
+type linkInfo struct {
+	name     string
+	addr     string // current hardware address
+	permAddr string // permanent hardware address, if known
+	path     string // sysfs device path, e.g. /sys/devices/pci0000:00/0000:00:02.0/0000:02:00.0
+	driver   string // e.g. igb
+}
+
+func newLinkInfo(attr *netlink.LinkAttrs) linkInfo {
+	li := linkInfo{
+		name: attr.Name,
+		addr: attr.HardwareAddr.String(),
 	}
+	if li.addr == "" {
+		return li // not a physical network card, only matched by name
+	}
+	if perm, err := ethtool.PermAddr(attr.Name); err == nil {
+		li.permAddr = perm.String()
+	}
+	dev := filepath.Join("/sys/class/net", attr.Name, "device")
+	if path, err := filepath.EvalSymlinks(dev); err == nil {
+		li.path = path
+	}
+	if driver, err := os.Readlink(filepath.Join(dev, "driver")); err == nil {
+		li.driver = filepath.Base(driver)
+	}
+	return li
+}
 
-	for _, prefix := range got.Prefixes {
-		// pick the first address of the prefix, e.g. address 2a02:168:4a00::1
-		// for prefix 2a02:168:4a00::/48
-		prefix.IP[len(prefix.IP)-1] = 1
-		// Use the first /64 subnet within larger prefixes
-		if ones, bits := prefix.Mask.Size(); ones < 64 {
-			prefix.Mask = net.CIDRMask(64, bits)
-		}
-		addr, err := netlink.ParseAddr(prefix.String())
-		if err != nil {
-			return err
+// matches reports whether details apply to the link described by li. All
+// criteria which details specify need to match. The hardware address matches
+// the permanent address (preferred, as it survives spoofing and MAC
+// randomization) or the current address of the link. A link which already
+// carries the spoofed hardware address of details matches, too.
+func (details InterfaceDetails) matches(li linkInfo) bool {
+	if li.addr == "" {
+		return details.Name == li.name
+	}
+	spoofed := details.SpoofHardwareAddr != "" && details.SpoofHardwareAddr == li.addr
+	if details.HardwareAddr == "" && details.Path == "" && details.Driver == "" {
+		return spoofed
+	}
+	if hw := details.HardwareAddr; hw != "" {
+		switch {
+		case li.permAddr != "" && hw == li.permAddr:
+		case hw == li.addr:
+		case spoofed:
+		default:
+			return false
 		}
+	}
+	if details.Path != "" && !strings.HasSuffix(li.path, "/"+details.Path) {
+		return false
+	}
+	if details.Driver != "" && details.Driver != li.driver {
+		return false
+	}
+	return true
+}
 
-		if err := netlink.AddrReplace(link, addr); err != nil {
-			return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+// match returns the InterfaceDetails which apply to the link with attributes
+// attr. Links without a hardware address, bridges and virtual children are
+// matched by name.
+func (cfg InterfaceConfig) match(attr *netlink.LinkAttrs) (InterfaceDetails, bool) {
+	li := newLinkInfo(attr)
+	if cfg.bridge(attr.Name) != nil || cfg.virtual(attr.Name) != nil || attr.Alias == tunnelAlias {
+		li = linkInfo{name: attr.Name} // random hardware address
+	}
+	for _, details := range cfg.Interfaces {
+		if details.matches(li) {
+			return details, true
 		}
 	}
-	return nil
+	return InterfaceDetails{}, false
 }
 
-type InterfaceDetails struct {
-	HardwareAddr      string `json:"hardware_addr"`       // e.g. dc:9b:9c:ee:72:fd
-	SpoofHardwareAddr string `json:"spoof_hardware_addr"` // e.g. dc:9b:9c:ee:72:fd
-	Name              string `json:"name"`                // e.g. uplink0, or lan0
-	Addr              string `json:"addr"`                // e.g. 192.168.42.1/24
+// Configured reports whether interfaces.json in dir contains InterfaceDetails
+// for the link with attributes attr, or lists it as bridge member, or whether
+// tunnels.json in dir uses it as underlay link.
+func Configured(dir string, attr *netlink.LinkAttrs) bool {
+	if tc, err := readTunnels(dir); err == nil {
+		for _, t := range tc.Tunnels {
+			if t.Dev == attr.Name {
+				return true
+			}
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		return false
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return false
+	}
+	if _, ok := cfg.match(attr); ok {
+		return true
+	}
+	return cfg.bridgeOf(attr.Name) != ""
 }
 
-type InterfaceConfig struct {
-	Interfaces []InterfaceDetails `json:"interfaces"`
+// readInterfaceConfig reads interfaces.json in dir. A missing file results in
+// an empty InterfaceConfig.
+func readInterfaceConfig(dir string) (InterfaceConfig, error) {
+	var cfg InterfaceConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
 }
 
 // Interface returns the InterfaceDetails configured for interface ifname in
@@ -216,52 +415,41 @@ func LinkAddress(dir, ifname string) (net.IP, error) {
 	return ip, err
 }
 
-func applyInterfaces(dir, root string) error {
+// applyInterfaces configures the links listed in interfaces.json. Links which
+// are down are not set up yet (see setLinksUp), so that no packets are
+// forwarded before the firewall is installed. The returned links need to be
+// set up.
+func applyInterfaces(dir, root string) ([]netlink.Link, error) {
 	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
 		}
-		return err
+		return nil, err
 	}
 	var cfg InterfaceConfig
 	if err := json.Unmarshal(b, &cfg); err != nil {
-		return err
+		return nil, err
 	}
-	byName := make(map[string]InterfaceDetails)
-	byHardwareAddr := make(map[string]InterfaceDetails)
-	for _, details := range cfg.Interfaces {
-		byHardwareAddr[details.HardwareAddr] = details
-		if spoof := details.SpoofHardwareAddr; spoof != "" {
-			byHardwareAddr[spoof] = details
-		}
-		byName[details.Name] = details
+	if err := createBridges(cfg); err != nil {
+		return nil, err
 	}
 	links, err := netlink.LinkList()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, l := range links {
+	var down []netlink.Link
+	configure := func(l netlink.Link) error {
 		attr := l.Attrs()
 		// TODO: prefix log line with details about the interface.
 		// link &{LinkAttrs:{Index:2 MTU:1500 TxQLen:1000 Name:eth0 HardwareAddr:00:0d:b9:49:70:18 Flags:broadcast|multicast RawFlags:4098 ParentIndex:0 MasterIndex:0 Namespace:<nil> Alias: Statistics:0xc4200f45f8 Promisc:0 Xdp:0xc4200ca180 EncapType:ether Protinfo:<nil> OperState:down NetNsID:0 NumTxQueues:0 NumRxQueues:0 Vfs:[]}}, attr &{Index:2 MTU:1500 TxQLen:1000 Name:eth0 HardwareAddr:00:0d:b9:49:70:18 Flags:broadcast|multicast RawFlags:4098 ParentIndex:0 MasterIndex:0 Namespace:<nil> Alias: Statistics:0xc4200f45f8 Promisc:0 Xdp:0xc4200ca180 EncapType:ether Protinfo:<nil> OperState:down NetNsID:0 NumTxQueues:0 NumRxQueues:0 Vfs:[]}
 
-		var (
-			details InterfaceDetails
-			ok      bool
-		)
-		addr := attr.HardwareAddr.String()
-		if addr == "" {
-			details, ok = byName[attr.Name]
-			if !ok {
-				continue // not a configurable interface (e.g. sit0)
-			}
-		} else {
-			details, ok = byHardwareAddr[addr]
-		}
+		details, ok := cfg.match(attr)
 		if !ok {
-			log.Printf("no config for interface %s/%s", attr.Name, addr)
-			continue
+			if attr.HardwareAddr.String() != "" {
+				log.Printf("no config for interface %s/%s", attr.Name, attr.HardwareAddr)
+			}
+			return nil // not a configurable interface (e.g. sit0)
 		}
 		log.Printf("apply details %+v", details)
 		if attr.Name != details.Name {
@@ -271,21 +459,27 @@ func applyInterfaces(dir, root string) error {
 			attr.Name = details.Name
 		}
 
-		if spoof := details.SpoofHardwareAddr; spoof != "" {
-			hwaddr, err := net.ParseMAC(spoof)
-			if err != nil {
-				return fmt.Errorf("ParseMAC(%q): %v", spoof, err)
-			}
-			if err := netlink.LinkSetHardwareAddr(l, hwaddr); err != nil {
-				return fmt.Errorf("LinkSetHardwareAddr(%v): %v", hwaddr, err)
+		if err := applyHardwareAddr(l, details.SpoofHardwareAddr); err != nil {
+			return err
+		}
+
+		if err := applyMTU(l, details.MTU); err != nil {
+			return err
+		}
+
+		if err := applyLinkSettings(attr.Name, details.Link); err != nil {
+			// Not fatal: the interface might work with its default settings.
+			log.Printf("link settings of %s: %v", attr.Name, err)
+		}
+
+		for offload, enabled := range details.Offloads {
+			if err := ethtool.SetOffload(attr.Name, ethtool.Offload(offload), enabled); err != nil {
+				log.Printf("offloads of %s: %v", attr.Name, err)
 			}
 		}
 
 		if attr.OperState != netlink.OperUp {
-			// Set the interface to up, which is required by all other configuration.
-			if err := netlink.LinkSetUp(l); err != nil {
-				return fmt.Errorf("LinkSetUp(%s): %v", attr.Name, err)
-			}
+			down = append(down, l)
 		}
 
 		if details.Addr != "" {
@@ -309,6 +503,66 @@ func applyInterfaces(dir, root string) error {
 				}
 			}
 		}
+		return nil
+	}
+	for _, l := range links {
+		if err := configure(l); err != nil {
+			return nil, err
+		}
+	}
+	// Virtual children are created once their parents were renamed.
+	created, err := createVirtualLinks(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range created {
+		if err := configure(l); err != nil {
+			return nil, err
+		}
+	}
+	created, err = createTunnels(dir, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range created {
+		if err := configure(l); err != nil {
+			return nil, err
+		}
+	}
+	// Members are added once all links were renamed.
+	if err := applyBridgeMembers(cfg); err != nil {
+		return nil, err
+	}
+	return down, nil
+}
+
+// applyHardwareAddr sets the hardware address of l to spoof (unless empty),
+// e.g. for ISPs which bind the uplink to a registered MAC address. Many
+// drivers refuse changing the address of a running link (EBUSY), so the
+// address is only set when it differs.
+func applyHardwareAddr(l netlink.Link, spoof string) error {
+	if spoof == "" {
+		return nil
+	}
+	hwaddr, err := net.ParseMAC(spoof)
+	if err != nil {
+		return fmt.Errorf("ParseMAC(%q): %v", spoof, err)
+	}
+	if bytes.Equal(l.Attrs().HardwareAddr, hwaddr) {
+		return nil
+	}
+	if err := netlink.LinkSetHardwareAddr(l, hwaddr); err != nil {
+		return fmt.Errorf("LinkSetHardwareAddr(%v): %v", hwaddr, err)
+	}
+	return nil
+}
+
+// setLinksUp sets links up, which is required for adding routes.
+func setLinksUp(links []netlink.Link) error {
+	for _, l := range links {
+		if err := netlink.LinkSetUp(l); err != nil {
+			return fmt.Errorf("LinkSetUp(%s): %v", l.Attrs().Name, err)
+		}
 	}
 	return nil
 }
@@ -319,10 +573,11 @@ func nfifname(n string) []byte {
 	return b
 }
 
-func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest net.IP, dportMin, dportMax uint16) []expr.Any {
-	var cmp []expr.Any
+// portCmp returns expressions comparing the port in register 1 against the
+// specified port (range).
+func portCmp(portMin, portMax uint16) []expr.Any {
 	if portMin == portMax {
-		cmp = []expr.Any{
+		return []expr.Any{
 			// [ cmp eq reg 1 0x0000e60f ]
 			&expr.Cmp{
 				Op:       expr.CmpOpEq,
@@ -330,22 +585,25 @@ func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest n
 				Data:     binaryutil.BigEndian.PutUint16(portMin),
 			},
 		}
-	} else {
-		cmp = []expr.Any{
-			// [ cmp gte reg 1 0x0000e60f ]
-			&expr.Cmp{
-				Op:       expr.CmpOpGte,
-				Register: 1,
-				Data:     binaryutil.BigEndian.PutUint16(portMin),
-			},
-			// [ cmp lte reg 1 0x0000fa0f ]
-			&expr.Cmp{
-				Op:       expr.CmpOpLte,
-				Register: 1,
-				Data:     binaryutil.BigEndian.PutUint16(portMax),
-			},
-		}
 	}
+	return []expr.Any{
+		// [ cmp gte reg 1 0x0000e60f ]
+		&expr.Cmp{
+			Op:       expr.CmpOpGte,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(portMin),
+		},
+		// [ cmp lte reg 1 0x0000fa0f ]
+		&expr.Cmp{
+			Op:       expr.CmpOpLte,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(portMax),
+		},
+	}
+}
+
+func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest net.IP, dportMin, dportMax uint16) []expr.Any {
+	cmp := portCmp(portMin, portMax)
 	ex := []expr.Any{
 		// [ meta load iifname => reg 1 ]
 		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
@@ -421,7 +679,8 @@ func portForwardExpr(ifname string, proto uint8, portMin, portMax uint16, dest n
 	return ex
 }
 
-type portForwarding struct {
+// PortForwarding is an entry in portforwardings.json.
+type PortForwarding struct {
 	Proto    string `json:"proto"`     // e.g. “tcp” (or “tcp,udp”)
 	Port     string `json:"port"`      // e.g. “8080” (or “8080-8090”)
 	DestAddr string `json:"dest_addr"` // e.g. “192.168.42.2”
@@ -429,7 +688,24 @@ type portForwarding struct {
 }
 
 type portForwardings struct {
-	Forwardings []portForwarding `json:"forwardings"`
+	Forwardings []PortForwarding `json:"forwardings"`
+}
+
+// PortForwardings returns the port forwardings configured in
+// portforwardings.json.
+func PortForwardings(dir string) ([]PortForwarding, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "portforwardings.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg portForwardings
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg.Forwardings, nil
 }
 
 var rangeRe = regexp.MustCompile(`^([0-9]+)(?:-([0-9]+))?$`)
@@ -453,29 +729,23 @@ func parsePort(p string) (min uint16, max uint16, _ error) {
 	return uint16(min64), uint16(max64), nil
 }
 
-func applyPortForwardings(dir, ifname string, c *nftables.Conn, nat *nftables.Table, prerouting *nftables.Chain) error {
-	b, err := ioutil.ReadFile(filepath.Join(dir, "portforwardings.json"))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	var cfg portForwardings
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return err
+func parseProto(proto string) (uint8, error) {
+	switch proto {
+	case "", "tcp":
+		return unix.IPPROTO_TCP, nil
+	case "udp":
+		return unix.IPPROTO_UDP, nil
+	default:
+		return 0, fmt.Errorf(`unknown proto %q, expected "tcp" or "udp"`, proto)
 	}
+}
 
-	for _, fw := range cfg.Forwardings {
+func applyPortForwardings(forwardings []PortForwarding, ifname string, c *ruleset, nat *nftables.Table, prerouting *nftables.Chain) error {
+	for _, fw := range forwardings {
 		for _, proto := range strings.Split(fw.Proto, ",") {
-			var p uint8
-			switch proto {
-			case "", "tcp":
-				p = unix.IPPROTO_TCP
-			case "udp":
-				p = unix.IPPROTO_UDP
-			default:
-				return fmt.Errorf(`unknown proto %q, expected "tcp" or "udp"`, proto)
+			p, err := parseProto(proto)
+			if err != nil {
+				return err
 			}
 
 			min, max, err := parsePort(fw.Port)
@@ -497,6 +767,99 @@ func applyPortForwardings(dir, ifname string, c *nftables.Conn, nat *nftables.Ta
 	return nil
 }
 
+// applyPortForwardingFilter accepts the inbound connections of the port
+// forwardings (matching their translated destination, as the forward hook
+// runs after DNAT) and drops all other new inbound IPv4 connections on all
+// masqueraded uplinks, so that only the forwarded ports of LAN hosts are
+// reachable. Without port forwardings, inbound IPv4 traffic is not filtered.
+func applyPortForwardingFilter(forwardings []PortForwarding, ifname string, c *ruleset, filter4 *nftables.Table, forward *nftables.Chain) error {
+	if len(forwardings) == 0 {
+		return nil
+	}
+	// Expressions without per-rule data are shared between the rules, as
+	// configurations can contain thousands of port forwardings.
+	var (
+		inbound = iifnameExprs(ifname)
+		daddr   = &expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       16, // destination address
+			Len:          4,
+		}
+		l4proto = &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1}
+		dport   = &expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // destination port
+			Len:          2,
+		}
+		accept = &expr.Verdict{Kind: expr.VerdictAccept}
+	)
+	for _, fw := range forwardings {
+		dest := net.ParseIP(fw.DestAddr).To4()
+		if dest == nil {
+			return fmt.Errorf("port forwarding %s: dest_addr %q is not an IPv4 address", fw.Port, fw.DestAddr)
+		}
+		dmin, dmax, err := parsePort(fw.DestPort)
+		if err != nil {
+			return err
+		}
+		for _, proto := range strings.Split(fw.Proto, ",") {
+			p, err := parseProto(proto)
+			if err != nil {
+				return err
+			}
+			exprs := make([]expr.Any, 0, 10)
+			exprs = append(exprs, inbound...)
+			exprs = append(exprs,
+				// [ payload load 4b @ network header + 16 => reg 1 ]
+				daddr,
+				// [ cmp eq reg 1 0x172aa8c0 ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: dest},
+				// [ meta load l4proto => reg 1 ]
+				l4proto,
+				// [ cmp eq reg 1 0x00000006 ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{p}},
+				// [ payload load 2b @ transport header + 2 => reg 1 ]
+				dport)
+			exprs = append(exprs, portCmp(dmin, dmax)...)
+			exprs = append(exprs,
+				// [ immediate reg 0 accept ]
+				accept)
+			c.AddRule(&nftables.Rule{
+				Table: filter4,
+				Chain: forward,
+				Exprs: exprs,
+			})
+		}
+	}
+
+	for _, uplink := range masqueradedUplinks(ifname) {
+		c.AddRule(&nftables.Rule{
+			Table: filter4,
+			Chain: forward,
+			Exprs: append(iifnameExprs(uplink),
+				// ct state new
+				&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           binaryutil.NativeEndian.PutUint32(ctStateNew),
+					Xor:            binaryutil.NativeEndian.PutUint32(0),
+				},
+				&expr.Cmp{
+					Op:       expr.CmpOpNeq,
+					Register: 1,
+					Data:     binaryutil.NativeEndian.PutUint32(0),
+				},
+				// [ immediate reg 0 drop ]
+				&expr.Verdict{Kind: expr.VerdictDrop}),
+		})
+	}
+	return nil
+}
+
 // DefaultCounterObj is overridden while testing
 var DefaultCounterObj = &nftables.CounterObj{}
 
@@ -537,10 +900,11 @@ func getCounterObj(c *nftables.Conn, o *nftables.CounterObj) *nftables.CounterOb
 	return o
 }
 
-func applyFirewall(dir, ifname string) error {
-	c := &nftables.Conn{}
-
-	c.FlushRuleset()
+// buildFirewall returns the firewall ruleset for the uplink interface ifname.
+// counters returns the counter object to use (e.g. carrying over the values
+// of the currently active ruleset).
+func buildFirewall(dir, ifname string, counters func(*nftables.CounterObj) *nftables.CounterObj) (*ruleset, error) {
+	c := &ruleset{}
 
 	nat := c.AddTable(&nftables.Table{
 		Family: nftables.TableFamilyIPv4,
@@ -563,25 +927,40 @@ func applyFirewall(dir, ifname string) error {
 		Type:     nftables.ChainTypeNAT,
 	})
 
-	c.AddRule(&nftables.Rule{
-		Table: nat,
-		Chain: postrouting,
-		Exprs: []expr.Any{
-			// meta load oifname => reg 1
-			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-			// cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000
-			&expr.Cmp{
-				Op:       expr.CmpOpEq,
-				Register: 1,
-				Data:     nfifname(ifname),
+	for _, ifname := range masqueradedUplinks(ifname) {
+		c.AddRule(&nftables.Rule{
+			Table: nat,
+			Chain: postrouting,
+			Exprs: []expr.Any{
+				// meta load oifname => reg 1
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				// cmp eq reg 1 0x696c7075 0x00306b6e 0x00000000 0x00000000
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     nfifname(ifname),
+				},
+				// masq
+				&expr.Masq{},
 			},
-			// masq
-			&expr.Masq{},
-		},
-	})
+		})
+	}
+
+	forwardings, err := PortForwardings(dir)
+	if err != nil {
+		return nil, err
+	}
+	pluginForwardings, _, err := pluginFragments(dir)
+	if err != nil {
+		return nil, err
+	}
+	forwardings = append(forwardings, pluginForwardings...)
+	if err := applyPortForwardings(forwardings, ifname, c, nat, prerouting); err != nil {
+		return nil, err
+	}
 
-	if err := applyPortForwardings(dir, ifname, c, nat, prerouting); err != nil {
-		return err
+	if err := applyDNSRedirect(dir, c, nat, prerouting); err != nil {
+		return nil, err
 	}
 
 	filter4 := c.AddTable(&nftables.Table{
@@ -594,6 +973,19 @@ func applyFirewall(dir, ifname string) error {
 		Name:   "filter",
 	})
 
+	if err := applyAntiSpoofing(dir, ifname, c, filter4, filter6); err != nil {
+		return nil, err
+	}
+
+	if err := applyInterception(dir, c, filter4); err != nil {
+		return nil, err
+	}
+
+	clampIfnames, err := mssClampInterfaces(dir, ifname)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, filter := range []*nftables.Table{filter4, filter6} {
 		forward := c.AddChain(&nftables.Chain{
 			Name:     "forward",
@@ -603,75 +995,15 @@ func applyFirewall(dir, ifname string) error {
 			Type:     nftables.ChainTypeFilter,
 		})
 
-		c.AddRule(&nftables.Rule{
-			Table: filter,
-			Chain: forward,
-			Exprs: []expr.Any{
-				// [ meta load oifname => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-				// [ cmp eq reg 1 0x30707070 0x00000000 0x00000000 0x00000000 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     nfifname(ifname),
-				},
-
-				// [ meta load l4proto => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				// [ cmp eq reg 1 0x00000006 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     []byte{unix.IPPROTO_TCP},
-				},
-
-				// [ payload load 1b @ transport header + 13 => reg 1 ]
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseTransportHeader,
-					Offset:       13, // TODO
-					Len:          1,  // TODO
-				},
-				// [ bitwise reg 1 = (reg=1 & 0x00000002 ) ^ 0x00000000 ]
-				&expr.Bitwise{
-					DestRegister:   1,
-					SourceRegister: 1,
-					Len:            1,
-					Mask:           []byte{0x02},
-					Xor:            []byte{0x00},
-				},
-				// [ cmp neq reg 1 0x00000000 ]
-				&expr.Cmp{
-					Op:       expr.CmpOpNeq,
-					Register: 1,
-					Data:     []byte{0x00},
-				},
-
-				// [ rt load tcpmss => reg 1 ]
-				&expr.Rt{
-					Register: 1,
-					Key:      expr.RtTCPMSS,
-				},
-				// [ byteorder reg 1 = hton(reg 1, 2, 2) ]
-				&expr.Byteorder{
-					DestRegister:   1,
-					SourceRegister: 1,
-					Op:             expr.ByteorderHton,
-					Len:            2,
-					Size:           2,
-				},
-				// [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
-				&expr.Exthdr{
-					SourceRegister: 1,
-					Type:           2, // TODO
-					Offset:         2,
-					Len:            2,
-					Op:             expr.ExthdrOpTcpopt,
-				},
-			},
-		})
+		for _, ifname := range append([]string{ifname}, clampIfnames...) {
+			c.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: mssClampExprs(ifname),
+			})
+		}
 
-		counterObj := getCounterObj(c, &nftables.CounterObj{
+		counterObj := counters(&nftables.CounterObj{
 			Table: filter,
 			Name:  "fwded",
 		})
@@ -689,13 +1021,120 @@ func applyFirewall(dir, ifname string) error {
 				},
 			},
 		})
+
+		// Blocks, bindings and the encrypted DNS block take effect before any
+		// accept verdict, e.g. of the priority traffic of an exceeded quota.
+		if err := applyBlocks(dir, c, filter, forward); err != nil {
+			return nil, err
+		}
+
+		if err := applyBindings(dir, c, filter, forward); err != nil {
+			return nil, err
+		}
+
+		if err := applyEncryptedDNSBlock(dir, c, filter, forward); err != nil {
+			return nil, err
+		}
+
+		if err := applyQuotas(dir, c, filter, forward); err != nil {
+			return nil, err
+		}
+
+		if err := applyWireGuardFirewall(dir, c, filter, forward); err != nil {
+			return nil, err
+		}
+
+		if filter == filter4 {
+			if err := applyPortForwardingFilter(forwardings, ifname, c, filter4, forward); err != nil {
+				return nil, err
+			}
+		}
+
+		if filter == filter6 {
+			if err := applyPinholes(dir, ifname, c, filter6, forward); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return c.Flush()
+	if err := applyARPBindings(dir, c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// mssClampExprs returns expressions which clamp the TCP MSS of SYN packets
+// leaving via ifname to the path MTU.
+func mssClampExprs(ifname string) []expr.Any {
+	return []expr.Any{
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 0x30707070 0x00000000 0x00000000 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     nfifname(ifname),
+		},
+
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 0x00000006 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{unix.IPPROTO_TCP},
+		},
+
+		// [ payload load 1b @ transport header + 13 => reg 1 ]
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       13, // TODO
+			Len:          1,  // TODO
+		},
+		// [ bitwise reg 1 = (reg=1 & 0x00000002 ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			DestRegister:   1,
+			SourceRegister: 1,
+			Len:            1,
+			Mask:           []byte{0x02},
+			Xor:            []byte{0x00},
+		},
+		// [ cmp neq reg 1 0x00000000 ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     []byte{0x00},
+		},
+
+		// [ rt load tcpmss => reg 1 ]
+		&expr.Rt{
+			Register: 1,
+			Key:      expr.RtTCPMSS,
+		},
+		// [ byteorder reg 1 = hton(reg 1, 2, 2) ]
+		&expr.Byteorder{
+			DestRegister:   1,
+			SourceRegister: 1,
+			Op:             expr.ByteorderHton,
+			Len:            2,
+			Size:           2,
+		},
+		// [ exthdr write tcpopt reg 1 => 2b @ 2 + 2 ]
+		&expr.Exthdr{
+			SourceRegister: 1,
+			Type:           2, // TODO
+			Offset:         2,
+			Len:            2,
+			Op:             expr.ExthdrOpTcpopt,
+		},
+	}
 }
 
 func uplinkInterface() (string, error) {
 	names := []string{
+		"ppp0",    // PPPoE session on uplink0, see cmd/pppoe
 		"uplink0", // router7
 		"eth0",    // gokrazy
 		"ens3",    // distri
@@ -709,14 +1148,25 @@ func uplinkInterface() (string, error) {
 	return "", fmt.Errorf("no uplink ethernet interface found (checked %v)", names)
 }
 
-func applySysctl(ifname string) error {
+// sysctls returns the sysctls for routing via the uplink ifname.
+func sysctls(ifname string) []string {
 	sysctls := []string{
 		"net.ipv4.ip_forward=1",
 		"net.ipv6.conf.all.forwarding=1",
 	}
 	if ifname != "" {
-		sysctls = append(sysctls, "net.ipv6.conf."+ifname+".accept_ra=2")
+		sysctls = append(sysctls,
+			"net.ipv6.conf."+ifname+".accept_ra=2",
+			// Skip the uplink default route while the link is down, so that
+			// traffic fails over to a backup uplink (e.g. wwan0).
+			"net.ipv4.conf."+ifname+".ignore_routes_with_linkdown=1")
 	}
+	return sysctls
+}
+
+// writeSysctls applies sysctls of the form key=value, e.g.
+// net.ipv4.ip_forward=1.
+func writeSysctls(sysctls []string) error {
 	for _, ctl := range sysctls {
 		idx := strings.Index(ctl, "=")
 		key, val := ctl[:idx], ctl[idx+1:]
@@ -725,62 +1175,174 @@ func applySysctl(ifname string) error {
 			return fmt.Errorf("sysctl(%v=%v): %v", key, val, err)
 		}
 	}
-
 	return nil
 }
 
+// Warnings are the non-fatal errors of Apply, returned if no other errors
+// occurred: the configuration is in effect, but optional aspects of it (e.g.
+// QoS or a backup uplink) could not be applied. Callers should log them and
+// keep running.
+type Warnings []error
+
+func (w Warnings) Error() string {
+	return fmt.Sprintf("%v", []error(w))
+}
+
+// warning marks err as non-fatal, see Warnings.
+type warning struct {
+	err error
+}
+
+func (w warning) Error() string {
+	return w.err.Error()
+}
+
+// Apply configures the kernel according to the configuration in dir: after
+// configuring the links (see applyInterfaces), the desired state is built
+// from all configuration inputs (see buildState) and then applied. The steps
+// are traced (see package trace).
 func Apply(dir, root string) error {
+	span := trace.Start(nil, "netconfig.Apply")
+	err := apply(dir, root, span)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func apply(dir, root string, span *trace.Span) error {
+	start := time.Now()
+	c := &nftables.Conn{}
+	if err := preloadFirewall(c); err != nil {
+		log.Printf("preloading firewall: %v", err)
+	}
 
-	// TODO: split into two parts: delay the up until later
-	if err := applyInterfaces(dir, root); err != nil {
+	down, err := applyInterfaces(dir, root)
+	if err != nil {
 		return fmt.Errorf("interfaces: %v", err)
 	}
 
-	var errors []error
+	var (
+		errors   []error
+		warnings Warnings
+		steps    *stepRunner
+	)
 	appendError := func(err error) {
-		errors = append(errors, err)
+		if w, ok := err.(warning); ok {
+			warnings = append(warnings, w.err)
+		} else {
+			errors = append(errors, err)
+		}
 		log.Println(err)
+		steps.failed(err)
 	}
 
-	if err := applyDhcp4(dir); err != nil {
-		appendError(fmt.Errorf("dhcp4: %v", err))
+	features, err := loadFeatures(dir, time.Now)
+	if err != nil {
+		appendError(err)
 	}
+	steps = newStepRunner(dir, appendError, features)
+	steps.span = span
+	steps.last = start
+	steps.done(StepInterfaces)
 
-	if err := applyDhcp6(dir); err != nil {
-		appendError(fmt.Errorf("dhcp6: %v", err))
+	ifname, err := uplinkInterface()
+	if err != nil {
+		log.Printf("uplinkInterface: %v", err)
 	}
 
+	st := buildState(dir, ifname, func(o *nftables.CounterObj) *nftables.CounterObj {
+		return getCounterObj(c, o)
+	}, appendError)
+
+	// Install the firewall (atomically replacing the preloaded ruleset)
+	// before enabling forwarding and setting up links, so that no packets
+	// are forwarded unfiltered during boot.
+	if st.firewall != nil {
+		gen, err := activateFirewall(c, st.firewall)
+		if err != nil {
+			appendError(fmt.Errorf("firewall: %v", err))
+		} else {
+			log.Printf("firewall: activated generation %d (%d rules)", gen.Num, gen.Rules)
+		}
+	}
+	steps.done(StepFirewall)
+
+	if err := writeSysctls(st.sysctls); err != nil {
+		appendError(fmt.Errorf("sysctl: %v", err))
+	}
+	st.applyTokens(appendError)
+	steps.done(StepSysctl)
+
+	if err := setLinksUp(down); err != nil {
+		appendError(fmt.Errorf("interfaces: %v", err))
+	}
+	steps.done(StepUp)
+
+	st.applyNeighbors(appendError)
+	steps.done(StepNeighbors)
+
+	imported, err := st.routing.listImported()
+	if err != nil {
+		appendError(fmt.Errorf("routing: %v", err))
+	}
+	st.imported = imported
+	st.owned = loadOwnedAddrs(dir)
+	st.applyLinks(appendError)
+	if err := st.owned.save(); err != nil {
+		appendError(warning{fmt.Errorf("owned addresses: %v", err)})
+	}
+	st.applyRoutes(appendError)
+	st.applyExport(appendError)
+	st.applyRules(appendError)
+	if err := flushFailedOver(masqueradedUplinks(ifname)); err != nil {
+		appendError(warning{fmt.Errorf("failover: %v", err)})
+	}
+	steps.done(StepLinks)
+
+	st.resolveGateways(ifname)
+
 	for _, process := range []string{
-		"dyndns",   // depends on the public IPv4 address
-		"dnsd",     // listens on private IPv4/IPv6
-		"diagd",    // listens on private IPv4/IPv6
-		"backupd",  // listens on private IPv4/IPv6
-		"captured", // listens on private IPv4/IPv6
+		"dyndns",      // depends on the public IPv4 address
+		"dhcp4relayd", // relays on (possibly new) interfaces
+		"dnsd",        // listens on private IPv4/IPv6
+		"diagd",       // listens on private IPv4/IPv6
+		"backupd",     // listens on private IPv4/IPv6
+		"captured",    // listens on private IPv4/IPv6
+		"apd",         // listens on private IPv4/IPv6
+		"ingressd",    // listens on public IPv4/IPv6
+		"mcrouted",    // routes between (possibly new) interfaces
+		"proxyd",      // listens on private IPv4/IPv6
+		"scheduled",   // listens on private IPv4/IPv6
+		"storaged",    // listens on private IPv4/IPv6
+		"syslogd",     // listens on private IPv4/IPv6
 	} {
 		if err := notify.Process("/user/"+process, syscall.SIGUSR1); err != nil {
 			log.Printf("notifying %s: %v", process, err)
 		}
 	}
 
-	ifname, err := uplinkInterface()
-	if err != nil {
-		log.Printf("uplinkInterface: %v", err)
+	if err := applyWireGuard(dir); err != nil {
+		appendError(fmt.Errorf("wireguard: %v", err))
 	}
+	steps.done(StepWireGuard)
 
-	if err := applySysctl(ifname); err != nil {
-		appendError(fmt.Errorf("sysctl: %v", err))
+	if err := checkMTU(dir); err != nil {
+		appendError(warning{fmt.Errorf("mtu: %v", err)})
 	}
+	steps.done(StepMTU)
 
-	if err := applyFirewall(dir, ifname); err != nil {
-		appendError(fmt.Errorf("firewall: %v", err))
+	if err := applyQoS(dir); err != nil {
+		appendError(warning{fmt.Errorf("qos: %v", err)})
 	}
+	steps.done(StepQoS)
 
-	if err := applyWireGuard(dir); err != nil {
-		appendError(fmt.Errorf("wireguard: %v", err))
-	}
+	steps.finish()
 
 	if len(errors) > 0 {
 		return fmt.Errorf("%v", errors)
 	}
+	if len(warnings) > 0 {
+		return warnings
+	}
 	return nil
 }
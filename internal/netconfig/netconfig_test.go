@@ -0,0 +1,212 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyHardwareAddr(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	const spoof = "dc:9b:9c:ee:72:fd"
+	// Applying twice must not fail: the second call must not touch the link.
+	for i := 0; i < 2; i++ {
+		l, err := netlink.LinkByName("veth0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := applyHardwareAddr(l, spoof); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := netlink.LinkByName("veth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.Attrs().HardwareAddr.String(), spoof; got != want {
+		t.Errorf("hardware address: got %s, want %s", got, want)
+	}
+
+	if err := applyHardwareAddr(l, "dc:9b:9c"); err == nil {
+		t.Errorf("applyHardwareAddr(invalid) unexpectedly succeeded")
+	}
+}
+
+func TestApplyLinkSettings(t *testing.T) {
+	var calls []string
+	autoneg := true
+	origAutoneg, origSpeedDuplex, origEEE, origPause := getAutoneg, setSpeedDuplex, setEEE, setPause
+	defer func() {
+		getAutoneg, setSpeedDuplex, setEEE, setPause = origAutoneg, origSpeedDuplex, origEEE, origPause
+	}()
+	getAutoneg = func(ifname string) (supported, enabled bool, _ error) {
+		return true, autoneg, nil
+	}
+	setSpeedDuplex = func(ifname string, speed int, fullDuplex bool) error {
+		calls = append(calls, fmt.Sprintf("speed(%s, %d, full=%v)", ifname, speed, fullDuplex))
+		return nil
+	}
+	setEEE = func(ifname string, enabled bool) error {
+		calls = append(calls, fmt.Sprintf("eee(%s, %v)", ifname, enabled))
+		return nil
+	}
+	setPause = func(ifname string, rx, tx *bool) error {
+		str := func(b *bool) string {
+			if b == nil {
+				return "unchanged"
+			}
+			return fmt.Sprint(*b)
+		}
+		calls = append(calls, fmt.Sprintf("pause(%s, rx=%s, tx=%s)", ifname, str(rx), str(tx)))
+		return nil
+	}
+
+	for _, tt := range []struct {
+		name    string
+		details string
+		forced  bool // autonegotiation currently disabled
+		want    []string
+	}{
+		{
+			name:    "Speed",
+			details: `{"link": {"speed": 100, "duplex": "half"}}`,
+			want:    []string{"speed(uplink0, 100, full=false)"},
+		},
+		{
+			name:    "SpeedDefaultDuplex",
+			details: `{"link": {"speed": 1000}}`,
+			want:    []string{"speed(uplink0, 1000, full=true)"},
+		},
+		{
+			name:    "EEE",
+			details: `{"link": {"eee": false}}`,
+			want:    []string{"eee(uplink0, false)"},
+		},
+		{
+			name:    "RxPauseOnly",
+			details: `{"link": {"rx_pause": false}}`,
+			want:    []string{"pause(uplink0, rx=false, tx=unchanged)"},
+		},
+		{
+			name:    "TxPauseOnly",
+			details: `{"link": {"tx_pause": true}}`,
+			want:    []string{"pause(uplink0, rx=unchanged, tx=true)"},
+		},
+		{
+			name:    "Unset",
+			details: `{"link": {}}`,
+			want:    nil,
+		},
+		{
+			name:    "NotConfigured",
+			details: `{}`,
+			want:    nil,
+		},
+		{
+			name:    "SpeedRemoved",
+			details: `{"link": {"eee": true}}`,
+			forced:  true,
+			want:    []string{"speed(uplink0, 0, full=true)", "eee(uplink0, true)"},
+		},
+		{
+			name:    "SpeedRemovedNotConfigured",
+			details: `{}`,
+			forced:  true,
+			want:    []string{"speed(uplink0, 0, full=true)"},
+		},
+		{
+			name:    "SpeedStillForced",
+			details: `{"link": {"speed": 100}}`,
+			forced:  true,
+			want:    []string{"speed(uplink0, 100, full=true)"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			autoneg = !tt.forced
+			var details InterfaceDetails
+			if err := json.Unmarshal([]byte(tt.details), &details); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyLinkSettings("uplink0", details.Link); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, calls); diff != "" {
+				t.Errorf("ethtool calls: unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if err := applyLinkSettings("uplink0", &LinkSettings{Speed: 100, Duplex: "quarter"}); err == nil {
+		t.Errorf("applyLinkSettings(duplex=quarter) unexpectedly succeeded")
+	}
+}
+
+func TestInterfaceDetailsMatches(t *testing.T) {
+	nic := linkInfo{
+		name:     "eth0",
+		addr:     "02:00:00:00:00:01", // randomized by the driver
+		permAddr: "dc:9b:9c:ee:72:fd",
+		path:     "/sys/devices/pci0000:00/0000:00:1c.0/0000:02:00.0",
+		driver:   "igb",
+	}
+	spoofed := nic
+	spoofed.addr = "00:1f:16:31:73:75"
+	virtual := linkInfo{name: "wg0"}
+
+	for _, tt := range []struct {
+		name    string
+		details InterfaceDetails
+		li      linkInfo
+		want    bool
+	}{
+		{"PermAddr", InterfaceDetails{HardwareAddr: "dc:9b:9c:ee:72:fd"}, nic, true},
+		{"CurrentAddr", InterfaceDetails{HardwareAddr: "02:00:00:00:00:01"}, nic, true},
+		{"OtherAddr", InterfaceDetails{HardwareAddr: "dc:9b:9c:ee:72:fe"}, nic, false},
+		{"Path", InterfaceDetails{Path: "0000:02:00.0"}, nic, true},
+		{"PathSuffixOnly", InterfaceDetails{Path: "00:02:00.0"}, nic, false},
+		{"OtherPath", InterfaceDetails{Path: "0000:03:00.0"}, nic, false},
+		{"Driver", InterfaceDetails{Driver: "igb"}, nic, true},
+		{"OtherDriver", InterfaceDetails{Driver: "r8169"}, nic, false},
+		{"AllCriteria", InterfaceDetails{HardwareAddr: "dc:9b:9c:ee:72:fd", Path: "0000:02:00.0", Driver: "igb"}, nic, true},
+		{"OneCriterionDiffers", InterfaceDetails{HardwareAddr: "dc:9b:9c:ee:72:fd", Path: "0000:02:00.0", Driver: "e1000e"}, nic, false},
+		{"NoCriteria", InterfaceDetails{Name: "eth0"}, nic, false},
+		{"Spoofed", InterfaceDetails{HardwareAddr: "dc:9b:9c:ee:72:fe", SpoofHardwareAddr: "00:1f:16:31:73:75"}, spoofed, true},
+		{"SpoofedOnly", InterfaceDetails{Name: "uplink0", SpoofHardwareAddr: "00:1f:16:31:73:75"}, spoofed, true},
+		{"SpoofedOnlyOtherAddr", InterfaceDetails{Name: "uplink0", SpoofHardwareAddr: "00:1f:16:31:73:75"}, nic, false},
+		{"VirtualByName", InterfaceDetails{Name: "wg0"}, virtual, true},
+		{"VirtualOtherName", InterfaceDetails{Name: "wg1"}, virtual, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.details.matches(tt.li); got != tt.want {
+				t.Errorf("%+v.matches(%+v) = %v, want %v", tt.details, tt.li, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/renameio"
+	"github.com/vishvananda/netlink"
+)
+
+// Route protocols (rtm_protocol) of the routes which netconfig installs.
+// netconfig only ever removes routes of these protocols, so routes of other
+// origin (the kernel, routing daemons such as babeld or bird, or “ip route
+// add”) are left alone. The numbers are not assigned in
+// /etc/iproute2/rt_protos, so use e.g. “ip route show proto 71” to list
+// the static routes.
+const (
+	rtprotLease     = 70 // DHCP leases, see dhcp4Lease
+	rtprotStatic    = 71 // routes.json, see applyRoutes
+	rtprotExport    = 72 // routing.json export table, see applyExport
+	rtprotIntercept = 73 // TPROXY HTTP(S) interception (intercept.go), see interceptionState
+	rtprotWireGuard = 74 // wireguard.json allowed IPs, see applyWireGuardRoutes
+)
+
+// ownedAddrs is the set of addresses which netconfig configured, so that only
+// those are removed once no longer desired (e.g. the address of a previous
+// DHCP lease). Unlike routes, addresses cannot be tagged with a protocol, so
+// the set is persisted across restarts in dir/netconfigd/addrs.json.
+type ownedAddrs struct {
+	path  string // empty for an in-memory set
+	addrs map[string]bool
+}
+
+func ownedAddrsPath(dir string) string {
+	return filepath.Join(dir, "netconfigd", "addrs.json")
+}
+
+func ownedAddrKey(ifname string, addr *netlink.Addr) string {
+	return ifname + " " + addr.IPNet.String()
+}
+
+// loadOwnedAddrs reads the set of owned addresses from dir. A missing or
+// corrupt file results in an empty set: addresses are then kept rather
+// than removed.
+func loadOwnedAddrs(dir string) *ownedAddrs {
+	o := &ownedAddrs{
+		path:  ownedAddrsPath(dir),
+		addrs: make(map[string]bool),
+	}
+	b, err := ioutil.ReadFile(o.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("owned addresses: %v", err)
+		}
+		return o
+	}
+	var keys []string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		log.Printf("owned addresses: %s: %v", o.path, err)
+		return o
+	}
+	for _, key := range keys {
+		o.addrs[key] = true
+	}
+	return o
+}
+
+// owns reports whether addr on ifname was configured by netconfig. A nil
+// set owns no addresses.
+func (o *ownedAddrs) owns(ifname string, addr *netlink.Addr) bool {
+	return o != nil && o.addrs[ownedAddrKey(ifname, addr)]
+}
+
+func (o *ownedAddrs) add(ifname string, addr *netlink.Addr) {
+	if o != nil {
+		o.addrs[ownedAddrKey(ifname, addr)] = true
+	}
+}
+
+func (o *ownedAddrs) remove(ifname string, addr *netlink.Addr) {
+	if o != nil {
+		delete(o.addrs, ownedAddrKey(ifname, addr))
+	}
+}
+
+// save persists the set, if it is not an in-memory set.
+func (o *ownedAddrs) save() error {
+	if o == nil || o.path == "" {
+		return nil
+	}
+	keys := make([]string, 0, len(o.addrs))
+	for key := range o.addrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b, err := json.MarshalIndent(keys, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(o.path, b, 0644)
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// Conntrack states, from include/uapi/linux/netfilter/nf_conntrack_common.h
+const (
+	ctStateEstablished = 2
+	ctStateRelated     = 4
+	ctStateNew         = 8
+)
+
+// Pinhole allows inbound IPv6 connections from the internet to a LAN host.
+// Pinholes refer to hosts instead of addresses: the rules are regenerated
+// from the host’s token binding (see Binding.Token) whenever the delegated
+// prefix or the host changes.
+type Pinhole struct {
+	Host  string `json:"host"`  // DHCP hostname or hardware address, e.g. “nas”
+	Proto string `json:"proto"` // e.g. “tcp” (or “tcp,udp”)
+	Port  string `json:"port"`  // e.g. “443” (or “8000-8080”)
+}
+
+// hostHardwareAddrs returns the hardware address of each DHCP hostname
+// (lower-case) in the dhcp4d leases.
+func hostHardwareAddrs(dir string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp4d", "leases.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// The lease type lives in internal/dhcp4d, which imports this package.
+	var leases []struct {
+		HardwareAddr     string `json:"hardware_addr"`
+		Hostname         string `json:"hostname"`
+		HostnameOverride string `json:"hostname_override"`
+	}
+	if err := json.Unmarshal(b, &leases); err != nil {
+		return nil, err
+	}
+	hwaddrs := make(map[string]string)
+	for _, l := range leases {
+		hostname := l.Hostname
+		if l.HostnameOverride != "" {
+			hostname = l.HostnameOverride
+		}
+		hwaddr, err := net.ParseMAC(l.HardwareAddr)
+		if err != nil || hostname == "" {
+			continue
+		}
+		hwaddrs[strings.ToLower(hostname)] = hwaddr.String()
+	}
+	return hwaddrs, nil
+}
+
+// pinholeAddr returns the current address of the host of p, or nil if the
+// host is unknown or has no token address (yet).
+func pinholeAddr(p Pinhole, hwaddrs map[string]string, tokenAddrs map[string]net.IP) net.IP {
+	if hwaddr, err := net.ParseMAC(p.Host); err == nil {
+		return tokenAddrs[hwaddr.String()]
+	}
+	return tokenAddrs[hwaddrs[strings.ToLower(p.Host)]]
+}
+
+// applyPinholes accepts inbound IPv6 connections to the pinholes of
+// firewall.json and drops all other new inbound IPv6 connections on all
+// masqueraded uplinks. Without pinholes, inbound IPv6 traffic is not
+// filtered.
+func applyPinholes(dir, ifname string, c *ruleset, filter6 *nftables.Table, forward *nftables.Chain) error {
+	cfg, err := readFirewallConfig(dir)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Pinholes) == 0 {
+		return nil
+	}
+	hwaddrs, err := hostHardwareAddrs(dir)
+	if err != nil {
+		return err
+	}
+	tokenAddrs, err := TokenAddrs(dir)
+	if err != nil {
+		return err
+	}
+	var pinholes [][]expr.Any
+	for _, p := range cfg.Pinholes {
+		min, max, err := parsePort(p.Port)
+		if err != nil {
+			return err
+		}
+		for _, proto := range strings.Split(p.Proto, ",") {
+			l4proto, err := parseProto(proto)
+			if err != nil {
+				return err
+			}
+			addr := pinholeAddr(p, hwaddrs, tokenAddrs)
+			if addr == nil {
+				// Not a configuration error: the lease might have expired, or
+				// dhcp6 might not have obtained a prefix yet.
+				log.Printf("pinhole %s %s/%s: no token address for host, not opening", p.Host, p.Port, proto)
+				continue
+			}
+			exprs := daddrExprs(&net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}, expr.CmpOpEq)
+			exprs = append(exprs,
+				// [ meta load l4proto => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				// [ cmp eq reg 1 0x00000006 ]
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     []byte{l4proto},
+				},
+				// [ payload load 2b @ transport header + 2 => reg 1 ]
+				&expr.Payload{
+					DestRegister: 1,
+					Base:         expr.PayloadBaseTransportHeader,
+					Offset:       2, // destination port
+					Len:          2,
+				})
+			exprs = append(exprs, portCmp(min, max)...)
+			pinholes = append(pinholes, append(exprs,
+				// [ immediate reg 0 accept ]
+				&expr.Verdict{Kind: expr.VerdictAccept}))
+		}
+	}
+
+	for _, uplink := range masqueradedUplinks(ifname) {
+		inbound := append(iifnameExprs(uplink),
+			// [ meta load oifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			// [ cmp eq reg 1 0x306e616c 0x00000000 0x00000000 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     nfifname("lan0"),
+			})
+		for _, pinhole := range pinholes {
+			c.AddRule(&nftables.Rule{
+				Table: filter6,
+				Chain: forward,
+				Exprs: append(append([]expr.Any(nil), inbound...), pinhole...),
+			})
+		}
+
+		c.AddRule(&nftables.Rule{
+			Table: filter6,
+			Chain: forward,
+			Exprs: append(inbound,
+				// ct state != established,related
+				&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+				&expr.Bitwise{
+					SourceRegister: 1,
+					DestRegister:   1,
+					Len:            4,
+					Mask:           binaryutil.NativeEndian.PutUint32(ctStateEstablished | ctStateRelated),
+					Xor:            binaryutil.NativeEndian.PutUint32(0),
+				},
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     binaryutil.NativeEndian.PutUint32(0),
+				},
+				// [ immediate reg 0 drop ]
+				&expr.Verdict{Kind: expr.VerdictDrop}),
+		})
+	}
+	return nil
+}
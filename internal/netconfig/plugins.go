@@ -0,0 +1,144 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/renameio"
+)
+
+// FirewallFragment is the contribution of a plugin (see pluginsd) to the
+// firewall: port forwardings (as in portforwardings.json) and blocks.
+type FirewallFragment struct {
+	Forwardings []PortForwarding `json:"forwardings,omitempty"`
+	Blocks      []Block          `json:"blocks,omitempty"`
+}
+
+// Validate returns an error if f would not result in a valid firewall.
+func (f FirewallFragment) Validate() error {
+	for _, fw := range f.Forwardings {
+		for _, proto := range strings.Split(fw.Proto, ",") {
+			if _, err := parseProto(proto); err != nil {
+				return fmt.Errorf("forwarding %s: %v", fw.Port, err)
+			}
+		}
+		if _, _, err := parsePort(fw.Port); err != nil {
+			return fmt.Errorf("forwarding: %v", err)
+		}
+		if _, _, err := parsePort(fw.DestPort); err != nil {
+			return fmt.Errorf("forwarding %s: dest_port: %v", fw.Port, err)
+		}
+		if ip := net.ParseIP(fw.DestAddr); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("forwarding %s: invalid dest_addr %q", fw.Port, fw.DestAddr)
+		}
+	}
+	for _, b := range f.Blocks {
+		if b.Addr == "" && b.HardwareAddr == "" {
+			return fmt.Errorf("block: neither addr nor hardware_addr set")
+		}
+		if b.Addr != "" && net.ParseIP(b.Addr) == nil {
+			return fmt.Errorf("block: invalid addr %q", b.Addr)
+		}
+		if b.HardwareAddr != "" {
+			if _, err := net.ParseMAC(b.HardwareAddr); err != nil {
+				return fmt.Errorf("block: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func firewallFragmentPath(dir, plugin string) string {
+	return filepath.Join(dir, "pluginsd", plugin, "firewall.json")
+}
+
+// ReadFirewallFragments returns the firewall fragments of all plugins, keyed
+// by plugin name.
+func ReadFirewallFragments(dir string) (map[string]FirewallFragment, error) {
+	paths, err := filepath.Glob(firewallFragmentPath(dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	fragments := make(map[string]FirewallFragment, len(paths))
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f FirewallFragment
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		fragments[filepath.Base(filepath.Dir(path))] = f
+	}
+	return fragments, nil
+}
+
+// WriteFirewallFragment validates and persists the firewall fragment of
+// plugin to dir.
+func WriteFirewallFragment(dir, plugin string, f FirewallFragment) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := firewallFragmentPath(dir, plugin)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(path, b, 0644)
+}
+
+// RemoveFirewallFragment removes the firewall fragment of plugin from dir,
+// e.g. after the plugin was removed from the configuration.
+func RemoveFirewallFragment(dir, plugin string) error {
+	if err := os.Remove(firewallFragmentPath(dir, plugin)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pluginFragments returns the port forwardings and blocks of all plugins, in
+// plugin name order for a deterministic ruleset.
+func pluginFragments(dir string) ([]PortForwarding, []Block, error) {
+	fragments, err := ReadFirewallFragments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(fragments))
+	for name := range fragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var (
+		forwardings []PortForwarding
+		blocks      []Block
+	)
+	for _, name := range names {
+		forwardings = append(forwardings, fragments[name].Forwardings...)
+		blocks = append(blocks, fragments[name].Blocks...)
+	}
+	return forwardings, blocks, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// PortViolation is a bridge member on which more hardware addresses than
+// BridgeDetails.MaxMACs were learned.
+type PortViolation struct {
+	Bridge  string   // e.g. lan0
+	Member  string   // e.g. lan3
+	Max     int      // e.g. 2
+	HWAddrs []string // learned hardware addresses
+	Allowed []string // hardware addresses which remain allowed
+}
+
+func (v PortViolation) String() string {
+	return fmt.Sprintf("bridge %s: %d hardware addresses on %s (max %d): %s; locked to %s",
+		v.Bridge, len(v.HWAddrs), v.Member, v.Max,
+		strings.Join(v.HWAddrs, ", "),
+		strings.Join(v.Allowed, ", "))
+}
+
+var (
+	portSecurityMu sync.Mutex
+	// lockedPorts are the members which CheckPortSecurity locked, so that
+	// Apply keeps them locked.
+	lockedPorts = make(map[string]bool)
+	// knownGood are the hardware addresses of each member when it was last
+	// within its limit.
+	knownGood = make(map[string][]string)
+)
+
+func portLocked(member string) bool {
+	portSecurityMu.Lock()
+	defer portSecurityMu.Unlock()
+	return lockedPorts[member]
+}
+
+// learnedHWAddrs returns the hardware addresses which bridge learned on each
+// of its members, i.e. the dynamic entries of its forwarding database.
+func learnedHWAddrs(bridge netlink.Link) (map[int][]string, error) {
+	fdb, err := netlink.NeighList(0, unix.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+	learned := make(map[int][]string)
+	seen := make(map[string]bool)
+	for _, n := range fdb {
+		if n.MasterIndex != bridge.Attrs().Index ||
+			n.State&(unix.NUD_PERMANENT|unix.NUD_NOARP) != 0 {
+			continue // local or static entry
+		}
+		key := fmt.Sprintf("%d/%s", n.LinkIndex, n.HardwareAddr)
+		if seen[key] {
+			continue // same address in multiple VLANs
+		}
+		seen[key] = true
+		learned[n.LinkIndex] = append(learned[n.LinkIndex], n.HardwareAddr.String())
+	}
+	for _, hwaddrs := range learned {
+		sort.Strings(hwaddrs)
+	}
+	return learned, nil
+}
+
+// lockPort pins the allowed hardware addresses to member as static
+// forwarding database entries and locks member, so that the bridge drops
+// frames from all other hardware addresses.
+func lockPort(bridge, member netlink.Link, allowed []string) error {
+	for _, hwaddr := range allowed {
+		n := &netlink.Neigh{
+			LinkIndex:   member.Attrs().Index,
+			MasterIndex: bridge.Attrs().Index,
+			Family:      unix.AF_BRIDGE,
+			Flags:       netlink.NTF_MASTER,
+			State:       unix.NUD_NOARP, // static
+		}
+		var err error
+		if n.HardwareAddr, err = net.ParseMAC(hwaddr); err != nil {
+			return err
+		}
+		if err := netlink.NeighSet(n); err != nil {
+			return fmt.Errorf("pinning %s: %v", hwaddr, err)
+		}
+	}
+	portSecurityMu.Lock()
+	lockedPorts[member.Attrs().Name] = true
+	portSecurityMu.Unlock()
+	return setBridgePort(member, iflaBrportLocked, true)
+}
+
+// CheckPortSecurity compares the number of hardware addresses learned on the
+// members of the bridges of interfaces.json in dir with their MaxMACs limit.
+// A member exceeding its limit is locked to the hardware addresses it had
+// when it was last checked within its limit (if any), until netconfigd
+// restarts. Locked members are not reported again.
+func CheckPortSecurity(dir string) ([]PortViolation, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	var violations []PortViolation
+	for _, br := range cfg.Bridges {
+		if len(br.MaxMACs) == 0 {
+			continue
+		}
+		bridge, err := netlink.LinkByName(br.Name)
+		if err != nil {
+			return nil, err
+		}
+		learned, err := learnedHWAddrs(bridge)
+		if err != nil {
+			return nil, fmt.Errorf("bridge %s: %v", br.Name, err)
+		}
+		for member, max := range br.MaxMACs {
+			if portLocked(member) {
+				continue
+			}
+			l, err := netlink.LinkByName(member)
+			if err != nil {
+				continue // not present (yet)
+			}
+			hwaddrs := learned[l.Attrs().Index]
+			if len(hwaddrs) <= max {
+				portSecurityMu.Lock()
+				knownGood[member] = hwaddrs
+				portSecurityMu.Unlock()
+				continue
+			}
+			portSecurityMu.Lock()
+			allowed := knownGood[member]
+			portSecurityMu.Unlock()
+			if err := lockPort(bridge, l, allowed); err != nil {
+				return nil, fmt.Errorf("bridge %s: locking %s: %v", br.Name, member, err)
+			}
+			violations = append(violations, PortViolation{
+				Bridge:  br.Name,
+				Member:  member,
+				Max:     max,
+				HWAddrs: hwaddrs,
+				Allowed: allowed,
+			})
+		}
+	}
+	return violations, nil
+}
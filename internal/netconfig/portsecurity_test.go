@@ -0,0 +1,165 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// TestPortSecurity sends frames from several hardware addresses into a
+// bridge member (via the peer of a veth pair) in a new network namespace.
+func TestPortSecurity(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	if err := netlink.LinkAdd(&netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: "lan1"},
+		PeerName:  "peer1",
+	}); err != nil {
+		t.Skipf("adding veth link: %v", err)
+	}
+	peer, err := netlink.LinkByName("peer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the peer from sending frames (e.g. router solicitations) itself.
+	if err := ioutil.WriteFile("/proc/sys/net/ipv6/conf/peer1/disable_ipv6", []byte("1"), 0644); err != nil {
+		t.Skipf("disabling IPv6: %v", err)
+	}
+	if err := netlink.LinkSetUp(peer); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{
+  "bridges": [
+    {
+      "name": "br0",
+      "members": ["lan1"],
+      "max_macs": {"lan1": 1}
+    }
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyInterfaces(tmp, tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		portSecurityMu.Lock()
+		defer portSecurityMu.Unlock()
+		delete(lockedPorts, "lan1")
+		delete(knownGood, "lan1")
+	}()
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	send := func(src string) {
+		t.Helper()
+		hwaddr, err := net.ParseMAC(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Any frame suffices for the bridge to learn its source address.
+		frame := loopProbe(hwaddr, make([]byte, 8), 0)
+		if err := unix.Sendto(fd, frame, 0, &unix.SockaddrLinklayer{
+			Ifindex: peer.Attrs().Index,
+			Halen:   6,
+			Addr:    [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	learned := func() []string {
+		t.Helper()
+		bridge, err := netlink.LinkByName("br0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lan1, err := netlink.LinkByName("lan1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := learnedHWAddrs(bridge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l[lan1.Attrs().Index]
+	}
+
+	send("02:00:00:00:00:0a")
+	violations, err := CheckPortSecurity(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) > 0 {
+		t.Fatalf("CheckPortSecurity: unexpected violations: %v", violations)
+	}
+
+	send("02:00:00:00:00:0b")
+	send("02:00:00:00:00:0c")
+	violations, err = CheckPortSecurity(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortViolation{
+		{
+			Bridge:  "br0",
+			Member:  "lan1",
+			Max:     1,
+			HWAddrs: []string{"02:00:00:00:00:0a", "02:00:00:00:00:0b", "02:00:00:00:00:0c"},
+			Allowed: []string{"02:00:00:00:00:0a"},
+		},
+	}
+	if diff := cmp.Diff(want, violations); diff != "" {
+		t.Fatalf("CheckPortSecurity: unexpected violations: diff (-want +got):\n%s", diff)
+	}
+
+	// The locked member must not learn new hardware addresses. The entries
+	// learned before the violation age out.
+	send("02:00:00:00:00:0d")
+	for _, hwaddr := range learned() {
+		if hwaddr == "02:00:00:00:00:0d" {
+			t.Errorf("locked member learned %s", hwaddr)
+		}
+	}
+	// Locked members are not reported again.
+	if violations, err := CheckPortSecurity(tmp); err != nil {
+		t.Fatal(err)
+	} else if len(violations) > 0 {
+		t.Errorf("CheckPortSecurity after locking: unexpected violations: %v", violations)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/dhcp6"
+)
+
+// Subnet returns the /64 subnet with index idx of the delegated prefix, e.g.
+// 2001:db8:0:1::/64 for index 1 of 2001:db8::/48. Prefixes of /64 or longer
+// only have subnet 0, the prefix itself.
+func Subnet(prefix net.IPNet, idx int) (net.IPNet, error) {
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len {
+		return net.IPNet{}, fmt.Errorf("%v is not an IPv6 prefix", prefix)
+	}
+	if ones >= 64 {
+		if idx != 0 {
+			return net.IPNet{}, fmt.Errorf("subnet %d of %v: the prefix has no /64 subnets", idx, prefix)
+		}
+		return net.IPNet{IP: prefix.IP.Mask(prefix.Mask), Mask: prefix.Mask}, nil
+	}
+	if idx < 0 || uint64(idx) >= 1<<uint(64-ones) {
+		return net.IPNet{}, fmt.Errorf("subnet %d of %v: the prefix has %d /64 subnets", idx, prefix, uint64(1)<<uint(64-ones))
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.Mask(prefix.Mask))
+	binary.BigEndian.PutUint64(ip[:8], binary.BigEndian.Uint64(ip[:8])|uint64(idx))
+	return net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}, nil
+}
+
+// IPv6Subnets returns the interfaces which get a subnet of the delegated
+// prefixes, with the index of the subnet (see Subnet), as configured by
+// ipv6_subnet in interfaces.json in dir. lan0 gets subnet 0 unless configured
+// otherwise. Interfaces whose ipv6_subnet is negative are included with index
+// -1, so that their addresses of previous subnets are removed.
+func IPv6Subnets(dir string) (map[string]int, error) {
+	subnets := map[string]int{"lan0": 0}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return subnets, nil
+		}
+		return nil, err
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	for _, details := range cfg.Interfaces {
+		if details.IPv6Subnet == nil {
+			continue
+		}
+		idx := *details.IPv6Subnet
+		if idx < 0 {
+			idx = -1
+		}
+		subnets[details.Name] = idx
+	}
+	used := make(map[int]string)
+	for ifname, idx := range subnets {
+		if idx < 0 {
+			continue
+		}
+		if other, ok := used[idx]; ok {
+			return nil, fmt.Errorf("interfaces.json: %s and %s both use ipv6_subnet %d", other, ifname, idx)
+		}
+		used[idx] = ifname
+	}
+	return subnets, nil
+}
+
+// lifetime converts the absolute lifetime until into seconds for
+// netlink.Addr: 0 (forever) if the lease does not specify lifetimes, and at
+// least 1 so that an expiring address is not made permanent.
+func lifetime(until, now time.Time) int {
+	if until.IsZero() {
+		return 0
+	}
+	if secs := int(until.Sub(now) / time.Second); secs > 0 {
+		return secs
+	}
+	return 1
+}
+
+// delegatedAddrs returns the addresses (the first address of their subnet)
+// which the interfaces of IPv6Subnets get from the delegated prefixes of the
+// DHCPv6 lease in dir, keyed by interface name, with the preferred and valid
+// lifetimes of the lease. A nil map is returned if there is no lease yet.
+// Interfaces whose subnet does not exist within the prefixes are omitted and
+// reported in the returned error.
+func delegatedAddrs(dir string, now time.Time) (map[string][]*netlink.Addr, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // dhcp6 might not have obtained a lease yet
+		}
+		return nil, err
+	}
+	var got dhcp6.Config
+	if err := json.Unmarshal(b, &got); err != nil {
+		return nil, err
+	}
+	subnets, err := IPv6Subnets(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var first error
+	addrs := make(map[string][]*netlink.Addr)
+	for ifname, idx := range subnets {
+		addrs[ifname] = nil
+		if idx < 0 {
+			continue
+		}
+		for i, prefix := range got.Prefixes {
+			if i < len(got.Lifetimes) && !got.Lifetimes[i].ValidUntil.IsZero() &&
+				!got.Lifetimes[i].ValidUntil.After(now) {
+				continue // expired
+			}
+			subnet, err := Subnet(prefix, idx)
+			if err != nil {
+				if first == nil {
+					first = fmt.Errorf("%s: %v", ifname, err)
+				}
+				delete(addrs, ifname)
+				break
+			}
+			// pick the first address of the subnet, e.g. address
+			// 2a02:168:4a00:1::1 for subnet 2a02:168:4a00:1::/64
+			subnet.IP[len(subnet.IP)-1] = 1
+			addr := &netlink.Addr{IPNet: &subnet}
+			if i < len(got.Lifetimes) {
+				addr.ValidLft = lifetime(got.Lifetimes[i].ValidUntil, now)
+				addr.PreferedLft = lifetime(got.Lifetimes[i].PreferredUntil, now)
+				if addr.PreferedLft == 0 || addr.PreferedLft > addr.ValidLft {
+					addr.PreferedLft = addr.ValidLft
+				}
+			}
+			addrs[ifname] = append(addrs[ifname], addr)
+		}
+	}
+	return addrs, first
+}
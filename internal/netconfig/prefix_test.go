@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSubnet(t *testing.T) {
+	for _, tt := range []struct {
+		prefix  string
+		idx     int
+		want    string
+		wantErr bool
+	}{
+		{prefix: "2001:db8::/48", idx: 0, want: "2001:db8::/64"},
+		{prefix: "2001:db8::/48", idx: 1, want: "2001:db8:0:1::/64"},
+		{prefix: "2001:db8::/48", idx: 0xffff, want: "2001:db8:0:ffff::/64"},
+		{prefix: "2001:db8::/48", idx: 0x10000, wantErr: true},
+		{prefix: "2001:db8:0:ff00::/56", idx: 0x2a, want: "2001:db8:0:ff2a::/64"},
+		{prefix: "2001:db8:0:1::/64", idx: 0, want: "2001:db8:0:1::/64"},
+		{prefix: "2001:db8:0:1::/64", idx: 1, wantErr: true},
+		{prefix: "192.0.2.0/24", idx: 0, wantErr: true},
+	} {
+		t.Run(fmt.Sprintf("%s#%d", tt.prefix, tt.idx), func(t *testing.T) {
+			_, prefix, err := net.ParseCIDR(tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Subnet(*prefix, tt.idx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Subnet: err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("Subnet = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDelegatedAddrs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp6", "wire"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp6", "wire", "lease.json"), []byte(`
+{
+  "prefixes": [
+    {"IP": "2001:db8::", "Mask": "////////AAAAAAAAAAAAAA=="},
+    {"IP": "2001:db8:1::", "Mask": "////////AAAAAAAAAAAAAA=="}
+  ],
+  "lifetimes": [
+    {"preferred_until": "2020-06-01T13:00:00Z", "valid_until": "2020-06-01T14:00:00Z"},
+    {"preferred_until": "2020-06-01T11:00:00Z", "valid_until": "2020-06-01T11:30:00Z"}
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{
+  "interfaces": [
+    {"name": "lan0", "ipv6_subnet": 2},
+    {"name": "guest0", "ipv6_subnet": 1},
+    {"name": "iot0", "ipv6_subnet": -1},
+    {"name": "lab0", "ipv6_subnet": 65536}
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := delegatedAddrs(tmp, now)
+	if err == nil {
+		t.Errorf("delegatedAddrs: no error for lab0, whose subnet does not exist")
+	}
+	got := make(map[string][]string)
+	for ifname, as := range addrs {
+		got[ifname] = []string{}
+		for _, a := range as {
+			got[ifname] = append(got[ifname], fmt.Sprintf("%v preferred %d valid %d", a.IPNet, a.PreferedLft, a.ValidLft))
+		}
+	}
+	// The second prefix expired, lab0 is omitted.
+	want := map[string][]string{
+		"lan0":   {"2001:db8:0:2::1/64 preferred 3600 valid 7200"},
+		"guest0": {"2001:db8:0:1::1/64 preferred 3600 valid 7200"},
+		"iot0":   {},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("delegatedAddrs: diff (-want +got):\n%s", diff)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{"interfaces": [{"name": "guest0", "ipv6_subnet": 0}]}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IPv6Subnets(tmp); err == nil {
+		t.Errorf("IPv6Subnets: no error for subnet 0 used by lan0 and guest0")
+	}
+}
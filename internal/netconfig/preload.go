@@ -0,0 +1,105 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// preloadRuleset returns a minimal default-deny ruleset: forwarding is
+// dropped, and only loopback, lan0 and replies to connections the router
+// itself initiated are accepted as input.
+func preloadRuleset() *ruleset {
+	r := &ruleset{}
+	drop := nftables.ChainPolicyDrop
+	preload := r.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   "preload",
+	})
+	input := r.AddChain(&nftables.Chain{
+		Name:     "input",
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Table:    preload,
+		Type:     nftables.ChainTypeFilter,
+		Policy:   &drop,
+	})
+	r.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Table:    preload,
+		Type:     nftables.ChainTypeFilter,
+		Policy:   &drop,
+	})
+
+	for _, ifname := range []string{"lo", "lan0"} {
+		r.AddRule(&nftables.Rule{
+			Table: preload,
+			Chain: input,
+			Exprs: []expr.Any{
+				// meta iifname ifname
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{
+					Op:       expr.CmpOpEq,
+					Register: 1,
+					Data:     nfifname(ifname),
+				},
+				// accept
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			},
+		})
+	}
+
+	r.AddRule(&nftables.Rule{
+		Table: preload,
+		Chain: input,
+		Exprs: []expr.Any{
+			// ct state established,related
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(ctStateEstablished | ctStateRelated),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpNeq,
+				Register: 1,
+				Data:     binaryutil.NativeEndian.PutUint32(0),
+			},
+			// accept
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+	return r
+}
+
+// preloadFirewall installs preloadRuleset unless a ruleset is already
+// installed, i.e. at boot, so that the router is not exposed before Apply
+// converged. The full ruleset atomically replaces it (see ruleset.apply).
+func preloadFirewall(c *nftables.Conn) error {
+	tables, err := c.ListTables()
+	if err != nil {
+		return err
+	}
+	if len(tables) > 0 {
+		return nil // not booting, e.g. netconfigd was restarted
+	}
+	return preloadRuleset().apply(c)
+}
@@ -0,0 +1,352 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// QoSConfig is read from /perm/qos.json. It shapes the traffic of the uplink
+// to slightly below the line rate, so that queues build up in the router
+// (where CAKE or fq_codel keep them short) instead of in the modem, which
+// avoids bufferbloat.
+type QoSConfig struct {
+	Interface string `json:"interface"` // default: uplink0
+	Qdisc     string `json:"qdisc"`     // “cake” (default) or “fq_codel” (shaped by HTB)
+
+	// EgressKbit and IngressKbit are the upload and download rates in
+	// kbit/s, e.g. 9500 and 47500 for a 50/10 Mbit/s DSL line (about 95%
+	// of the line rate). 0 leaves the direction unshaped.
+	EgressKbit  uint64 `json:"egress_kbit"`
+	IngressKbit uint64 `json:"ingress_kbit"`
+
+	// Overhead is the per-packet overhead of the link layer in bytes (CAKE
+	// only), e.g. 34 for VDSL2 with PPPoE. 0 uses the CAKE default.
+	Overhead int `json:"overhead"`
+}
+
+func readQoSConfig(dir string) (*QoSConfig, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "qos.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg QoSConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Interface == "" {
+		cfg.Interface = "uplink0"
+	}
+	if cfg.Qdisc == "" {
+		cfg.Qdisc = "cake"
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (cfg *QoSConfig) validate() error {
+	if cfg.Qdisc != "cake" && cfg.Qdisc != "fq_codel" {
+		return fmt.Errorf("invalid qdisc %q: expected cake or fq_codel", cfg.Qdisc)
+	}
+	if cfg.Overhead < -64 || cfg.Overhead > 256 {
+		return fmt.Errorf("overhead %d out of range [-64, 256]", cfg.Overhead)
+	}
+	return nil
+}
+
+// ifbName returns the name of the IFB link whose egress shapes the ingress
+// traffic of ifname.
+func ifbName(ifname string) string {
+	name := "ifb4" + ifname
+	if len(name) > unix.IFNAMSIZ-1 {
+		name = name[:unix.IFNAMSIZ-1]
+	}
+	return name
+}
+
+// qosApplied is the configuration which was last applied, and the link it
+// was applied to: a recreated link (e.g. ppp0) has a new index.
+var qosApplied struct {
+	sync.Mutex
+	cfg       *QoSConfig
+	linkIndex int
+}
+
+var rootHandle = netlink.MakeHandle(1, 0)
+
+// applyQoS installs the qdiscs of qos.json on the uplink, unless they were
+// already installed on the same link, and removes them when qos.json is
+// removed.
+func applyQoS(dir string) error {
+	cfg, err := readQoSConfig(dir)
+	if err != nil {
+		return err
+	}
+	qosApplied.Lock()
+	defer qosApplied.Unlock()
+	if cfg == nil {
+		if prev := qosApplied.cfg; prev != nil {
+			qosApplied.cfg = nil
+			return removeQoS(prev.Interface)
+		}
+		return nil
+	}
+	link, err := netlink.LinkByName(cfg.Interface)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil // uplink not present (yet), e.g. PPPoE session down
+		}
+		return err
+	}
+	if prev := qosApplied.cfg; prev != nil && *prev == *cfg && qosApplied.linkIndex == link.Attrs().Index {
+		return nil
+	}
+	if prev := qosApplied.cfg; prev != nil && prev.Interface != cfg.Interface {
+		if err := removeQoS(prev.Interface); err != nil {
+			return err
+		}
+	}
+	qosApplied.cfg = nil // re-apply after errors
+	if err := applyShaping(link, cfg); err != nil {
+		return err
+	}
+	qosApplied.cfg = cfg
+	qosApplied.linkIndex = link.Attrs().Index
+	return nil
+}
+
+func applyShaping(link netlink.Link, cfg *QoSConfig) error {
+	if cfg.EgressKbit > 0 {
+		if err := replaceShaper(link, cfg, cfg.EgressKbit, false); err != nil {
+			return fmt.Errorf("egress: %v", err)
+		}
+	} else if err := deleteRootQdisc(link); err != nil {
+		return fmt.Errorf("egress: %v", err)
+	}
+
+	if cfg.IngressKbit == 0 {
+		return removeIngress(link)
+	}
+	ifb, err := ensureIFB(ifbName(cfg.Interface))
+	if err != nil {
+		return fmt.Errorf("ingress: %v", err)
+	}
+	// Redirect all ingress traffic of the uplink to the IFB link, whose
+	// egress is shaped like an uplink.
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := netlink.QdiscReplace(ingress); err != nil {
+		return fmt.Errorf("ingress: QdiscReplace(ingress): %v", err)
+	}
+	redirect := &netlink.MatchAll{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    ingress.Handle,
+			Priority:  1,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{netlink.NewMirredAction(ifb.Attrs().Index)},
+	}
+	if err := netlink.FilterReplace(redirect); err != nil {
+		return fmt.Errorf("ingress: FilterReplace(redirect to %s): %v", ifb.Attrs().Name, err)
+	}
+	if err := replaceShaper(ifb, cfg, cfg.IngressKbit, true); err != nil {
+		return fmt.Errorf("ingress: %v", err)
+	}
+	return nil
+}
+
+// replaceShaper installs the root qdisc of cfg, shaping to kbit, on link.
+func replaceShaper(link netlink.Link, cfg *QoSConfig, kbit uint64, ingress bool) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		// A qdisc of a different kind cannot be replaced in place.
+		if q.Attrs().Parent == netlink.HANDLE_ROOT && q.Attrs().Handle == rootHandle && q.Type() != rootQdiscKind(cfg) {
+			if err := netlink.QdiscDel(q); err != nil {
+				return fmt.Errorf("QdiscDel(%s): %v", q.Type(), err)
+			}
+		}
+	}
+	if cfg.Qdisc == "cake" {
+		return replaceCake(link.Attrs().Index, kbit, cfg.Overhead, ingress)
+	}
+	htb := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    rootHandle,
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	htb.Defcls = 1
+	if err := netlink.QdiscReplace(htb); err != nil {
+		return fmt.Errorf("QdiscReplace(htb): %v", err)
+	}
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(1, 1),
+		Parent:    rootHandle,
+	}, netlink.HtbClassAttrs{
+		Rate: kbit * 1000, // bit/s
+	})
+	if err := netlink.ClassReplace(class); err != nil {
+		return fmt.Errorf("ClassReplace(htb): %v", err)
+	}
+	fqCodel := netlink.NewFqCodel(netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(0x10, 0),
+		Parent:    class.Handle,
+	})
+	if err := netlink.QdiscReplace(fqCodel); err != nil {
+		return fmt.Errorf("QdiscReplace(fq_codel): %v", err)
+	}
+	return nil
+}
+
+func rootQdiscKind(cfg *QoSConfig) string {
+	if cfg.Qdisc == "cake" {
+		return "cake"
+	}
+	return "htb"
+}
+
+// Attributes of the CAKE qdisc (linux/pkt_sched.h), which the netlink
+// package does not support.
+const (
+	tcaCakeBaseRate64 = 2
+	tcaCakeOverhead   = 6
+	tcaCakeNat        = 11
+	tcaCakeIngress    = 15
+)
+
+func replaceCake(linkIndex int, kbit uint64, overhead int, ingress bool) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWQDISC, unix.NLM_F_CREATE|unix.NLM_F_REPLACE|unix.NLM_F_ACK)
+	req.AddData(&nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(linkIndex),
+		Handle:  rootHandle,
+		Parent:  netlink.HANDLE_ROOT,
+	})
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("cake")))
+	options := nl.NewRtAttr(nl.TCA_OPTIONS, nil)
+	options.AddRtAttr(tcaCakeBaseRate64, nl.Uint64Attr(kbit*1000/8)) // byte/s
+	// Fairness between LAN hosts instead of between their (masqueraded)
+	// flows.
+	options.AddRtAttr(tcaCakeNat, nl.Uint32Attr(1))
+	if overhead != 0 {
+		options.AddRtAttr(tcaCakeOverhead, nl.Uint32Attr(uint32(int32(overhead))))
+	}
+	if ingress {
+		options.AddRtAttr(tcaCakeIngress, nl.Uint32Attr(1))
+	}
+	req.AddData(options)
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("RTM_NEWQDISC(cake): %v (is sch_cake available?)", err)
+	}
+	return nil
+}
+
+func ensureIFB(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); !ok {
+			return nil, err
+		}
+		if err := netlink.LinkAdd(&netlink.Ifb{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			return nil, fmt.Errorf("LinkAdd(ifb %s): %v", name, err)
+		}
+		if link, err = netlink.LinkByName(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("LinkSetUp(%s): %v", name, err)
+	}
+	return link, nil
+}
+
+// deleteRootQdisc restores the default root qdisc of link.
+func deleteRootQdisc(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_ROOT && q.Attrs().Handle == rootHandle {
+			if err := netlink.QdiscDel(q); err != nil {
+				return fmt.Errorf("QdiscDel(%s): %v", q.Type(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeIngress removes the ingress qdisc (with the redirect filter) of link
+// and the IFB link.
+func removeIngress(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Attrs().Parent == netlink.HANDLE_INGRESS {
+			if err := netlink.QdiscDel(q); err != nil {
+				return fmt.Errorf("QdiscDel(ingress): %v", err)
+			}
+		}
+	}
+	ifb, err := netlink.LinkByName(ifbName(link.Attrs().Name))
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(ifb)
+}
+
+// removeQoS removes the shaping of ifname, e.g. after qos.json was removed.
+func removeQoS(ifname string) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	if err := deleteRootQdisc(link); err != nil {
+		return err
+	}
+	return removeIngress(link)
+}
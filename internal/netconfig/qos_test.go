@@ -0,0 +1,148 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadQoSConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if cfg, err := readQoSConfig(tmp); err != nil || cfg != nil {
+		t.Fatalf("readQoSConfig(no qos.json) = %v, %v, want nil, nil", cfg, err)
+	}
+
+	write := func(cfg string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(tmp, "qos.json"), []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"egress_kbit": 9500, "ingress_kbit": 47500}`)
+	got, err := readQoSConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &QoSConfig{
+		Interface:   "uplink0",
+		Qdisc:       "cake",
+		EgressKbit:  9500,
+		IngressKbit: 47500,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("readQoSConfig: diff (-want +got):\n%s", diff)
+	}
+
+	for _, cfg := range []string{
+		`{"qdisc": "sfq", "egress_kbit": 9500}`,
+		`{"egress_kbit": 9500, "overhead": 1000}`,
+	} {
+		write(cfg)
+		if _, err := readQoSConfig(tmp); err == nil {
+			t.Errorf("readQoSConfig(%s) unexpectedly succeeded", cfg)
+		}
+	}
+
+	if got, want := ifbName("uplink0"), "ifb4uplink0"; got != want {
+		t.Errorf("ifbName(uplink0) = %q, want %q", got, want)
+	}
+	if got := ifbName("verylonglink0"); len(got) >= unix.IFNAMSIZ {
+		t.Errorf("ifbName(verylonglink0) = %q, exceeds IFNAMSIZ", got)
+	}
+}
+
+// TestApplyQoS shapes the egress of a veth link with HTB and fq_codel in a new
+// network namespace and verifies that the qdiscs are removed with qos.json.
+func TestApplyQoS(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	link, err := netlink.LinkByName("uplink0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer func() {
+		qosApplied.Lock()
+		qosApplied.cfg = nil
+		qosApplied.Unlock()
+	}()
+
+	qdiscs := func() []string {
+		t.Helper()
+		qs, err := netlink.QdiscList(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, q := range qs {
+			if q.Type() == "noqueue" {
+				continue // default of veth links
+			}
+			result = append(result, q.Type())
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	cfg := `{"qdisc": "fq_codel", "egress_kbit": 9500}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "qos.json"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyQoS(tmp); err != nil {
+		t.Skipf("applyQoS: %v (sch_htb or sch_fq_codel not available?)", err)
+	}
+	// Applying again must not fail or change anything.
+	if err := applyQoS(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"fq_codel", "htb"}, qdiscs()); diff != "" {
+		t.Errorf("unexpected qdiscs: diff (-want +got):\n%s", diff)
+	}
+
+	if err := os.Remove(filepath.Join(tmp, "qos.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyQoS(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string(nil), qdiscs()); diff != "" {
+		t.Errorf("unexpected qdiscs after removing qos.json: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+
+	"github.com/rtr7/router7/internal/quota"
+)
+
+// applyQuotas stops forwarding traffic via uplinks whose data quota (see
+// quota.json) is exhausted, except for the configured priority traffic.
+func applyQuotas(dir string, c *ruleset, filter *nftables.Table, forward *nftables.Chain) error {
+	exceeded, err := quota.Exceeded(dir)
+	if err != nil {
+		return err
+	}
+	for _, q := range exceeded {
+		log.Printf("quota for %s exceeded, restricting to priority traffic", q.Interface)
+		oifname := []expr.Any{
+			// [ meta load oifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			// [ cmp eq reg 1 0x696c7075 0x00316b6e 0x00000000 0x00000000 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     nfifname(q.Interface),
+			},
+		}
+		for _, prio := range q.Priority {
+			min, max, err := parsePort(prio.Port)
+			if err != nil {
+				return err
+			}
+			for _, proto := range strings.Split(prio.Proto, ",") {
+				p, err := parseProto(proto)
+				if err != nil {
+					return err
+				}
+				exprs := append([]expr.Any{}, oifname...)
+				exprs = append(exprs,
+					// [ meta load l4proto => reg 1 ]
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					// [ cmp eq reg 1 0x00000006 ]
+					&expr.Cmp{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						Data:     []byte{p},
+					},
+					// [ payload load 2b @ transport header + 2 => reg 1 ]
+					&expr.Payload{
+						DestRegister: 1,
+						Base:         expr.PayloadBaseTransportHeader,
+						Offset:       2, // destination port
+						Len:          2,
+					})
+				exprs = append(exprs, portCmp(min, max)...)
+				exprs = append(exprs,
+					// [ immediate reg 0 accept ]
+					&expr.Verdict{Kind: expr.VerdictAccept})
+				c.AddRule(&nftables.Rule{
+					Table: filter,
+					Chain: forward,
+					Exprs: exprs,
+				})
+			}
+		}
+		c.AddRule(&nftables.Rule{
+			Table: filter,
+			Chain: forward,
+			Exprs: append(oifname,
+				// [ immediate reg 0 drop ]
+				&expr.Verdict{Kind: expr.VerdictDrop}),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// RoutesConfig is read from /perm/routes.json.
+type RoutesConfig struct {
+	Routes []StaticRoute `json:"routes"`
+	Rules  []StaticRule  `json:"rules"`
+}
+
+// StaticRoute is a user-defined route, e.g. to a lab network behind another
+// router on lan0 or to a VPN concentrator.
+type StaticRoute struct {
+	Destination string `json:"destination"` // e.g. 10.23.0.0/16 or 2001:db8::/48
+	Gateway     string `json:"gateway"`     // e.g. 192.168.42.2, empty for on-link routes
+	Interface   string `json:"interface"`   // e.g. lan0
+	Metric      int    `json:"metric"`      // default: 0 (IPv4), 1024 (IPv6)
+	Table       int    `json:"table"`       // default: main table (254)
+}
+
+// StaticRule is a user-defined policy routing rule (ip rule), e.g. to look up
+// the traffic of one LAN subnet in the routing table of a second uplink.
+type StaticRule struct {
+	From  string `json:"from"`  // source prefix, e.g. 192.168.42.128/25
+	To    string `json:"to"`    // destination prefix, e.g. 10.0.0.0/8
+	Table int    `json:"table"` // e.g. 100
+}
+
+// The rules of routes.json are installed with priorities staticRulePriority,
+// staticRulePriority+1, … in configuration order, i.e. they are evaluated
+// before the main table (32766). Rules within the priority range are owned by
+// netconfig, as rules carry no protocol which could identify them.
+const (
+	staticRulePriority = 20000
+	maxStaticRules     = 1000
+)
+
+func ownedRulePriority(priority int) bool {
+	return priority >= staticRulePriority && priority < staticRulePriority+maxStaticRules
+}
+
+// defaultIPv6Metric is the metric the kernel uses for IPv6 routes without
+// metric. Setting it explicitly lets us recognize installed routes.
+const defaultIPv6Metric = 1024
+
+func readRoutesConfig(dir string) (*RoutesConfig, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "routes.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &RoutesConfig{}, nil
+		}
+		return nil, err
+	}
+	var cfg RoutesConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// staticRoute converts sr into a route via the link with index linkIndex.
+func staticRoute(sr StaticRoute, linkIndex int) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(sr.Destination)
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := dst.IP.To4() == nil
+	r := &netlink.Route{
+		LinkIndex: linkIndex,
+		Dst:       dst,
+		Priority:  sr.Metric,
+		Table:     sr.Table,
+		Protocol:  rtprotStatic,
+	}
+	if ipv6 && r.Priority == 0 {
+		r.Priority = defaultIPv6Metric
+	}
+	if sr.Gateway == "" {
+		r.Scope = netlink.SCOPE_LINK
+		return r, nil
+	}
+	r.Gw = net.ParseIP(sr.Gateway)
+	if r.Gw == nil {
+		return nil, fmt.Errorf("invalid gateway %q", sr.Gateway)
+	}
+	if (r.Gw.To4() == nil) != ipv6 {
+		return nil, fmt.Errorf("gateway %s: address family differs from destination %s", sr.Gateway, sr.Destination)
+	}
+	if ones, _ := dst.Mask.Size(); ones == 0 {
+		// The kernel reports default routes without destination.
+		r.Dst = nil
+	}
+	return r, nil
+}
+
+// staticRoutes returns the routes configured in routes.json whose link is
+// present. Routes via links which appear later (e.g. wg0) are installed by
+// the next Apply.
+func staticRoutes(dir string) ([]*netlink.Route, error) {
+	cfg, err := readRoutesConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*netlink.Route
+	for _, sr := range cfg.Routes {
+		if sr.Interface == "" {
+			return nil, fmt.Errorf("route %s: interface must be set", sr.Destination)
+		}
+		link, err := netlink.LinkByName(sr.Interface)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue // link not present (yet)
+			}
+			return nil, err
+		}
+		r, err := staticRoute(sr, link.Attrs().Index)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", sr.Destination, err)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// staticRule converts sr, the idx'th rule of routes.json, into a rule.
+func staticRule(sr StaticRule, idx int) (*netlink.Rule, error) {
+	if idx >= maxStaticRules {
+		return nil, fmt.Errorf("too many rules (more than %d)", maxStaticRules)
+	}
+	if sr.From == "" && sr.To == "" {
+		return nil, fmt.Errorf("from or to must be set")
+	}
+	if sr.Table <= 0 {
+		return nil, fmt.Errorf("table must be set")
+	}
+	r := netlink.NewRule()
+	r.Family = netlink.FAMILY_V4
+	r.Priority = staticRulePriority + idx
+	r.Table = sr.Table
+	for _, p := range []struct {
+		prefix string
+		dst    **net.IPNet
+	}{
+		{sr.From, &r.Src},
+		{sr.To, &r.Dst},
+	} {
+		if p.prefix == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(p.prefix)
+		if err != nil {
+			return nil, err
+		}
+		family := netlink.FAMILY_V4
+		if n.IP.To4() == nil {
+			family = netlink.FAMILY_V6
+		}
+		if r.Src != nil && family != r.Family {
+			return nil, fmt.Errorf("to %s: address family differs from %s", sr.To, sr.From)
+		}
+		r.Family = family
+		*p.dst = n
+	}
+	return r, nil
+}
+
+// staticRules returns the rules configured in routes.json.
+func staticRules(dir string) ([]*netlink.Rule, error) {
+	cfg, err := readRoutesConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*netlink.Rule, 0, len(cfg.Rules))
+	for idx, sr := range cfg.Rules {
+		r, err := staticRule(sr, idx)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (from %q to %q): %v", idx, sr.From, sr.To, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func sameStaticRoute(a, b *netlink.Route) bool {
+	return a.LinkIndex == b.LinkIndex && sameRoute(a, b)
+}
+
+// applyRoutes installs the static routes and removes static routes which are
+// no longer configured, e.g. after editing routes.json.
+func (st *state) applyRoutes(appendError func(error)) {
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Protocol: rtprotStatic,
+	}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		appendError(fmt.Errorf("routes: RouteList: %v", err))
+		return
+	}
+	var stale []*netlink.Route
+	for idx := range existing {
+		r := &existing[idx]
+		var desired bool
+		for _, want := range st.routes {
+			if sameStaticRoute(r, want) {
+				desired = true
+				break
+			}
+		}
+		if !desired {
+			stale = append(stale, r)
+		}
+	}
+	for _, err := range batchRoutes(unix.RTM_DELROUTE, stale) {
+		appendError(fmt.Errorf("routes: %v", err))
+	}
+	var missing []*netlink.Route
+	for _, want := range st.routes {
+		var installed bool
+		for idx := range existing {
+			if sameStaticRoute(&existing[idx], want) {
+				installed = true
+				break
+			}
+		}
+		if installed {
+			continue
+		}
+		if other := importedConflict(st.imported, want); other != nil {
+			appendError(fmt.Errorf("routes: %v conflicts with route of protocol %d", want.Dst, other.Protocol))
+			continue
+		}
+		missing = append(missing, want)
+	}
+	for _, err := range batchRoutes(unix.RTM_NEWROUTE, missing) {
+		appendError(fmt.Errorf("routes: %v", err))
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestStaticRouteInvalid(t *testing.T) {
+	for _, sr := range []StaticRoute{
+		{Destination: "10.23.0.0"},
+		{Destination: "10.23.0.0/16", Gateway: "192.168.42"},
+		{Destination: "10.23.0.0/16", Gateway: "fe80::1"},
+		{Destination: "2001:db8::/32", Gateway: "192.168.42.2"},
+	} {
+		if _, err := staticRoute(sr, 1); err == nil {
+			t.Errorf("staticRoute(%+v) unexpectedly succeeded", sr)
+		}
+	}
+}
+
+// TestStaticRoutes installs static routes in a new network namespace and
+// verifies that removed routes are cleaned up, but foreign routes are not.
+func TestStaticRoutes(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"192.0.2.1/24", "2001:db8::1/64"} {
+		a, err := netlink.ParseAddr(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Flags = unix.IFA_F_NODAD
+		if err := netlink.AddrAdd(veth, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	foreign := &netlink.Route{
+		LinkIndex: veth.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.ParseIP("10.99.0.0"), Mask: net.CIDRMask(16, 32)},
+		Gw:        net.ParseIP("192.0.2.99"),
+	}
+	if err := netlink.RouteAdd(foreign); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	apply := func(cfg string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(tmp, "routes.json"), []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		routes, err := staticRoutes(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := &state{routes: routes}
+		// Applying twice must not fail or change anything.
+		for i := 0; i < 2; i++ {
+			st.applyRoutes(func(err error) { t.Fatal(err) })
+		}
+	}
+	installed := func() []string {
+		t.Helper()
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, r := range routes {
+			if r.Protocol != rtprotStatic && r.Protocol != unix.RTPROT_BOOT {
+				continue // e.g. kernel routes of the addresses
+			}
+			result = append(result, r.String())
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	apply(`{"routes": [
+  {"destination": "10.23.0.0/16", "interface": "veth0"},
+  {"destination": "10.24.0.0/16", "gateway": "192.0.2.2", "interface": "veth0", "metric": 10, "table": 100},
+  {"destination": "2001:db8:1::/48", "gateway": "2001:db8::2", "interface": "veth0"},
+  {"destination": "10.25.0.0/16", "interface": "wg9"}
+]}`)
+	idx := veth.Attrs().Index
+	format := func(r *netlink.Route) string {
+		r.LinkIndex = idx
+		return r.String()
+	}
+	want := []string{
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.23.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Scope: netlink.SCOPE_LINK, Table: unix.RT_TABLE_MAIN}),
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.24.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Gw: net.ParseIP("192.0.2.2").To4(), Table: 100}),
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.99.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Gw: net.ParseIP("192.0.2.99").To4(), Table: unix.RT_TABLE_MAIN}),
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("2001:db8:1::"), Mask: net.CIDRMask(48, 128)}, Gw: net.ParseIP("2001:db8::2"), Table: unix.RT_TABLE_MAIN}),
+	}
+	sort.Strings(want)
+	if diff := cmp.Diff(want, installed()); diff != "" {
+		t.Fatalf("unexpected routes: diff (-want +got):\n%s", diff)
+	}
+
+	// Routes which are removed from routes.json are removed from the
+	// kernel, routes of other origin are kept.
+	apply(`{"routes": [
+  {"destination": "10.23.0.0/16", "interface": "veth0"}
+]}`)
+	want = []string{
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.23.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Scope: netlink.SCOPE_LINK, Table: unix.RT_TABLE_MAIN}),
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.99.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Gw: net.ParseIP("192.0.2.99").To4(), Table: unix.RT_TABLE_MAIN}),
+	}
+	if diff := cmp.Diff(want, installed()); diff != "" {
+		t.Fatalf("unexpected routes after removal: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestStaticRuleInvalid(t *testing.T) {
+	for _, sr := range []StaticRule{
+		{Table: 100},
+		{From: "192.168.42.0/24"},
+		{From: "192.168.42.0", Table: 100},
+		{From: "192.168.42.0/24", To: "2001:db8::/32", Table: 100},
+	} {
+		if _, err := staticRule(sr, 0); err == nil {
+			t.Errorf("staticRule(%+v) unexpectedly succeeded", sr)
+		}
+	}
+}
+
+// TestStaticRules installs policy routing rules in a new network namespace and
+// verifies that removed rules are cleaned up, but foreign rules are not.
+func TestStaticRules(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	foreign := netlink.NewRule()
+	foreign.Priority = 1000
+	foreign.Src = &net.IPNet{IP: net.ParseIP("10.99.0.0").To4(), Mask: net.CIDRMask(16, 32)}
+	foreign.Table = 99
+	if err := netlink.RuleAdd(foreign); err != nil {
+		t.Skipf("RuleAdd: %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	apply := func(cfg string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(tmp, "routes.json"), []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := staticRules(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := &state{rules: rules}
+		// Applying twice must not fail or change anything.
+		for i := 0; i < 2; i++ {
+			st.applyRules(func(err error) { t.Fatal(err) })
+		}
+	}
+	installed := func() []string {
+		t.Helper()
+		var result []string
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			rules, err := netlink.RuleList(family)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range rules {
+				if r.Table == unix.RT_TABLE_LOCAL || r.Table == unix.RT_TABLE_MAIN || r.Table == unix.RT_TABLE_DEFAULT {
+					continue // default rules
+				}
+				result = append(result, fmt.Sprintf("%d: from %v to %v table %d", r.Priority, r.Src, r.Dst, r.Table))
+			}
+		}
+		return result
+	}
+
+	apply(`{"rules": [
+  {"from": "192.168.42.128/25", "table": 100},
+  {"to": "10.0.0.0/8", "table": 101},
+  {"from": "2001:db8:42::/48", "table": 100}
+]}`)
+	want := []string{
+		"1000: from 10.99.0.0/16 to <nil> table 99",
+		"20000: from 192.168.42.128/25 to <nil> table 100",
+		"20001: from <nil> to 10.0.0.0/8 table 101",
+		"20002: from 2001:db8:42::/48 to <nil> table 100",
+	}
+	if diff := cmp.Diff(want, installed()); diff != "" {
+		t.Fatalf("unexpected rules: diff (-want +got):\n%s", diff)
+	}
+
+	// Rules which are removed from routes.json are removed from the kernel,
+	// rules of other origin are kept.
+	apply(`{"rules": [
+  {"to": "10.0.0.0/8", "table": 101}
+]}`)
+	want = []string{
+		"1000: from 10.99.0.0/16 to <nil> table 99",
+		"20000: from <nil> to 10.0.0.0/8 table 101",
+	}
+	if diff := cmp.Diff(want, installed()); diff != "" {
+		t.Fatalf("unexpected rules after removal: diff (-want +got):\n%s", diff)
+	}
+}
+
+// TestBatchRoutes installs and removes more routes than fit into one batch.
+func TestBatchRoutes(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 2*routeBatchSize + 1
+	routes := make([]*netlink.Route, 0, n+1)
+	for i := 0; i < n; i++ {
+		routes = append(routes, &netlink.Route{
+			LinkIndex: veth.Attrs().Index,
+			Dst:       &net.IPNet{IP: net.IPv4(10, 23, byte(i>>8), byte(i)), Mask: net.CIDRMask(32, 32)},
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  rtprotStatic,
+		})
+	}
+	// A failing request does not affect the other requests of its batch.
+	routes = append(routes[:1], append([]*netlink.Route{{
+		LinkIndex: 4242, // does not exist
+		Dst:       &net.IPNet{IP: net.IPv4(10, 42, 0, 0), Mask: net.CIDRMask(16, 32)},
+	}}, routes[1:]...)...)
+
+	installed := func() int {
+		t.Helper()
+		got, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+			Protocol: rtprotStatic,
+		}, netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(got)
+	}
+
+	errs := batchRoutes(unix.RTM_NEWROUTE, routes)
+	if got, want := len(errs), 1; got != want {
+		t.Fatalf("RTM_NEWROUTE: got %d errors (%v), want %d", got, errs, want)
+	}
+	if !strings.Contains(errs[0].Error(), "10.42.0.0/16") {
+		t.Errorf("error %q does not name the failed route", errs[0])
+	}
+	if got, want := installed(), n; got != want {
+		t.Fatalf("got %d routes, want %d", got, want)
+	}
+	// Replacing is idempotent.
+	if errs := batchRoutes(unix.RTM_NEWROUTE, routes[2:]); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	if errs := batchRoutes(unix.RTM_DELROUTE, routes[2:]); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if got, want := installed(), 1; got != want {
+		t.Errorf("got %d routes after deletion, want %d", got, want)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// RoutingConfig is read from /perm/routing.json. It integrates netconfig with
+// an external routing daemon (e.g. FRR or BIRD) in networks with multiple
+// routers: routes are exchanged via the kernel routing tables, identified by
+// their protocol number.
+type RoutingConfig struct {
+	// Import lists the route protocols of the routing daemon, by name (e.g.
+	// “bgp”, “ospf”, “rip”, “babel”, “zebra” or “bird”) or number (e.g.
+	// “196”). Routes of these protocols are never replaced or removed by
+	// netconfig, even if they conflict with routes netconfig configures.
+	Import []string `json:"import"`
+
+	// ExportTable is a routing table (e.g. 200) which netconfig fills with
+	// copies of its own routes (connected networks, DHCP and static routes),
+	// so that the routing daemon can redistribute them, e.g. via FRR’s
+	// “ip import-table 200” or a BIRD kernel protocol with “kernel table
+	// 200”. The table is owned by netconfig. 0 disables the export.
+	ExportTable int `json:"export_table"`
+}
+
+// routeProtocols maps the names of route protocols (as in
+// /etc/iproute2/rt_protos) to their number.
+var routeProtocols = map[string]int{
+	"zebra": unix.RTPROT_ZEBRA,
+	"bird":  unix.RTPROT_BIRD,
+	"babel": unix.RTPROT_BABEL,
+	"bgp":   unix.RTPROT_BGP,
+	"isis":  unix.RTPROT_ISIS,
+	"ospf":  unix.RTPROT_OSPF,
+	"rip":   unix.RTPROT_RIP,
+	"eigrp": unix.RTPROT_EIGRP,
+}
+
+// routing is the parsed RoutingConfig.
+type routing struct {
+	importProtocols map[int]bool
+	exportTable     int
+}
+
+func readRoutingConfig(dir string) (*routing, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "routing.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg RoutingConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	rt := &routing{
+		importProtocols: make(map[int]bool),
+		exportTable:     cfg.ExportTable,
+	}
+	for _, name := range cfg.Import {
+		proto, ok := routeProtocols[name]
+		if !ok {
+			n, err := strconv.ParseUint(name, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("unknown route protocol %q", name)
+			}
+			proto = int(n)
+		}
+		switch proto {
+		case unix.RTPROT_UNSPEC, unix.RTPROT_KERNEL, unix.RTPROT_BOOT, unix.RTPROT_STATIC, unix.RTPROT_DHCP,
+			rtprotLease, rtprotStatic, rtprotExport, rtprotIntercept, rtprotWireGuard:
+			return nil, fmt.Errorf("route protocol %q is used by the kernel or netconfig", name)
+		}
+		rt.importProtocols[proto] = true
+	}
+	switch cfg.ExportTable {
+	case 0:
+	case unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL, unix.RT_TABLE_DEFAULT, interceptTable:
+		return nil, fmt.Errorf("export_table %d is in use", cfg.ExportTable)
+	}
+	return rt, nil
+}
+
+// listImported returns the routes which the routing daemon installed, or nil
+// if no route protocols are imported.
+func (rt *routing) listImported() ([]netlink.Route, error) {
+	if rt == nil || len(rt.importProtocols) == 0 {
+		return nil, nil
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	imported := routes[:0]
+	for _, r := range routes {
+		if rt.importProtocols[r.Protocol] {
+			imported = append(imported, r)
+		}
+	}
+	return imported, nil
+}
+
+// importedConflict returns the imported route which installing want would
+// replace (routes are identified by destination, table and metric), or nil.
+func importedConflict(imported []netlink.Route, want *netlink.Route) *netlink.Route {
+	wantIPv6 := isIPv6Route(want)
+	for idx := range imported {
+		r := &imported[idx]
+		if isIPv6Route(r) != wantIPv6 {
+			continue
+		}
+		other := *want // copy
+		other.Gw = r.Gw
+		if sameRoute(r, &other) {
+			return r
+		}
+	}
+	return nil
+}
+
+func isIPv6Route(r *netlink.Route) bool {
+	for _, ip := range []net.IP{r.Gw, r.Src} {
+		if ip != nil {
+			return ip.To4() == nil
+		}
+	}
+	if r.Dst != nil {
+		return r.Dst.IP.To4() == nil
+	}
+	return false
+}
+
+// exportRoutes returns copies of the routes and connected networks of st in
+// the export table.
+func (st *state) exportRoutes() []*netlink.Route {
+	if st.routing == nil || st.routing.exportTable == 0 {
+		return nil
+	}
+	var exported []*netlink.Route
+	export := func(r *netlink.Route) {
+		if importedConflict(st.imported, r) != nil {
+			return // not installed, see applyRoutes
+		}
+		c := *r // copy
+		c.Table = st.routing.exportTable
+		c.Protocol = rtprotExport
+		if c.Priority == 0 && isIPv6Route(&c) {
+			c.Priority = defaultIPv6Metric
+		}
+		exported = append(exported, &c)
+	}
+	for _, ls := range st.links {
+		if ls.ifname == "lo" {
+			continue // e.g. interception
+		}
+		link, err := netlink.LinkByName(ls.ifname)
+		if err != nil {
+			continue // link not present (yet)
+		}
+		for _, addr := range ls.addrs {
+			ones, bits := addr.Mask.Size()
+			if ones == bits {
+				continue // no connected network
+			}
+			export(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Dst: &net.IPNet{
+					IP:   addr.IP.Mask(addr.Mask),
+					Mask: addr.Mask,
+				},
+				Scope: netlink.SCOPE_LINK,
+			})
+		}
+		for _, r := range ls.routes {
+			export(r)
+		}
+	}
+	for _, r := range st.routes {
+		if r.Table == 0 || r.Table == unix.RT_TABLE_MAIN {
+			export(r)
+		}
+	}
+	return exported
+}
+
+// applyExport makes the export table contain exactly the exported routes
+// (other routes in the table are left alone).
+func (st *state) applyExport(appendError func(error)) {
+	if st.routing == nil || st.routing.exportTable == 0 {
+		return
+	}
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Table:    st.routing.exportTable,
+		Protocol: rtprotExport,
+	}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		appendError(fmt.Errorf("routing: RouteList: %v", err))
+		return
+	}
+	exported := st.exportRoutes()
+	for idx := range existing {
+		r := &existing[idx]
+		var desired bool
+		for _, want := range exported {
+			if sameStaticRoute(r, want) {
+				desired = true
+				break
+			}
+		}
+		if desired {
+			continue
+		}
+		if err := netlink.RouteDel(r); err != nil {
+			appendError(fmt.Errorf("routing: RouteDel(%v): %v", r.Dst, err))
+		}
+	}
+	for _, want := range exported {
+		if routeInstalled(existing, want) {
+			continue
+		}
+		if err := netlink.RouteReplace(want); err != nil {
+			appendError(fmt.Errorf("routing: RouteReplace(%v, table %d): %v", want.Dst, want.Table, err))
+		}
+	}
+}
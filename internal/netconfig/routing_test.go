@@ -0,0 +1,203 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadRoutingConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	rt, err := readRoutingConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt != nil {
+		t.Fatalf("readRoutingConfig without routing.json = %+v, want nil", rt)
+	}
+
+	for _, tt := range []struct {
+		cfg     string
+		want    *routing
+		wantErr bool
+	}{
+		{
+			cfg: `{"import": ["bgp", "bird", "196"], "export_table": 200}`,
+			want: &routing{
+				importProtocols: map[int]bool{
+					unix.RTPROT_BGP:  true,
+					unix.RTPROT_BIRD: true,
+					196:              true,
+				},
+				exportTable: 200,
+			},
+		},
+		{cfg: `{"import": ["carrier-pigeon"]}`, wantErr: true},
+		{cfg: `{"import": ["static"]}`, wantErr: true},
+		{cfg: `{"import": ["16"]}`, wantErr: true}, // DHCP
+		{cfg: `{"import": ["71"]}`, wantErr: true}, // rtprotStatic
+		{cfg: `{"import": ["256"]}`, wantErr: true},
+		{cfg: `{"export_table": 254}`, wantErr: true},
+		{cfg: `{"export_table": 100}`, wantErr: true}, // interceptTable
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "routing.json"), []byte(tt.cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readRoutingConfig(tmp)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readRoutingConfig(%s) unexpectedly succeeded", tt.cfg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(routing{})); diff != "" {
+			t.Errorf("readRoutingConfig(%s): diff (-want +got):\n%s", tt.cfg, diff)
+		}
+	}
+}
+
+// TestRoutingDaemon verifies that routes of a routing daemon are never
+// replaced, and that the export table contains router7’s routes.
+func TestRoutingDaemon(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := netlink.ParseAddr("192.0.2.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.AddrAdd(veth, addr); err != nil {
+		t.Fatal(err)
+	}
+	idx := veth.Attrs().Index
+	bgp := &netlink.Route{
+		LinkIndex: idx,
+		Dst:       &net.IPNet{IP: net.ParseIP("10.23.0.0").To4(), Mask: net.CIDRMask(16, 32)},
+		Gw:        net.ParseIP("192.0.2.99").To4(),
+		Protocol:  unix.RTPROT_BGP,
+	}
+	if err := netlink.RouteAdd(bgp); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for fn, cfg := range map[string]string{
+		"routing.json": `{"import": ["bgp"], "export_table": 200}`,
+		"routes.json": `{"routes": [
+  {"destination": "10.23.0.0/16", "gateway": "192.0.2.2", "interface": "veth0"},
+  {"destination": "10.24.0.0/16", "gateway": "192.0.2.2", "interface": "veth0"}
+]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rt, err := readRoutingConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := staticRoutes(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &state{
+		routing: rt,
+		routes:  routes,
+		links: []linkState{
+			{ifname: "veth0", addrs: []*netlink.Addr{addr}},
+		},
+	}
+	var errs []error
+	for i := 0; i < 2; i++ {
+		imported, err := rt.listImported()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.imported = imported
+		st.applyRoutes(func(err error) { errs = append(errs, err) })
+		st.applyExport(func(err error) { t.Fatal(err) })
+	}
+	if got, want := len(errs), 2; got != want {
+		t.Errorf("applyRoutes reported %d errors (%v), want %d (conflict with BGP route)", got, errs, want)
+	}
+
+	list := func(table int) []string {
+		t.Helper()
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, r := range routes {
+			if r.Protocol == unix.RTPROT_KERNEL {
+				continue
+			}
+			result = append(result, r.String())
+		}
+		sort.Strings(result)
+		return result
+	}
+	format := func(r *netlink.Route) string {
+		r.LinkIndex = idx
+		return r.String()
+	}
+	want := []string{
+		format(&netlink.Route{Dst: bgp.Dst, Gw: bgp.Gw, Table: unix.RT_TABLE_MAIN}),
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.24.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Gw: net.ParseIP("192.0.2.2").To4(), Table: unix.RT_TABLE_MAIN}),
+	}
+	sort.Strings(want)
+	if diff := cmp.Diff(want, list(unix.RT_TABLE_MAIN)); diff != "" {
+		t.Errorf("unexpected main table: diff (-want +got):\n%s", diff)
+	}
+
+	want = []string{
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("10.24.0.0").To4(), Mask: net.CIDRMask(16, 32)}, Gw: net.ParseIP("192.0.2.2").To4(), Table: 200}),
+		format(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("192.0.2.0").To4(), Mask: net.CIDRMask(24, 32)}, Scope: netlink.SCOPE_LINK, Table: 200}),
+	}
+	sort.Strings(want)
+	if diff := cmp.Diff(want, list(200)); diff != "" {
+		t.Errorf("unexpected export table: diff (-want +got):\n%s", diff)
+	}
+}
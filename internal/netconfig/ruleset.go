@@ -0,0 +1,107 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import "github.com/google/nftables"
+
+// ruleset records the tables, chains, objects, sets and rules of the
+// firewall, so that they can be applied to the kernel (see apply) or
+// simulated (see Simulate). Its methods mirror those of nftables.Conn.
+type ruleset struct {
+	tables []*nftables.Table
+	chains []*nftables.Chain
+	objs   []nftables.Obj
+	sets   []rulesetSet
+	rules  []*nftables.Rule
+
+	// sysctls are required by the rules (e.g. rp_filter for anti-spoofing).
+	// Failing to apply them is not fatal.
+	sysctls []string
+}
+
+func (r *ruleset) AddTable(t *nftables.Table) *nftables.Table {
+	r.tables = append(r.tables, t)
+	return t
+}
+
+func (r *ruleset) AddChain(c *nftables.Chain) *nftables.Chain {
+	r.chains = append(r.chains, c)
+	return c
+}
+
+func (r *ruleset) AddObj(o nftables.Obj) nftables.Obj {
+	r.objs = append(r.objs, o)
+	return o
+}
+
+type rulesetSet struct {
+	set   *nftables.Set
+	elems []nftables.SetElement
+}
+
+func (r *ruleset) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	r.sets = append(r.sets, rulesetSet{s, vals})
+	return nil
+}
+
+func (r *ruleset) AddRule(rule *nftables.Rule) *nftables.Rule {
+	r.rules = append(r.rules, rule)
+	return rule
+}
+
+// chainRules returns the rules of chain ch, in order.
+func (r *ruleset) chainRules(ch *nftables.Chain) []*nftables.Rule {
+	var rules []*nftables.Rule
+	for _, rule := range r.rules {
+		if rule.Chain == ch {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// apply atomically replaces the kernel ruleset with r: all changes are sent
+// in a single batch, which the kernel commits as one transaction (or not at
+// all).
+func (r *ruleset) apply(c *nftables.Conn) error {
+	// Queue the batch on a connection of its own, so that an error while
+	// queueing does not leave a partial batch for the next Flush of c.
+	b := &nftables.Conn{TestDial: c.TestDial, NetNS: c.NetNS}
+	b.FlushRuleset()
+	for _, t := range r.tables {
+		b.AddTable(t)
+	}
+	for _, ch := range r.chains {
+		b.AddChain(ch)
+	}
+	for _, o := range r.objs {
+		b.AddObj(o)
+	}
+	for _, s := range r.sets {
+		if err := b.AddSet(s.set, s.elems); err != nil {
+			return err
+		}
+	}
+	for _, rule := range r.rules {
+		b.AddRule(rule)
+	}
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	if err := writeSysctls(r.sysctls); err != nil {
+		log.Printf("firewall: %v", err)
+	}
+	return nil
+}
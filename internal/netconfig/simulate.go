@@ -0,0 +1,407 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Packet is a hypothetical packet to be forwarded by the router, see
+// Simulate.
+type Packet struct {
+	IIfName string `json:"iifname"` // e.g. uplink0
+	OIfName string `json:"oifname"` // e.g. lan0
+
+	// SrcHardwareAddr is the source MAC address (optional).
+	SrcHardwareAddr net.HardwareAddr `json:"src_hwaddr,omitempty"`
+
+	Src     net.IP `json:"src"`
+	Dst     net.IP `json:"dst"`
+	Proto   uint8  `json:"proto"` // e.g. unix.IPPROTO_TCP
+	SrcPort uint16 `json:"sport"`
+	DstPort uint16 `json:"dport"`
+
+	// SYN marks the packet as a TCP SYN (connection establishment) packet.
+	SYN bool `json:"syn"`
+}
+
+// Step is a firewall rule which matched the simulated packet.
+type Step struct {
+	Table  string `json:"table"`  // e.g. “ip filter”
+	Chain  string `json:"chain"`  // e.g. “forward”
+	Rule   int    `json:"rule"`   // index of the rule within the chain
+	Action string `json:"action"` // e.g. “drop”, “dnat to 192.168.42.2:80”
+}
+
+// Trace describes the path of a simulated packet through the firewall.
+type Trace struct {
+	Steps   []Step `json:"steps"`
+	Verdict string `json:"verdict"` // “accept”, “drop” or “redirect” (to the router)
+
+	// Dst and DstPort are the packet’s destination after DNAT.
+	Dst     net.IP `json:"dst"`
+	DstPort uint16 `json:"dport"`
+}
+
+// Simulate traces the (connection-establishing) packet p through the
+// firewall rules which netconfig generates from the configuration in dir,
+// without touching the kernel ruleset. Only the forwarding path (prerouting,
+// forward and postrouting hooks) is simulated.
+func Simulate(dir string, p Packet) (*Trace, error) {
+	uplink, err := uplinkInterface()
+	if err != nil {
+		uplink = "uplink0" // rules match on interface names only
+	}
+	return simulateFirewall(dir, uplink, p)
+}
+
+func simulateFirewall(dir, uplink string, p Packet) (*Trace, error) {
+	rs, err := buildFirewall(dir, uplink, func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rs.simulate(p)
+}
+
+type simPacket struct {
+	Packet
+
+	ll        []byte // link layer (ethernet) header
+	network   []byte
+	transport []byte
+
+	redirected bool // delivered to the router itself instead of forwarded
+
+	sets map[string][]nftables.SetElement // of the packet’s address family
+}
+
+func newSimPacket(p Packet) (*simPacket, error) {
+	sp := &simPacket{Packet: p}
+	if p.Src == nil || p.Dst == nil {
+		return nil, fmt.Errorf("source and destination address must be specified")
+	}
+	if (p.Src.To4() == nil) != (p.Dst.To4() == nil) {
+		return nil, fmt.Errorf("source and destination address family differ")
+	}
+	sp.ll = make([]byte, 14)
+	copy(sp.ll[6:], p.SrcHardwareAddr)
+	if src := p.Src.To4(); src != nil {
+		sp.network = make([]byte, 20)
+		sp.network[9] = p.Proto
+		copy(sp.network[12:], src)
+		copy(sp.network[16:], p.Dst.To4())
+	} else {
+		sp.network = make([]byte, 40)
+		sp.network[6] = p.Proto
+		copy(sp.network[8:], p.Src.To16())
+		copy(sp.network[24:], p.Dst.To16())
+	}
+	sp.transport = make([]byte, 20)
+	copy(sp.transport[0:], binaryutil.BigEndian.PutUint16(p.SrcPort))
+	copy(sp.transport[2:], binaryutil.BigEndian.PutUint16(p.DstPort))
+	if p.SYN && p.Proto == unix.IPPROTO_TCP {
+		sp.transport[13] = 0x02
+	}
+	return sp, nil
+}
+
+func (sp *simPacket) ipv4() bool { return sp.Src.To4() != nil }
+
+func (sp *simPacket) dnat(addr []byte, port []byte) {
+	if sp.ipv4() {
+		copy(sp.network[16:20], addr)
+	} else {
+		copy(sp.network[24:40], addr)
+	}
+	if len(port) >= 2 {
+		copy(sp.transport[2:4], port)
+	}
+}
+
+func (sp *simPacket) dst() (net.IP, uint16) {
+	var ip net.IP
+	if sp.ipv4() {
+		ip = net.IP(append([]byte(nil), sp.network[16:20]...))
+	} else {
+		ip = net.IP(append([]byte(nil), sp.network[24:40]...))
+	}
+	return ip, binary.BigEndian.Uint16(sp.transport[2:4])
+}
+
+func familyName(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyARP:
+		return "arp"
+	default:
+		return fmt.Sprintf("family %d", f)
+	}
+}
+
+// hookChains returns the base chains of hook which apply to sp, ordered by
+// priority.
+func (r *ruleset) hookChains(sp *simPacket, hook nftables.ChainHook) []*nftables.Chain {
+	family := nftables.TableFamilyIPv6
+	if sp.ipv4() {
+		family = nftables.TableFamilyIPv4
+	}
+	var chains []*nftables.Chain
+	for _, ch := range r.chains {
+		if ch.Type == "" || ch.Hooknum != hook {
+			continue // not a base chain
+		}
+		if f := ch.Table.Family; f != family && f != nftables.TableFamilyINet {
+			continue
+		}
+		chains = append(chains, ch)
+	}
+	sort.SliceStable(chains, func(i, j int) bool {
+		return chains[i].Priority < chains[j].Priority
+	})
+	return chains
+}
+
+func (r *ruleset) simulate(p Packet) (*Trace, error) {
+	sp, err := newSimPacket(p)
+	if err != nil {
+		return nil, err
+	}
+	sp.sets = make(map[string][]nftables.SetElement)
+	for _, s := range r.sets {
+		if f := s.set.Table.Family; (f == nftables.TableFamilyIPv4) == sp.ipv4() {
+			sp.sets[s.set.Name] = s.elems
+		}
+	}
+	tr := &Trace{Verdict: "accept"}
+	for _, hook := range []nftables.ChainHook{
+		nftables.ChainHookPrerouting,
+		nftables.ChainHookForward,
+		nftables.ChainHookPostrouting,
+	} {
+		for _, ch := range r.hookChains(sp, hook) {
+			verdict, err := r.simulateChain(sp, ch, tr)
+			if err != nil {
+				return nil, err
+			}
+			if verdict == expr.VerdictDrop {
+				tr.Verdict = "drop"
+				tr.Dst, tr.DstPort = sp.dst()
+				return tr, nil
+			}
+			if sp.redirected {
+				tr.Verdict = "redirect"
+				tr.Dst, tr.DstPort = sp.dst()
+				return tr, nil
+			}
+		}
+	}
+	tr.Dst, tr.DstPort = sp.dst()
+	return tr, nil
+}
+
+// simulateChain evaluates the rules of ch and returns the resulting verdict
+// (VerdictAccept if no rule issued a verdict, i.e. the chain policy).
+func (r *ruleset) simulateChain(sp *simPacket, ch *nftables.Chain, tr *Trace) (expr.VerdictKind, error) {
+	for idx, rule := range r.chainRules(ch) {
+		matched, action, verdict, err := sp.eval(rule.Exprs)
+		if err != nil {
+			return 0, fmt.Errorf("%s %s %s rule %d: %v", familyName(ch.Table.Family), ch.Table.Name, ch.Name, idx, err)
+		}
+		if !matched {
+			continue
+		}
+		tr.Steps = append(tr.Steps, Step{
+			Table:  familyName(ch.Table.Family) + " " + ch.Table.Name,
+			Chain:  ch.Name,
+			Rule:   idx,
+			Action: action,
+		})
+		switch verdict {
+		case expr.VerdictAccept, expr.VerdictDrop:
+			return verdict, nil
+		case expr.VerdictReturn:
+			return expr.VerdictAccept, nil
+		}
+	}
+	return expr.VerdictAccept, nil
+}
+
+// eval evaluates the expressions of a rule against sp. verdict is
+// VerdictContinue unless the rule issued a verdict.
+func (sp *simPacket) eval(exprs []expr.Any) (matched bool, action string, verdict expr.VerdictKind, _ error) {
+	regs := make(map[uint32][]byte)
+	action = "continue"
+	verdict = expr.VerdictContinue
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			if e.SourceRegister {
+				continue // setting e.g. the packet mark does not match
+			}
+			var val []byte
+			switch e.Key {
+			case expr.MetaKeyIIFNAME:
+				val = nfifname(sp.IIfName)
+			case expr.MetaKeyOIFNAME:
+				val = nfifname(sp.OIfName)
+			case expr.MetaKeyL4PROTO:
+				val = []byte{sp.Proto}
+			case expr.MetaKeyIIFTYPE:
+				val = binaryutil.NativeEndian.PutUint16(unix.ARPHRD_ETHER)
+			default:
+				return false, "", 0, fmt.Errorf("unsupported meta key %d", e.Key)
+			}
+			regs[e.Register] = val
+
+		case *expr.Payload:
+			var hdr []byte
+			switch e.Base {
+			case expr.PayloadBaseLLHeader:
+				hdr = sp.ll
+			case expr.PayloadBaseNetworkHeader:
+				hdr = sp.network
+			case expr.PayloadBaseTransportHeader:
+				hdr = sp.transport
+			}
+			if int(e.Offset+e.Len) > len(hdr) {
+				return false, "", 0, nil // out of bounds: no match
+			}
+			regs[e.DestRegister] = append([]byte(nil), hdr[e.Offset:e.Offset+e.Len]...)
+
+		case *expr.Bitwise:
+			src := regs[e.SourceRegister]
+			dst := make([]byte, e.Len)
+			for i := range dst {
+				if i < len(src) && i < len(e.Mask) && i < len(e.Xor) {
+					dst[i] = (src[i] & e.Mask[i]) ^ e.Xor[i]
+				}
+			}
+			regs[e.DestRegister] = dst
+
+		case *expr.Cmp:
+			reg := make([]byte, len(e.Data))
+			copy(reg, regs[e.Register])
+			c := bytes.Compare(reg, e.Data)
+			var ok bool
+			switch e.Op {
+			case expr.CmpOpEq:
+				ok = c == 0
+			case expr.CmpOpNeq:
+				ok = c != 0
+			case expr.CmpOpLt:
+				ok = c < 0
+			case expr.CmpOpLte:
+				ok = c <= 0
+			case expr.CmpOpGt:
+				ok = c > 0
+			case expr.CmpOpGte:
+				ok = c >= 0
+			}
+			if !ok {
+				return false, "", 0, nil
+			}
+
+		case *expr.Ct:
+			if e.Key != expr.CtKeySTATE {
+				return false, "", 0, fmt.Errorf("unsupported ct key %d", e.Key)
+			}
+			// Only TCP packets other than SYN packets belong to an
+			// existing connection.
+			state := uint32(ctStateNew)
+			if sp.Proto == unix.IPPROTO_TCP && !sp.SYN {
+				state = ctStateEstablished
+			}
+			regs[e.Register] = binaryutil.NativeEndian.PutUint32(state)
+
+		case *expr.Immediate:
+			regs[e.Register] = e.Data
+
+		case *expr.Lookup:
+			var found bool
+			for _, el := range sp.sets[e.SetName] {
+				if bytes.Equal(regs[e.SourceRegister], el.Key) {
+					found = true
+					break
+				}
+			}
+			if found == e.Invert {
+				return false, "", 0, nil
+			}
+
+		case *expr.NAT:
+			if e.Type != expr.NATTypeDestNAT {
+				return true, "snat", expr.VerdictAccept, nil
+			}
+			addr := regs[e.RegAddrMin]
+			port := regs[e.RegProtoMin]
+			sp.dnat(addr, port)
+			ip, dport := sp.dst()
+			return true, fmt.Sprintf("dnat to %s", net.JoinHostPort(ip.String(), fmt.Sprint(dport))), expr.VerdictAccept, nil
+
+		case *expr.Masq:
+			return true, "masquerade", expr.VerdictAccept, nil
+
+		case *expr.Redir:
+			sp.redirected = true
+			return true, "redirect", expr.VerdictAccept, nil
+
+		case *expr.TProxy:
+			// The destination is left unchanged: the proxy accepts
+			// connections to any address.
+			sp.redirected = true
+			port := binary.BigEndian.Uint16(regs[e.RegPort])
+			return true, fmt.Sprintf("tproxy to :%d", port), expr.VerdictAccept, nil
+
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				return true, "accept", e.Kind, nil
+			case expr.VerdictDrop:
+				return true, "drop", e.Kind, nil
+			case expr.VerdictReturn:
+				return true, "return", e.Kind, nil
+			default:
+				return false, "", 0, fmt.Errorf("unsupported verdict %d", e.Kind)
+			}
+
+		case *expr.Objref, *expr.Counter:
+			// counters do not influence the verdict
+
+		case *expr.Rt, *expr.Byteorder, *expr.Exthdr:
+			// only used for rewriting the TCP MSS option
+			action = "mangle"
+
+		default:
+			return false, "", 0, fmt.Errorf("unsupported expression %T", e)
+		}
+	}
+	return true, action, verdict, nil
+}
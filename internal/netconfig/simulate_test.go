@@ -0,0 +1,305 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSimulate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "portforwardings.json"), []byte(`
+{
+  "forwardings": [
+    {
+      "proto": "tcp",
+      "port": "8080",
+      "dest_addr": "192.168.42.23",
+      "dest_port": "80"
+    }
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "firewall.json"), []byte(`{"dns_redirect": ["192.168.42.50"], "block_encrypted_dns": ["192.168.42.52"], "interception": {"clients": ["192.168.42.53"], "proxy_port": 8081}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteBlocks(tmp, []Block{
+		{Addr: "192.168.42.99", Until: time.Now().Add(time.Hour)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("PortForwarding", func(t *testing.T) {
+		tr, err := simulateFirewall(tmp, "uplink0", Packet{
+			IIfName: "uplink0",
+			OIfName: "lan0",
+			Src:     net.ParseIP("203.0.113.1"),
+			Dst:     net.ParseIP("198.51.100.1"),
+			Proto:   unix.IPPROTO_TCP,
+			SrcPort: 12345,
+			DstPort: 8080,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := tr.Verdict, "accept"; got != want {
+			t.Errorf("unexpected verdict: got %q, want %q", got, want)
+		}
+		if got, want := tr.Dst.String(), "192.168.42.23"; got != want {
+			t.Errorf("unexpected destination: got %s, want %s", got, want)
+		}
+		if got, want := tr.DstPort, uint16(80); got != want {
+			t.Errorf("unexpected destination port: got %d, want %d", got, want)
+		}
+		if len(tr.Steps) == 0 || tr.Steps[0].Chain != "prerouting" {
+			t.Errorf("expected a prerouting step, got %+v", tr.Steps)
+		}
+	})
+
+	t.Run("NotForwarded", func(t *testing.T) {
+		for _, tt := range []struct {
+			dst   string
+			dport uint16
+			syn   bool
+			want  string
+		}{
+			{"198.51.100.1", 8080, true, "accept"},  // forwarded
+			{"192.168.42.23", 22, true, "drop"},     // not forwarded
+			{"192.168.42.23", 22, false, "accept"},  // established
+			{"198.51.100.1", 8081, false, "accept"}, // established
+		} {
+			tr, err := simulateFirewall(tmp, "uplink0", Packet{
+				IIfName: "uplink0",
+				OIfName: "lan0",
+				Src:     net.ParseIP("203.0.113.1"),
+				Dst:     net.ParseIP(tt.dst),
+				Proto:   unix.IPPROTO_TCP,
+				SrcPort: 12345,
+				DstPort: tt.dport,
+				SYN:     tt.syn,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tr.Verdict; got != tt.want {
+				t.Errorf("%s:%d (SYN: %v): unexpected verdict: got %q, want %q (steps: %+v)", tt.dst, tt.dport, tt.syn, got, tt.want, tr.Steps)
+			}
+		}
+	})
+
+	t.Run("Blocked", func(t *testing.T) {
+		tr, err := simulateFirewall(tmp, "uplink0", Packet{
+			IIfName: "lan0",
+			OIfName: "uplink0",
+			Src:     net.ParseIP("192.168.42.99"),
+			Dst:     net.ParseIP("198.51.100.1"),
+			Proto:   unix.IPPROTO_UDP,
+			SrcPort: 12345,
+			DstPort: 53,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := tr.Verdict, "drop"; got != want {
+			t.Errorf("unexpected verdict: got %q, want %q (steps: %+v)", got, want, tr.Steps)
+		}
+		last := tr.Steps[len(tr.Steps)-1]
+		if got, want := last.Table+" "+last.Chain, "ip filter forward"; got != want {
+			t.Errorf("unexpected dropping chain: got %q, want %q", got, want)
+		}
+	})
+	t.Run("DNSRedirect", func(t *testing.T) {
+		for _, tt := range []struct {
+			src  string
+			want string
+		}{
+			{"192.168.42.50", "redirect"},
+			{"192.168.42.51", "accept"},
+		} {
+			tr, err := simulateFirewall(tmp, "uplink0", Packet{
+				IIfName: "lan0",
+				OIfName: "uplink0",
+				Src:     net.ParseIP(tt.src),
+				Dst:     net.ParseIP("8.8.8.8"),
+				Proto:   unix.IPPROTO_UDP,
+				SrcPort: 12345,
+				DstPort: 53,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tr.Verdict; got != tt.want {
+				t.Errorf("%s: unexpected verdict: got %q, want %q (steps: %+v)", tt.src, got, tt.want, tr.Steps)
+			}
+		}
+	})
+	t.Run("BlockEncryptedDNS", func(t *testing.T) {
+		for _, tt := range []struct {
+			src   string
+			dst   string
+			dport uint16
+			want  string
+		}{
+			{"192.168.42.52", "1.1.1.1", 443, "drop"},        // DoH
+			{"192.168.42.52", "198.51.100.1", 853, "drop"},   // DoT
+			{"192.168.42.52", "198.51.100.1", 443, "accept"}, // HTTPS
+			{"192.168.42.51", "1.1.1.1", 443, "accept"},      // other client
+		} {
+			tr, err := simulateFirewall(tmp, "uplink0", Packet{
+				IIfName: "lan0",
+				OIfName: "uplink0",
+				Src:     net.ParseIP(tt.src),
+				Dst:     net.ParseIP(tt.dst),
+				Proto:   unix.IPPROTO_TCP,
+				SrcPort: 12345,
+				DstPort: tt.dport,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tr.Verdict; got != tt.want {
+				t.Errorf("%s → %s:%d: unexpected verdict: got %q, want %q (steps: %+v)", tt.src, tt.dst, tt.dport, got, tt.want, tr.Steps)
+			}
+		}
+	})
+	t.Run("Interception", func(t *testing.T) {
+		for _, tt := range []struct {
+			src   string
+			dport uint16
+			want  string
+		}{
+			{"192.168.42.53", 443, "redirect"},
+			{"192.168.42.53", 22, "accept"},
+			{"192.168.42.51", 443, "accept"},
+		} {
+			tr, err := simulateFirewall(tmp, "uplink0", Packet{
+				IIfName: "lan0",
+				OIfName: "uplink0",
+				Src:     net.ParseIP(tt.src),
+				Dst:     net.ParseIP("198.51.100.1"),
+				Proto:   unix.IPPROTO_TCP,
+				SrcPort: 12345,
+				DstPort: tt.dport,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tr.Verdict; got != tt.want {
+				t.Errorf("%s → :%d: unexpected verdict: got %q, want %q (steps: %+v)", tt.src, tt.dport, got, tt.want, tr.Steps)
+			}
+			if tt.want != "redirect" {
+				continue
+			}
+			last := tr.Steps[len(tr.Steps)-1]
+			if got, want := last.Action, "tproxy to :8081"; got != want {
+				t.Errorf("unexpected action: got %q, want %q", got, want)
+			}
+			if got, want := tr.DstPort, tt.dport; got != want {
+				t.Errorf("unexpected destination port: got %d, want %d", got, want)
+			}
+		}
+	})
+}
+
+func TestPinholes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range []struct {
+		path    string
+		content string
+	}{
+		{"firewall.json", `{"pinholes": [{"host": "NAS", "proto": "tcp", "port": "443"}]}`},
+		{"bindings.json", `{"bindings": [{"hardware_addr": "00:1f:16:31:73:75", "token": "::23"}]}`},
+		{"dhcp4d/leases.json", `[{"hardware_addr": "00:1f:16:31:73:75", "hostname": "nas", "addr": "192.168.42.23"}]`},
+		{"dhcp6/wire/lease.json", `{"prefixes": [{"IP": "2a02:168:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`},
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, f.path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmp, f.path), []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		dst  string
+		port uint16
+		syn  bool
+		want string
+	}{
+		{"Pinhole", "2a02:168:4a00::23", 443, true, "accept"},
+		{"OtherPort", "2a02:168:4a00::23", 22, true, "drop"},
+		{"OtherHost", "2a02:168:4a00::42", 443, true, "drop"},
+		{"Established", "2a02:168:4a00::42", 22, false, "accept"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := simulateFirewall(tmp, "uplink0", Packet{
+				IIfName: "uplink0",
+				OIfName: "lan0",
+				Src:     net.ParseIP("2001:db8::1"),
+				Dst:     net.ParseIP(tt.dst),
+				Proto:   unix.IPPROTO_TCP,
+				SrcPort: 12345,
+				DstPort: tt.port,
+				SYN:     tt.syn,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tr.Verdict; got != tt.want {
+				t.Errorf("unexpected verdict: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The pinhole follows prefix changes.
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp6/wire/lease.json"), []byte(`{"prefixes": [{"IP": "2a02:168:4b00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := simulateFirewall(tmp, "uplink0", Packet{
+		IIfName: "uplink0",
+		OIfName: "lan0",
+		Src:     net.ParseIP("2001:db8::1"),
+		Dst:     net.ParseIP("2a02:168:4b00::23"),
+		Proto:   unix.IPPROTO_TCP,
+		DstPort: 443,
+		SYN:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tr.Verdict, "accept"; got != want {
+		t.Errorf("after prefix change: unexpected verdict: got %q, want %q", got, want)
+	}
+}
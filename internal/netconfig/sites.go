@@ -0,0 +1,189 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/renameio"
+)
+
+// Site is another router7 instance, connected by a WireGuard tunnel, with
+// which LAN prefixes are exchanged (see sitelinkd).
+type Site struct {
+	Name      string `json:"name"`       // e.g. “office”
+	PublicKey string `json:"public_key"` // base64-encoded WireGuard key
+
+	// Endpoint of the remote site (optional if the remote site connects to
+	// this one), e.g. “office.example.net:51820”.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// TunnelAddr is the address of the remote site on the WireGuard link,
+	// e.g. 10.0.137.2, from which it is served its prefixes and at which
+	// its prefixes are fetched.
+	TunnelAddr string `json:"tunnel_addr"`
+}
+
+// SitesConfig is the site-to-site configuration, read from sites.json.
+type SitesConfig struct {
+	Interface string `json:"interface"` // WireGuard interface, default wg0
+	Port      int    `json:"port"`      // prefix exchange port, default 8076
+	Sites     []Site `json:"sites"`
+}
+
+// ReadSites reads sites.json in dir, filling in defaults.
+func ReadSites(dir string) (SitesConfig, error) {
+	var cfg SitesConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sites.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("sites.json: %v", err)
+	}
+	if cfg.Interface == "" {
+		cfg.Interface = "wg0"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 8076
+	}
+	for _, s := range cfg.Sites {
+		if s.Name == "" || s.PublicKey == "" {
+			return cfg, fmt.Errorf("sites.json: site %q: name and public_key are required", s.Name)
+		}
+		if net.ParseIP(s.TunnelAddr) == nil {
+			return cfg, fmt.Errorf("sites.json: site %s: invalid tunnel_addr %q", s.Name, s.TunnelAddr)
+		}
+	}
+	return cfg, nil
+}
+
+// TunnelNet returns the host network of the tunnel address of s, e.g.
+// 10.0.137.2/32.
+func (s Site) TunnelNet() *net.IPNet {
+	ip := net.ParseIP(s.TunnelAddr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// SitePrefixesPath returns the path of the prefixes which sitelinkd learned
+// from the sites, keyed by site name.
+func SitePrefixesPath(dir string) string {
+	return filepath.Join(dir, "sitelinkd", "prefixes.json")
+}
+
+// ReadSitePrefixes reads the prefixes learned from the sites. A missing file
+// results in an empty map.
+func ReadSitePrefixes(dir string) (map[string][]string, error) {
+	prefixes := make(map[string][]string)
+	b, err := ioutil.ReadFile(SitePrefixesPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return prefixes, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &prefixes); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// WriteSitePrefixes persists the prefixes learned from the sites.
+func WriteSitePrefixes(dir string, prefixes map[string][]string) error {
+	b, err := json.MarshalIndent(prefixes, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(SitePrefixesPath(dir)), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(SitePrefixesPath(dir), b, 0644)
+}
+
+// sitesKeepalive keeps the NAT mappings of the site tunnels open, so that
+// both sites can reach each other at all times.
+const sitesKeepalive = 25 // seconds
+
+// mergeSites adds the sites of sites.json in dir as peers of the site
+// interface in cfg, allowing the tunnel address and the learned prefixes of
+// each site. Peers of wireguard.json with the same public key are extended.
+// The routes and forward accept rules of the WireGuard configuration then
+// cover the remote sites.
+func mergeSites(dir string, cfg *wireguardInterfaces) error {
+	sites, err := ReadSites(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var iface *wireguardInterface
+	for i := range cfg.Interfaces {
+		if cfg.Interfaces[i].Name == sites.Interface {
+			iface = &cfg.Interfaces[i]
+		}
+	}
+	if iface == nil {
+		return fmt.Errorf("sites.json: interface %s not configured in wireguard.json", sites.Interface)
+	}
+	learned, err := ReadSitePrefixes(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range sites.Sites {
+		allowed := append([]string{s.TunnelNet().String()}, learned[s.Name]...)
+		sort.Strings(allowed[1:])
+		var peer *wireguardPeer
+		for i := range iface.Peers {
+			if iface.Peers[i].PublicKey == s.PublicKey {
+				peer = &iface.Peers[i]
+			}
+		}
+		if peer == nil {
+			iface.Peers = append(iface.Peers, wireguardPeer{PublicKey: s.PublicKey})
+			peer = &iface.Peers[len(iface.Peers)-1]
+		}
+		if peer.Endpoint == "" {
+			peer.Endpoint = s.Endpoint
+		}
+		if peer.PersistentKeepalive == 0 && peer.Endpoint != "" {
+			peer.PersistentKeepalive = sitesKeepalive
+		}
+		for _, a := range allowed {
+			if !containsString(peer.AllowedIPs, a) {
+				peer.AllowedIPs = append(peer.AllowedIPs, a)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
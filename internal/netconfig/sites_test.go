@@ -0,0 +1,87 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMergeSites(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for fn, content := range map[string]string{
+		"wireguard.json": `{"interfaces": [{
+  "name": "wg0",
+  "private_key": "gBCV3afBKfW7RycmeZFMpJykvO+58KfSEIyavay90kE=",
+  "port": 51820,
+  "peers": [
+    {"public_key": "office=", "allowed_ips": ["fe80::/64"]},
+    {"public_key": "laptop=", "allowed_ips": ["10.0.137.9/32"]}
+  ]
+}]}`,
+		"sites.json": `{"sites": [
+  {"name": "office", "public_key": "office=", "endpoint": "office.example.net:51820", "tunnel_addr": "10.0.137.2"},
+  {"name": "cabin", "public_key": "cabin=", "tunnel_addr": "10.0.137.3"}
+]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteSitePrefixes(tmp, map[string][]string{
+		"office": {"192.168.43.0/24", "2001:db8:43::/64"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := readWireGuard(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []wireguardPeer{
+		{
+			PublicKey:           "office=",
+			Endpoint:            "office.example.net:51820",
+			AllowedIPs:          []string{"fe80::/64", "10.0.137.2/32", "192.168.43.0/24", "2001:db8:43::/64"},
+			PersistentKeepalive: sitesKeepalive,
+		},
+		{
+			PublicKey:  "laptop=",
+			AllowedIPs: []string{"10.0.137.9/32"},
+		},
+		{
+			PublicKey:  "cabin=",
+			AllowedIPs: []string{"10.0.137.3/32"},
+		},
+	}
+	if diff := cmp.Diff(want, cfg.Interfaces[0].Peers); diff != "" {
+		t.Errorf("peers: diff (-want +got):\n%s", diff)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "sites.json"), []byte(`{"interface": "wg1", "sites": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readWireGuard(tmp); err == nil {
+		t.Errorf("readWireGuard unexpectedly accepted sites of an unconfigured interface")
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/vishvananda/netlink"
+)
+
+// SmokeTestConfig is read from /perm/smoketest.json.
+type SmokeTestConfig struct {
+	// Settle is how long to wait after Apply before testing, so that
+	// DHCP leases, router advertisements and daemons reconverge.
+	// Default: 10s.
+	Settle string `json:"settle"`
+
+	// DNSName is resolved via dnsd on lan0. Default: one.one.one.one.
+	DNSName string `json:"dns_name"`
+
+	// NATTarget (host:port) is connected to via TCP from the lan0 address,
+	// so that the connection is only established when the masquerading of
+	// LAN traffic works. Default: 1.1.1.1:443.
+	NATTarget string `json:"nat_target"`
+}
+
+// ReadSmokeTestConfig reads smoketest.json from dir. A missing file results
+// in the default configuration.
+func ReadSmokeTestConfig(dir string) (SmokeTestConfig, error) {
+	var cfg SmokeTestConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "smoketest.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Settle == "" {
+		cfg.Settle = "10s"
+	}
+	if _, err := time.ParseDuration(cfg.Settle); err != nil {
+		return cfg, fmt.Errorf("settle: %v", err)
+	}
+	if cfg.DNSName == "" {
+		cfg.DNSName = "one.one.one.one"
+	}
+	if cfg.NATTarget == "" {
+		cfg.NATTarget = "1.1.1.1:443"
+	}
+	return cfg, nil
+}
+
+// SettleDuration returns the parsed Settle field.
+func (cfg SmokeTestConfig) SettleDuration() time.Duration {
+	d, _ := time.ParseDuration(cfg.Settle)
+	return d
+}
+
+// Names of the checks of SmokeTest, in order.
+const (
+	SmokeDefaultRoute = "default_route"
+	SmokeGateway      = "gateway"
+	SmokeDNS          = "dns"
+	SmokeNAT          = "nat"
+)
+
+// smokeTimeout bounds the DNS and NAT checks.
+const smokeTimeout = 5 * time.Second
+
+// SmokeCheck is the result of one check of SmokeTest.
+type SmokeCheck struct {
+	Name   string `json:"name"` // see Smoke*
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SmokeResult is the result of SmokeTest. Healthy is only true if all checks
+// passed.
+type SmokeResult struct {
+	Time    time.Time    `json:"time"`
+	Healthy bool         `json:"healthy"`
+	Checks  []SmokeCheck `json:"checks"`
+}
+
+// Failed returns the checks which did not pass.
+func (r *SmokeResult) Failed() []SmokeCheck {
+	var failed []SmokeCheck
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// SmokeTest verifies the dataplane after Apply: a default route is present,
+// its gateway is reachable, dnsd resolves and LAN traffic is masqueraded.
+// The result is written to dir/netconfigd/smoketest.json.
+func SmokeTest(dir string, cfg SmokeTestConfig) (*SmokeResult, error) {
+	res := &SmokeResult{Time: time.Now(), Healthy: true}
+	check := func(name string, fn func() (string, error)) {
+		detail, err := fn()
+		c := SmokeCheck{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			c.Detail = err.Error()
+			res.Healthy = false
+		}
+		res.Checks = append(res.Checks, c)
+	}
+
+	var gws []gateway
+	check(SmokeDefaultRoute, func() (string, error) {
+		var err error
+		gws, err = defaultRoutes()
+		if err != nil {
+			return "", err
+		}
+		if len(gws) == 0 {
+			return "", fmt.Errorf("no default route")
+		}
+		var routes []string
+		for _, gw := range gws {
+			if gw.ip == nil {
+				routes = append(routes, "dev "+gw.ifname)
+			} else {
+				routes = append(routes, fmt.Sprintf("via %v dev %s", gw.ip, gw.ifname))
+			}
+		}
+		return strings.Join(routes, ", "), nil
+	})
+	check(SmokeGateway, func() (string, error) {
+		if len(gws) == 0 {
+			return "", fmt.Errorf("no default route")
+		}
+		var unreachable []string
+		for _, gw := range gws {
+			if gw.ip == nil {
+				// Point-to-point links (e.g. PPPoE, wwan) have no gateway.
+				return gw.ifname + " is point-to-point", nil
+			}
+			hwaddr, err := resolveGateway(gw)
+			if err == nil {
+				return fmt.Sprintf("%v reachable via %v", gw, hwaddr), nil
+			}
+			unreachable = append(unreachable, fmt.Sprintf("%v: %v", gw, err))
+		}
+		return "", fmt.Errorf("%s", strings.Join(unreachable, "; "))
+	})
+	check(SmokeDNS, func() (string, error) {
+		ip, err := LinkAddress(dir, "lan0")
+		if err != nil {
+			return "", err
+		}
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), "53"))
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), smokeTimeout)
+		defer cancel()
+		addrs, err := resolver.LookupHost(ctx, cfg.DNSName)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s: %s", cfg.DNSName, strings.Join(addrs, ", ")), nil
+	})
+	check(SmokeNAT, func() (string, error) {
+		ip, err := LinkAddress(dir, "lan0")
+		if err != nil {
+			return "", err
+		}
+		d := net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: ip},
+			Timeout:   smokeTimeout,
+		}
+		conn, err := d.Dial("tcp", cfg.NATTarget)
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+		return fmt.Sprintf("connected to %s from %v", cfg.NATTarget, ip), nil
+	})
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return res, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "netconfigd"), 0755); err != nil {
+		return res, err
+	}
+	if err := renameio.WriteFile(filepath.Join(dir, "netconfigd", "smoketest.json"), b, 0644); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// ReadSmokeResult returns the result of the last SmokeTest, or nil if there
+// is none.
+func ReadSmokeResult(dir string) (*SmokeResult, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "netconfigd", "smoketest.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res SmokeResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// defaultRoutes returns the (IPv4 and IPv6) default routes of the main
+// routing table as gateways. The ip field is nil for routes without gateway.
+func defaultRoutes() ([]gateway, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	var gws []gateway
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			continue
+		}
+		gws = append(gws, gateway{ifname: link.Attrs().Name, linkIndex: r.LinkIndex, ip: r.Gw})
+	}
+	return gws, nil
+}
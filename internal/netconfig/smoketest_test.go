@@ -0,0 +1,126 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// TestSmokeTest runs the smoke test in a new network namespace, first
+// without any configuration, then with a point-to-point default route and a
+// local NAT target.
+func TestSmokeTest(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ok := func(res *SmokeResult) map[string]bool {
+		m := make(map[string]bool)
+		for _, c := range res.Checks {
+			m[c.Name] = c.OK
+		}
+		return m
+	}
+
+	cfg, err := ReadSmokeTestConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := SmokeTest(tmp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Healthy {
+		t.Errorf("SmokeTest without default route: healthy, want unhealthy")
+	}
+	want := map[string]bool{
+		SmokeDefaultRoute: false,
+		SmokeGateway:      false,
+		SmokeDNS:          false,
+		SmokeNAT:          false,
+	}
+	if diff := cmp.Diff(want, ok(res)); diff != "" {
+		t.Fatalf("SmokeTest: unexpected results: diff (-want +got):\n%s", diff)
+	}
+	if got, want := res.Failed()[0].Detail, "no default route"; got != want {
+		t.Errorf("default route detail = %q, want %q", got, want)
+	}
+
+	_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+	if err := netlink.RouteAdd(&netlink.Route{LinkIndex: lo.Attrs().Index, Dst: defaultDst}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "interfaces.json"), []byte(`
+{
+  "interfaces": [
+    {
+      "name": "lan0",
+      "addr": "127.0.0.1/8"
+    }
+  ]
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg.NATTarget = ln.Addr().String()
+	res, err = SmokeTest(tmp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]bool{
+		SmokeDefaultRoute: true,
+		SmokeGateway:      true,
+		SmokeDNS:          false, // no dnsd
+		SmokeNAT:          true,
+	}
+	if diff := cmp.Diff(want, ok(res)); diff != "" {
+		t.Fatalf("SmokeTest: unexpected results: diff (-want +got):\n%s", diff)
+	}
+
+	last, err := ReadSmokeResult(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(ok(res), ok(last)); diff != "" {
+		t.Errorf("ReadSmokeResult: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,524 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/pppoe"
+)
+
+// linkState is the addresses and routes which netconfig configures on a link.
+type linkState struct {
+	source string // configuration input, e.g. dhcp4 or dhcp6
+	ifname string
+	addrs  []*netlink.Addr
+	routes []*netlink.Route
+
+	// ownedFamily is the address family (netlink.FAMILY_V4 or FAMILY_V6) of
+	// the addresses on the link which are managed by netconfig: permanent
+	// global addresses of that family which netconfig configured (see
+	// ownedAddrs) but no source desires are removed, e.g. the address of a
+	// previous DHCP lease. 0 keeps all addresses.
+	ownedFamily int
+
+	// ownedProtocol is the protocol (e.g. rtprotLease) of the routes on the
+	// link which are managed by this source: routes of that protocol which
+	// are not desired are removed, e.g. the default route via the gateway of
+	// a previous lease, or with the priority of the previous uplink health.
+	// 0 keeps all routes.
+	ownedProtocol int
+
+	// announce makes apply announce newly added addresses to the clients
+	// on the link (see announceAddrs).
+	announce bool
+}
+
+// state is the kernel state which netconfig derives from its configuration
+// inputs. Link settings (names, MTU, offloads, …) are not part of the state:
+// they are configured by applyInterfaces beforehand, as the state refers to
+// links by name.
+type state struct {
+	links     []linkState
+	neighbors []*netlink.Neigh
+	rules     []*netlink.Rule  // policy routing
+	routes    []*netlink.Route // static routes (routes.json), see applyRoutes
+	routing   *routing         // routing daemon integration (routing.json)
+	imported  []netlink.Route  // routes of the routing daemon, see listImported
+	owned     *ownedAddrs      // addresses configured by netconfig
+	sysctls   []string
+	iids      []*iidState // IPv6 address generation
+	firewall  *ruleset
+}
+
+// buildState returns the desired state for the configuration in dir and the
+// uplink interface ifname. Parts of the state which cannot be built are
+// reported via appendError and omitted, so that the remainder can still be
+// applied.
+func buildState(dir, ifname string, counters func(*nftables.CounterObj) *nftables.CounterObj, appendError func(error)) *state {
+	var st state
+
+	neighs, err := neighbors(dir)
+	if err != nil {
+		appendError(fmt.Errorf("neighbors: %v", err))
+	}
+	st.neighbors = neighs
+
+	links, err := interfaceAddrs(dir)
+	if err != nil {
+		appendError(fmt.Errorf("interfaces: %v", err))
+	}
+	st.links = append(st.links, links...)
+
+	priority := 0
+	if !uplinkHealthy(dir, "uplink0") {
+		priority = unhealthyPriority
+	}
+	if ls, err := dhcp4State(filepath.Join(dir, "dhcp4/wire/lease.json"), "uplink0", priority); err != nil {
+		appendError(fmt.Errorf("dhcp4: %v", err))
+	} else if ls != nil {
+		st.links = append(st.links, *ls)
+	}
+
+	if ls, err := pppoeState(dir, priority); err != nil {
+		appendError(fmt.Errorf("pppoe: %v", err))
+	} else if ls != nil {
+		st.links = append(st.links, *ls)
+	}
+
+	for idx, backup := range BackupUplinks {
+		if _, err := net.InterfaceByName(backup); err != nil {
+			continue // backup uplink not present
+		}
+		if ls, err := dhcp4State(BackupLeasePath(dir, backup), backup, 100*(idx+1)); err != nil {
+			appendError(warning{fmt.Errorf("dhcp4(%s): %v", backup, err)})
+		} else if ls != nil {
+			st.links = append(st.links, *ls)
+		}
+	}
+
+	delegated, err := delegatedAddrs(dir, time.Now())
+	if err != nil {
+		appendError(fmt.Errorf("dhcp6: %v", err))
+	}
+	ifnames := make([]string, 0, len(delegated))
+	for ifname := range delegated {
+		ifnames = append(ifnames, ifname)
+	}
+	sort.Strings(ifnames)
+	for _, ifname := range ifnames {
+		addrs := delegated[ifname]
+		source := "dhcp6"
+		if ifname != "lan0" {
+			if _, err := net.InterfaceByName(ifname); err != nil {
+				continue // e.g. VLAN not created yet
+			}
+			source = "dhcp6(" + ifname + ")"
+		}
+		st.links = append(st.links, linkState{
+			source:      source,
+			ifname:      ifname,
+			addrs:       addrs,
+			announce:    true,
+			ownedFamily: netlink.FAMILY_V6, // addresses of previous prefixes
+		})
+	}
+
+	if ls, rules, err := interceptionState(dir); err != nil {
+		appendError(fmt.Errorf("interception: %v", err))
+	} else if ls != nil {
+		st.links = append(st.links, *ls)
+		st.rules = rules
+	}
+
+	routes, err := staticRoutes(dir)
+	if err != nil {
+		appendError(fmt.Errorf("routes: %v", err))
+	}
+	st.routes = routes
+	st.summarize()
+
+	rules, err := staticRules(dir)
+	if err != nil {
+		appendError(fmt.Errorf("rules: %v", err))
+	}
+	st.rules = append(st.rules, rules...)
+
+	rt, err := readRoutingConfig(dir)
+	if err != nil {
+		appendError(fmt.Errorf("routing: %v", err))
+	}
+	st.routing = rt
+
+	st.sysctls = sysctls(ifname)
+	iids, err := iidStates(dir)
+	if err != nil {
+		appendError(fmt.Errorf("ipv6: %v", err))
+	}
+	st.iids = iids
+	for _, iid := range iids {
+		st.sysctls = append(st.sysctls, iid.sysctls...)
+	}
+
+	rs, err := buildFirewall(dir, ifname, counters)
+	if err != nil {
+		appendError(fmt.Errorf("firewall: %v", err))
+	}
+	st.firewall = rs
+
+	return &st
+}
+
+// summarize aggregates the routes of each link and the static routes (see
+// summarizeRoutes). Summarizing the desired state means that applying it, dry
+// runs and VerifyRoutes all work with the routes which are installed.
+func (st *state) summarize() {
+	// The networks of the link addresses, which the kernel routes, are taken
+	// into account like any other route.
+	var connected []*netlink.Route
+	for _, ls := range st.links {
+		for _, addr := range ls.addrs {
+			connected = append(connected, &netlink.Route{
+				Dst: &net.IPNet{
+					IP:   addr.IP.Mask(addr.Mask),
+					Mask: addr.Mask,
+				},
+				Scope: netlink.SCOPE_LINK,
+			})
+		}
+	}
+	// others returns all routes except for those of link skip.
+	others := func(skip int) []*netlink.Route {
+		all := append(append([]*netlink.Route(nil), connected...), st.routes...)
+		for j, ls := range st.links {
+			if j != skip {
+				all = append(all, ls.routes...)
+			}
+		}
+		return all
+	}
+	for i := range st.links {
+		st.links[i].routes = summarizeRoutes(st.links[i].routes, others(i))
+	}
+	st.routes = summarizeRoutes(st.routes, others(-1))
+}
+
+// interfaceAddrs returns the addresses configured in interfaces.json for the
+// links which are present.
+func interfaceAddrs(dir string) ([]linkState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var states []linkState
+	for _, l := range links {
+		details, ok := cfg.match(l.Attrs())
+		if !ok || details.Addr == "" {
+			continue
+		}
+		addr, err := netlink.ParseAddr(details.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("ParseAddr(%q): %v", details.Addr, err)
+		}
+		states = append(states, linkState{
+			source:   "interfaces",
+			ifname:   details.Name,
+			addrs:    []*netlink.Addr{addr},
+			announce: details.Name != "uplink0",
+		})
+	}
+	return states, nil
+}
+
+func dhcp4State(leasePath, ifname string, priority int) (*linkState, error) {
+	link, addr, routes, err := dhcp4Lease(leasePath, ifname, priority)
+	if err != nil {
+		return nil, err
+	}
+	source := "dhcp4"
+	if ifname != "uplink0" {
+		source = "dhcp4(" + ifname + ")"
+	}
+	ls := &linkState{
+		source:        source,
+		ifname:        ifname,
+		ownedFamily:   netlink.FAMILY_V4,
+		ownedProtocol: rtprotLease,
+	}
+	if link == nil {
+		// No lease (anymore): the address and routes of a previous lease
+		// (e.g. one which expired or was released) are removed.
+		if _, err := netlink.LinkByName(ifname); err != nil {
+			return nil, nil
+		}
+		return ls, nil
+	}
+	ls.addrs = []*netlink.Addr{addr}
+	ls.routes = routes
+	return ls, nil
+}
+
+// pppoeState returns the state for the PPPoE lease in dir, or nil if there is
+// no lease or its ppp interface is gone. Unlike a DHCP lease, the address is
+// a point-to-point address and the default route points to the interface,
+// without a gateway.
+func pppoeState(dir string, priority int) (*linkState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pppoe/wire/lease.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // PPPoE not used or no session yet
+		}
+		return nil, err
+	}
+	var lease pppoe.Lease
+	if err := json.Unmarshal(b, &lease); err != nil {
+		return nil, err
+	}
+	link, err := netlink.LinkByName(lease.Interface)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil, nil // session ended, cmd/pppoe removes the lease
+		}
+		return nil, err
+	}
+	clientIP := net.ParseIP(lease.ClientIP).To4()
+	peerIP := net.ParseIP(lease.PeerIP).To4()
+	if clientIP == nil || peerIP == nil {
+		return nil, fmt.Errorf("invalid PPPoE lease: client_ip %q, peer_ip %q", lease.ClientIP, lease.PeerIP)
+	}
+	addrs := []*netlink.Addr{
+		{
+			IPNet: &net.IPNet{IP: clientIP, Mask: net.CIDRMask(32, 32)},
+			Peer:  &net.IPNet{IP: peerIP, Mask: net.CIDRMask(32, 32)},
+		},
+	}
+	if ll, peer := net.ParseIP(lease.LinkLocal), net.ParseIP(lease.PeerLinkLocal); ll != nil && peer != nil {
+		addrs = append(addrs, &netlink.Addr{
+			IPNet: &net.IPNet{IP: ll, Mask: net.CIDRMask(128, 128)},
+			Peer:  &net.IPNet{IP: peer, Mask: net.CIDRMask(128, 128)},
+		})
+	}
+	return &linkState{
+		source: "pppoe",
+		ifname: lease.Interface,
+		addrs:  addrs,
+		routes: []*netlink.Route{
+			{
+				LinkIndex: link.Attrs().Index,
+				Dst: &net.IPNet{
+					IP:   net.IPv4zero,
+					Mask: net.CIDRMask(0, 32),
+				},
+				Src:      clientIP,
+				Scope:    netlink.SCOPE_LINK,
+				Protocol: rtprotLease,
+				Priority: priority,
+			},
+		},
+		ownedFamily:   netlink.FAMILY_V4,
+		ownedProtocol: rtprotLease,
+	}, nil
+}
+
+func (st *state) applyNeighbors(appendError func(error)) {
+	for _, n := range st.neighbors {
+		if err := netlink.NeighSet(n); err != nil {
+			appendError(fmt.Errorf("neighbors: NeighSet(%v, %v): %v", n.IP, n.HardwareAddr, err))
+			return
+		}
+	}
+}
+
+func (st *state) applyLinks(appendError func(error)) {
+	h, err := netlink.NewHandle()
+	if err != nil {
+		appendError(fmt.Errorf("netlink.NewHandle: %v", err))
+		return
+	}
+	defer h.Delete()
+	// Addresses are desired if any source configures them on the link.
+	desired := make(map[string][]*netlink.Addr)
+	for _, ls := range st.links {
+		desired[ls.ifname] = append(desired[ls.ifname], ls.addrs...)
+	}
+	for _, ls := range st.links {
+		if err := ls.apply(h, desired[ls.ifname], st.imported, st.owned); err != nil {
+			appendError(fmt.Errorf("%s: %v", ls.source, err))
+		}
+	}
+}
+
+// apply makes the kernel state of the link match ls: desired addresses and
+// routes are added or replaced, stale ones of the owned family and protocol
+// are removed. Calling apply again without changes is a no-op, so Apply can
+// run on every lease renewal. Routes which would replace an imported route
+// (see RoutingConfig) are skipped. Added addresses are recorded in owned.
+func (ls *linkState) apply(h *netlink.Handle, desired []*netlink.Addr, imported []netlink.Route, owned *ownedAddrs) error {
+	link, err := h.LinkByName(ls.ifname)
+	if err != nil {
+		return err
+	}
+	var announce []net.IP
+	if ls.announce || ls.ownedFamily != 0 {
+		existing, err := h.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("AddrList: %v", err)
+		}
+		if ls.announce {
+			announce = newAddrs(existing, ls.addrs)
+		}
+		for _, addr := range staleAddrs(existing, desired, ls.ownedFamily) {
+			if !owned.owns(ls.ifname, addr) {
+				continue // e.g. added by the user or another daemon
+			}
+			if err := h.AddrDel(link, addr); err != nil {
+				return fmt.Errorf("AddrDel(%v): %v", addr, err)
+			}
+			owned.remove(ls.ifname, addr)
+		}
+	}
+	for _, addr := range ls.addrs {
+		if err := h.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("AddrReplace(%v): %v", addr, err)
+		}
+		owned.add(ls.ifname, addr)
+	}
+	if len(announce) > 0 {
+		go announceAddrs(ls.ifname, announce)
+	}
+	// Dump the existing routes once instead of replacing every route, which
+	// is expensive for many routes and causes FIB churn.
+	existing, err := h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+	}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		existing = nil // replace all routes
+	}
+	for _, r := range staleRoutes(existing, ls.routes, ls.ownedProtocol) {
+		if err := h.RouteDel(r); err != nil {
+			return fmt.Errorf("RouteDel(%v): %v", r.Dst, err)
+		}
+	}
+	for _, r := range ls.routes {
+		if routeInstalled(existing, r) {
+			continue
+		}
+		if other := importedConflict(imported, r); other != nil {
+			log.Printf("%s: not installing route %v: conflicts with route of protocol %d", ls.source, r.Dst, other.Protocol)
+			continue
+		}
+		if err := h.RouteReplace(r); err != nil {
+			return fmt.Errorf("RouteReplace(%v): %v", r.Dst, err)
+		}
+	}
+	return nil
+}
+
+// staleAddrs returns the global addresses of family in existing which are not
+// desired. Link-local addresses are never stale; addresses the kernel
+// generated (e.g. via SLAAC) are kept by apply, as netconfig does not own
+// them. Delegated addresses have lifetimes, so they are not permanent.
+func staleAddrs(existing []netlink.Addr, desired []*netlink.Addr, family int) []*netlink.Addr {
+	if family == 0 {
+		return nil
+	}
+	var stale []*netlink.Addr
+	for idx := range existing {
+		addr := &existing[idx]
+		if (family == netlink.FAMILY_V4) != (addr.IP.To4() != nil) ||
+			addr.Scope != unix.RT_SCOPE_UNIVERSE {
+			continue
+		}
+		var found bool
+		for _, want := range desired {
+			if want.IPNet.String() == addr.IPNet.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, addr)
+		}
+	}
+	return stale
+}
+
+// staleRoutes returns the routes of protocol in existing which are not
+// desired.
+func staleRoutes(existing []netlink.Route, desired []*netlink.Route, protocol int) []*netlink.Route {
+	if protocol == 0 {
+		return nil
+	}
+	var stale []*netlink.Route
+	for idx := range existing {
+		r := &existing[idx]
+		if r.Protocol != protocol {
+			continue
+		}
+		var found bool
+		for _, want := range desired {
+			if sameRoute(r, want) && r.Src.Equal(want.Src) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, r)
+		}
+	}
+	return stale
+}
+
+// routeInstalled reports whether a route equivalent to want is in existing.
+func routeInstalled(existing []netlink.Route, want *netlink.Route) bool {
+	for idx := range existing {
+		r := &existing[idx]
+		if !sameRoute(r, want) ||
+			!r.Src.Equal(want.Src) ||
+			r.Scope != want.Scope {
+			continue
+		}
+		if want.Type != 0 && r.Type != want.Type {
+			continue
+		}
+		if want.Protocol != 0 && r.Protocol != want.Protocol {
+			continue
+		}
+		return true
+	}
+	return false
+}
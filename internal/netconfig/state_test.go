@@ -0,0 +1,525 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuildState(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp6", "wire"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp6", "wire", "lease.json"), []byte(`
+{
+  "valid_until":"0001-01-01T00:00:00Z",
+  "prefixes":[
+    {"IP":"2a02:168:4a00::","Mask":"////////AAAAAAAAAAAAAA=="}
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var errors []error
+	st := buildState(tmp, "uplink0", func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	}, func(err error) {
+		errors = append(errors, err)
+	})
+	if len(errors) > 0 {
+		t.Fatalf("buildState: %v", errors)
+	}
+
+	if got, want := len(st.links), 1; got != want {
+		t.Fatalf("unexpected number of links: got %d, want %d", got, want)
+	}
+	ls := st.links[0]
+	if got, want := ls.source+" "+ls.ifname+" "+ls.addrs[0].IPNet.String(), "dhcp6 lan0 2a02:168:4a00::1/64"; got != want {
+		t.Errorf("unexpected link state: got %q, want %q", got, want)
+	}
+
+	want := []string{
+		"net.ipv4.ip_forward=1",
+		"net.ipv6.conf.all.forwarding=1",
+		"net.ipv6.conf.uplink0.accept_ra=2",
+		"net.ipv4.conf.uplink0.ignore_routes_with_linkdown=1",
+	}
+	if diff := cmp.Diff(want, st.sysctls); diff != "" {
+		t.Errorf("unexpected sysctls: (-want +got)\n%s", diff)
+	}
+
+	if st.firewall == nil || len(st.firewall.tables) == 0 {
+		t.Errorf("firewall ruleset unexpectedly empty")
+	}
+}
+
+func TestBackupUplinkWarning(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "uplink0"}, PeerName: "uplink1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fn := BackupLeasePath(tmp, "uplink1")
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A broken backup uplink lease must not stop netconfigd.
+	var errors []error
+	buildState(tmp, "uplink0", func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	}, func(err error) {
+		errors = append(errors, err)
+	})
+	if got, want := len(errors), 1; got != want {
+		t.Fatalf("buildState: got %d errors (%v), want %d", got, errors, want)
+	}
+	if _, ok := errors[0].(warning); !ok {
+		t.Errorf("buildState: %v is not a warning", errors[0])
+	}
+}
+
+func TestNeighborState(t *testing.T) {
+	gw := net.ParseIP("192.0.2.1")
+	hwaddr := net.HardwareAddr{0x02, 0x73, 0x53, 0x00, 0xca, 0xfe}
+	for _, tt := range []struct {
+		desc       string
+		neighs     []netlink.Neigh
+		wantHW     net.HardwareAddr
+		wantFailed bool
+	}{
+		{
+			desc: "not yet resolved",
+		},
+		{
+			desc: "incomplete",
+			neighs: []netlink.Neigh{
+				{IP: gw, State: netlink.NUD_INCOMPLETE},
+			},
+		},
+		{
+			desc: "stale entries are being re-confirmed",
+			neighs: []netlink.Neigh{
+				{IP: gw, State: netlink.NUD_STALE, HardwareAddr: hwaddr},
+			},
+		},
+		{
+			desc: "reachable",
+			neighs: []netlink.Neigh{
+				{IP: net.ParseIP("192.0.2.2"), State: netlink.NUD_FAILED},
+				{IP: gw, State: netlink.NUD_REACHABLE, HardwareAddr: hwaddr},
+			},
+			wantHW: hwaddr,
+		},
+		{
+			desc: "failed",
+			neighs: []netlink.Neigh{
+				{IP: gw, State: netlink.NUD_FAILED},
+			},
+			wantFailed: true,
+		},
+	} {
+		gotHW, gotFailed := neighborState(tt.neighs, gw)
+		if gotHW.String() != tt.wantHW.String() || gotFailed != tt.wantFailed {
+			t.Errorf("%s: neighborState = %v, %v; want %v, %v", tt.desc, gotHW, gotFailed, tt.wantHW, tt.wantFailed)
+		}
+	}
+}
+
+func TestResolveGatewaysAsync(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan gateway, 2)
+	resolve = func(gw gateway) (net.HardwareAddr, error) {
+		started <- gw
+		<-release
+		return nil, fmt.Errorf("no ARP/NDP reply")
+	}
+	defer func() { resolve = resolveGateway }()
+
+	st := &state{
+		links: []linkState{
+			{
+				source: "dhcp4",
+				ifname: "uplink-test0",
+				routes: []*netlink.Route{
+					{Gw: net.ParseIP("192.0.2.1"), LinkIndex: 23},
+					{Dst: &net.IPNet{IP: net.ParseIP("192.0.2.0"), Mask: net.CIDRMask(24, 32)}, LinkIndex: 23},
+				},
+			},
+		},
+	}
+	// Both calls return while the gateway does not answer, and the second
+	// does not probe the gateway again.
+	st.resolveGateways("uplink-test0")
+	st.resolveGateways("uplink-test0")
+	if got, want := (<-started).ip.String(), "192.0.2.1"; got != want {
+		t.Errorf("resolving %v, want %v", got, want)
+	}
+	select {
+	case gw := <-started:
+		t.Errorf("%v resolved again while resolving", gw)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+}
+
+func TestIPv6Settings(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	st, err := (&IPv6Settings{IID: "token", Token: "::1:2", TemporaryAddresses: true}).state(tmp, "uplink0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.token.String(), "::1:2"; got != want {
+		t.Errorf("token: got %s, want %s", got, want)
+	}
+	want := []string{
+		"net.ipv6.conf.uplink0.addr_gen_mode=0",
+		"net.ipv6.conf.uplink0.use_tempaddr=2",
+	}
+	if diff := cmp.Diff(want, st.sysctls); diff != "" {
+		t.Errorf("unexpected sysctls: (-want +got)\n%s", diff)
+	}
+
+	// The stable-privacy secret is generated once and then re-used, so that
+	// addresses are stable across reboots.
+	first, err := (&IPv6Settings{IID: "stable-privacy"}).state(tmp, "uplink0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := (&IPv6Settings{IID: "stable-privacy"}).state(tmp, "uplink0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(first.sysctls, second.sysctls); diff != "" {
+		t.Errorf("stable secret changed: (-first +second)\n%s", diff)
+	}
+	if got, want := first.sysctls[1], "net.ipv6.conf.uplink0.addr_gen_mode=2"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, s := range []IPv6Settings{
+		{IID: "token", Token: "192.168.0.1"},
+		{IID: "token"},
+		{IID: "mac"},
+	} {
+		if _, err := s.state(tmp, "uplink0"); err == nil {
+			t.Errorf("%+v: state unexpectedly succeeded", s)
+		}
+	}
+}
+
+func TestTokenBindings(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "bindings.json"), []byte(`
+{
+  "bindings":[
+    {"hardware_addr":"00:1f:16:31:73:75","addr":"192.168.42.23","token":"::23"}
+  ]
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a delegated prefix, only the IPv4 binding applies.
+	bindings, err := readBindings(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(bindings), 1; got != want {
+		t.Fatalf("readBindings: got %d bindings, want %d", got, want)
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp6", "wire"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The token address follows prefix changes.
+	for _, tt := range []struct {
+		ip   string
+		mask string
+		want string
+	}{
+		{"2a02:168:4a00::", "////////AAAAAAAAAAAAAA==", "2a02:168:4a00::23"}, // /64
+		{"2a02:168:4b00::", "//////8AAAAAAAAAAAAAAA==", "2a02:168:4b00::23"}, // /56
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "dhcp6", "wire", "lease.json"), []byte(`
+{
+  "valid_until":"0001-01-01T00:00:00Z",
+  "prefixes":[
+    {"IP":"`+tt.ip+`","Mask":"`+tt.mask+`"}
+  ]
+}
+`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := TokenAddrs(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]net.IP{"00:1f:16:31:73:75": net.ParseIP(tt.want)}
+		if diff := cmp.Diff(want, addrs); diff != "" {
+			t.Errorf("TokenAddrs: unexpected diff (-want +got):\n%s", diff)
+		}
+	}
+
+	for _, token := range []string{"192.168.42.23", "2a02:168:4a00::23", "garbage"} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "bindings.json"), []byte(`
+{
+  "bindings":[
+    {"hardware_addr":"00:1f:16:31:73:75","token":"`+token+`"}
+  ]
+}
+`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readBindings(tmp); err == nil {
+			t.Errorf("readBindings(token %q) unexpectedly succeeded", token)
+		}
+	}
+}
+
+// TestLinkStateRenewal applies two consecutive DHCPv4 leases (twice each) in
+// a new network namespace and verifies that the address and routes of the
+// first lease are removed, but addresses of other families are kept. Once the
+// lease expires, its address and routes are removed, too.
+func TestLinkStateRenewal(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		t.Fatal(err)
+	}
+	// Addresses which netconfig did not configure must be kept.
+	for _, addr := range []string{"2001:db8::1/64", "203.0.113.5/24"} {
+		foreign, err := netlink.ParseAddr(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		foreign.Flags = unix.IFA_F_NODAD
+		if err := netlink.AddrAdd(veth, foreign); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := netlink.NewHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	leasePath := filepath.Join(tmp, "lease.json")
+	owned := &ownedAddrs{addrs: make(map[string]bool)}
+
+	apply := func(lease string) {
+		t.Helper()
+		if err := ioutil.WriteFile(leasePath, []byte(lease), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ls, err := dhcp4State(leasePath, "veth0", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := ls.apply(h, ls.addrs, nil, owned); err != nil {
+				t.Fatalf("apply #%d: %v", i+1, err)
+			}
+		}
+	}
+	apply(`{"client_ip": "192.0.2.23", "subnet_mask": "255.255.255.0", "router": "192.0.2.1"}`)
+	apply(`{"client_ip": "198.51.100.23", "subnet_mask": "255.255.255.0", "router": "198.51.100.1"}`)
+
+	addrs, err := netlink.AddrList(veth, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, addr := range addrs {
+		if addr.Scope == unix.RT_SCOPE_UNIVERSE {
+			got = append(got, addr.IPNet.String())
+		}
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"198.51.100.23/24", "2001:db8::1/64", "203.0.113.5/24"}, got); diff != "" {
+		t.Errorf("unexpected addresses: diff (-want +got):\n%s", diff)
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Protocol: rtprotLease,
+	}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, r := range routes {
+		got = append(got, fmt.Sprintf("%v via %v", r.Dst, r.Gw))
+	}
+	sort.Strings(got)
+	want := []string{
+		"198.51.100.1/32 via <nil>",
+		"<nil> via 198.51.100.1",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected routes: diff (-want +got):\n%s", diff)
+	}
+
+	apply(`{"client_ip": "198.51.100.23", "subnet_mask": "255.255.255.0", "router": "198.51.100.1", "expiry": "2018-05-18T23:46:04Z"}`)
+	addrs, err = netlink.AddrList(veth, netlink.FAMILY_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, addr := range addrs {
+		if addr.Scope == unix.RT_SCOPE_UNIVERSE {
+			got = append(got, addr.IPNet.String())
+		}
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"2001:db8::1/64", "203.0.113.5/24"}, got); diff != "" {
+		t.Errorf("expired lease: unexpected addresses: diff (-want +got):\n%s", diff)
+	}
+	routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Protocol: rtprotLease,
+	}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) > 0 {
+		t.Errorf("expired lease: routes not removed: %v", routes)
+	}
+}
+
+// TestPPPoEState applies a PPPoE lease in a new network namespace, with a
+// veth link standing in for the ppp interface.
+func TestPPPoEState(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if ls, err := pppoeState(tmp, 0); err != nil || ls != nil {
+		t.Fatalf("pppoeState without lease = %v, %v; want nil, nil", ls, err)
+	}
+	if err := os.MkdirAll(filepath.Join(tmp, "pppoe", "wire"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lease := `{"interface": "ppp0", "client_ip": "198.51.100.7", "peer_ip": "198.51.100.1", "dns": ["192.0.2.53"], "mtu": 1492}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "pppoe", "wire", "lease.json"), []byte(lease), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ls, err := pppoeState(tmp, 0); err != nil || ls != nil {
+		t.Fatalf("pppoeState without ppp0 = %v, %v; want nil, nil", ls, err)
+	}
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ppp0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		t.Fatal(err)
+	}
+	h, err := netlink.NewHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Delete()
+	ls, err := pppoeState(tmp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.apply(h, ls.addrs, nil, &ownedAddrs{addrs: make(map[string]bool)}); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := netlink.AddrList(veth, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, addr := range addrs {
+		got = append(got, fmt.Sprintf("%v peer %v", addr.IPNet, addr.Peer))
+	}
+	if diff := cmp.Diff([]string{"198.51.100.7/32 peer 198.51.100.1/32"}, got); diff != "" {
+		t.Errorf("unexpected addresses: diff (-want +got):\n%s", diff)
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Protocol: rtprotLease,
+	}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, r := range routes {
+		got = append(got, fmt.Sprintf("%v via %v src %v", r.Dst, r.Gw, r.Src))
+	}
+	if diff := cmp.Diff([]string{"<nil> via <nil> src 198.51.100.7"}, got); diff != "" {
+		t.Errorf("unexpected routes: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+)
+
+// summarizePrefixes returns the smallest list of prefixes covering exactly
+// the same addresses as prefixes: prefixes covered by another prefix are
+// removed, and adjacent prefixes of the same length are merged (repeatedly),
+// e.g. 10.0.0.0/25 and 10.0.0.128/25 become 10.0.0.0/24. IPv4 and IPv6
+// prefixes are not mixed. The result is sorted.
+func summarizePrefixes(prefixes []*net.IPNet) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(prefixes))
+	for _, p := range prefixes {
+		ip := p.IP.To4()
+		if ip == nil {
+			ip = p.IP.To16()
+		}
+		ones, bits := p.Mask.Size()
+		if ip == nil || bits != len(ip)*8 {
+			result = append(result, p) // leave malformed prefixes alone
+			continue
+		}
+		result = append(result, &net.IPNet{
+			IP:   ip.Mask(p.Mask),
+			Mask: net.CIDRMask(ones, bits),
+		})
+	}
+	for {
+		sort.Slice(result, func(i, j int) bool {
+			a, b := result[i], result[j]
+			if len(a.IP) != len(b.IP) {
+				return len(a.IP) < len(b.IP)
+			}
+			if c := bytes.Compare(a.IP, b.IP); c != 0 {
+				return c < 0
+			}
+			ai, _ := a.Mask.Size()
+			bi, _ := b.Mask.Size()
+			return ai < bi
+		})
+		merged := result[:0:0]
+		var changed bool
+		for _, p := range result {
+			if len(merged) == 0 {
+				merged = append(merged, p)
+				continue
+			}
+			last := merged[len(merged)-1]
+			if len(last.IP) != len(p.IP) {
+				merged = append(merged, p)
+				continue
+			}
+			if last.Contains(p.IP) {
+				lastOnes, _ := last.Mask.Size()
+				ones, _ := p.Mask.Size()
+				if lastOnes <= ones {
+					changed = true
+					continue // p is covered by last
+				}
+			}
+			if parent := siblingParent(last, p); parent != nil {
+				merged[len(merged)-1] = parent
+				changed = true
+				continue
+			}
+			merged = append(merged, p)
+		}
+		result = merged
+		if !changed {
+			return result
+		}
+	}
+}
+
+// siblingParent returns the prefix covering exactly a and b if they are the
+// two halves of it, or nil otherwise.
+func siblingParent(a, b *net.IPNet) *net.IPNet {
+	aOnes, bits := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	if aOnes != bOnes || aOnes == 0 {
+		return nil
+	}
+	mask := net.CIDRMask(aOnes-1, bits)
+	if !a.IP.Mask(mask).Equal(b.IP.Mask(mask)) || a.IP.Equal(b.IP) {
+		return nil
+	}
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}
+}
+
+// routeKey identifies routes which differ only in their destination.
+func routeKey(r *netlink.Route) string {
+	return fmt.Sprintf("%d %v %v %d %d %d %d %d", r.LinkIndex, r.Gw, r.Src, r.Table, r.Priority, r.Protocol, r.Scope, r.Type)
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// summarizeRoutes aggregates the destinations of routes which only differ in
+// their destination (see summarizePrefixes), e.g. the AllowedIPs of a VPN
+// peer. Routes are only aggregated if none of their destinations overlaps
+// with a destination of routes (or others, e.g. the routes of other links)
+// with different attributes, so that longest-prefix matching selects the
+// same route for every address as before.
+func summarizeRoutes(routes, others []*netlink.Route) []*netlink.Route {
+	var (
+		keys   []string
+		groups = make(map[string][]*netlink.Route)
+	)
+	for _, r := range routes {
+		if r.Dst == nil {
+			keys = append(keys, "") // the default route is never aggregated
+			groups[""] = append(groups[""], r)
+			continue
+		}
+		key := routeKey(r)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	all := append(append([]*netlink.Route(nil), routes...), others...)
+	conflicts := func(key string, group []*netlink.Route) bool {
+		for _, r := range group {
+			for _, other := range all {
+				if other.Dst == nil || routeKey(other) == key {
+					continue
+				}
+				if overlaps(r.Dst, other.Dst) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var result []*netlink.Route
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		group := groups[key]
+		if key == "" || len(group) == 1 || conflicts(key, group) {
+			result = append(result, group...)
+			continue
+		}
+		dsts := make([]*net.IPNet, len(group))
+		for i, r := range group {
+			dsts[i] = r.Dst
+		}
+		for _, dst := range summarizePrefixes(dsts) {
+			r := *group[0] // copy
+			r.Dst = dst
+			result = append(result, &r)
+		}
+	}
+	return result
+}
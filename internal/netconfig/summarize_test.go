@@ -0,0 +1,194 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+)
+
+func mustParseCIDRs(t *testing.T, s string) []*net.IPNet {
+	t.Helper()
+	var prefixes []*net.IPNet
+	for _, f := range strings.Fields(s) {
+		_, ipnet, err := net.ParseCIDR(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	return prefixes
+}
+
+func prefixString(prefixes []*net.IPNet) string {
+	var s []string
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func TestSummarizePrefixes(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "10.0.0.0/25 10.0.0.128/25",
+			want: "10.0.0.0/24",
+		},
+		{
+			in:   "10.0.3.0/24 10.0.0.0/24 10.0.2.0/24 10.0.1.0/24",
+			want: "10.0.0.0/22",
+		},
+		{
+			in:   "10.0.0.0/24 10.0.0.5/32 10.0.0.0/24",
+			want: "10.0.0.0/24",
+		},
+		{
+			// a covered prefix is removed, after which the remaining
+			// prefixes can be merged
+			in:   "10.0.0.0/25 10.0.0.64/26 10.0.0.128/25",
+			want: "10.0.0.0/24",
+		},
+		{
+			// adjacent, but not siblings
+			in:   "10.0.1.0/24 10.0.2.0/24",
+			want: "10.0.1.0/24 10.0.2.0/24",
+		},
+		{
+			in:   "2001:db8::/49 192.168.0.0/24 2001:db8:0:8000::/49",
+			want: "192.168.0.0/24 2001:db8::/48",
+		},
+		{
+			// host bits are cleared
+			in:   "10.0.0.1/25 10.0.0.129/25",
+			want: "10.0.0.0/24",
+		},
+	} {
+		got := prefixString(summarizePrefixes(mustParseCIDRs(t, tt.in)))
+		if got != tt.want {
+			t.Errorf("summarizePrefixes(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeRoutes(t *testing.T) {
+	gw := net.ParseIP("10.0.0.1")
+	otherGw := net.ParseIP("10.0.0.2")
+	route := func(dst string, gw net.IP) *netlink.Route {
+		_, ipnet, err := net.ParseCIDR(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &netlink.Route{LinkIndex: 3, Dst: ipnet, Gw: gw}
+	}
+	dsts := func(routes []*netlink.Route) []string {
+		var s []string
+		for _, r := range routes {
+			s = append(s, r.Dst.String()+" via "+r.Gw.String())
+		}
+		return s
+	}
+
+	routes := []*netlink.Route{
+		route("172.16.0.0/24", gw),
+		route("172.16.1.0/24", gw),
+		route("172.17.0.0/24", otherGw),
+		route("172.17.1.0/24", otherGw),
+	}
+	got := dsts(summarizeRoutes(routes, nil))
+	want := []string{
+		"172.16.0.0/23 via 10.0.0.1",
+		"172.17.0.0/23 via 10.0.0.2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected routes: (-want +got)\n%s", diff)
+	}
+
+	// 172.16.1.128/25 via another gateway would no longer be more specific
+	// than an aggregate, so the first group must not be aggregated.
+	others := []*netlink.Route{route("172.16.1.128/25", otherGw)}
+	got = dsts(summarizeRoutes(routes, others))
+	want = []string{
+		"172.16.0.0/24 via 10.0.0.1",
+		"172.16.1.0/24 via 10.0.0.1",
+		"172.17.0.0/23 via 10.0.0.2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected routes: (-want +got)\n%s", diff)
+	}
+}
+
+func TestRouteInstalled(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("172.16.0.0/24")
+	want := &netlink.Route{
+		LinkIndex: 3,
+		Dst:       dst,
+		Gw:        net.ParseIP("10.0.0.1"),
+		Src:       net.ParseIP("10.0.0.2"),
+		Protocol:  16, // RTPROT_DHCP
+	}
+	installed := *want
+	installed.Table = 254 // RT_TABLE_MAIN
+	installed.Type = 1    // RTN_UNICAST
+	if !routeInstalled([]netlink.Route{installed}, want) {
+		t.Errorf("routeInstalled(%v) = false, want true", want)
+	}
+
+	previousLease := installed
+	previousLease.Src = net.ParseIP("10.0.0.3")
+	if routeInstalled([]netlink.Route{previousLease}, want) {
+		t.Errorf("routeInstalled unexpectedly true for a route with a different source address")
+	}
+}
+
+func TestStateSummarize(t *testing.T) {
+	route := func(dst, gw string) *netlink.Route {
+		_, ipnet, err := net.ParseCIDR(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &netlink.Route{LinkIndex: 3, Dst: ipnet, Gw: net.ParseIP(gw), Protocol: rtprotStatic}
+	}
+	addr, err := netlink.ParseAddr("10.1.1.1/25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &state{
+		links: []linkState{{ifname: "lan1", addrs: []*netlink.Addr{addr}}},
+		routes: []*netlink.Route{
+			route("172.16.0.0/24", "192.0.2.2"),
+			route("172.16.1.0/24", "192.0.2.2"),
+			// These overlap with the connected network of lan1,
+			// 10.1.1.0/25, so they are not aggregated.
+			route("10.1.0.0/24", "192.0.2.3"),
+			route("10.1.1.0/24", "192.0.2.3"),
+		},
+	}
+	st.summarize()
+	var got []string
+	for _, r := range st.routes {
+		got = append(got, r.Dst.String())
+	}
+	want := []string{"172.16.0.0/23", "10.1.0.0/24", "10.1.1.0/24"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected static routes: (-want +got)\n%s", diff)
+	}
+}
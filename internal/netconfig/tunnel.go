@@ -0,0 +1,257 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+)
+
+// TunnelDetails declare a GRE, GRE-TAP or VXLAN tunnel to another site,
+// typically over a WireGuard link (local and remote are then WireGuard
+// addresses). gretap and vxlan tunnels carry ethernet frames and can be listed
+// as bridge members in interfaces.json to stretch a LAN segment between the
+// sites. The address of the tunnel is configured like that of a network
+// card, by an entry in interfaces.json with the same name.
+type TunnelDetails struct {
+	Name   string `json:"name"`   // e.g. gretap0
+	Type   string `json:"type"`   // gre, gretap or vxlan
+	Local  string `json:"local"`  // underlay address of this site, e.g. 10.0.137.1
+	Remote string `json:"remote"` // underlay address of the other site, e.g. 10.0.137.2
+
+	// Dev is the underlay link, e.g. wg0 (optional). The tunnel is created
+	// once the link is present, with an MTU which fits into that of the link.
+	Dev string `json:"dev,omitempty"`
+
+	Key  uint32 `json:"key,omitempty"`  // gre, gretap: optional key
+	VNI  int    `json:"vni,omitempty"`  // vxlan: network identifier
+	Port int    `json:"port,omitempty"` // vxlan: UDP port, default 4789
+	TTL  uint8  `json:"ttl,omitempty"`  // default: inherited from the inner packet
+}
+
+// TunnelConfig is the tunnel configuration, read from tunnels.json.
+type TunnelConfig struct {
+	Tunnels []TunnelDetails `json:"tunnels"`
+}
+
+// tunnelAlias marks links created by netconfig, so that only those are
+// removed when they are no longer configured.
+const tunnelAlias = "router7 tunnel"
+
+// readTunnels reads tunnels.json in dir. A missing file results in an empty
+// TunnelConfig.
+func readTunnels(dir string) (TunnelConfig, error) {
+	var cfg TunnelConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "tunnels.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("tunnels.json: %v", err)
+	}
+	return cfg, nil
+}
+
+func (cfg TunnelConfig) tunnel(ifname string) *TunnelDetails {
+	for i, t := range cfg.Tunnels {
+		if t.Name == ifname {
+			return &cfg.Tunnels[i]
+		}
+	}
+	return nil
+}
+
+// link returns the link to create for t, using the underlay link dev (nil if
+// t.Dev is not set).
+func (t *TunnelDetails) link(dev netlink.Link) (netlink.Link, error) {
+	local := net.ParseIP(t.Local)
+	if local == nil {
+		return nil, fmt.Errorf("invalid local address %q", t.Local)
+	}
+	remote := net.ParseIP(t.Remote)
+	if remote == nil {
+		return nil, fmt.Errorf("invalid remote address %q", t.Remote)
+	}
+	if (local.To4() == nil) != (remote.To4() == nil) {
+		return nil, fmt.Errorf("local %v and remote %v are of different address families", local, remote)
+	}
+	attrs := netlink.LinkAttrs{Name: t.Name}
+	var devIndex int
+	if dev != nil {
+		devIndex = dev.Attrs().Index
+	}
+	var l netlink.Link
+	switch t.Type {
+	case "gre":
+		l = &netlink.Gretun{
+			LinkAttrs: attrs,
+			Local:     local,
+			Remote:    remote,
+			IKey:      t.Key,
+			OKey:      t.Key,
+			Ttl:       t.TTL,
+			Link:      uint32(devIndex),
+		}
+
+	case "gretap":
+		l = &netlink.Gretap{
+			LinkAttrs: attrs,
+			Local:     local,
+			Remote:    remote,
+			IKey:      t.Key,
+			OKey:      t.Key,
+			Ttl:       t.TTL,
+			Link:      uint32(devIndex),
+		}
+
+	case "vxlan":
+		if t.VNI <= 0 || t.VNI >= 1<<24 {
+			return nil, fmt.Errorf("vni %d out of range [1, %d]", t.VNI, 1<<24-1)
+		}
+		if t.Key != 0 {
+			return nil, fmt.Errorf("key is only supported for gre and gretap, use vni")
+		}
+		port := t.Port
+		if port == 0 {
+			port = 4789 // IANA-assigned, the kernel defaults to 8472
+		}
+		l = &netlink.Vxlan{
+			LinkAttrs:    attrs,
+			VxlanId:      t.VNI,
+			SrcAddr:      local,
+			Group:        remote,
+			Port:         port,
+			VtepDevIndex: devIndex,
+			TTL:          int(t.TTL),
+			Learning:     true,
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported type %q, expected gre, gretap or vxlan", t.Type)
+	}
+	if dev != nil {
+		l.Attrs().MTU = dev.Attrs().MTU - tunnelOverhead[l.Type()]
+	}
+	return l, nil
+}
+
+// sameTunnel reports whether the existing link matches the desired link,
+// i.e. need not be re-created.
+func sameTunnel(existing, want netlink.Link) bool {
+	if existing.Type() != want.Type() {
+		return false
+	}
+	switch w := want.(type) {
+	case *netlink.Gretun:
+		e := existing.(*netlink.Gretun)
+		return e.Local.Equal(w.Local) && e.Remote.Equal(w.Remote) &&
+			e.IKey == w.IKey && e.Ttl == w.Ttl
+	case *netlink.Gretap:
+		e := existing.(*netlink.Gretap)
+		return e.Local.Equal(w.Local) && e.Remote.Equal(w.Remote) &&
+			e.IKey == w.IKey && e.Ttl == w.Ttl
+	case *netlink.Vxlan:
+		e := existing.(*netlink.Vxlan)
+		return e.SrcAddr.Equal(w.SrcAddr) && e.Group.Equal(w.Group) &&
+			e.VxlanId == w.VxlanId && e.Port == w.Port &&
+			e.VtepDevIndex == w.VtepDevIndex && e.TTL == w.TTL
+	}
+	return false
+}
+
+func isTunnel(l netlink.Link) bool {
+	switch l.(type) {
+	case *netlink.Gretun, *netlink.Gretap, *netlink.Vxlan:
+		return l.Attrs().Alias == tunnelAlias
+	}
+	return false
+}
+
+// createTunnels reconciles the tunnels of tunnels.json in dir: missing
+// tunnels are created, tunnels whose settings changed are re-created and
+// tunnels which are no longer configured are removed. Tunnels whose underlay
+// link is not present (yet) are skipped. The returned links were created and
+// need to be configured.
+func createTunnels(dir string, cfg InterfaceConfig) ([]netlink.Link, error) {
+	tc, err := readTunnels(dir)
+	if err != nil {
+		return nil, err
+	}
+	var created []netlink.Link
+	for i := range tc.Tunnels {
+		t := &tc.Tunnels[i]
+		if t.Type == "gre" && cfg.bridgeOf(t.Name) != "" {
+			return nil, fmt.Errorf("tunnel %s: gre tunnels carry IP packets and cannot be bridge members, use gretap", t.Name)
+		}
+		var dev netlink.Link
+		if t.Dev != "" {
+			if dev, err = netlink.LinkByName(t.Dev); err != nil {
+				log.Printf("tunnel %s: dev %s: %v", t.Name, t.Dev, err)
+				continue
+			}
+		}
+		want, err := t.link(dev)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %s: %v", t.Name, err)
+		}
+		if existing, err := netlink.LinkByName(t.Name); err == nil {
+			if !isTunnel(existing) {
+				return nil, fmt.Errorf("tunnel %s: a %s link of that name exists", t.Name, existing.Type())
+			}
+			if sameTunnel(existing, want) {
+				continue
+			}
+			log.Printf("tunnel %s: settings changed, re-creating", t.Name)
+			if err := netlink.LinkDel(existing); err != nil {
+				return nil, fmt.Errorf("tunnel %s: LinkDel: %v", t.Name, err)
+			}
+		}
+		if err := netlink.LinkAdd(want); err != nil {
+			return nil, fmt.Errorf("tunnel %s: LinkAdd(%s): %v", t.Name, want.Type(), err)
+		}
+		if err := netlink.LinkSetAlias(want, tunnelAlias); err != nil {
+			return nil, fmt.Errorf("tunnel %s: LinkSetAlias: %v", t.Name, err)
+		}
+		l, err := netlink.LinkByName(t.Name)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, l)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		if !isTunnel(l) || tc.tunnel(l.Attrs().Name) != nil {
+			continue
+		}
+		log.Printf("tunnel %s: no longer configured, removing", l.Attrs().Name)
+		if err := netlink.LinkDel(l); err != nil {
+			return nil, fmt.Errorf("tunnel %s: LinkDel: %v", l.Attrs().Name, err)
+		}
+	}
+	return created, nil
+}
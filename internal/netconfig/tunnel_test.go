@@ -0,0 +1,151 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func tunnelLinks(t *testing.T) []string {
+	t.Helper()
+	links, err := netlink.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range links {
+		if isTunnel(l) {
+			names = append(names, l.Type()+" "+l.Attrs().Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestTunnels reconciles tunnels over a veth link in a new network namespace.
+func TestTunnels(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "wg0", MTU: 1420}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	for _, l := range []netlink.Link{
+		&netlink.Gretun{LinkAttrs: netlink.LinkAttrs{Name: "probe0"}, Local: []byte{10, 0, 0, 1}, Remote: []byte{10, 0, 0, 2}},
+		&netlink.Gretap{LinkAttrs: netlink.LinkAttrs{Name: "probe1"}, Local: []byte{10, 0, 0, 1}, Remote: []byte{10, 0, 0, 2}},
+		&netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "probe2"}, VxlanId: 1, Port: 4789},
+	} {
+		if err := netlink.LinkAdd(l); err != nil {
+			t.Skipf("LinkAdd(%s): %v", l.Type(), err)
+		}
+		if err := netlink.LinkDel(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	writeTunnels := func(cfg string) {
+		t.Helper()
+		if err := ioutil.WriteFile(filepath.Join(tmp, "tunnels.json"), []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTunnels(`{"tunnels": [
+  {"name": "gre0", "type": "gre", "local": "10.0.137.1", "remote": "10.0.137.2", "key": 42},
+  {"name": "gretap0", "type": "gretap", "local": "10.0.137.1", "remote": "10.0.137.2", "dev": "wg0"},
+  {"name": "vx0", "type": "vxlan", "vni": 100, "local": "10.0.137.1", "remote": "10.0.137.2", "dev": "wg0"},
+  {"name": "vx1", "type": "vxlan", "vni": 101, "local": "10.0.137.1", "remote": "10.0.137.3", "dev": "wg1"}
+]}`)
+	cfg := InterfaceConfig{
+		Bridges: []BridgeDetails{{Name: "lan0", Members: []string{"gretap0", "vx0"}}},
+	}
+	created, err := createTunnels(tmp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(created), 3; got != want {
+		t.Fatalf("createTunnels created %d links, want %d", got, want)
+	}
+	want := []string{"gre gre0", "gretap gretap0", "vxlan vx0"}
+	if diff := cmp.Diff(want, tunnelLinks(t)); diff != "" {
+		t.Fatalf("tunnels: diff (-want +got):\n%s", diff)
+	}
+	vx, err := netlink.LinkByName("vx0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := vx.Attrs().MTU, 1420-tunnelOverhead["vxlan"]; got != want {
+		t.Errorf("vx0 MTU = %d, want %d", got, want)
+	}
+	if got, want := vx.(*netlink.Vxlan).Port, 4789; got != want {
+		t.Errorf("vx0 port = %d, want %d", got, want)
+	}
+
+	// A second run must not re-create unchanged tunnels.
+	created, err = createTunnels(tmp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(created), 0; got != want {
+		t.Fatalf("createTunnels re-created %d links, want %d", got, want)
+	}
+
+	// Changing the key re-creates gre0, removing vx0 deletes it.
+	writeTunnels(`{"tunnels": [
+  {"name": "gre0", "type": "gre", "local": "10.0.137.1", "remote": "10.0.137.2", "key": 43},
+  {"name": "gretap0", "type": "gretap", "local": "10.0.137.1", "remote": "10.0.137.2", "dev": "wg0"}
+]}`)
+	created, err = createTunnels(tmp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(created), 1; got != want || created[0].Attrs().Name != "gre0" {
+		t.Fatalf("createTunnels created %d links, want %d (gre0)", got, want)
+	}
+	want = []string{"gre gre0", "gretap gretap0"}
+	if diff := cmp.Diff(want, tunnelLinks(t)); diff != "" {
+		t.Fatalf("tunnels: diff (-want +got):\n%s", diff)
+	}
+
+	// gre tunnels carry IP packets and cannot be bridged.
+	cfg.Bridges[0].Members = append(cfg.Bridges[0].Members, "gre0")
+	if _, err := createTunnels(tmp, cfg); err == nil {
+		t.Errorf("createTunnels unexpectedly accepted gre0 as bridge member")
+	}
+
+	// Links which were not created by netconfig are never touched.
+	if err := netlink.LinkSetAlias(veth, ""); err != nil {
+		t.Fatal(err)
+	}
+	writeTunnels(`{"tunnels": [{"name": "wg0", "type": "gre", "local": "10.0.137.1", "remote": "10.0.137.2"}]}`)
+	if _, err := createTunnels(tmp, InterfaceConfig{}); err == nil {
+		t.Errorf("createTunnels unexpectedly replaced link wg0")
+	}
+}
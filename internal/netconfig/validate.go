@@ -0,0 +1,312 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtr7/router7/internal/dhcp4"
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/pppoe"
+)
+
+// decodeFile decodes the JSON file fn in dir into v. Unknown fields are
+// rejected if strict is set, so that typos in hand-written configuration do
+// not go unnoticed. It reports whether the file exists.
+func decodeFile(dir, fn string, v interface{}, strict bool) (bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// validator collects the problems of the configuration files.
+type validator struct {
+	dir      string
+	problems []error
+}
+
+func (v *validator) errorf(fn, format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Errorf("%s: %s", fn, fmt.Sprintf(format, args...)))
+}
+
+// decode decodes fn (see decodeFile), recording a problem if that fails.
+func (v *validator) decode(fn string, dst interface{}, strict bool) bool {
+	exists, err := decodeFile(v.dir, fn, dst, strict)
+	if err != nil {
+		v.errorf(fn, "%v", err)
+		return false
+	}
+	return exists
+}
+
+func (v *validator) mac(fn, what, s string) {
+	if s == "" {
+		return
+	}
+	if _, err := net.ParseMAC(s); err != nil {
+		v.errorf(fn, "%s: %v", what, err)
+	}
+}
+
+func (v *validator) cidr(fn, what, s string) {
+	if _, _, err := net.ParseCIDR(s); err != nil {
+		v.errorf(fn, "%s: %v", what, err)
+	}
+}
+
+func (v *validator) ip(fn, what, s string) {
+	if net.ParseIP(s) == nil {
+		v.errorf(fn, "%s: invalid IP address %q", what, s)
+	}
+}
+
+// Validate parses the configuration in dir (interfaces.json, the firewall,
+// port forwarding, routing, tunnel and WireGuard configuration, and the
+// leases of the uplink daemons) and cross-checks the references between the
+// files, without touching the kernel. Unknown fields in hand-written files
+// are reported, as they usually are typos. Validate returns all problems it
+// found.
+func Validate(dir string) []error {
+	v := &validator{dir: dir}
+
+	// names are the interfaces which the configuration can refer to.
+	names := map[string]bool{"ppp0": true}
+	for _, backup := range BackupUplinks {
+		names[backup] = true
+	}
+
+	const ifn = "interfaces.json"
+	var cfg InterfaceConfig
+	v.decode(ifn, &cfg, true)
+	for _, b := range cfg.Bridges {
+		if b.Name == "" {
+			v.errorf(ifn, "bridge without name")
+		}
+		names[b.Name] = true
+	}
+	for _, virt := range cfg.Virtual {
+		names[virt.Name] = true
+	}
+	members := make(map[string]string)
+	for _, b := range cfg.Bridges {
+		for _, m := range b.Members {
+			if other, ok := members[m]; ok {
+				v.errorf(ifn, "%s is a member of bridges %s and %s", m, other, b.Name)
+			}
+			members[m] = b.Name
+		}
+	}
+	seen := make(map[string]bool)
+	for idx, details := range cfg.Interfaces {
+		what := details.Name
+		if what == "" {
+			what = fmt.Sprintf("interfaces[%d]", idx)
+			if details.HardwareAddr == "" && details.Path == "" && details.Driver == "" {
+				v.errorf(ifn, "%s: neither name, hardware_addr, path nor driver set", what)
+			}
+		} else if seen[what] {
+			v.errorf(ifn, "%s: configured more than once", what)
+		}
+		seen[details.Name] = true
+		names[details.Name] = true
+		v.mac(ifn, what+": hardware_addr", details.HardwareAddr)
+		v.mac(ifn, what+": spoof_hardware_addr", details.SpoofHardwareAddr)
+		if details.Addr != "" {
+			v.cidr(ifn, what+": addr", details.Addr)
+		}
+		if details.MTU != 0 && (details.MTU < 68 || details.MTU > 65535) {
+			v.errorf(ifn, "%s: mtu %d out of range [68, 65535]", what, details.MTU)
+		}
+		if ls := details.Link; ls != nil && ls.Duplex != "" && ls.Duplex != "full" && ls.Duplex != "half" {
+			v.errorf(ifn, "%s: invalid duplex %q: expected full or half", what, ls.Duplex)
+		}
+		for offload := range details.Offloads {
+			switch offload {
+			case "gro", "gso", "tso", "lro":
+			default:
+				v.errorf(ifn, "%s: unknown offload %q, expected gro, gso, tso or lro", what, offload)
+			}
+		}
+		if d := details.DHCP4; d != nil {
+			if d.SubnetSelection != "" {
+				v.ip(ifn, what+": dhcp4: subnet_selection", d.SubnetSelection)
+			}
+			if d.RequestedAddress != "" {
+				v.ip(ifn, what+": dhcp4: requested_address", d.RequestedAddress)
+			}
+			if d.VLAN != nil && (d.VLAN.ID > 4094 || d.VLAN.Priority > 7) {
+				v.errorf(ifn, "%s: dhcp4: vlan %d priority %d out of range", what, d.VLAN.ID, d.VLAN.Priority)
+			}
+		}
+	}
+	if _, err := IPv6Subnets(dir); err != nil {
+		v.problems = append(v.problems, err)
+	}
+
+	const tfn = "tunnels.json"
+	var tc TunnelConfig
+	v.decode(tfn, &tc, true)
+	for _, t := range tc.Tunnels {
+		names[t.Name] = true
+	}
+
+	const wfn = "wireguard.json"
+	var wg wireguardInterfaces
+	v.decode(wfn, &wg, true)
+	for _, iface := range wg.Interfaces {
+		names[iface.Name] = true
+		if _, err := iface.privateKey(dir); err != nil {
+			v.errorf(wfn, "%s: %v", iface.Name, err)
+		}
+		for _, p := range iface.Peers {
+			if b, err := base64.StdEncoding.DecodeString(p.PublicKey); err != nil || len(b) != 32 {
+				v.errorf(wfn, "%s: peer %q: invalid public key", iface.Name, p.PublicKey)
+			}
+			if p.Endpoint != "" {
+				if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+					v.errorf(wfn, "%s: peer %q: endpoint: %v", iface.Name, p.PublicKey, err)
+				}
+			}
+			for _, ip := range p.AllowedIPs {
+				v.cidr(wfn, iface.Name+": peer "+p.PublicKey+": allowed_ips", ip)
+			}
+		}
+	}
+
+	// References between the files can only be checked once all names are
+	// known.
+	for _, virt := range cfg.Virtual {
+		if !names[virt.Parent] {
+			v.errorf(ifn, "virtual %s: parent %q is not configured", virt.Name, virt.Parent)
+		}
+		v.mac(ifn, "virtual "+virt.Name+": hardware_addr", virt.HardwareAddr)
+	}
+	for _, t := range tc.Tunnels {
+		if _, err := t.link(nil); err != nil {
+			v.errorf(tfn, "%s: %v", t.Name, err)
+		}
+		if t.Dev != "" && !names[t.Dev] {
+			v.errorf(tfn, "%s: dev %q is not configured", t.Name, t.Dev)
+		}
+		if t.Type == "gre" && cfg.bridgeOf(t.Name) != "" {
+			v.errorf(tfn, "%s: gre tunnels cannot be bridge members, use gretap", t.Name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "sites.json")); err == nil {
+		if sites, err := ReadSites(dir); err != nil {
+			v.problems = append(v.problems, err)
+		} else if !names[sites.Interface] {
+			v.errorf("sites.json", "interface %s not configured in wireguard.json", sites.Interface)
+		}
+	}
+
+	const pfn = "portforwardings.json"
+	var pf portForwardings
+	v.decode(pfn, &pf, true)
+	for _, fw := range pf.Forwardings {
+		what := "port " + fw.Port
+		for _, proto := range strings.Split(fw.Proto, ",") {
+			if _, err := parseProto(proto); err != nil {
+				v.errorf(pfn, "%s: %v", what, err)
+			}
+		}
+		if _, _, err := parsePort(fw.Port); err != nil {
+			v.errorf(pfn, "%s: %v", what, err)
+		}
+		if _, _, err := parsePort(fw.DestPort); err != nil {
+			v.errorf(pfn, "%s: dest_port: %v", what, err)
+		}
+		v.ip(pfn, what+": dest_addr", fw.DestAddr)
+	}
+
+	const rfn = "routes.json"
+	var rc RoutesConfig
+	v.decode(rfn, &rc, true)
+	for _, sr := range rc.Routes {
+		what := sr.Destination
+		v.cidr(rfn, what+": destination", sr.Destination)
+		if sr.Gateway != "" {
+			v.ip(rfn, what+": gateway", sr.Gateway)
+		}
+		if sr.Interface != "" && !names[sr.Interface] {
+			v.errorf(rfn, "%s: interface %q is not configured", what, sr.Interface)
+		}
+	}
+	for idx, sr := range rc.Rules {
+		if _, err := staticRule(sr, idx); err != nil {
+			v.errorf(rfn, "rule %d: %v", idx, err)
+		}
+	}
+
+	var routing RoutingConfig
+	if v.decode("routing.json", &routing, true) {
+		if _, err := readRoutingConfig(dir); err != nil {
+			v.errorf("routing.json", "%v", err)
+		}
+	}
+
+	if v.decode("qos.json", &QoSConfig{}, true) {
+		if _, err := readQoSConfig(dir); err != nil {
+			v.errorf("qos.json", "%v", err)
+		}
+	}
+
+	const ffn = "firewall.json"
+	var fc FirewallConfig
+	v.decode(ffn, &fc, true)
+
+	const bfn = "bindings.json"
+	var bc bindingsConfig
+	v.decode(bfn, &bc, true)
+	for _, b := range bc.Bindings {
+		v.mac(bfn, b.Addr+": hardware_addr", b.HardwareAddr)
+		v.ip(bfn, b.HardwareAddr+": addr", b.Addr)
+	}
+
+	var flags map[string]FeatureFlag
+	v.decode("features.json", &flags, true)
+
+	// Leases are written by the uplink daemons, but might have been copied
+	// from a backup or edited by hand.
+	var l4 dhcp4.Config
+	v.decode("dhcp4/wire/lease.json", &l4, false)
+	var l6 dhcp6.Config
+	v.decode("dhcp6/wire/lease.json", &l6, false)
+	var lp pppoe.Lease
+	v.decode("pppoe/wire/lease.json", &lp, false)
+
+	return v.problems
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeConfig(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for fn, content := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(fn)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	writeConfig(t, tmp, map[string]string{
+		"interfaces.json": `{
+  "interfaces": [
+    {"hardware_addr": "02:73:53:00:ca:fe", "name": "uplink0"},
+    {"hardware_addr": "02:73:53:00:b0:0c", "spoof_hardware_addr": "02:73:53:00:b0:aa", "name": "lan0", "addr": "192.168.42.1/24"},
+    {"name": "wg0", "addr": "10.0.137.1/24"}
+  ],
+  "virtual": [{"name": "dns0", "parent": "lan0"}]
+}`,
+		"wireguard.json": `{"interfaces": [{
+  "name": "wg0",
+  "private_key": "gBCV3afBKfW7RycmeZFMpJykvO+58KfSEIyavay90kE=",
+  "port": 51820,
+  "peers": [{"public_key": "ScxV5nQsUIaaOp3qdwPqRcgMkR3oR6nyi1tBLUovqBs=", "endpoint": "[::1]:12345", "allowed_ips": ["10.0.137.0/24"]}]
+}]}`,
+		"tunnels.json": `{"tunnels": [{"name": "gretap0", "type": "gretap", "local": "10.0.137.1", "remote": "10.0.137.2", "dev": "wg0"}]}`,
+		"portforwardings.json": `{"forwardings": [
+  {"port": "8080", "dest_addr": "192.168.42.23", "dest_port": "9999"},
+  {"proto": "tcp,udp", "port": "8040-8060", "dest_addr": "192.168.42.99", "dest_port": "8040-8060"}
+]}`,
+		"routes.json":           `{"routes": [{"destination": "10.23.0.0/16", "gateway": "192.168.42.2", "interface": "lan0"}]}`,
+		"dhcp6/wire/lease.json": `{"prefixes": [{"IP": "2a02:168:4a00::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`,
+	})
+	if problems := Validate(tmp); len(problems) > 0 {
+		t.Fatalf("Validate(valid configuration) = %v", problems)
+	}
+
+	writeConfig(t, tmp, map[string]string{
+		"interfaces.json": `{
+  "interfaces": [
+    {"hardware_addr": "02:73:53:00:ca:fe", "name": "uplink0"},
+    {"hardware_addr": "02:73:53:00:b0:0c", "name": "lan0", "adr": "192.168.42.1/24"}
+  ]
+}`,
+	})
+	problems := Validate(tmp)
+	if len(problems) != 1 {
+		t.Fatalf("Validate(unknown field) = %v, want exactly one problem", problems)
+	}
+
+	writeConfig(t, tmp, map[string]string{
+		"interfaces.json": `{
+  "interfaces": [
+    {"hardware_addr": "02:73:53:00:ca:fe", "name": "uplink0"},
+    {"hardware_addr": "02:73:53:00:b0:0c:ff:ff:ff", "name": "lan0", "addr": "192.168.42.1"},
+    {"name": "lan0", "mtu": 20}
+  ],
+  "virtual": [{"name": "dns0", "parent": "lan1"}]
+}`,
+		"portforwardings.json": `{"forwardings": [{"proto": "sctp", "port": "80", "dest_addr": "192.168.42.300", "dest_port": "80"}]}`,
+		"routes.json":          `{"routes": [{"destination": "10.23.0.0/16", "interface": "lan9"}]}`,
+	})
+	var got []string
+	for _, p := range Validate(tmp) {
+		got = append(got, p.Error())
+	}
+	want := []string{
+		`interfaces.json: lan0: hardware_addr: address 02:73:53:00:b0:0c:ff:ff:ff: invalid MAC address`,
+		`interfaces.json: lan0: addr: invalid CIDR address: 192.168.42.1`,
+		`interfaces.json: lan0: configured more than once`,
+		`interfaces.json: lan0: mtu 20 out of range [68, 65535]`,
+		`interfaces.json: virtual dns0: parent "lan1" is not configured`,
+		`portforwardings.json: port 80: unknown proto "sctp", expected "tcp" or "udp"`,
+		`portforwardings.json: port 80: dest_addr: invalid IP address "192.168.42.300"`,
+		`routes.json: 10.23.0.0/16: interface "lan9" is not configured`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Validate: diff (-want +got):\n%s", diff)
+	}
+}
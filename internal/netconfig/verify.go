@@ -0,0 +1,341 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// VerifyFirewall compares the live nftables ruleset against the ruleset
+// generated from the configuration in dir and returns a description of each
+// difference (e.g. caused by other tools modifying the ruleset). An empty
+// result means no drift was detected.
+func VerifyFirewall(dir string) ([]string, error) {
+	st, err := desiredState(dir)
+	if err != nil {
+		return nil, err
+	}
+	got, err := liveRuleset(&nftables.Conn{})
+	if err != nil {
+		return nil, err
+	}
+	return st.firewall.diff(got)
+}
+
+// desiredState returns the state for the configuration in dir, or the first
+// error encountered while building it.
+func desiredState(dir string) (*state, error) {
+	ifname, err := uplinkInterface()
+	if err != nil {
+		return nil, err
+	}
+	var first error
+	st := buildState(dir, ifname, func(o *nftables.CounterObj) *nftables.CounterObj {
+		return o
+	}, func(err error) {
+		if first == nil {
+			first = err
+		}
+	})
+	return st, first
+}
+
+// liveRuleset returns the tables, chains and rules currently installed in the
+// kernel.
+func liveRuleset(c *nftables.Conn) (*ruleset, error) {
+	var r ruleset
+	tables, err := c.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	r.tables = tables
+	chains, err := c.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	r.chains = chains
+	for _, ch := range chains {
+		rules, err := c.GetRule(ch.Table, ch)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			rule.Chain = ch // GetRule only sets the chain name
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return &r, nil
+}
+
+func tableKey(t *nftables.Table) string {
+	return familyName(t.Family) + " " + t.Name
+}
+
+func chainKey(ch *nftables.Chain) string {
+	return tableKey(ch.Table) + " " + ch.Name
+}
+
+// decodable reports whether the nftables package can decode e when listing
+// rules. Other expressions are skipped by nftables.Conn.GetRule and hence
+// cannot be compared.
+func decodable(e expr.Any) bool {
+	if meta, ok := e.(*expr.Meta); ok && (meta.SourceRegister || meta.Register == 0) {
+		// Setting meta keys (e.g. the packet mark) is decoded without the
+		// source register, i.e. as a load into the verdict register.
+		return false
+	}
+	switch e.(type) {
+	case *expr.Meta, *expr.Cmp, *expr.Counter, *expr.Payload, *expr.Lookup,
+		*expr.Immediate, *expr.Bitwise, *expr.Redir, *expr.NAT, *expr.Limit,
+		*expr.Dynset, *expr.Verdict:
+		return true
+	}
+	return false
+}
+
+// fingerprint returns a string representation of the comparable expressions
+// of rule.
+func fingerprint(rule *nftables.Rule) (string, error) {
+	var parts []string
+	for _, e := range rule.Exprs {
+		if !decodable(e) {
+			continue
+		}
+		if nat, ok := e.(*expr.NAT); ok {
+			// The kernel reports unset maximum registers as equal to the
+			// minimum registers.
+			norm := *nat
+			if norm.RegAddrMax == 0 {
+				norm.RegAddrMax = norm.RegAddrMin
+			}
+			if norm.RegProtoMax == 0 {
+				norm.RegProtoMax = norm.RegProtoMin
+			}
+			e = &norm
+		}
+		if lookup, ok := e.(*expr.Lookup); ok {
+			// Sets are referenced by name; the ID is only valid within the
+			// batch which created the set.
+			norm := *lookup
+			norm.SetID = 0
+			e = &norm
+		}
+		b, err := expr.Marshal(e)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%x", b))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func (r *ruleset) fingerprints() (map[string][]string, error) {
+	fps := make(map[string][]string)
+	for _, rule := range r.rules {
+		fp, err := fingerprint(rule)
+		if err != nil {
+			return nil, err
+		}
+		key := chainKey(rule.Chain)
+		fps[key] = append(fps[key], fp)
+	}
+	return fps, nil
+}
+
+// diff returns the differences between the desired ruleset r and the live
+// ruleset got.
+func (r *ruleset) diff(got *ruleset) ([]string, error) {
+	var diffs []string
+
+	wantTables := make(map[string]bool)
+	for _, t := range r.tables {
+		wantTables[tableKey(t)] = true
+	}
+	gotTables := make(map[string]bool)
+	for _, t := range got.tables {
+		key := tableKey(t)
+		gotTables[key] = true
+		if !wantTables[key] {
+			diffs = append(diffs, fmt.Sprintf("unexpected table %s", key))
+		}
+	}
+	for key := range wantTables {
+		if !gotTables[key] {
+			diffs = append(diffs, fmt.Sprintf("missing table %s", key))
+		}
+	}
+
+	wantChains := make(map[string]*nftables.Chain)
+	for _, ch := range r.chains {
+		wantChains[chainKey(ch)] = ch
+	}
+	gotChains := make(map[string]*nftables.Chain)
+	for _, ch := range got.chains {
+		key := chainKey(ch)
+		gotChains[key] = ch
+		want, ok := wantChains[key]
+		if !ok {
+			if wantTables[tableKey(ch.Table)] {
+				diffs = append(diffs, fmt.Sprintf("unexpected chain %s", key))
+			}
+			continue
+		}
+		if want.Type != ch.Type || want.Hooknum != ch.Hooknum || want.Priority != ch.Priority {
+			diffs = append(diffs, fmt.Sprintf("chain %s: got type %s hook %d priority %d, want type %s hook %d priority %d",
+				key, ch.Type, ch.Hooknum, ch.Priority, want.Type, want.Hooknum, want.Priority))
+		}
+	}
+	for key := range wantChains {
+		if _, ok := gotChains[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("missing chain %s", key))
+		}
+	}
+
+	wantRules, err := r.fingerprints()
+	if err != nil {
+		return nil, err
+	}
+	gotRules, err := got.fingerprints()
+	if err != nil {
+		return nil, err
+	}
+	for key, want := range wantRules {
+		if _, ok := gotChains[key]; !ok {
+			continue // already reported as missing chain
+		}
+		got := gotRules[key]
+		if len(got) != len(want) {
+			diffs = append(diffs, fmt.Sprintf("chain %s: got %d rules, want %d", key, len(got), len(want)))
+			continue
+		}
+		for idx := range want {
+			if got[idx] != want[idx] {
+				diffs = append(diffs, fmt.Sprintf("chain %s: rule %d differs", key, idx))
+			}
+		}
+	}
+	for key, got := range gotRules {
+		if _, ok := wantRules[key]; !ok && wantChains[key] != nil {
+			diffs = append(diffs, fmt.Sprintf("chain %s: got %d rules, want 0", key, len(got)))
+		}
+	}
+
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+func sameRoute(a, b *netlink.Route) bool {
+	dst := func(r *netlink.Route) string {
+		if r.Dst == nil {
+			return "0.0.0.0/0"
+		}
+		return r.Dst.String()
+	}
+	table := func(r *netlink.Route) int {
+		if r.Table == unix.RT_TABLE_UNSPEC {
+			return unix.RT_TABLE_MAIN
+		}
+		return r.Table
+	}
+	return dst(a) == dst(b) &&
+		table(a) == table(b) &&
+		a.Gw.Equal(b.Gw) &&
+		a.Priority == b.Priority
+}
+
+// VerifyRoutes compares the addresses and routes of all links against those
+// configured from dir and returns a description of each missing entry (e.g.
+// removed by the kernel after a link flap). An empty result means no drift
+// was detected.
+func VerifyRoutes(dir string) ([]string, error) {
+	st, err := desiredState(dir)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []string
+	for _, st := range st.links {
+		link, err := netlink.LinkByName(st.ifname)
+		if err != nil {
+			continue // link not present (yet)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for _, want := range st.addrs {
+			var found bool
+			for _, got := range addrs {
+				if got.IPNet.String() == want.IPNet.String() {
+					found = true
+					break
+				}
+			}
+			if !found {
+				diffs = append(diffs, fmt.Sprintf("missing address %s on %s", want.IPNet, st.ifname))
+			}
+		}
+		if len(st.routes) == 0 {
+			continue
+		}
+		// List the routes of all tables, e.g. interceptTable.
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+		}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, err
+		}
+		for _, want := range st.routes {
+			var found bool
+			for idx := range routes {
+				if sameRoute(&routes[idx], want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				diffs = append(diffs, fmt.Sprintf("missing route %s via %v metric %d on %s", want.Dst, want.Gw, want.Priority, st.ifname))
+			}
+		}
+	}
+	if len(st.routes) > 0 {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+			Protocol: rtprotStatic,
+		}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, err
+		}
+		for _, want := range st.routes {
+			var found bool
+			for idx := range routes {
+				if sameStaticRoute(&routes[idx], want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				diffs = append(diffs, fmt.Sprintf("missing static route %s via %v metric %d", want.Dst, want.Gw, want.Priority))
+			}
+		}
+	}
+	sort.Strings(diffs)
+	return diffs, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestDiff(t *testing.T) {
+	build := func(drop bool, natMax uint32) *ruleset {
+		var rs ruleset
+		nat := rs.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "nat"})
+		prerouting := rs.AddChain(&nftables.Chain{
+			Name:     "prerouting",
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityFilter,
+			Table:    nat,
+			Type:     nftables.ChainTypeNAT,
+		})
+		exprs := portForwardExpr("uplink0", unix.IPPROTO_TCP, 8080, 8080, net.ParseIP("192.168.42.23"), 80, 80)
+		exprs[len(exprs)-1].(*expr.NAT).RegProtoMax = natMax
+		rs.AddRule(&nftables.Rule{Table: nat, Chain: prerouting, Exprs: exprs})
+		if drop {
+			rs.AddRule(&nftables.Rule{
+				Table: nat,
+				Chain: prerouting,
+				Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+			})
+		}
+		return &rs
+	}
+
+	want := build(false, 0)
+	for _, tt := range []struct {
+		name string
+		got  *ruleset
+		want []string
+	}{
+		{"Identical", build(false, 2), nil},
+		{"AdditionalRule", build(true, 2), []string{"chain ip nat prerouting: got 2 rules, want 1"}},
+		{"ModifiedRule", build(false, 3), []string{"chain ip nat prerouting: rule 0 differs"}},
+		{"MissingTable", &ruleset{}, []string{"missing chain ip nat prerouting", "missing table ip nat"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, err := want.diff(tt.got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := cmp.Diff(tt.want, diffs); d != "" {
+				t.Errorf("unexpected diff: (-want +got)\n%s", d)
+			}
+		})
+	}
+}
+
+func TestSameRoute(t *testing.T) {
+	want := &netlink.Route{
+		Dst: &net.IPNet{
+			IP:   net.ParseIP("0.0.0.0"),
+			Mask: net.CIDRMask(0, 32),
+		},
+		Gw:       net.ParseIP("85.195.207.1"),
+		Priority: 100,
+	}
+	// The kernel reports the default route without destination.
+	got := netlink.Route{Gw: net.ParseIP("85.195.207.1").To4(), Priority: 100}
+	if !sameRoute(&got, want) {
+		t.Errorf("sameRoute(%v, %v) = false, want true", got, want)
+	}
+	got.Priority = 0
+	if sameRoute(&got, want) {
+		t.Errorf("sameRoute(%v, %v) = true, want false", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// VirtualDetails declare a macvlan or ipvlan child interface of a network
+// card, e.g. to give a service (DNS blocker, monitoring agent) its own MAC
+// and/or IP address on the LAN. The address of the child interface is
+// configured like that of a network card, by an entry in interfaces with the
+// same name.
+type VirtualDetails struct {
+	Name   string `json:"name"`   // e.g. dns0
+	Type   string `json:"type"`   // macvlan (default) or ipvlan
+	Parent string `json:"parent"` // e.g. lan0
+
+	// Mode is the macvlan mode (bridge (default), private, vepa or
+	// passthru) or the ipvlan mode (l2 (default), l3 or l3s). In macvlan
+	// bridge mode, the child can communicate with other children, but
+	// never with the parent itself.
+	Mode string `json:"mode,omitempty"`
+
+	// HardwareAddr is the MAC address of a macvlan child (default: random
+	// on every creation), e.g. so that DHCP reservations on the LAN apply.
+	// ipvlan children share the MAC address of their parent.
+	HardwareAddr string `json:"hardware_addr,omitempty"`
+}
+
+// virtualAlias marks links created by netconfig, so that only those are
+// removed when they are no longer configured.
+const virtualAlias = "router7 virtual"
+
+// virtual returns the VirtualDetails of ifname, or nil if ifname is not a
+// virtual child interface.
+func (cfg InterfaceConfig) virtual(ifname string) *VirtualDetails {
+	for i, v := range cfg.Virtual {
+		if v.Name == ifname {
+			return &cfg.Virtual[i]
+		}
+	}
+	return nil
+}
+
+var (
+	macvlanModes = map[string]netlink.MacvlanMode{
+		"":         netlink.MACVLAN_MODE_BRIDGE,
+		"bridge":   netlink.MACVLAN_MODE_BRIDGE,
+		"private":  netlink.MACVLAN_MODE_PRIVATE,
+		"vepa":     netlink.MACVLAN_MODE_VEPA,
+		"passthru": netlink.MACVLAN_MODE_PASSTHRU,
+	}
+	ipvlanModes = map[string]netlink.IPVlanMode{
+		"":    netlink.IPVLAN_MODE_L2,
+		"l2":  netlink.IPVLAN_MODE_L2,
+		"l3":  netlink.IPVLAN_MODE_L3,
+		"l3s": netlink.IPVLAN_MODE_L3S,
+	}
+)
+
+// link returns the link to create for v as child of the link with index
+// parent.
+func (v *VirtualDetails) link(parent int) (netlink.Link, error) {
+	attrs := netlink.LinkAttrs{
+		Name:        v.Name,
+		ParentIndex: parent,
+	}
+	switch v.Type {
+	case "", "macvlan":
+		mode, ok := macvlanModes[v.Mode]
+		if !ok {
+			return nil, fmt.Errorf("unsupported macvlan mode %q", v.Mode)
+		}
+		if v.HardwareAddr != "" {
+			hwaddr, err := net.ParseMAC(v.HardwareAddr)
+			if err != nil {
+				return nil, err
+			}
+			attrs.HardwareAddr = hwaddr
+		}
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: mode}, nil
+
+	case "ipvlan":
+		mode, ok := ipvlanModes[v.Mode]
+		if !ok {
+			return nil, fmt.Errorf("unsupported ipvlan mode %q", v.Mode)
+		}
+		if v.HardwareAddr != "" {
+			return nil, fmt.Errorf("ipvlan children use the hardware address of their parent, hardware_addr must not be set")
+		}
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: mode}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q, expected macvlan or ipvlan", v.Type)
+}
+
+// sameVirtual reports whether the existing link matches the desired link,
+// i.e. need not be re-created.
+func sameVirtual(existing, want netlink.Link) bool {
+	if existing.Type() != want.Type() || existing.Attrs().ParentIndex != want.Attrs().ParentIndex {
+		return false
+	}
+	if hwaddr := want.Attrs().HardwareAddr; hwaddr != nil && !bytes.Equal(existing.Attrs().HardwareAddr, hwaddr) {
+		return false
+	}
+	switch w := want.(type) {
+	case *netlink.Macvlan:
+		return existing.(*netlink.Macvlan).Mode == w.Mode
+	case *netlink.IPVlan:
+		return existing.(*netlink.IPVlan).Mode == w.Mode
+	}
+	return false
+}
+
+func isVirtual(l netlink.Link) bool {
+	switch l.(type) {
+	case *netlink.Macvlan, *netlink.IPVlan:
+		return l.Attrs().Alias == virtualAlias
+	}
+	return false
+}
+
+// createVirtualLinks reconciles the virtual child interfaces of cfg: missing
+// children are created, children whose settings changed are re-created and
+// children which are no longer configured are removed. Children whose parent
+// is not present (yet) are skipped. The returned links were created and need
+// to be configured.
+func createVirtualLinks(cfg InterfaceConfig) ([]netlink.Link, error) {
+	var created []netlink.Link
+	for i := range cfg.Virtual {
+		v := &cfg.Virtual[i]
+		if cfg.bridgeOf(v.Name) != "" {
+			return nil, fmt.Errorf("virtual %s: must not be a bridge member", v.Name)
+		}
+		parent, err := netlink.LinkByName(v.Parent)
+		if err != nil {
+			log.Printf("virtual %s: parent %s: %v", v.Name, v.Parent, err)
+			continue
+		}
+		want, err := v.link(parent.Attrs().Index)
+		if err != nil {
+			return nil, fmt.Errorf("virtual %s: %v", v.Name, err)
+		}
+		if existing, err := netlink.LinkByName(v.Name); err == nil {
+			if !isVirtual(existing) {
+				return nil, fmt.Errorf("virtual %s: a %s link of that name exists", v.Name, existing.Type())
+			}
+			if sameVirtual(existing, want) {
+				continue
+			}
+			log.Printf("virtual %s: settings changed, re-creating", v.Name)
+			if err := netlink.LinkDel(existing); err != nil {
+				return nil, fmt.Errorf("virtual %s: LinkDel: %v", v.Name, err)
+			}
+		}
+		if err := netlink.LinkAdd(want); err != nil {
+			return nil, fmt.Errorf("virtual %s: LinkAdd(%s on %s): %v", v.Name, want.Type(), v.Parent, err)
+		}
+		if err := netlink.LinkSetAlias(want, virtualAlias); err != nil {
+			return nil, fmt.Errorf("virtual %s: LinkSetAlias: %v", v.Name, err)
+		}
+		l, err := netlink.LinkByName(v.Name)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, l)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		if !isVirtual(l) || cfg.virtual(l.Attrs().Name) != nil {
+			continue
+		}
+		log.Printf("virtual %s: no longer configured, removing", l.Attrs().Name)
+		if err := netlink.LinkDel(l); err != nil {
+			return nil, fmt.Errorf("virtual %s: LinkDel: %v", l.Attrs().Name, err)
+		}
+	}
+	return created, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func virtualLinks(t *testing.T) []string {
+	t.Helper()
+	links, err := netlink.LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range links {
+		if isVirtual(l) {
+			names = append(names, l.Type()+" "+l.Attrs().Name+" "+l.Attrs().HardwareAddr.String())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestVirtualLinks reconciles macvlan and ipvlan children of a veth link in a
+// new network namespace.
+func TestVirtualLinks(t *testing.T) {
+	runtime.LockOSThread() // the thread is terminated with the test goroutine
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lan0"}, PeerName: "veth1"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("LinkAdd(veth): %v", err)
+	}
+	for _, l := range []netlink.Link{
+		&netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Name: "probe0", ParentIndex: veth.Attrs().Index}},
+		&netlink.IPVlan{LinkAttrs: netlink.LinkAttrs{Name: "probe1", ParentIndex: veth.Attrs().Index}},
+	} {
+		if err := netlink.LinkAdd(l); err != nil {
+			t.Skipf("LinkAdd(%s): %v", l.Type(), err)
+		}
+		if err := netlink.LinkDel(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := InterfaceConfig{
+		Virtual: []VirtualDetails{
+			{Name: "dns0", Parent: "lan0", HardwareAddr: "02:00:00:00:53:01"},
+			{Name: "mon0", Type: "ipvlan", Parent: "lan0", Mode: "l3"},
+			{Name: "usb0", Parent: "usb-ethernet0"}, // parent not present
+		},
+	}
+	created, err := createVirtualLinks(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(created), 2; got != want {
+		t.Fatalf("createVirtualLinks created %d links, want %d", got, want)
+	}
+	parent, err := netlink.LinkByName("lan0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ipvlan mon0 " + parent.Attrs().HardwareAddr.String(), // shared
+		"macvlan dns0 02:00:00:00:53:01",
+	}
+	if diff := cmp.Diff(want, virtualLinks(t)); diff != "" {
+		t.Fatalf("virtual links: diff (-want +got):\n%s", diff)
+	}
+
+	// Unchanged children are kept, changed children are re-created.
+	cfg.Virtual[1].Mode = "l2"
+	created, err = createVirtualLinks(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0].Attrs().Name != "mon0" {
+		t.Fatalf("createVirtualLinks after mode change created %v, want mon0", created)
+	}
+	if got := created[0].(*netlink.IPVlan).Mode; got != netlink.IPVLAN_MODE_L2 {
+		t.Errorf("mon0 mode = %v, want l2", got)
+	}
+
+	// Children which are no longer configured are removed.
+	cfg.Virtual = cfg.Virtual[:1]
+	if _, err := createVirtualLinks(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want[1:], virtualLinks(t)); diff != "" {
+		t.Fatalf("virtual links after removal: diff (-want +got):\n%s", diff)
+	}
+
+	// Links which netconfig did not create are never replaced.
+	cfg.Virtual = append(cfg.Virtual, VirtualDetails{Name: "veth1", Parent: "lan0"})
+	if _, err := createVirtualLinks(cfg); err == nil {
+		t.Errorf("createVirtualLinks replaced veth1")
+	}
+}
@@ -22,9 +22,13 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"syscall"
+	"strings"
+	"time"
 
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -33,13 +37,23 @@ type wireguardPeer struct {
 	PublicKey  string   `json:"public_key"`  // base64-encoded
 	Endpoint   string   `json:"endpoint"`    // e.g. “[::1]:12345”
 	AllowedIPs []string `json:"allowed_ips"` // e.g. “["fe80::/64", "10.0.137.0/24"]”
+
+	// PersistentKeepalive is the interval in seconds of keepalive packets,
+	// e.g. to keep NAT mappings open (0 disables keepalives).
+	PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
 }
 
 type wireguardInterface struct {
-	Name       string          `json:"name"`        // e.g. “wg0”
-	PrivateKey string          `json:"private_key"` // base64-encoded
-	Port       int             `json:"port"`        // e.g. “51820”
-	Peers      []wireguardPeer `json:"peers"`
+	Name       string `json:"name"`        // e.g. “wg0”
+	PrivateKey string `json:"private_key"` // base64-encoded
+
+	// PrivateKeyFile refers to a file containing the base64-encoded private
+	// key instead (e.g. as written by “wg genkey”), relative to /perm, e.g.
+	// “wireguard/wg0.key”, so that wireguard.json can be shared.
+	PrivateKeyFile string `json:"private_key_file"`
+
+	Port  int             `json:"port"` // e.g. “51820”
+	Peers []wireguardPeer `json:"peers"`
 }
 
 type wireguardInterfaces struct {
@@ -60,18 +74,181 @@ func (w *wgLink) Attrs() *netlink.LinkAttrs {
 	return &attrs
 }
 
-func applyWireGuard(dir string) error {
+func readWireGuard(dir string) (wireguardInterfaces, error) {
+	var cfg wireguardInterfaces
 	b, err := ioutil.ReadFile(filepath.Join(dir, "wireguard.json"))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return cfg, nil
 		}
-		return err
+		return cfg, err
 	}
-	var cfg wireguardInterfaces
 	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	if err := mergeSites(dir, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// privateKey returns the private key of iface, reading PrivateKeyFile
+// relative to dir if set.
+func (iface *wireguardInterface) privateKey(dir string) (wgtypes.Key, error) {
+	encoded := iface.PrivateKey
+	if iface.PrivateKeyFile != "" {
+		if encoded != "" {
+			return wgtypes.Key{}, fmt.Errorf("%s: private_key and private_key_file are mutually exclusive", iface.Name)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, iface.PrivateKeyFile))
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		encoded = strings.TrimSpace(string(b))
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("%s: private key: %v", iface.Name, err)
+	}
+	return wgtypes.NewKey(b)
+}
+
+// WireGuardPublicKey returns the base64-encoded public key of the WireGuard
+// interface ifname of wireguard.json in dir, e.g. to configure this router as
+// peer of another one.
+func WireGuardPublicKey(dir, ifname string) (string, error) {
+	cfg, err := readWireGuard(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range cfg.Interfaces {
+		if iface.Name != ifname {
+			continue
+		}
+		key, err := iface.privateKey(dir)
+		if err != nil {
+			return "", err
+		}
+		return key.PublicKey().String(), nil
+	}
+	return "", fmt.Errorf("wireguard.json does not configure interface %q", ifname)
+}
+
+// allowedNets returns the allowed IPs of all peers of iface.
+func (iface *wireguardInterface) allowedNets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range iface.Peers {
+		for _, ip := range p.AllowedIPs {
+			_, ipnet, err := net.ParseCIDR(ip)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets, nil
+}
+
+// wireguardRoutes returns the routes via the link with index linkIndex to
+// the allowed IPs of the peers of iface, except for link-local networks and
+// networks within connected (the networks of the link’s addresses), which
+// the kernel routes already, and default routes, which would divert all
+// traffic into the tunnel (use routes.json for that).
+func wireguardRoutes(iface wireguardInterface, linkIndex int, connected []*net.IPNet) ([]*netlink.Route, error) {
+	nets, err := iface.allowedNets()
+	if err != nil {
+		return nil, err
+	}
+	var routes []*netlink.Route
+	seen := make(map[string]bool)
+nets:
+	for _, n := range nets {
+		if ones, _ := n.Mask.Size(); ones == 0 {
+			log.Printf("wireguard %s: not routing default route %v, use routes.json", iface.Name, n)
+			continue
+		}
+		if n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		for _, c := range connected {
+			cones, _ := c.Mask.Size()
+			if ones, _ := n.Mask.Size(); ones >= cones && c.Contains(n.IP) {
+				continue nets
+			}
+		}
+		if seen[n.String()] {
+			continue
+		}
+		seen[n.String()] = true
+		r := &netlink.Route{
+			LinkIndex: linkIndex,
+			Dst:       n,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  rtprotWireGuard,
+		}
+		if n.IP.To4() == nil {
+			r.Priority = defaultIPv6Metric
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+// applyWireGuardRoutes installs routes and removes routes of protocol
+// rtprotWireGuard which are no longer desired, e.g. after removing a peer.
+func applyWireGuardRoutes(h *netlink.Handle, desired []*netlink.Route) error {
+	existing, err := h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{
+		Protocol: rtprotWireGuard,
+	}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("RouteList: %v", err)
+	}
+	var stale []*netlink.Route
+	for idx := range existing {
+		r := &existing[idx]
+		var want bool
+		for _, d := range desired {
+			if sameStaticRoute(r, d) {
+				want = true
+				break
+			}
+		}
+		if !want {
+			stale = append(stale, r)
+		}
+	}
+	errs := batchRoutes(unix.RTM_DELROUTE, stale)
+	var missing []*netlink.Route
+	for _, d := range desired {
+		var installed bool
+		for idx := range existing {
+			if sameStaticRoute(&existing[idx], d) {
+				installed = true
+				break
+			}
+		}
+		if !installed {
+			missing = append(missing, d)
+		}
+	}
+	errs = append(errs, batchRoutes(unix.RTM_NEWROUTE, missing)...)
+	return joinErrors(errs)
+}
+
+func applyWireGuard(dir string) error {
+	cfg, err := readWireGuard(dir)
+	if err != nil {
 		return err
 	}
+	if len(cfg.Interfaces) == 0 {
+		// Remove the routes of a previous configuration, if any.
+		h, err := netlink.NewHandle()
+		if err != nil {
+			return fmt.Errorf("netlink.NewHandle: %v", err)
+		}
+		defer h.Delete()
+		return applyWireGuardRoutes(h, nil)
+	}
 
 	h, err := netlink.NewHandle()
 	if err != nil {
@@ -85,12 +262,20 @@ func applyWireGuard(dir string) error {
 	}
 	defer cl.Close()
 
+	var routes []*netlink.Route
 	for _, iface := range cfg.Interfaces {
 		l := &wgLink{iface.Name}
-		if err := h.LinkAdd(l); err != nil {
-			if ee, ok := err.(syscall.Errno); !ok || ee != syscall.EEXIST {
+		link, err := h.LinkByName(iface.Name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); !ok {
+				return err
+			}
+			if err := h.LinkAdd(l); err != nil {
 				return fmt.Errorf("LinkAdd(%v): %v", l, err)
 			}
+			if link, err = h.LinkByName(iface.Name); err != nil {
+				return err
+			}
 		}
 
 		var peers []wgtypes.PeerConfig
@@ -119,18 +304,20 @@ func applyWireGuard(dir string) error {
 					return err
 				}
 			}
+			var keepalive *time.Duration
+			if p.PersistentKeepalive > 0 {
+				d := time.Duration(p.PersistentKeepalive) * time.Second
+				keepalive = &d
+			}
 			peers = append(peers, wgtypes.PeerConfig{
-				PublicKey:         publicKey,
-				Endpoint:          addr,
-				ReplaceAllowedIPs: true, // replace instead of appending
-				AllowedIPs:        ips,
+				PublicKey:                   publicKey,
+				Endpoint:                    addr,
+				PersistentKeepaliveInterval: keepalive,
+				ReplaceAllowedIPs:           true, // replace instead of appending
+				AllowedIPs:                  ips,
 			})
 		}
-		b, err := base64.StdEncoding.DecodeString(iface.PrivateKey)
-		if err != nil {
-			return err
-		}
-		privateKey, err := wgtypes.NewKey(b)
+		privateKey, err := iface.privateKey(dir)
 		if err != nil {
 			return err
 		}
@@ -144,7 +331,79 @@ func applyWireGuard(dir string) error {
 		if err != nil {
 			return err
 		}
+
+		addrs, err := h.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		var connected []*net.IPNet
+		for _, a := range addrs {
+			connected = append(connected, &net.IPNet{
+				IP:   a.IP.Mask(a.Mask),
+				Mask: a.Mask,
+			})
+		}
+		r, err := wireguardRoutes(iface, link.Attrs().Index, connected)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, r...)
+	}
+
+	// Aggregate the AllowedIPs (including the prefixes of the sites), unless
+	// they overlap with other routes of the kernel.
+	kernel, err := h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("RouteList: %v", err)
 	}
+	var others []*netlink.Route
+	for idx := range kernel {
+		if kernel[idx].Protocol != rtprotWireGuard {
+			others = append(others, &kernel[idx])
+		}
+	}
+	routes = summarizeRoutes(routes, others)
+
+	// Routes require the link to be up, which applyInterfaces does for
+	// links listed in interfaces.json.
+	if err := applyWireGuardRoutes(h, routes); err != nil {
+		return fmt.Errorf("routes: %v", err)
+	}
+	return nil
+}
 
+// applyWireGuardFirewall accepts packets which arrive on a WireGuard
+// interface from the allowed IPs of its peers (of the address family of
+// filter), so that later rules (e.g. the pinholes of firewall.json) do not
+// drop VPN traffic.
+func applyWireGuardFirewall(dir string, c *ruleset, filter *nftables.Table, forward *nftables.Chain) error {
+	cfg, err := readWireGuard(dir)
+	if err != nil {
+		return err
+	}
+	ipv6 := filter.Family == nftables.TableFamilyIPv6
+	for _, iface := range cfg.Interfaces {
+		nets, err := iface.allowedNets()
+		if err != nil {
+			return err
+		}
+		for _, n := range nets {
+			if (n.IP.To4() == nil) != ipv6 {
+				continue
+			}
+			exprs := iifnameExprs(iface.Name)
+			if ones, _ := n.Mask.Size(); ones > 0 {
+				exprs = append(exprs, saddrExprs(n, expr.CmpOpEq)...)
+			}
+			exprs = append(exprs,
+				// [ immediate reg 0 accept ]
+				&expr.Verdict{Kind: expr.VerdictAccept})
+			c.AddRule(&nftables.Rule{
+				Table: filter,
+				Chain: forward,
+				Exprs: exprs,
+			})
+		}
+	}
 	return nil
 }
@@ -0,0 +1,106 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netconfig
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+)
+
+func TestWireGuardPrivateKey(t *testing.T) {
+	const key = "gBCV3afBKfW7RycmeZFMpJykvO+58KfSEIyavay90kE="
+	tmp, err := ioutil.TempDir("", "netconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "wireguard"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "wireguard", "wg0.key"), []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	inline := wireguardInterface{Name: "wg0", PrivateKey: key}
+	want, err := inline.privateKey(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := wireguardInterface{Name: "wg0", PrivateKeyFile: "wireguard/wg0.key"}
+	got, err := file.privateKey(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("private_key_file: got %v, want %v", got, want)
+	}
+
+	both := wireguardInterface{Name: "wg0", PrivateKey: key, PrivateKeyFile: "wireguard/wg0.key"}
+	if _, err := both.privateKey(tmp); err == nil {
+		t.Errorf("privateKey unexpectedly accepted private_key and private_key_file")
+	}
+}
+
+func TestWireGuardRoutes(t *testing.T) {
+	iface := wireguardInterface{
+		Name: "wg0",
+		Peers: []wireguardPeer{
+			{AllowedIPs: []string{"10.0.137.2/32", "192.168.43.0/24", "fe80::/64"}},
+			{AllowedIPs: []string{"10.0.137.3/32", "2001:db8:43::/48", "0.0.0.0/0"}},
+			{AllowedIPs: []string{"192.168.43.0/24"}}, // duplicate
+		},
+	}
+	_, connected, _ := net.ParseCIDR("10.0.137.0/24")
+	got, err := wireguardRoutes(iface, 5, []*net.IPNet{connected})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	want := []*netlink.Route{
+		{
+			LinkIndex: 5,
+			Dst:       mustParseCIDR("192.168.43.0/24"),
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  rtprotWireGuard,
+		},
+		{
+			LinkIndex: 5,
+			Dst:       mustParseCIDR("2001:db8:43::/48"),
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  rtprotWireGuard,
+			Priority:  defaultIPv6Metric,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wireguardRoutes: diff (-want +got):\n%s", diff)
+	}
+
+	iface.Peers[0].AllowedIPs = append(iface.Peers[0].AllowedIPs, "invalid")
+	if _, err := wireguardRoutes(iface, 5, nil); err == nil {
+		t.Errorf("wireguardRoutes unexpectedly accepted an invalid allowed IP")
+	}
+}
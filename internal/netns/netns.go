@@ -0,0 +1,102 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netns runs a router7 process in a network namespace, so that
+// router7 can be developed, tested or deployed in a container or VM host
+// without touching the network of the host.
+package netns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// path returns the path of the network namespace name, which is either a
+// name created by “ip netns add” or a path like /proc/1234/ns/net.
+func path(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return filepath.Join("/var/run/netns", name)
+}
+
+func same(a, b string) (bool, error) {
+	var sa, sb unix.Stat_t
+	if err := unix.Stat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(b, &sb); err != nil {
+		return false, err
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino, nil
+}
+
+// Enter makes the process run in network namespace name (see path), like
+// “ip netns exec”: unless the process already runs in that namespace, the
+// calling thread enters it, mounts a sysfs instance of the namespace in a new
+// mount namespace and re-executes the program, which then runs entirely in
+// the namespace (a Go program cannot move its other threads). An empty name
+// is a no-op.
+//
+// Enter must be called early in main, before any state is set up.
+func Enter(name string) error {
+	if name == "" {
+		return nil
+	}
+	target := path(name)
+	inside, err := same("/proc/self/ns/net", target)
+	if err != nil {
+		return err
+	}
+	if inside {
+		return nil
+	}
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The thread is tainted: it must not be used by other goroutines if exec
+	// fails.
+	runtime.LockOSThread()
+	if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("setns(%s): %v", target, err)
+	}
+	if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+		return fmt.Errorf("unshare: %v", err)
+	}
+	// Keep mounts of this namespace from propagating to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("making / a slave mount: %v", err)
+	}
+	// Network devices in /sys/class/net are those of the namespace which
+	// mounted sysfs.
+	if err := unix.Unmount("/sys", unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("unmounting /sys: %v", err)
+	}
+	if err := unix.Mount(name, "/sys", "sysfs", 0, ""); err != nil {
+		return fmt.Errorf("mounting /sys: %v", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return unix.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netns
+
+import "testing"
+
+func TestPath(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want string
+	}{
+		{"router7", "/var/run/netns/router7"},
+		{"/proc/1234/ns/net", "/proc/1234/ns/net"},
+	} {
+		if got := path(tt.name); got != tt.want {
+			t.Errorf("path(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnterCurrent(t *testing.T) {
+	// Entering the namespace the process already runs in must not re-execute
+	// the test binary.
+	for _, name := range []string{"", "/proc/self/ns/net"} {
+		if err := Enter(name); err != nil {
+			t.Errorf("Enter(%q): %v", name, err)
+		}
+	}
+	if err := Enter("/nonexistent/ns/net"); err == nil {
+		t.Errorf("Enter(/nonexistent/ns/net) unexpectedly succeeded")
+	}
+}
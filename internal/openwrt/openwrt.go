@@ -0,0 +1,318 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openwrt converts OpenWrt UCI configuration (network, dhcp and
+// firewall) and dnsmasq static leases into router7 configuration files.
+//
+// Only settings with a router7 equivalent are converted, everything else
+// results in a warning.
+package openwrt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/renameio"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// leaseRange is the number of addresses handed out by dhcp4d, starting
+// after the lan0 address.
+const leaseRange = 230
+
+// Input is the configuration to convert. Each field may be empty.
+type Input struct {
+	Network  []*Section // /etc/config/network
+	DHCP     []*Section // /etc/config/dhcp (or ParseDnsmasq)
+	Firewall []*Section // /etc/config/firewall
+
+	// LAN is the lan0 address (e.g. 192.168.42.1/24) to use if Network does
+	// not configure it, e.g. when only converting dnsmasq static leases.
+	LAN string
+}
+
+// Result is the converted configuration.
+type Result struct {
+	Interfaces  netconfig.InterfaceConfig
+	Forwardings []netconfig.PortForwarding
+	Leases      []*dhcp4d.Lease // static leases
+
+	// Warnings describe settings which were not converted.
+	Warnings []string
+}
+
+func (r *Result) warnf(format string, v ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, v...))
+}
+
+// Convert converts in.
+func Convert(in Input) (*Result, error) {
+	r := &Result{}
+	lan, err := r.convertNetwork(in.Network)
+	if err != nil {
+		return nil, err
+	}
+	if lan == nil && in.LAN != "" {
+		if lan, err = parseAddr(in.LAN, ""); err != nil {
+			return nil, fmt.Errorf("lan: %v", err)
+		}
+	}
+	r.convertDHCP(in.DHCP, lan)
+	r.convertFirewall(in.Firewall)
+	return r, nil
+}
+
+// parseAddr parses an ipaddr option (with or without prefix length) and the
+// netmask option into an address in CIDR notation.
+func parseAddr(ipaddr, netmask string) (*net.IPNet, error) {
+	if strings.Contains(ipaddr, "/") {
+		ip, ipnet, err := net.ParseCIDR(ipaddr)
+		if err != nil {
+			return nil, err
+		}
+		ipnet.IP = ip
+		return ipnet, nil
+	}
+	ip := net.ParseIP(ipaddr).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %q", ipaddr)
+	}
+	mask := net.IPv4Mask(255, 255, 255, 0)
+	if netmask != "" {
+		m := net.ParseIP(netmask).To4()
+		if m == nil {
+			return nil, fmt.Errorf("invalid netmask %q", netmask)
+		}
+		mask = net.IPMask(m)
+	}
+	return &net.IPNet{IP: ip, Mask: mask}, nil
+}
+
+// convertNetwork converts the lan and wan interfaces and returns the lan0
+// address.
+func (r *Result) convertNetwork(sections []*Section) (*net.IPNet, error) {
+	var lan *net.IPNet
+	for _, s := range sections {
+		if s.Type != "interface" {
+			continue
+		}
+		switch s.Name {
+		case "loopback":
+		case "lan":
+			if proto := s.Option("proto"); proto != "static" {
+				return nil, fmt.Errorf("interface lan: proto %q unsupported, expected static", proto)
+			}
+			addr, err := parseAddr(s.Option("ipaddr"), s.Option("netmask"))
+			if err != nil {
+				return nil, fmt.Errorf("interface lan: %v", err)
+			}
+			if ones, _ := addr.Mask.Size(); ones != 24 {
+				r.warnf("interface lan: dhcp4d only serves a /24, not a /%d", ones)
+			}
+			lan = addr
+			r.Interfaces.Interfaces = append(r.Interfaces.Interfaces, netconfig.InterfaceDetails{
+				Name: "lan0",
+				Addr: addr.String(),
+				MTU:  atoi(s.Option("mtu")),
+			})
+		case "wan":
+			if proto := s.Option("proto"); proto != "dhcp" {
+				r.warnf("interface wan: proto %q unsupported, using dhcp", proto)
+			}
+			r.Interfaces.Interfaces = append(r.Interfaces.Interfaces, netconfig.InterfaceDetails{
+				Name:              "uplink0",
+				SpoofHardwareAddr: s.Option("macaddr"),
+				MTU:               atoi(s.Option("mtu")),
+			})
+		case "wan6":
+			// router7 always runs dhcp6 on uplink0
+		default:
+			r.warnf("interface %s: not converted (router7 has one lan and one wan interface)", s.Name)
+		}
+	}
+	if len(r.Interfaces.Interfaces) > 0 {
+		r.warnf("interfaces.json: fill in hardware_addr of each interface (router7 identifies interfaces by MAC address)")
+	}
+	return lan, nil
+}
+
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s) // 0 (default) for empty or invalid values
+	return i
+}
+
+func (r *Result) convertDHCP(sections []*Section, lan *net.IPNet) {
+	for _, s := range sections {
+		switch s.Type {
+		case "host":
+			r.convertHost(s, lan)
+		case "dhcp":
+			if s.Option("start") != "" || s.Option("limit") != "" || s.Option("leasetime") != "" {
+				r.warnf("dhcp %s: start, limit and leasetime not converted (dhcp4d hands out .2 to .%d for 20m)", s.Name, leaseRange+1)
+			}
+		case "domain":
+			r.warnf("domain %s: not converted (dnsd resolves DHCP hostnames)", s.Option("name"))
+		}
+	}
+}
+
+func (r *Result) convertHost(s *Section, lan *net.IPNet) {
+	name := s.Option("name")
+	ip := net.ParseIP(s.Option("ip")).To4()
+	if ip == nil {
+		r.warnf("host %s: no IPv4 address, not converted", name)
+		return
+	}
+	if lan == nil || !lan.Contains(ip) {
+		r.warnf("host %s: %v outside of lan, not converted", name, ip)
+		return
+	}
+	start := binary.BigEndian.Uint32(lan.IP.To4()) + 1
+	num := int(binary.BigEndian.Uint32(ip)) - int(start)
+	if num < 0 || num >= leaseRange {
+		r.warnf("host %s: %v outside of the dhcp4d range, not converted", name, ip)
+		return
+	}
+	// OpenWrt’s mac option can contain multiple (space-separated) addresses,
+	// whereas a router7 lease has exactly one.
+	var macs []string
+	for _, m := range s.Options["mac"] {
+		macs = append(macs, strings.Fields(m)...)
+	}
+	if len(macs) == 0 {
+		r.warnf("host %s: no MAC address, not converted", name)
+		return
+	}
+	if len(macs) > 1 {
+		r.warnf("host %s: only converting the first of %d MAC addresses", name, len(macs))
+	}
+	hwaddr, err := net.ParseMAC(macs[0])
+	if err != nil {
+		r.warnf("host %s: %v, not converted", name, err)
+		return
+	}
+	for _, l := range r.Leases {
+		if l.Num == num {
+			r.warnf("host %s: %v already assigned to %s, not converted", name, ip, l.HardwareAddr)
+			return
+		}
+	}
+	r.Leases = append(r.Leases, &dhcp4d.Lease{
+		Num:              num,
+		Addr:             ip,
+		HardwareAddr:     hwaddr.String(),
+		Hostname:         name,
+		HostnameOverride: name,
+		// zero Expiry: static lease
+	})
+}
+
+func (r *Result) convertFirewall(sections []*Section) {
+	for _, s := range sections {
+		switch s.Type {
+		case "redirect":
+			r.convertRedirect(s)
+		case "rule", "forwarding":
+			r.warnf("firewall %s %s: not converted (see firewall.json for router7’s opt-in firewall features)", s.Type, s.Option("name"))
+		}
+	}
+}
+
+func (r *Result) convertRedirect(s *Section) {
+	name := s.Option("name")
+	if s.Option("enabled") == "0" {
+		return
+	}
+	if target := s.Option("target"); target != "" && target != "DNAT" {
+		r.warnf("redirect %s: target %s not converted", name, target)
+		return
+	}
+	if src := s.Option("src"); src != "wan" {
+		r.warnf("redirect %s: src %q not converted (port forwardings apply to uplink0)", name, src)
+		return
+	}
+	port := strings.Replace(s.Option("src_dport"), ":", "-", 1)
+	if port == "" || s.Option("dest_ip") == "" {
+		r.warnf("redirect %s: src_dport and dest_ip required, not converted", name)
+		return
+	}
+	destPort := strings.Replace(s.Option("dest_port"), ":", "-", 1)
+	if destPort == "" {
+		destPort = port
+	}
+	var protos []string
+	proto := strings.Join(s.Options["proto"], " ")
+	if proto == "" {
+		proto = "tcp udp" // OpenWrt default
+	}
+	for _, p := range strings.Fields(proto) {
+		switch p {
+		case "tcpudp":
+			protos = append(protos, "tcp", "udp")
+		case "tcp", "udp":
+			protos = append(protos, p)
+		default:
+			r.warnf("redirect %s: proto %s not converted", name, p)
+		}
+	}
+	if len(protos) == 0 {
+		return
+	}
+	r.Forwardings = append(r.Forwardings, netconfig.PortForwarding{
+		Proto:    strings.Join(protos, ","),
+		Port:     port,
+		DestAddr: s.Option("dest_ip"),
+		DestPort: destPort,
+	})
+}
+
+// Write writes the non-empty parts of r as router7 configuration files
+// into dir (i.e. a copy of /perm).
+func (r *Result) Write(dir string) error {
+	for _, f := range []struct {
+		path  string
+		empty bool
+		v     interface{}
+	}{
+		{"interfaces.json", len(r.Interfaces.Interfaces) == 0, r.Interfaces},
+		{"portforwardings.json", len(r.Forwardings) == 0, struct {
+			Forwardings []netconfig.PortForwarding `json:"forwardings"`
+		}{r.Forwardings}},
+		{"dhcp4d/leases.json", len(r.Leases) == 0, r.Leases},
+	} {
+		if f.empty {
+			continue
+		}
+		b, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := renameio.WriteFile(path, append(b, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openwrt
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+const network = `
+config interface 'loopback'
+	option ifname 'lo'
+	option proto 'static'
+	option ipaddr '127.0.0.1'
+	option netmask '255.0.0.0'
+
+config interface 'lan'
+	option type 'bridge'
+	option ifname 'eth0.1'
+	option proto 'static'
+	option ipaddr '192.168.1.1'
+	option netmask '255.255.255.0'
+
+config interface 'wan'
+	option ifname 'eth0.2'
+	option proto 'dhcp'
+	option macaddr "00:0d:b9:4b:7d:01"  # ISP-registered
+	option mtu 1492
+`
+
+const dhcp = `
+config dhcp 'lan'
+	option interface 'lan'
+	option start '100'
+	option limit '150'
+
+config host
+	option name 'nas'
+	option mac '00:11:32:aa:bb:cc'
+	option ip '192.168.1.10'
+
+config host
+	option name 'printer'
+	list mac '3c:2a:f4:00:00:01'
+	list mac '3c:2a:f4:00:00:02'
+	option ip '192.168.1.20'
+`
+
+const firewall = `
+config rule
+	option name 'Allow-Ping'
+	option src 'wan'
+
+config redirect
+	option name 'ssh'
+	option src 'wan'
+	option src_dport '2222'
+	option dest_ip '192.168.1.10'
+	option dest_port '22'
+	option proto 'tcp'
+
+config redirect
+	option name 'games'
+	option src 'wan'
+	option src_dport '27015-27030'
+	option dest_ip '192.168.1.10'
+
+config redirect
+	option name 'disabled'
+	option enabled '0'
+	option src 'wan'
+	option src_dport '80'
+	option dest_ip '192.168.1.10'
+`
+
+func mustParse(t *testing.T, s string) []*Section {
+	t.Helper()
+	sections, err := ParseUCI(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sections
+}
+
+func TestConvert(t *testing.T) {
+	r, err := Convert(Input{
+		Network:  mustParse(t, network),
+		DHCP:     mustParse(t, dhcp),
+		Firewall: mustParse(t, firewall),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantInterfaces := netconfig.InterfaceConfig{
+		Interfaces: []netconfig.InterfaceDetails{
+			{Name: "lan0", Addr: "192.168.1.1/24"},
+			{Name: "uplink0", SpoofHardwareAddr: "00:0d:b9:4b:7d:01", MTU: 1492},
+		},
+	}
+	if diff := cmp.Diff(wantInterfaces, r.Interfaces); diff != "" {
+		t.Errorf("unexpected interfaces: diff (-want +got):\n%s", diff)
+	}
+
+	wantForwardings := []netconfig.PortForwarding{
+		{Proto: "tcp", Port: "2222", DestAddr: "192.168.1.10", DestPort: "22"},
+		{Proto: "tcp,udp", Port: "27015-27030", DestAddr: "192.168.1.10", DestPort: "27015-27030"},
+	}
+	if diff := cmp.Diff(wantForwardings, r.Forwardings); diff != "" {
+		t.Errorf("unexpected forwardings: diff (-want +got):\n%s", diff)
+	}
+
+	wantLeases := []*dhcp4d.Lease{
+		{
+			Num:              8,
+			Addr:             net.ParseIP("192.168.1.10").To4(),
+			HardwareAddr:     "00:11:32:aa:bb:cc",
+			Hostname:         "nas",
+			HostnameOverride: "nas",
+		},
+		{
+			Num:              18,
+			Addr:             net.ParseIP("192.168.1.20").To4(),
+			HardwareAddr:     "3c:2a:f4:00:00:01",
+			Hostname:         "printer",
+			HostnameOverride: "printer",
+		},
+	}
+	if diff := cmp.Diff(wantLeases, r.Leases); diff != "" {
+		t.Errorf("unexpected leases: diff (-want +got):\n%s", diff)
+	}
+
+	// hardware_addr, dhcp range, printer MACs, Allow-Ping
+	if got, want := len(r.Warnings), 4; got != want {
+		t.Errorf("unexpected number of warnings: got %d, want %d: %q", got, want, r.Warnings)
+	}
+}
+
+func TestParseDnsmasq(t *testing.T) {
+	const conf = `
+domain=lan
+dhcp-range=192.168.1.100,192.168.1.200,12h
+dhcp-host=00:11:32:aa:bb:cc,nas,192.168.1.10,infinite
+dhcp-host=id:01:02:03,set:iot,3c:2a:f4:00:00:01,192.168.1.20,printer,24h
+`
+	hosts, err := ParseDnsmasq(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Section{
+		{
+			Type: "host",
+			Options: map[string][]string{
+				"mac":  {"00:11:32:aa:bb:cc"},
+				"name": {"nas"},
+				"ip":   {"192.168.1.10"},
+			},
+		},
+		{
+			Type: "host",
+			Options: map[string][]string{
+				"mac":  {"3c:2a:f4:00:00:01"},
+				"name": {"printer"},
+				"ip":   {"192.168.1.20"},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, hosts); diff != "" {
+		t.Errorf("unexpected hosts: diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openwrt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Section is a “config” section of a UCI file, e.g.:
+//
+//	config interface 'lan'
+//		option proto 'static'
+//		list dns '1.1.1.1'
+type Section struct {
+	Type    string              // e.g. interface
+	Name    string              // e.g. lan, empty for anonymous sections
+	Options map[string][]string // option values have one element
+}
+
+// Option returns the (first) value of the option called name.
+func (s *Section) Option(name string) string {
+	if v := s.Options[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// fields splits a UCI line into words, removing single or double quotes.
+func fields(line string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		quote  rune
+		inWord bool
+	)
+loop:
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '#':
+			if !inWord {
+				break loop // comment
+			}
+			word.WriteRune(r)
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// ParseUCI parses a UCI configuration file, e.g. /etc/config/network.
+func ParseUCI(r io.Reader) ([]*Section, error) {
+	var (
+		sections []*Section
+		current  *Section
+	)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		words, err := fields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "package":
+		case "config":
+			if len(words) < 2 || len(words) > 3 {
+				return nil, fmt.Errorf("line %d: expected config <type> [<name>]", lineno)
+			}
+			current = &Section{Type: words[1], Options: make(map[string][]string)}
+			if len(words) == 3 {
+				current.Name = words[2]
+			}
+			sections = append(sections, current)
+		case "option", "list":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: %s outside of config section", lineno, words[0])
+			}
+			if len(words) != 3 {
+				return nil, fmt.Errorf("line %d: expected %s <name> <value>", lineno, words[0])
+			}
+			if words[0] == "option" {
+				current.Options[words[1]] = []string{words[2]}
+			} else {
+				current.Options[words[1]] = append(current.Options[words[1]], words[2])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unexpected keyword %q", lineno, words[0])
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// ParseDnsmasq parses the static leases (dhcp-host lines) of a dnsmasq.conf
+// file and returns them as UCI host sections.
+func ParseDnsmasq(r io.Reader) ([]*Section, error) {
+	var hosts []*Section
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "dhcp-host=") {
+			continue
+		}
+		host := &Section{Type: "host", Options: make(map[string][]string)}
+		for _, f := range strings.Split(strings.TrimPrefix(line, "dhcp-host="), ",") {
+			f = strings.TrimSpace(f)
+			if hwaddr, err := net.ParseMAC(f); err == nil {
+				host.Options["mac"] = append(host.Options["mac"], hwaddr.String())
+			} else if ip := net.ParseIP(f); ip != nil && ip.To4() != nil {
+				host.Options["ip"] = []string{f}
+			} else if f == "" || strings.Contains(f, ":") || f == "infinite" || f == "ignore" || (f[0] >= '0' && f[0] <= '9') {
+				// client id, tag, lease time, …
+			} else {
+				host.Options["name"] = []string{f}
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, scanner.Err()
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugin implements the API through which out-of-tree components
+// (plugins) extend router7: plugins are programs started by pluginsd, which
+// subscribe to the events of package hooks, contribute port forwardings and
+// blocks to the firewall and publish their status.
+//
+// Like with hashicorp/go-plugin, pluginsd starts each plugin as a subprocess
+// and talks net/rpc over a connection private to that plugin: a socket pair,
+// of which the plugin inherits one end as file descriptor 3 (which NewClient
+// picks up). The connection identifies the plugin, so no further
+// authentication is needed. The RPC service “Plugin” offers:
+//
+//	Subscribe(event string, *bool)           receive events (all if empty)
+//	Next(bool, *[]hooks.Event)               wait for subscribed events
+//	SetFirewall(netconfig.FirewallFragment, *bool)
+//	                                         replace the firewall fragment
+//	SetStatus([]byte, *bool)                 replace the status (JSON)
+//
+// router7 daemons publish events via POST /publish on Addr, where GET /status
+// returns the status of all plugins.
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/rtr7/router7/internal/hooks"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// Addr is the address on which pluginsd serves event publishing and the
+// status of all plugins.
+const Addr = "localhost:8075"
+
+// EnvName is the environment variable which holds the name of the plugin.
+const EnvName = "ROUTER7_PLUGIN_NAME"
+
+// apiFD is the file descriptor on which plugins inherit their connection to
+// the plugin API.
+const apiFD = 3
+
+// Config is read from /perm/plugins.json.
+type Config struct {
+	Plugins []Plugin `json:"plugins"`
+}
+
+// Plugin is a program which pluginsd runs (and restarts when it exits).
+type Plugin struct {
+	Name string   `json:"name"` // e.g. ddns-example, identifies fragment and status
+	Path string   `json:"path"` // e.g. /perm/plugins/ddns-example
+	Args []string `json:"args"` // e.g. ["-interval=5m"]
+}
+
+var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ReadConfig reads the plugins from dir/plugins.json.
+func ReadConfig(dir string) (*Config, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "plugins.json"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, p := range cfg.Plugins {
+		if !nameRe.MatchString(p.Name) {
+			return nil, fmt.Errorf("plugin %q: invalid name, expected e.g. ddns-example", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("plugin %q: configured more than once", p.Name)
+		}
+		seen[p.Name] = true
+		if p.Path == "" {
+			return nil, fmt.Errorf("plugin %q: path must be set", p.Name)
+		}
+	}
+	return &cfg, nil
+}
+
+// Client accesses the plugin API on behalf of one plugin.
+type Client struct {
+	rpc *rpc.Client
+}
+
+// NewClient returns a Client for the plugin API of the pluginsd which started
+// the calling program.
+func NewClient() (*Client, error) {
+	if os.Getenv(EnvName) == "" {
+		return nil, fmt.Errorf("%s not set: not started by pluginsd?", EnvName)
+	}
+	f := os.NewFile(apiFD, "plugin-api")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d: %v", apiFD, err)
+	}
+	return &Client{rpc: rpc.NewClient(conn)}, nil
+}
+
+// Close closes the connection to the plugin API.
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
+
+// Events calls fn for each event (of type event, or all events if empty)
+// until the connection fails or fn returns an error.
+func (c *Client) Events(event string, fn func(hooks.Event) error) error {
+	var ok bool
+	if err := c.rpc.Call("Plugin.Subscribe", event, &ok); err != nil {
+		return err
+	}
+	for {
+		var events []hooks.Event
+		if err := c.rpc.Call("Plugin.Next", true, &events); err != nil {
+			return err
+		}
+		for _, ev := range events {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SetFirewall replaces the firewall fragment of the plugin.
+func (c *Client) SetFirewall(f netconfig.FirewallFragment) error {
+	var ok bool
+	return c.rpc.Call("Plugin.SetFirewall", f, &ok)
+}
+
+// SetStatus replaces the status of the plugin with status, which must be
+// encodable as JSON.
+func (c *Client) SetStatus(status interface{}) error {
+	b, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	return c.rpc.Call("Plugin.SetStatus", b, &ok)
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/hooks"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for _, tt := range []struct {
+		cfg     string
+		wantErr bool
+	}{
+		{`{"plugins": [{"name": "ddns-example", "path": "/perm/plugins/ddns"}]}`, false},
+		{`{"plugins": [{"name": "../etc", "path": "/perm/plugins/ddns"}]}`, true},
+		{`{"plugins": [{"name": "ddns"}]}`, true},
+		{`{"plugins": [{"name": "ddns", "path": "/a"}, {"name": "ddns", "path": "/b"}]}`, true},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "plugins.json"), []byte(tt.cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(tmp); (err != nil) != tt.wantErr {
+			t.Errorf("ReadConfig(%s) = %v, want error: %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	srv := NewServer(tmp)
+	firewallChanged := make(chan bool, 1)
+	srv.FirewallChanged = func() { firewallChanged <- true }
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	local, remote := net.Pipe()
+	go srv.ServeConn("example", local)
+	c := &Client{rpc: rpc.NewClient(remote)}
+	defer c.Close()
+
+	t.Run("Events", func(t *testing.T) {
+		errStop := errors.New("stop")
+		got := make(chan hooks.Event, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Events(hooks.EventUplinkDown, func(ev hooks.Event) error {
+				got <- ev
+				return errStop
+			})
+		}()
+		for {
+			srv.mu.Lock()
+			n := len(srv.subs)
+			srv.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		want := hooks.Event{
+			Event: hooks.EventUplinkDown,
+			Time:  time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+			Data:  map[string]string{"interface": "uplink0"},
+		}
+		// Events of other types are filtered.
+		srv.Publish(hooks.Event{Event: hooks.EventUplinkUp})
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ts.Client().Post(ts.URL+"/publish", "application/json", strings.NewReader(string(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if diff := cmp.Diff(want, <-got); diff != "" {
+			t.Errorf("event: diff (-want +got):\n%s", diff)
+		}
+		if err := <-done; err != errStop {
+			t.Errorf("Events = %v, want %v", err, errStop)
+		}
+	})
+
+	t.Run("Firewall", func(t *testing.T) {
+		invalid := netconfig.FirewallFragment{
+			Forwardings: []netconfig.PortForwarding{{Proto: "sctp", Port: "8080", DestAddr: "192.168.42.23", DestPort: "80"}},
+		}
+		if err := c.SetFirewall(invalid); err == nil {
+			t.Errorf("SetFirewall(invalid) unexpectedly succeeded")
+		}
+		f := netconfig.FirewallFragment{
+			Forwardings: []netconfig.PortForwarding{{Proto: "tcp", Port: "8080", DestAddr: "192.168.42.23", DestPort: "80"}},
+			Blocks:      []netconfig.Block{{Addr: "192.168.42.99", Reason: "example"}},
+		}
+
+		// The firewall cannot be changed while the configuration is frozen.
+		if err := freeze.Freeze(tmp, freeze.State{Reason: "debugging", Since: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetFirewall(f); err == nil {
+			t.Errorf("SetFirewall while frozen unexpectedly succeeded")
+		}
+		if err := freeze.Thaw(tmp); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.SetFirewall(f); err != nil {
+			t.Fatal(err)
+		}
+		<-firewallChanged
+		got, err := netconfig.ReadFirewallFragments(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]netconfig.FirewallFragment{"example": f}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("fragments: diff (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		if err := c.SetStatus(map[string]int{"updates": 3}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ts.Client().Get(ts.URL + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected HTTP status: %v", resp.Status)
+		}
+		var got map[string]map[string]int
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]map[string]int{"example": {"updates": 3}}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("status: diff (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestAttach(t *testing.T) {
+	if os.Getenv("HELPER_PROCESS") == "1" {
+		c, err := NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if err := c.SetStatus("attached"); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	tmp, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	srv := NewServer(tmp)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAttach$")
+	cmd.Env = append(os.Environ(), "HELPER_PROCESS=1", EnvName+"=example")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	api, err := srv.Attach("example", cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	got := string(srv.status["example"])
+	srv.mu.Unlock()
+	if want := `"attached"`; got != want {
+		t.Errorf("status = %s, want %s", got, want)
+	}
+}
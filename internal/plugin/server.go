@@ -0,0 +1,274 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/freeze"
+	"github.com/rtr7/router7/internal/hooks"
+	"github.com/rtr7/router7/internal/netconfig"
+	"github.com/rtr7/router7/internal/teelogger"
+	"golang.org/x/sys/unix"
+)
+
+var log = teelogger.NewConsole()
+
+// subscriber receives the events of a plugin which called Subscribe.
+type subscriber struct {
+	event string // empty: all events
+	ch    chan hooks.Event
+}
+
+// Server implements the plugin API.
+type Server struct {
+	dir string // e.g. /perm
+
+	// FirewallChanged is called after a plugin replaced its firewall
+	// fragment, e.g. to make netconfigd apply it.
+	FirewallChanged func()
+
+	mu     sync.Mutex
+	status map[string]json.RawMessage
+	subs   map[*subscriber]bool
+}
+
+// NewServer returns a Server which persists firewall fragments in dir.
+func NewServer(dir string) *Server {
+	return &Server{
+		dir:    dir,
+		status: make(map[string]json.RawMessage),
+		subs:   make(map[*subscriber]bool),
+	}
+}
+
+// Publish sends ev to all subscribers. Subscribers which do not keep up miss
+// events instead of blocking the publisher.
+func (s *Server) Publish(ev hooks.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		if sub.event != "" && sub.event != ev.Event {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Printf("subscriber too slow, dropping %s event", ev.Event)
+		}
+	}
+}
+
+// attachment is the pluginsd end of the connection to a plugin, plus the
+// plugin end which is inherited by the plugin process.
+type attachment struct {
+	conn   net.Conn
+	remote *os.File
+}
+
+func (a *attachment) Close() error {
+	a.remote.Close()
+	return a.conn.Close()
+}
+
+// Attach prepares cmd to run as plugin name: cmd inherits one end of a socket
+// pair as file descriptor 3 (see NewClient), and the plugin API is served on
+// the other end until the returned io.Closer is closed, which should happen
+// once cmd exited.
+func (s *Server) Attach(name string, cmd *exec.Cmd) (io.Closer, error) {
+	if len(cmd.ExtraFiles) > 0 {
+		return nil, fmt.Errorf("plugin %s: ExtraFiles already set", name)
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "plugin-api")
+	defer local.Close()
+	remote := os.NewFile(uintptr(fds[1]), name)
+	conn, err := net.FileConn(local)
+	if err != nil {
+		remote.Close()
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{remote}
+	go s.ServeConn(name, conn)
+	return &attachment{conn: conn, remote: remote}, nil
+}
+
+// ServeConn serves the plugin API to plugin name on conn until conn is
+// closed.
+func (s *Server) ServeConn(name string, conn io.ReadWriteCloser) {
+	sess := &session{
+		s:    s,
+		name: name,
+		done: make(chan struct{}),
+	}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Plugin", sess); err != nil {
+		log.Printf("plugin %s: %v", name, err)
+		conn.Close()
+		return
+	}
+	srv.ServeConn(conn)
+	close(sess.done)
+	sess.unsubscribe()
+}
+
+// session is the RPC service “Plugin” for the connection of one plugin.
+type session struct {
+	s    *Server
+	name string
+	done chan struct{} // closed when the connection is closed
+
+	mu  sync.Mutex
+	sub *subscriber
+}
+
+func (ss *session) unsubscribe() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.sub == nil {
+		return
+	}
+	ss.s.mu.Lock()
+	delete(ss.s.subs, ss.sub)
+	ss.s.mu.Unlock()
+	ss.sub = nil
+}
+
+// Subscribe makes the plugin receive events of type event (or all events if
+// empty) via Next, replacing any previous subscription.
+func (ss *session) Subscribe(event string, ok *bool) error {
+	ss.unsubscribe()
+	sub := &subscriber{
+		event: event,
+		ch:    make(chan hooks.Event, 100),
+	}
+	ss.mu.Lock()
+	ss.sub = sub
+	ss.mu.Unlock()
+	ss.s.mu.Lock()
+	ss.s.subs[sub] = true
+	ss.s.mu.Unlock()
+	*ok = true
+	return nil
+}
+
+// Next waits for at least one subscribed event and returns all events which
+// are available.
+func (ss *session) Next(_ bool, events *[]hooks.Event) error {
+	ss.mu.Lock()
+	sub := ss.sub
+	ss.mu.Unlock()
+	if sub == nil {
+		return errors.New("not subscribed, call Subscribe first")
+	}
+	select {
+	case <-ss.done:
+		return errors.New("connection closed")
+	case ev := <-sub.ch:
+		*events = append(*events, ev)
+	}
+	for {
+		select {
+		case ev := <-sub.ch:
+			*events = append(*events, ev)
+		default:
+			return nil
+		}
+	}
+}
+
+// SetFirewall replaces the firewall fragment of the plugin, unless the
+// configuration is frozen (see package freeze).
+func (ss *session) SetFirewall(f netconfig.FirewallFragment, ok *bool) error {
+	st, err := freeze.Read(ss.s.dir, time.Now())
+	if err != nil {
+		// Fail closed: a corrupt freeze file should not permit changes.
+		return fmt.Errorf("reading freeze state: %v", err)
+	}
+	if st != nil {
+		return fmt.Errorf("configuration frozen since %v: %s", st.Since.Format(time.RFC3339), st.Reason)
+	}
+	if err := netconfig.WriteFirewallFragment(ss.s.dir, ss.name, f); err != nil {
+		log.Printf("plugin %s: %v", ss.name, err)
+		return err
+	}
+	log.Printf("plugin %s: firewall fragment replaced (%d forwardings, %d blocks)", ss.name, len(f.Forwardings), len(f.Blocks))
+	if ss.s.FirewallChanged != nil {
+		ss.s.FirewallChanged()
+	}
+	*ok = true
+	return nil
+}
+
+// SetStatus replaces the status of the plugin with status, which must be
+// valid JSON.
+func (ss *session) SetStatus(status []byte, ok *bool) error {
+	if !json.Valid(status) {
+		return errors.New("status is not valid JSON")
+	}
+	ss.s.mu.Lock()
+	ss.s.status[ss.name] = json.RawMessage(status)
+	ss.s.mu.Unlock()
+	*ok = true
+	return nil
+}
+
+// ServeHTTP implements http.Handler for event publishing (POST /publish) and
+// the status of all plugins (GET /status).
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveHTTP(w, r); err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) error {
+	switch {
+	case r.URL.Path == "/publish" && r.Method == "POST":
+		var ev hooks.Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return err
+		}
+		s.Publish(ev)
+		return nil
+
+	case r.URL.Path == "/status" && r.Method == "GET":
+		s.mu.Lock()
+		b, err := json.MarshalIndent(s.status, "", "  ")
+		s.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(b)
+		return err
+	}
+	http.NotFound(w, r)
+	return nil
+}
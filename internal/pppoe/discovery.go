@@ -0,0 +1,274 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+)
+
+// etherTypeDiscovery is the EtherType of the PPPoE discovery stage, see RFC
+// 2516. Session stage frames are handled by the kernel.
+const etherTypeDiscovery = 0x8863
+
+// Discovery stage codes.
+const (
+	codePADI = 0x09
+	codePADO = 0x07
+	codePADR = 0x19
+	codePADS = 0x65
+	codePADT = 0xa7
+)
+
+// Discovery stage tags.
+const (
+	tagEndOfList        = 0x0000
+	tagServiceName      = 0x0101
+	tagACName           = 0x0102
+	tagHostUniq         = 0x0103
+	tagACCookie         = 0x0104
+	tagRelaySessionID   = 0x0110
+	tagServiceNameError = 0x0201
+	tagACSystemError    = 0x0202
+	tagGenericError     = 0x0203
+)
+
+const (
+	ethernetHdrLen = 14
+	pppoeHdrLen    = 6
+)
+
+type tag struct {
+	typ  uint16
+	data []byte
+}
+
+// discoveryPacket is a PPPoE discovery stage packet.
+type discoveryPacket struct {
+	code    uint8
+	session uint16
+	tags    []tag
+}
+
+func (p *discoveryPacket) tag(typ uint16) ([]byte, bool) {
+	for _, t := range p.tags {
+		if t.typ == typ {
+			return t.data, true
+		}
+	}
+	return nil, false
+}
+
+func (p *discoveryPacket) marshal() []byte {
+	var payload []byte
+	for _, t := range p.tags {
+		payload = append(payload, byte(t.typ>>8), byte(t.typ), byte(len(t.data)>>8), byte(len(t.data)))
+		payload = append(payload, t.data...)
+	}
+	b := make([]byte, pppoeHdrLen, pppoeHdrLen+len(payload))
+	b[0] = 0x11 // version 1, type 1
+	b[1] = p.code
+	binary.BigEndian.PutUint16(b[2:4], p.session)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func parseDiscovery(b []byte) (*discoveryPacket, error) {
+	if len(b) < pppoeHdrLen {
+		return nil, fmt.Errorf("discovery packet too short")
+	}
+	if b[0] != 0x11 {
+		return nil, fmt.Errorf("unsupported PPPoE version/type %#x", b[0])
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if len(b) < pppoeHdrLen+length {
+		return nil, fmt.Errorf("discovery packet truncated")
+	}
+	p := &discoveryPacket{
+		code:    b[1],
+		session: binary.BigEndian.Uint16(b[2:4]),
+	}
+	payload := b[pppoeHdrLen : pppoeHdrLen+length]
+	for len(payload) >= 4 {
+		typ := binary.BigEndian.Uint16(payload[0:2])
+		n := int(binary.BigEndian.Uint16(payload[2:4]))
+		if len(payload) < 4+n {
+			return nil, fmt.Errorf("tag %#x truncated", typ)
+		}
+		if typ == tagEndOfList {
+			break
+		}
+		p.tags = append(p.tags, tag{typ: typ, data: payload[4 : 4+n]})
+		payload = payload[4+n:]
+	}
+	return p, nil
+}
+
+// err returns the error reported in the tags of p, if any.
+func (p *discoveryPacket) err() error {
+	for _, typ := range []uint16{tagServiceNameError, tagACSystemError, tagGenericError} {
+		if msg, ok := p.tag(typ); ok {
+			return fmt.Errorf("access concentrator error (tag %#x): %q", typ, msg)
+		}
+	}
+	return nil
+}
+
+// discoveryConn sends and receives discovery packets as ethernet frames.
+type discoveryConn struct {
+	conn   net.PacketConn // SOCK_RAW packet conn, bound to etherTypeDiscovery
+	hwaddr net.HardwareAddr
+}
+
+func (c *discoveryConn) send(dst net.HardwareAddr, p *discoveryPacket) error {
+	payload := p.marshal()
+	frame := make([]byte, ethernetHdrLen, ethernetHdrLen+len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], c.hwaddr)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeDiscovery)
+	_, err := c.conn.WriteTo(append(frame, payload...), &raw.Addr{HardwareAddr: dst})
+	return err
+}
+
+// receive returns the next discovery packet with the specified code which
+// is addressed to c, or an error once deadline passes.
+func (c *discoveryConn) receive(code uint8, deadline time.Time) (*discoveryPacket, net.HardwareAddr, error) {
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, 1500+ethernetHdrLen)
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		frame := buf[:n]
+		if n < ethernetHdrLen ||
+			binary.BigEndian.Uint16(frame[12:14]) != etherTypeDiscovery ||
+			!bytes.Equal(frame[0:6], c.hwaddr) {
+			continue
+		}
+		p, err := parseDiscovery(frame[ethernetHdrLen:])
+		if err != nil || p.code != code {
+			continue
+		}
+		src := append(net.HardwareAddr(nil), frame[6:12]...)
+		return p, src, nil
+	}
+}
+
+// discovery is the result of the discovery stage.
+type discovery struct {
+	session uint16
+	ac      net.HardwareAddr // access concentrator
+	acName  string
+}
+
+// discover performs the discovery stage (PADI, PADO, PADR, PADS) and
+// returns the established session.
+func (c *discoveryConn) discover(serviceName, acName string, hostUniq []byte) (*discovery, error) {
+	tags := []tag{
+		{typ: tagServiceName, data: []byte(serviceName)},
+		{typ: tagHostUniq, data: hostUniq},
+	}
+	// RFC 2516 section 7: the timeout doubles with every retransmission.
+	timeout := 1 * time.Second
+	var (
+		pado *discoveryPacket
+		ac   net.HardwareAddr
+	)
+	for attempt := 0; pado == nil; attempt++ {
+		if attempt == 5 {
+			return nil, fmt.Errorf("no PADO received")
+		}
+		if err := c.send(layers.EthernetBroadcast, &discoveryPacket{code: codePADI, tags: tags}); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		timeout *= 2
+		for {
+			p, src, err := c.receive(codePADO, deadline)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if uniq, _ := p.tag(tagHostUniq); !bytes.Equal(uniq, hostUniq) {
+				continue // offer for a different client
+			}
+			if name, _ := p.tag(tagACName); acName != "" && string(name) != acName {
+				continue
+			}
+			if err := p.err(); err != nil {
+				return nil, err
+			}
+			pado, ac = p, src
+			break
+		}
+	}
+
+	name, _ := pado.tag(tagACName)
+	padr := &discoveryPacket{code: codePADR, tags: tags}
+	for _, typ := range []uint16{tagACCookie, tagRelaySessionID} {
+		if data, ok := pado.tag(typ); ok {
+			padr.tags = append(padr.tags, tag{typ: typ, data: data})
+		}
+	}
+	timeout = 1 * time.Second
+	for attempt := 0; attempt < 5; attempt++ {
+		if err := c.send(ac, padr); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		timeout *= 2
+		for {
+			p, src, err := c.receive(codePADS, deadline)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if uniq, _ := p.tag(tagHostUniq); !bytes.Equal(uniq, hostUniq) || !bytes.Equal(src, ac) {
+				continue
+			}
+			if err := p.err(); err != nil {
+				return nil, err
+			}
+			if p.session == 0 {
+				return nil, fmt.Errorf("PADS without session id")
+			}
+			return &discovery{
+				session: p.session,
+				ac:      ac,
+				acName:  string(name),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no PADS received from %v (%s)", ac, name)
+}
+
+// terminate sends a PADT for session, e.g. of a previous run which was not
+// terminated properly.
+func (c *discoveryConn) terminate(ac net.HardwareAddr, session uint16) error {
+	return c.send(ac, &discoveryPacket{code: codePADT, session: session})
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	pxProtoOE   = 0 // PX_PROTO_OE of linux/if_pppox.h
+	npmodePass  = 0 // NPMODE_PASS of linux/ppp_defs.h
+	ifnamsiz    = 16
+	sockaddrLen = 30 // packed struct sockaddr_pppox
+)
+
+// kernelChannel is a PPPoE session in the kernel: the PPPoX socket encapsulates
+// the frames of a ppp channel, whose control protocol frames are exchanged via
+// /dev/ppp, and whose network protocol packets are routed via the ppp unit
+// (interface pppN).
+type kernelChannel struct {
+	sock   int
+	ch     *os.File // /dev/ppp attached to the channel
+	unit   *os.File // /dev/ppp attached to the unit
+	ifname string
+	buf    []byte
+}
+
+func ioctlInt(fd uintptr, req uint, v *int32) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), uintptr(unsafe.Pointer(v))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPPP opens /dev/ppp in non-blocking mode, which makes reads on the
+// returned file support deadlines.
+func openPPP() (*os.File, error) {
+	fd, err := unix.Open("/dev/ppp", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/ppp: %v", err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/ppp"), nil
+}
+
+// newKernelChannel creates the ppp interface ppp<unit> for the PPPoE session
+// d on the ethernet interface ifname.
+func newKernelChannel(ifname string, d *discovery, unit int) (_ *kernelChannel, err error) {
+	k := &kernelChannel{
+		sock:   -1,
+		ifname: fmt.Sprintf("ppp%d", unit),
+		buf:    make([]byte, 2+maxMRU+64),
+	}
+	defer func() {
+		if err != nil {
+			k.close()
+		}
+	}()
+	k.sock, err = unix.Socket(unix.AF_PPPOX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, pxProtoOE)
+	if err != nil {
+		return nil, fmt.Errorf("socket(AF_PPPOX): %v (is the pppoe kernel module loaded?)", err)
+	}
+
+	// struct sockaddr_pppox: sa_family, sa_protocol, then struct pppoe_addr
+	// (session id in network byte order, remote MAC, device name).
+	var sa [sockaddrLen]byte
+	*(*uint16)(unsafe.Pointer(&sa[0])) = unix.AF_PPPOX
+	proto := uint32(pxProtoOE)
+	copy(sa[2:6], (*[4]byte)(unsafe.Pointer(&proto))[:])
+	binary.BigEndian.PutUint16(sa[6:8], d.session)
+	copy(sa[8:14], d.ac)
+	copy(sa[14:14+ifnamsiz-1], ifname)
+	if _, _, errno := unix.Syscall(unix.SYS_CONNECT, uintptr(k.sock), uintptr(unsafe.Pointer(&sa[0])), sockaddrLen); errno != 0 {
+		return nil, fmt.Errorf("connect(PPPoX session %d): %v", d.session, errno)
+	}
+
+	var chindex int32
+	if err := ioctlInt(uintptr(k.sock), unix.PPPIOCGCHAN, &chindex); err != nil {
+		return nil, fmt.Errorf("PPPIOCGCHAN: %v", err)
+	}
+	if k.ch, err = openPPP(); err != nil {
+		return nil, err
+	}
+	if err := ioctlInt(k.ch.Fd(), unix.PPPIOCATTCHAN, &chindex); err != nil {
+		return nil, fmt.Errorf("PPPIOCATTCHAN: %v", err)
+	}
+	if k.unit, err = openPPP(); err != nil {
+		return nil, err
+	}
+	u := int32(unit)
+	if err := ioctlInt(k.unit.Fd(), unix.PPPIOCNEWUNIT, &u); err != nil {
+		return nil, fmt.Errorf("PPPIOCNEWUNIT(%d): %v", unit, err)
+	}
+	if err := ioctlInt(k.ch.Fd(), unix.PPPIOCCONNECT, &u); err != nil {
+		return nil, fmt.Errorf("PPPIOCCONNECT: %v", err)
+	}
+	return k, nil
+}
+
+func (k *kernelChannel) readFrame(deadline time.Time) (uint16, []byte, error) {
+	if err := k.ch.SetReadDeadline(deadline); err != nil {
+		return 0, nil, err
+	}
+	for {
+		n, err := k.ch.Read(k.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 2 {
+			continue
+		}
+		return binary.BigEndian.Uint16(k.buf[:2]), k.buf[2:n], nil
+	}
+}
+
+func (k *kernelChannel) writeFrame(proto uint16, b []byte) error {
+	frame := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(frame, proto)
+	_, err := k.ch.Write(append(frame, b...))
+	return err
+}
+
+func (k *kernelChannel) enable(proto uint16, mtu int) error {
+	// struct npioctl
+	npi := [2]int32{int32(proto), npmodePass}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, k.unit.Fd(), unix.PPPIOCSNPMODE, uintptr(unsafe.Pointer(&npi))); errno != 0 {
+		return fmt.Errorf("PPPIOCSNPMODE(%#x): %v", proto, errno)
+	}
+	l, err := netlink.LinkByName(k.ifname)
+	if err != nil {
+		return err
+	}
+	if l.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(l, mtu); err != nil {
+			return fmt.Errorf("LinkSetMTU(%s, %d): %v", k.ifname, mtu, err)
+		}
+	}
+	return netlink.LinkSetUp(l)
+}
+
+func (k *kernelChannel) close() {
+	// Closing the unit removes the ppp interface, closing the socket ends
+	// the session in the kernel.
+	if k.unit != nil {
+		k.unit.Close()
+	}
+	if k.ch != nil {
+		k.ch.Close()
+	}
+	if k.sock != -1 {
+		unix.Close(k.sock)
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PPP protocol numbers.
+const (
+	protoIPv4   = 0x0021
+	protoIPv6   = 0x0057
+	protoIPCP   = 0x8021
+	protoIPV6CP = 0x8057
+	protoLCP    = 0xc021
+	protoPAP    = 0xc023
+	protoCHAP   = 0xc223
+)
+
+// Control protocol codes, see RFC 1661 section 5.
+const (
+	confReq    = 1
+	confAck    = 2
+	confNak    = 3
+	confRej    = 4
+	termReq    = 5
+	termAck    = 6
+	codeRej    = 7
+	protoRej   = 8
+	echoReq    = 9
+	echoReply  = 10
+	discardReq = 11
+)
+
+// LCP options.
+const (
+	lcpMRU   = 1
+	lcpAuth  = 3
+	lcpMagic = 5
+)
+
+// IPCP options, see RFC 1332 and RFC 1877.
+const (
+	ipcpAddr = 3
+	ipcpDNS1 = 129
+	ipcpDNS2 = 131
+)
+
+// IPV6CP options, see RFC 5072.
+const ipv6cpIfaceID = 1
+
+// chapMD5 is the CHAP algorithm of RFC 1994.
+const chapMD5 = 5
+
+// packet is a control protocol packet (LCP, IPCP, PAP, …).
+type packet struct {
+	code uint8
+	id   uint8
+	data []byte
+}
+
+func (p packet) marshal() []byte {
+	b := make([]byte, 4, 4+len(p.data))
+	b[0] = p.code
+	b[1] = p.id
+	binary.BigEndian.PutUint16(b[2:4], uint16(4+len(p.data)))
+	return append(b, p.data...)
+}
+
+func parsePacket(b []byte) (packet, error) {
+	if len(b) < 4 {
+		return packet{}, fmt.Errorf("packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return packet{}, fmt.Errorf("invalid packet length %d", length)
+	}
+	return packet{code: b[0], id: b[1], data: b[4:length]}, nil
+}
+
+type option struct {
+	typ  uint8
+	data []byte
+}
+
+func marshalOptions(opts []option) []byte {
+	var b []byte
+	for _, o := range opts {
+		b = append(b, o.typ, byte(2+len(o.data)))
+		b = append(b, o.data...)
+	}
+	return b
+}
+
+func parseOptions(b []byte) ([]option, error) {
+	var opts []option
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] < 2 || int(b[1]) > len(b) {
+			return nil, fmt.Errorf("invalid option")
+		}
+		opts = append(opts, option{typ: b[0], data: b[2:b[1]]})
+		b = b[b[1]:]
+	}
+	return opts, nil
+}
+
+// controlProtocol holds the negotiation state of one control protocol (LCP,
+// IPCP or IPV6CP). Instead of implementing the full state machine of RFC
+// 1661, it retransmits its Configure-Request until the peer acknowledges it,
+// and answers each Configure-Request of the peer; the protocol is opened once
+// both requests have been acknowledged.
+type controlProtocol struct {
+	proto uint16
+
+	// request returns the options of our Configure-Request.
+	request func() []option
+	// peer answers the Configure-Request of the peer with confAck,
+	// confNak or confRej and the options to include.
+	peer func(opts []option) (uint8, []option)
+	// nak and rej handle the peer's answer to our Configure-Request.
+	nak func(opts []option)
+	rej func(opts []option)
+
+	id      uint8 // of our last Configure-Request
+	sent    int   // number of Configure-Requests sent without an answer
+	ackRecv bool  // our Configure-Request was acknowledged
+	ackSent bool  // we acknowledged the peer's Configure-Request
+}
+
+func (c *controlProtocol) opened() bool { return c.ackRecv && c.ackSent }
+
+// answer partitions the options of a Configure-Request: if any option is
+// rejected (reject returns true), the rejected options are returned with
+// confRej; otherwise, if any option has a nak suggestion, those are returned
+// with confNak; otherwise the request is acknowledged.
+func answer(opts []option, reject func(option) bool, nak func(option) *option) (uint8, []option) {
+	var rejected, naked []option
+	for _, o := range opts {
+		if reject(o) {
+			rejected = append(rejected, o)
+			continue
+		}
+		if n := nak(o); n != nil {
+			naked = append(naked, *n)
+		}
+	}
+	if len(rejected) > 0 {
+		return confRej, rejected
+	}
+	if len(naked) > 0 {
+		return confNak, naked
+	}
+	return confAck, opts
+}
+
+// side is the client (session) or the server (serverSession) of a PPP
+// session: the behavior in which both differ, while endpoint implements what
+// they have in common.
+type side interface {
+	// handle processes a control protocol frame received from the peer.
+	handle(proto uint16, b []byte, now time.Time) error
+	// tick is called at least once per second, e.g. to retransmit.
+	tick(now time.Time) error
+	// opened is called when c reached the opened state.
+	opened(c *controlProtocol, now time.Time) error
+	// renegotiate is called when the peer sends a Configure-Request for
+	// the opened c, and returns an error unless that is acceptable.
+	renegotiate(c *controlProtocol) error
+	// retry is called after the peer answered our Configure-Request with
+	// a Configure-Nak or -Reject (passed to c.nak or c.rej), and returns
+	// whether to send another Configure-Request.
+	retry(c *controlProtocol) (bool, error)
+	// terminated is called after acknowledging a Terminate-Request for c.
+	terminated(c *controlProtocol) error
+	// protocolRejected is called when the peer rejects protocol proto.
+	protocolRejected(proto uint16) error
+}
+
+// endpoint holds the state which client and server sessions share: the
+// channel, LCP and the LCP keepalive.
+type endpoint struct {
+	ch     channel
+	lcp    *controlProtocol
+	sentAt map[*controlProtocol]time.Time
+
+	magic      uint32
+	lastEcho   time.Time
+	echoMissed int
+}
+
+func newEndpoint(ch channel) endpoint {
+	return endpoint{
+		ch:     ch,
+		sentAt: make(map[*controlProtocol]time.Time),
+		magic:  binary.BigEndian.Uint32(random(4)),
+	}
+}
+
+func (e *endpoint) write(proto uint16, p packet) error {
+	return e.ch.writeFrame(proto, p.marshal())
+}
+
+func (e *endpoint) sendRequest(c *controlProtocol, now time.Time) error {
+	c.id++
+	c.sent++
+	e.sentAt[c] = now
+	return e.write(c.proto, packet{code: confReq, id: c.id, data: marshalOptions(c.request())})
+}
+
+// handleControl negotiates c with the peer, calling s.opened once c reached
+// the opened state, and answers LCP echo requests.
+func (e *endpoint) handleControl(s side, c *controlProtocol, p packet, now time.Time) error {
+	wasOpened := c.opened()
+	switch p.code {
+	case confReq:
+		opts, err := parseOptions(p.data)
+		if err != nil {
+			return nil // ignore malformed requests
+		}
+		if wasOpened {
+			if err := s.renegotiate(c); err != nil {
+				return err
+			}
+		}
+		code, resp := c.peer(opts)
+		data := p.data
+		if code != confAck {
+			data = marshalOptions(resp)
+		}
+		if err := e.write(c.proto, packet{code: code, id: p.id, data: data}); err != nil {
+			return err
+		}
+		c.ackSent = code == confAck
+
+	case confAck:
+		if p.id != c.id || c.ackRecv {
+			return nil
+		}
+		c.ackRecv = true
+		c.sent = 0
+
+	case confNak, confRej:
+		if p.id != c.id || c.ackRecv {
+			return nil
+		}
+		opts, err := parseOptions(p.data)
+		if err != nil {
+			return nil
+		}
+		if p.code == confNak {
+			c.nak(opts)
+		} else {
+			c.rej(opts)
+		}
+		retry, err := s.retry(c)
+		if err != nil || !retry {
+			return err
+		}
+		return e.sendRequest(c, now)
+
+	case termReq:
+		if err := e.write(c.proto, packet{code: termAck, id: p.id}); err != nil {
+			return err
+		}
+		return s.terminated(c)
+
+	case protoRej:
+		if c == e.lcp && len(p.data) >= 2 {
+			if err := s.protocolRejected(binary.BigEndian.Uint16(p.data)); err != nil {
+				return err
+			}
+		}
+
+	case echoReq:
+		if c == e.lcp && wasOpened {
+			data := u32(e.magic)
+			if len(p.data) > 4 {
+				data = append(data, p.data[4:]...)
+			}
+			return e.write(protoLCP, packet{code: echoReply, id: p.id, data: data})
+		}
+
+	case echoReply:
+		if c == e.lcp {
+			e.echoMissed = 0
+		}
+	}
+	if !wasOpened && c.opened() {
+		return s.opened(c, now)
+	}
+	return nil
+}
+
+// keepalive sends an LCP echo request every echoInterval and fails once the
+// peer missed answering maxEchoFailures of them.
+func (e *endpoint) keepalive(now time.Time, peer string) error {
+	if now.Sub(e.lastEcho) < echoInterval {
+		return nil
+	}
+	if e.echoMissed >= maxEchoFailures {
+		return fmt.Errorf("%s did not answer %d LCP echo requests", peer, e.echoMissed)
+	}
+	e.echoMissed++
+	e.lastEcho = now
+	e.lcp.id++
+	return e.write(protoLCP, packet{code: echoReq, id: e.lcp.id, data: u32(e.magic)})
+}
+
+// run negotiates the session of s and keeps it alive until done is closed (in
+// which case the session is terminated and nil is returned) or an error
+// occurs.
+func (e *endpoint) run(s side, done <-chan struct{}) error {
+	if err := e.sendRequest(e.lcp, time.Now()); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-done:
+			e.lcp.id++
+			return e.write(protoLCP, packet{code: termReq, id: e.lcp.id})
+		default:
+		}
+		proto, b, err := e.ch.readFrame(time.Now().Add(1 * time.Second))
+		now := time.Now()
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				return err
+			}
+		} else if err := s.handle(proto, b, now); err != nil {
+			return err
+		}
+		if err := s.tick(now); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pppoe implements a PPPoE client (RFC 2516) for uplinks of ISPs which
+// require PPPoE with credentials instead of DHCP.
+//
+// The discovery stage and the PPP control protocols (LCP with PAP or CHAP-MD5
+// authentication, IPCP and IPV6CP) are implemented in Go; the session itself
+// is handed to the kernel (pppoe and ppp_generic modules), which creates the
+// ppp interface and forwards packets without copying them to user space.
+//
+// Server implements the other end (the access concentrator), with local or
+// RADIUS authentication.
+package pppoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/mdlayher/raw"
+)
+
+// Config is the PPPoE configuration, read from pppoe.json.
+type Config struct {
+	Interface   string `json:"interface"` // ethernet interface, default uplink0
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	ServiceName string `json:"service_name"` // optional
+	ACName      string `json:"ac_name"`      // optional: only use this access concentrator
+}
+
+// ReadConfig reads pppoe.json in dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pppoe.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Interface == "" {
+		cfg.Interface = "uplink0"
+	}
+	if cfg.Username == "" {
+		return cfg, fmt.Errorf("pppoe.json: username not set")
+	}
+	return cfg, nil
+}
+
+// Lease is the configuration negotiated for a session, which is written to
+// pppoe/wire/lease.json for netconfig, like the DHCP leases.
+type Lease struct {
+	Interface     string   `json:"interface"` // e.g. ppp0
+	ClientIP      string   `json:"client_ip"`
+	PeerIP        string   `json:"peer_ip"`
+	DNS           []string `json:"dns"`
+	MTU           int      `json:"mtu"`
+	LinkLocal     string   `json:"link_local,omitempty"` // from the IPV6CP interface identifier
+	PeerLinkLocal string   `json:"peer_link_local,omitempty"`
+	Session       uint16   `json:"session_id"`
+	ACName        string   `json:"ac_name"`
+}
+
+// Run establishes a PPPoE session on cfg.Interface, creating interface
+// ppp<unit>. onUp is called with the lease once IPCP is opened, and again once
+// IPV6CP is opened. Run returns when the session ends: nil when done was
+// closed (in which case the session was terminated), otherwise the error.
+func Run(cfg Config, unit int, done <-chan struct{}, onUp func(Lease)) error {
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return err
+	}
+	conn, err := raw.ListenPacket(iface, etherTypeDiscovery, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	dc := &discoveryConn{conn: conn, hwaddr: iface.HardwareAddr}
+	d, err := dc.discover(cfg.ServiceName, cfg.ACName, random(8))
+	if err != nil {
+		return err
+	}
+	defer dc.terminate(d.ac, d.session)
+
+	k, err := newKernelChannel(cfg.Interface, d, unit)
+	if err != nil {
+		return err
+	}
+	defer k.close()
+
+	s := newSession(k, cfg.Username, cfg.Password)
+	s.onUp = onUp
+	s.lease = Lease{
+		Interface: k.ifname,
+		Session:   d.session,
+		ACName:    d.acName,
+	}
+	if err := s.run(done); err != nil {
+		return fmt.Errorf("session %d with %s (%v): %v", d.session, d.acName, d.ac, err)
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"crypto/md5"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiscoveryPacket(t *testing.T) {
+	p := &discoveryPacket{
+		code:    codePADS,
+		session: 0x1234,
+		tags: []tag{
+			{typ: tagServiceName, data: []byte{}},
+			{typ: tagACName, data: []byte("BRAS-1")},
+			{typ: tagHostUniq, data: []byte{1, 2, 3, 4}},
+		},
+	}
+	b := p.marshal()
+	got, err := parseDiscovery(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(p, got, cmp.AllowUnexported(discoveryPacket{}, tag{})); diff != "" {
+		t.Errorf("parseDiscovery(marshal()): diff (-want +got):\n%s", diff)
+	}
+	if name, _ := got.tag(tagACName); string(name) != "BRAS-1" {
+		t.Errorf("AC-Name = %q, want BRAS-1", name)
+	}
+	for i := 0; i < len(b); i++ {
+		parseDiscovery(b[:i]) // must not panic
+	}
+
+	p.tags = append(p.tags, tag{typ: tagServiceNameError, data: []byte("no such service")})
+	if err := p.err(); err == nil {
+		t.Errorf("err() = nil for a Service-Name-Error")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type frame struct {
+	proto uint16
+	b     []byte
+}
+
+// fakeChannel connects a session to the test, which plays the peer.
+type fakeChannel struct {
+	toSession   chan frame
+	fromSession chan frame
+	enabled     chan uint16
+}
+
+func (c *fakeChannel) readFrame(deadline time.Time) (uint16, []byte, error) {
+	select {
+	case f := <-c.toSession:
+		return f.proto, f.b, nil
+	case <-time.After(time.Until(deadline)):
+		return 0, nil, timeoutError{}
+	}
+}
+
+func (c *fakeChannel) writeFrame(proto uint16, b []byte) error {
+	c.fromSession <- frame{proto, append([]byte(nil), b...)}
+	return nil
+}
+
+func (c *fakeChannel) enable(proto uint16, mtu int) error {
+	c.enabled <- proto
+	return nil
+}
+
+type fakePeer struct {
+	t  *testing.T
+	ch *fakeChannel
+}
+
+// read returns the next packet of the session, which must be of protocol
+// proto and have the specified code. LCP echo requests are skipped.
+func (p *fakePeer) read(proto uint16, code uint8) packet {
+	p.t.Helper()
+	for {
+		var f frame
+		select {
+		case f = <-p.ch.fromSession:
+		case <-time.After(5 * time.Second):
+			p.t.Fatalf("timeout waiting for %#x code %d", proto, code)
+		}
+		pkt, err := parsePacket(f.b)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if f.proto == protoLCP && pkt.code == echoReq {
+			continue
+		}
+		if f.proto != proto || pkt.code != code {
+			p.t.Fatalf("got %#x code %d (%x), want %#x code %d", f.proto, pkt.code, pkt.data, proto, code)
+		}
+		return pkt
+	}
+}
+
+func (p *fakePeer) readOptions(proto uint16, code uint8) (uint8, []option) {
+	p.t.Helper()
+	pkt := p.read(proto, code)
+	opts, err := parseOptions(pkt.data)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return pkt.id, opts
+}
+
+func (p *fakePeer) write(proto uint16, pkt packet) {
+	p.ch.toSession <- frame{proto, pkt.marshal()}
+}
+
+func TestSession(t *testing.T) {
+	ch := &fakeChannel{
+		toSession:   make(chan frame),
+		fromSession: make(chan frame, 10),
+		enabled:     make(chan uint16, 2),
+	}
+	leases := make(chan Lease, 2)
+	s := newSession(ch, "user@isp", "secret")
+	s.onUp = func(l Lease) { leases <- l }
+	s.lease = Lease{Interface: "ppp0", Session: 0x1234, ACName: "BRAS-1"}
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() { errc <- s.run(done) }()
+	p := &fakePeer{t: t, ch: ch}
+
+	// LCP
+	id, opts := p.readOptions(protoLCP, confReq)
+	if got, want := len(opts), 2; got != want {
+		t.Fatalf("LCP Configure-Request: %d options, want %d", got, want)
+	}
+	p.write(protoLCP, packet{code: confAck, id: id, data: marshalOptions(opts)})
+	peerLCP := marshalOptions([]option{
+		{typ: lcpMRU, data: u16(1492)},
+		{typ: lcpAuth, data: u16(protoPAP)},
+		{typ: lcpMagic, data: u32(0xdeadbeef)},
+	})
+	p.write(protoLCP, packet{code: confReq, id: 1, data: peerLCP})
+	if pkt := p.read(protoLCP, confAck); string(pkt.data) != string(peerLCP) {
+		t.Fatalf("LCP Configure-Ack does not echo the request")
+	}
+
+	// PAP
+	pkt := p.read(protoPAP, 1)
+	if got, want := pkt.data, append(append([]byte{8}, "user@isp"...), append([]byte{6}, "secret"...)...); string(got) != string(want) {
+		t.Fatalf("PAP Authenticate-Request = %q, want %q", got, want)
+	}
+	p.write(protoPAP, packet{code: 2, id: pkt.id})
+
+	// IPCP: the peer assigns the address and DNS servers via Configure-Nak.
+	id, opts = p.readOptions(protoIPCP, confReq)
+	if got, want := len(opts), 3; got != want {
+		t.Fatalf("IPCP Configure-Request: %d options, want %d", got, want)
+	}
+	v6id, v6opts := p.readOptions(protoIPV6CP, confReq)
+	p.write(protoIPCP, packet{code: confNak, id: id, data: marshalOptions([]option{
+		{typ: ipcpAddr, data: net.ParseIP("198.51.100.7").To4()},
+		{typ: ipcpDNS1, data: net.ParseIP("192.0.2.53").To4()},
+		{typ: ipcpDNS2, data: net.ParseIP("192.0.2.54").To4()},
+	})})
+	id, opts = p.readOptions(protoIPCP, confReq)
+	if got, want := net.IP(opts[0].data).String(), "198.51.100.7"; got != want {
+		t.Fatalf("IPCP Configure-Request after Nak: address %s, want %s", got, want)
+	}
+	p.write(protoIPCP, packet{code: confAck, id: id, data: marshalOptions(opts)})
+	p.write(protoIPCP, packet{code: confReq, id: 1, data: marshalOptions([]option{
+		{typ: ipcpAddr, data: net.ParseIP("198.51.100.1").To4()},
+	})})
+	p.read(protoIPCP, confAck)
+	if got, want := <-ch.enabled, uint16(protoIPv4); got != want {
+		t.Fatalf("enabled protocol %#x, want %#x", got, want)
+	}
+	want := Lease{
+		Interface: "ppp0",
+		ClientIP:  "198.51.100.7",
+		PeerIP:    "198.51.100.1",
+		DNS:       []string{"192.0.2.53", "192.0.2.54"},
+		MTU:       1492,
+		Session:   0x1234,
+		ACName:    "BRAS-1",
+	}
+	if diff := cmp.Diff(want, <-leases); diff != "" {
+		t.Fatalf("lease: diff (-want +got):\n%s", diff)
+	}
+
+	// IPV6CP
+	p.write(protoIPV6CP, packet{code: confAck, id: v6id, data: marshalOptions(v6opts)})
+	p.write(protoIPV6CP, packet{code: confReq, id: 1, data: marshalOptions([]option{
+		{typ: ipv6cpIfaceID, data: []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+	})})
+	p.read(protoIPV6CP, confAck)
+	<-ch.enabled
+	want.LinkLocal = (&session{}).linkLocal(v6opts[0].data)
+	want.PeerLinkLocal = "fe80::1"
+	if diff := cmp.Diff(want, <-leases); diff != "" {
+		t.Fatalf("lease after IPV6CP: diff (-want +got):\n%s", diff)
+	}
+
+	// Keepalive
+	p.write(protoLCP, packet{code: echoReq, id: 7, data: u32(0xdeadbeef)})
+	p.read(protoLCP, echoReply)
+
+	close(done)
+	p.read(protoLCP, termReq)
+	if err := <-errc; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
+
+func TestCHAP(t *testing.T) {
+	ch := &fakeChannel{fromSession: make(chan frame, 10)}
+	s := newSession(ch, "user@isp", "secret")
+	s.auth = protoCHAP
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	p := packet{code: 1, id: 42, data: append(append([]byte{byte(len(challenge))}, challenge...), "BRAS-1"...)}
+	if err := s.handleCHAP(p, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	f := <-ch.fromSession
+	resp, err := parsePacket(f.b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(append(append([]byte{42}, "secret"...), challenge...))
+	want := append(append([]byte{md5.Size}, sum[:]...), "user@isp"...)
+	if f.proto != protoCHAP || resp.code != 2 || resp.id != 42 || string(resp.data) != string(want) {
+		t.Fatalf("CHAP response = %#x %+v, want code 2, id 42, data %x", f.proto, resp, want)
+	}
+
+	if err := s.handleCHAP(packet{code: 4, id: 42, data: []byte("denied")}, time.Now()); err == nil {
+		t.Fatalf("CHAP Failure did not result in an error")
+	}
+}
+
+// pipe returns two channels which are connected to each other, e.g. to run a
+// client session against a server session.
+func pipe() (*fakeChannel, *fakeChannel) {
+	ab := make(chan frame, 100)
+	ba := make(chan frame, 100)
+	return &fakeChannel{toSession: ba, fromSession: ab, enabled: make(chan uint16, 2)},
+		&fakeChannel{toSession: ab, fromSession: ba, enabled: make(chan uint16, 2)}
+}
+
+func TestServerSession(t *testing.T) {
+	users := []User{{Username: "alice", Password: "secret"}}
+	for _, auth := range []uint16{protoCHAP, protoPAP} {
+		clientCh, serverCh := pipe()
+		srv := newServerSession(serverCh, auth, net.ParseIP("10.64.0.1"), net.ParseIP("10.64.0.2"), []net.IP{net.ParseIP("192.0.2.53")})
+		srv.authenticate = func(req authRequest) (authResult, error) {
+			return authResult{}, verifyLocal(users, req)
+		}
+		up := make(chan struct{}, 1)
+		srv.onUp = func() error {
+			up <- struct{}{}
+			return nil
+		}
+		leases := make(chan Lease, 2)
+		client := newSession(clientCh, "alice", "secret")
+		client.onUp = func(l Lease) { leases <- l }
+
+		serverDone, clientDone := make(chan struct{}), make(chan struct{})
+		serverErr, clientErr := make(chan error, 1), make(chan error, 1)
+		go func() { serverErr <- srv.run(serverDone) }()
+		go func() { clientErr <- client.run(clientDone) }()
+
+		var l Lease
+		select {
+		case l = <-leases:
+		case err := <-serverErr:
+			t.Fatalf("auth %#x: server: %v", auth, err)
+		case err := <-clientErr:
+			t.Fatalf("auth %#x: client: %v", auth, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("auth %#x: timeout waiting for the session to come up", auth)
+		}
+		<-up
+		want := Lease{
+			ClientIP: "10.64.0.2",
+			PeerIP:   "10.64.0.1",
+			DNS:      []string{"192.0.2.53", "192.0.2.53"},
+			MTU:      maxMRU,
+		}
+		if diff := cmp.Diff(want, l); diff != "" {
+			t.Errorf("auth %#x: lease: diff (-want +got):\n%s", auth, diff)
+		}
+		if got := srv.username; got != "alice" {
+			t.Errorf("auth %#x: username = %q, want alice", auth, got)
+		}
+
+		// The client ends the session.
+		close(clientDone)
+		if err := <-clientErr; err != nil {
+			t.Errorf("auth %#x: client: %v", auth, err)
+		}
+		if err := <-serverErr; err != ErrTerminated {
+			t.Errorf("auth %#x: server: %v, want %v", auth, err, ErrTerminated)
+		}
+	}
+}
+
+func TestServerSessionAuthFailure(t *testing.T) {
+	clientCh, serverCh := pipe()
+	srv := newServerSession(serverCh, protoCHAP, net.ParseIP("10.64.0.1"), net.ParseIP("10.64.0.2"), nil)
+	srv.authenticate = func(req authRequest) (authResult, error) {
+		return authResult{}, verifyLocal([]User{{Username: "alice", Password: "secret"}}, req)
+	}
+	client := newSession(clientCh, "alice", "guess")
+	done := make(chan struct{})
+	defer close(done)
+	serverErr, clientErr := make(chan error, 1), make(chan error, 1)
+	go func() { serverErr <- srv.run(done) }()
+	go func() { clientErr <- client.run(done) }()
+	if err := <-serverErr; err == nil {
+		t.Errorf("server: session with wrong password did not fail")
+	}
+	if err := <-clientErr; err == nil {
+		t.Errorf("client: session with wrong password did not fail")
+	}
+}
+
+func TestServerDiscovery(t *testing.T) {
+	addrs, err := poolAddrs("10.64.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(addrs), 2; got != want {
+		t.Fatalf("poolAddrs(/30): %d addresses, want %d", got, want)
+	}
+	s := &Server{
+		cfg:       ServerConfig{ACName: "router7", ServiceName: "lab"},
+		cookieKey: []byte("key"),
+		serverIP:  addrs[0],
+		clients:   addrs[1:],
+		sessions:  make(map[uint16]*serverSessionState),
+		slots:     make([]bool, 1),
+	}
+	client := net.HardwareAddr{0x22, 0xb3, 0x67, 0xfb, 0xc4, 0x41}
+	other := net.HardwareAddr{0x22, 0xb3, 0x67, 0xfb, 0xc4, 0x42}
+	padi := &discoveryPacket{code: codePADI, tags: []tag{
+		{typ: tagServiceName, data: []byte{}},
+		{typ: tagHostUniq, data: []byte{1, 2, 3, 4}},
+	}}
+	pado := s.offer(padi, client)
+	if name, _ := pado.tag(tagACName); string(name) != "router7" {
+		t.Errorf("PADO AC-Name = %q, want router7", name)
+	}
+	if uniq, _ := pado.tag(tagHostUniq); string(uniq) != "\x01\x02\x03\x04" {
+		t.Errorf("PADO Host-Uniq = %x, want 01020304", uniq)
+	}
+	if p := s.offer(&discoveryPacket{code: codePADI, tags: []tag{{typ: tagServiceName, data: []byte("other")}}}, client); p != nil {
+		t.Errorf("PADO for a service which is not offered")
+	}
+
+	cookie, _ := pado.tag(tagACCookie)
+	padr := &discoveryPacket{code: codePADR, tags: append(padi.tags, tag{typ: tagACCookie, data: cookie})}
+	if pads, _ := s.confirm(padr, other); pads != nil {
+		t.Errorf("PADS for a cookie of a different client")
+	}
+	pads, st := s.confirm(padr, client)
+	if st == nil || pads.session == 0 || pads.session != st.id {
+		t.Fatalf("confirm = %+v, %+v, want a new session", pads, st)
+	}
+	// A retransmitted PADR gets the same session.
+	if again, st := s.confirm(padr, client); st != nil || again.session != pads.session {
+		t.Errorf("confirm(retransmitted PADR) = session %d, want %d", again.session, pads.session)
+	}
+	// The pool is exhausted.
+	cookie = s.cookie(other)
+	padr = &discoveryPacket{code: codePADR, tags: []tag{{typ: tagACCookie, data: cookie}}}
+	if pads, st := s.confirm(padr, other); st != nil || pads.err() == nil {
+		t.Errorf("confirm with exhausted pool = %+v, %+v, want error", pads, st)
+	}
+
+	s.end(pads.session, other, 1) // not the session of other: ignored
+	select {
+	case <-st.done:
+		t.Errorf("PADT of a different client ended the session")
+	default:
+	}
+	s.end(pads.session, client, 1)
+	<-st.done
+}
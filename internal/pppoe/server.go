@@ -0,0 +1,504 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/raw"
+	"github.com/vishvananda/netlink"
+
+	"github.com/rtr7/router7/internal/radius"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// serverUnitBase is the number of the ppp interface of the first server
+// session, which leaves the lower numbers (e.g. ppp0) to the client.
+const serverUnitBase = 100
+
+// User is a local account of the PPPoE server.
+type User struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ServerConfig is the PPPoE server (access concentrator) configuration,
+// read from pppoed.json.
+type ServerConfig struct {
+	Interface   string `json:"interface"`    // e.g. lan0 or a VLAN interface
+	ACName      string `json:"ac_name"`      // default: router7
+	ServiceName string `json:"service_name"` // optional: only offer this service
+
+	// Pool contains the addresses of the sessions, e.g. 10.64.0.0/24: the
+	// first host address is the address of the server end of all sessions,
+	// the others are assigned to the clients.
+	Pool string   `json:"pool"`
+	DNS  []string `json:"dns"` // assigned to the clients via IPCP
+
+	Auth   string         `json:"auth"`   // chap (default) or pap
+	Users  []User         `json:"users"`  // local accounts, if radius is not set
+	Radius *radius.Config `json:"radius"` // authentication (and accounting) server
+}
+
+// ReadServerConfig reads pppoed.json in dir.
+func ReadServerConfig(dir string) (ServerConfig, error) {
+	var cfg ServerConfig
+	b, err := ioutil.ReadFile(filepath.Join(dir, "pppoed.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("pppoed.json: %v", err)
+	}
+	if cfg.Interface == "" {
+		return cfg, fmt.Errorf("pppoed.json: interface not set")
+	}
+	if cfg.ACName == "" {
+		cfg.ACName = "router7"
+	}
+	if _, err := poolAddrs(cfg.Pool); err != nil {
+		return cfg, fmt.Errorf("pppoed.json: %v", err)
+	}
+	for _, s := range cfg.DNS {
+		if net.ParseIP(s).To4() == nil {
+			return cfg, fmt.Errorf("pppoed.json: invalid DNS server %q", s)
+		}
+	}
+	if len(cfg.DNS) > 2 {
+		return cfg, fmt.Errorf("pppoed.json: IPCP assigns at most 2 DNS servers, got %d", len(cfg.DNS))
+	}
+	switch cfg.Auth {
+	case "":
+		cfg.Auth = "chap"
+	case "chap", "pap":
+	default:
+		return cfg, fmt.Errorf("pppoed.json: unknown auth %q (want chap or pap)", cfg.Auth)
+	}
+	if cfg.Radius != nil {
+		if err := cfg.Radius.Validate(); err != nil {
+			return cfg, fmt.Errorf("pppoed.json: %v", err)
+		}
+	} else if len(cfg.Users) == 0 {
+		return cfg, fmt.Errorf("pppoed.json: neither users nor radius configured")
+	}
+	return cfg, nil
+}
+
+// poolAddrs returns the host addresses of the IPv4 network pool: the first is
+// the address of the server, the others are assigned to the clients.
+func poolAddrs(pool string) ([]net.IP, error) {
+	ip, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool: %v", err)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("invalid pool %q: not an IPv4 network", pool)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 || bits-ones > 16 {
+		return nil, fmt.Errorf("invalid pool %q: want a prefix length between /16 and /30", pool)
+	}
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	var addrs []net.IP
+	for i := uint32(1); i < 1<<uint(bits-ones)-1; i++ {
+		addr := make(net.IP, 4)
+		binary.BigEndian.PutUint32(addr, base+i)
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// serverSessionState is a session of the Server.
+type serverSessionState struct {
+	id       uint16
+	peer     net.HardwareAddr
+	hostUniq []byte
+	slot     int // index into Server.clients
+	done     chan struct{}
+	cause    int // radius termination cause, if ended by the server
+}
+
+// Server answers the discovery stage on an interface and runs a session for
+// each client, on interface ppp<serverUnitBase+n>.
+type Server struct {
+	cfg       ServerConfig
+	dc        *discoveryConn
+	radius    *radius.Client
+	cookieKey []byte
+	serverIP  net.IP
+	clients   []net.IP
+	dns       []net.IP
+
+	mu       sync.Mutex
+	sessions map[uint16]*serverSessionState
+	slots    []bool // in use, by index into clients
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a Server for cfg, listening on cfg.Interface.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	addrs, err := poolAddrs(cfg.Pool)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(cfg.Interface)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := raw.ListenPacket(iface, etherTypeDiscovery, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:       cfg,
+		dc:        &discoveryConn{conn: conn, hwaddr: iface.HardwareAddr},
+		cookieKey: random(32),
+		serverIP:  addrs[0],
+		clients:   addrs[1:],
+		sessions:  make(map[uint16]*serverSessionState),
+		slots:     make([]bool, len(addrs)-1),
+	}
+	for _, d := range cfg.DNS {
+		s.dns = append(s.dns, net.ParseIP(d).To4())
+	}
+	if cfg.Radius != nil {
+		s.radius = radius.NewClient(*cfg.Radius)
+	}
+	return s, nil
+}
+
+// cookie returns the AC-Cookie for the client with hardware address hwaddr,
+// which allows verifying a PADR without keeping state for each PADI.
+func (s *Server) cookie(hwaddr net.HardwareAddr) []byte {
+	mac := hmac.New(sha256.New, s.cookieKey)
+	mac.Write(hwaddr)
+	return mac.Sum(nil)[:16]
+}
+
+// serves returns whether the server offers the service requested by p.
+func (s *Server) serves(p *discoveryPacket) bool {
+	name, _ := p.tag(tagServiceName)
+	return len(name) == 0 || string(name) == s.cfg.ServiceName
+}
+
+// reply returns the tags which are echoed from client packet p.
+func reply(p *discoveryPacket) []tag {
+	var tags []tag
+	for _, typ := range []uint16{tagHostUniq, tagRelaySessionID} {
+		if data, ok := p.tag(typ); ok {
+			tags = append(tags, tag{typ: typ, data: data})
+		}
+	}
+	return tags
+}
+
+// offer returns the PADO for PADI p of client src, or nil if the requested
+// service is not offered.
+func (s *Server) offer(p *discoveryPacket, src net.HardwareAddr) *discoveryPacket {
+	if !s.serves(p) {
+		return nil
+	}
+	return &discoveryPacket{
+		code: codePADO,
+		tags: append([]tag{
+			{typ: tagACName, data: []byte(s.cfg.ACName)},
+			{typ: tagServiceName, data: []byte(s.cfg.ServiceName)},
+			{typ: tagACCookie, data: s.cookie(src)},
+		}, reply(p)...),
+	}
+}
+
+// confirm handles PADR p of client src: it returns the PADS, and the new
+// session (nil if the PADR was refused or retransmitted).
+func (s *Server) confirm(p *discoveryPacket, src net.HardwareAddr) (*discoveryPacket, *serverSessionState) {
+	pads := &discoveryPacket{
+		code: codePADS,
+		tags: append([]tag{{typ: tagServiceName, data: []byte(s.cfg.ServiceName)}}, reply(p)...),
+	}
+	if cookie, _ := p.tag(tagACCookie); !hmac.Equal(cookie, s.cookie(src)) {
+		return nil, nil // not a response to our PADO
+	}
+	if !s.serves(p) {
+		pads.tags = append(pads.tags, tag{typ: tagServiceNameError, data: []byte("service not offered")})
+		return pads, nil
+	}
+	hostUniq, _ := p.tag(tagHostUniq)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.sessions {
+		if bytes.Equal(st.peer, src) && bytes.Equal(st.hostUniq, hostUniq) {
+			// Retransmitted PADR: our PADS was lost.
+			pads.session = st.id
+			return pads, nil
+		}
+	}
+	slot := -1
+	for i, used := range s.slots {
+		if !used {
+			slot = i
+			break
+		}
+	}
+	if slot == -1 {
+		pads.tags = append(pads.tags, tag{typ: tagACSystemError, data: []byte("no free addresses")})
+		return pads, nil
+	}
+	var id uint16
+	for id == 0 || s.sessions[id] != nil {
+		id = binary.BigEndian.Uint16(random(2))
+	}
+	st := &serverSessionState{
+		id:       id,
+		peer:     src,
+		hostUniq: append([]byte(nil), hostUniq...),
+		slot:     slot,
+		done:     make(chan struct{}),
+	}
+	s.sessions[id] = st
+	s.slots[slot] = true
+	pads.session = id
+	return pads, st
+}
+
+// end makes the session with id (of client src) terminate, with the radius
+// termination cause.
+func (s *Server) end(id uint16, src net.HardwareAddr, cause int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.sessions[id]
+	if !ok || (src != nil && !bytes.Equal(st.peer, src)) || st.cause != 0 {
+		return
+	}
+	st.cause = cause
+	close(st.done)
+}
+
+// authenticator returns the function which verifies the credentials of the
+// client with hardware address hwaddr against the local accounts or the
+// RADIUS server.
+func (s *Server) authenticator(hwaddr net.HardwareAddr) func(authRequest) (authResult, error) {
+	return func(req authRequest) (authResult, error) {
+		if s.radius != nil {
+			accept, err := s.radius.Authenticate(radius.Request{
+				Username:         req.username,
+				Password:         req.password,
+				CHAPID:           req.chapID,
+				CHAPChallenge:    req.challenge,
+				CHAPResponse:     req.response,
+				CallingStationID: hwaddr.String(),
+			})
+			if err != nil {
+				return authResult{}, err
+			}
+			return authResult{clientIP: accept.FramedIP, timeout: accept.SessionTimeout}, nil
+		}
+		return authResult{}, verifyLocal(s.cfg.Users, req)
+	}
+}
+
+// verifyLocal verifies req against the local accounts users.
+func verifyLocal(users []User, req authRequest) error {
+	for _, u := range users {
+		if u.Username != req.username {
+			continue
+		}
+		if req.response != nil {
+			h := md5.New()
+			h.Write([]byte{req.chapID})
+			h.Write([]byte(u.Password))
+			h.Write(req.challenge)
+			if subtle.ConstantTimeCompare(h.Sum(nil), req.response) == 1 {
+				return nil
+			}
+		} else if subtle.ConstantTimeCompare([]byte(u.Password), []byte(req.password)) == 1 {
+			return nil
+		}
+		break
+	}
+	return fmt.Errorf("invalid credentials")
+}
+
+// configure assigns the server address and the peer (client) address to the
+// ppp interface ifname.
+func configure(ifname string, serverIP, clientIP net.IP) error {
+	l, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrReplace(l, &netlink.Addr{
+		IPNet: &net.IPNet{IP: serverIP, Mask: net.CIDRMask(32, 32)},
+		Peer:  &net.IPNet{IP: clientIP, Mask: net.CIDRMask(32, 32)},
+	})
+}
+
+// runSession runs session st until it ends, and releases it.
+func (s *Server) runSession(st *serverSessionState) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.sessions, st.id)
+		s.slots[st.slot] = false
+	}()
+	defer s.dc.terminate(st.peer, st.id)
+
+	k, err := newKernelChannel(s.cfg.Interface, &discovery{session: st.id, ac: st.peer}, serverUnitBase+st.slot)
+	if err != nil {
+		log.Printf("session %d with %v: %v", st.id, st.peer, err)
+		return
+	}
+	defer k.close()
+
+	auth := uint16(protoCHAP)
+	if s.cfg.Auth == "pap" {
+		auth = protoPAP
+	}
+	ss := newServerSession(k, auth, s.serverIP, s.clients[st.slot], s.dns)
+	ss.authenticate = s.authenticator(st.peer)
+	var (
+		up   time.Time
+		acct radius.Accounting
+	)
+	ss.onUp = func() error {
+		if err := configure(k.ifname, s.serverIP, ss.clientIP); err != nil {
+			return err
+		}
+		up = time.Now()
+		log.Printf("session %d: %q (%v) up on %s with %v", st.id, ss.username, st.peer, k.ifname, ss.clientIP)
+		if s.radius != nil {
+			acct = radius.Accounting{
+				SessionID:        fmt.Sprintf("%08X-%04X", up.Unix(), st.id),
+				Username:         ss.username,
+				CallingStationID: st.peer.String(),
+				FramedIP:         ss.clientIP,
+			}
+			start := acct
+			start.Status = radius.Start
+			go func() {
+				if err := s.radius.Account(start); err != nil {
+					log.Printf("session %d: accounting: %v", st.id, err)
+				}
+			}()
+		}
+		return nil
+	}
+	err = ss.run(st.done)
+	s.mu.Lock()
+	cause := st.cause
+	s.mu.Unlock()
+	switch {
+	case cause != 0:
+	case err == ErrTerminated:
+		cause = radius.CauseUserRequest
+	case err == errSessionTimeout:
+		cause = radius.CauseSessionTimeout
+	default:
+		cause = radius.CauseLostCarrier
+	}
+	log.Printf("session %d: %q (%v) ended (cause %d): %v", st.id, ss.username, st.peer, cause, err)
+	if s.radius == nil || up.IsZero() {
+		return
+	}
+	acct.Status = radius.Stop
+	acct.SessionTime = time.Since(up)
+	acct.TerminateCause = cause
+	if l, err := netlink.LinkByName(k.ifname); err == nil && l.Attrs().Statistics != nil {
+		stats := l.Attrs().Statistics
+		acct.InputOctets = stats.RxBytes
+		acct.OutputOctets = stats.TxBytes
+		acct.InputPackets = uint32(stats.RxPackets)
+		acct.OutputPackets = uint32(stats.TxPackets)
+	}
+	if err := s.radius.Account(acct); err != nil {
+		log.Printf("session %d: accounting: %v", st.id, err)
+	}
+}
+
+// Serve answers the discovery stage until the Server is closed.
+func (s *Server) Serve() error {
+	buf := make([]byte, 1500+ethernetHdrLen)
+	for {
+		n, _, err := s.dc.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		frame := buf[:n]
+		if n < ethernetHdrLen || binary.BigEndian.Uint16(frame[12:14]) != etherTypeDiscovery {
+			continue
+		}
+		if dst := frame[0:6]; !bytes.Equal(dst, s.dc.hwaddr) && !bytes.Equal(dst, layers.EthernetBroadcast) {
+			continue
+		}
+		p, err := parseDiscovery(frame[ethernetHdrLen:])
+		if err != nil {
+			continue
+		}
+		src := append(net.HardwareAddr(nil), frame[6:12]...)
+		switch p.code {
+		case codePADI:
+			if pado := s.offer(p, src); pado != nil {
+				if err := s.dc.send(src, pado); err != nil {
+					log.Printf("PADO to %v: %v", src, err)
+				}
+			}
+
+		case codePADR:
+			pads, st := s.confirm(p, src)
+			if pads == nil {
+				continue
+			}
+			if err := s.dc.send(src, pads); err != nil {
+				log.Printf("PADS to %v: %v", src, err)
+			}
+			if st != nil {
+				s.wg.Add(1)
+				go s.runSession(st)
+			}
+
+		case codePADT:
+			s.end(p.session, src, radius.CauseUserRequest)
+		}
+	}
+}
+
+// Close terminates all sessions and makes Serve return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	var ids []uint16
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		s.end(id, nil, radius.CauseAdminReset)
+	}
+	s.wg.Wait()
+	return s.dc.conn.Close()
+}
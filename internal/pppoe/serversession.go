@@ -0,0 +1,411 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// authTimeout is how long a client may take to authenticate after LCP is
+// opened.
+const authTimeout = 30 * time.Second
+
+var errSessionTimeout = errors.New("session timeout")
+
+// authRequest holds the credentials of a client: the password (PAP) or the
+// response to our challenge (CHAP-MD5).
+type authRequest struct {
+	username  string
+	password  string
+	chapID    uint8
+	challenge []byte
+	response  []byte
+}
+
+// authResult is the authorization of an authenticated client.
+type authResult struct {
+	clientIP net.IP        // overrides the address from the pool, if set
+	timeout  time.Duration // ends the session after this duration, if set
+}
+
+// serverSession negotiates LCP, authentication and IPCP with a client, playing
+// the access concentrator: it requests authentication and assigns the
+// address (and DNS servers) of the client. IPV6CP is rejected.
+type serverSession struct {
+	endpoint
+
+	auth         uint16 // protoCHAP or protoPAP
+	authenticate func(authRequest) (authResult, error)
+	serverIP     net.IP
+	clientIP     net.IP
+	dns          []net.IP
+	onUp         func() error // called once IPCP is opened
+
+	ipcp *controlProtocol
+
+	mru        int
+	peerMRU    int
+	noMRU      bool
+	refused    bool // the client does not support our authentication protocol
+	lcpOpened  time.Time
+	authed     bool
+	authedAt   time.Time
+	username   string
+	timeout    time.Duration
+	chapID     uint8
+	challenge  []byte
+	chapSent   int
+	chapSentAt time.Time
+}
+
+func newServerSession(ch channel, auth uint16, serverIP, clientIP net.IP, dns []net.IP) *serverSession {
+	s := &serverSession{
+		endpoint: newEndpoint(ch),
+		auth:     auth,
+		serverIP: serverIP.To4(),
+		clientIP: clientIP.To4(),
+		dns:      dns,
+		mru:      maxMRU,
+		peerMRU:  maxMRU,
+	}
+	s.lcp = &controlProtocol{
+		proto:   protoLCP,
+		request: s.lcpRequest,
+		peer:    s.lcpPeer,
+		nak:     s.lcpNak,
+		rej:     s.lcpRej,
+	}
+	s.ipcp = &controlProtocol{
+		proto:   protoIPCP,
+		request: s.ipcpRequest,
+		peer:    s.ipcpPeer,
+		nak:     func([]option) {}, // the server address is not negotiable
+		rej:     func([]option) {},
+	}
+	return s
+}
+
+func (s *serverSession) authOption() option {
+	if s.auth == protoCHAP {
+		return option{typ: lcpAuth, data: []byte{byte(protoCHAP >> 8), byte(protoCHAP & 0xff), chapMD5}}
+	}
+	return option{typ: lcpAuth, data: u16(protoPAP)}
+}
+
+func (s *serverSession) lcpRequest() []option {
+	opts := []option{s.authOption(), {typ: lcpMagic, data: u32(s.magic)}}
+	if !s.noMRU {
+		opts = append([]option{{typ: lcpMRU, data: u16(s.mru)}}, opts...)
+	}
+	return opts
+}
+
+func (s *serverSession) lcpPeer(opts []option) (uint8, []option) {
+	code, resp := answer(opts, func(o option) bool {
+		switch o.typ {
+		case lcpMRU, lcpMagic:
+			return false
+		case 2: // Async-Control-Character-Map: meaningless for PPPoE
+			return false
+		}
+		return true // including authentication of the server
+	}, func(o option) *option {
+		if o.typ == lcpMRU && (len(o.data) != 2 || binary.BigEndian.Uint16(o.data) > maxMRU) {
+			return &option{typ: lcpMRU, data: u16(maxMRU)}
+		}
+		return nil
+	})
+	if code == confAck {
+		s.peerMRU = maxMRU
+		for _, o := range opts {
+			if o.typ == lcpMRU {
+				s.peerMRU = int(binary.BigEndian.Uint16(o.data))
+			}
+		}
+	}
+	return code, resp
+}
+
+func (s *serverSession) lcpNak(opts []option) {
+	for _, o := range opts {
+		switch o.typ {
+		case lcpMRU:
+			if len(o.data) == 2 {
+				if mru := int(binary.BigEndian.Uint16(o.data)); mru < s.mru {
+					s.mru = mru
+				}
+			}
+		case lcpMagic:
+			s.magic = binary.BigEndian.Uint32(random(4))
+		case lcpAuth:
+			s.refused = true
+		}
+	}
+}
+
+func (s *serverSession) lcpRej(opts []option) {
+	for _, o := range opts {
+		switch o.typ {
+		case lcpMRU:
+			s.noMRU = true
+		case lcpAuth:
+			s.refused = true
+		}
+	}
+}
+
+func (s *serverSession) ipcpRequest() []option {
+	return []option{{typ: ipcpAddr, data: s.serverIP}}
+}
+
+func (s *serverSession) ipcpPeer(opts []option) (uint8, []option) {
+	// want returns the value which the client must request for option typ,
+	// or nil if the option is not supported.
+	want := func(typ uint8) net.IP {
+		switch typ {
+		case ipcpAddr:
+			return s.clientIP
+		case ipcpDNS1, ipcpDNS2:
+			if len(s.dns) == 0 {
+				return nil
+			}
+			// With one DNS server, both options get its address:
+			// rejecting one makes clients (like ours) omit both.
+			i := int(typ-ipcpDNS1) / 2
+			if i >= len(s.dns) {
+				i = len(s.dns) - 1
+			}
+			return s.dns[i].To4()
+		}
+		return nil
+	}
+	return answer(opts, func(o option) bool {
+		return want(o.typ) == nil || len(o.data) != 4
+	}, func(o option) *option {
+		if ip := want(o.typ); !ip.Equal(net.IP(o.data)) {
+			return &option{typ: o.typ, data: ip}
+		}
+		return nil
+	})
+}
+
+func (s *serverSession) sendChallenge(now time.Time) error {
+	if s.challenge == nil {
+		s.chapID++
+		s.challenge = random(16)
+	}
+	s.chapSent++
+	s.chapSentAt = now
+	data := append([]byte{byte(len(s.challenge))}, s.challenge...)
+	data = append(data, "router7"...)
+	return s.write(protoCHAP, packet{code: 1, id: s.chapID, data: data})
+}
+
+// authenticated is called once the client is authenticated.
+func (s *serverSession) authenticated(r authResult, now time.Time) error {
+	s.authed = true
+	s.authedAt = now
+	s.timeout = r.timeout
+	if r.clientIP != nil {
+		s.clientIP = r.clientIP.To4()
+	}
+	return s.sendRequest(s.ipcp, now)
+}
+
+// verify authenticates req and answers the client with ack or nak (PAP
+// Authenticate-Ack/-Nak or CHAP Success/Failure).
+func (s *serverSession) verify(proto uint16, id uint8, req authRequest, now time.Time) error {
+	ack, nak := uint8(2), uint8(3)
+	if proto == protoCHAP {
+		ack, nak = 3, 4
+	}
+	s.username = req.username
+	r, err := s.authenticate(req)
+	if err != nil {
+		if err := s.write(proto, packet{code: nak, id: id, data: authMessage(proto, "authentication failed")}); err != nil {
+			return err
+		}
+		return fmt.Errorf("authentication of %q failed: %v", req.username, err)
+	}
+	if err := s.write(proto, packet{code: ack, id: id, data: authMessage(proto, "")}); err != nil {
+		return err
+	}
+	return s.authenticated(r, now)
+}
+
+// authMessage returns the data of a PAP Authenticate-Ack/-Nak (a
+// length-prefixed message) or CHAP Success/Failure (the message) packet.
+func authMessage(proto uint16, msg string) []byte {
+	if proto == protoPAP {
+		return append([]byte{byte(len(msg))}, msg...)
+	}
+	return []byte(msg)
+}
+
+func (s *serverSession) handlePAP(p packet, now time.Time) error {
+	if s.auth != protoPAP || !s.lcp.opened() || p.code != 1 {
+		return nil
+	}
+	if s.authed {
+		// The client retransmits its request: our Authenticate-Ack was lost.
+		return s.write(protoPAP, packet{code: 2, id: p.id, data: authMessage(protoPAP, "")})
+	}
+	d := p.data
+	if len(d) < 1 || len(d) < 1+int(d[0])+1 || len(d) < 2+int(d[0])+int(d[1+d[0]]) {
+		return nil
+	}
+	username := string(d[1 : 1+d[0]])
+	password := string(d[2+d[0] : 2+int(d[0])+int(d[1+d[0]])])
+	return s.verify(protoPAP, p.id, authRequest{username: username, password: password}, now)
+}
+
+func (s *serverSession) handleCHAP(p packet, now time.Time) error {
+	if s.auth != protoCHAP || p.code != 2 || p.id != s.chapID {
+		return nil
+	}
+	if s.authed {
+		return s.write(protoCHAP, packet{code: 3, id: p.id})
+	}
+	if len(p.data) < 1 || int(p.data[0]) != md5.Size || len(p.data) < 1+md5.Size {
+		return nil
+	}
+	return s.verify(protoCHAP, p.id, authRequest{
+		username:  string(p.data[1+md5.Size:]),
+		chapID:    p.id,
+		challenge: s.challenge,
+		response:  p.data[1 : 1+md5.Size],
+	}, now)
+}
+
+// opened is called when c reached the opened state.
+func (s *serverSession) opened(c *controlProtocol, now time.Time) error {
+	switch c {
+	case s.lcp:
+		s.lcpOpened = now
+		if s.auth == protoCHAP {
+			return s.sendChallenge(now)
+		}
+		return nil // wait for the Authenticate-Request
+
+	case s.ipcp:
+		if err := s.ch.enable(protoIPv4, s.peerMRU); err != nil {
+			return err
+		}
+		if s.onUp != nil {
+			return s.onUp()
+		}
+	}
+	return nil
+}
+
+func (s *serverSession) renegotiate(c *controlProtocol) error {
+	return fmt.Errorf("client renegotiates %#x", c.proto)
+}
+
+func (s *serverSession) retry(c *controlProtocol) (bool, error) {
+	if s.refused {
+		return false, fmt.Errorf("client refuses authentication with protocol %#x", s.auth)
+	}
+	return true, nil
+}
+
+func (s *serverSession) terminated(c *controlProtocol) error {
+	return ErrTerminated
+}
+
+func (s *serverSession) protocolRejected(proto uint16) error {
+	return nil // we only offer what clients need
+}
+
+func (s *serverSession) handle(proto uint16, b []byte, now time.Time) error {
+	p, err := parsePacket(b)
+	if err != nil {
+		return nil // ignore malformed packets
+	}
+	switch proto {
+	case protoLCP:
+		return s.handleControl(s, s.lcp, p, now)
+	case protoIPCP:
+		if !s.authed {
+			return nil // the client retransmits
+		}
+		return s.handleControl(s, s.ipcp, p, now)
+	case protoPAP:
+		return s.handlePAP(p, now)
+	case protoCHAP:
+		return s.handleCHAP(p, now)
+	}
+	if s.lcp.opened() {
+		// Including IPV6CP: clients get their IPv6 connectivity
+		// elsewhere, if at all.
+		s.lcp.id++
+		return s.write(protoLCP, packet{code: protoRej, id: s.lcp.id, data: append(u16(int(proto)), b...)})
+	}
+	return nil
+}
+
+// tick retransmits unanswered requests, ends sessions which do not
+// authenticate in time or exceed their session timeout, and sends LCP echo
+// requests.
+func (s *serverSession) tick(now time.Time) error {
+	active := []*controlProtocol{s.lcp}
+	if s.authed {
+		active = append(active, s.ipcp)
+	}
+	for _, c := range active {
+		if c.ackRecv || now.Sub(s.sentAt[c]) < restartInterval {
+			continue
+		}
+		if c.sent >= maxConfigure {
+			return fmt.Errorf("no answer to %#x Configure-Request", c.proto)
+		}
+		if err := s.sendRequest(c, now); err != nil {
+			return err
+		}
+	}
+	if s.lcp.opened() && !s.authed {
+		if now.Sub(s.lcpOpened) >= authTimeout {
+			return fmt.Errorf("client did not authenticate within %v", authTimeout)
+		}
+		if s.auth == protoCHAP && now.Sub(s.chapSentAt) >= restartInterval && s.chapSent < maxConfigure {
+			if err := s.sendChallenge(now); err != nil {
+				return err
+			}
+		}
+	}
+	if s.authed && s.timeout > 0 && now.Sub(s.authedAt) >= s.timeout {
+		s.lcp.id++
+		if err := s.write(protoLCP, packet{code: termReq, id: s.lcp.id}); err != nil {
+			return err
+		}
+		return errSessionTimeout
+	}
+	if s.ipcp.opened() {
+		return s.keepalive(now, "client")
+	}
+	return nil
+}
+
+// run negotiates the session and keeps it alive until done is closed (in
+// which case the session is terminated and nil is returned) or an error
+// occurs.
+func (s *serverSession) run(done <-chan struct{}) error {
+	return s.endpoint.run(s, done)
+}
@@ -0,0 +1,521 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pppoe
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	restartInterval = 3 * time.Second  // RFC 1661 Restart timer
+	maxConfigure    = 10               // RFC 1661 Max-Configure
+	echoInterval    = 10 * time.Second // LCP keepalive
+	maxEchoFailures = 6
+
+	// maxMRU is the maximum MRU of PPPoE: the ethernet MTU minus the PPPoE
+	// (6 bytes) and PPP (2 bytes) headers.
+	maxMRU = 1492
+)
+
+// ErrTerminated is returned when the peer terminates the session.
+var ErrTerminated = errors.New("session terminated by peer")
+
+// channel transfers PPP frames, i.e. the PPP protocol number followed by the
+// information field, of the control protocols.
+type channel interface {
+	readFrame(deadline time.Time) (uint16, []byte, error)
+	writeFrame(proto uint16, b []byte) error
+	// enable passes packets of the network protocol proto (protoIPv4 or
+	// protoIPv6) through the ppp interface, which gets the specified MTU.
+	enable(proto uint16, mtu int) error
+}
+
+// session negotiates LCP, authentication, IPCP and IPV6CP over a channel.
+type session struct {
+	endpoint
+
+	username string
+	password string
+	onUp     func(Lease)
+	lease    Lease // Interface, Session and ACName are set by the caller
+
+	ipcp, ipv6cp *controlProtocol
+
+	mru       int    // our MRU
+	peerMRU   int    // MTU of the ppp interface
+	auth      uint16 // protoPAP, protoCHAP or 0 (no authentication)
+	authed    bool
+	papID     uint8
+	papSent   int
+	papSentAt time.Time
+	noMRU     bool // LCP option rejected
+	noDNS     bool // IPCP options rejected
+	noIPv6    bool // IPV6CP rejected
+	clientIP  net.IP
+	peerIP    net.IP
+	dns       [2]net.IP
+	ifaceID   []byte
+	peerID    []byte
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand must not fail
+	}
+	return b
+}
+
+func newSession(ch channel, username, password string) *session {
+	s := &session{
+		endpoint: newEndpoint(ch),
+		username: username,
+		password: password,
+		mru:      maxMRU,
+		peerMRU:  maxMRU,
+		clientIP: net.IPv4zero.To4(),
+		ifaceID:  random(8),
+	}
+	s.lcp = &controlProtocol{
+		proto:   protoLCP,
+		request: s.lcpRequest,
+		peer:    s.lcpPeer,
+		nak:     s.lcpNak,
+		rej:     s.lcpRej,
+	}
+	s.ipcp = &controlProtocol{
+		proto:   protoIPCP,
+		request: s.ipcpRequest,
+		peer:    s.ipcpPeer,
+		nak:     s.ipcpNak,
+		rej:     s.ipcpRej,
+	}
+	s.ipv6cp = &controlProtocol{
+		proto:   protoIPV6CP,
+		request: s.ipv6cpRequest,
+		peer:    s.ipv6cpPeer,
+		nak:     s.ipv6cpNak,
+		rej:     func([]option) { s.noIPv6 = true },
+	}
+	return s
+}
+
+func u16(v int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func (s *session) lcpRequest() []option {
+	opts := []option{{typ: lcpMagic, data: u32(s.magic)}}
+	if !s.noMRU {
+		opts = append([]option{{typ: lcpMRU, data: u16(s.mru)}}, opts...)
+	}
+	return opts
+}
+
+func (s *session) lcpPeer(opts []option) (uint8, []option) {
+	code, resp := answer(opts, func(o option) bool {
+		switch o.typ {
+		case lcpMRU, lcpMagic, lcpAuth:
+			return false
+		case 2: // Async-Control-Character-Map: meaningless for PPPoE
+			return false
+		}
+		return true
+	}, func(o option) *option {
+		switch o.typ {
+		case lcpMRU:
+			if len(o.data) != 2 || binary.BigEndian.Uint16(o.data) > maxMRU {
+				return &option{typ: lcpMRU, data: u16(maxMRU)}
+			}
+		case lcpAuth:
+			if len(o.data) < 2 {
+				return &option{typ: lcpAuth, data: u16(protoPAP)}
+			}
+			switch binary.BigEndian.Uint16(o.data) {
+			case protoPAP:
+			case protoCHAP:
+				if len(o.data) != 3 || o.data[2] != chapMD5 {
+					return &option{typ: lcpAuth, data: []byte{byte(protoCHAP >> 8), byte(protoCHAP & 0xff), chapMD5}}
+				}
+			default:
+				return &option{typ: lcpAuth, data: u16(protoPAP)}
+			}
+		}
+		return nil
+	})
+	if code == confAck {
+		s.auth = 0
+		s.peerMRU = maxMRU
+		for _, o := range opts {
+			switch o.typ {
+			case lcpMRU:
+				s.peerMRU = int(binary.BigEndian.Uint16(o.data))
+			case lcpAuth:
+				s.auth = binary.BigEndian.Uint16(o.data)
+			}
+		}
+	}
+	return code, resp
+}
+
+func (s *session) lcpNak(opts []option) {
+	for _, o := range opts {
+		switch o.typ {
+		case lcpMRU:
+			if len(o.data) == 2 {
+				if mru := int(binary.BigEndian.Uint16(o.data)); mru < s.mru {
+					s.mru = mru
+				}
+			}
+		case lcpMagic:
+			s.magic = binary.BigEndian.Uint32(random(4))
+		}
+	}
+}
+
+func (s *session) lcpRej(opts []option) {
+	for _, o := range opts {
+		if o.typ == lcpMRU {
+			s.noMRU = true
+		}
+	}
+}
+
+func (s *session) ipcpRequest() []option {
+	opts := []option{{typ: ipcpAddr, data: s.clientIP}}
+	if !s.noDNS {
+		for i, typ := range []uint8{ipcpDNS1, ipcpDNS2} {
+			ip := net.IPv4zero.To4()
+			if s.dns[i] != nil {
+				ip = s.dns[i]
+			}
+			opts = append(opts, option{typ: typ, data: ip})
+		}
+	}
+	return opts
+}
+
+func (s *session) ipcpPeer(opts []option) (uint8, []option) {
+	code, resp := answer(opts, func(o option) bool {
+		return o.typ != ipcpAddr || len(o.data) != 4
+	}, func(option) *option { return nil })
+	if code == confAck {
+		for _, o := range opts {
+			s.peerIP = net.IP(append([]byte(nil), o.data...))
+		}
+	}
+	return code, resp
+}
+
+func (s *session) ipcpNak(opts []option) {
+	for _, o := range opts {
+		if len(o.data) != 4 {
+			continue
+		}
+		ip := net.IP(append([]byte(nil), o.data...))
+		switch o.typ {
+		case ipcpAddr:
+			s.clientIP = ip
+		case ipcpDNS1:
+			s.dns[0] = ip
+		case ipcpDNS2:
+			s.dns[1] = ip
+		}
+	}
+}
+
+func (s *session) ipcpRej(opts []option) {
+	for _, o := range opts {
+		if o.typ == ipcpDNS1 || o.typ == ipcpDNS2 {
+			s.noDNS = true
+		}
+	}
+}
+
+func (s *session) ipv6cpRequest() []option {
+	return []option{{typ: ipv6cpIfaceID, data: s.ifaceID}}
+}
+
+func (s *session) ipv6cpPeer(opts []option) (uint8, []option) {
+	code, resp := answer(opts, func(o option) bool {
+		return o.typ != ipv6cpIfaceID || len(o.data) != 8
+	}, func(o option) *option {
+		if bytes.Equal(o.data, s.ifaceID) || bytes.Equal(o.data, make([]byte, 8)) {
+			// RFC 5072 section 4.1: suggest a different identifier.
+			return &option{typ: ipv6cpIfaceID, data: random(8)}
+		}
+		return nil
+	})
+	if code == confAck {
+		s.peerID = append([]byte(nil), opts[0].data...)
+	}
+	return code, resp
+}
+
+func (s *session) ipv6cpNak(opts []option) {
+	for _, o := range opts {
+		if o.typ == ipv6cpIfaceID && len(o.data) == 8 {
+			s.ifaceID = append([]byte(nil), o.data...)
+		}
+	}
+}
+
+// active returns the control protocols which are negotiated in the current
+// phase.
+func (s *session) active() []*controlProtocol {
+	if !s.authed {
+		return []*controlProtocol{s.lcp}
+	}
+	if s.noIPv6 {
+		return []*controlProtocol{s.lcp, s.ipcp}
+	}
+	return []*controlProtocol{s.lcp, s.ipcp, s.ipv6cp}
+}
+
+func (s *session) linkLocal(id []byte) string {
+	if id == nil {
+		return ""
+	}
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:], id)
+	return ip.String()
+}
+
+func (s *session) up() error {
+	if !s.ipcp.opened() {
+		return nil
+	}
+	l := s.lease
+	l.ClientIP = s.clientIP.String()
+	l.PeerIP = s.peerIP.String()
+	l.DNS = nil
+	for _, ip := range s.dns {
+		if ip != nil && !ip.Equal(net.IPv4zero) {
+			l.DNS = append(l.DNS, ip.String())
+		}
+	}
+	l.MTU = s.peerMRU
+	if s.ipv6cp.opened() {
+		l.LinkLocal = s.linkLocal(s.ifaceID)
+		l.PeerLinkLocal = s.linkLocal(s.peerID)
+	}
+	if s.onUp != nil {
+		s.onUp(l)
+	}
+	return nil
+}
+
+// opened is called when c reached the opened state.
+func (s *session) opened(c *controlProtocol, now time.Time) error {
+	switch c {
+	case s.lcp:
+		switch s.auth {
+		case protoPAP:
+			return s.sendPAP(now)
+		case protoCHAP:
+			return nil // wait for the challenge
+		}
+		return s.authenticated(now)
+
+	case s.ipcp:
+		if err := s.ch.enable(protoIPv4, s.peerMRU); err != nil {
+			return err
+		}
+		return s.up()
+
+	case s.ipv6cp:
+		if err := s.ch.enable(protoIPv6, s.peerMRU); err != nil {
+			return err
+		}
+		return s.up()
+	}
+	return nil
+}
+
+func (s *session) authenticated(now time.Time) error {
+	s.authed = true
+	if err := s.sendRequest(s.ipcp, now); err != nil {
+		return err
+	}
+	return s.sendRequest(s.ipv6cp, now)
+}
+
+func (s *session) sendPAP(now time.Time) error {
+	s.papID++
+	s.papSent++
+	s.papSentAt = now
+	data := append([]byte{byte(len(s.username))}, s.username...)
+	data = append(data, byte(len(s.password)))
+	data = append(data, s.password...)
+	return s.write(protoPAP, packet{code: 1, id: s.papID, data: data})
+}
+
+func (s *session) handlePAP(p packet, now time.Time) error {
+	if s.authed || s.auth != protoPAP || p.id != s.papID {
+		return nil
+	}
+	switch p.code {
+	case 2: // Authenticate-Ack
+		return s.authenticated(now)
+	case 3: // Authenticate-Nak
+		return fmt.Errorf("PAP authentication failed: %q", message(p.data))
+	}
+	return nil
+}
+
+func (s *session) handleCHAP(p packet, now time.Time) error {
+	if s.authed || s.auth != protoCHAP {
+		return nil
+	}
+	switch p.code {
+	case 1: // Challenge
+		if len(p.data) < 1 || len(p.data) < 1+int(p.data[0]) {
+			return nil
+		}
+		value := p.data[1 : 1+p.data[0]]
+		h := md5.New()
+		h.Write([]byte{p.id})
+		h.Write([]byte(s.password))
+		h.Write(value)
+		data := append([]byte{md5.Size}, h.Sum(nil)...)
+		data = append(data, s.username...)
+		return s.write(protoCHAP, packet{code: 2, id: p.id, data: data})
+	case 3: // Success
+		return s.authenticated(now)
+	case 4: // Failure
+		return fmt.Errorf("CHAP authentication failed: %q", p.data)
+	}
+	return nil
+}
+
+// message returns the message of a PAP Authenticate-Ack or -Nak.
+func message(data []byte) string {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return ""
+	}
+	return string(data[1 : 1+data[0]])
+}
+
+func (s *session) renegotiate(c *controlProtocol) error {
+	if c == s.lcp {
+		return fmt.Errorf("peer renegotiates LCP")
+	}
+	return nil
+}
+
+func (s *session) retry(c *controlProtocol) (bool, error) {
+	return c != s.ipv6cp || !s.noIPv6, nil
+}
+
+func (s *session) terminated(c *controlProtocol) error {
+	if c == s.ipv6cp {
+		s.noIPv6 = true
+		return nil
+	}
+	return ErrTerminated
+}
+
+func (s *session) protocolRejected(proto uint16) error {
+	switch proto {
+	case protoIPV6CP:
+		s.noIPv6 = true
+	case protoIPCP:
+		return fmt.Errorf("peer rejected IPCP")
+	}
+	return nil
+}
+
+func (s *session) handle(proto uint16, b []byte, now time.Time) error {
+	p, err := parsePacket(b)
+	if err != nil {
+		return nil // ignore malformed packets
+	}
+	switch proto {
+	case protoLCP:
+		return s.handleControl(s, s.lcp, p, now)
+	case protoIPCP, protoIPV6CP:
+		if !s.authed {
+			return nil // the peer retransmits
+		}
+		c := s.ipcp
+		if proto == protoIPV6CP {
+			c = s.ipv6cp
+		}
+		return s.handleControl(s, c, p, now)
+	case protoPAP:
+		return s.handlePAP(p, now)
+	case protoCHAP:
+		return s.handleCHAP(p, now)
+	}
+	if s.lcp.opened() {
+		s.lcp.id++
+		return s.write(protoLCP, packet{code: protoRej, id: s.lcp.id, data: append(u16(int(proto)), b...)})
+	}
+	return nil
+}
+
+// tick retransmits unanswered requests and sends LCP echo requests.
+func (s *session) tick(now time.Time) error {
+	for _, c := range s.active() {
+		if c.ackRecv || now.Sub(s.sentAt[c]) < restartInterval {
+			continue
+		}
+		if c.sent >= maxConfigure {
+			if c == s.ipv6cp {
+				s.noIPv6 = true // IPv6 is optional
+				continue
+			}
+			return fmt.Errorf("no answer to %#x Configure-Request", c.proto)
+		}
+		if err := s.sendRequest(c, now); err != nil {
+			return err
+		}
+	}
+	if s.lcp.opened() && !s.authed && s.auth == protoPAP && now.Sub(s.papSentAt) >= restartInterval {
+		if s.papSent >= maxConfigure {
+			return fmt.Errorf("no answer to PAP Authenticate-Request")
+		}
+		if err := s.sendPAP(now); err != nil {
+			return err
+		}
+	}
+	if s.ipcp.opened() {
+		return s.keepalive(now, "peer")
+	}
+	return nil
+}
+
+// run negotiates the session and keeps it alive until done is closed (in
+// which case the session is terminated and nil is returned) or an error
+// occurs.
+func (s *session) run(done <-chan struct{}) error {
+	return s.endpoint.run(s, done)
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiling serves net/http/pprof, expvar and Go runtime statistics
+// on the HTTP ports of router7 daemons, protected by the gokrazy password.
+package profiling
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// PasswordFiles are the locations of the gokrazy web interface password, in
+// the order in which gokrazy reads them.
+var PasswordFiles = []string{"/perm/gokr-pw.txt", "/etc/gokr-pw.txt"}
+
+// username is the user name of the gokrazy web interface.
+const username = "gokrazy"
+
+func password() (string, error) {
+	for _, fn := range PasswordFiles {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", nil
+}
+
+var started = time.Now()
+
+type runtimeStats struct {
+	GoVersion    string           `json:"go_version"`
+	Uptime       string           `json:"uptime"`
+	NumCPU       int              `json:"num_cpu"`
+	GOMAXPROCS   int              `json:"gomaxprocs"`
+	NumGoroutine int              `json:"num_goroutine"`
+	NumCgoCall   int64            `json:"num_cgo_call"`
+	GC           debug.GCStats    `json:"gc"`
+	MemStats     runtime.MemStats `json:"mem_stats"`
+}
+
+func serveRuntime(w http.ResponseWriter, r *http.Request) {
+	st := runtimeStats{
+		GoVersion:    runtime.Version(),
+		Uptime:       time.Since(started).Round(time.Second).String(),
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumGoroutine: runtime.NumGoroutine(),
+		NumCgoCall:   runtime.NumCgoCall(),
+	}
+	debug.ReadGCStats(&st.GC)
+	runtime.ReadMemStats(&st.MemStats)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(&st)
+}
+
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/runtime", serveRuntime)
+	return mux
+}
+
+// Handler serves the diagnostics endpoints below /debug/ and passes all other
+// requests to h, e.g.:
+//
+//	curl -u gokrazy:$(cat gokr-pw.txt) http://router7:8066/debug/pprof/heap > heap.pprof
+//
+// Requests below /debug/ require HTTP basic authentication with the gokrazy
+// password and are rejected if no password is configured. Handler takes
+// precedence over the (unauthenticated) handlers which importing
+// net/http/pprof and expvar registers in http.DefaultServeMux.
+func Handler(h http.Handler) http.Handler {
+	mux := newMux()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/debug/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		want, err := password()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if want == "" {
+			http.Error(w, "no gokrazy password configured", http.StatusForbidden)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="router7"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiling
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "profiling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	pwfile := filepath.Join(tmp, "gokr-pw.txt")
+	defer func(files []string) { PasswordFiles = files }(PasswordFiles)
+	PasswordFiles = []string{pwfile}
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	get := func(path, user, pass string) int {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		desc       string
+		path       string
+		user, pass string
+		want       int
+	}{
+		{"other paths pass through", "/metrics", "", "", http.StatusTeapot},
+		{"no password configured", "/debug/runtime", "gokrazy", "", http.StatusForbidden},
+	} {
+		if got := get(tt.path, tt.user, tt.pass); got != tt.want {
+			t.Errorf("%s: GET %s: got HTTP %d, want %d", tt.desc, tt.path, got, tt.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(pwfile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		desc       string
+		path       string
+		user, pass string
+		want       int
+	}{
+		{"no credentials", "/debug/pprof/", "", "", http.StatusUnauthorized},
+		{"wrong password", "/debug/pprof/", "gokrazy", "guess", http.StatusUnauthorized},
+		{"wrong user", "/debug/vars", "root", "secret", http.StatusUnauthorized},
+		{"pprof", "/debug/pprof/", "gokrazy", "secret", http.StatusOK},
+		{"expvar", "/debug/vars", "gokrazy", "secret", http.StatusOK},
+		{"runtime", "/debug/runtime", "gokrazy", "secret", http.StatusOK},
+	} {
+		if got := get(tt.path, tt.user, tt.pass); got != tt.want {
+			t.Errorf("%s: GET %s: got HTTP %d, want %d", tt.desc, tt.path, got, tt.want)
+		}
+	}
+}
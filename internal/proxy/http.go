@@ -0,0 +1,102 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/splice"
+)
+
+// proxyAuth returns the credentials of the Proxy-Authorization header of r.
+func proxyAuth(r *http.Request) (user, password string, ok bool) {
+	const prefix = "Basic "
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	idx := strings.IndexByte(string(b), ':')
+	if idx == -1 {
+		return "", "", false
+	}
+	return string(b[:idx]), string(b[idx+1:]), true
+}
+
+func httpError(w io.Writer, code int, header string) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+}
+
+// serveHTTP serves a CONNECT request or a single plain HTTP request (the
+// connection is closed afterwards, so that every request is subject to the
+// rules).
+func (c *config) serveHTTP(conn *bufferedConn, client net.IP) error {
+	req, err := http.ReadRequest(conn.r)
+	if err != nil {
+		return err
+	}
+	user, password, ok := proxyAuth(req)
+	if !ok || !c.authenticate(user, password) {
+		httpError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"router7\"\r\n")
+		return fmt.Errorf("http: authentication failed for user %q", user)
+	}
+
+	addr := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" {
+			httpError(conn, http.StatusBadRequest, "")
+			return fmt.Errorf("http: unsupported URL %q", req.URL)
+		}
+		addr = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "80")
+	}
+
+	upstream, err := c.dial(client, user, addr)
+	if err != nil {
+		httpError(conn, http.StatusBadGateway, "")
+		return err
+	}
+	defer upstream.Close()
+	conn.SetReadDeadline(time.Time{})
+
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return err
+		}
+		splice.Conns(conn, upstream)
+		return nil
+	}
+
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Close = true
+	if err := req.Write(upstream); err != nil {
+		httpError(conn, http.StatusBadGateway, "")
+		return err
+	}
+	_, err = io.Copy(conn, upstream)
+	return err
+}
@@ -0,0 +1,292 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxy implements an authenticated SOCKS5 and HTTP egress proxy
+// whose outbound interface (or routing table, via the packet mark) is
+// selected per rule, e.g. to test the behavior of an application when its
+// traffic leaves via a backup uplink or a WireGuard tunnel.
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rtr7/router7/internal/splice"
+	"github.com/rtr7/router7/internal/teelogger"
+	"golang.org/x/sys/unix"
+)
+
+var log = teelogger.NewConsole()
+
+// User is a proxy user, authenticating with SOCKS5 username/password
+// authentication or HTTP basic authentication.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// Outbound is a way for connections to leave the router.
+type Outbound struct {
+	// Interface binds connections to the specified interface, e.g. uplink2
+	// or wg0.
+	Interface string `json:"interface"`
+
+	// Mark sets the packet mark of connections, e.g. to select a routing
+	// table via an ip rule.
+	Mark uint32 `json:"mark"`
+}
+
+// Rule selects an outbound. Empty criteria match all connections.
+type Rule struct {
+	Clients  []string `json:"clients"`  // IP addresses or networks
+	User     string   `json:"user"`     // User.Name
+	Outbound string   `json:"outbound"` // key in Config.Outbounds, or “direct”
+}
+
+// Config is read from /perm/proxy.json.
+type Config struct {
+	Port      uint16              `json:"port"` // default: 1080
+	Users     []User              `json:"users"`
+	Outbounds map[string]Outbound `json:"outbounds"`
+
+	// Rules are evaluated in order, the first matching rule wins. Connections
+	// not matched by any rule use the direct outbound.
+	Rules []Rule `json:"rules"`
+}
+
+// ReadConfig reads proxy.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "proxy.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 1080
+	}
+	return cfg, nil
+}
+
+type rule struct {
+	nets     []*net.IPNet
+	user     string
+	outbound string
+}
+
+type config struct {
+	users     map[string]string // name → password
+	outbounds map[string]Outbound
+	rules     []rule
+}
+
+// Proxy serves SOCKS5 and HTTP proxy connections as configured via SetConfig.
+type Proxy struct {
+	mu  sync.Mutex
+	cfg *config
+}
+
+// NewProxy returns a Proxy without users, i.e. which rejects all clients.
+func NewProxy() *Proxy {
+	return &Proxy{cfg: &config{}}
+}
+
+func parseClient(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client %q: neither IP address nor network", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// SetConfig replaces the users, outbounds and rules of p.
+func (p *Proxy) SetConfig(cfg Config) error {
+	if len(cfg.Users) == 0 {
+		return fmt.Errorf("no users configured")
+	}
+	c := &config{
+		users:     make(map[string]string),
+		outbounds: make(map[string]Outbound),
+	}
+	for _, u := range cfg.Users {
+		if u.Name == "" || len(u.Name) > 255 || len(u.Password) > 255 {
+			return fmt.Errorf("user %q: name must be 1-255 bytes, password at most 255 bytes", u.Name)
+		}
+		c.users[u.Name] = u.Password
+	}
+	c.outbounds["direct"] = Outbound{}
+	for name, o := range cfg.Outbounds {
+		c.outbounds[name] = o
+	}
+	for idx, r := range cfg.Rules {
+		if _, ok := c.outbounds[r.Outbound]; !ok {
+			return fmt.Errorf("rule %d: unknown outbound %q", idx, r.Outbound)
+		}
+		if r.User != "" {
+			if _, ok := c.users[r.User]; !ok {
+				return fmt.Errorf("rule %d: unknown user %q", idx, r.User)
+			}
+		}
+		rl := rule{user: r.User, outbound: r.Outbound}
+		for _, client := range r.Clients {
+			n, err := parseClient(client)
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", idx, err)
+			}
+			rl.nets = append(rl.nets, n)
+		}
+		c.rules = append(c.rules, rl)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg = c
+	return nil
+}
+
+func (p *Proxy) config() *config {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cfg
+}
+
+// authenticate returns whether password is the password of user. The
+// password is compared in constant time, so that response times do not give
+// away how much of a guess was correct.
+func (c *config) authenticate(user, password string) bool {
+	want, ok := c.users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+// outbound returns the name of the outbound for connections by user from
+// client.
+func (c *config) outbound(client net.IP, user string) string {
+	for _, r := range c.rules {
+		if r.user != "" && r.user != user {
+			continue
+		}
+		if len(r.nets) > 0 {
+			var matched bool
+			for _, n := range r.nets {
+				if n.Contains(client) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		return r.outbound
+	}
+	return "direct"
+}
+
+// dial connects to addr via the outbound selected for user and client.
+func (c *config) dial(client net.IP, user, addr string) (net.Conn, error) {
+	name := c.outbound(client, user)
+	o := c.outbounds[name]
+	d := net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var serr error
+			if err := rc.Control(func(fd uintptr) {
+				if o.Interface != "" {
+					serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, o.Interface)
+					if serr != nil {
+						return
+					}
+				}
+				if o.Mark != 0 {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.Mark))
+				}
+			}); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("outbound %s: %v", name, err)
+	}
+	return conn, nil
+}
+
+// Serve accepts connections on ln and serves them using HandleConn.
+func (p *Proxy) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.HandleConn(conn)
+	}
+}
+
+// bufferedConn reads from r, which buffers reads from the underlying Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(splice.CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// HandleConn serves a SOCKS5 or HTTP proxy connection, depending on its first
+// byte.
+func (p *Proxy) HandleConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := bc.r.Peek(1)
+	if err != nil {
+		return
+	}
+	var client net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = addr.IP
+	}
+	cfg := p.config()
+	if first[0] == socksVersion {
+		err = cfg.serveSOCKS(bc, client)
+	} else {
+		err = cfg.serveHTTP(bc, client)
+	}
+	if err != nil {
+		log.Printf("%v: %v", conn.RemoteAddr(), err)
+	}
+}
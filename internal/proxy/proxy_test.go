@@ -0,0 +1,169 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+func startProxy(t *testing.T, cfg Config) net.Listener {
+	t.Helper()
+	p := NewProxy()
+	if err := p.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(ln)
+	return ln
+}
+
+var testUsers = []User{{Name: "alice", Password: "secret"}}
+
+func TestSOCKS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello")
+	}))
+	defer backend.Close()
+	ln := startProxy(t, Config{Users: testUsers})
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	for _, tt := range []struct {
+		password string
+		wantErr  bool
+	}{
+		{"secret", false},
+		{"wrong", true},
+	} {
+		d, err := xproxy.SOCKS5("tcp", addr, &xproxy.Auth{User: "alice", Password: tt.password}, xproxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{Dial: d.Dial}}
+		resp, err := client.Get(backend.URL)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("password %q: unexpectedly succeeded", tt.password)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "hello"; got != want {
+			t.Errorf("unexpected response: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("Proxy-Authorization header forwarded to backend")
+		}
+		fmt.Fprintf(w, "hello")
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+	ln := startProxy(t, Config{Users: testUsers})
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	for _, tt := range []struct {
+		user     *url.Userinfo
+		target   *httptest.Server
+		wantCode int
+	}{
+		{url.UserPassword("alice", "secret"), backend, http.StatusOK},
+		{url.UserPassword("alice", "secret"), tlsBackend, http.StatusOK}, // CONNECT
+		{url.UserPassword("alice", "wrong"), backend, http.StatusProxyAuthRequired},
+		{nil, backend, http.StatusProxyAuthRequired},
+	} {
+		transport := tt.target.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: addr, User: tt.user})
+		resp, err := (&http.Client{Transport: transport}).Get(tt.target.URL)
+		if err != nil {
+			if tt.wantCode != http.StatusOK {
+				continue // CONNECT failures are returned as errors
+			}
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, tt.wantCode; got != want {
+			t.Errorf("%s via %v: unexpected status: got %d, want %d", tt.target.URL, tt.user, got, want)
+		}
+	}
+}
+
+func TestOutbound(t *testing.T) {
+	p := NewProxy()
+	if err := p.SetConfig(Config{
+		Users: append(testUsers, User{Name: "bob", Password: "hunter2"}),
+		Outbounds: map[string]Outbound{
+			"uplink2": {Interface: "uplink2"},
+			"wg":      {Interface: "wg0", Mark: 0x200},
+		},
+		Rules: []Rule{
+			{User: "bob", Outbound: "wg"},
+			{Clients: []string{"192.168.42.0/28"}, Outbound: "uplink2"},
+			{Clients: []string{"192.168.42.23"}, Outbound: "wg"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := p.config()
+	for _, tt := range []struct {
+		client string
+		user   string
+		want   string
+	}{
+		{"192.168.42.5", "alice", "uplink2"},
+		{"192.168.42.5", "bob", "wg"},
+		{"192.168.42.23", "alice", "wg"},
+		{"192.168.42.99", "alice", "direct"},
+	} {
+		if got := cfg.outbound(net.ParseIP(tt.client), tt.user); got != tt.want {
+			t.Errorf("outbound(%s, %s) = %q, want %q", tt.client, tt.user, got, tt.want)
+		}
+	}
+
+	for _, cfg := range []Config{
+		{},
+		{Users: testUsers, Rules: []Rule{{Outbound: "nonexistent"}}},
+		{Users: testUsers, Rules: []Rule{{User: "nobody", Outbound: "direct"}}},
+		{Users: testUsers, Rules: []Rule{{Clients: []string{"garbage"}, Outbound: "direct"}}},
+	} {
+		if err := p.SetConfig(cfg); err == nil {
+			t.Errorf("SetConfig(%+v): unexpectedly succeeded", cfg)
+		}
+	}
+}
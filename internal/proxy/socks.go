@@ -0,0 +1,165 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/rtr7/router7/internal/splice"
+)
+
+// SOCKS5 constants, see https://tools.ietf.org/html/rfc1928 and
+// https://tools.ietf.org/html/rfc1929 (username/password authentication).
+const (
+	socksVersion = 5
+
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+	socksAuthVersion      = 1
+
+	socksCmdConnect = 1
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded           = 0
+	socksHostUnreachable     = 4
+	socksCmdNotSupported     = 7
+	socksAddrTypeUnsupported = 8
+)
+
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// socksReply sends a reply without a bound address, which clients do not need
+// for CONNECT.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (c *config) serveSOCKS(conn *bufferedConn, client net.IP) error {
+	hdr, err := readBytes(conn, 2) // version, number of methods
+	if err != nil {
+		return err
+	}
+	methods, err := readBytes(conn, int(hdr[1]))
+	if err != nil {
+		return err
+	}
+	var offered bool
+	for _, m := range methods {
+		if m == socksAuthPassword {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return fmt.Errorf("socks: client does not support password authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+		return err
+	}
+
+	// username/password authentication
+	b, err := readBytes(conn, 2) // version, username length
+	if err != nil {
+		return err
+	}
+	user, err := readBytes(conn, int(b[1]))
+	if err != nil {
+		return err
+	}
+	b, err = readBytes(conn, 1) // password length
+	if err != nil {
+		return err
+	}
+	password, err := readBytes(conn, int(b[0]))
+	if err != nil {
+		return err
+	}
+	if !c.authenticate(string(user), string(password)) {
+		conn.Write([]byte{socksAuthVersion, 1})
+		return fmt.Errorf("socks: authentication failed for user %q", user)
+	}
+	if _, err := conn.Write([]byte{socksAuthVersion, 0}); err != nil {
+		return err
+	}
+
+	// request
+	req, err := readBytes(conn, 4) // version, command, reserved, address type
+	if err != nil {
+		return err
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(conn, socksCmdNotSupported)
+		return fmt.Errorf("socks: unsupported command %d", req[1])
+	}
+	var host string
+	switch req[3] {
+	case socksAddrIPv4:
+		b, err := readBytes(conn, net.IPv4len)
+		if err != nil {
+			return err
+		}
+		host = net.IP(b).String()
+	case socksAddrIPv6:
+		b, err := readBytes(conn, net.IPv6len)
+		if err != nil {
+			return err
+		}
+		host = net.IP(b).String()
+	case socksAddrDomain:
+		b, err := readBytes(conn, 1)
+		if err != nil {
+			return err
+		}
+		b, err = readBytes(conn, int(b[0]))
+		if err != nil {
+			return err
+		}
+		host = string(b)
+	default:
+		socksReply(conn, socksAddrTypeUnsupported)
+		return fmt.Errorf("socks: unsupported address type %d", req[3])
+	}
+	b, err = readBytes(conn, 2)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b))))
+
+	upstream, err := c.dial(client, string(user), addr)
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		return err
+	}
+	defer upstream.Close()
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	splice.Conns(conn, upstream)
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota implements monthly data usage accounting for metered uplinks.
+package quota
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/renameio"
+)
+
+// PriorityTraffic identifies traffic which is still forwarded once the quota
+// is exhausted.
+type PriorityTraffic struct {
+	Proto string `json:"proto"` // e.g. “tcp” (or “tcp,udp”)
+	Port  string `json:"port"`  // e.g. “22” (or “8080-8090”)
+}
+
+type Quota struct {
+	Interface  string            `json:"interface"`   // e.g. uplink1
+	LimitBytes uint64            `json:"limit_bytes"` // rx+tx bytes per billing period
+	BillingDay int               `json:"billing_day"` // day of month on which usage resets, e.g. 1
+	Priority   []PriorityTraffic `json:"priority"`    // forwarded even when exceeded
+}
+
+type Config struct {
+	Quotas []Quota `json:"quotas"`
+}
+
+// State is the persisted accounting state of one Quota.
+type State struct {
+	Interface   string    `json:"interface"`
+	PeriodStart time.Time `json:"period_start"`
+	UsedBytes   uint64    `json:"used_bytes"`
+	LastCounter uint64    `json:"last_counter"` // last observed interface counter
+	Exceeded    bool      `json:"exceeded"`
+}
+
+// PeriodStart returns the start of the billing period containing t. Billing
+// days which do not exist in a month (e.g. the 31st in April) are clamped to
+// the last day of that month.
+func PeriodStart(t time.Time, billingDay int) time.Time {
+	if billingDay < 1 {
+		billingDay = 1
+	}
+	start := func(year int, month time.Month) time.Time {
+		// day 0 of the next month is the last day of this month
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		day := billingDay
+		if day > last {
+			day = last
+		}
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	}
+	s := start(t.Year(), t.Month())
+	if t.Before(s) {
+		prev := time.Date(t.Year(), t.Month()-1, 1, 0, 0, 0, 0, t.Location())
+		s = start(prev.Year(), prev.Month())
+	}
+	return s
+}
+
+// Update accounts for the interface byte counter observed at time now and
+// reports whether the Exceeded field changed.
+func (s *State) Update(q Quota, now time.Time, counter uint64) bool {
+	period := PeriodStart(now, q.BillingDay)
+	if !s.PeriodStart.Equal(period) {
+		s.PeriodStart = period
+		s.UsedBytes = 0
+	}
+	if counter >= s.LastCounter {
+		s.UsedBytes += counter - s.LastCounter
+	} else {
+		// The counter was reset (e.g. the interface was re-created), so all
+		// of its bytes were transferred since our last observation.
+		s.UsedBytes += counter
+	}
+	s.LastCounter = counter
+	exceeded := q.LimitBytes > 0 && s.UsedBytes >= q.LimitBytes
+	changed := exceeded != s.Exceeded
+	s.Exceeded = exceeded
+	return changed
+}
+
+func statePath(dir string) string {
+	return filepath.Join(dir, "quota", "state.json")
+}
+
+// ReadConfig reads quota.json from dir. A missing file results in an empty
+// Config.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "quota.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// ReadState reads the accounting state (keyed by interface name) from dir.
+func ReadState(dir string) (map[string]*State, error) {
+	states := make(map[string]*State)
+	b, err := ioutil.ReadFile(statePath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, nil
+		}
+		return nil, err
+	}
+	var list []*State
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		states[s.Interface] = s
+	}
+	return states, nil
+}
+
+// WriteState persists states to dir.
+func WriteState(dir string, states map[string]*State) error {
+	list := make([]*State, 0, len(states))
+	for _, s := range states {
+		list = append(list, s)
+	}
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath(dir)), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(statePath(dir), b, 0644)
+}
+
+// Exceeded returns the quotas whose usage exceeds their limit.
+func Exceeded(dir string) ([]Quota, error) {
+	cfg, err := ReadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Quotas) == 0 {
+		return nil, nil
+	}
+	states, err := ReadState(dir)
+	if err != nil {
+		return nil, err
+	}
+	var exceeded []Quota
+	for _, q := range cfg.Quotas {
+		if s, ok := states[q.Interface]; ok && s.Exceeded {
+			exceeded = append(exceeded, q)
+		}
+	}
+	return exceeded, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	for _, tt := range []struct {
+		now        time.Time
+		billingDay int
+		want       time.Time
+	}{
+		{
+			now:        time.Date(2020, time.May, 17, 13, 0, 0, 0, time.UTC),
+			billingDay: 1,
+			want:       time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:        time.Date(2020, time.May, 3, 13, 0, 0, 0, time.UTC),
+			billingDay: 15,
+			want:       time.Date(2020, time.April, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// April has no 31st, so the period starts on the 30th.
+			now:        time.Date(2020, time.April, 30, 1, 0, 0, 0, time.UTC),
+			billingDay: 31,
+			want:       time.Date(2020, time.April, 30, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:        time.Date(2020, time.January, 5, 1, 0, 0, 0, time.UTC),
+			billingDay: 10,
+			want:       time.Date(2019, time.December, 10, 0, 0, 0, 0, time.UTC),
+		},
+	} {
+		if got := PeriodStart(tt.now, tt.billingDay); !got.Equal(tt.want) {
+			t.Errorf("PeriodStart(%v, %d) = %v, want %v", tt.now, tt.billingDay, got, tt.want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	q := Quota{
+		Interface:  "uplink1",
+		LimitBytes: 1000,
+		BillingDay: 1,
+	}
+	now := time.Date(2020, time.May, 17, 13, 0, 0, 0, time.UTC)
+	var s State
+	if s.Update(q, now, 400) {
+		t.Fatalf("quota unexpectedly exceeded after 400 bytes")
+	}
+	// counter reset, e.g. after re-plugging the modem
+	if s.Update(q, now, 100) {
+		t.Fatalf("quota unexpectedly exceeded after 500 bytes")
+	}
+	if got, want := s.UsedBytes, uint64(500); got != want {
+		t.Fatalf("unexpected usage: got %d, want %d", got, want)
+	}
+	if !s.Update(q, now, 700) {
+		t.Fatalf("quota unexpectedly not exceeded after 1100 bytes")
+	}
+	// new billing period
+	if !s.Update(q, now.AddDate(0, 1, 0), 750) {
+		t.Fatalf("quota unexpectedly not reset in new billing period")
+	}
+	if got, want := s.UsedBytes, uint64(50); got != want {
+		t.Fatalf("unexpected usage: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package radius implements a RADIUS client for authentication (RFC 2865) and
+// accounting (RFC 2866), as used by the PPPoE server.
+package radius
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Packet codes.
+const (
+	codeAccessRequest      = 1
+	codeAccessAccept       = 2
+	codeAccessReject       = 3
+	codeAccountingRequest  = 4
+	codeAccountingResponse = 5
+)
+
+// Attribute types.
+const (
+	attrUserName             = 1
+	attrUserPassword         = 2
+	attrCHAPPassword         = 3
+	attrServiceType          = 6
+	attrFramedProtocol       = 7
+	attrFramedIPAddress      = 8
+	attrReplyMessage         = 18
+	attrSessionTimeout       = 27
+	attrCallingStationID     = 31
+	attrNASIdentifier        = 32
+	attrAcctStatusType       = 40
+	attrAcctInputOctets      = 42
+	attrAcctOutputOctets     = 43
+	attrAcctSessionID        = 44
+	attrAcctSessionTime      = 46
+	attrAcctInputPackets     = 47
+	attrAcctOutputPackets    = 48
+	attrAcctTerminateCause   = 49
+	attrAcctInputGigawords   = 52
+	attrAcctOutputGigawords  = 53
+	attrCHAPChallenge        = 60
+	attrNASPortType          = 61
+	attrMessageAuthenticator = 80
+)
+
+const (
+	serviceTypeFramed  = 2
+	framedProtocolPPP  = 1
+	nasPortTypeVirtual = 5
+)
+
+const (
+	hdrLen  = 20
+	authLen = 16
+	maxLen  = 4096
+)
+
+// Config configures the RADIUS servers.
+type Config struct {
+	Server     string `json:"server"`     // e.g. 10.0.0.5 or 10.0.0.5:1812
+	Accounting string `json:"accounting"` // optional, e.g. 10.0.0.5:1813
+	Secret     string `json:"secret"`
+
+	// NASIdentifier identifies the router to the servers, default: router7.
+	NASIdentifier string `json:"nas_identifier,omitempty"`
+}
+
+// Validate returns an error if cfg lacks a server or the secret.
+func (cfg Config) Validate() error {
+	if cfg.Server == "" {
+		return fmt.Errorf("radius: server not set")
+	}
+	if cfg.Secret == "" {
+		return fmt.Errorf("radius: secret not set")
+	}
+	return nil
+}
+
+type attribute struct {
+	typ  uint8
+	data []byte
+}
+
+type packet struct {
+	code          uint8
+	id            uint8
+	authenticator [authLen]byte
+	attrs         []attribute
+}
+
+func (p *packet) attr(typ uint8) ([]byte, bool) {
+	for _, a := range p.attrs {
+		if a.typ == typ {
+			return a.data, true
+		}
+	}
+	return nil, false
+}
+
+func (p *packet) add(typ uint8, data []byte) {
+	p.attrs = append(p.attrs, attribute{typ: typ, data: data})
+}
+
+func (p *packet) addString(typ uint8, s string) {
+	if s != "" {
+		p.add(typ, []byte(s))
+	}
+}
+
+func (p *packet) addUint32(typ uint8, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	p.add(typ, b)
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, hdrLen, maxLen)
+	b[0] = p.code
+	b[1] = p.id
+	copy(b[4:hdrLen], p.authenticator[:])
+	for _, a := range p.attrs {
+		b = append(b, a.typ, byte(2+len(a.data)))
+		b = append(b, a.data...)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < hdrLen {
+		return nil, fmt.Errorf("packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < hdrLen || length > len(b) {
+		return nil, fmt.Errorf("invalid packet length %d", length)
+	}
+	p := &packet{code: b[0], id: b[1]}
+	copy(p.authenticator[:], b[4:hdrLen])
+	for attrs := b[hdrLen:length]; len(attrs) > 0; {
+		if len(attrs) < 2 || attrs[1] < 2 || int(attrs[1]) > len(attrs) {
+			return nil, fmt.Errorf("invalid attribute")
+		}
+		p.attrs = append(p.attrs, attribute{typ: attrs[0], data: attrs[2:attrs[1]]})
+		attrs = attrs[attrs[1]:]
+	}
+	return p, nil
+}
+
+// hidePassword encrypts password as described in RFC 2865 section 5.2.
+func hidePassword(password, secret []byte, authenticator [authLen]byte) []byte {
+	n := (len(password) + authLen - 1) / authLen * authLen
+	if n == 0 {
+		n = authLen
+	}
+	b := make([]byte, n)
+	copy(b, password)
+	prev := authenticator[:]
+	for i := 0; i < n; i += authLen {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		sum := h.Sum(nil)
+		for j := range sum {
+			b[i+j] ^= sum[j]
+		}
+		prev = b[i : i+authLen]
+	}
+	return b
+}
+
+// messageAuthenticator returns the value of the Message-Authenticator
+// attribute (RFC 3579 section 3.2) of the marshaled packet b, whose
+// Message-Authenticator attribute (if any) must be zeroed.
+func messageAuthenticator(b, secret []byte) []byte {
+	mac := hmac.New(md5.New, secret)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// zeroMessageAuthenticator returns a copy of b (a valid packet) with the
+// value of its Message-Authenticator attribute zeroed, and that value.
+func zeroMessageAuthenticator(b []byte) ([]byte, []byte) {
+	b = append([]byte(nil), b...)
+	for attrs := b[hdrLen:]; len(attrs) >= 2; attrs = attrs[attrs[1]:] {
+		if attrs[0] == attrMessageAuthenticator && attrs[1] == 2+authLen {
+			value := append([]byte(nil), attrs[2:2+authLen]...)
+			for i := range attrs[2 : 2+authLen] {
+				attrs[2+i] = 0
+			}
+			return b, value
+		}
+	}
+	return b, nil
+}
+
+// Client sends requests to the RADIUS servers of a Config.
+type Client struct {
+	cfg     Config
+	timeout time.Duration
+	tries   int
+}
+
+// NewClient returns a Client for the servers of cfg.
+func NewClient(cfg Config) *Client {
+	if cfg.NASIdentifier == "" {
+		cfg.NASIdentifier = "router7"
+	}
+	return &Client{
+		cfg:     cfg,
+		timeout: 3 * time.Second,
+		tries:   3,
+	}
+}
+
+func withPort(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+// exchange sends request b (with identifier id and request authenticator
+// reqAuth) to server and returns the verified response.
+func (c *Client) exchange(server string, b []byte, id uint8, reqAuth [authLen]byte) (*packet, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, maxLen)
+	for try := 0; try < c.tries; try++ {
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break // retransmit
+				}
+				return nil, err
+			}
+			resp, err := c.verify(buf[:n], id, reqAuth)
+			if err != nil {
+				continue // e.g. a late response to a previous request
+			}
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("no response from RADIUS server %s", server)
+}
+
+var errResponseAuthenticator = errors.New("invalid response authenticator")
+
+// verify parses response b and checks its authenticators against the
+// request with identifier id and authenticator reqAuth.
+func (c *Client) verify(b []byte, id uint8, reqAuth [authLen]byte) (*packet, error) {
+	resp, err := parsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	if resp.id != id {
+		return nil, fmt.Errorf("response for request %d, want %d", resp.id, id)
+	}
+	b = b[:binary.BigEndian.Uint16(b[2:4])]
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(reqAuth[:])
+	h.Write(b[hdrLen:])
+	h.Write([]byte(c.cfg.Secret))
+	if !hmac.Equal(h.Sum(nil), resp.authenticator[:]) {
+		return nil, errResponseAuthenticator
+	}
+	if zeroed, value := zeroMessageAuthenticator(b); value != nil {
+		copy(zeroed[4:hdrLen], reqAuth[:])
+		if !hmac.Equal(messageAuthenticator(zeroed, []byte(c.cfg.Secret)), value) {
+			return nil, fmt.Errorf("invalid Message-Authenticator")
+		}
+	}
+	return resp, nil
+}
+
+func newID() uint8 {
+	var b [1]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand must not fail
+	}
+	return b[0]
+}
+
+// Request is an authentication request of a PPP client, either with a
+// password (PAP) or with the response to a CHAP-MD5 challenge.
+type Request struct {
+	Username string
+	Password string // PAP
+
+	CHAPID        uint8
+	CHAPChallenge []byte
+	CHAPResponse  []byte
+
+	CallingStationID string // e.g. the hardware address of the client
+}
+
+// Accept is the authorization of an accepted Request.
+type Accept struct {
+	FramedIP       net.IP        // assigned by the server, if set
+	SessionTimeout time.Duration // 0: unlimited
+	Message        string
+}
+
+// RejectError is returned when the server rejects a Request.
+type RejectError struct {
+	Message string // Reply-Message of the server, if any
+}
+
+func (e *RejectError) Error() string {
+	if e.Message == "" {
+		return "rejected by RADIUS server"
+	}
+	return fmt.Sprintf("rejected by RADIUS server: %q", e.Message)
+}
+
+// accessRequest returns the Access-Request for r.
+func (c *Client) accessRequest(r Request) *packet {
+	p := &packet{code: codeAccessRequest, id: newID()}
+	if _, err := rand.Read(p.authenticator[:]); err != nil {
+		panic(err) // crypto/rand must not fail
+	}
+	p.addString(attrUserName, r.Username)
+	if r.CHAPResponse != nil {
+		p.add(attrCHAPPassword, append([]byte{r.CHAPID}, r.CHAPResponse...))
+		p.add(attrCHAPChallenge, r.CHAPChallenge)
+	} else {
+		p.add(attrUserPassword, hidePassword([]byte(r.Password), []byte(c.cfg.Secret), p.authenticator))
+	}
+	p.addUint32(attrServiceType, serviceTypeFramed)
+	p.addUint32(attrFramedProtocol, framedProtocolPPP)
+	p.addUint32(attrNASPortType, nasPortTypeVirtual)
+	p.addString(attrNASIdentifier, c.cfg.NASIdentifier)
+	p.addString(attrCallingStationID, r.CallingStationID)
+	p.add(attrMessageAuthenticator, make([]byte, authLen))
+	return p
+}
+
+// Authenticate sends an Access-Request for r. It returns a *RejectError if
+// the server rejected r.
+func (c *Client) Authenticate(r Request) (*Accept, error) {
+	p := c.accessRequest(r)
+	b := p.marshal()
+	// The Message-Authenticator is the last attribute.
+	copy(b[len(b)-authLen:], messageAuthenticator(b, []byte(c.cfg.Secret)))
+	resp, err := c.exchange(withPort(c.cfg.Server, "1812"), b, p.id, p.authenticator)
+	if err != nil {
+		return nil, err
+	}
+	msg, _ := resp.attr(attrReplyMessage)
+	switch resp.code {
+	case codeAccessAccept:
+		a := &Accept{Message: string(msg)}
+		if ip, ok := resp.attr(attrFramedIPAddress); ok && len(ip) == 4 {
+			// 255.255.255.254 and 255.255.255.255 mean: assigned by
+			// the NAS, i.e. from the pool (RFC 2865 section 5.8).
+			if !net.IP(ip).Equal(net.IPv4bcast) && !net.IP(ip).Equal(net.IPv4(255, 255, 255, 254)) {
+				a.FramedIP = net.IP(append([]byte(nil), ip...))
+			}
+		}
+		if t, ok := resp.attr(attrSessionTimeout); ok && len(t) == 4 {
+			a.SessionTimeout = time.Duration(binary.BigEndian.Uint32(t)) * time.Second
+		}
+		return a, nil
+	case codeAccessReject:
+		return nil, &RejectError{Message: string(msg)}
+	}
+	return nil, fmt.Errorf("unexpected RADIUS response code %d", resp.code)
+}
+
+// Accounting status types.
+const (
+	Start         = 1
+	Stop          = 2
+	InterimUpdate = 3
+)
+
+// Termination causes, see RFC 2866 section 5.10.
+const (
+	CauseUserRequest    = 1
+	CauseLostCarrier    = 2
+	CauseSessionTimeout = 5
+	CauseAdminReset     = 6
+	CauseNASError       = 9
+)
+
+// Accounting is an accounting record of a session.
+type Accounting struct {
+	Status           int // Start, Stop or InterimUpdate
+	SessionID        string
+	Username         string
+	CallingStationID string
+	FramedIP         net.IP
+
+	// Set for Stop and InterimUpdate:
+	SessionTime   time.Duration
+	InputOctets   uint64 // received from the client
+	OutputOctets  uint64 // sent to the client
+	InputPackets  uint32
+	OutputPackets uint32
+
+	TerminateCause int // set for Stop
+}
+
+// accountingRequest returns the Accounting-Request for a, without its
+// authenticator.
+func (c *Client) accountingRequest(a Accounting) *packet {
+	p := &packet{code: codeAccountingRequest, id: newID()}
+	p.addUint32(attrAcctStatusType, uint32(a.Status))
+	p.addString(attrAcctSessionID, a.SessionID)
+	p.addString(attrUserName, a.Username)
+	p.addUint32(attrServiceType, serviceTypeFramed)
+	p.addUint32(attrFramedProtocol, framedProtocolPPP)
+	p.addUint32(attrNASPortType, nasPortTypeVirtual)
+	p.addString(attrNASIdentifier, c.cfg.NASIdentifier)
+	p.addString(attrCallingStationID, a.CallingStationID)
+	if ip := a.FramedIP.To4(); ip != nil {
+		p.add(attrFramedIPAddress, ip)
+	}
+	if a.Status != Start {
+		p.addUint32(attrAcctSessionTime, uint32(a.SessionTime/time.Second))
+		p.addUint32(attrAcctInputOctets, uint32(a.InputOctets))
+		p.addUint32(attrAcctInputGigawords, uint32(a.InputOctets>>32))
+		p.addUint32(attrAcctOutputOctets, uint32(a.OutputOctets))
+		p.addUint32(attrAcctOutputGigawords, uint32(a.OutputOctets>>32))
+		p.addUint32(attrAcctInputPackets, a.InputPackets)
+		p.addUint32(attrAcctOutputPackets, a.OutputPackets)
+	}
+	if a.Status == Stop && a.TerminateCause != 0 {
+		p.addUint32(attrAcctTerminateCause, uint32(a.TerminateCause))
+	}
+	return p
+}
+
+// Account sends an Accounting-Request for a to the accounting server, if
+// configured.
+func (c *Client) Account(a Accounting) error {
+	if c.cfg.Accounting == "" {
+		return nil
+	}
+	p := c.accountingRequest(a)
+	// RFC 2866 section 3: the Request Authenticator is the MD5 sum of the
+	// packet (with a zero authenticator) and the secret.
+	b := p.marshal()
+	h := md5.New()
+	h.Write(b)
+	h.Write([]byte(c.cfg.Secret))
+	copy(p.authenticator[:], h.Sum(nil))
+	copy(b[4:hdrLen], p.authenticator[:])
+	resp, err := c.exchange(withPort(c.cfg.Accounting, "1813"), b, p.id, p.authenticator)
+	if err != nil {
+		return err
+	}
+	if resp.code != codeAccountingResponse {
+		return fmt.Errorf("unexpected RADIUS response code %d", resp.code)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+const secret = "testing123"
+
+// revealPassword decrypts a User-Password attribute, i.e. reverses
+// hidePassword.
+func revealPassword(b, secret []byte, authenticator [authLen]byte) []byte {
+	out := make([]byte, len(b))
+	prev := authenticator[:]
+	for i := 0; i+authLen <= len(b); i += authLen {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		sum := h.Sum(nil)
+		for j := range sum {
+			out[i+j] = b[i+j] ^ sum[j]
+		}
+		prev = b[i : i+authLen]
+	}
+	return bytes.TrimRight(out, "\x00")
+}
+
+// fakeServer answers requests on a local UDP port with the packet returned
+// by handle, signed like a RADIUS server does.
+func fakeServer(t *testing.T, handle func(req *packet, raw []byte) *packet) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer pc.Close()
+		buf := make([]byte, maxLen)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := parsePacket(buf[:n])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp := handle(req, buf[:n])
+			if resp == nil {
+				continue // drop
+			}
+			resp.id = req.id
+			resp.authenticator = req.authenticator
+			b := resp.marshal()
+			h := md5.New()
+			h.Write(b)
+			h.Write([]byte(secret))
+			copy(b[4:hdrLen], h.Sum(nil))
+			if _, err := pc.WriteTo(b, addr); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestAuthenticate(t *testing.T) {
+	server := fakeServer(t, func(req *packet, raw []byte) *packet {
+		if req.code != codeAccessRequest {
+			t.Errorf("request code = %d, want %d", req.code, codeAccessRequest)
+		}
+		zeroed, value := zeroMessageAuthenticator(raw)
+		if !hmac.Equal(messageAuthenticator(zeroed, []byte(secret)), value) {
+			t.Errorf("invalid Message-Authenticator in request")
+		}
+		user, _ := req.attr(attrUserName)
+		var ok bool
+		if hidden, found := req.attr(attrUserPassword); found {
+			ok = string(revealPassword(hidden, []byte(secret), req.authenticator)) == "a rather long password"
+		}
+		if chap, found := req.attr(attrCHAPPassword); found && len(chap) == 1+md5.Size {
+			challenge, _ := req.attr(attrCHAPChallenge)
+			sum := md5.Sum(append(append([]byte{chap[0]}, "secret"...), challenge...))
+			ok = bytes.Equal(chap[1:], sum[:])
+		}
+		if string(user) != "alice" || !ok {
+			resp := &packet{code: codeAccessReject}
+			resp.addString(attrReplyMessage, "wrong password")
+			return resp
+		}
+		resp := &packet{code: codeAccessAccept}
+		resp.add(attrFramedIPAddress, net.ParseIP("10.64.0.99").To4())
+		resp.addUint32(attrSessionTimeout, 3600)
+		return resp
+	})
+	c := NewClient(Config{Server: server, Secret: secret})
+
+	accept, err := c.Authenticate(Request{Username: "alice", Password: "a rather long password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := accept.FramedIP.String(), "10.64.0.99"; got != want {
+		t.Errorf("FramedIP = %s, want %s", got, want)
+	}
+	if got, want := accept.SessionTimeout, time.Hour; got != want {
+		t.Errorf("SessionTimeout = %v, want %v", got, want)
+	}
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	sum := md5.Sum(append(append([]byte{42}, "secret"...), challenge...))
+	if _, err := c.Authenticate(Request{Username: "alice", CHAPID: 42, CHAPChallenge: challenge, CHAPResponse: sum[:]}); err != nil {
+		t.Errorf("Authenticate(CHAP): %v", err)
+	}
+
+	_, err = c.Authenticate(Request{Username: "alice", Password: "guess"})
+	if rerr, ok := err.(*RejectError); !ok || rerr.Message != "wrong password" {
+		t.Errorf("Authenticate(wrong password) = %v, want RejectError", err)
+	}
+}
+
+func TestAuthenticateWrongSecret(t *testing.T) {
+	server := fakeServer(t, func(req *packet, raw []byte) *packet {
+		return &packet{code: codeAccessAccept}
+	})
+	c := NewClient(Config{Server: server, Secret: "not the secret"})
+	c.timeout = 100 * time.Millisecond
+	if _, err := c.Authenticate(Request{Username: "alice"}); err == nil {
+		t.Errorf("Authenticate succeeded despite an invalid response authenticator")
+	}
+}
+
+func TestAccount(t *testing.T) {
+	records := make(chan *packet, 1)
+	server := fakeServer(t, func(req *packet, raw []byte) *packet {
+		// Verify the Request Authenticator (RFC 2866 section 3).
+		b := append([]byte(nil), raw...)
+		copy(b[4:hdrLen], make([]byte, authLen))
+		h := md5.New()
+		h.Write(b)
+		h.Write([]byte(secret))
+		if !hmac.Equal(h.Sum(nil), req.authenticator[:]) {
+			t.Errorf("invalid Request Authenticator")
+			return nil
+		}
+		records <- req
+		return &packet{code: codeAccountingResponse}
+	})
+	c := NewClient(Config{Server: server, Accounting: server, Secret: secret})
+	err := c.Account(Accounting{
+		Status:         Stop,
+		SessionID:      "5EC3B2A0-1234",
+		Username:       "alice",
+		FramedIP:       net.ParseIP("10.64.0.2"),
+		SessionTime:    90 * time.Second,
+		InputOctets:    5<<32 + 7,
+		TerminateCause: CauseUserRequest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-records
+	for _, tt := range []struct {
+		typ  uint8
+		want uint32
+	}{
+		{attrAcctStatusType, Stop},
+		{attrAcctSessionTime, 90},
+		{attrAcctInputOctets, 7},
+		{attrAcctInputGigawords, 5},
+		{attrAcctTerminateCause, CauseUserRequest},
+	} {
+		b, ok := req.attr(tt.typ)
+		if !ok || len(b) != 4 {
+			t.Errorf("attribute %d missing", tt.typ)
+			continue
+		}
+		if got := binary.BigEndian.Uint32(b); got != tt.want {
+			t.Errorf("attribute %d = %d, want %d", tt.typ, got, tt.want)
+		}
+	}
+
+	// Without an accounting server, no records are sent.
+	if err := NewClient(Config{Server: server, Secret: secret}).Account(Accounting{Status: Start}); err != nil {
+		t.Errorf("Account without accounting server: %v", err)
+	}
+}
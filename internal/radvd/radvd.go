@@ -26,20 +26,80 @@ import (
 	"golang.org/x/net/ipv6"
 )
 
+// Default lifetimes of announced prefixes, which are also the maximum
+// lifetimes announced for prefixes with a known lifetime: hosts learn about
+// changes within the preferred lifetime even if they miss a few
+// advertisements.
+const (
+	defaultPreferredLifetime = 30 * time.Minute
+	defaultValidLifetime     = 2 * time.Hour
+)
+
+// Prefix is announced for stateless address autoconfiguration. Prefixes
+// larger than /64 are announced as their first /64.
+type Prefix struct {
+	net.IPNet
+
+	// PreferredUntil and ValidUntil end the lifetimes of the prefix, e.g. of
+	// a DHCPv6 prefix delegation. The announced lifetimes never exceed them.
+	// Zero values result in the default lifetimes.
+	PreferredUntil time.Time
+	ValidUntil     time.Time
+}
+
+// announced returns the announced subnet of p.
+func (p Prefix) announced() net.IPNet {
+	ones, _ := p.Mask.Size()
+	// Use the first /64 subnet within larger prefixes
+	if ones < 64 {
+		ones = 64
+	}
+	return net.IPNet{IP: p.IP.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}
+}
+
+// lifetimes returns the preferred and valid lifetime to announce for p at now.
+func (p Prefix) lifetimes(now time.Time) (preferred, valid time.Duration) {
+	preferred, valid = defaultPreferredLifetime, defaultValidLifetime
+	if !p.PreferredUntil.IsZero() && p.PreferredUntil.Sub(now) < preferred {
+		preferred = p.PreferredUntil.Sub(now)
+	}
+	if !p.ValidUntil.IsZero() && p.ValidUntil.Sub(now) < valid {
+		valid = p.ValidUntil.Sub(now)
+	}
+	if valid < 0 {
+		valid = 0
+	}
+	if preferred > valid {
+		preferred = valid
+	}
+	if preferred < 0 {
+		preferred = 0
+	}
+	return preferred.Truncate(time.Second), valid.Truncate(time.Second)
+}
+
 type Server struct {
 	pc     *ipv6.PacketConn
 	ifname string
 
+	timeNow func() time.Time
+
 	mu       sync.Mutex
-	prefixes []net.IPNet
-	iface    *net.Interface
+	prefixes []Prefix
+	// deprecated are no longer part of prefixes and are announced with a
+	// preferred lifetime of 0 until their ValidUntil, so that hosts stop
+	// using addresses within them for new connections.
+	deprecated []Prefix
+	iface      *net.Interface
 }
 
 func NewServer() (*Server, error) {
-	return &Server{}, nil
+	return &Server{timeNow: time.Now}, nil
 }
 
-func (s *Server) SetPrefixes(prefixes []net.IPNet) {
+// SetPrefixes replaces the announced prefixes and sends a router
+// advertisement. Prefixes which are no longer announced are deprecated.
+func (s *Server) SetPrefixes(prefixes []Prefix) {
 	s.mu.Lock()
 	if s.ifname != "" {
 		var err error
@@ -50,13 +110,85 @@ func (s *Server) SetPrefixes(prefixes []net.IPNet) {
 			log.Fatal(err) // interface vanished
 		}
 	}
-	s.prefixes = prefixes
+	s.setPrefixesLocked(prefixes)
 	s.mu.Unlock()
 	if s.iface != nil {
 		s.sendAdvertisement(nil)
 	}
 }
 
+func (s *Server) setPrefixesLocked(prefixes []Prefix) {
+	now := s.timeNow()
+	current := make(map[string]bool)
+	for _, p := range prefixes {
+		a := p.announced()
+		current[a.String()] = true
+	}
+	var deprecated []Prefix
+	for _, p := range s.deprecated {
+		a := p.announced()
+		if current[a.String()] || !now.Before(p.ValidUntil) {
+			continue // announced again or expired
+		}
+		deprecated = append(deprecated, p)
+	}
+	for _, p := range s.prefixes {
+		a := p.announced()
+		if current[a.String()] {
+			continue
+		}
+		// Hosts do not reduce the valid lifetime of their addresses below
+		// 2 hours (RFC 4862, section 5.5.3e), but stop using them for new
+		// connections once they are no longer preferred.
+		_, valid := p.lifetimes(now)
+		if valid == 0 {
+			continue
+		}
+		log.Printf("deprecating prefix %v", a)
+		deprecated = append(deprecated, Prefix{IPNet: a, ValidUntil: now.Add(valid)})
+		current[a.String()] = true
+	}
+	s.prefixes = prefixes
+	s.deprecated = deprecated
+}
+
+// prefixOptions returns the prefix information options to announce at now.
+func (s *Server) prefixOptions(now time.Time) []ndp.Option {
+	var options []ndp.Option
+	for _, prefix := range s.prefixes {
+		preferred, valid := prefix.lifetimes(now)
+		if valid == 0 {
+			continue // expired
+		}
+		a := prefix.announced()
+		ones, _ := a.Mask.Size()
+		options = append(options, &ndp.PrefixInformation{
+			PrefixLength:                   uint8(ones),
+			OnLink:                         true,
+			AutonomousAddressConfiguration: true,
+			ValidLifetime:                  valid,
+			PreferredLifetime:              preferred,
+			Prefix:                         a.IP,
+		})
+	}
+	for _, prefix := range s.deprecated {
+		_, valid := prefix.lifetimes(now)
+		if valid == 0 {
+			continue // expired
+		}
+		ones, _ := prefix.Mask.Size()
+		options = append(options, &ndp.PrefixInformation{
+			PrefixLength:                   uint8(ones),
+			OnLink:                         true,
+			AutonomousAddressConfiguration: true,
+			ValidLifetime:                  valid,
+			PreferredLifetime:              0,
+			Prefix:                         prefix.IP,
+		})
+	}
+	return options
+}
+
 func (s *Server) Serve(ifname string, conn net.PacketConn) error {
 	var err error
 	s.ifname = ifname
@@ -127,7 +259,7 @@ var ipv6LinkLocal = func(cidr string) *net.IPNet {
 func (s *Server) sendAdvertisement(addr net.Addr) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.prefixes == nil {
+	if s.prefixes == nil && len(s.deprecated) == 0 {
 		return nil // nothing to do
 	}
 	if addr == nil {
@@ -155,7 +287,7 @@ func (s *Server) sendAdvertisement(addr net.Addr) error {
 				break
 			}
 		}
-		if !linkLocal.Equal(net.IPv6zero) {
+		if linkLocal != nil {
 			options = append(options, &ndp.RecursiveDNSServer{
 				Lifetime: 30 * time.Minute,
 				Servers:  []net.IP{linkLocal},
@@ -163,22 +295,7 @@ func (s *Server) sendAdvertisement(addr net.Addr) error {
 		}
 	}
 
-	for _, prefix := range s.prefixes {
-		ones, _ := prefix.Mask.Size()
-		// Use the first /64 subnet within larger prefixes
-		if ones < 64 {
-			ones = 64
-		}
-
-		options = append(options, &ndp.PrefixInformation{
-			PrefixLength:                   uint8(ones),
-			OnLink:                         true,
-			AutonomousAddressConfiguration: true,
-			ValidLifetime:                  2 * time.Hour,
-			PreferredLifetime:              30 * time.Minute,
-			Prefix:                         prefix.IP,
-		})
-	}
+	options = append(options, s.prefixOptions(s.timeNow())...)
 
 	options = append(options,
 		ndp.NewMTU(uint32(s.iface.MTU)),
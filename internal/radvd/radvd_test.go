@@ -0,0 +1,103 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package radvd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/ndp"
+)
+
+func mustParseCIDR(s string) net.IPNet {
+	_, net, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *net
+}
+
+func TestPrefixLifetimes(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := &Server{timeNow: func() time.Time { return now }}
+
+	pi := func(prefix string, preferred, valid time.Duration) ndp.Option {
+		p := mustParseCIDR(prefix)
+		ones, _ := p.Mask.Size()
+		return &ndp.PrefixInformation{
+			PrefixLength:                   uint8(ones),
+			OnLink:                         true,
+			AutonomousAddressConfiguration: true,
+			ValidLifetime:                  valid,
+			PreferredLifetime:              preferred,
+			Prefix:                         p.IP,
+		}
+	}
+
+	s.SetPrefixes([]Prefix{
+		{
+			IPNet:          mustParseCIDR("2001:db8:1::/48"),
+			PreferredUntil: now.Add(10 * time.Minute),
+			ValidUntil:     now.Add(24 * time.Hour),
+		},
+		{IPNet: mustParseCIDR("2001:db8:2::/64")},
+	})
+	want := []ndp.Option{
+		pi("2001:db8:1::/64", 10*time.Minute, defaultValidLifetime),
+		pi("2001:db8:2::/64", defaultPreferredLifetime, defaultValidLifetime),
+	}
+	if diff := cmp.Diff(want, s.prefixOptions(now)); diff != "" {
+		t.Fatalf("prefixOptions: diff (-want +got):\n%s", diff)
+	}
+
+	// The lease is renewed with a new prefix: the old prefix is deprecated.
+	now = now.Add(5 * time.Minute)
+	s.SetPrefixes([]Prefix{
+		{
+			IPNet:          mustParseCIDR("2001:db8:3::/48"),
+			PreferredUntil: now.Add(1 * time.Hour),
+			ValidUntil:     now.Add(90 * time.Minute),
+		},
+		{IPNet: mustParseCIDR("2001:db8:2::/64")},
+	})
+	later := now.Add(30 * time.Minute)
+	want = []ndp.Option{
+		pi("2001:db8:3::/64", 30*time.Minute, 60*time.Minute),
+		pi("2001:db8:2::/64", defaultPreferredLifetime, defaultValidLifetime),
+		pi("2001:db8:1::/64", 0, defaultValidLifetime-30*time.Minute),
+	}
+	if diff := cmp.Diff(want, s.prefixOptions(later)); diff != "" {
+		t.Fatalf("prefixOptions after prefix change: diff (-want +got):\n%s", diff)
+	}
+
+	// The old prefix is delegated again: it is no longer deprecated.
+	s.SetPrefixes([]Prefix{{IPNet: mustParseCIDR("2001:db8:1::/48")}})
+	want = []ndp.Option{
+		pi("2001:db8:1::/64", defaultPreferredLifetime, defaultValidLifetime),
+		pi("2001:db8:3::/64", 0, 90*time.Minute),
+		pi("2001:db8:2::/64", 0, defaultValidLifetime),
+	}
+	if diff := cmp.Diff(want, s.prefixOptions(now)); diff != "" {
+		t.Fatalf("prefixOptions after prefix returned: diff (-want +got):\n%s", diff)
+	}
+
+	// Deprecated prefixes are no longer announced once they expired.
+	want = want[:1]
+	if diff := cmp.Diff(want, s.prefixOptions(now.Add(defaultValidLifetime))); diff != "" {
+		t.Errorf("prefixOptions after expiry: diff (-want +got):\n%s", diff)
+	}
+}
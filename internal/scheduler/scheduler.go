@@ -0,0 +1,296 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scheduler runs periodic maintenance tasks (e.g. blocklist refreshes,
+// speedtests, backups, certificate renewals) on cron-like schedules, as
+// configured in /perm/schedule.json.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rtr7/router7/internal/notify"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Task is an entry in schedule.json. Exactly one of URL, Process and Command
+// must be set.
+type Task struct {
+	Name     string `json:"name"`     // e.g. “backup”
+	Schedule string `json:"schedule"` // see Parse, e.g. “30 3 * * *”
+
+	// Jitter delays each run by a random duration of up to Jitter (e.g.
+	// “10m”), so that multiple routers do not hit a service simultaneously.
+	Jitter string `json:"jitter"`
+
+	// Timeout bounds each run (default: 10m).
+	Timeout string `json:"timeout"`
+
+	// URL is requested with Method (default: POST), e.g. to trigger an API
+	// of another router7 daemon.
+	URL    string `json:"url"`
+	Method string `json:"method"`
+
+	// Process is sent SIGUSR1, e.g. /user/dnsd to reload its configuration.
+	Process string `json:"process"`
+
+	// Command is executed, e.g. ["/perm/bin/renew-certs", "--quiet"].
+	Command []string `json:"command"`
+}
+
+// ReadConfig reads the tasks from schedule.json in dir.
+func ReadConfig(dir string) ([]Task, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "schedule.json"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Tasks []Task `json:"tasks"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg.Tasks, nil
+}
+
+// Status is the status of a task.
+type Status struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+	Running  bool      `json:"running"`
+
+	LastRun      time.Time `json:"last_run"`
+	LastDuration float64   `json:"last_duration_seconds"`
+	LastError    string    `json:"last_error"` // empty if successful
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+}
+
+type task struct {
+	Task
+	schedule Schedule
+	jitter   time.Duration
+	timeout  time.Duration
+	run      func(ctx context.Context) error
+
+	status Status // guarded by Scheduler.mu
+}
+
+// Scheduler runs tasks according to their schedules.
+type Scheduler struct {
+	mu    sync.Mutex
+	tasks []*task
+}
+
+func newTask(t Task) (*task, error) {
+	if t.Name == "" {
+		return nil, fmt.Errorf("task without name")
+	}
+	sched, err := Parse(t.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", t.Name, err)
+	}
+	tt := &task{
+		Task:     t,
+		schedule: sched,
+		timeout:  10 * time.Minute,
+		status: Status{
+			Name:     t.Name,
+			Schedule: t.Schedule,
+		},
+	}
+	if t.Jitter != "" {
+		if tt.jitter, err = time.ParseDuration(t.Jitter); err != nil {
+			return nil, fmt.Errorf("%s: jitter: %v", t.Name, err)
+		}
+	}
+	if t.Timeout != "" {
+		if tt.timeout, err = time.ParseDuration(t.Timeout); err != nil {
+			return nil, fmt.Errorf("%s: timeout: %v", t.Name, err)
+		}
+	}
+	var actions int
+	if t.URL != "" {
+		actions++
+		method := t.Method
+		if method == "" {
+			method = "POST"
+		}
+		tt.run = func(ctx context.Context) error { return request(ctx, method, t.URL) }
+	}
+	if t.Process != "" {
+		actions++
+		tt.run = func(ctx context.Context) error { return notify.Process(t.Process, syscall.SIGUSR1) }
+	}
+	if len(t.Command) > 0 {
+		actions++
+		tt.run = func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			return cmd.Run()
+		}
+	}
+	if actions != 1 {
+		return nil, fmt.Errorf("%s: exactly one of url, process and command must be set", t.Name)
+	}
+	return tt, nil
+}
+
+func request(ctx context.Context, method, url string) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP status %v: %s", resp.Status, b)
+	}
+	return nil
+}
+
+// New returns a Scheduler for tasks.
+func New(tasks []Task) (*Scheduler, error) {
+	s := &Scheduler{}
+	names := make(map[string]bool)
+	for _, t := range tasks {
+		tt, err := newTask(t)
+		if err != nil {
+			return nil, err
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate task name %q", t.Name)
+		}
+		names[t.Name] = true
+		s.tasks = append(s.tasks, tt)
+	}
+	return s, nil
+}
+
+// Run runs the tasks until ctx is canceled.
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range s.tasks {
+		wg.Add(1)
+		go func(t *task) {
+			defer wg.Done()
+			s.loop(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, t *task) {
+	for {
+		next := t.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("%s: schedule %q never activates", t.Name, t.Schedule)
+			return
+		}
+		if t.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(t.jitter))))
+		}
+		s.mu.Lock()
+		t.status.NextRun = next
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		s.runTask(ctx, t)
+	}
+}
+
+// runTask runs t once and records its status.
+func (s *Scheduler) runTask(ctx context.Context, t *task) {
+	s.mu.Lock()
+	t.status.Running = true
+	s.mu.Unlock()
+
+	start := time.Now()
+	log.Printf("%s: running", t.Name)
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	err := t.run(ctx)
+	cancel()
+	duration := time.Since(start)
+	if err != nil {
+		log.Printf("%s: failed after %v: %v", t.Name, duration, err)
+	} else {
+		log.Printf("%s: done after %v", t.Name, duration)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.status.Running = false
+	t.status.LastRun = start
+	t.status.LastDuration = duration.Seconds()
+	t.status.Runs++
+	t.status.LastError = ""
+	if err != nil {
+		t.status.LastError = err.Error()
+		t.status.Failures++
+	}
+}
+
+// RunNow runs the task called name immediately (in addition to its
+// schedule) and returns once it completed.
+func (s *Scheduler) RunNow(ctx context.Context, name string) error {
+	for _, t := range s.tasks {
+		if t.Name != name {
+			continue
+		}
+		s.runTask(ctx, t)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if t.status.LastError != "" {
+			return fmt.Errorf("%s", t.status.LastError)
+		}
+		return nil
+	}
+	return fmt.Errorf("no such task: %q", name)
+}
+
+// Status returns the status of all tasks, ordered by name.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		statuses = append(statuses, t.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	base := time.Date(2020, 6, 1, 13, 37, 42, 0, time.UTC) // a Monday
+	for _, tt := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, 6, 1, 13, 38, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 6, 1, 13, 45, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2020, 6, 2, 3, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2020, 6, 1, 17, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2020, 6, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 6, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 3", time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC)}, // dom or dow
+		{"@monthly", time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 6, 1, 14, 0, 0, 0, time.UTC)},
+		{"@every 6h", time.Date(2020, 6, 1, 18, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	} {
+		sched, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		if got := sched.Next(base); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next(%v) = %v, want %v", tt.spec, base, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"@every 10s",
+		"@fortnightly",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q): unexpectedly succeeded", spec)
+		}
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/fail" {
+			http.Error(w, "backup target full", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := New([]Task{
+		{Name: "backup", Schedule: "@daily", URL: srv.URL + "/backup"},
+		{Name: "speedtest", Schedule: "@hourly", Jitter: "5m", URL: srv.URL + "/fail"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.RunNow(ctx, "backup"); err != nil {
+		t.Errorf("RunNow(backup): %v", err)
+	}
+	if err := s.RunNow(ctx, "speedtest"); err == nil {
+		t.Errorf("RunNow(speedtest): unexpectedly succeeded")
+	}
+	if err := s.RunNow(ctx, "nonexistent"); err == nil {
+		t.Errorf("RunNow(nonexistent): unexpectedly succeeded")
+	}
+	if got, want := calls, 2; got != want {
+		t.Errorf("unexpected number of requests: got %d, want %d", got, want)
+	}
+	st := s.Status()
+	if got, want := len(st), 2; got != want {
+		t.Fatalf("unexpected number of statuses: got %d, want %d", got, want)
+	}
+	if st[0].Name != "backup" || st[0].Runs != 1 || st[0].LastError != "" {
+		t.Errorf("unexpected backup status: %+v", st[0])
+	}
+	if st[1].Name != "speedtest" || st[1].Failures != 1 || st[1].LastError == "" {
+		t.Errorf("unexpected speedtest status: %+v", st[1])
+	}
+
+	for _, tasks := range [][]Task{
+		{{Name: "x", Schedule: "@daily"}},                                      // no action
+		{{Name: "x", Schedule: "@daily", URL: "http://x", Process: "/user/x"}}, // two actions
+		{{Schedule: "@daily", URL: "http://x"}},                                // no name
+		{{Name: "x", Schedule: "@daily", URL: "http://x"}, {Name: "x", Schedule: "@daily", URL: "http://y"}},
+	} {
+		if _, err := New(tasks); err == nil {
+			t.Errorf("New(%+v): unexpectedly succeeded", tasks)
+		}
+	}
+}
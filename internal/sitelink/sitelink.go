@@ -0,0 +1,217 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sitelink exchanges the LAN prefixes of router7 instances which are
+// connected by WireGuard (see sites.json). Each site serves its prefixes on
+// its WireGuard address, only to the tunnel addresses of the configured
+// sites: WireGuard authenticates the peers, and only accepts packets from a
+// tunnel address through the peer whose allowed IPs include it.
+package sitelink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp6"
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+// MaxPrefixes is the maximum number of prefixes accepted from a site, so that
+// a misconfigured site cannot flood the routing table.
+const MaxPrefixes = 64
+
+// Prefixes is the response of the /prefixes handler.
+type Prefixes struct {
+	Site     string   `json:"site"` // name of the serving site, informational
+	Prefixes []string `json:"prefixes"`
+}
+
+// LocalPrefixes returns the LAN prefixes of this site: the networks of the
+// addresses of interfaces.json in dir (except for uplinks and the site
+// interface ifname) and the subnets of the delegated IPv6 prefixes.
+func LocalPrefixes(dir, ifname string) ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "interfaces.json"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg netconfig.InterfaceConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	for _, details := range cfg.Interfaces {
+		if details.Addr == "" ||
+			details.Name == ifname ||
+			strings.HasPrefix(details.Name, "uplink") {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(details.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("interfaces.json: %s: %v", details.Name, err)
+		}
+		prefixes = append(prefixes, ipnet.String())
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, "dhcp6/wire/lease.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var lease dhcp6.Config
+		if err := json.Unmarshal(b, &lease); err != nil {
+			return nil, err
+		}
+		subnets, err := netconfig.IPv6Subnets(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range lease.Prefixes {
+			for _, idx := range subnets {
+				if idx < 0 {
+					continue
+				}
+				subnet, err := netconfig.Subnet(prefix, idx)
+				if err != nil {
+					continue // reported by netconfigd
+				}
+				prefixes = append(prefixes, subnet.String())
+			}
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+// Handler returns a handler serving the prefixes returned by local to the
+// tunnel addresses of the sites of cfg.
+func Handler(name string, cfg netconfig.SitesConfig, local func() ([]string, error)) http.Handler {
+	allowed := make(map[string]bool)
+	for _, s := range cfg.Sites {
+		allowed[net.ParseIP(s.TunnelAddr).String()] = true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prefixes", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !allowed[net.ParseIP(host).String()] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		prefixes, err := local()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Prefixes{Site: name, Prefixes: prefixes})
+	})
+	return mux
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Fetch fetches the prefixes of site s, which serves them on port.
+func Fetch(s netconfig.Site, port int) ([]string, error) {
+	u := "http://" + net.JoinHostPort(s.TunnelAddr, strconv.Itoa(port)) + "/prefixes"
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: unexpected HTTP status: got %v, want %v (body: %s)", u, resp.Status, want, strings.TrimSpace(string(b)))
+	}
+	var p Prefixes
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	return p.Prefixes, nil
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Filter returns the prefixes which are safe to route to a site: prefixes
+// which are malformed, default routes, link-local or multicast, or which
+// overlap with reserved networks (e.g. the local prefixes, the tunnel
+// addresses and the prefixes of other sites) are rejected, as are prefixes
+// beyond MaxPrefixes. The returned error describes the rejected prefixes.
+func Filter(prefixes []string, reserved []*net.IPNet) ([]string, error) {
+	var (
+		accepted []string
+		rejected []string
+		seen     = make(map[string]bool)
+	)
+	for _, p := range prefixes {
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%q: %v", p, err))
+			continue
+		}
+		if seen[ipnet.String()] {
+			continue
+		}
+		seen[ipnet.String()] = true
+		if ones, _ := ipnet.Mask.Size(); ones == 0 {
+			rejected = append(rejected, fmt.Sprintf("%v: default route", ipnet))
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() || ipnet.IP.IsMulticast() {
+			rejected = append(rejected, fmt.Sprintf("%v: link-local or multicast", ipnet))
+			continue
+		}
+		var conflict *net.IPNet
+		for _, r := range reserved {
+			if overlaps(ipnet, r) {
+				conflict = r
+				break
+			}
+		}
+		if conflict != nil {
+			rejected = append(rejected, fmt.Sprintf("%v: overlaps %v", ipnet, conflict))
+			continue
+		}
+		if len(accepted) == MaxPrefixes {
+			rejected = append(rejected, fmt.Sprintf("%v: more than %d prefixes", ipnet, MaxPrefixes))
+			continue
+		}
+		accepted = append(accepted, ipnet.String())
+	}
+	sort.Strings(accepted)
+	if len(rejected) > 0 {
+		return accepted, fmt.Errorf("rejected %s", strings.Join(rejected, ", "))
+	}
+	return accepted, nil
+}
+
+// ParseNets parses the networks in prefixes, skipping malformed entries.
+func ParseNets(prefixes []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range prefixes {
+		if _, ipnet, err := net.ParseCIDR(p); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sitelink
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/netconfig"
+)
+
+func TestLocalPrefixes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sitelink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Join(tmp, "dhcp6", "wire"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fn, content := range map[string]string{
+		"interfaces.json": `{"interfaces": [
+  {"name": "uplink0", "addr": "203.0.113.2/24"},
+  {"name": "lan0", "addr": "192.168.42.1/24"},
+  {"name": "guest0", "addr": "192.168.44.1/24", "ipv6_subnet": 1},
+  {"name": "wg0", "addr": "10.0.137.1/24"}
+]}`,
+		"dhcp6/wire/lease.json": `{"prefixes": [{"IP": "2001:db8::", "Mask": "////////AAAAAAAAAAAAAA=="}]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmp, fn), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := LocalPrefixes(tmp, "wg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"192.168.42.0/24",
+		"192.168.44.0/24",
+		"2001:db8:0:1::/64",
+		"2001:db8::/64",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("LocalPrefixes: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	reserved := ParseNets([]string{"192.168.42.0/24", "10.0.137.2/32"})
+	got, err := Filter([]string{
+		"192.168.43.0/24",
+		"192.168.43.0/24", // duplicate
+		"2001:db8:43::/64",
+		"0.0.0.0/0",
+		"fe80::/64",
+		"192.168.0.0/16", // contains 192.168.42.0/24
+		"10.0.137.0/24",  // contains the tunnel address
+		"bogus",
+	}, reserved)
+	if err == nil {
+		t.Errorf("Filter unexpectedly returned no error")
+	}
+	want := []string{"192.168.43.0/24", "2001:db8:43::/64"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Filter: diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	cfg := netconfig.SitesConfig{
+		Sites: []netconfig.Site{{Name: "office", TunnelAddr: "127.0.0.1"}},
+	}
+	h := Handler("home", cfg, func() ([]string, error) {
+		return []string{"192.168.42.0/24"}, nil
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Fetch(cfg.Sites[0], p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"192.168.42.0/24"}, got); diff != "" {
+		t.Errorf("Fetch: diff (-want +got):\n%s", diff)
+	}
+
+	// Requests from other addresses are forbidden.
+	req := httptest.NewRequest("GET", "/prefixes", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusForbidden; got != want {
+		t.Errorf("GET /prefixes from 192.0.2.1: status %d, want %d", got, want)
+	}
+}
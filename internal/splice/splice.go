@@ -0,0 +1,46 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package splice copies data between connections, e.g. between a client and
+// the upstream of a proxy.
+package splice
+
+import (
+	"io"
+	"net"
+)
+
+// CloseWriter is implemented by connections which can shut down their
+// writing side (e.g. *net.TCPConn), signaling the end of data to the peer
+// while still reading its reply.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// Conns copies data between a and b until both directions are done. The
+// end of data in one direction is passed on via CloseWrite, if supported.
+func Conns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(CloseWriter); ok {
+			cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	<-done
+}
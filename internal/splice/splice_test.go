@@ -0,0 +1,89 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package splice_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/rtr7/router7/internal/splice"
+)
+
+// pair returns both ends of a TCP connection via the loopback interface.
+func pair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+func TestConns(t *testing.T) {
+	client, a := pair(t)
+	defer client.Close()
+	defer a.Close()
+	b, upstream := pair(t)
+	defer b.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		splice.Conns(a, b)
+		close(done)
+	}()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// The end of the request is passed on, so that upstream can reply.
+	req, err := ioutil.ReadAll(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(req), "request"; got != want {
+		t.Errorf("upstream read %q, want %q", got, want)
+	}
+	if _, err := upstream.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(reply), "reply"; got != want {
+		t.Errorf("client read %q, want %q", got, want)
+	}
+	<-done
+}
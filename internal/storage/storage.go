@@ -0,0 +1,286 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage keeps the permanent partition from filling up: it enforces
+// size and age budgets for directories of accumulating data (logs, history,
+// packet captures) by deleting their oldest files, and monitors free space
+// and flash wear.
+//
+// A full /perm breaks lease persistence of dhcp4d, so budgets are halved
+// while free space is below the configured minimum.
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Budget limits the disk usage of a directory.
+type Budget struct {
+	Path     string `json:"path"`      // relative to /perm, e.g. “usage”
+	MaxBytes int64  `json:"max_bytes"` // 0 means no size limit
+	MaxAge   string `json:"max_age"`   // e.g. “720h”, empty means no age limit
+}
+
+// DefaultBudgets are used for directories which are not configured.
+var DefaultBudgets = []Budget{
+	{Path: "usage", MaxBytes: 16 << 20, MaxAge: "2160h"},
+	{Path: "log", MaxBytes: 32 << 20},
+	{Path: "pcap", MaxBytes: 64 << 20, MaxAge: "168h"},
+}
+
+// Config is read from /perm/storage.json.
+type Config struct {
+	Budgets []Budget `json:"budgets"`
+
+	// MinFreePercent is the free space below which an alert is sent and
+	// budgets are halved (default: 10).
+	MinFreePercent float64 `json:"min_free_percent"`
+
+	// MaxWearPercent is the estimated flash wear (eMMC life time) at which
+	// an alert is sent (default: 80).
+	MaxWearPercent float64 `json:"max_wear_percent"`
+}
+
+// ReadConfig reads storage.json from dir. A missing file results in the
+// default configuration.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "storage.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.MinFreePercent == 0 {
+		cfg.MinFreePercent = 10
+	}
+	if cfg.MaxWearPercent == 0 {
+		cfg.MaxWearPercent = 80
+	}
+	configured := make(map[string]bool)
+	for _, b := range cfg.Budgets {
+		if b.Path == "" || filepath.IsAbs(b.Path) || strings.HasPrefix(filepath.Clean(b.Path), "..") {
+			return cfg, fmt.Errorf("budget path %q must be relative to /perm", b.Path)
+		}
+		if b.MaxAge != "" {
+			if _, err := time.ParseDuration(b.MaxAge); err != nil {
+				return cfg, fmt.Errorf("budget %s: max_age: %v", b.Path, err)
+			}
+		}
+		configured[filepath.Clean(b.Path)] = true
+	}
+	for _, b := range DefaultBudgets {
+		if !configured[b.Path] {
+			cfg.Budgets = append(cfg.Budgets, b)
+		}
+	}
+	return cfg, nil
+}
+
+// BudgetStatus is the disk usage of a budgeted directory.
+type BudgetStatus struct {
+	Path         string `json:"path"`
+	Bytes        int64  `json:"bytes"`
+	MaxBytes     int64  `json:"max_bytes"`
+	RotatedFiles int    `json:"rotated_files"` // during this check
+	RotatedBytes int64  `json:"rotated_bytes"` // during this check
+}
+
+// Status is the result of a check.
+type Status struct {
+	Time        time.Time      `json:"time"`
+	TotalBytes  uint64         `json:"total_bytes"`
+	FreeBytes   uint64         `json:"free_bytes"`
+	FreePercent float64        `json:"free_percent"`
+	Budgets     []BudgetStatus `json:"budgets"`
+
+	// WrittenBytes is the number of bytes written to the device holding
+	// /perm since boot.
+	WrittenBytes uint64 `json:"written_bytes"`
+
+	// WearPercent is the upper bound of the eMMC life time estimate, or -1
+	// if the device does not report it.
+	WearPercent float64 `json:"wear_percent"`
+
+	FreeLow  bool `json:"free_low"`
+	WearHigh bool `json:"wear_high"`
+}
+
+// Manager checks the partition mounted at Dir.
+type Manager struct {
+	Dir   string // e.g. /perm
+	Sysfs string // e.g. /sys
+}
+
+// NewManager returns a Manager for the partition mounted at dir.
+func NewManager(dir string) *Manager {
+	return &Manager{Dir: dir, Sysfs: "/sys"}
+}
+
+// Check enforces the budgets of cfg and returns the resulting status.
+func (m *Manager) Check(cfg Config, now time.Time) (*Status, error) {
+	st := &Status{Time: now, WearPercent: -1}
+	if err := m.statfs(st); err != nil {
+		return nil, err
+	}
+	st.FreeLow = st.FreePercent < cfg.MinFreePercent
+	for _, b := range cfg.Budgets {
+		if st.FreeLow {
+			b.MaxBytes /= 2
+		}
+		bs, err := rotate(filepath.Join(m.Dir, b.Path), b, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Path, err)
+		}
+		st.Budgets = append(st.Budgets, bs)
+	}
+	if err := m.statfs(st); err != nil {
+		return nil, err
+	}
+	if err := m.blockStats(st); err != nil {
+		return nil, err
+	}
+	st.WearHigh = st.WearPercent >= cfg.MaxWearPercent
+	return st, nil
+}
+
+func (m *Manager) statfs(st *Status) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(m.Dir, &fs); err != nil {
+		return err
+	}
+	st.TotalBytes = fs.Blocks * uint64(fs.Bsize)
+	st.FreeBytes = fs.Bavail * uint64(fs.Bsize)
+	if st.TotalBytes > 0 {
+		st.FreePercent = 100 * float64(st.FreeBytes) / float64(st.TotalBytes)
+	}
+	return nil
+}
+
+// blockStats fills in the write and wear statistics of the block device
+// holding m.Dir, if available.
+func (m *Manager) blockStats(st *Status) error {
+	var stat unix.Stat_t
+	if err := unix.Stat(m.Dir, &stat); err != nil {
+		return err
+	}
+	dev := filepath.Join(m.Sysfs, "dev", "block", fmt.Sprintf("%d:%d", unix.Major(stat.Dev), unix.Minor(stat.Dev)))
+	if b, err := ioutil.ReadFile(filepath.Join(dev, "stat")); err == nil {
+		// See https://www.kernel.org/doc/Documentation/block/stat.txt
+		if fields := strings.Fields(string(b)); len(fields) > 6 {
+			sectors, err := strconv.ParseUint(fields[6], 10, 64)
+			if err == nil {
+				st.WrittenBytes = sectors * 512
+			}
+		}
+	}
+	// The life time estimate is reported by the whole device (e.g. mmcblk0),
+	// which is the parent of the partition (e.g. mmcblk0p4).
+	for _, path := range []string{
+		filepath.Join(dev, "device", "life_time"),
+		filepath.Join(dev, "..", "device", "life_time"),
+	} {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			st.WearPercent = parseLifeTime(string(b))
+			break
+		}
+	}
+	return nil
+}
+
+// parseLifeTime parses the eMMC DEVICE_LIFE_TIME_EST_TYP_A and _TYP_B
+// values (e.g. “0x02 0x01”), which estimate the used life time in steps of
+// 10%, and returns the upper bound of the larger one in percent.
+func parseLifeTime(s string) float64 {
+	wear := -1.0
+	for _, f := range strings.Fields(s) {
+		v, err := strconv.ParseUint(f, 0, 8)
+		if err != nil || v == 0 {
+			continue // not defined
+		}
+		if pct := float64(v) * 10; pct > wear {
+			wear = pct // 0x0B (exceeded) results in 110
+		}
+	}
+	return wear
+}
+
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// rotate deletes the files in dir which are older than b.MaxAge, then the
+// oldest files until the remaining files fit into b.MaxBytes.
+func rotate(dir string, b Budget, now time.Time) (BudgetStatus, error) {
+	bs := BudgetStatus{Path: b.Path, MaxBytes: b.MaxBytes}
+	var files []file
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, file{path, info.Size(), info.ModTime()})
+			bs.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return bs, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var cutoff time.Time
+	if b.MaxAge != "" {
+		maxAge, err := time.ParseDuration(b.MaxAge)
+		if err != nil {
+			return bs, err
+		}
+		cutoff = now.Add(-maxAge)
+	}
+	for _, f := range files {
+		if !f.modTime.Before(cutoff) && (b.MaxBytes == 0 || bs.Bytes <= b.MaxBytes) {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			return bs, err
+		}
+		bs.Bytes -= f.size
+		bs.RotatedFiles++
+		bs.RotatedBytes += f.size
+	}
+	return bs, nil
+}
+
+// Rotate enforces b for dir (which need not be below the managed
+// partition), e.g. for per-source budgets of a daemon within its directory.
+func Rotate(dir string, b Budget, now time.Time) (BudgetStatus, error) {
+	return rotate(dir, b, now)
+}
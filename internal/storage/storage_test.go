@@ -0,0 +1,149 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCheck(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	perm := filepath.Join(tmp, "perm")
+	now := time.Date(2020, 6, 1, 13, 37, 0, 0, time.UTC)
+
+	// log/0 (oldest) … log/4 (newest), 1 KiB each
+	if err := os.MkdirAll(filepath.Join(perm, "log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(perm, "log", fmt.Sprint(i))
+		if err := ioutil.WriteFile(path, make([]byte, 1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-5) * 24 * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// leases must never be touched
+	if err := os.MkdirAll(filepath.Join(perm, "dhcp4d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	leases := filepath.Join(perm, "dhcp4d", "leases.json")
+	if err := ioutil.WriteFile(leases, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake the sysfs entries of the block device holding perm.
+	var stat unix.Stat_t
+	if err := unix.Stat(perm, &stat); err != nil {
+		t.Fatal(err)
+	}
+	sysfs := filepath.Join(tmp, "sys")
+	dev := filepath.Join(sysfs, "dev", "block", fmt.Sprintf("%d:%d", unix.Major(stat.Dev), unix.Minor(stat.Dev)))
+	if err := os.MkdirAll(filepath.Join(dev, "device"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const blockStat = "  137    0  5082  256  2048   13  4096  1201  0  1300  1457\n"
+	if err := ioutil.WriteFile(filepath.Join(dev, "stat"), []byte(blockStat), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dev, "device", "life_time"), []byte("0x02 0x09\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Config{
+		Budgets: []Budget{
+			{Path: "log", MaxBytes: 3 * 1024, MaxAge: "96h"},
+			{Path: "nonexistent", MaxBytes: 1},
+		},
+		MinFreePercent: 0, // never low, so that budgets are not halved
+		MaxWearPercent: 80,
+	}
+	m := &Manager{Dir: perm, Sysfs: sysfs}
+	st, err := m.Check(cfg, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// log/0 exceeds max_age, log/1 exceeds max_bytes
+	if got, want := st.Budgets[0], (BudgetStatus{
+		Path:         "log",
+		Bytes:        3 * 1024,
+		MaxBytes:     3 * 1024,
+		RotatedFiles: 2,
+		RotatedBytes: 2 * 1024,
+	}); got != want {
+		t.Errorf("unexpected log budget: got %+v, want %+v", got, want)
+	}
+	for i, want := range []bool{false, false, true, true, true} {
+		_, err := os.Stat(filepath.Join(perm, "log", fmt.Sprint(i)))
+		if got := err == nil; got != want {
+			t.Errorf("log/%d exists = %v, want %v", i, got, want)
+		}
+	}
+	if _, err := os.Stat(leases); err != nil {
+		t.Errorf("leases.json deleted: %v", err)
+	}
+	if got, want := st.WrittenBytes, uint64(4096*512); got != want {
+		t.Errorf("unexpected written bytes: got %d, want %d", got, want)
+	}
+	if got, want := st.WearPercent, 90.0; got != want {
+		t.Errorf("unexpected wear: got %v, want %v", got, want)
+	}
+	if !st.WearHigh {
+		t.Errorf("wear not reported as high")
+	}
+
+	// With free space below the minimum, budgets are halved.
+	cfg.MinFreePercent = 101
+	st, err = m.Check(cfg, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.FreeLow {
+		t.Errorf("free space not reported as low")
+	}
+	if got, want := st.Budgets[0].Bytes, int64(1024); got != want {
+		t.Errorf("unexpected log bytes with low free space: got %d, want %d", got, want)
+	}
+}
+
+func TestParseLifeTime(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want float64
+	}{
+		{"0x01 0x01\n", 10},
+		{"0x03 0x05", 50},
+		{"0x0B 0x01", 110},
+		{"0x00 0x00", -1},
+		{"", -1},
+	} {
+		if got := parseLifeTime(tt.in); got != tt.want {
+			t.Errorf("parseLifeTime(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
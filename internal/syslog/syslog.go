@@ -0,0 +1,480 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package syslog collects syslog messages (RFC 3164 and RFC 5424 over UDP)
+// from LAN devices such as access points, NAS or cameras, and stores them in
+// one directory per source with per-source retention.
+package syslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+	"github.com/rtr7/router7/internal/storage"
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Retention limits the disk usage of the messages of a source.
+type Retention struct {
+	MaxBytes int64  `json:"max_bytes"` // 0 means no size limit
+	MaxAge   string `json:"max_age"`   // e.g. “720h”, empty means no age limit
+}
+
+// DefaultRetention applies to sources without configured retention.
+var DefaultRetention = Retention{MaxBytes: 4 << 20, MaxAge: "720h"}
+
+// Config is read from /perm/syslog.json.
+type Config struct {
+	// Retention applies to all sources not listed in Sources (default:
+	// DefaultRetention).
+	Retention *Retention `json:"retention"`
+
+	// Sources maps source names (the DHCP hostname of the sender, else its
+	// IP address) to their retention.
+	Sources map[string]Retention `json:"sources"`
+}
+
+// ReadConfig reads syslog.json from dir. A missing file results in the
+// default configuration.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "syslog.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return cfg, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.Retention == nil {
+		r := DefaultRetention
+		cfg.Retention = &r
+	}
+	if _, err := time.ParseDuration(cfg.Retention.MaxAge); cfg.Retention.MaxAge != "" && err != nil {
+		return cfg, fmt.Errorf("retention: max_age: %v", err)
+	}
+	for name, r := range cfg.Sources {
+		if _, err := time.ParseDuration(r.MaxAge); r.MaxAge != "" && err != nil {
+			return cfg, fmt.Errorf("source %s: max_age: %v", name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// RetentionOf returns the retention of source.
+func (c Config) RetentionOf(source string) Retention {
+	if r, ok := c.Sources[source]; ok {
+		return r
+	}
+	if c.Retention != nil {
+		return *c.Retention
+	}
+	return DefaultRetention
+}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Message is a received syslog message.
+type Message struct {
+	// Time is the time of reception: many devices have no (or no correct)
+	// clock, so the timestamp of the message is ignored.
+	Time     time.Time
+	Facility int
+	Severity int
+	Hostname string // as sent, possibly empty
+	Tag      string // RFC 3164 tag or RFC 5424 APP-NAME, possibly empty
+	Text     string
+}
+
+// String formats m as a line of the log files.
+func (m Message) String() string {
+	var b strings.Builder
+	b.WriteString(m.Time.UTC().Format(time.RFC3339))
+	b.WriteByte(' ')
+	b.WriteString(severities[m.Severity&7])
+	if m.Hostname != "" {
+		b.WriteByte(' ')
+		b.WriteString(m.Hostname)
+	}
+	if m.Tag != "" {
+		b.WriteByte(' ')
+		b.WriteString(m.Tag)
+		b.WriteByte(':')
+	}
+	b.WriteByte(' ')
+	b.WriteString(m.Text)
+	return b.String()
+}
+
+// Parse parses the syslog message b, received at now. Messages without PRI
+// part are accepted with priority user.notice, as recommended by RFC 3164.
+func Parse(b []byte, now time.Time) (Message, error) {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+	if s == "" {
+		return Message{}, fmt.Errorf("empty message")
+	}
+	m := Message{Time: now, Facility: 1, Severity: 5}
+	if strings.HasPrefix(s, "<") {
+		end := strings.IndexByte(s, '>')
+		if end < 2 || end > 4 {
+			return m, fmt.Errorf("malformed PRI part")
+		}
+		pri, err := strconv.Atoi(s[1:end])
+		if err != nil || pri > 191 {
+			return m, fmt.Errorf("malformed PRI part")
+		}
+		m.Facility, m.Severity = pri/8, pri%8
+		s = s[end+1:]
+	}
+	if strings.HasPrefix(s, "1 ") {
+		parse5424(&m, s[len("1 "):])
+	} else {
+		parse3164(&m, s)
+	}
+	return m, nil
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// parse5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA
+// [MSG].
+func parse5424(m *Message, s string) {
+	fields := strings.SplitN(s, " ", 6)
+	if len(fields) < 6 {
+		m.Text = s
+		return
+	}
+	m.Hostname = nilValue(fields[1])
+	m.Tag = nilValue(fields[2])
+	s = fields[5]
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	} else {
+		// Skip the SD-ELEMENTs, whose PARAM-VALUEs may contain escaped
+		// brackets and spaces.
+		inValue, escaped := false, false
+	sd:
+		for i, r := range s {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inValue = !inValue
+			case r == ']' && !inValue && !strings.HasPrefix(s[i+1:], "["):
+				s = s[i+1:]
+				break sd
+			}
+		}
+	}
+	m.Text = strings.TrimPrefix(strings.TrimPrefix(s, " "), "\ufeff") // BOM
+}
+
+// parse3164 parses [TIMESTAMP HOSTNAME] [TAG[PID]:] MSG.
+func parse3164(m *Message, s string) {
+	if len(s) > len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, s[:len(time.Stamp)]); err == nil {
+			s = strings.TrimPrefix(s[len(time.Stamp):], " ")
+			if idx := strings.IndexByte(s, ' '); idx > -1 && !strings.HasSuffix(s[:idx], ":") {
+				m.Hostname = s[:idx]
+				s = s[idx+1:]
+			}
+		}
+	}
+	for i, r := range s {
+		if r == ':' || r == '[' {
+			if i > 0 {
+				rest := s[i:]
+				if r == '[' {
+					end := strings.Index(rest, "]:")
+					if end == -1 {
+						break
+					}
+					rest = rest[end+1:]
+				}
+				m.Tag = s[:i]
+				s = strings.TrimPrefix(rest[1:], " ")
+			}
+			break
+		}
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./", r)) {
+			break
+		}
+	}
+	m.Text = s
+}
+
+// sourceName turns s into a safe directory name.
+func sourceName(s string) string {
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+type logFile struct {
+	date string
+	f    *os.File
+}
+
+// Collector writes messages to Dir/<source>/<date>.log.
+type Collector struct {
+	Dir string // e.g. /perm/log/syslog
+
+	mu    sync.Mutex
+	names map[string]string // IP address → source name
+	files map[string]*logFile
+}
+
+// NewCollector returns a Collector storing messages in dir.
+func NewCollector(dir string) *Collector {
+	return &Collector{
+		Dir:   dir,
+		names: make(map[string]string),
+		files: make(map[string]*logFile),
+	}
+}
+
+// SetNames names sources after the hostnames of their (unexpired) DHCP
+// leases, so that their messages are kept together when their IP address
+// changes.
+func (c *Collector) SetNames(leases []*dhcp4d.Lease, now time.Time) {
+	names := make(map[string]string)
+	for _, l := range leases {
+		if l.Expired(now) || l.Addr == nil {
+			continue
+		}
+		name := l.HostnameOverride
+		if name == "" {
+			name = l.Hostname
+		}
+		if name != "" {
+			names[l.Addr.String()] = sourceName(name)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = names
+}
+
+// Source returns the source name of messages sent from ip.
+func (c *Collector) Source(ip net.IP) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.source(ip)
+}
+
+func (c *Collector) source(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if name, ok := c.names[ip.String()]; ok {
+		return name
+	}
+	return sourceName(ip.String())
+}
+
+// Log appends m, sent from ip, to the log file of its source.
+func (c *Collector) Log(ip net.IP, m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	source := c.source(ip)
+	date := m.Time.UTC().Format("2006-01-02")
+	lf, ok := c.files[source]
+	if ok && lf.date != date {
+		lf.f.Close()
+		delete(c.files, source)
+		ok = false
+	}
+	if !ok {
+		dir := filepath.Join(c.Dir, source)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, date+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		lf = &logFile{date: date, f: f}
+		c.files[source] = lf
+	}
+	_, err := lf.f.WriteString(strings.Replace(m.String(), "\n", " ", -1) + "\n")
+	return err
+}
+
+// Close closes all log files.
+func (c *Collector) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeFiles()
+	return nil
+}
+
+func (c *Collector) closeFiles() {
+	for source, lf := range c.files {
+		lf.f.Close()
+		delete(c.files, source)
+	}
+}
+
+// Source is the disk usage of a source.
+type Source struct {
+	Name  string   `json:"name"`
+	Bytes int64    `json:"bytes"`
+	Dates []string `json:"dates"` // of the log files, oldest first
+}
+
+// Sources returns the sources from which messages are stored.
+func (c *Collector) Sources() ([]Source, error) {
+	fis, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sources []Source
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(c.Dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s := Source{Name: fi.Name()}
+		for _, f := range files {
+			if date := strings.TrimSuffix(f.Name(), ".log"); date != f.Name() {
+				s.Bytes += f.Size()
+				s.Dates = append(s.Dates, date)
+			}
+		}
+		sort.Strings(s.Dates)
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// Path returns the log file of source for date (e.g. 2020-05-01).
+func (c *Collector) Path(source, date string) (string, error) {
+	if sourceName(source) != source {
+		return "", fmt.Errorf("invalid source %q", source)
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return "", fmt.Errorf("invalid date %q", date)
+	}
+	return filepath.Join(c.Dir, source, date+".log"), nil
+}
+
+// Enforce deletes the oldest log files of each source which exceed its
+// retention.
+func (c *Collector) Enforce(cfg Config, now time.Time) ([]storage.BudgetStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Files are re-opened by the next Log call, in case they are deleted.
+	c.closeFiles()
+	fis, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var statuses []storage.BudgetStatus
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		r := cfg.RetentionOf(fi.Name())
+		bs, err := storage.Rotate(filepath.Join(c.Dir, fi.Name()), storage.Budget{
+			Path:     fi.Name(),
+			MaxBytes: r.MaxBytes,
+			MaxAge:   r.MaxAge,
+		}, now)
+		if err != nil {
+			return statuses, fmt.Errorf("%s: %v", fi.Name(), err)
+		}
+		statuses = append(statuses, bs)
+	}
+	return statuses, nil
+}
+
+// Server receives syslog messages on a UDP address.
+type Server struct {
+	Addr      string // e.g. 192.168.42.1:514
+	Collector *Collector
+
+	mu   sync.Mutex
+	conn net.PacketConn
+}
+
+// ListenAndServe receives messages until Close is called.
+func (s *Server) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	defer conn.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		m, err := Parse(buf[:n], time.Now())
+		if err != nil {
+			continue
+		}
+		if err := s.Collector.Log(addr.(*net.UDPAddr).IP, m); err != nil {
+			log.Printf("syslog: %v", err)
+		}
+	}
+}
+
+// Close stops ListenAndServe.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
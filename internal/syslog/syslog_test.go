@@ -0,0 +1,217 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syslog
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name string
+		msg  string
+		want Message
+	}{
+		{
+			name: "RFC3164",
+			msg:  "<30>May  1 11:59:58 ap-attic hostapd[1234]: wlan0: STA 02:00:00:00:01:01 IEEE 802.11: associated\n",
+			want: Message{
+				Facility: 3,
+				Severity: 6,
+				Hostname: "ap-attic",
+				Tag:      "hostapd",
+				Text:     "wlan0: STA 02:00:00:00:01:01 IEEE 802.11: associated",
+			},
+		},
+		{
+			name: "RFC3164WithoutTimestamp",
+			msg:  "<12>camera: motion detected",
+			want: Message{
+				Facility: 1,
+				Severity: 4,
+				Tag:      "camera",
+				Text:     "motion detected",
+			},
+		},
+		{
+			name: "RFC3164WithoutTag",
+			msg:  "<13>disk 2 temperature 52 C",
+			want: Message{
+				Facility: 1,
+				Severity: 5,
+				Text:     "disk 2 temperature 52 C",
+			},
+		},
+		{
+			name: "WithoutPRI",
+			msg:  "hello",
+			want: Message{Facility: 1, Severity: 5, Text: "hello"},
+		},
+		{
+			name: "RFC5424",
+			msg:  `<165>1 2020-05-01T11:59:58.003Z nas.lan smartd 42 ID47 [exampleSDID@32473 iut="3" eventSource="App\]lication"][x@1 a="b"] ` + "\ufeff" + "disk 2: reallocated sector count increased",
+			want: Message{
+				Facility: 20,
+				Severity: 5,
+				Hostname: "nas.lan",
+				Tag:      "smartd",
+				Text:     "disk 2: reallocated sector count increased",
+			},
+		},
+		{
+			name: "RFC5424NilValues",
+			msg:  "<14>1 - - - - - - started",
+			want: Message{Facility: 1, Severity: 6, Text: "started"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.msg), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Time = now
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("Parse: unexpected message: diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, msg := range []string{"", "\n", "<999>too large", "<x>"} {
+		if _, err := Parse([]byte(msg), now); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", msg)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCollector(tmp)
+	defer c.Close()
+	c.SetNames([]*dhcp4d.Lease{
+		{Addr: net.ParseIP("192.168.42.3"), Hostname: "ap-attic", Expiry: now.Add(time.Hour)},
+		{Addr: net.ParseIP("192.168.42.4"), Hostname: "../escape", Expiry: now.Add(time.Hour)},
+		{Addr: net.ParseIP("192.168.42.5"), Hostname: "gone", Expiry: now.Add(-time.Hour)},
+	}, now)
+	for _, tt := range []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.42.3", "ap-attic"},
+		{"::ffff:192.168.42.3", "ap-attic"},
+		{"192.168.42.4", ".._escape"},
+		{"192.168.42.5", "192.168.42.5"},
+		{"fe80::1", "fe80::1"},
+	} {
+		if got := c.Source(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Source(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+
+	ap := net.ParseIP("192.168.42.3")
+	log := func(text string, at time.Time) {
+		t.Helper()
+		if err := c.Log(ap, Message{Time: at, Severity: 6, Tag: "hostapd", Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log("yesterday", now.Add(-24*time.Hour))
+	log("first\nline", now)
+	log("second", now)
+	b, err := ioutil.ReadFile(filepath.Join(tmp, "ap-attic", "2020-05-01.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2020-05-01T12:00:00Z info hostapd: first line\n" +
+		"2020-05-01T12:00:00Z info hostapd: second\n"
+	if diff := cmp.Diff(want, string(b)); diff != "" {
+		t.Fatalf("log file: diff (-want +got):\n%s", diff)
+	}
+	sources, err := c.Sources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Source{{Name: "ap-attic", Bytes: int64(len(want) + len("2020-04-30T12:00:00Z info hostapd: yesterday\n")), Dates: []string{"2020-04-30", "2020-05-01"}}}, sources); diff != "" {
+		t.Fatalf("Sources: diff (-want +got):\n%s", diff)
+	}
+
+	if _, err := c.Path("..", "2020-05-01"); err == nil {
+		t.Errorf("Path(..) unexpectedly succeeded")
+	}
+	if _, err := c.Path("ap-attic", "../../x"); err == nil {
+		t.Errorf("Path(date ../../x) unexpectedly succeeded")
+	}
+
+	// Age the file of yesterday, then enforce a retention of one day for
+	// ap-attic only.
+	yesterday := filepath.Join(tmp, "ap-attic", "2020-04-30.log")
+	if err := os.Chtimes(yesterday, now.Add(-24*time.Hour), now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{Sources: map[string]Retention{"ap-attic": {MaxAge: "1h"}}}
+	if _, err := c.Enforce(cfg, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(yesterday); !os.IsNotExist(err) {
+		t.Errorf("%s not deleted by retention", yesterday)
+	}
+	log("after enforce", now)
+	b, err = ioutil.ReadFile(filepath.Join(tmp, "ap-attic", "2020-05-01.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(b), "after enforce\n") {
+		t.Errorf("log file does not end in the last message: %q", string(b))
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg, err := ReadConfig(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.RetentionOf("nas"), DefaultRetention; got != want {
+		t.Errorf("RetentionOf(nas) = %v, want %v", got, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "syslog.json"), []byte(`{"sources":{"nas":{"max_bytes":1048576,"max_age":"forever"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfig(tmp); err == nil {
+		t.Errorf("ReadConfig(max_age: forever) unexpectedly succeeded")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package topology computes which LAN device is connected behind which
+// router port, switch or access point, based on LLDP announcements, the
+// bridge forwarding database, the ARP/NDP neighbor table, DHCP leases and
+// the clients reported by managed access points.
+package topology
+
+import (
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/rtr7/router7/internal/accesspoint"
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+// Node kinds
+const (
+	KindRouter      = "router"
+	KindPort        = "port" // bridge member of the router
+	KindSwitch      = "switch"
+	KindAccessPoint = "ap"
+	KindDevice      = "device"
+)
+
+// Node is a vertex of the topology graph.
+type Node struct {
+	ID    string   `json:"id"`   // hardware address, port name or “router”
+	Kind  string   `json:"kind"` // see Kind*
+	Name  string   `json:"name,omitempty"`
+	Addrs []string `json:"addrs,omitempty"`
+}
+
+// Edge connects Node From (closer to the router) with Node To.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Graph is a tree rooted at the router.
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Input is the data from which the topology is computed.
+type Input struct {
+	Router string // hostname
+
+	// FDB maps hardware addresses to the bridge member on which they were
+	// learned. Empty if the LAN interface is not a bridge.
+	FDB map[string]string
+
+	// Addrs maps hardware addresses to IP addresses (ARP/NDP).
+	Addrs map[string][]string
+
+	LLDP         []accesspoint.Neighbor
+	Leases       []*dhcp4d.Lease
+	AccessPoints []accesspoint.AccessPoint
+}
+
+const routerID = "router"
+
+// Compute returns the topology of in.
+func Compute(in Input, now time.Time) Graph {
+	nodes := map[string]*Node{
+		routerID: {ID: routerID, Kind: KindRouter, Name: in.Router},
+	}
+	node := func(hwaddr, kind string) *Node {
+		n, ok := nodes[hwaddr]
+		if !ok {
+			n = &Node{ID: hwaddr, Kind: kind}
+			nodes[hwaddr] = n
+		}
+		return n
+	}
+
+	// Infrastructure: switches and access points.
+	for _, n := range in.LLDP {
+		kind := KindDevice
+		switch {
+		case n.AccessPoint():
+			kind = KindAccessPoint
+		case n.Switch():
+			kind = KindSwitch
+		}
+		node(n.HardwareAddr, kind).Name = n.SystemName
+	}
+	clientOf := make(map[string]string) // client → access point
+	for _, ap := range in.AccessPoints {
+		n := node(ap.HardwareAddr, KindAccessPoint)
+		n.Kind = KindAccessPoint
+		if n.Name == "" {
+			n.Name = ap.Hostname
+		}
+		for _, c := range ap.Clients {
+			clientOf[c.HardwareAddr] = ap.HardwareAddr
+		}
+	}
+
+	// End devices.
+	for _, l := range in.Leases {
+		if l.Expired(now) {
+			continue
+		}
+		n := node(l.HardwareAddr, KindDevice)
+		if l.HostnameOverride != "" {
+			n.Name = l.HostnameOverride
+		} else if n.Name == "" {
+			n.Name = l.Hostname
+		}
+	}
+	for hwaddr := range in.Addrs {
+		node(hwaddr, KindDevice)
+	}
+	for hwaddr := range in.FDB {
+		node(hwaddr, KindDevice)
+	}
+	for client := range clientOf {
+		node(client, KindDevice)
+	}
+	for hwaddr, addrs := range in.Addrs {
+		nodes[hwaddr].Addrs = append(nodes[hwaddr].Addrs, addrs...)
+	}
+	for _, n := range nodes {
+		sort.Strings(n.Addrs)
+	}
+
+	// Infrastructure nodes per router port ("" if unknown or not bridged).
+	switches := make(map[string][]string)
+	for id, n := range nodes {
+		if n.Kind == KindSwitch {
+			port := in.FDB[id]
+			switches[port] = append(switches[port], id)
+		}
+	}
+	portNode := func(port string) string {
+		if port == "" {
+			return routerID
+		}
+		if _, ok := nodes[port]; !ok {
+			nodes[port] = &Node{ID: port, Kind: KindPort, Name: port}
+		}
+		return port
+	}
+	// parent returns the closest known upstream node of id: the access point
+	// reporting it as client, else the only switch on its port (devices
+	// behind multiple switches on the same port cannot be told apart), else
+	// its port.
+	parent := func(id string) string {
+		n := nodes[id]
+		if ap, ok := clientOf[id]; ok && n.Kind == KindDevice {
+			return ap
+		}
+		port := in.FDB[id]
+		if n.Kind != KindSwitch {
+			if sw := switches[port]; len(sw) == 1 {
+				return sw[0]
+			}
+		}
+		return portNode(port)
+	}
+
+	var g Graph
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		if id != routerID && nodes[id].Kind != KindPort {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		g.Edges = append(g.Edges, Edge{From: parent(id), To: id})
+	}
+	for id := range nodes {
+		if nodes[id].Kind == KindPort {
+			g.Edges = append(g.Edges, Edge{From: routerID, To: id})
+		}
+	}
+	for _, n := range nodes {
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// Tree is a Node with its children, for rendering.
+type Tree struct {
+	Node
+	Children []*Tree
+}
+
+// Tree returns the tree of g, rooted at the router.
+func (g Graph) Tree() *Tree {
+	trees := make(map[string]*Tree)
+	for _, n := range g.Nodes {
+		trees[n.ID] = &Tree{Node: n}
+	}
+	for _, e := range g.Edges {
+		from, to := trees[e.From], trees[e.To]
+		if from == nil || to == nil {
+			continue
+		}
+		from.Children = append(from.Children, to)
+	}
+	return trees[routerID]
+}
+
+// Gather returns the forwarding database of the bridge ifname (if it is a
+// bridge) and the neighbor table of ifname.
+func Gather(ifname string) (fdb map[string]string, addrs map[string][]string, _ error) {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return nil, nil, err
+	}
+	fdb = make(map[string]string)
+	if _, ok := link.(*netlink.Bridge); ok {
+		members := make(map[int]string)
+		links, err := netlink.LinkList()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, l := range links {
+			if l.Attrs().MasterIndex == link.Attrs().Index {
+				members[l.Attrs().Index] = l.Attrs().Name
+			}
+		}
+		entries, err := netlink.NeighList(0, unix.AF_BRIDGE)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			member, ok := members[e.LinkIndex]
+			if !ok || e.MasterIndex != link.Attrs().Index || e.State&unix.NUD_PERMANENT != 0 {
+				continue // not learned on a member
+			}
+			fdb[e.HardwareAddr.String()] = member
+		}
+	}
+
+	addrs = make(map[string][]string)
+	neighbors, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, n := range neighbors {
+		if n.HardwareAddr == nil || n.State&(unix.NUD_FAILED|unix.NUD_INCOMPLETE|unix.NUD_NOARP) != 0 {
+			continue
+		}
+		if n.IP.IsLinkLocalUnicast() && n.IP.To4() == nil {
+			continue // every IPv6 host has one
+		}
+		hwaddr := n.HardwareAddr.String()
+		addrs[hwaddr] = append(addrs[hwaddr], n.IP.String())
+	}
+	return fdb, addrs, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topology
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/rtr7/router7/internal/accesspoint"
+	"github.com/rtr7/router7/internal/dhcp4d"
+)
+
+func TestCompute(t *testing.T) {
+	const (
+		sw      = "02:00:00:00:00:01" // switch behind lan1
+		ap      = "02:00:00:00:00:02" // access point behind the switch
+		desktop = "02:00:00:00:00:03" // wired, behind the switch
+		phone   = "02:00:00:00:00:04" // Wi-Fi client of the access point
+		printer = "02:00:00:00:00:05" // directly on lan2
+	)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	in := Input{
+		Router: "router7",
+		FDB: map[string]string{
+			sw:      "lan1",
+			ap:      "lan1",
+			desktop: "lan1",
+			phone:   "lan1",
+			printer: "lan2",
+		},
+		Addrs: map[string][]string{
+			printer: {"192.168.42.5"},
+			desktop: {"2001:db8::3", "192.168.42.3"},
+		},
+		LLDP: []accesspoint.Neighbor{
+			{HardwareAddr: sw, SystemName: "switch-office", Capabilities: 1 << 2},
+		},
+		Leases: []*dhcp4d.Lease{
+			{HardwareAddr: desktop, Hostname: "desktop", Expiry: now.Add(time.Hour)},
+			{HardwareAddr: phone, Hostname: "phone", Expiry: now.Add(time.Hour)},
+			{HardwareAddr: "02:00:00:00:00:99", Hostname: "gone", Expiry: now.Add(-time.Hour)},
+		},
+		AccessPoints: []accesspoint.AccessPoint{
+			{
+				HardwareAddr: ap,
+				Hostname:     "ap-attic",
+				Clients:      []accesspoint.Client{{HardwareAddr: phone}},
+			},
+		},
+	}
+	got := Compute(in, now)
+	want := Graph{
+		Nodes: []Node{
+			{ID: sw, Kind: KindSwitch, Name: "switch-office"},
+			{ID: ap, Kind: KindAccessPoint, Name: "ap-attic"},
+			{ID: desktop, Kind: KindDevice, Name: "desktop", Addrs: []string{"192.168.42.3", "2001:db8::3"}},
+			{ID: phone, Kind: KindDevice, Name: "phone"},
+			{ID: printer, Kind: KindDevice, Addrs: []string{"192.168.42.5"}},
+			{ID: "lan1", Kind: KindPort, Name: "lan1"},
+			{ID: "lan2", Kind: KindPort, Name: "lan2"},
+			{ID: "router", Kind: KindRouter, Name: "router7"},
+		},
+		Edges: []Edge{
+			{From: sw, To: ap},
+			{From: sw, To: desktop},
+			{From: ap, To: phone},
+			{From: "lan1", To: sw},
+			{From: "lan2", To: printer},
+			{From: "router", To: "lan1"},
+			{From: "router", To: "lan2"},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Compute: unexpected graph: diff (-want +got):\n%s", diff)
+	}
+
+	tree := got.Tree()
+	if got, want := len(tree.Children), 2; got != want {
+		t.Fatalf("router has %d children, want %d", got, want)
+	}
+	lan1 := tree.Children[0]
+	if got, want := lan1.Children[0].Children[0].ID, ap; got != want {
+		t.Errorf("first node behind the switch = %s, want %s", got, want)
+	}
+}
+
+func TestComputeUnbridged(t *testing.T) {
+	// Without bridge, all devices are attached to the router, unless there
+	// is exactly one switch.
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	in := Input{
+		Router: "router7",
+		Leases: []*dhcp4d.Lease{
+			{Addr: net.ParseIP("192.168.42.3"), HardwareAddr: "02:00:00:00:00:03", Hostname: "desktop"},
+		},
+	}
+	got := Compute(in, now)
+	want := []Edge{{From: "router", To: "02:00:00:00:00:03"}}
+	if diff := cmp.Diff(want, got.Edges); diff != "" {
+		t.Fatalf("Compute: unexpected edges: diff (-want +got):\n%s", diff)
+	}
+
+	in.LLDP = []accesspoint.Neighbor{{HardwareAddr: "02:00:00:00:00:01", Capabilities: 1 << 2}}
+	got = Compute(in, now)
+	want = []Edge{
+		{From: "02:00:00:00:00:01", To: "02:00:00:00:00:03"},
+		{From: "router", To: "02:00:00:00:00:01"},
+	}
+	if diff := cmp.Diff(want, got.Edges); diff != "" {
+		t.Fatalf("Compute: unexpected edges: diff (-want +got):\n%s", diff)
+	}
+}
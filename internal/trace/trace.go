@@ -0,0 +1,349 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trace records spans of netconfig.Apply steps, DHCP exchanges and
+// DNS queries and exports them to the OpenTelemetry collector configured in
+// /perm/tracing.json, using OTLP/HTTP with JSON encoding.
+//
+// Without configuration, Start returns nil, and all methods of a nil *Span do
+// nothing, so that instrumented code does not need to check whether tracing
+// is enabled.
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rtr7/router7/internal/teelogger"
+)
+
+var log = teelogger.NewConsole()
+
+// Config is read from /perm/tracing.json.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of the collector, e.g.
+	// http://192.168.42.5:4318/v1/traces
+	Endpoint string `json:"endpoint"`
+
+	// SampleRatio is the fraction of high-volume operations (DNS queries,
+	// see StartSampled) which are traced. Default: 0.01
+	SampleRatio *float64 `json:"sample_ratio"`
+}
+
+// Span is an operation, e.g. a step of netconfig.Apply.
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte // zero for root spans
+	name    string
+	start   time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs map[string]interface{}
+	err   error
+}
+
+// exporter batches ended spans and sends them to the collector.
+type exporter struct {
+	endpoint    string
+	service     string
+	sampleRatio float64
+	client      *http.Client
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// maxBuffered bounds the memory use while the collector is unreachable.
+const maxBuffered = 2048
+
+var (
+	globalMu sync.Mutex
+	global   *exporter // nil: tracing disabled
+)
+
+// Init enables tracing for service (e.g. netconfigd) if dir/tracing.json
+// exists.
+func Init(dir, service string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "tracing.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("tracing.json: %v", err)
+	}
+	if cfg.Endpoint == "" {
+		return fmt.Errorf("tracing.json: endpoint must be set")
+	}
+	e := &exporter{
+		endpoint:    cfg.Endpoint,
+		service:     service,
+		sampleRatio: 0.01,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	if cfg.SampleRatio != nil {
+		e.sampleRatio = *cfg.SampleRatio
+	}
+	globalMu.Lock()
+	global = e
+	globalMu.Unlock()
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			if err := e.flush(); err != nil {
+				log.Printf("tracing: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func current() *exporter {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	return global
+}
+
+// Start starts a span called name, which is a child of parent (or a root
+// span if parent is nil). It returns nil if tracing is disabled.
+func Start(parent *Span, name string) *Span {
+	return StartAt(parent, name, time.Now())
+}
+
+// StartAt is like Start, but for an operation which started at start.
+func StartAt(parent *Span, name string, start time.Time) *Span {
+	if current() == nil {
+		return nil
+	}
+	s := &Span{
+		name:  name,
+		start: start,
+	}
+	rand.Read(s.spanID[:])
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parent = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return s
+}
+
+// StartSampled is like Start, but root spans are only started for the
+// configured fraction of calls, e.g. for DNS queries.
+func StartSampled(parent *Span, name string) *Span {
+	e := current()
+	if e == nil {
+		return nil
+	}
+	if parent == nil && mathrand.Float64() >= e.sampleRatio {
+		return nil
+	}
+	return Start(parent, name)
+}
+
+// SetAttribute annotates s, e.g. with the interface name. value must be a
+// string, bool, int or float64.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks s as failed with err (unless nil).
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End ends s and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	e := current()
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) >= maxBuffered {
+		return // collector unreachable, drop
+	}
+	e.spans = append(e.spans, s)
+}
+
+// Flush sends the ended spans to the collector, e.g. before the program
+// exits.
+func Flush() error {
+	e := current()
+	if e == nil {
+		return nil
+	}
+	return e.flush()
+}
+
+// The following types are the OTLP/HTTP JSON encoding of spans, see
+// https://github.com/open-telemetry/opentelemetry-proto
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is a string in JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2: error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"` // 1: internal
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		i := strconv.Itoa(v)
+		a.Value.IntValue = &i
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              1,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for key, value := range s.attrs {
+		o.Attributes = append(o.Attributes, attribute(key, value))
+	}
+	if s.err != nil {
+		o.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return o
+}
+
+func (e *exporter) request(spans []*Span) otlpRequest {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttribute{attribute("service.name", e.service)}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "router7"
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, s.otlp())
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func (e *exporter) flush() error {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("exporting %d spans: %v", len(spans), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("exporting %d spans: unexpected HTTP status: %v (%s)", len(spans), resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDisabled(t *testing.T) {
+	if current() != nil {
+		t.Skip("tracing already enabled")
+	}
+	s := Start(nil, "disabled")
+	if s != nil {
+		t.Fatalf("Start = %v, want nil", s)
+	}
+	// Methods of nil spans must not panic.
+	s.SetAttribute("key", "value")
+	s.SetError(errors.New("failed"))
+	s.End()
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- req
+	}))
+	defer ts.Close()
+
+	tmp, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cfg := `{"endpoint": "` + ts.URL + `/v1/traces", "sample_ratio": 0}`
+	if err := ioutil.WriteFile(filepath.Join(tmp, "tracing.json"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(tmp, "netconfigd"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		globalMu.Lock()
+		global = nil
+		globalMu.Unlock()
+	}()
+
+	if s := StartSampled(nil, "dns.query"); s != nil {
+		t.Errorf("StartSampled with sample_ratio 0 = %v, want nil", s)
+	}
+	root := Start(nil, "netconfig.Apply")
+	child := Start(root, "firewall")
+	child.SetAttribute("rules", 42)
+	child.SetError(errors.New("EPERM"))
+	child.End()
+	root.End()
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-received
+	if got, want := len(req.ResourceSpans), 1; got != want {
+		t.Fatalf("got %d resource spans, want %d", got, want)
+	}
+	rs := req.ResourceSpans[0]
+	if diff := cmp.Diff([]otlpAttribute{attribute("service.name", "netconfigd")}, rs.Resource.Attributes); diff != "" {
+		t.Errorf("resource attributes: diff (-want +got):\n%s", diff)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if got, want := len(spans), 2; got != want {
+		t.Fatalf("got %d spans, want %d", got, want)
+	}
+	gotChild, gotRoot := spans[0], spans[1]
+	if gotChild.TraceID != gotRoot.TraceID {
+		t.Errorf("child trace ID %s differs from root trace ID %s", gotChild.TraceID, gotRoot.TraceID)
+	}
+	if gotChild.ParentSpanID != gotRoot.SpanID {
+		t.Errorf("child parent span ID = %s, want %s", gotChild.ParentSpanID, gotRoot.SpanID)
+	}
+	if gotRoot.ParentSpanID != "" {
+		t.Errorf("root parent span ID = %s, want none", gotRoot.ParentSpanID)
+	}
+	want := otlpSpan{
+		Name:       "firewall",
+		Kind:       1,
+		Attributes: []otlpAttribute{attribute("rules", 42)},
+		Status:     &otlpStatus{Code: 2, Message: "EPERM"},
+	}
+	gotChild.TraceID, gotChild.SpanID, gotChild.ParentSpanID = "", "", ""
+	gotChild.StartTimeUnixNano, gotChild.EndTimeUnixNano = "", ""
+	if diff := cmp.Diff(want, gotChild); diff != "" {
+		t.Errorf("child span: diff (-want +got):\n%s", diff)
+	}
+}
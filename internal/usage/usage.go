@@ -0,0 +1,353 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package usage aggregates the byte counters of connection tracking entries
+// into per-device daily summaries, which are persisted in /perm/usage.
+//
+// Traffic of connections which start and end between two collections is not
+// accounted, so the summaries are a lower bound. Destinations are reported by
+// address, as dnsd does not log queries.
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/renameio"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// topDestinations is the number of destinations per device which are
+	// persisted.
+	topDestinations = 10
+
+	// maxDestinations bounds the number of destinations per device which
+	// are tracked in memory.
+	maxDestinations = 1000
+
+	// retention is the number of days for which summaries are kept.
+	retention = 90
+
+	dateFormat = "2006-01-02"
+)
+
+// Destination is a remote address and the bytes exchanged with it.
+type Destination struct {
+	Addr  string `json:"addr"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// Device is the usage of one device (identified by MAC address).
+type Device struct {
+	HardwareAddr string        `json:"hardware_addr"`
+	Hostname     string        `json:"hostname,omitempty"`
+	RxBytes      uint64        `json:"rx_bytes"` // received by the device
+	TxBytes      uint64        `json:"tx_bytes"` // sent by the device
+	Top          []Destination `json:"top_destinations"`
+}
+
+// Summary is the usage of all devices during a period.
+type Summary struct {
+	Start   string    `json:"start"` // e.g. 2020-06-01
+	Days    int       `json:"days"`  // 1 for daily, 7 for weekly summaries
+	Devices []*Device `json:"devices"`
+}
+
+func dir(permDir string) string {
+	return filepath.Join(permDir, "usage")
+}
+
+func dayPath(permDir string, day time.Time) string {
+	return filepath.Join(dir(permDir), day.Format(dateFormat)+".json")
+}
+
+// ReadDay returns the summary of day (ignoring its time of day). A day
+// without data results in an empty summary.
+func ReadDay(permDir string, day time.Time) (*Summary, error) {
+	s := &Summary{Start: day.Format(dateFormat), Days: 1}
+	b, err := ioutil.ReadFile(dayPath(permDir, day))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadWeek returns the summary of the 7 days starting with start.
+func ReadWeek(permDir string, start time.Time) (*Summary, error) {
+	devices := make(map[string]*device)
+	for i := 0; i < 7; i++ {
+		day, err := ReadDay(permDir, start.AddDate(0, 0, i))
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range day.Devices {
+			dev, ok := devices[d.HardwareAddr]
+			if !ok {
+				dev = newDevice(d.HardwareAddr)
+				devices[d.HardwareAddr] = dev
+			}
+			dev.merge(d)
+		}
+	}
+	return &Summary{
+		Start:   start.Format(dateFormat),
+		Days:    7,
+		Devices: summarize(devices),
+	}, nil
+}
+
+// WeekStart returns the start (Monday) of the week containing t.
+func WeekStart(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+}
+
+type device struct {
+	Device
+	dests map[string]uint64
+}
+
+func newDevice(hwaddr string) *device {
+	return &device{
+		Device: Device{HardwareAddr: hwaddr},
+		dests:  make(map[string]uint64),
+	}
+}
+
+func (d *device) merge(o *Device) {
+	if o.Hostname != "" {
+		d.Hostname = o.Hostname
+	}
+	d.RxBytes += o.RxBytes
+	d.TxBytes += o.TxBytes
+	for _, dst := range o.Top {
+		d.dests[dst.Addr] += dst.Bytes
+	}
+}
+
+func topN(dests map[string]uint64, n int) []Destination {
+	top := make([]Destination, 0, len(dests))
+	for addr, bytes := range dests {
+		top = append(top, Destination{Addr: addr, Bytes: bytes})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		return top[i].Addr < top[j].Addr
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (d *device) account(dst string, rx, tx uint64) {
+	d.RxBytes += rx
+	d.TxBytes += tx
+	d.dests[dst] += rx + tx
+	if len(d.dests) > maxDestinations {
+		// Forget the smaller half of the destinations.
+		keep := topN(d.dests, maxDestinations/2)
+		d.dests = make(map[string]uint64, len(keep))
+		for _, dst := range keep {
+			d.dests[dst.Addr] = dst.Bytes
+		}
+	}
+}
+
+// summarize returns the devices ordered by total bytes.
+func summarize(devices map[string]*device) []*Device {
+	result := make([]*Device, 0, len(devices))
+	for _, d := range devices {
+		dev := d.Device
+		dev.Top = topN(d.dests, topDestinations)
+		result = append(result, &dev)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti := result[i].RxBytes + result[i].TxBytes
+		tj := result[j].RxBytes + result[j].TxBytes
+		if ti != tj {
+			return ti > tj
+		}
+		return result[i].HardwareAddr < result[j].HardwareAddr
+	})
+	return result
+}
+
+// flowKey identifies a connection tracking entry.
+type flowKey struct {
+	proto            uint8
+	src, dst         string
+	srcPort, dstPort uint16
+}
+
+type counters struct {
+	fwd, rev uint64
+}
+
+// Collector accounts connection tracking byte counters to devices.
+type Collector struct {
+	permDir string
+
+	day     time.Time // start of the current day
+	devices map[string]*device
+	last    map[flowKey]counters
+}
+
+// NewCollector returns a Collector which persists to permDir, continuing the
+// summary of the current day, if any.
+func NewCollector(permDir string, now time.Time) (*Collector, error) {
+	c := &Collector{
+		permDir: permDir,
+		last:    make(map[flowKey]counters),
+	}
+	if err := c.startDay(now); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Collector) startDay(now time.Time) error {
+	c.day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	c.devices = make(map[string]*device)
+	s, err := ReadDay(c.permDir, c.day)
+	if err != nil {
+		return err
+	}
+	for _, d := range s.Devices {
+		dev := newDevice(d.HardwareAddr)
+		dev.merge(d)
+		c.devices[d.HardwareAddr] = dev
+	}
+	return nil
+}
+
+// DeviceFunc resolves a LAN address to a device’s MAC address and hostname.
+type DeviceFunc func(ip net.IP) (hwaddr, hostname string, ok bool)
+
+// Collect accounts the traffic of flows (since the previous call) to the
+// devices identified by lookup. Flows which do not originate from a device
+// (e.g. port forwardings) are accounted to their destination device.
+func (c *Collector) Collect(now time.Time, flows []*netlink.ConntrackFlow, lookup DeviceFunc) error {
+	if now.Format(dateFormat) != c.day.Format(dateFormat) {
+		if err := c.Persist(); err != nil {
+			return err
+		}
+		if err := c.startDay(now); err != nil {
+			return err
+		}
+		if err := c.prune(now); err != nil {
+			return err
+		}
+	}
+	seen := make(map[flowKey]counters, len(flows))
+	for _, f := range flows {
+		key := flowKey{
+			proto:   f.Forward.Protocol,
+			src:     f.Forward.SrcIP.String(),
+			dst:     f.Forward.DstIP.String(),
+			srcPort: f.Forward.SrcPort,
+			dstPort: f.Forward.DstPort,
+		}
+		cur := counters{fwd: f.Forward.Bytes, rev: f.Reverse.Bytes}
+		seen[key] = cur
+		prev := c.last[key]
+		if cur.fwd < prev.fwd || cur.rev < prev.rev {
+			prev = counters{} // flow was re-created
+		}
+		fwd, rev := cur.fwd-prev.fwd, cur.rev-prev.rev
+		if fwd == 0 && rev == 0 {
+			continue
+		}
+		if hwaddr, hostname, ok := lookup(f.Forward.SrcIP); ok {
+			c.device(hwaddr, hostname).account(key.dst, rev, fwd)
+		} else if hwaddr, hostname, ok := lookup(f.Forward.DstIP); ok {
+			c.device(hwaddr, hostname).account(key.src, fwd, rev)
+		}
+	}
+	c.last = seen
+	return nil
+}
+
+func (c *Collector) device(hwaddr, hostname string) *device {
+	d, ok := c.devices[hwaddr]
+	if !ok {
+		d = newDevice(hwaddr)
+		c.devices[hwaddr] = d
+	}
+	if hostname != "" {
+		d.Hostname = hostname
+	}
+	return d
+}
+
+// Summary returns the summary of the current day.
+func (c *Collector) Summary() *Summary {
+	return &Summary{
+		Start:   c.day.Format(dateFormat),
+		Days:    1,
+		Devices: summarize(c.devices),
+	}
+}
+
+// Persist writes the summary of the current day to permDir.
+func (c *Collector) Persist() error {
+	b, err := json.Marshal(c.Summary())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir(c.permDir), 0755); err != nil {
+		return err
+	}
+	return renameio.WriteFile(dayPath(c.permDir, c.day), b, 0644)
+}
+
+// prune deletes summaries older than retention days.
+func (c *Collector) prune(now time.Time) error {
+	fis, err := ioutil.ReadDir(dir(c.permDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cutoff := now.AddDate(0, 0, -retention).Format(dateFormat)
+	for _, fi := range fis {
+		date := strings.TrimSuffix(fi.Name(), ".json")
+		if _, err := time.Parse(dateFormat, date); err != nil {
+			continue // not a summary
+		}
+		if date < cutoff {
+			if err := os.Remove(filepath.Join(dir(c.permDir), fi.Name())); err != nil {
+				return fmt.Errorf("pruning: %v", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usage
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func flow(src, dst string, dport uint16, fwd, rev uint64) *netlink.ConntrackFlow {
+	f := &netlink.ConntrackFlow{}
+	f.Forward.Protocol = unix.IPPROTO_TCP
+	f.Forward.SrcIP = net.ParseIP(src)
+	f.Forward.DstIP = net.ParseIP(dst)
+	f.Forward.SrcPort = 40000
+	f.Forward.DstPort = dport
+	f.Forward.Bytes = fwd
+	f.Reverse.Bytes = rev
+	return f
+}
+
+func lookup(ip net.IP) (string, string, bool) {
+	switch ip.String() {
+	case "192.168.42.23":
+		return "00:1f:16:3a:62:8d", "laptop", true
+	case "192.168.42.42":
+		return "b8:27:eb:00:00:01", "", true
+	}
+	return "", "", false
+}
+
+func TestCollector(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	day := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC) // a Monday
+	c, err := NewCollector(tmp, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flows := range [][]*netlink.ConntrackFlow{
+		{
+			flow("192.168.42.23", "203.0.113.1", 443, 100, 1000),
+			flow("192.168.42.23", "203.0.113.2", 443, 10, 10),
+		},
+		{
+			flow("192.168.42.23", "203.0.113.1", 443, 150, 3000), // +50, +2000
+			// 203.0.113.2 closed
+			flow("198.51.100.7", "192.168.42.42", 22, 500, 70), // port forwarding
+		},
+	} {
+		if err := c.Collect(day, flows, lookup); err != nil {
+			t.Fatal(err)
+		}
+		day = day.Add(time.Minute)
+	}
+	if err := c.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The summary must survive a restart.
+	c, err = NewCollector(tmp, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Summary{
+		Start: "2020-06-01",
+		Days:  1,
+		Devices: []*Device{
+			{
+				HardwareAddr: "00:1f:16:3a:62:8d",
+				Hostname:     "laptop",
+				RxBytes:      3010,
+				TxBytes:      160,
+				Top: []Destination{
+					{Addr: "203.0.113.1", Bytes: 3150},
+					{Addr: "203.0.113.2", Bytes: 20},
+				},
+			},
+			{
+				HardwareAddr: "b8:27:eb:00:00:01",
+				RxBytes:      500,
+				TxBytes:      70,
+				Top: []Destination{
+					{Addr: "198.51.100.7", Bytes: 570},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, c.Summary()); diff != "" {
+		t.Errorf("unexpected summary: diff (-want +got):\n%s", diff)
+	}
+
+	// The next day starts a new summary.
+	tomorrow := day.AddDate(0, 0, 1)
+	if err := c.Collect(tomorrow, []*netlink.ConntrackFlow{
+		flow("192.168.42.23", "203.0.113.1", 443, 100, 100),
+	}, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	week, err := ReadWeek(tmp, WeekStart(tomorrow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := week.Start, "2020-06-01"; got != want {
+		t.Errorf("unexpected week start: got %s, want %s", got, want)
+	}
+	if got, want := week.Devices[0].RxBytes, uint64(3110); got != want {
+		t.Errorf("unexpected weekly rx bytes: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wwan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// QMI services and messages, see libqmi’s data/qmi-service-*.json.
+const (
+	qmiServiceCTL = 0x00
+	qmiServiceWDS = 0x01 // wireless data service
+	qmiServiceNAS = 0x03 // network access service
+	qmiServiceWDA = 0x1a // wireless data administrative service
+
+	qmiCTLGetClientID     = 0x0022
+	qmiCTLReleaseClientID = 0x0023
+	qmiCTLSync            = 0x0027
+
+	qmiWDSStartNetwork = 0x0020
+
+	qmiNASGetSignalStrength = 0x0020
+	qmiNASGetServingSystem  = 0x0024
+
+	qmiWDASetDataFormat = 0x0020
+)
+
+// qmiErrorNoEffect is returned by WDS Start Network if the data connection is
+// already established.
+const qmiErrorNoEffect QMIError = 0x1a
+
+// QMIError is a QMI protocol error code returned by the modem.
+type QMIError uint16
+
+func (e QMIError) Error() string {
+	return fmt.Sprintf("QMI error %#x", uint16(e))
+}
+
+type qmiTLV struct {
+	typ   uint8
+	value []byte
+}
+
+// qmiMessage is a QMUX message, i.e. a QMI service message addressed to a
+// client.
+type qmiMessage struct {
+	service uint8
+	client  uint8
+	flags   uint8 // SDU control flags: request, response or indication
+	txn     uint16
+	msgID   uint16
+	tlvs    []qmiTLV
+}
+
+// response reports whether m is a response (as opposed to a request or an
+// indication).
+func (m *qmiMessage) response() bool {
+	if m.service == qmiServiceCTL {
+		return m.flags == 0x01
+	}
+	return m.flags == 0x02
+}
+
+func (m *qmiMessage) tlv(typ uint8) []byte {
+	for _, tlv := range m.tlvs {
+		if tlv.typ == typ {
+			return tlv.value
+		}
+	}
+	return nil
+}
+
+// err returns the error contained in the result TLV of a response.
+func (m *qmiMessage) err() error {
+	result := m.tlv(0x02)
+	if len(result) < 4 {
+		return fmt.Errorf("QMI message %#04x: missing result", m.msgID)
+	}
+	if binary.LittleEndian.Uint16(result) == 0 {
+		return nil
+	}
+	return QMIError(binary.LittleEndian.Uint16(result[2:]))
+}
+
+func (m *qmiMessage) marshal() []byte {
+	var payload bytes.Buffer
+	for _, tlv := range m.tlvs {
+		payload.WriteByte(tlv.typ)
+		binary.Write(&payload, binary.LittleEndian, uint16(len(tlv.value)))
+		payload.Write(tlv.value)
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0x01, 0, 0}) // QMUX marker, length (filled in below)
+	if m.flags == 0 {
+		b.WriteByte(0x00) // sent by the control point
+	} else {
+		b.WriteByte(0x80) // sent by the service
+	}
+	b.WriteByte(m.service)
+	b.WriteByte(m.client)
+	b.WriteByte(m.flags)
+	if m.service == qmiServiceCTL {
+		b.WriteByte(uint8(m.txn))
+	} else {
+		binary.Write(&b, binary.LittleEndian, m.txn)
+	}
+	binary.Write(&b, binary.LittleEndian, m.msgID)
+	binary.Write(&b, binary.LittleEndian, uint16(payload.Len()))
+	b.Write(payload.Bytes())
+	msg := b.Bytes()
+	binary.LittleEndian.PutUint16(msg[1:], uint16(len(msg)-1))
+	return msg
+}
+
+// parseQMIMessage parses a QMUX message without its marker and length, i.e.
+// starting at the QMUX control flags.
+func parseQMIMessage(b []byte) (*qmiMessage, error) {
+	if len(b) < 3 {
+		return nil, fmt.Errorf("QMUX message too short: %d bytes", len(b))
+	}
+	m := &qmiMessage{
+		service: b[1],
+		client:  b[2],
+	}
+	sdu := b[3:]
+	hdrLen := 7
+	if m.service == qmiServiceCTL {
+		hdrLen = 6
+	}
+	if len(sdu) < hdrLen {
+		return nil, fmt.Errorf("QMI message too short: %d bytes", len(sdu))
+	}
+	m.flags = sdu[0]
+	if m.service == qmiServiceCTL {
+		m.txn = uint16(sdu[1])
+		sdu = sdu[2:]
+	} else {
+		m.txn = binary.LittleEndian.Uint16(sdu[1:])
+		sdu = sdu[3:]
+	}
+	m.msgID = binary.LittleEndian.Uint16(sdu)
+	payload := sdu[4:]
+	if n := int(binary.LittleEndian.Uint16(sdu[2:])); n <= len(payload) {
+		payload = payload[:n]
+	} else {
+		return nil, fmt.Errorf("QMI message %#04x truncated: %d of %d bytes", m.msgID, len(payload), n)
+	}
+	for len(payload) > 0 {
+		if len(payload) < 3 {
+			return nil, fmt.Errorf("QMI message %#04x: truncated TLV", m.msgID)
+		}
+		n := int(binary.LittleEndian.Uint16(payload[1:]))
+		if len(payload) < 3+n {
+			return nil, fmt.Errorf("QMI message %#04x: truncated TLV %#x", m.msgID, payload[0])
+		}
+		m.tlvs = append(m.tlvs, qmiTLV{typ: payload[0], value: payload[3 : 3+n]})
+		payload = payload[3+n:]
+	}
+	return m, nil
+}
+
+// QMI controls a modem via QMI, i.e. the QMUX protocol spoken on the control
+// device of qmi_wwan (e.g. /dev/cdc-wdm0).
+type QMI struct {
+	// Timeout bounds how long the modem may take to respond to a request.
+	Timeout time.Duration
+
+	rw      io.ReadWriter
+	r       *bufio.Reader
+	ctlTxn  uint8
+	txn     uint16
+	clients map[uint8]uint8 // service to client ID
+}
+
+// NewQMI returns a QMI which talks to the control device rw.
+func NewQMI(rw io.ReadWriter) *QMI {
+	return &QMI{
+		Timeout: DefaultTimeout,
+		rw:      rw,
+		r:       bufio.NewReader(rw),
+		clients: make(map[uint8]uint8),
+	}
+}
+
+func (q *QMI) read() (*qmiMessage, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(q.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0x01 {
+		return nil, fmt.Errorf("unexpected QMUX marker %#x", hdr[0])
+	}
+	n := int(binary.LittleEndian.Uint16(hdr[1:]))
+	if n < 2 {
+		return nil, fmt.Errorf("invalid QMUX length %d", n)
+	}
+	b := make([]byte, n-2)
+	if _, err := io.ReadFull(q.r, b); err != nil {
+		return nil, err
+	}
+	return parseQMIMessage(b)
+}
+
+// request sends message msgID to service and returns the response, skipping
+// indications and responses to other clients.
+func (q *QMI) request(service uint8, msgID uint16, tlvs ...qmiTLV) (*qmiMessage, error) {
+	req := &qmiMessage{
+		service: service,
+		client:  q.clients[service], // 0 for CTL
+		msgID:   msgID,
+		tlvs:    tlvs,
+	}
+	if service == qmiServiceCTL {
+		q.ctlTxn++
+		if q.ctlTxn == 0 {
+			q.ctlTxn++
+		}
+		req.txn = uint16(q.ctlTxn)
+	} else {
+		q.txn++
+		if q.txn == 0 {
+			q.txn++
+		}
+		req.txn = q.txn
+	}
+	if err := setReadDeadline(q.rw, q.Timeout); err != nil {
+		return nil, err
+	}
+	if _, err := q.rw.Write(req.marshal()); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := q.read()
+		if err != nil {
+			return nil, fmt.Errorf("QMI service %#x message %#04x: %v", service, msgID, err)
+		}
+		if !resp.response() ||
+			resp.service != req.service ||
+			resp.client != req.client ||
+			resp.txn != req.txn ||
+			resp.msgID != req.msgID {
+			continue
+		}
+		return resp, resp.err()
+	}
+}
+
+// Init allocates clients for the services used by Connect and Status and
+// selects 802.3 framing for the data path.
+func (q *QMI) Init(cfg Config) error {
+	// Release client IDs which a previous (crashed) session might have
+	// leaked: modems only offer a few of them.
+	if _, err := q.request(qmiServiceCTL, qmiCTLSync); err != nil {
+		return err
+	}
+	for _, service := range []uint8{qmiServiceWDS, qmiServiceNAS, qmiServiceWDA} {
+		resp, err := q.request(qmiServiceCTL, qmiCTLGetClientID, qmiTLV{0x01, []byte{service}})
+		if err != nil {
+			return fmt.Errorf("allocating client for QMI service %#x: %v", service, err)
+		}
+		id := resp.tlv(0x01)
+		if len(id) != 2 || id[0] != service {
+			return fmt.Errorf("allocating client for QMI service %#x: unexpected response %x", service, id)
+		}
+		q.clients[service] = id[1]
+	}
+	// Raw-IP is not supported (see package comment).
+	const linkLayer8023 = 1
+	var format [4]byte
+	binary.LittleEndian.PutUint32(format[:], linkLayer8023)
+	if _, err := q.request(qmiServiceWDA, qmiWDASetDataFormat, qmiTLV{0x11, format[:]}); err != nil {
+		return fmt.Errorf("setting data format: %v", err)
+	}
+	return nil
+}
+
+// Release releases the clients allocated by Init, which also tears down the
+// data connection.
+func (q *QMI) Release() error {
+	var firstErr error
+	for service, id := range q.clients {
+		if _, err := q.request(qmiServiceCTL, qmiCTLReleaseClientID, qmiTLV{0x01, []byte{service, id}}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(q.clients, service)
+	}
+	return firstErr
+}
+
+// Connect establishes the data connection to cfg.APN.
+func (q *QMI) Connect(cfg Config) error {
+	family := byte(4)
+	if cfg.PDPType == "IPV6" {
+		family = 6
+	}
+	tlvs := []qmiTLV{{0x19, []byte{family}}}
+	if cfg.APN != "" {
+		tlvs = append(tlvs, qmiTLV{0x14, []byte(cfg.APN)})
+	}
+	_, err := q.request(qmiServiceWDS, qmiWDSStartNetwork, tlvs...)
+	if err == qmiErrorNoEffect {
+		return nil // already connected
+	}
+	return err
+}
+
+// Status queries signal strength, network registration and operator.
+func (q *QMI) Status() (Status, error) {
+	st := Status{LastUpdated: time.Now()}
+	resp, err := q.request(qmiServiceNAS, qmiNASGetSignalStrength)
+	if _, ok := err.(QMIError); ok {
+		// The signal strength is unavailable without service, which
+		// must not fail the session.
+	} else if err != nil {
+		return st, err
+	} else if v := resp.tlv(0x01); len(v) >= 1 {
+		st.SignalDBm = int(int8(v[0]))
+	}
+	resp, err = q.request(qmiServiceNAS, qmiNASGetServingSystem)
+	if err != nil {
+		return st, err
+	}
+	if v := resp.tlv(0x01); len(v) >= 1 {
+		st.Registered = v[0] == 1
+	}
+	if v := resp.tlv(0x12); len(v) >= 5 { // current PLMN
+		mcc := binary.LittleEndian.Uint16(v)
+		mnc := binary.LittleEndian.Uint16(v[2:])
+		if n := int(v[4]); n > 0 && len(v) >= 5+n {
+			st.Operator = string(v[5 : 5+n])
+		} else {
+			st.Operator = fmt.Sprintf("%03d%02d", mcc, mnc)
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wwan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// fakeQMI answers every request with a successful response, preceded by an
+// indication which must be skipped.
+type fakeQMI struct {
+	bytes.Buffer // responses
+	requests     []*qmiMessage
+	respond      func(req *qmiMessage) []qmiTLV
+}
+
+func (f *fakeQMI) Write(p []byte) (int, error) {
+	req, err := parseQMIMessage(p[3:])
+	if err != nil {
+		return 0, err
+	}
+	f.requests = append(f.requests, req)
+	resp := *req
+	resp.flags = 0x02
+	if req.service == qmiServiceCTL {
+		resp.flags = 0x01
+	}
+	ind := resp
+	ind.flags <<= 1
+	f.Buffer.Write(ind.marshal())
+	resp.tlvs = append([]qmiTLV{{0x02, []byte{0, 0, 0, 0}}}, f.respond(req)...)
+	f.Buffer.Write(resp.marshal())
+	return len(p), nil
+}
+
+func TestQMI(t *testing.T) {
+	f := fakeQMI{
+		respond: func(req *qmiMessage) []qmiTLV {
+			switch {
+			case req.service == qmiServiceCTL && req.msgID == qmiCTLGetClientID:
+				service := req.tlv(0x01)[0]
+				return []qmiTLV{{0x01, []byte{service, service + 1}}}
+			case req.service == qmiServiceWDS && req.msgID == qmiWDSStartNetwork:
+				return []qmiTLV{{0x01, []byte{1, 2, 3, 4}}}
+			case req.service == qmiServiceNAS && req.msgID == qmiNASGetSignalStrength:
+				return []qmiTLV{{0x01, []byte{0xb5 /* -75 */, 0x08}}}
+			case req.service == qmiServiceNAS && req.msgID == qmiNASGetServingSystem:
+				plmn := []byte{0, 0, 0, 0, 8}
+				binary.LittleEndian.PutUint16(plmn, 228)
+				binary.LittleEndian.PutUint16(plmn[2:], 1)
+				return []qmiTLV{
+					{0x01, []byte{1, 1, 1, 2, 1, 8}},
+					{0x12, append(plmn, "Swisscom"...)},
+				}
+			}
+			return nil
+		},
+	}
+	q := NewQMI(&f)
+	cfg := Config{APN: "gprs.swisscom.ch", PDPType: "IP"}
+	if err := q.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Connect(cfg); err != nil {
+		t.Fatal(err)
+	}
+	st, err := q.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.SignalDBm, -75; got != want {
+		t.Errorf("unexpected signal: got %d, want %d", got, want)
+	}
+	if !st.Registered {
+		t.Errorf("unexpectedly not registered")
+	}
+	if got, want := st.Operator, "Swisscom"; got != want {
+		t.Errorf("unexpected operator: got %q, want %q", got, want)
+	}
+
+	var start *qmiMessage
+	for _, req := range f.requests {
+		if req.service == qmiServiceWDS && req.msgID == qmiWDSStartNetwork {
+			start = req
+		}
+	}
+	if start == nil {
+		t.Fatalf("WDS Start Network not sent")
+	}
+	if got, want := start.client, uint8(qmiServiceWDS+1); got != want {
+		t.Errorf("unexpected WDS client ID: got %d, want %d", got, want)
+	}
+	if got, want := string(start.tlv(0x14)), cfg.APN; got != want {
+		t.Errorf("unexpected APN: got %q, want %q", got, want)
+	}
+
+	f.requests = nil
+	if err := q.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(f.requests), 3; got != want {
+		t.Errorf("unexpected number of released clients: got %d, want %d", got, want)
+	}
+}
+
+func TestQMIError(t *testing.T) {
+	var f bytes.Buffer
+	resp := qmiMessage{
+		service: qmiServiceCTL,
+		flags:   0x01,
+		txn:     1,
+		msgID:   qmiCTLSync,
+		tlvs:    []qmiTLV{{0x02, []byte{1, 0, 0x1a, 0}}},
+	}
+	f.Write(resp.marshal())
+	if _, err := NewQMI(&f).request(qmiServiceCTL, qmiCTLSync); err != qmiErrorNoEffect {
+		t.Fatalf("request: got %v, want %v", err, qmiErrorNoEffect)
+	}
+}
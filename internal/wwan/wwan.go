@@ -0,0 +1,262 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wwan controls USB LTE/5G modems, either via their AT command port or
+// via QMI (the control protocol of qmi_wwan devices, e.g. /dev/cdc-wdm0). The
+// MBIM control protocol is not supported.
+//
+// The data path is expected to be an ethernet-like network interface (e.g.
+// qmi_wwan in 802.3 mode, cdc_mbim, cdc_ether or rndis_host) on which the
+// modem runs a DHCPv4 server. Raw-IP mode is not supported.
+package wwan
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is read from /perm/wwan.json.
+type Config struct {
+	Interface     string `json:"interface"`      // e.g. wwan0
+	Protocol      string `json:"protocol"`       // at (default) or qmi
+	ControlDevice string `json:"control_device"` // e.g. /dev/ttyUSB2 or /dev/cdc-wdm0
+	APN           string `json:"apn"`            // e.g. internet
+	PDPType       string `json:"pdp_type"`       // IP (default), IPV6 or IPV4V6
+
+	// Connect are the modem-specific AT commands which establish the data
+	// connection, e.g. AT^NDISDUP=1,1 (Huawei) or AT+CGACT=1,1. Unused with
+	// QMI, which starts the data connection itself.
+	Connect []string `json:"connect"`
+}
+
+// ReadConfig reads wwan.json from dir.
+func ReadConfig(dir string) (Config, error) {
+	var cfg Config
+	b, err := ioutil.ReadFile(filepath.Join(dir, "wwan.json"))
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Interface == "" {
+		cfg.Interface = "wwan0"
+	}
+	if cfg.PDPType == "" {
+		cfg.PDPType = "IP"
+	}
+	switch cfg.Protocol {
+	case "":
+		cfg.Protocol = "at"
+	case "at", "qmi":
+	default:
+		return cfg, fmt.Errorf("unknown protocol %q, expected at or qmi", cfg.Protocol)
+	}
+	return cfg, nil
+}
+
+// Controller is implemented by Modem (AT commands) and QMI.
+type Controller interface {
+	// Init prepares the modem for Connect.
+	Init(cfg Config) error
+
+	// Connect establishes the data connection.
+	Connect(cfg Config) error
+
+	// Status queries signal strength, network registration and operator.
+	Status() (Status, error)
+}
+
+// DefaultTimeout is how long a modem may take to respond to a command before
+// it is considered unresponsive.
+const DefaultTimeout = 30 * time.Second
+
+// setReadDeadline bounds the next reads from rw to timeout if rw supports
+// deadlines (e.g. *os.File), so that a wedged modem results in an error
+// instead of blocking forever.
+func setReadDeadline(rw io.ReadWriter, timeout time.Duration) error {
+	d, ok := rw.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return nil
+	}
+	return d.SetReadDeadline(time.Now().Add(timeout))
+}
+
+// Status describes the radio state of the modem.
+type Status struct {
+	SignalDBm   int       `json:"signal_dbm"` // 0 if unknown
+	Operator    string    `json:"operator"`
+	Registered  bool      `json:"registered"`
+	LastUpdated time.Time `json:"last_updated"`
+}
+
+// Modem sends AT commands over the modem’s control device.
+type Modem struct {
+	// Timeout bounds how long the modem may take to respond to a command.
+	Timeout time.Duration
+
+	rw io.ReadWriter
+	r  *bufio.Reader
+}
+
+// NewModem returns a Modem which talks to the control device rw, which must
+// already be configured for raw (non-canonical) I/O.
+func NewModem(rw io.ReadWriter) *Modem {
+	return &Modem{
+		Timeout: DefaultTimeout,
+		rw:      rw,
+		r:       bufio.NewReader(rw),
+	}
+}
+
+// Command sends the AT command cmd and returns the response lines (excluding
+// the echo of cmd and the final result code).
+func (m *Modem) Command(cmd string) ([]string, error) {
+	if err := setReadDeadline(m.rw, m.Timeout); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(m.rw, "%s\r", cmd); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := m.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cmd, err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", line == cmd:
+			continue // blank line or command echo
+		case line == "OK":
+			return lines, nil
+		case line == "ERROR",
+			strings.HasPrefix(line, "+CME ERROR"),
+			strings.HasPrefix(line, "+CMS ERROR"),
+			line == "NO CARRIER":
+			return lines, fmt.Errorf("%s: %s", cmd, line)
+		}
+		lines = append(lines, line)
+	}
+}
+
+// Init disables command echo and configures the APN.
+func (m *Modem) Init(cfg Config) error {
+	if _, err := m.Command("ATE0"); err != nil {
+		return err
+	}
+	if cfg.APN != "" {
+		cmd := fmt.Sprintf(`AT+CGDCONT=1,"%s","%s"`, cfg.PDPType, cfg.APN)
+		if _, err := m.Command(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect establishes the data connection.
+func (m *Modem) Connect(cfg Config) error {
+	for _, cmd := range cfg.Connect {
+		if _, err := m.Command(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status queries signal strength, network registration and operator.
+func (m *Modem) Status() (Status, error) {
+	st := Status{LastUpdated: time.Now()}
+	lines, err := m.Command("AT+CSQ")
+	if err != nil {
+		return st, err
+	}
+	for _, line := range lines {
+		if dbm, ok := ParseCSQ(line); ok {
+			st.SignalDBm = dbm
+		}
+	}
+	lines, err = m.Command("AT+CREG?")
+	if err != nil {
+		return st, err
+	}
+	for _, line := range lines {
+		if registered, ok := ParseCREG(line); ok {
+			st.Registered = registered
+		}
+	}
+	lines, err = m.Command("AT+COPS?")
+	if err != nil {
+		return st, err
+	}
+	for _, line := range lines {
+		if op, ok := ParseCOPS(line); ok {
+			st.Operator = op
+		}
+	}
+	return st, nil
+}
+
+// ParseCSQ parses a +CSQ response (e.g. “+CSQ: 17,99”) and returns the
+// received signal strength in dBm. ok is false if the signal strength is
+// unknown.
+func ParseCSQ(line string) (dbm int, ok bool) {
+	if !strings.HasPrefix(line, "+CSQ:") {
+		return 0, false
+	}
+	fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+CSQ:")), ",")
+	rssi, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || rssi < 0 || rssi > 31 {
+		return 0, false // 99 means not known or not detectable
+	}
+	// See 3GPP TS 27.007, 8.5: 0 is -113 dBm or less, 31 is -51 dBm or greater.
+	return -113 + 2*rssi, true
+}
+
+// ParseCREG parses a +CREG response (e.g. “+CREG: 0,1”) and reports whether
+// the modem is registered to its home network or roaming.
+func ParseCREG(line string) (registered bool, ok bool) {
+	if !strings.HasPrefix(line, "+CREG:") {
+		return false, false
+	}
+	fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+CREG:")), ",")
+	if len(fields) < 2 {
+		return false, false
+	}
+	stat, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return false, false
+	}
+	return stat == 1 || stat == 5, true
+}
+
+// ParseCOPS parses a +COPS response (e.g. “+COPS: 0,0,"Swisscom",7”) and
+// returns the operator name.
+func ParseCOPS(line string) (operator string, ok bool) {
+	if !strings.HasPrefix(line, "+COPS:") {
+		return "", false
+	}
+	fields := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+COPS:")), ",")
+	if len(fields) < 3 {
+		return "", true // not registered
+	}
+	return strings.Trim(fields[2], `"`), true
+}
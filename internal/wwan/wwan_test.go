@@ -0,0 +1,97 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wwan
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	if dbm, ok := ParseCSQ("+CSQ: 17,99"); !ok || dbm != -79 {
+		t.Errorf("ParseCSQ = %d, %v, want -79, true", dbm, ok)
+	}
+	if _, ok := ParseCSQ("+CSQ: 99,99"); ok {
+		t.Errorf("ParseCSQ(99) unexpectedly ok")
+	}
+	if registered, ok := ParseCREG("+CREG: 0,5"); !ok || !registered {
+		t.Errorf("ParseCREG = %v, %v, want true, true", registered, ok)
+	}
+	if op, ok := ParseCOPS(`+COPS: 0,0,"Swisscom",7`); !ok || op != "Swisscom" {
+		t.Errorf("ParseCOPS = %q, %v, want Swisscom, true", op, ok)
+	}
+}
+
+type fakeModem struct {
+	bytes.Buffer // responses
+	written      strings.Builder
+}
+
+func (f *fakeModem) Write(p []byte) (int, error) { return f.written.Write(p) }
+
+func TestStatus(t *testing.T) {
+	var f fakeModem
+	f.WriteString("AT+CSQ\r\n+CSQ: 20,99\r\n\r\nOK\r\n")
+	f.WriteString("+CREG: 0,1\r\nOK\r\n")
+	f.WriteString("+COPS: 0,0,\"Salt\",7\r\nOK\r\n")
+	st, err := NewModem(&f).Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := st.SignalDBm, -73; got != want {
+		t.Errorf("unexpected signal: got %d, want %d", got, want)
+	}
+	if !st.Registered {
+		t.Errorf("unexpectedly not registered")
+	}
+	if got, want := st.Operator, "Salt"; got != want {
+		t.Errorf("unexpected operator: got %q, want %q", got, want)
+	}
+	if got, want := f.written.String(), "AT+CSQ\rAT+CREG?\rAT+COPS?\r"; got != want {
+		t.Errorf("unexpected commands: got %q, want %q", got, want)
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	var f fakeModem
+	f.WriteString("+CME ERROR: 10\r\n")
+	if _, err := NewModem(&f).Command("AT+COPS?"); err == nil {
+		t.Fatalf("Command unexpectedly succeeded")
+	}
+}
+
+// unresponsiveModem discards commands and never responds.
+type unresponsiveModem struct {
+	*os.File
+}
+
+func (unresponsiveModem) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestCommandTimeout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	m := NewModem(unresponsiveModem{r})
+	m.Timeout = 10 * time.Millisecond
+	if _, err := m.Command("AT+CSQ"); err == nil {
+		t.Fatalf("Command unexpectedly succeeded")
+	}
+}